@@ -0,0 +1,239 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package awsssm is a minimal client for the AWS Systems Manager
+// (SSM) Parameter Store, just sufficient to get and put a single
+// parameter without pulling in the AWS SDK.
+package awsssm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrParameterNotFound is returned by Client.GetParameter when the
+// parameter doesn't exist.
+var ErrParameterNotFound = errors.New("awsssm: parameter not found")
+
+// Credentials are AWS credentials.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional
+}
+
+// CredentialsFromEnv returns the credentials in the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+func CredentialsFromEnv() (Credentials, error) {
+	c := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, errors.New("awsssm: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// ARN is a parsed SSM parameter ARN, of the form
+// "arn:aws:ssm:<region>:<account>:parameter/<name>".
+type ARN struct {
+	Partition string // usually "aws"
+	Region    string
+	Account   string
+	Name      string // parameter name, as used in API calls
+}
+
+// ParseARN parses an SSM parameter ARN.
+func ParseARN(s string) (ARN, error) {
+	f := strings.SplitN(s, ":", 6)
+	if len(f) != 6 || f[0] != "arn" || f[2] != "ssm" || f[3] == "" {
+		return ARN{}, fmt.Errorf("awsssm: invalid SSM parameter ARN %q", s)
+	}
+	name := strings.TrimPrefix(f[5], "parameter")
+	if name == f[5] || len(name) < 2 || name[0] != '/' {
+		return ARN{}, fmt.Errorf("awsssm: ARN %q is not an SSM parameter", s)
+	}
+	// Hierarchical parameter names begin with a slash;
+	// top-level ones don't.
+	if !strings.Contains(name[1:], "/") {
+		name = name[1:]
+	}
+	return ARN{Partition: f[1], Region: f[3], Account: f[4], Name: name}, nil
+}
+
+// Client is an SSM Parameter Store client for a single region.
+type Client struct {
+	Region string
+	Creds  Credentials
+
+	// Endpoint optionally overrides the SSM endpoint URL.
+	// If empty, the region's public endpoint is used.
+	Endpoint string
+	// HTTPClient is the HTTP client to use; nil means
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	now func() time.Time // or nil for time.Now
+}
+
+func (c *Client) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return "https://ssm." + c.Region + ".amazonaws.com/"
+}
+
+// GetParameter returns the decrypted value of the named parameter.
+func (c *Client) GetParameter(ctx context.Context, name string) (string, error) {
+	var res struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	err := c.call(ctx, "GetParameter", map[string]interface{}{
+		"Name":           name,
+		"WithDecryption": true,
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.Parameter.Value, nil
+}
+
+// PutParameter sets the named parameter to value, as a SecureString,
+// creating it if needed.
+func (c *Client) PutParameter(ctx context.Context, name, value string) error {
+	return c.call(ctx, "PutParameter", map[string]interface{}{
+		"Name":      name,
+		"Value":     value,
+		"Type":      "SecureString",
+		"Overwrite": true,
+	}, nil)
+}
+
+func (c *Client) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonSSM."+action)
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	sign(req, body, "ssm", c.Region, c.Creds, now())
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(slurp, &e)
+		if strings.HasSuffix(e.Type, "ParameterNotFound") {
+			return ErrParameterNotFound
+		}
+		return fmt.Errorf("awsssm: %s: %s: %s %s", action, res.Status, e.Type, e.Message)
+	}
+	if out != nil {
+		return json.Unmarshal(slurp, out)
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose body is
+// body.
+func sign(req *http.Request, body []byte, service, region string, creds Credentials, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vv := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vv, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonReq))
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, sig))
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package awsssm
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// The "get-vanilla" case from the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	sign(req, nil, "service", "us-east-1", creds, now)
+
+	const want = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization:\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestParseARN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ARN
+		wantErr bool
+	}{
+		{
+			in:   "arn:aws:ssm:us-east-1:123456789012:parameter/tailscale-state",
+			want: ARN{Partition: "aws", Region: "us-east-1", Account: "123456789012", Name: "tailscale-state"},
+		},
+		{
+			in:   "arn:aws:ssm:eu-west-2:123456789012:parameter/tailscale/node1",
+			want: ARN{Partition: "aws", Region: "eu-west-2", Account: "123456789012", Name: "/tailscale/node1"},
+		},
+		{in: "arn:aws:s3:::bucket", wantErr: true},
+		{in: "arn:aws:ssm:us-east-1:123456789012:document/foo", wantErr: true},
+		{in: "not-an-arn", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseARN(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseARN(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseARN(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Resolver returns a net.Resolver that sends all DNS queries to
+// tailscaled over the LocalAPI (see QueryDNS), rather than to the
+// nameservers in the OS configuration. Programs can use it to resolve
+// MagicDNS names even when tailscaled isn't the OS resolver, such as
+// with userspace networking.
+//
+// The returned Resolver uses Go's built-in resolver, so /etc/hosts and
+// the search domains of /etc/resolv.conf still apply; the nameservers
+// listed there are ignored.
+func Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dnsConn{ctx: ctx}, nil
+		},
+	}
+}
+
+// dnsConn is a net.Conn that speaks DNS over TCP (queries and responses
+// prefixed by their 2-byte length) to Go's resolver, sending each
+// query to the LocalAPI. It isn't a net.PacketConn, so the resolver
+// uses TCP framing and never truncates responses.
+type dnsConn struct {
+	ctx      context.Context
+	deadline time.Time
+	closed   bool
+
+	wbuf bytes.Buffer // partial query written by the resolver
+	rbuf bytes.Buffer // framed responses not yet read by the resolver
+}
+
+var errDNSConnClosed = errors.New("tailscale DNS conn closed")
+
+func (c *dnsConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, errDNSConnClosed
+	}
+	c.wbuf.Write(p)
+	for c.wbuf.Len() >= 2 {
+		b := c.wbuf.Bytes()
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			break
+		}
+		query := append([]byte(nil), b[2:2+n]...)
+		c.wbuf.Next(2 + n)
+		if err := c.roundTrip(query); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// roundTrip sends query to tailscaled and queues its framed response
+// to be read.
+func (c *dnsConn) roundTrip(query []byte) error {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	resp, err := QueryDNS(ctx, query)
+	if err != nil {
+		return err
+	}
+	if len(resp) > 0xffff {
+		return errors.New("DNS response too large")
+	}
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(resp)))
+	c.rbuf.Write(hdr[:])
+	c.rbuf.Write(resp)
+	return nil
+}
+
+func (c *dnsConn) Read(p []byte) (int, error) {
+	if c.closed {
+		return 0, errDNSConnClosed
+	}
+	if c.rbuf.Len() == 0 {
+		// Every query is answered in Write, so there's nothing more
+		// to wait for.
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(p)
+}
+
+func (c *dnsConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return dnsConnAddr{} }
+func (c *dnsConn) RemoteAddr() net.Addr { return dnsConnAddr{} }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// dnsConnAddr is the net.Addr of both ends of a dnsConn.
+type dnsConnAddr struct{}
+
+func (dnsConnAddr) Network() string { return "tailscaled" }
+func (dnsConnAddr) String() string  { return "local-tailscaled.sock" }
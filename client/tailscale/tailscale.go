@@ -6,17 +6,31 @@
 package tailscale
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/nsjoin"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/sched"
+	"tailscale.com/wgengine/filter"
 )
 
 // tsClient does HTTP requests to the local Tailscale daemon.
@@ -26,16 +40,26 @@ var tsClient = &http.Client{
 			if addr != "local-tailscaled.sock:80" {
 				return nil, fmt.Errorf("unexpected URL address %q", addr)
 			}
-			// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
-			// a TCP server on a random port, find the random port. For HTTP connections,
-			// we don't send the token. It gets added in an HTTP Basic-Auth header.
-			if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
-				var d net.Dialer
-				return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
-			}
-			return safesocket.ConnectDefault()
+			return dialLocal(ctx)
 		},
 	},
+	// Redirects from the LocalAPI, such as the web UI's, are for
+	// the caller's client to follow, not for the daemon.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// dialLocal connects to the local Tailscale daemon.
+func dialLocal(ctx context.Context) (net.Conn, error) {
+	// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
+	// a TCP server on a random port, find the random port. For HTTP connections,
+	// we don't send the token. It gets added in an HTTP Basic-Auth header.
+	if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
+	}
+	return safesocket.ConnectDefault()
 }
 
 // DoLocalRequest makes an HTTP request to the local machine's Tailscale daemon.
@@ -98,3 +122,747 @@ func Goroutines(ctx context.Context) ([]byte, error) {
 	}
 	return body, nil
 }
+
+// DialTCP connects to port on host through the tailnet, via
+// tailscaled, which lets programs reach peers from machines in
+// userspace networking mode, without a TUN device. host is a peer's
+// MagicDNS name or an IP address.
+//
+// The returned conn supports CloseWrite, to send EOF to the peer while
+// still reading its response, if the connection to tailscaled does.
+func DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{
+		"Upgrade":    []string{"ts-dial"},
+		"Connection": []string{"upgrade"},
+		"Dial-Host":  []string{host},
+		"Dial-Port":  []string{strconv.Itoa(int(port))},
+	}
+	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+		req.SetBasicAuth("", token)
+	}
+
+	// Do the request by hand rather than with tsClient, whose
+	// Transport hides the connection's CloseWrite behind the 101
+	// response's body.
+	c, err := dialLocal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(res.Body)
+		c.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	c.SetDeadline(time.Time{})
+	return &dialConn{Conn: c, br: br}, nil
+}
+
+// dialConn is a connection upgraded by the LocalAPI's /dial endpoint.
+type dialConn struct {
+	net.Conn
+	br *bufio.Reader // reads from Conn, and may have buffered the start of the stream
+}
+
+func (c *dialConn) Read(p []byte) (int, error) { return c.br.Read(p) }
+
+// CloseWrite shuts down the writing side of the connection, if the
+// connection to tailscaled supports that.
+func (c *dialConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support CloseWrite")
+}
+
+// Pprof returns tailscaled's pprof profile called name, such as
+// "heap" or "goroutine", or for "profile", a CPU profile taken over the
+// given number of seconds.
+func Pprof(ctx context.Context, name string, seconds int) ([]byte, error) {
+	return send(ctx, "GET", fmt.Sprintf("/localapi/v0/pprof?name=%s&seconds=%d", url.QueryEscape(name), seconds), nil)
+}
+
+// DebugMagicsock returns magicsock's path discovery state.
+func DebugMagicsock(ctx context.Context) (*ipnstate.MagicsockDebug, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/debug-magicsock", nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.MagicsockDebug)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// LinkEvents returns the network changes tailscaled recently noticed,
+// oldest first.
+func LinkEvents(ctx context.Context) ([]ipnstate.LinkEvent, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/debug-link-events", nil)
+	if err != nil {
+		return nil, err
+	}
+	var evs []ipnstate.LinkEvent
+	if err := json.Unmarshal(body, &evs); err != nil {
+		return nil, err
+	}
+	return evs, nil
+}
+
+// StreamDebugCapture returns a pcap stream of the packets going through
+// tailscaled's TUN device that match the tcpdump-style filter
+// expression (empty for all packets). The stream runs until ctx is
+// done or the returned ReadCloser is closed.
+func StreamDebugCapture(ctx context.Context, filter string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/debug-capture?filter="+url.QueryEscape(filter), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
+
+// send makes an HTTP request of the given method to the LocalAPI path
+// (such as "/localapi/v0/status") and returns the response body. It
+// returns an error if the response status isn't 200 OK.
+func send(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, slurp)
+	}
+	return slurp, nil
+}
+
+// Status returns the daemon's current status.
+func Status(ctx context.Context) (*ipnstate.Status, error) {
+	return StatusWithFilter(ctx, ipnstate.StatusFilter{})
+}
+
+// StatusWithFilter returns the daemon's current status, with only
+// the peers selected by f.
+func StatusWithFilter(ctx context.Context, f ipnstate.StatusFilter) (*ipnstate.Status, error) {
+	path := "/localapi/v0/status"
+	if !f.IsZero() {
+		path += "?" + f.Values().Encode()
+	}
+	body, err := send(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.Status)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// PeerStats returns the connection statistics of each peer.
+func PeerStats(ctx context.Context) ([]ipnstate.PeerConnStats, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/peer-stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	var stats []ipnstate.PeerConnStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// FilterStats returns the packet filter's per-rule accept counts and
+// its drop counts by reason.
+func FilterStats(ctx context.Context) (*filter.Stats, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/filter-stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(filter.Stats)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// DNSStatus returns the DNS configuration tailscaled has programmed.
+func DNSStatus(ctx context.Context) (*ipnstate.DNSStatus, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/dns-status", nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.DNSStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Tasks returns the status of tailscaled's periodic tasks.
+func Tasks(ctx context.Context) ([]sched.TaskStatus, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/tasks", nil)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []sched.TaskStatus
+	if err := json.Unmarshal(body, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// RunTask makes tailscaled run the periodic task with the given name
+// now, rather than at its next scheduled time.
+func RunTask(ctx context.Context, name string) error {
+	_, err := send(ctx, "POST", "/localapi/v0/tasks/run?name="+url.QueryEscape(name), nil)
+	return err
+}
+
+// DNSQueryLog returns tailscaled's log of recent MagicDNS queries.
+func DNSQueryLog(ctx context.Context) (*ipnstate.DNSQueryLog, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/dns-query-log", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDNSQueryLog(body)
+}
+
+// SetDNSQueryLog turns tailscaled's DNS query log on or off, and sets
+// whether it records the answers to queries. Turning it off discards
+// the queries logged so far.
+func SetDNSQueryLog(ctx context.Context, on, withAnswers bool) (*ipnstate.DNSQueryLog, error) {
+	path := fmt.Sprintf("/localapi/v0/dns-query-log?enable=%v&answers=%v", on, withAnswers)
+	body, err := send(ctx, "POST", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDNSQueryLog(body)
+}
+
+// QueryDNS sends the DNS query message to tailscaled, which answers
+// MagicDNS names itself and forwards other queries to its upstream
+// nameservers, and returns the response message. See also Resolver.
+func QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	return send(ctx, "POST", "/localapi/v0/dns-query", query)
+}
+
+func decodeDNSQueryLog(body []byte) (*ipnstate.DNSQueryLog, error) {
+	l := new(ipnstate.DNSQueryLog)
+	if err := json.Unmarshal(body, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetPrefs returns the daemon's current preferences, without private keys.
+func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/prefs", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefs(body)
+}
+
+// SetPrefs replaces the daemon's preferences with p and returns the
+// resulting preferences, without private keys.
+func SetPrefs(ctx context.Context, p *ipn.Prefs) (*ipn.Prefs, error) {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/prefs", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefs(body)
+}
+
+// EditPrefs changes only the daemon's preferences that mp marks as
+// set and returns the resulting preferences, without private keys.
+func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	j, err := json.Marshal(mp)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "PATCH", "/localapi/v0/prefs", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefs(body)
+}
+
+// StartLoginInteractive starts an interactive login. Once the
+// control server provides it, the URL to visit to log in is the
+// AuthURL in Status.
+func StartLoginInteractive(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/login-interactive", nil)
+	return err
+}
+
+func decodePrefs(body []byte) (*ipn.Prefs, error) {
+	p := new(ipn.Prefs)
+	if err := json.Unmarshal(body, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NetMap returns the daemon's current network map, without private keys.
+func NetMap(ctx context.Context) (*netmap.NetworkMap, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/netmap", nil)
+	if err != nil {
+		return nil, err
+	}
+	nm := new(netmap.NetworkMap)
+	if err := json.Unmarshal(body, nm); err != nil {
+		return nil, err
+	}
+	return nm, nil
+}
+
+// Profiles returns the daemon's login profiles.
+func Profiles(ctx context.Context) (*ipn.LoginProfiles, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/profiles", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProfiles(body)
+}
+
+// SwitchProfile switches the daemon to the named login profile,
+// creating it if it doesn't exist, and returns the resulting profiles.
+func SwitchProfile(ctx context.Context, name string) (*ipn.LoginProfiles, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/profiles/switch?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProfiles(body)
+}
+
+// DeleteProfile deletes the named login profile, which must not be
+// the current one, and returns the remaining profiles.
+func DeleteProfile(ctx context.Context, name string) (*ipn.LoginProfiles, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/profiles/delete?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProfiles(body)
+}
+
+// NetworkLocations returns the prefs the daemon applies on
+// particular networks, and the ID of the current network.
+func NetworkLocations(ctx context.Context) (*ipn.NetworkLocations, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/network-locations", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLocations(body)
+}
+
+// SaveNetworkLocation makes the daemon remember its current exit
+// node and shields up prefs for the network with the given ID, or
+// the current network if it's empty, and returns the resulting
+// network locations.
+func SaveNetworkLocation(ctx context.Context, network string) (*ipn.NetworkLocations, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/network-locations/save?network="+url.QueryEscape(network), nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLocations(body)
+}
+
+// DeleteNetworkLocation makes the daemon forget the prefs for the
+// network with the given ID, or the current network if it's empty,
+// and returns the remaining network locations.
+func DeleteNetworkLocation(ctx context.Context, network string) (*ipn.NetworkLocations, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/network-locations/delete?network="+url.QueryEscape(network), nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLocations(body)
+}
+
+func decodeNetworkLocations(body []byte) (*ipn.NetworkLocations, error) {
+	nl := new(ipn.NetworkLocations)
+	if err := json.Unmarshal(body, nl); err != nil {
+		return nil, err
+	}
+	return nl, nil
+}
+
+// NetworkChanges returns the network config accepted with the
+// ConfirmNetworkChanges pref and any pending change to it.
+func NetworkChanges(ctx context.Context) (*ipn.NetworkChanges, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/network-changes", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkChanges(body)
+}
+
+// AcceptNetworkChanges applies the pending network config change, which
+// must be want, and returns the resulting state.
+func AcceptNetworkChanges(ctx context.Context, want *ipn.NetworkConfig) (*ipn.NetworkChanges, error) {
+	j, err := json.Marshal(want)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/network-changes/accept", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkChanges(body)
+}
+
+func decodeNetworkChanges(body []byte) (*ipn.NetworkChanges, error) {
+	nc := new(ipn.NetworkChanges)
+	if err := json.Unmarshal(body, nc); err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
+// NetworkLockStatus returns the state of tailnet lock on this node.
+func NetworkLockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/tka/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLockStatus(body)
+}
+
+// NetworkLockInit enables tailnet lock on this node, trusting its new
+// signing key and the signing keys of other nodes in trusted.
+func NetworkLockInit(ctx context.Context, trusted []tka.PublicKey) (*ipnstate.NetworkLockStatus, error) {
+	j, err := json.Marshal(trusted)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/tka/init", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLockStatus(body)
+}
+
+// NetworkLockSign signs the node key nk with this node's signing key.
+func NetworkLockSign(ctx context.Context, nk tailcfg.NodeKey) error {
+	_, err := send(ctx, "POST", "/localapi/v0/tka/sign?nodekey="+url.QueryEscape(nk.String()), nil)
+	return err
+}
+
+// NetworkLockAdd trusts the signing keys in keys, in addition to those
+// already trusted.
+func NetworkLockAdd(ctx context.Context, keys []tka.PublicKey) (*ipnstate.NetworkLockStatus, error) {
+	return networkLockKeys(ctx, "add", keys)
+}
+
+// NetworkLockRemove stops trusting the signing keys in keys.
+func NetworkLockRemove(ctx context.Context, keys []tka.PublicKey) (*ipnstate.NetworkLockStatus, error) {
+	return networkLockKeys(ctx, "remove", keys)
+}
+
+func networkLockKeys(ctx context.Context, op string, keys []tka.PublicKey) (*ipnstate.NetworkLockStatus, error) {
+	j, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/tka/"+op, j)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLockStatus(body)
+}
+
+// NetworkLockDisable turns tailnet lock off on this node.
+func NetworkLockDisable(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/tka/disable", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNetworkLockStatus(body)
+}
+
+func decodeNetworkLockStatus(body []byte) (*ipnstate.NetworkLockStatus, error) {
+	st := new(ipnstate.NetworkLockStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func decodeProfiles(body []byte) (*ipn.LoginProfiles, error) {
+	lp := new(ipn.LoginProfiles)
+	if err := json.Unmarshal(body, lp); err != nil {
+		return nil, err
+	}
+	return lp, nil
+}
+
+// Serve returns the services that tailscaled serves on the node's
+// Tailscale IPs.
+func Serve(ctx context.Context) ([]ipn.ServeHandler, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/serve", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeServeHandlers(body)
+}
+
+// SetServe replaces the services that tailscaled serves on the node's
+// Tailscale IPs and returns the result.
+func SetServe(ctx context.Context, handlers []ipn.ServeHandler) ([]ipn.ServeHandler, error) {
+	if handlers == nil {
+		handlers = []ipn.ServeHandler{}
+	}
+	j, err := json.Marshal(handlers)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/serve", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodeServeHandlers(body)
+}
+
+func decodeServeHandlers(body []byte) ([]ipn.ServeHandler, error) {
+	var handlers []ipn.ServeHandler
+	if err := json.Unmarshal(body, &handlers); err != nil {
+		return nil, err
+	}
+	return handlers, nil
+}
+
+// VirtualServices returns tailscaled's load balanced virtual services.
+func VirtualServices(ctx context.Context) ([]ipn.VirtualService, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/virtual-services", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeVirtualServices(body)
+}
+
+// SetVirtualServices replaces tailscaled's virtual services and
+// returns the result.
+func SetVirtualServices(ctx context.Context, services []ipn.VirtualService) ([]ipn.VirtualService, error) {
+	if services == nil {
+		services = []ipn.VirtualService{}
+	}
+	j, err := json.Marshal(services)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/virtual-services", j)
+	if err != nil {
+		return nil, err
+	}
+	return decodeVirtualServices(body)
+}
+
+func decodeVirtualServices(body []byte) ([]ipn.VirtualService, error) {
+	var services []ipn.VirtualService
+	if err := json.Unmarshal(body, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// VirtualServiceStatus returns the state of tailscaled's virtual
+// services' backends.
+func VirtualServiceStatus(ctx context.Context) ([]ipnstate.VirtualServiceStatus, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/virtual-services/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	var st []ipnstate.VirtualServiceStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// CertPair returns a TLS certificate chain and private key, in PEM
+// form, for domain, which must be this node's DNS name.
+func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	res, err := send(ctx, "GET", "/localapi/v0/cert?type=pair&domain="+url.QueryEscape(domain), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rest := res; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, nil, errors.New("invalid certificate response")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// GetCertificate fetches a TLS certificate for the TLS ClientHello in
+// hi from tailscaled. It can be used as the GetCertificate func of a
+// tls.Config for local servers, for hi.ServerName being the node's
+// DNS name.
+//
+// It requires write access to the LocalAPI.
+func GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hi == nil || hi.ServerName == "" {
+		return nil, errors.New("no SNI ServerName")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	certPEM, keyPEM, err := CertPair(ctx, hi.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Containers returns the container network namespaces attached to
+// the tailnet through tailscaled.
+func Containers(ctx context.Context) ([]nsjoin.Attachment, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/containers", nil)
+	if err != nil {
+		return nil, err
+	}
+	var atts []nsjoin.Attachment
+	if err := json.Unmarshal(body, &atts); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
+
+// AttachContainer attaches the network namespace target, a process ID
+// or the name of a namespace in /var/run/netns, to the tailnet.
+func AttachContainer(ctx context.Context, target string) (*nsjoin.Attachment, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/containers/attach?target="+url.QueryEscape(target), nil)
+	if err != nil {
+		return nil, err
+	}
+	a := new(nsjoin.Attachment)
+	if err := json.Unmarshal(body, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// DetachContainer detaches the attached network namespace with the
+// given ID.
+func DetachContainer(ctx context.Context, id string) error {
+	_, err := send(ctx, "POST", "/localapi/v0/containers/detach?id="+url.QueryEscape(id), nil)
+	return err
+}
+
+// PeerGroups returns the user's peer groups.
+func PeerGroups(ctx context.Context) (ipn.PeerGroups, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodePeerGroups(body)
+}
+
+// SetPeerGroup sets the members of the named peer group, creating it
+// if needed, or deletes it if members is empty. It returns the
+// resulting peer groups.
+func SetPeerGroup(ctx context.Context, name string, members []string) (ipn.PeerGroups, error) {
+	if members == nil {
+		members = []string{}
+	}
+	j, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/groups?name="+url.QueryEscape(name), j)
+	if err != nil {
+		return nil, err
+	}
+	return decodePeerGroups(body)
+}
+
+func decodePeerGroups(body []byte) (ipn.PeerGroups, error) {
+	groups := ipn.PeerGroups{}
+	if err := json.Unmarshal(body, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// WatchIPNBus subscribes to the daemon's notifications, calling fn
+// for each until ctx is done or fn returns false. The first
+// notification describes the daemon's current state.
+func WatchIPNBus(ctx context.Context, fn func(ipn.Notify) (keepGoing bool)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch", nil)
+	if err != nil {
+		return err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var n ipn.Notify
+		if err := dec.Decode(&n); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if !fn(n) {
+			return nil
+		}
+	}
+}
@@ -49,6 +49,13 @@ var (
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
+	clientRate    = flag.Int("client-rate-limit", 0, "if non-zero, maximum bytes per second each client may send")
+	clientPktRate = flag.Int("client-packet-rate-limit", 0, "if non-zero, maximum packets per second each client may send")
+	maxClients    = flag.Int("max-clients", 0, "if non-zero, maximum number of connected clients")
+	maxClientsIP  = flag.Int("max-clients-per-ip", 0, "if non-zero, maximum number of connected clients per IP address")
+	verifyClients = flag.Bool("verify-clients", false, "only admit clients that are nodes in the tailnet of the tailscaled running on this machine")
+	regionName    = flag.String("region", "", "region name to show on the /latency page; defaults to --hostname")
+	metricsAddr   = flag.String("metrics-addr", "", "if non-empty, address on which to serve Prometheus metrics at /metrics without access checks, such as a private IP:port; they're always available at /debug/metrics")
 )
 
 type config struct {
@@ -138,6 +145,15 @@ func main() {
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
+	s.SetClientLimits(derp.ClientLimits{
+		BytesPerSecond:   *clientRate,
+		PacketsPerSecond: *clientPktRate,
+		MaxConns:         *maxClients,
+		MaxConnsPerIP:    *maxClientsIP,
+	})
+	if *verifyClients {
+		s.SetVerifyClient(newTailnetVerifier().verify)
+	}
 	if err := startMesh(s); err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
@@ -146,8 +162,12 @@ func main() {
 	// Create our own mux so we don't expose /debug/ stuff to the world.
 	mux := tsweb.NewMux(debugHandler(s))
 	mux.Handle("/derp", derphttp.Handler(s))
+	mux.Handle("/debug/metrics", tsweb.Protected(metricsHandler(s)))
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", handleBootstrapDNS)
+	mux.HandleFunc("/derp/probe", probeHandler)
+	mux.HandleFunc("/derp/latency-check", probeHandler)
+	mux.HandleFunc("/latency", latencyPageHandler)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(200)
@@ -159,6 +179,7 @@ func main() {
   <a href="https://pkg.go.dev/tailscale.com/derp">DERP</a>
   server.
 </p>
+<p>Measure your latency to it at <a href='/latency'>/latency</a>.</p>
 `)
 		if tsweb.AllowDebugAccess(r) {
 			io.WriteString(w, "<p>Debug info at <a href='/debug/'>/debug/</a>.</p>\n")
@@ -168,6 +189,9 @@ func main() {
 	if *runSTUN {
 		go serveSTUN()
 	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr, s)
+	}
 
 	httpsrv := &http.Server{
 		Addr:    *addr,
@@ -199,8 +223,13 @@ func main() {
 			cert.Certificate = append(cert.Certificate, s.MetaCert())
 			return cert, nil
 		}
+		// Probes are also answered over plain HTTP, for clients
+		// behind middleboxes that interfere with TLS.
+		port80 := http.NewServeMux()
+		port80.HandleFunc("/derp/probe", probeHandler)
+		port80.Handle("/", tsweb.Port80Handler{Main: mux})
 		go func() {
-			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+			err := http.ListenAndServe(":80", certManager.HTTPHandler(port80))
 			if err != nil {
 				if err != http.ErrServerClosed {
 					log.Fatal(err)
@@ -240,6 +269,7 @@ func debugHandler(s *derp.Server) http.Handler {
 
 		f(`<li><a href="/debug/vars">/debug/vars</a> (Go)</li>
    <li><a href="/debug/varz">/debug/varz</a> (Prometheus)</li>
+   <li><a href="/debug/metrics">/debug/metrics</a> (Prometheus, with per-client and mesh peer metrics)</li>
    <li><a href="/debug/pprof/">/debug/pprof/</a></li>
    <li><a href="/debug/pprof/goroutine?debug=1">/debug/pprof/goroutine</a> (collapsed)</li>
    <li><a href="/debug/pprof/goroutine?debug=2">/debug/pprof/goroutine</a> (full)</li>
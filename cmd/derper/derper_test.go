@@ -5,8 +5,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -33,3 +41,105 @@ func TestProdAutocertHostPolicy(t *testing.T) {
 	}
 
 }
+
+func TestWriteClientMetrics(t *testing.T) {
+	var k key.Public
+	k[0] = 1
+	var buf bytes.Buffer
+	writeClientMetrics(&buf, []derp.ClientStats{{
+		Key:            k,
+		ConnectedAt:    time.Unix(1600000000, 0),
+		PacketsRecv:    2,
+		BytesRecv:      100,
+		PacketsDropped: 3,
+	}})
+	got := buf.String()
+	for _, want := range []string{
+		"# TYPE derp_client_bytes_received counter\n",
+		`derp_client_bytes_received{key="AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",mesh="false"} 100` + "\n",
+		`derp_client_packets_dropped{key="AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",mesh="false"} 3` + "\n",
+		`derp_client_connected_since_seconds{key="AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",mesh="false"} 1600000000` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	tests := []struct {
+		method   string
+		wantCode int
+	}{
+		{"GET", 200},
+		{"HEAD", 200},
+		{"OPTIONS", 204},
+		{"POST", 405},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		probeHandler(rec, httptest.NewRequest(tt.method, "/derp/probe", nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: code = %d; want %d", tt.method, rec.Code, tt.wantCode)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q; want *", tt.method, got)
+		}
+		if got := rec.Header().Get("Cache-Control"); !strings.Contains(got, "no-store") {
+			t.Errorf("%s: Cache-Control = %q; want no-store", tt.method, got)
+		}
+	}
+}
+
+func TestTailnetVerifier(t *testing.T) {
+	self, peer, joiner, stranger := key.Public{1}, key.Public{2}, key.Public{3}, key.Public{4}
+	now := time.Unix(1000, 0)
+	var fetches int
+	members := []key.Public{peer}
+	v := &tailnetVerifier{
+		status: func(context.Context) (*ipnstate.Status, error) {
+			fetches++
+			st := &ipnstate.Status{
+				Self: &ipnstate.PeerStatus{PublicKey: self},
+				Peer: map[key.Public]*ipnstate.PeerStatus{},
+			}
+			for _, k := range members {
+				st.Peer[k] = &ipnstate.PeerStatus{PublicKey: k}
+			}
+			return st, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	steps := []struct {
+		name        string
+		advance     time.Duration
+		key         key.Public
+		wantOK      bool
+		wantFetches int
+	}{
+		{"self", 0, self, true, 1},
+		{"peer-cached", time.Second, peer, true, 1},
+		{"stranger", time.Second, stranger, false, 1},
+		{"stranger-again", time.Second, stranger, false, 1},
+		{"stranger-refetch", verifyMinRefresh, stranger, false, 2},
+		{"joiner", verifyMinRefresh + time.Second, joiner, true, 3},
+		{"peer-expired", verifyCacheTTL + time.Second, peer, false, 4},
+	}
+	for _, st := range steps {
+		now = now.Add(st.advance)
+		switch st.name {
+		case "joiner":
+			members = append(members, joiner)
+		case "peer-expired":
+			members = []key.Public{joiner}
+		}
+		err := v.verify(st.key, "1.2.3.4:5")
+		if (err == nil) != st.wantOK {
+			t.Errorf("%s: err = %v; want ok=%v", st.name, err, st.wantOK)
+		}
+		if fetches != st.wantFetches {
+			t.Errorf("%s: %d status fetches; want %d", st.name, fetches, st.wantFetches)
+		}
+	}
+}
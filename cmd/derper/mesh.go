@@ -7,9 +7,11 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
@@ -32,6 +34,33 @@ func startMesh(s *derp.Server) error {
 	return nil
 }
 
+// meshPeer is a DERP server in our region that we mesh with, for
+// monitoring.
+type meshPeer struct {
+	host string
+	c    *derphttp.Client
+
+	clients     expvar.Int // clients connected to host
+	forwarded   expvar.Int // packets forwarded to host
+	forwardErrs expvar.Int // packets that failed to forward to host
+}
+
+// ForwardPacket implements derp.PacketForwarder.
+func (p *meshPeer) ForwardPacket(src, dst key.Public, payload []byte) error {
+	err := p.c.ForwardPacket(src, dst, payload)
+	if err != nil {
+		p.forwardErrs.Add(1)
+	} else {
+		p.forwarded.Add(1)
+	}
+	return err
+}
+
+var (
+	meshPeersMu sync.Mutex
+	meshPeers   []*meshPeer
+)
+
 func startMeshWithHost(s *derp.Server, host string) error {
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
 	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
@@ -39,8 +68,31 @@ func startMeshWithHost(s *derp.Server, host string) error {
 		return err
 	}
 	c.MeshKey = s.MeshKey()
-	add := func(k key.Public) { s.AddPacketForwarder(k, c) }
-	remove := func(k key.Public) { s.RemovePacketForwarder(k, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
+	p := &meshPeer{host: host, c: c}
+	meshPeersMu.Lock()
+	meshPeers = append(meshPeers, p)
+	meshPeersMu.Unlock()
+	add := func(k key.Public) {
+		p.clients.Add(1)
+		s.AddPacketForwarder(k, p)
+	}
+	remove := func(k key.Public) {
+		p.clients.Add(-1)
+		s.RemovePacketForwarder(k, p)
+	}
+	go func() {
+		c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
+
+		// It only returns if host is ourselves, which
+		// isn't a peer to monitor.
+		meshPeersMu.Lock()
+		defer meshPeersMu.Unlock()
+		for i, p2 := range meshPeers {
+			if p2 == p {
+				meshPeers = append(meshPeers[:i], meshPeers[i+1:]...)
+				break
+			}
+		}
+	}()
 	return nil
 }
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"tailscale.com/derp"
+	"tailscale.com/tsweb"
+)
+
+// metricsHandler returns an HTTP handler that writes all of the
+// process's expvars in Prometheus format, as tsweb.VarzHandler does,
+// followed by per-client and per-mesh-peer metrics.
+func metricsHandler(s *derp.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsweb.VarzHandler(w, r)
+		writeClientMetrics(w, s.ClientStats())
+
+		meshPeersMu.Lock()
+		peers := append([]*meshPeer(nil), meshPeers...)
+		meshPeersMu.Unlock()
+		writeMeshMetrics(w, peers)
+	})
+}
+
+// serveMetrics serves metricsHandler's output at /metrics on addr,
+// without the access checks of the /debug/ endpoints. It's meant for
+// Prometheus to scrape over a private network.
+func serveMetrics(addr string, s *derp.Server) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(s))
+	log.Printf("derper: serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("derper: metrics: %v", err)
+	}
+}
+
+// writeClientMetrics writes the stats of each connected client,
+// labeled by its public key.
+func writeClientMetrics(w io.Writer, clients []derp.ClientStats) {
+	metric := func(name, typ string, v func(derp.ClientStats) int64) {
+		fmt.Fprintf(w, "# TYPE derp_client_%s %s\n", name, typ)
+		for _, c := range clients {
+			k, _ := c.Key.MarshalText()
+			fmt.Fprintf(w, "derp_client_%s{key=%q,mesh=\"%v\"} %v\n", name, k, c.Mesh, v(c))
+		}
+	}
+	metric("packets_received", "counter", func(c derp.ClientStats) int64 { return c.PacketsRecv })
+	metric("bytes_received", "counter", func(c derp.ClientStats) int64 { return c.BytesRecv })
+	metric("packets_sent", "counter", func(c derp.ClientStats) int64 { return c.PacketsSent })
+	metric("bytes_sent", "counter", func(c derp.ClientStats) int64 { return c.BytesSent })
+	metric("packets_dropped", "counter", func(c derp.ClientStats) int64 { return c.PacketsDropped })
+	metric("connected_since_seconds", "gauge", func(c derp.ClientStats) int64 { return c.ConnectedAt.Unix() })
+}
+
+// writeMeshMetrics writes the health of each mesh peer, labeled by
+// its hostname.
+func writeMeshMetrics(w io.Writer, peers []*meshPeer) {
+	metric := func(name, typ string, v func(*meshPeer) int64) {
+		fmt.Fprintf(w, "# TYPE derp_mesh_peer_%s %s\n", name, typ)
+		for _, p := range peers {
+			fmt.Fprintf(w, "derp_mesh_peer_%s{host=%q} %v\n", name, p.host, v(p))
+		}
+	}
+	metric("up", "gauge", func(p *meshPeer) int64 {
+		if p.c.IsConnected() {
+			return 1
+		}
+		return 0
+	})
+	metric("clients", "gauge", func(p *meshPeer) int64 { return p.clients.Value() })
+	metric("packets_forwarded", "counter", func(p *meshPeer) int64 { return p.forwarded.Value() })
+	metric("forward_errors", "counter", func(p *meshPeer) int64 { return p.forwardErrs.Value() })
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"html"
+	"net/http"
+
+	"tailscale.com/version"
+)
+
+var probeRequests = expvar.NewInt("counter_probe_requests")
+
+// probeHandler answers latency probes from clients and browsers. It
+// returns an empty, uncacheable 200 response, and allows any origin
+// so that pages on other sites (such as a captive portal check) can
+// time it. It's served over plain HTTP as well as HTTPS.
+//
+// It's registered at both /derp/probe and /derp/latency-check, the
+// path netcheck uses when UDP is blocked.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	h.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	switch r.Method {
+	case "GET", "HEAD":
+		probeRequests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	case "OPTIONS":
+		h.Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
+	}
+}
+
+// latencyPageHandler serves a page that measures the browser's round
+// trip time to this server using /derp/probe.
+func latencyPageHandler(w http.ResponseWriter, r *http.Request) {
+	region := *regionName
+	if region == "" {
+		region = *hostname
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
+	f(`<html><head><title>DERP latency</title></head><body>
+<h1>DERP latency</h1>
+<ul>
+`)
+	f("<li><b>Region:</b> %v</li>\n", html.EscapeString(region))
+	f("<li><b>Version:</b> %v</li>\n", html.EscapeString(version.Long))
+	f(`<li><b>Round trip time:</b> <span id="rtt">measuring&hellip;</span></li>
+</ul>
+<script>
+(async function() {
+  const el = document.getElementById("rtt");
+  const times = [];
+  for (let i = 0; i < 10; i++) {
+    const start = performance.now();
+    try {
+      await fetch("/derp/probe?" + i, {cache: "no-store"});
+    } catch (e) {
+      el.textContent = "error: " + e;
+      return;
+    }
+    times.push(performance.now() - start);
+    const sorted = times.slice().sort((a, b) => a - b);
+    el.textContent = sorted[0].toFixed(1) + " ms (best of " + times.length + ", median " +
+      sorted[Math.floor(sorted.length / 2)].toFixed(1) + " ms)";
+  }
+})();
+</script>
+</body></html>
+`)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+const (
+	// verifyCacheTTL is how long the tailnet's node keys are trusted
+	// before they're fetched again, so removed nodes are rejected.
+	verifyCacheTTL = time.Minute
+
+	// verifyMinRefresh is how soon the node keys may be fetched again
+	// to look for a key that wasn't in them, such as a node that just
+	// joined. It bounds the LocalAPI calls a flood of unknown keys
+	// can cause.
+	verifyMinRefresh = 5 * time.Second
+)
+
+// tailnetVerifier is a derp.Server verify func for --verify-clients.
+// It admits only clients whose public key is that of a node in the
+// local tailscaled's tailnet (including tailscaled itself), caching
+// the tailnet's node keys rather than asking tailscaled per client.
+type tailnetVerifier struct {
+	status func(context.Context) (*ipnstate.Status, error) // tailscale.Status, or a fake in tests
+	now    func() time.Time
+
+	mu      sync.Mutex // held during fetches, so concurrent misses share one
+	keys    map[key.Public]bool
+	fetched time.Time
+}
+
+func newTailnetVerifier() *tailnetVerifier {
+	return &tailnetVerifier{
+		status: tailscale.Status,
+		now:    time.Now,
+	}
+}
+
+func (v *tailnetVerifier) verify(clientKey key.Public, remoteAddr string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	age := v.now().Sub(v.fetched)
+	if v.keys == nil || age > verifyCacheTTL || (!v.keys[clientKey] && age > verifyMinRefresh) {
+		if err := v.fetchLocked(); err != nil {
+			if v.keys == nil {
+				return err
+			}
+			log.Printf("verify-clients: %v; using node keys from %v ago", err, age.Round(time.Second))
+		}
+	}
+	if v.keys[clientKey] {
+		return nil
+	}
+	return errors.New("not a node in this tailnet")
+}
+
+func (v *tailnetVerifier) fetchLocked() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := v.status(ctx)
+	if err != nil {
+		return fmt.Errorf("getting tailscaled status to verify client: %w", err)
+	}
+	keys := make(map[key.Public]bool, len(st.Peer)+1)
+	if st.Self != nil {
+		keys[st.Self.PublicKey] = true
+	}
+	for k := range st.Peer {
+		keys[k] = true
+	}
+	v.keys = keys
+	v.fetched = v.now()
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var certCmd = &ffcli.Command{
+	Name:       "cert",
+	ShortUsage: "cert [flags] <domain>",
+	ShortHelp:  "Get a TLS certificate for this machine's DNS name or a custom domain",
+	LongHelp: strings.TrimSpace(`
+"tailscale cert" gets a publicly trusted TLS certificate for this
+machine's MagicDNS name from Let's Encrypt, proving control of the name
+with a DNS-01 challenge. tailscaled caches the certificate and gets a
+new one when it's close to expiring, so run this again (e.g. from cron)
+to pick up renewals.
+
+It can also get certificates for custom domains that are CNAMEs for
+this machine's MagicDNS name, once they're listed in "tailscale up
+--cert-domains". Their DNS-01 challenge records are set by the
+provider given to tailscaled's --cert-dns-provider flag;
+"exec:/path/to/hook" runs "hook set NAME VALUE" and "hook remove NAME
+VALUE", and should only return from "set" once the record is publicly
+visible.
+
+By default the certificate chain and private key are written to
+<domain>.crt and <domain>.key in the current directory; use "-" to
+write to stdout.
+`),
+	Exec: runCert,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("cert", flag.ExitOnError)
+		fs.StringVar(&certArgs.certFile, "cert-file", "", "output cert file; defaults to DOMAIN.crt")
+		fs.StringVar(&certArgs.keyFile, "key-file", "", "output key file; defaults to DOMAIN.key")
+		return fs
+	})(),
+}
+
+var certArgs struct {
+	certFile string
+	keyFile  string
+}
+
+func runCert(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale cert [flags] <domain>")
+	}
+	domain := args[0]
+
+	certPEM, keyPEM, err := tailscale.CertPair(ctx, domain)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := certArgs.certFile, certArgs.keyFile
+	if certFile == "" {
+		certFile = domain + ".crt"
+	}
+	if keyFile == "" {
+		keyFile = domain + ".key"
+	}
+	if err := writeCertFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := writeCertFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return nil
+}
+
+func writeCertFile(name string, data []byte, mode os.FileMode) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(name, data, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", name)
+	return nil
+}
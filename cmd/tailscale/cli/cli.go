@@ -31,8 +31,8 @@ func ActLikeCLI() bool {
 		return false
 	}
 	switch os.Args[1] {
-	case "up", "down", "status", "netcheck", "ping", "version",
-		"debug",
+	case "up", "down", "status", "ip", "dns", "netcheck", "ping", "version", "switch", "group",
+		"container", "serve", "cert", "web", "debug", "completion", "__complete",
 		"-V", "--version", "-h", "--help":
 		return true
 	}
@@ -62,11 +62,27 @@ change in the future.
 `),
 		Subcommands: []*ffcli.Command{
 			upCmd,
+			setCmd,
+			setupCmd,
 			downCmd,
 			netcheckCmd,
 			statusCmd,
+			ipCmd,
+			dnsCmd,
 			pingCmd,
+			ncCmd,
+			switchCmd,
+			locationCmd,
+			netchangesCmd,
+			groupCmd,
+			lockCmd,
+			containerCmd,
+			serveCmd,
+			vserviceCmd,
+			certCmd,
+			webCmd,
 			versionCmd,
+			completionCmd,
 		},
 		FlagSet: rootfs,
 		Exec:    func(context.Context, []string) error { return flag.ErrHelp },
@@ -77,6 +93,11 @@ change in the future.
 		rootCmd.Subcommands = append(rootCmd.Subcommands, debugCmd)
 	}
 
+	// Nor the command the shell completion scripts call.
+	if len(args) > 0 && args[0] == "__complete" {
+		return runComplete(rootCmd, args[1:])
+	}
+
 	if err := rootCmd.Parse(args); err != nil {
 		return err
 	}
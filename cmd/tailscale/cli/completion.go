@@ -0,0 +1,232 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/util/dnsname"
+)
+
+var completionCmd = &ffcli.Command{
+	Name:       "completion",
+	ShortUsage: "completion <bash|zsh|fish|powershell>",
+	ShortHelp:  "Print a shell completion script",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale completion' command prints a script that makes the given
+shell complete tailscale's subcommands and flags, and the names of
+peers for commands that take them, such as 'tailscale ping'. Peer
+names are fetched from tailscaled as you type.
+
+To load completions in the current shell:
+
+  bash:        source <(tailscale completion bash)
+  zsh:         source <(tailscale completion zsh)
+  fish:        tailscale completion fish | source
+  powershell:  tailscale completion powershell | Out-String | Invoke-Expression
+
+To load them in every new shell, add that line to the shell's startup
+file (~/.bashrc, ~/.zshrc, ~/.config/fish/config.fish or $PROFILE).
+`),
+	Exec: runCompletion,
+}
+
+func runCompletion(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion <bash|zsh|fish|powershell>")
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q; want bash, zsh, fish or powershell", args[0])
+	}
+	fmt.Print(strings.TrimLeft(script, "\n"))
+	return nil
+}
+
+// The completion scripts all call back into "tailscale __complete
+// --cur=WORD [WORDS...]", where WORD is the (possibly empty) word being
+// completed and WORDS are the ones before it, not counting "tailscale"
+// itself. It prints the candidates, one per line. The current word is
+// passed as a flag because some shells drop empty arguments.
+var completionScripts = map[string]string{
+	"bash": `
+_tailscale() {
+	local IFS=$'\n'
+	COMPREPLY=($(tailscale __complete "--cur=${COMP_WORDS[COMP_CWORD]}" "${COMP_WORDS[@]:1:COMP_CWORD-1}" 2>/dev/null))
+}
+complete -o default -F _tailscale tailscale
+`,
+	"zsh": `
+#compdef tailscale
+_tailscale() {
+	local -a completions
+	completions=(${(f)"$(tailscale __complete "--cur=${words[CURRENT]}" "${(@)words[2,CURRENT-1]}" 2>/dev/null)"})
+	compadd -a completions
+}
+compdef _tailscale tailscale
+`,
+	"fish": `
+function __tailscale_complete
+	set -l args (commandline -opc)
+	set -e args[1]
+	set -l cur (commandline -ct)
+	tailscale __complete "--cur=$cur" $args 2>/dev/null
+end
+complete -c tailscale -f -a '(__tailscale_complete)'
+`,
+	"powershell": `
+Register-ArgumentCompleter -Native -CommandName tailscale -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 |
+		Where-Object { $_.Extent.EndOffset -lt $cursorPosition } |
+		ForEach-Object { $_.ToString() })
+	& tailscale __complete "--cur=$wordToComplete" @words 2>$null | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
+
+// peerArgCommands are the commands, by path below the root, whose
+// positional arguments are peers. The value is how many leading
+// positional arguments aren't.
+var peerArgCommands = map[string]int{
+	"ping":         0,
+	"ip":           0,
+	"group add":    1,
+	"group remove": 1,
+}
+
+// runComplete implements the hidden "__complete" command that the
+// completion scripts call.
+func runComplete(root *ffcli.Command, args []string) error {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "--cur=") {
+		return errors.New("usage: __complete --cur=WORD [WORDS...]")
+	}
+	cur := strings.TrimPrefix(args[0], "--cur=")
+	cands := completions(root, args[1:], cur, completePeers)
+	sort.Strings(cands)
+	for _, c := range cands {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+// completions returns the candidates for the word cur, which follows
+// words on a command line for root. It calls peers for the names of
+// peers, if they're wanted.
+func completions(root *ffcli.Command, words []string, cur string, peers func() []string) []string {
+	cmd := root
+	var path []string
+	npos := 0 // positional arguments seen
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if strings.HasPrefix(w, "-") {
+			if !strings.Contains(w, "=") && flagTakesValue(cmd, w) {
+				if i == len(words)-1 {
+					// cur is the flag's value, which we don't
+					// know how to complete.
+					return nil
+				}
+				i++
+			}
+			continue
+		}
+		if npos == 0 {
+			if sub := subcommand(cmd, w); sub != nil {
+				cmd = sub
+				path = append(path, sub.Name)
+				continue
+			}
+		}
+		npos++
+	}
+
+	var ret []string
+	add := func(c string) {
+		if strings.HasPrefix(c, cur) {
+			ret = append(ret, c)
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		if strings.Contains(cur, "=") {
+			return nil
+		}
+		if cmd.FlagSet != nil {
+			cmd.FlagSet.VisitAll(func(f *flag.Flag) {
+				add("--" + f.Name)
+			})
+		}
+		return ret
+	}
+	if npos == 0 {
+		for _, sub := range cmd.Subcommands {
+			add(sub.Name)
+		}
+	}
+	if skip, ok := peerArgCommands[strings.Join(path, " ")]; ok && npos >= skip {
+		for _, p := range peers() {
+			add(p)
+		}
+	}
+	return ret
+}
+
+// subcommand returns cmd's subcommand called name, or nil.
+func subcommand(cmd *ffcli.Command, name string) *ffcli.Command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// flagTakesValue reports whether the flag arg (such as "--json" or
+// "-c") of cmd takes a value as the following word.
+func flagTakesValue(cmd *ffcli.Command, arg string) bool {
+	if cmd.FlagSet == nil {
+		return false
+	}
+	f := cmd.FlagSet.Lookup(strings.TrimLeft(arg, "-"))
+	if f == nil {
+		return false
+	}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+// completePeers returns the MagicDNS names (or hostnames, for peers
+// without one) of the current peers, or nil if tailscaled can't be
+// reached quickly.
+func completePeers() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, ps := range st.Peer {
+		name := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix)
+		if name == "" {
+			name = dnsname.SanitizeHostname(ps.HostName)
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
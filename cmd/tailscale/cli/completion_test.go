@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"flag"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+)
+
+func TestCompletions(t *testing.T) {
+	pingFS := flag.NewFlagSet("ping", flag.ContinueOnError)
+	pingFS.Int("c", 10, "")
+	pingFS.Bool("verbose", false, "")
+	root := &ffcli.Command{
+		Name: "tailscale",
+		Subcommands: []*ffcli.Command{
+			{Name: "ping", FlagSet: pingFS},
+			{Name: "ip"},
+			{Name: "status"},
+			{Name: "group", Subcommands: []*ffcli.Command{
+				{Name: "add"},
+				{Name: "remove"},
+			}},
+		},
+	}
+	peers := func() []string { return []string{"nas", "phone", "pi"} }
+
+	tests := []struct {
+		words string // space-separated
+		cur   string
+		want  []string
+	}{
+		{"", "", []string{"group", "ip", "ping", "status"}},
+		{"", "p", []string{"ping"}},
+		{"ping", "p", []string{"phone", "pi"}},
+		{"ping", "-", []string{"--c", "--verbose"}},
+		{"ping --verbose", "n", []string{"nas"}},
+		{"ping -c", "", nil}, // the flag's value
+		{"ping -c 3", "n", []string{"nas"}},
+		{"status", "", nil}, // takes no peers
+		{"group", "", []string{"add", "remove"}},
+		{"group add", "", nil}, // the group's name comes first
+		{"group add family", "p", []string{"phone", "pi"}},
+		{"ping --c=", "", []string{"nas", "phone", "pi"}},
+		{"ping", "--c=", nil},
+	}
+	for _, tt := range tests {
+		words := strings.Fields(tt.words)
+		got := completions(root, words, tt.cur, peers)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("completions(%q, cur %q) = %q; want %q", tt.words, tt.cur, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var containerCmd = &ffcli.Command{
+	Name:       "container",
+	ShortUsage: "container <list|attach|detach> [args]",
+	ShortHelp:  "Share this node's tailnet connection with containers",
+	LongHelp: strings.TrimSpace(`
+Attaching a container gives its network namespace a route to the
+tailnet through this machine's tailscaled, without running tailscaled
+in the container. The container's traffic appears to the tailnet to
+come from this machine.
+
+A container is named by the PID of any process in it, or by the name
+of a network namespace created with "ip netns add". For example:
+
+  tailscale container attach $(docker inspect -f '{{.State.Pid}}' web)
+
+Attachments last until they're detached or tailscaled stops. This
+is only supported on Linux, with IP forwarding enabled and not in
+userspace networking mode.
+`),
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "list",
+			ShortUsage: "container list",
+			ShortHelp:  "List attached containers",
+			Exec:       runContainerList,
+		},
+		{
+			Name:       "attach",
+			ShortUsage: "container attach <pid|netns>",
+			ShortHelp:  "Attach a container to the tailnet",
+			Exec:       runContainerAttach,
+		},
+		{
+			Name:       "detach",
+			ShortUsage: "container detach <id>",
+			ShortHelp:  "Detach an attached container",
+			Exec:       runContainerDetach,
+		},
+	},
+}
+
+func runContainerList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	atts, err := tailscale.Containers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range atts {
+		fmt.Printf("%-8s %-15s %s\n", a.ID, a.NSAddr.IP, a.Target)
+	}
+	return nil
+}
+
+func runContainerAttach(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: container attach <pid|netns>")
+	}
+	a, err := tailscale.AttachContainer(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("attached %s as %s (%v)\n", a.Target, a.ID, a.NSAddr.IP)
+	return nil
+}
+
+func runContainerDetach(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: container detach <id>")
+	}
+	return tailscale.DetachContainer(ctx, args[0])
+}
@@ -6,26 +6,90 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/wgengine/filter"
 )
 
 var debugCmd = &ffcli.Command{
 	Name: "debug",
 	Exec: runDebug,
+	Subcommands: []*ffcli.Command{
+		debugCaptureCmd,
+		debugDNSLogCmd,
+		debugTasksCmd,
+		{
+			Name:       "prefs",
+			ShortUsage: "debug prefs",
+			ShortHelp:  "Print tailscaled's prefs, as JSON",
+			Exec: debugJSON(func(ctx context.Context) (interface{}, error) {
+				return tailscale.GetPrefs(ctx)
+			}),
+		},
+		{
+			Name:       "netmap",
+			ShortUsage: "debug netmap",
+			ShortHelp:  "Print the current network map, as JSON",
+			Exec: debugJSON(func(ctx context.Context) (interface{}, error) {
+				return tailscale.NetMap(ctx)
+			}),
+		},
+		{
+			Name:       "magicsock",
+			ShortUsage: "debug magicsock",
+			ShortHelp:  "Print magicsock's path discovery state for each peer, as JSON",
+			Exec: debugJSON(func(ctx context.Context) (interface{}, error) {
+				return tailscale.DebugMagicsock(ctx)
+			}),
+		},
+		{
+			Name:       "link-events",
+			ShortUsage: "debug link-events",
+			ShortHelp:  "Print the network changes tailscaled recently noticed, as JSON",
+			Exec: debugJSON(func(ctx context.Context) (interface{}, error) {
+				return tailscale.LinkEvents(ctx)
+			}),
+		},
+		{
+			Name:       "daemon-goroutines",
+			ShortUsage: "debug daemon-goroutines",
+			ShortHelp:  "Print tailscaled's goroutines",
+			Exec: func(ctx context.Context, args []string) error {
+				if len(args) > 0 {
+					return errors.New("unknown arguments")
+				}
+				goroutines, err := tailscale.Goroutines(ctx)
+				if err != nil {
+					return err
+				}
+				os.Stdout.Write(goroutines)
+				return nil
+			},
+		},
+		debugProfileCmd,
+	},
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("debug", flag.ExitOnError)
 		fs.BoolVar(&debugArgs.goroutines, "daemon-goroutines", false, "If true, dump the tailscaled daemon's goroutines")
+		fs.BoolVar(&debugArgs.filterStats, "filter-stats", false, "If true, print the packet filter's per-rule accept and drop counters")
 		return fs
 	})(),
 }
 
 var debugArgs struct {
-	goroutines bool
+	goroutines  bool
+	filterStats bool
 }
 
 func runDebug(ctx context.Context, args []string) error {
@@ -39,5 +103,277 @@ func runDebug(ctx context.Context, args []string) error {
 		}
 		os.Stdout.Write(goroutines)
 	}
+	if debugArgs.filterStats {
+		st, err := tailscale.FilterStats(ctx)
+		if err != nil {
+			return err
+		}
+		printFilterStats(st)
+	}
+	return nil
+}
+
+// debugJSON returns an Exec func for a debug subcommand that prints
+// what get returns as indented JSON.
+func debugJSON(get func(context.Context) (interface{}, error)) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return errors.New("unknown arguments")
+		}
+		v, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		j, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(j, '\n'))
+		return nil
+	}
+}
+
+var debugProfileCmd = &ffcli.Command{
+	Name:       "profile",
+	ShortUsage: "debug profile [--type=cpu|heap|goroutine|allocs|block|mutex] [--seconds=N] [-o file]",
+	ShortHelp:  "Write a pprof profile of tailscaled",
+	LongHelp: strings.TrimSpace(`
+"tailscale debug profile" writes a profile of tailscaled, in the format
+read by "go tool pprof", to attach to bug reports about CPU or memory
+use. A CPU profile samples tailscaled for --seconds first.
+
+	tailscale debug profile --type=heap -o heap.pprof
+	go tool pprof -top heap.pprof
+`),
+	Exec: runDebugProfile,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("profile", flag.ExitOnError)
+		fs.StringVar(&debugProfileArgs.typ, "type", "cpu", "profile type: cpu, heap, goroutine, allocs, block, mutex or threadcreate")
+		fs.IntVar(&debugProfileArgs.seconds, "seconds", 30, "how long to sample for a CPU profile")
+		fs.StringVar(&debugProfileArgs.out, "o", "", `file to write the profile to, or "-" for stdout; default "tailscaled-TYPE.pprof"`)
+		return fs
+	})(),
+}
+
+var debugProfileArgs struct {
+	typ     string
+	seconds int
+	out     string
+}
+
+func runDebugProfile(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	name := debugProfileArgs.typ
+	if name == "cpu" {
+		name = "profile"
+		fmt.Fprintf(os.Stderr, "# profiling CPU for %d seconds...\n", debugProfileArgs.seconds)
+	}
+	out := debugProfileArgs.out
+	if out == "" {
+		out = "tailscaled-" + debugProfileArgs.typ + ".pprof"
+	}
+	prof, err := tailscale.Pprof(ctx, name, debugProfileArgs.seconds)
+	if err != nil {
+		return err
+	}
+	if out == "-" {
+		_, err := os.Stdout.Write(prof)
+		return err
+	}
+	if err := ioutil.WriteFile(out, prof, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "# wrote %s\n", out)
+	return nil
+}
+
+func printFilterStats(st *filter.Stats) {
+	fmt.Printf("# packet filter counters since %v\n", st.Since.Format(time.RFC3339))
+	fmt.Printf("rules (accepted new flows):\n")
+	if len(st.Rules) == 0 {
+		fmt.Printf("  (none; all incoming connections are dropped)\n")
+	}
+	for i, rs := range st.Rules {
+		fmt.Printf("  %3d %10d  %s\n", i, rs.Accepts, rs.Rule)
+	}
+	fmt.Printf("drops:\n")
+	if len(st.Drops) == 0 {
+		fmt.Printf("  (none)\n")
+	}
+	for _, ds := range st.Drops {
+		fmt.Printf("  %-3s %10d  %s\n", ds.Direction, ds.Count, ds.Reason)
+	}
+}
+
+var debugDNSLogCmd = &ffcli.Command{
+	Name:       "dns-log",
+	ShortUsage: "debug dns-log [on|answers|off]",
+	ShortHelp:  "Show or configure tailscaled's log of recent DNS queries",
+	LongHelp: strings.TrimSpace(`
+"tailscale debug dns-log" prints the recent DNS queries sent to
+MagicDNS: the name and type queried, who answered (MagicDNS itself or
+an upstream nameserver), how long it took and the response code.
+
+The log is off by default and only kept in memory. "on" turns it on,
+"answers" also records the answers to each query, and "off" turns it
+off and discards what it logged.
+`),
+	Exec: runDebugDNSLog,
+}
+
+func runDebugDNSLog(ctx context.Context, args []string) error {
+	var (
+		l   *ipnstate.DNSQueryLog
+		err error
+	)
+	switch {
+	case len(args) == 0:
+		l, err = tailscale.DNSQueryLog(ctx)
+	case len(args) == 1 && args[0] == "on":
+		l, err = tailscale.SetDNSQueryLog(ctx, true, false)
+	case len(args) == 1 && args[0] == "answers":
+		l, err = tailscale.SetDNSQueryLog(ctx, true, true)
+	case len(args) == 1 && args[0] == "off":
+		l, err = tailscale.SetDNSQueryLog(ctx, false, false)
+	default:
+		return errors.New("usage: tailscale debug dns-log [on|answers|off]")
+	}
+	if err != nil {
+		return err
+	}
+	if !l.Enabled {
+		fmt.Printf("# DNS query log is off; turn it on with \"tailscale debug dns-log on\"\n")
+		return nil
+	}
+	for _, q := range l.Queries {
+		resolver := q.Resolver
+		if resolver == "" {
+			resolver = "-"
+		}
+		fmt.Printf("%s %-5s %-40s %-22s %6.1fms %s", q.Time.Format("15:04:05.000"), q.Type, q.Name, resolver, q.LatencySeconds*1000, q.RCode)
+		if len(q.Answers) > 0 {
+			fmt.Printf(" [%s]", strings.Join(q.Answers, ", "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+var debugTasksCmd = &ffcli.Command{
+	Name:       "tasks",
+	ShortUsage: "debug tasks [--run name]",
+	ShortHelp:  "Show tailscaled's periodic tasks, or run one now",
+	LongHelp: strings.TrimSpace(`
+"tailscale debug tasks" lists the work tailscaled does periodically,
+such as checking for updates and renewing certificates: when each task
+last ran, how long it took and whether it failed, and when it will next
+run. Tasks run at jittered intervals, and failed ones are retried with
+backoff, so the times vary.
+
+With --run, the named task runs now instead of at its next scheduled
+time.
+`),
+	Exec: runDebugTasks,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("tasks", flag.ExitOnError)
+		fs.StringVar(&debugTasksArgs.run, "run", "", "name of a task to run now")
+		return fs
+	})(),
+}
+
+var debugTasksArgs struct {
+	run string
+}
+
+func runDebugTasks(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	if debugTasksArgs.run != "" {
+		return tailscale.RunTask(ctx, debugTasksArgs.run)
+	}
+	tasks, err := tailscale.Tasks(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	fmt.Printf("%-18s %-10s %-22s %-10s %s\n", "TASK", "EVERY", "LAST RUN", "NEXT RUN", "RESULT")
+	for _, t := range tasks {
+		last := "-"
+		if !t.LastStart.IsZero() {
+			last = fmt.Sprintf("%v ago (%v)", now.Sub(t.LastStart).Round(time.Second), t.LastDuration.Round(time.Millisecond))
+		}
+		next := "running"
+		if !t.Running {
+			next = "in " + t.NextRun.Sub(now).Round(time.Second).String()
+		}
+		result := "-"
+		switch {
+		case t.Failures > 0:
+			result = fmt.Sprintf("failed %d times: %s", t.Failures, t.LastErr)
+		case t.Runs > 0:
+			result = fmt.Sprintf("ok (%d runs)", t.Runs)
+		}
+		fmt.Printf("%-18s %-10v %-22s %-10s %s\n", t.Name, t.Interval, last, next, result)
+	}
+	return nil
+}
+
+var debugCaptureCmd = &ffcli.Command{
+	Name:       "capture",
+	ShortUsage: "debug capture [-o file] [filter expression]",
+	ShortHelp:  "Stream a pcap of the packets going through the Tailscale interface",
+	LongHelp: strings.TrimSpace(`
+"tailscale debug capture" writes copies of the packets going to and
+from the Tailscale interface, as seen by tailscaled before its packet
+filter, in pcap format. For a live view, pipe it to Wireshark:
+
+	tailscale debug capture | wireshark -k -i -
+
+The optional filter expression selects which packets to capture using
+a subset of tcpdump's syntax: "[src|dst] host ADDR", "[src|dst] net
+CIDR", "[src|dst] port N", "ip", "ip6", "tcp", "udp", "icmp", "icmp6",
+"inbound" and "outbound", combined with "and", "or", "not" and
+parentheses. For example:
+
+	tailscale debug capture -o ssh.pcap tcp port 22 and host 100.101.102.103
+`),
+	Exec: runDebugCapture,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("capture", flag.ExitOnError)
+		fs.StringVar(&debugCaptureArgs.out, "o", "-", `file to write the capture to, or "-" for stdout`)
+		return fs
+	})(),
+}
+
+var debugCaptureArgs struct {
+	out string
+}
+
+func runDebugCapture(ctx context.Context, args []string) error {
+	var out io.Writer = os.Stdout
+	if debugCaptureArgs.out == "-" {
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return errors.New("refusing to write a binary pcap stream to a terminal; pipe it to a program or use -o")
+		}
+	} else {
+		f, err := os.Create(debugCaptureArgs.out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	rc, err := tailscale.StreamDebugCapture(ctx, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(out, rc); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("capture: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <status>",
+	ShortHelp:  "Show DNS settings",
+	Exec:       func(context.Context, []string) error { return flag.ErrHelp },
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "status",
+			ShortUsage: "dns status [--json]",
+			ShortHelp:  "Show the DNS configuration tailscaled has programmed",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale dns status' command shows the nameservers and search
+domains tailscaled has told the operating system to use and, with
+MagicDNS, the upstream nameservers its own resolver forwards
+non-Tailscale names to. It also shows why the configuration couldn't
+be applied, if it couldn't.
+`),
+			Exec: runDNSStatus,
+			FlagSet: (func() *flag.FlagSet {
+				fs := flag.NewFlagSet("status", flag.ExitOnError)
+				fs.BoolVar(&dnsStatusArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+	},
+}
+
+var dnsStatusArgs struct {
+	json bool
+}
+
+func runDNSStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	st, err := tailscale.DNSStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsStatusArgs.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(j, '\n'))
+		return nil
+	}
+	printDNSStatus(st)
+	return nil
+}
+
+func printDNSStatus(st *ipnstate.DNSStatus) {
+	if !st.AcceptDNS {
+		fmt.Println("Tailscale DNS: off (tailscale up --accept-dns=false)")
+		return
+	}
+	if st.MagicDNSSuffix != "" {
+		fmt.Printf("MagicDNS:       on, suffix %s\n", st.MagicDNSSuffix)
+	} else {
+		fmt.Println("MagicDNS:       off")
+	}
+	if len(st.Nameservers) == 0 {
+		fmt.Println("Nameservers:    none; the OS's own DNS settings are in use")
+	} else {
+		ns := make([]string, len(st.Nameservers))
+		for i, ip := range st.Nameservers {
+			ns[i] = ip.String()
+		}
+		fmt.Printf("Nameservers:    %s\n", strings.Join(ns, ", "))
+	}
+	if len(st.Domains) > 0 {
+		fmt.Printf("Search domains: %s\n", strings.Join(st.Domains, ", "))
+	}
+	if st.PerDomain {
+		fmt.Println("Split DNS:      nameservers are only used for the search domains")
+	}
+	if st.Proxied {
+		fmt.Printf("Upstreams:      %s\n", strings.Join(st.Upstreams, ", "))
+	}
+	if st.Error != "" {
+		fmt.Printf("Error:          %s\n", st.Error)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var groupCmd = &ffcli.Command{
+	Name:       "group",
+	ShortUsage: "group <list|add|remove> [group] [peers...]",
+	ShortHelp:  "Manage local groups of peers",
+	LongHelp: strings.TrimSpace(`
+Peer groups are named lists of peers, kept by the local tailscaled,
+that can be used as targets of other commands. For example:
+
+  tailscale group add prod web-1 web-2 db-1
+  tailscale ping group:prod
+  tailscale status --group=prod
+
+Peers are named by MagicDNS name, hostname or Tailscale IP. Groups
+are local to this machine and have no effect on access control.
+`),
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "list",
+			ShortUsage: "group list",
+			ShortHelp:  "List peer groups and their members",
+			Exec:       runGroupList,
+		},
+		{
+			Name:       "add",
+			ShortUsage: "group add <group> <peer> [peer...]",
+			ShortHelp:  "Add peers to a group, creating it if needed",
+			Exec:       runGroupAdd,
+		},
+		{
+			Name:       "remove",
+			ShortUsage: "group remove <group> [peer...]",
+			ShortHelp:  "Remove peers from a group, or the whole group if no peers are given",
+			Exec:       runGroupRemove,
+		},
+	},
+}
+
+func runGroupList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	groups, err := tailscale.PeerGroups(ctx)
+	if err != nil {
+		return err
+	}
+	printGroups(groups)
+	return nil
+}
+
+func runGroupAdd(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: group add <group> <peer> [peer...]")
+	}
+	name, add := args[0], args[1:]
+	groups, err := tailscale.PeerGroups(ctx)
+	if err != nil {
+		return err
+	}
+	members := groups[name]
+	for _, p := range add {
+		if !strSliceContains(members, p) {
+			members = append(members, p)
+		}
+	}
+	groups, err = tailscale.SetPeerGroup(ctx, name, members)
+	if err != nil {
+		return err
+	}
+	printGroups(ipn.PeerGroups{name: groups[name]})
+	return nil
+}
+
+func runGroupRemove(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: group remove <group> [peer...]")
+	}
+	name, remove := args[0], args[1:]
+	groups, err := tailscale.PeerGroups(ctx)
+	if err != nil {
+		return err
+	}
+	old, ok := groups[name]
+	if !ok {
+		return fmt.Errorf("no peer group %q", name)
+	}
+	var members []string
+	if len(remove) > 0 {
+		for _, p := range old {
+			if !strSliceContains(remove, p) {
+				members = append(members, p)
+			}
+		}
+	}
+	_, err = tailscale.SetPeerGroup(ctx, name, members)
+	return err
+}
+
+func printGroups(groups ipn.PeerGroups) {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, strings.Join(groups[name], " "))
+	}
+}
+
+// peerGroupMembers returns the members of the peer group named by
+// target, if target has the "group:" prefix.
+func peerGroupMembers(ctx context.Context, target string) (members []string, isGroup bool, err error) {
+	name, ok := ipn.ParsePeerGroupTarget(target)
+	if !ok {
+		return nil, false, nil
+	}
+	groups, err := tailscale.PeerGroups(ctx)
+	if err != nil {
+		return nil, true, err
+	}
+	members, ok = groups[name]
+	if !ok {
+		return nil, true, fmt.Errorf("no peer group %q", name)
+	}
+	return members, true, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+)
+
+var ipCmd = &ffcli.Command{
+	Name:       "ip",
+	ShortUsage: "ip [-4] [-6] [peer]",
+	ShortHelp:  "Show Tailscale IP addresses",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale ip' command prints this node's Tailscale IP addresses,
+one per line, IPv4 first. With a peer argument (a MagicDNS name,
+hostname or Tailscale IP), it prints that peer's addresses instead.
+
+With -4 or -6, only addresses of that family are printed, which is
+handy in scripts:
+
+  ssh root@$(tailscale ip -4 web-1)
+`),
+	Exec: runIP,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("ip", flag.ExitOnError)
+		fs.BoolVar(&ipArgs.want4, "4", false, "only print IPv4 addresses")
+		fs.BoolVar(&ipArgs.want6, "6", false, "only print IPv6 addresses")
+		return fs
+	})(),
+}
+
+var ipArgs struct {
+	want4 bool
+	want6 bool
+}
+
+func runIP(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ip [-4] [-6] [peer]")
+	}
+	if ipArgs.want4 && ipArgs.want6 {
+		return errors.New("-4 and -6 are mutually exclusive")
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return err
+	}
+	ips := st.TailscaleIPs
+	if len(args) == 1 {
+		ps := st.FindPeer(args[0])
+		if ps == nil {
+			return fmt.Errorf("no peer %q found", args[0])
+		}
+		ips = ps.TailscaleIPs
+	}
+	var printed bool
+	for _, ip := range sortIPs(ips) {
+		if ipArgs.want4 && !ip.Is4() || ipArgs.want6 && !ip.Is6() {
+			continue
+		}
+		fmt.Println(ip)
+		printed = true
+	}
+	if !printed {
+		switch {
+		case ipArgs.want4:
+			return errors.New("no Tailscale IPv4 address")
+		case ipArgs.want6:
+			return errors.New("no Tailscale IPv6 address")
+		}
+		return errors.New("no Tailscale IP addresses; is Tailscale up?")
+	}
+	return nil
+}
+
+// sortIPs returns ips with the IPv4 addresses first, otherwise in
+// their original order.
+func sortIPs(ips []netaddr.IP) []netaddr.IP {
+	ret := make([]netaddr.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.Is4() {
+			ret = append(ret, ip)
+		}
+	}
+	for _, ip := range ips {
+		if !ip.Is4() {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
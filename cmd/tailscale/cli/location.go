@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var locationCmd = &ffcli.Command{
+	Name:       "location",
+	ShortUsage: "location [--save | --delete] [network]",
+	ShortHelp:  "Remember exit node and shields up settings per network",
+	LongHelp: strings.TrimSpace(`
+"tailscale location" manages network locations: exit node and shields
+up settings that tailscaled applies automatically whenever the machine
+joins a particular network. For example, you can always use an exit
+node on a coffee shop's Wi-Fi, but not at home.
+
+Networks are identified by their Wi-Fi SSID ("wifi:NAME") or, on wired
+networks, by the MAC address of their default gateway ("gw:MAC").
+
+With --save, the current exit node and shields up settings (as set by
+"tailscale up") are remembered for the network, which defaults to the
+current one. With --delete, the network's settings are forgotten.
+Settings changed while on a network stay in effect until the machine
+leaves it.
+
+With no flags, the saved locations are listed and the current network
+is marked with an asterisk.
+`),
+	Exec: runLocation,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("location", flag.ExitOnError)
+		fs.BoolVar(&locationArgs.save, "save", false, "remember the current settings for the network")
+		fs.BoolVar(&locationArgs.delete, "delete", false, "forget the settings for the network")
+		return fs
+	})(),
+}
+
+var locationArgs struct {
+	save   bool
+	delete bool
+}
+
+func runLocation(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	var network string
+	if len(args) == 1 {
+		network = args[0]
+	}
+	var nl *ipn.NetworkLocations
+	var err error
+	switch {
+	case locationArgs.save && locationArgs.delete:
+		return errors.New("--save and --delete are mutually exclusive")
+	case locationArgs.save:
+		nl, err = tailscale.SaveNetworkLocation(ctx, network)
+	case locationArgs.delete:
+		nl, err = tailscale.DeleteNetworkLocation(ctx, network)
+	default:
+		if network != "" {
+			return errors.New("a network requires --save or --delete")
+		}
+		nl, err = tailscale.NetworkLocations(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if nl.Current == "" {
+		fmt.Println("# The current network can't be identified.")
+	}
+	networks := make([]string, 0, len(nl.Prefs))
+	for n := range nl.Prefs {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	for _, n := range networks {
+		lp := nl.Prefs[n]
+		mark := " "
+		if n == nl.Current {
+			mark = "*"
+		}
+		exitNode := "none"
+		if lp.ExitNodeID != "" {
+			exitNode = string(lp.ExitNodeID)
+		} else if !lp.ExitNodeIP.IsZero() {
+			exitNode = lp.ExitNodeIP.String()
+		}
+		fmt.Printf("%s %s\texit node: %s\tshields up: %v\n", mark, n, exitNode, lp.ShieldsUp)
+	}
+	if _, ok := nl.Prefs[nl.Current]; !ok && nl.Current != "" {
+		fmt.Printf("* %s\t(no saved settings)\n", nl.Current)
+	}
+	return nil
+}
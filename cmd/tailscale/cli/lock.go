@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+)
+
+var lockCmd = &ffcli.Command{
+	Name:       "lock",
+	ShortUsage: "lock <init|sign|add|remove|disable|status> [args...]",
+	ShortHelp:  "Manage tailnet lock",
+	LongHelp: strings.TrimSpace(`
+With tailnet lock enabled, this node ignores peers whose node keys
+aren't signed by a trusted signing key. Signing keys are held by
+nodes in the tailnet, not by the control server.
+
+"tailscale lock init" gives this node a signing key and trusts it,
+along with the signing keys of any other nodes given, by their
+"tlpub:" public keys as shown by "tailscale lock status". New nodes
+must then be signed with "tailscale lock sign" on a trusted node
+before locked peers will talk to them.
+
+Each node keeps its own list of trusted signing keys; there is no
+tailnet-wide list. Run "tailscale lock init" on every node to be
+locked, and make changes with "tailscale lock add", "tailscale lock
+remove" or "tailscale lock disable" on each of them. To rotate a
+compromised signing key, add its replacement on every locked node,
+re-sign the nodes it had signed with the new key, and then remove
+the old key on every locked node.
+
+Signing node keys needs a control server that distributes the
+signatures, which isn't generally available yet. Until then,
+"tailscale lock init" and "tailscale lock sign" only work when
+tailscaled runs with TS_DEBUG_TAILNET_LOCK=1 in its environment.
+`),
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "init",
+			ShortUsage: "lock init [tlpub:KEY...]",
+			ShortHelp:  "Enable tailnet lock, trusting this node and the given signing keys",
+			Exec:       runLockInit,
+		},
+		{
+			Name:       "sign",
+			ShortUsage: "lock sign <nodekey:KEY>",
+			ShortHelp:  "Sign a node key with this node's signing key",
+			Exec:       runLockSign,
+		},
+		{
+			Name:       "add",
+			ShortUsage: "lock add <tlpub:KEY...>",
+			ShortHelp:  "Trust the given signing keys",
+			Exec:       runLockAdd,
+		},
+		{
+			Name:       "remove",
+			ShortUsage: "lock remove <tlpub:KEY...>",
+			ShortHelp:  "Stop trusting the given signing keys",
+			Exec:       runLockRemove,
+		},
+		{
+			Name:       "disable",
+			ShortUsage: "lock disable",
+			ShortHelp:  "Turn tailnet lock off on this node, forgetting its trusted keys",
+			Exec:       runLockDisable,
+		},
+		{
+			Name:       "status",
+			ShortUsage: "lock status",
+			ShortHelp:  "Show the state of tailnet lock",
+			Exec:       runLockStatus,
+		},
+	},
+}
+
+// parseSigningKeys parses the "tlpub:" public keys in args.
+func parseSigningKeys(args []string) ([]tka.PublicKey, error) {
+	var keys []tka.PublicKey
+	for _, arg := range args {
+		k, err := tka.ParsePublicKey(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %q: %v", arg, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func runLockInit(ctx context.Context, args []string) error {
+	trusted, err := parseSigningKeys(args)
+	if err != nil {
+		return err
+	}
+	st, err := tailscale.NetworkLockInit(ctx, trusted)
+	if err != nil {
+		return err
+	}
+	printLockStatus(st)
+	return nil
+}
+
+func runLockSign(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lock sign <nodekey:KEY>")
+	}
+	var nk tailcfg.NodeKey
+	if err := nk.UnmarshalText([]byte(args[0])); err != nil {
+		return fmt.Errorf("invalid node key %q: %v", args[0], err)
+	}
+	return tailscale.NetworkLockSign(ctx, nk)
+}
+
+func runLockAdd(ctx context.Context, args []string) error {
+	return runLockModify(ctx, args, "add", tailscale.NetworkLockAdd)
+}
+
+func runLockRemove(ctx context.Context, args []string) error {
+	return runLockModify(ctx, args, "remove", tailscale.NetworkLockRemove)
+}
+
+func runLockModify(ctx context.Context, args []string, verb string, modify func(context.Context, []tka.PublicKey) (*ipnstate.NetworkLockStatus, error)) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: lock %s <tlpub:KEY...>", verb)
+	}
+	keys, err := parseSigningKeys(args)
+	if err != nil {
+		return err
+	}
+	st, err := modify(ctx, keys)
+	if err != nil {
+		return err
+	}
+	printLockStatus(st)
+	return nil
+}
+
+func runLockDisable(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	st, err := tailscale.NetworkLockDisable(ctx)
+	if err != nil {
+		return err
+	}
+	printLockStatus(st)
+	return nil
+}
+
+func runLockStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	st, err := tailscale.NetworkLockStatus(ctx)
+	if err != nil {
+		return err
+	}
+	printLockStatus(st)
+	return nil
+}
+
+func printLockStatus(st *ipnstate.NetworkLockStatus) {
+	if st.Enabled {
+		fmt.Println("Tailnet lock is ENABLED.")
+	} else {
+		fmt.Println("Tailnet lock is NOT enabled.")
+	}
+	if st.PublicKey != nil {
+		fmt.Printf("This node's signing key: %v\n", *st.PublicKey)
+	}
+	if !st.NodeKey.IsZero() {
+		signed := ""
+		if st.Enabled && !st.NodeKeySigned {
+			signed = " (NOT signed by a trusted key)"
+		}
+		fmt.Printf("This node's node key: %v%s\n", st.NodeKey, signed)
+	}
+	if !st.Enabled {
+		return
+	}
+	fmt.Println("\nTrusted signing keys:")
+	for _, k := range st.TrustedKeys {
+		fmt.Printf("  %v\n", k)
+	}
+	if len(st.FilteredPeers) > 0 {
+		fmt.Println("\nIgnored peers:")
+		for _, p := range st.FilteredPeers {
+			fmt.Printf("  %s\t%v\t%s\n", p.Name, p.NodeKey, p.Error)
+		}
+	}
+}
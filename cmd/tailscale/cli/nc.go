@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var ncCmd = &ffcli.Command{
+	Name:       "nc",
+	ShortUsage: "nc <hostname-or-IP> <port>",
+	ShortHelp:  "Connect to a port on a host, connected to stdin/stdout",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale nc' command connects to a TCP port on a peer, through
+tailscaled, and copies the connection to and from stdin and stdout.
+It works even when tailscaled uses userspace networking and the
+machine has no TUN device, which makes it useful as an OpenSSH
+ProxyCommand:
+
+  ssh -o ProxyCommand='tailscale nc %h %p' host
+
+The host may be a peer's MagicDNS name or an IP reachable over the
+tailnet.
+
+`),
+	Exec: runNC,
+}
+
+func runNC(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: nc <hostname-or-IP> <port>")
+	}
+	host, portStr := args[0], args[1]
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port number %q", portStr)
+	}
+	c, err := tailscale.DialTCP(ctx, host, uint16(port))
+	if err != nil {
+		return fmt.Errorf("dialing %s:%d: %w", host, port, err)
+	}
+	defer c.Close()
+
+	// On stdin EOF, send EOF upstream but keep reading, so that a
+	// request piped in still gets its whole response. Once the
+	// upstream side is done, there's nothing left to do: if stdin
+	// hasn't reached EOF, the copy from it can't be interrupted.
+	stdinDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, os.Stdin)
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		stdinDone <- err
+	}()
+	if _, err := io.Copy(os.Stdout, c); err != nil {
+		return err
+	}
+	select {
+	case err := <-stdinDone:
+		return err
+	default:
+		return nil
+	}
+}
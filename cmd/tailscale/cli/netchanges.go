@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var netchangesCmd = &ffcli.Command{
+	Name:       "netchanges",
+	ShortUsage: "netchanges [accept]",
+	ShortHelp:  "Review and accept route and DNS changes from the tailnet",
+	LongHelp: strings.TrimSpace(`
+With "tailscale up --confirm-network-changes", changes to the subnet
+routes, exit node routes and DNS settings from the tailnet aren't
+applied until you accept them, so a mistake in the tailnet's policy
+can't silently reroute this machine's traffic.
+
+"tailscale netchanges" shows any change waiting to be accepted, and
+"tailscale netchanges accept" applies it.
+`),
+	Exec: runNetChanges,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("netchanges", flag.ExitOnError)
+		fs.BoolVar(&netchangesArgs.yes, "yes", false, "with accept, don't ask for confirmation")
+		return fs
+	})(),
+}
+
+var netchangesArgs struct {
+	yes bool
+}
+
+func runNetChanges(ctx context.Context, args []string) error {
+	accept := false
+	switch {
+	case len(args) == 1 && args[0] == "accept":
+		accept = true
+	case len(args) > 0:
+		return fmt.Errorf("unknown arguments %q; want none or \"accept\"", args)
+	}
+	nc, err := tailscale.NetworkChanges(ctx)
+	if err != nil {
+		return err
+	}
+	if nc.Pending == nil {
+		fmt.Println("No network changes are waiting to be accepted.")
+		return nil
+	}
+	fmt.Println("Network changes waiting to be accepted:")
+	for _, line := range networkConfigDiff(nc.Accepted, nc.Pending) {
+		fmt.Printf("  %s\n", line)
+	}
+	if !accept {
+		fmt.Println("\nRun \"tailscale netchanges accept\" to apply them.")
+		return nil
+	}
+	if !netchangesArgs.yes && !askYesNo(bufio.NewReader(os.Stdin), "Apply them?", false) {
+		fmt.Println("Nothing changed.")
+		return nil
+	}
+	if _, err := tailscale.AcceptNetworkChanges(ctx, nc.Pending); err != nil {
+		return err
+	}
+	fmt.Println("Applied.")
+	return nil
+}
+
+// networkConfigDiff describes the changes from was to now.
+func networkConfigDiff(was, now *ipn.NetworkConfig) []string {
+	if was == nil {
+		was = &ipn.NetworkConfig{}
+	}
+	var ret []string
+	wasRoutes := map[netaddr.IPPrefix]bool{}
+	for _, r := range was.Routes {
+		wasRoutes[r] = true
+	}
+	nowRoutes := map[netaddr.IPPrefix]bool{}
+	for _, r := range now.Routes {
+		nowRoutes[r] = true
+		if !wasRoutes[r] {
+			ret = append(ret, fmt.Sprintf("+ route %v%s", r, routeNote(r)))
+		}
+	}
+	for _, r := range was.Routes {
+		if !nowRoutes[r] {
+			ret = append(ret, fmt.Sprintf("- route %v%s", r, routeNote(r)))
+		}
+	}
+	add := func(name string, a, b interface{}) {
+		if as, bs := fmt.Sprint(a), fmt.Sprint(b); as != bs {
+			ret = append(ret, fmt.Sprintf("  %s: %s -> %s", name, as, bs))
+		}
+	}
+	add("DNS servers", orNone(ipsString(was.Nameservers)), orNone(ipsString(now.Nameservers)))
+	add("DNS search domains", orNone(strings.Join(was.Domains, ",")), orNone(strings.Join(now.Domains, ",")))
+	add("DNS servers only for search domains", was.PerDomain, now.PerDomain)
+	add("MagicDNS", was.Proxied, now.Proxied)
+	return ret
+}
+
+func routeNote(r netaddr.IPPrefix) string {
+	if r.Bits == 0 {
+		return " (all internet traffic, via an exit node)"
+	}
+	return ""
+}
+
+func ipsString(ips []netaddr.IP) string {
+	ss := make([]string, len(ips))
+	for i, ip := range ips {
+		ss[i] = ip.String()
+	}
+	return strings.Join(ss, ",")
+}
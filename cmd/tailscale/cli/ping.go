@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
@@ -21,7 +22,7 @@ import (
 
 var pingCmd = &ffcli.Command{
 	Name:       "ping",
-	ShortUsage: "ping <hostname-or-IP>",
+	ShortUsage: "ping <hostname-or-IP | group:name>",
 	ShortHelp:  "Ping a host at the Tailscale layer, see how it routed",
 	LongHelp: strings.TrimSpace(`
 
@@ -41,6 +42,9 @@ The provided hostname must resolve to or be a Tailscale IP
 (e.g. 100.x.y.z) or a subnet IP advertised by a Tailscale
 relay node.
 
+A target of the form "group:name" pings each member of the named
+peer group in turn; see "tailscale group".
+
 `),
 	Exec: runPing,
 	FlagSet: (func() *flag.FlagSet {
@@ -67,14 +71,29 @@ func runPing(ctx context.Context, args []string) error {
 	if len(args) != 1 || args[0] == "" {
 		return errors.New("usage: ping <hostname-or-IP>")
 	}
-	var ip string
+	targets := args
+	members, isGroup, err := peerGroupMembers(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if isGroup {
+		targets = members
+	}
+
+	var (
+		mu sync.Mutex
+		ip string // guarded by mu; the IP currently being pinged
+	)
 	prc := make(chan *ipnstate.PingResult, 1)
 	stc := make(chan *ipnstate.Status, 1)
 	bc.SetNotifyCallback(func(n ipn.Notify) {
 		if n.ErrMessage != nil {
 			log.Fatal(*n.ErrMessage)
 		}
-		if pr := n.PingResult; pr != nil && pr.IP == ip {
+		mu.Lock()
+		curIP := ip
+		mu.Unlock()
+		if pr := n.PingResult; pr != nil && pr.IP == curIP {
 			prc <- pr
 		}
 		if n.Status != nil {
@@ -83,36 +102,60 @@ func runPing(ctx context.Context, args []string) error {
 	})
 	go pump(ctx, bc, c)
 
-	hostOrIP := args[0]
+	var failed []string
+	for _, hostOrIP := range targets {
+		if isGroup {
+			fmt.Printf("--- %s\n", hostOrIP)
+		}
+		pingIP, err := resolvePingTarget(ctx, bc, stc, hostOrIP)
+		if err == nil {
+			mu.Lock()
+			ip = pingIP
+			mu.Unlock()
+			err = pingHost(ctx, bc, prc, pingIP)
+		}
+		if err != nil {
+			if !isGroup || ctx.Err() != nil {
+				return err
+			}
+			fmt.Printf("%s: %v\n", hostOrIP, err)
+			failed = append(failed, hostOrIP)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("no reply from %d of %d peers in %s: %s", len(failed), len(targets), args[0], strings.Join(failed, ", "))
+	}
+	return nil
+}
 
+// resolvePingTarget returns the IP address to ping for hostOrIP.
+func resolvePingTarget(ctx context.Context, bc *ipn.BackendClient, stc <-chan *ipnstate.Status, hostOrIP string) (ip string, err error) {
 	// If the argument is an IP address, use it directly without any resolution.
 	if net.ParseIP(hostOrIP) != nil {
-		ip = hostOrIP
+		return hostOrIP, nil
 	}
 
 	// Otherwise, try to resolve it first from the network peer list.
-	if ip == "" {
-		bc.RequestStatus()
-		select {
-		case st := <-stc:
-			for _, ps := range st.Peer {
-				if hostOrIP == dnsOrQuoteHostname(st, ps) || hostOrIP == ps.DNSName {
-					ip = ps.TailAddr
-					break
-				}
+	bc.RequestStatus()
+	select {
+	case st := <-stc:
+		for _, ps := range st.Peer {
+			if hostOrIP == dnsOrQuoteHostname(st, ps) || hostOrIP == ps.DNSName {
+				ip = ps.TailAddr
+				break
 			}
-		case <-ctx.Done():
-			return ctx.Err()
 		}
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
 
 	// Finally, use DNS.
 	if ip == "" {
 		var res net.Resolver
 		if addrs, err := res.LookupHost(ctx, hostOrIP); err != nil {
-			return fmt.Errorf("error looking up IP of %q: %v", hostOrIP, err)
+			return "", fmt.Errorf("error looking up IP of %q: %v", hostOrIP, err)
 		} else if len(addrs) == 0 {
-			return fmt.Errorf("no IPs found for %q", hostOrIP)
+			return "", fmt.Errorf("no IPs found for %q", hostOrIP)
 		} else {
 			ip = addrs[0]
 		}
@@ -120,7 +163,12 @@ func runPing(ctx context.Context, args []string) error {
 	if pingArgs.verbose && ip != hostOrIP {
 		log.Printf("lookup %q => %q", hostOrIP, ip)
 	}
+	return ip, nil
+}
 
+// pingHost pings ip until it gets a direct reply (if --until-direct)
+// or has sent --c pings.
+func pingHost(ctx context.Context, bc *ipn.BackendClient, prc <-chan *ipnstate.PingResult, ip string) error {
 	n := 0
 	anyPong := false
 	for {
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var serveCmd = &ffcli.Command{
+	Name:       "serve",
+	ShortUsage: "serve [flags] <port|url|path> | serve status | serve off [flags]",
+	ShortHelp:  "Serve a local service or files on your tailnet",
+	LongHelp: strings.TrimSpace(`
+"tailscale serve" makes a local web server, or local files, available
+to the rest of your tailnet on this machine's Tailscale IPs. For
+example:
+
+  tailscale serve 3000                 proxy port 80 to localhost:3000
+  tailscale serve --https /srv/www     serve files over HTTPS on port 443
+  tailscale serve --port 8080 http://127.0.0.1:9090
+
+Proxied requests carry the Tailscale-User-Login and Tailscale-User-Name
+headers of the user making them. HTTPS uses a self-signed certificate.
+The configuration is kept across restarts until removed with
+"tailscale serve off".
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		fs.UintVar(&serveArgs.port, "port", 0, "port to serve on (default 80, or 443 with --https)")
+		fs.BoolVar(&serveArgs.https, "https", false, "serve HTTPS instead of HTTP")
+		return fs
+	})(),
+	Exec: runServe,
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "status",
+			ShortUsage: "serve status",
+			ShortHelp:  "Show what's being served",
+			Exec:       runServeStatus,
+		},
+		{
+			Name:       "off",
+			ShortUsage: "serve off [--port=N]",
+			ShortHelp:  "Stop serving on a port, or on all ports",
+			FlagSet: (func() *flag.FlagSet {
+				fs := flag.NewFlagSet("off", flag.ExitOnError)
+				fs.UintVar(&serveArgs.offPort, "port", 0, "port to stop serving on; all ports if unset")
+				return fs
+			})(),
+			Exec: runServeOff,
+		},
+	},
+}
+
+var serveArgs struct {
+	port    uint
+	https   bool
+	offPort uint
+}
+
+func runServe(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	port := serveArgs.port
+	if port == 0 {
+		port = 80
+		if serveArgs.https {
+			port = 443
+		}
+	}
+	if port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	target := args[0]
+	if strings.HasPrefix(target, ".") {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		target = abs
+	}
+	h, err := ipn.ParseServeTarget(uint16(port), serveArgs.https, target)
+	if err != nil {
+		return err
+	}
+	handlers, err := tailscale.Serve(ctx)
+	if err != nil {
+		return err
+	}
+	var replaced bool
+	for i := range handlers {
+		if handlers[i].Port == h.Port {
+			handlers[i] = h
+			replaced = true
+		}
+	}
+	if !replaced {
+		handlers = append(handlers, h)
+	}
+	if _, err := tailscale.SetServe(ctx, handlers); err != nil {
+		return err
+	}
+	fmt.Printf("serving %v\n", h)
+	return nil
+}
+
+func runServeStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	handlers, err := tailscale.Serve(ctx)
+	if err != nil {
+		return err
+	}
+	if len(handlers) == 0 {
+		fmt.Println("not serving anything")
+		return nil
+	}
+	for _, h := range handlers {
+		fmt.Println(h)
+	}
+	return nil
+}
+
+func runServeOff(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	handlers, err := tailscale.Serve(ctx)
+	if err != nil {
+		return err
+	}
+	var keep []ipn.ServeHandler
+	if serveArgs.offPort != 0 {
+		for _, h := range handlers {
+			if uint(h.Port) != serveArgs.offPort {
+				keep = append(keep, h)
+			}
+		}
+		if len(keep) == len(handlers) {
+			return errors.New("not serving on that port")
+		}
+	}
+	_, err = tailscale.SetServe(ctx, keep)
+	return err
+}
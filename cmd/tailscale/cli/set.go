@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var setCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "set [flags]",
+	ShortHelp:  "Change specified preferences",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale set' command changes the preferences whose flags are
+given, leaving the rest as they are, and applies them without
+reconnecting. Unlike 'tailscale up', it doesn't need every
+previously-set flag restated.
+
+`),
+	FlagSet: setFlagSet,
+	Exec:    runSet,
+}
+
+var setFlagSet = (func() *flag.FlagSet {
+	setf := flag.NewFlagSet("set", flag.ExitOnError)
+	setf.StringVar(&setArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty for none")
+	setf.BoolVar(&setArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	setf.StringVar(&setArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS, or empty for the OS's")
+	if runtime.GOOS == "linux" || isBSD(runtime.GOOS) {
+		setf.StringVar(&setArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24), or empty for none")
+		setf.BoolVar(&setArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	}
+	return setf
+})()
+
+var setArgs struct {
+	exitNodeIP            string
+	shieldsUp             bool
+	hostname              string
+	advertiseRoutes       string
+	advertiseDefaultRoute bool
+}
+
+func runSet(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	setFlags := map[string]bool{}
+	setFlagSet.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if len(setFlags) == 0 {
+		return errors.New("no preferences specified; see 'tailscale set --help'")
+	}
+
+	mp := new(ipn.MaskedPrefs)
+	if setFlags["exit-node"] {
+		if setArgs.exitNodeIP != "" {
+			ip, err := netaddr.ParseIP(setArgs.exitNodeIP)
+			if err != nil {
+				return fmt.Errorf("invalid IP address %q for --exit-node: %v", setArgs.exitNodeIP, err)
+			}
+			mp.ExitNodeIP = ip
+		}
+		mp.ExitNodeIPSet = true
+	}
+	if setFlags["shields-up"] {
+		mp.ShieldsUp = setArgs.shieldsUp
+		mp.ShieldsUpSet = true
+	}
+	if setFlags["hostname"] {
+		if len(setArgs.hostname) > 256 {
+			return fmt.Errorf("hostname too long: %d bytes (max 256)", len(setArgs.hostname))
+		}
+		mp.Hostname = setArgs.hostname
+		mp.HostnameSet = true
+	}
+	if setFlags["advertise-routes"] || setFlags["advertise-exit-node"] {
+		routes, err := setAdvertiseRoutes(ctx, setFlags)
+		if err != nil {
+			return err
+		}
+		if len(routes) > 0 {
+			checkIPForwarding(routes)
+		}
+		mp.AdvertiseRoutes = routes
+		mp.AdvertiseRoutesSet = true
+	}
+
+	_, err := tailscale.EditPrefs(ctx, mp)
+	return err
+}
+
+// setAdvertiseRoutes returns the routes to advertise after "set",
+// given which of --advertise-routes and --advertise-exit-node were
+// specified. The one that wasn't keeps its current value.
+func setAdvertiseRoutes(ctx context.Context, setFlags map[string]bool) ([]netaddr.IPPrefix, error) {
+	advertiseRoutes, advertiseDefaultRoute := setArgs.advertiseRoutes, setArgs.advertiseDefaultRoute
+	if !setFlags["advertise-routes"] || !setFlags["advertise-exit-node"] {
+		curPrefs, err := tailscale.GetPrefs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var subnets []string
+		var isExitNode bool
+		for _, r := range curPrefs.AdvertiseRoutes {
+			if r == ipv4default || r == ipv6default {
+				isExitNode = true
+			} else {
+				subnets = append(subnets, r.String())
+			}
+		}
+		if !setFlags["advertise-routes"] {
+			advertiseRoutes = strings.Join(subnets, ",")
+		}
+		if !setFlags["advertise-exit-node"] {
+			advertiseDefaultRoute = isExitNode
+		}
+	}
+	return calcAdvertiseRoutes(advertiseRoutes, advertiseDefaultRoute)
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/version/distro"
+)
+
+var setupCmd = &ffcli.Command{
+	Name:       "setup",
+	ShortUsage: "setup",
+	ShortHelp:  "Interactively log in and configure this machine",
+	LongHelp: strings.TrimSpace(`
+"tailscale setup" walks through logging in and the most common settings
+(hostname, exit node, advertised routes and Tailscale SSH), one question
+at a time. It shows the changes before making them, and only changes
+the settings it asks about.
+
+Press Enter at any question to keep the current setting.
+`),
+	Exec: runSetup,
+}
+
+func runSetup(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	in := bufio.NewReader(os.Stdin)
+
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("can't fetch status from tailscaled: %v", err)
+	}
+	if st.BackendState == ipn.NeedsLogin.String() || st.BackendState == ipn.NoState.String() {
+		fmt.Println("This machine isn't logged in to Tailscale.")
+		if !askYesNo(in, "Log in now?", true) {
+			return nil
+		}
+		if err := setupLogin(ctx); err != nil {
+			return err
+		}
+	}
+
+	cur, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	prefs := cur.Clone()
+
+	fmt.Println()
+	defHostname := prefs.Hostname
+	if defHostname == "" {
+		defHostname, _ = os.Hostname()
+	}
+	for {
+		h := ask(in, "Hostname", defHostname)
+		if len(h) > 256 {
+			fmt.Printf("hostname too long: %d bytes (max 256)\n", len(h))
+			continue
+		}
+		if h != defHostname || prefs.Hostname != "" {
+			prefs.Hostname = h
+		}
+		break
+	}
+
+	if distro.Get() != distro.Synology {
+		if err := setupExitNode(ctx, in, prefs); err != nil {
+			return err
+		}
+	}
+
+	if (runtime.GOOS == "linux" || isBSD(runtime.GOOS)) && distro.Get() != distro.Synology {
+		setupRoutes(in, prefs)
+	}
+
+	if runtime.GOOS == "linux" {
+		prefs.RunSSH = askYesNo(in, "Run Tailscale SSH, so tailnet users can SSH in as themselves?", prefs.RunSSH)
+	}
+	prefs.WantRunning = true
+
+	changes := prefsChanges(cur, prefs)
+	fmt.Println()
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+	fmt.Println("Changes:")
+	for _, c := range changes {
+		fmt.Printf("  %s\n", c)
+	}
+	if !askYesNo(in, "Apply?", true) {
+		fmt.Println("Nothing changed.")
+		return nil
+	}
+	if _, err := tailscale.SetPrefs(ctx, prefs); err != nil {
+		return err
+	}
+	fmt.Println("Done.")
+	return nil
+}
+
+// setupLogin starts an interactive login and waits for it to finish,
+// printing the URL to visit.
+func setupLogin(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var started bool
+	err := tailscale.WatchIPNBus(ctx, func(n ipn.Notify) bool {
+		if n.ErrMessage != nil {
+			fmt.Fprintf(os.Stderr, "backend error: %v\n", *n.ErrMessage)
+		}
+		if !started {
+			// The first notification is the current state; start
+			// the login only once we're watching for its URL.
+			started = true
+			if err := tailscale.StartLoginInteractive(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "can't start login: %v\n", err)
+				return false
+			}
+		}
+		if url := n.BrowseToURL; url != nil {
+			fmt.Printf("\nTo log in, visit:\n\n\t%s\n\n", *url)
+		}
+		if s := n.State; s != nil {
+			switch *s {
+			case ipn.NeedsMachineAuth:
+				fmt.Println("Logged in. An admin needs to authorize this machine before it can connect.")
+				return false
+			case ipn.Starting, ipn.Running:
+				fmt.Println("Logged in.")
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// setupExitNode asks which peer, if any, to use as an exit node.
+func setupExitNode(ctx context.Context, in *bufio.Reader, prefs *ipn.Prefs) error {
+	nm, err := tailscale.NetMap(ctx)
+	if err != nil {
+		return err
+	}
+	var options []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if isExitNodeOption(p) && len(p.Addresses) > 0 {
+			options = append(options, p)
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+
+	fmt.Println("\nExit nodes route your internet traffic through another machine:")
+	fmt.Println("  0: none")
+	def := "0"
+	for i, p := range options {
+		ip := p.Addresses[0].IP
+		fmt.Printf("  %d: %s (%v)\n", i+1, strings.TrimSuffix(p.Name, "."), ip)
+		if ip == prefs.ExitNodeIP {
+			def = strconv.Itoa(i + 1)
+		}
+	}
+	for {
+		n, err := strconv.Atoi(ask(in, "Exit node", def))
+		if err != nil || n < 0 || n > len(options) {
+			fmt.Printf("enter a number from 0 to %d\n", len(options))
+			continue
+		}
+		if n == 0 {
+			prefs.ExitNodeIP = netaddr.IP{}
+		} else {
+			prefs.ExitNodeIP = options[n-1].Addresses[0].IP
+		}
+		return nil
+	}
+}
+
+// isExitNodeOption reports whether n is allowed to route internet
+// traffic.
+func isExitNodeOption(n *tailcfg.Node) bool {
+	var v4, v6 bool
+	for _, r := range n.AllowedIPs {
+		v4 = v4 || r == ipv4default
+		v6 = v6 || r == ipv6default
+	}
+	return v4 && v6
+}
+
+// setupRoutes asks which subnet routes to advertise and whether to
+// offer to be an exit node.
+func setupRoutes(in *bufio.Reader, prefs *ipn.Prefs) {
+	var subnets []string
+	var wasExitNode bool
+	for _, r := range prefs.AdvertiseRoutes {
+		if r == ipv4default || r == ipv6default {
+			wasExitNode = true
+			continue
+		}
+		subnets = append(subnets, r.String())
+	}
+
+	fmt.Println("\nSubnet routes let other machines reach networks this machine is on.")
+	for {
+		s := ask(in, "Subnet routes to advertise (comma-separated, or \"none\")", orNone(strings.Join(subnets, ",")))
+		if s == "none" {
+			s = ""
+		}
+		exitNode := askYesNo(in, "Offer to be an exit node for the tailnet?", wasExitNode)
+		routes, err := calcAdvertiseRoutes(s, exitNode)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(routes) > 0 {
+			checkIPForwarding(routes)
+		}
+		prefs.AdvertiseRoutes = routes
+		return
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// prefsChanges returns a description of each setting "tailscale
+// setup" asks about that differs between was and now.
+func prefsChanges(was, now *ipn.Prefs) []string {
+	var ret []string
+	add := func(name string, a, b interface{}) {
+		if as, bs := fmt.Sprint(a), fmt.Sprint(b); as != bs {
+			ret = append(ret, fmt.Sprintf("%s: %s -> %s", name, as, bs))
+		}
+	}
+	add("connected", was.WantRunning, now.WantRunning)
+	add("hostname", orDefault(was.Hostname), orDefault(now.Hostname))
+	add("exit node", orNone(ipString(was.ExitNodeIP)), orNone(ipString(now.ExitNodeIP)))
+	add("advertised routes", orNone(prefixesString(was.AdvertiseRoutes)), orNone(prefixesString(now.AdvertiseRoutes)))
+	add("Tailscale SSH", was.RunSSH, now.RunSSH)
+	return ret
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "(OS default)"
+	}
+	return s
+}
+
+func ipString(ip netaddr.IP) string {
+	if ip.IsZero() {
+		return ""
+	}
+	return ip.String()
+}
+
+func prefixesString(pp []netaddr.IPPrefix) string {
+	ss := make([]string, len(pp))
+	for i, p := range pp {
+		ss[i] = p.String()
+	}
+	return strings.Join(ss, ",")
+}
+
+// ask prints question and returns the line the user types, or def if
+// they type nothing.
+func ask(in *bufio.Reader, question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := in.ReadString('\n')
+	if err == io.EOF && line == "" {
+		fatalf("\nsetup aborted")
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+// askYesNo asks a yes/no question, returning def if the user just
+// presses Enter.
+func askYesNo(in *bufio.Reader, question string, def bool) bool {
+	opts := "y/N"
+	if def {
+		opts = "Y/n"
+	}
+	for {
+		fmt.Printf("%s [%s]: ", question, opts)
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			fatalf("\nsetup aborted")
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
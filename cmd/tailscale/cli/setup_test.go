@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+func answers(lines ...string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+}
+
+func TestAskYesNo(t *testing.T) {
+	tests := []struct {
+		input string
+		def   bool
+		want  bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"y", false, true},
+		{"No", true, false},
+		{"maybe\nyes", false, true}, // asks again
+	}
+	for _, tt := range tests {
+		if got := askYesNo(answers(tt.input), "?", tt.def); got != tt.want {
+			t.Errorf("askYesNo(%q, def %v) = %v; want %v", tt.input, tt.def, got, tt.want)
+		}
+	}
+}
+
+func TestSetupRoutes(t *testing.T) {
+	subnet := netaddr.MustParseIPPrefix("192.168.1.0/24")
+	tests := []struct {
+		name   string
+		routes []netaddr.IPPrefix
+		input  []string
+		want   []netaddr.IPPrefix
+	}{
+		{
+			name:   "keep_current",
+			routes: []netaddr.IPPrefix{subnet, ipv4default, ipv6default},
+			input:  []string{"", ""},
+			want:   []netaddr.IPPrefix{ipv4default, ipv6default, subnet},
+		},
+		{
+			name:   "none",
+			routes: []netaddr.IPPrefix{subnet},
+			input:  []string{"none", "n"},
+			want:   []netaddr.IPPrefix{},
+		},
+		{
+			name:  "invalid_then_valid",
+			input: []string{"bogus", "n", "192.168.1.0/24", "y"},
+			want:  []netaddr.IPPrefix{ipv4default, ipv6default, subnet},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefs := &ipn.Prefs{AdvertiseRoutes: tt.routes}
+			setupRoutes(answers(tt.input...), prefs)
+			if !reflect.DeepEqual(prefs.AdvertiseRoutes, tt.want) {
+				t.Errorf("routes = %v; want %v", prefs.AdvertiseRoutes, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefsChanges(t *testing.T) {
+	was := &ipn.Prefs{WantRunning: true, Hostname: "old"}
+	now := was.Clone()
+	if got := prefsChanges(was, now); len(got) != 0 {
+		t.Errorf("no edits: changes = %q", got)
+	}
+
+	now.Hostname = ""
+	now.ExitNodeIP = netaddr.MustParseIP("100.64.0.1")
+	now.RunSSH = true
+	want := []string{
+		"hostname: old -> (OS default)",
+		"exit node: none -> 100.64.0.1",
+		"Tailscale SSH: false -> true",
+	}
+	if got := prefsChanges(was, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %q; want %q", got, want)
+	}
+}
+
+func TestIsExitNodeOption(t *testing.T) {
+	n := &tailcfg.Node{AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32"), ipv4default}}
+	if isExitNodeOption(n) {
+		t.Error("node allowing only IPv4 default route is an exit node option")
+	}
+	n.AllowedIPs = append(n.AllowedIPs, ipv6default)
+	if !isExitNodeOption(n) {
+		t.Error("node allowing both default routes isn't an exit node option")
+	}
+}
@@ -15,19 +15,22 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"github.com/toqueteos/webbrowser"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/tailcfg"
 	"tailscale.com/util/dnsname"
 )
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [-active] [-web] [-json]",
+	ShortUsage: "status [-active] [-services] [-web] [-json] [-name=glob] [-tag=tag] [-group=name] [-online] [-limit=N] [-health]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	Exec:       runStatus,
 	FlagSet: (func() *flag.FlagSet {
@@ -37,20 +40,34 @@ var statusCmd = &ffcli.Command{
 		fs.BoolVar(&statusArgs.active, "active", false, "filter output to only peers with active sessions (not applicable to web mode)")
 		fs.BoolVar(&statusArgs.self, "self", true, "show status of local machine")
 		fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
+		fs.BoolVar(&statusArgs.services, "services", false, "show services advertised by each machine")
+		fs.BoolVar(&statusArgs.health, "health", false, "show the health summary each machine publishes: version, warnings and key expiry")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.StringVar(&statusArgs.filter.Name, "name", "", "filter peers to those whose name or hostname matches this shell glob")
+		fs.StringVar(&statusArgs.filter.Tag, "tag", "", "filter peers to those advertising this ACL tag")
+		fs.StringVar(&statusArgs.filter.Group, "group", "", "filter peers to members of this peer group (see 'tailscale group')")
+		fs.BoolVar(&statusArgs.online, "online", false, "filter peers to those with a recent WireGuard handshake")
+		fs.IntVar(&statusArgs.filter.Offset, "offset", 0, "skip this many matching peers (sorted by name)")
+		fs.IntVar(&statusArgs.filter.Limit, "limit", 0, "show at most this many matching peers; 0 means no limit")
+		fs.BoolVar(&statusArgs.filter.Summary, "summary", false, "in JSON mode, show only each peer's names, owner and address")
 		return fs
 	})(),
 }
 
 var statusArgs struct {
-	json    bool   // JSON output mode
-	web     bool   // run webserver
-	listen  string // in web mode, webserver address to listen on, empty means auto
-	browser bool   // in web mode, whether to open browser
-	active  bool   // in CLI mode, filter output to only peers with active sessions
-	self    bool   // in CLI mode, show status of local machine
-	peers   bool   // in CLI mode, show status of peer machines
+	json     bool   // JSON output mode
+	web      bool   // run webserver
+	listen   string // in web mode, webserver address to listen on, empty means auto
+	browser  bool   // in web mode, whether to open browser
+	active   bool   // in CLI mode, filter output to only peers with active sessions
+	self     bool   // in CLI mode, show status of local machine
+	peers    bool   // in CLI mode, show status of peer machines
+	services bool   // in CLI mode, show services advertised by machines
+	health   bool   // in CLI mode, show machines' health summaries
+	online   bool   // filter output to only online peers
+
+	filter ipnstate.StatusFilter // peer filter applied by tailscaled
 }
 
 func getStatusFromServer(ctx context.Context, c net.Conn, bc *ipn.BackendClient) func() (*ipnstate.Status, error) {
@@ -87,6 +104,19 @@ func getStatusFromServer(ctx context.Context, c net.Conn, bc *ipn.BackendClient)
 }
 
 func runStatus(ctx context.Context, args []string) error {
+	if statusArgs.online {
+		statusArgs.filter.Online = &statusArgs.online
+	}
+	if !statusArgs.filter.IsZero() && !statusArgs.web {
+		// Let tailscaled do the filtering, so that on large
+		// tailnets only the selected peers are sent.
+		st, err := tailscale.StatusWithFilter(ctx, statusArgs.filter)
+		if err != nil {
+			return err
+		}
+		return printStatus(st)
+	}
+
 	c, bc, ctx, cancel := connect(ctx)
 	defer cancel()
 
@@ -97,6 +127,45 @@ func runStatus(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	if !statusArgs.web {
+		return printStatus(st)
+	}
+
+	ln, err := net.Listen("tcp", statusArgs.listen)
+	if err != nil {
+		return err
+	}
+	statusURL := interfaces.HTTPOfListener(ln)
+	fmt.Printf("Serving Tailscale status at %v ...\n", statusURL)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	if statusArgs.browser {
+		go webbrowser.Open(statusURL)
+	}
+	err = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		st, err := getStatus()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		st.WriteHTML(w)
+	}))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// printStatus prints st in the text or JSON form selected by the
+// command line flags.
+func printStatus(st *ipnstate.Status) error {
 	if statusArgs.json {
 		if statusArgs.active {
 			for peer, ps := range st.Peer {
@@ -112,44 +181,17 @@ func runStatus(ctx context.Context, args []string) error {
 		fmt.Printf("%s", j)
 		return nil
 	}
-	if statusArgs.web {
-		ln, err := net.Listen("tcp", statusArgs.listen)
-		if err != nil {
-			return err
-		}
-		statusURL := interfaces.HTTPOfListener(ln)
-		fmt.Printf("Serving Tailscale status at %v ...\n", statusURL)
-		go func() {
-			<-ctx.Done()
-			ln.Close()
-		}()
-		if statusArgs.browser {
-			go webbrowser.Open(statusURL)
-		}
-		err = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.RequestURI != "/" {
-				http.NotFound(w, r)
-				return
-			}
-			st, err := getStatus()
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			st.WriteHTML(w)
-		}))
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		return err
-	}
 
 	if st.BackendState == ipn.Stopped.String() {
 		fmt.Println("Tailscale is stopped.")
 		os.Exit(1)
 	}
 
+	if statusArgs.health {
+		printHealth(st)
+		return nil
+	}
+
 	var buf bytes.Buffer
 	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
 	printPS := func(ps *ipnstate.PeerStatus) {
@@ -185,6 +227,9 @@ func runStatus(ctx context.Context, args []string) error {
 			f(", tx %d rx %d", ps.TxBytes, ps.RxBytes)
 		}
 		f("\n")
+		if statusArgs.services && len(ps.Services) > 0 {
+			f("    services: %s\n", servicesString(ps.Services))
+		}
 	}
 
 	if statusArgs.self && st.Self != nil {
@@ -209,9 +254,95 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 	}
 	os.Stdout.Write(buf.Bytes())
+	if st.PeerTotal != nil && *st.PeerTotal > len(st.Peer) {
+		fmt.Printf("(showing %d of %d matching peers)\n", len(st.Peer), *st.PeerTotal)
+	}
+	if len(st.Health) > 0 {
+		fmt.Println("# Health check:")
+		for _, m := range st.Health {
+			fmt.Printf("#     - %s\n", m)
+		}
+	}
 	return nil
 }
 
+// healthStaleAfter is how long a machine can go unseen by the
+// control server before its health summary is shown as stale.
+// Machines only republish the summary when it changes, so its own
+// age says nothing about staleness.
+const healthStaleAfter = 2 * time.Hour
+
+// printHealth prints a table of the health summaries of the machines
+// in st.
+func printHealth(st *ipnstate.Status) {
+	var peers []*ipnstate.PeerStatus
+	if statusArgs.self && st.Self != nil {
+		peers = append(peers, st.Self)
+	}
+	if statusArgs.peers {
+		var ps []*ipnstate.PeerStatus
+		for _, p := range st.Peer {
+			if !p.ShareeNode && (!statusArgs.active || peerActive(p)) {
+				ps = append(ps, p)
+			}
+		}
+		ipnstate.SortPeers(ps)
+		peers = append(peers, ps...)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "MACHINE\tVERSION\tWARNINGS\tKEY EXPIRY\tCHANGED\n")
+	for _, ps := range peers {
+		version := ps.Version
+		if version == "" {
+			version = "-"
+		}
+		h := ps.Health
+		if h == nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\tno health summary\n", dnsOrQuoteHostname(st, ps), version)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			dnsOrQuoteHostname(st, ps), version, h.Warnings,
+			keyExpiryString(h.KeyExpiry, now), updatedString(h.Updated, ps.LastSeen, now))
+	}
+	tw.Flush()
+}
+
+// keyExpiryString describes a key expiring at t, as of now.
+func keyExpiryString(t, now time.Time) string {
+	switch {
+	case t.IsZero():
+		return "never"
+	case !t.After(now):
+		return "EXPIRED"
+	}
+	d := t.Sub(now)
+	if d < 48*time.Hour {
+		return fmt.Sprintf("in %v", d.Round(time.Minute))
+	}
+	return fmt.Sprintf("in %dd", int(d/(24*time.Hour)))
+}
+
+// updatedString describes a health summary last changed at t, as of
+// now, marking it stale if its machine was last seen by the control
+// server long before now. A zero lastSeen means it's connected.
+func updatedString(t, lastSeen, now time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	d := now.Sub(t)
+	if d < time.Minute {
+		d = 0
+	}
+	s := fmt.Sprintf("%v ago", d.Round(time.Minute))
+	if !lastSeen.IsZero() && now.Sub(lastSeen) > healthStaleAfter {
+		s += " (STALE)"
+	}
+	return s
+}
+
 // peerActive reports whether ps has recent activity.
 //
 // TODO: have the server report this bool instead.
@@ -219,6 +350,22 @@ func peerActive(ps *ipnstate.PeerStatus) bool {
 	return !ps.LastWrite.IsZero() && time.Since(ps.LastWrite) < 2*time.Minute
 }
 
+// servicesString returns a human-readable summary of svcs, such
+// as "tcp/22 (sshd), tcp/80".
+func servicesString(svcs []tailcfg.Service) string {
+	var sb strings.Builder
+	for i, s := range svcs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s/%d", s.Proto, s.Port)
+		if s.Description != "" {
+			fmt.Fprintf(&sb, " (%s)", s.Description)
+		}
+	}
+	return sb.String()
+}
+
 func dnsOrQuoteHostname(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 	baseName := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix)
 	if baseName != "" {
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var switchCmd = &ffcli.Command{
+	Name:       "switch",
+	ShortUsage: "switch [--list | --delete] [profile]",
+	ShortHelp:  "Switch to a different login profile",
+	LongHelp: strings.TrimSpace(`
+"tailscale switch" switches tailscaled between login profiles. Each
+profile keeps its own preferences and node key, so you can move
+between tailnets or accounts without logging out and back in.
+
+Switching to a profile that doesn't exist creates it; run
+"tailscale up" afterwards to log it in.
+
+With no arguments, or with --list, the profiles are listed and the
+current one is marked with an asterisk.
+`),
+	Exec: runSwitch,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("switch", flag.ExitOnError)
+		fs.BoolVar(&switchArgs.list, "list", false, "list login profiles")
+		fs.BoolVar(&switchArgs.delete, "delete", false, "delete the named profile instead of switching to it")
+		return fs
+	})(),
+}
+
+var switchArgs struct {
+	list   bool
+	delete bool
+}
+
+func runSwitch(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	var lp *ipn.LoginProfiles
+	var err error
+	switch {
+	case switchArgs.list || len(args) == 0:
+		if switchArgs.delete {
+			return errors.New("--delete requires a profile name")
+		}
+		lp, err = tailscale.Profiles(ctx)
+	case switchArgs.delete:
+		lp, err = tailscale.DeleteProfile(ctx, args[0])
+	default:
+		lp, err = tailscale.SwitchProfile(ctx, args[0])
+		if err == nil {
+			fmt.Printf("Switched to profile %q.\n", lp.Current)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range lp.Profiles {
+		mark := " "
+		if name == lp.Current {
+			mark = "*"
+		}
+		fmt.Printf("%s %s\n", mark, name)
+	}
+	return nil
+}
@@ -5,25 +5,30 @@
 package cli
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/net/ipforward"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/flagtype"
+	"tailscale.com/types/netmap"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/qrcode"
 	"tailscale.com/version/distro"
 )
 
@@ -36,34 +41,60 @@ var upCmd = &ffcli.Command{
 "tailscale up" connects this machine to your Tailscale network,
 triggering authentication if necessary.
 
-The flags passed to this command are specific to this machine. If you don't
-specify any flags, options are reset to their default.
+The flags passed to this command are specific to this machine. Settings
+whose flags you don't specify return to their defaults, so "tailscale up"
+refuses to change a setting made earlier unless you specify its flag
+again (it prints the full command to do so) or pass --reset.
+
+On headless machines, --authkey=file:/path reads the auth key from a
+file such as a mounted secret, and --qr shows the login URL as a QR
+code to scan with a phone.
 `),
-	FlagSet: (func() *flag.FlagSet {
-		upf := flag.NewFlagSet("up", flag.ExitOnError)
-		upf.StringVar(&upArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server")
-		upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
-		upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
-		upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
-		upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic")
-		upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
-		upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
-		upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. eng,montreal,ssh)")
-		upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
-		upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
-		if runtime.GOOS == "linux" || isBSD(runtime.GOOS) {
-			upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
-			upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
-		}
-		if runtime.GOOS == "linux" {
-			upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
-			upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
-		}
-		return upf
-	})(),
-	Exec: runUp,
+	FlagSet: upFlagSet,
+	Exec:    runUp,
 }
 
+var upFlagSet = (func() *flag.FlagSet {
+	upf := flag.NewFlagSet("up", flag.ExitOnError)
+	upf.StringVar(&upArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server")
+	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
+	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
+	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic")
+	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
+	upf.BoolVar(&upArgs.reset, "reset", false, "reset settings whose flags aren't specified to their default values")
+	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. eng,montreal,ssh)")
+	upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key, or \"file:\" followed by the path of a file containing one")
+	upf.StringVar(&upArgs.authKey, "auth-key", "", "alias for --authkey")
+	upf.BoolVar(&upArgs.qr, "qr", false, "also show the login URL as a QR code, for logging in from a phone")
+	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+	upf.StringVar(&upArgs.certDomains, "cert-domains", "", "custom domains CNAMEd to this machine that \"tailscale cert\" and HTTPS serve may get certificates for (comma-separated)")
+	upf.StringVar(&upArgs.alwaysOnPeers, "always-on-peers", "", "peers to keep WireGuard sessions up with, rather than dropping them when idle (comma-separated names, Tailscale IPs, or \"*\" for all)")
+	upf.DurationVar(&upArgs.keepalive, "keepalive-interval", 0, "WireGuard persistent keepalive interval for --always-on-peers; 0 means to pick one based on the local NAT")
+	upf.DurationVar(&upArgs.peerIdleTimeout, "peer-idle-timeout", 0, "how long a peer may be idle before its WireGuard session is dropped (min 30s); lower saves battery; 0 means 5m")
+	upf.Var(flagtype.PortValue(&upArgs.listenPort, 0), "listen-port", "UDP port to listen on for WireGuard and peer-to-peer traffic, overriding tailscaled's --port; 0 means use tailscaled's")
+	upf.StringVar(&upArgs.derpMapFile, "derp-map-file", "", "JSON file of DERP regions to merge into (or, with \"OmitDefaultRegions\", replace) the control server's; reloaded when changed")
+	upf.IntVar(&upArgs.preferredDERP, "preferred-derp", 0, "ID of the DERP region to use as home, rather than the one measured fastest; 0 means automatic")
+	upf.BoolVar(&upArgs.confirmNetChanges, "confirm-network-changes", false, "hold subnet route, exit node route and DNS changes from the tailnet until accepted with \"tailscale netchanges accept\"")
+	upf.BoolVar(&upArgs.ephemeral, "ephemeral", false, "register as an ephemeral node, which the tailnet deletes soon after it goes offline, and log out when tailscaled stops; for CI runners and autoscaled containers (use with --authkey, and tailscaled --state=mem: to keep no state on disk)")
+	upf.BoolVar(&upArgs.updateCheck, "update-check", true, "check daily for a newer Tailscale release and report it in health notices, if this build has a signed release manifest to check")
+	upf.BoolVar(&upArgs.autoUpdate, "auto-update", false, "install newer Tailscale releases found by the update check, using the system's package manager where there is one")
+	upf.StringVar(&upArgs.advertiseServices, "advertise-services", "", "local ports to advertise to other nodes as services (comma-separated, e.g. 22,80,443); if empty, a default policy applies")
+	if runtime.GOOS == "linux" || isBSD(runtime.GOOS) {
+		upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
+		upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+		upf.StringVar(&upArgs.appConnectorDomains, "app-connector-domains", "", "domains to route to through this node, advertising routes to the IPs they resolve to (comma-separated, e.g. example.com,*.example.net)")
+	}
+	if runtime.GOOS == "linux" {
+		upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server on this node's Tailscale IPs, permitting access by your Tailscale identity")
+		upf.StringVar(&upArgs.sshUsers, "ssh-users", "", "local users that --ssh permits logging in as (comma-separated); if empty, any user but root")
+		upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
+		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
+	}
+	return upf
+})()
+
 func defaultNetfilterMode() string {
 	if distro.Get() == distro.Synology {
 		return "off"
@@ -79,13 +110,30 @@ var upArgs struct {
 	exitNodeIP            string
 	shieldsUp             bool
 	forceReauth           bool
+	reset                 bool
 	advertiseRoutes       string
 	advertiseDefaultRoute bool
 	advertiseTags         string
 	snat                  bool
 	netfilterMode         string
 	authKey               string
+	qr                    bool
 	hostname              string
+	advertiseServices     string
+	certDomains           string
+	appConnectorDomains   string
+	alwaysOnPeers         string
+	keepalive             time.Duration
+	peerIdleTimeout       time.Duration
+	listenPort            uint16
+	derpMapFile           string
+	preferredDERP         int
+	runSSH                bool
+	sshUsers              string
+	updateCheck           bool
+	autoUpdate            bool
+	confirmNetChanges     bool
+	ephemeral             bool
 }
 
 func isBSD(s string) bool {
@@ -96,31 +144,11 @@ func warnf(format string, args ...interface{}) {
 	fmt.Printf("Warning: "+format+"\n", args...)
 }
 
-// checkIPForwarding prints warnings on linux if IP forwarding is not
-// enabled, or if we were unable to verify the state of IP forwarding.
-func checkIPForwarding() {
-	var key string
-
-	if runtime.GOOS == "linux" {
-		key = "net.ipv4.ip_forward"
-	} else if isBSD(runtime.GOOS) {
-		key = "net.inet.ip.forwarding"
-	} else {
-		return
-	}
-
-	bs, err := exec.Command("sysctl", "-n", key).Output()
-	if err != nil {
-		warnf("couldn't check %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
-		return
-	}
-	on, err := strconv.ParseBool(string(bytes.TrimSpace(bs)))
-	if err != nil {
-		warnf("couldn't parse %s (%v).\nSubnet routes won't work without IP forwarding.", key, err)
-		return
-	}
-	if !on {
-		warnf("%s is disabled. Subnet routes won't work.", key)
+// checkIPForwarding prints a warning if the OS won't forward packets
+// for routes. tailscaled also reports this in "tailscale status".
+func checkIPForwarding(routes []netaddr.IPPrefix) {
+	if err := ipforward.Check(routes); err != nil {
+		warnf("%v", err)
 	}
 }
 
@@ -129,38 +157,20 @@ var (
 	ipv6default = netaddr.MustParseIPPrefix("::/0")
 )
 
-func runUp(ctx context.Context, args []string) error {
-	if len(args) > 0 {
-		log.Fatalf("too many non-flag arguments: %q", args)
-	}
-
-	if distro.Get() == distro.Synology {
-		notSupported := "not yet supported on Synology; see https://github.com/tailscale/tailscale/issues/451"
-		if upArgs.advertiseRoutes != "" {
-			return errors.New("--advertise-routes is " + notSupported)
-		}
-		if upArgs.acceptRoutes {
-			return errors.New("--accept-routes is " + notSupported)
-		}
-		if upArgs.exitNodeIP != "" {
-			return errors.New("--exit-node is " + notSupported)
-		}
-		if upArgs.netfilterMode != "off" {
-			return errors.New("--netfilter-mode values besides \"off\" " + notSupported)
-		}
-	}
-
+// calcAdvertiseRoutes returns the routes to advertise given the
+// comma-separated --advertise-routes value and whether to advertise
+// this node as an exit node, sorted.
+func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netaddr.IPPrefix, error) {
 	routeMap := map[netaddr.IPPrefix]bool{}
 	var default4, default6 bool
-	if upArgs.advertiseRoutes != "" {
-		advroutes := strings.Split(upArgs.advertiseRoutes, ",")
-		for _, s := range advroutes {
+	if advertiseRoutes != "" {
+		for _, s := range strings.Split(advertiseRoutes, ",") {
 			ipp, err := netaddr.ParseIPPrefix(s)
 			if err != nil {
-				fatalf("%q is not a valid IP address or CIDR prefix", s)
+				return nil, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
 			}
 			if ipp != ipp.Masked() {
-				fatalf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+				return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
 			}
 			if ipp == ipv4default {
 				default4 = true
@@ -170,20 +180,14 @@ func runUp(ctx context.Context, args []string) error {
 			routeMap[ipp] = true
 		}
 		if default4 && !default6 {
-			fatalf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv4default, ipv6default)
+			return nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv4default, ipv6default)
 		} else if default6 && !default4 {
-			fatalf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv6default, ipv4default)
+			return nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv6default, ipv4default)
 		}
 	}
-	if upArgs.advertiseDefaultRoute {
-		routeMap[netaddr.MustParseIPPrefix("0.0.0.0/0")] = true
-		routeMap[netaddr.MustParseIPPrefix("::/0")] = true
-	}
-	if len(routeMap) > 0 {
-		checkIPForwarding()
-		if isBSD(runtime.GOOS) {
-			warnf("Subnet routing and exit nodes only work with additional manual configuration on bsd, and is not currently officially supported.")
-		}
+	if advertiseDefaultRoute {
+		routeMap[ipv4default] = true
+		routeMap[ipv6default] = true
 	}
 	routes := make([]netaddr.IPPrefix, 0, len(routeMap))
 	for r := range routeMap {
@@ -195,6 +199,45 @@ func runUp(ctx context.Context, args []string) error {
 		}
 		return routes[i].IP.Less(routes[j].IP)
 	})
+	return routes, nil
+}
+
+func runUp(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+
+	if distro.Get() == distro.Synology {
+		notSupported := "not yet supported on Synology; see https://github.com/tailscale/tailscale/issues/451"
+		if upArgs.advertiseRoutes != "" {
+			return errors.New("--advertise-routes is " + notSupported)
+		}
+		if upArgs.acceptRoutes {
+			return errors.New("--accept-routes is " + notSupported)
+		}
+		if upArgs.exitNodeIP != "" {
+			return errors.New("--exit-node is " + notSupported)
+		}
+		if upArgs.netfilterMode != "off" {
+			return errors.New("--netfilter-mode values besides \"off\" " + notSupported)
+		}
+	}
+
+	authKey, err := ipn.ResolveAuthKey(upArgs.authKey)
+	if err != nil {
+		fatalf("--authkey: %v", err)
+	}
+
+	routes, err := calcAdvertiseRoutes(upArgs.advertiseRoutes, upArgs.advertiseDefaultRoute)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(routes) > 0 {
+		checkIPForwarding(routes)
+		if isBSD(runtime.GOOS) {
+			warnf("Subnet routing and exit nodes only work with additional manual configuration on bsd, and is not currently officially supported.")
+		}
+	}
 
 	var exitNodeIP netaddr.IP
 	if upArgs.exitNodeIP != "" {
@@ -216,6 +259,72 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
+	var certDomains []string
+	if upArgs.certDomains != "" {
+		for _, d := range strings.Split(upArgs.certDomains, ",") {
+			d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+			if d == "" || strings.ContainsAny(d, " /:") || !strings.Contains(d, ".") {
+				fatalf("%q is not a valid domain name", d)
+			}
+			certDomains = append(certDomains, d)
+		}
+	}
+
+	var appDomains []string
+	if upArgs.appConnectorDomains != "" {
+		for _, d := range strings.Split(upArgs.appConnectorDomains, ",") {
+			d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+			if d == "" || strings.ContainsAny(d, " /:") || !strings.Contains(d, ".") || strings.Contains(strings.TrimPrefix(d, "*."), "*") {
+				fatalf("%q is not a valid domain name", d)
+			}
+			appDomains = append(appDomains, d)
+		}
+	}
+
+	var alwaysOnPeers []string
+	for _, p := range strings.Split(upArgs.alwaysOnPeers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			alwaysOnPeers = append(alwaysOnPeers, p)
+		}
+	}
+	var sshUsers []string
+	for _, u := range strings.Split(upArgs.sshUsers, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			sshUsers = append(sshUsers, u)
+		}
+	}
+	if k := upArgs.keepalive; k != 0 && (k < time.Second || k > 65535*time.Second) {
+		fatalf("--keepalive-interval must be between 1s and 65535s")
+	}
+	if d := upArgs.peerIdleTimeout; d != 0 && d < 30*time.Second {
+		fatalf("--peer-idle-timeout must be at least 30s")
+	}
+
+	var servicePorts []uint16
+	if upArgs.advertiseServices != "" {
+		for _, s := range strings.Split(upArgs.advertiseServices, ",") {
+			port, err := strconv.ParseUint(s, 10, 16)
+			if err != nil || port == 0 {
+				fatalf("%q is not a valid port number", s)
+			}
+			servicePorts = append(servicePorts, uint16(port))
+		}
+	}
+
+	derpMapFile := upArgs.derpMapFile
+	if derpMapFile != "" {
+		// tailscaled reads the file, so it can't be relative to our
+		// working directory.
+		abs, err := filepath.Abs(derpMapFile)
+		if err != nil {
+			fatalf("--derp-map-file: %v", err)
+		}
+		derpMapFile = abs
+	}
+	if upArgs.preferredDERP < 0 {
+		fatalf("--preferred-derp must be a DERP region ID")
+	}
+
 	if len(upArgs.hostname) > 256 {
 		fatalf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
@@ -232,6 +341,21 @@ func runUp(ctx context.Context, args []string) error {
 	prefs.AdvertiseTags = tags
 	prefs.NoSNAT = !upArgs.snat
 	prefs.Hostname = upArgs.hostname
+	prefs.AdvertiseServicePorts = servicePorts
+	prefs.ListenPort = upArgs.listenPort
+	prefs.AlwaysOnPeers = alwaysOnPeers
+	prefs.KeepaliveSeconds = uint16(upArgs.keepalive / time.Second)
+	prefs.PeerIdleSeconds = int(upArgs.peerIdleTimeout / time.Second)
+	prefs.DERPMapPath = derpMapFile
+	prefs.PreferredDERP = upArgs.preferredDERP
+	prefs.CertDomains = certDomains
+	prefs.RunSSH = upArgs.runSSH
+	prefs.SSHUsers = sshUsers
+	prefs.NoUpdateCheck = !upArgs.updateCheck
+	prefs.AutoUpdate = upArgs.autoUpdate
+	prefs.ConfirmNetworkChanges = upArgs.confirmNetChanges
+	prefs.Ephemeral = upArgs.ephemeral
+	prefs.AppConnectorDomains = appDomains
 	prefs.ForceDaemon = (runtime.GOOS == "windows")
 
 	if runtime.GOOS == "linux" {
@@ -252,6 +376,22 @@ func runUp(ctx context.Context, args []string) error {
 	c, bc, ctx, cancel := connect(ctx)
 	defer cancel()
 
+	// Services are configured by "tailscale serve", not "up", so
+	// keep whatever is already being served.
+	if curPrefs, err := tailscale.GetPrefs(ctx); err == nil {
+		prefs.Serve = curPrefs.Serve
+		if !upArgs.reset {
+			var nm *netmap.NetworkMap
+			if curPrefs.ExitNodeID != "" {
+				// Only the netmap knows the exit node's IP.
+				nm, _ = tailscale.NetMap(ctx)
+			}
+			if err := checkForAccidentalSettingReverts(upFlagSet, curPrefs, prefs, nm); err != nil {
+				fatalf("%v", err)
+			}
+		}
+	}
+
 	if !prefs.ExitNodeIP.IsZero() {
 		st, err := getStatusFromServer(ctx, c, bc)()
 		if err != nil {
@@ -272,7 +412,7 @@ func runUp(ctx context.Context, args []string) error {
 
 	opts := ipn.Options{
 		StateKey: ipn.GlobalDaemonStateKey,
-		AuthKey:  upArgs.authKey,
+		AuthKey:  authKey,
 		Notify: func(n ipn.Notify) {
 			if n.ErrMessage != nil {
 				msg := *n.ErrMessage
@@ -305,6 +445,9 @@ func runUp(ctx context.Context, args []string) error {
 			}
 			if url := n.BrowseToURL; url != nil {
 				fmt.Fprintf(os.Stderr, "\nTo authenticate, visit:\n\n\t%s\n\n", *url)
+				if upArgs.qr {
+					printQRCode(*url)
+				}
 			}
 		},
 	}
@@ -340,3 +483,157 @@ func runUp(ctx context.Context, args []string) error {
 
 	return nil
 }
+
+// upFlagPrefs maps each "tailscale up" flag that sets a pref to a func
+// returning the pref's value in p, formatted as the flag's value.
+var upFlagPrefs = map[string]func(p *ipn.Prefs) string{
+	"login-server": func(p *ipn.Prefs) string {
+		if p.ControlURL == "" {
+			return ipn.NewPrefs().ControlURL
+		}
+		return p.ControlURL
+	},
+	"accept-routes":      func(p *ipn.Prefs) string { return fmt.Sprint(p.RouteAll) },
+	"accept-dns":         func(p *ipn.Prefs) string { return fmt.Sprint(p.CorpDNS) },
+	"host-routes":        func(p *ipn.Prefs) string { return fmt.Sprint(p.AllowSingleHosts) },
+	"shields-up":         func(p *ipn.Prefs) string { return fmt.Sprint(p.ShieldsUp) },
+	"advertise-tags":     func(p *ipn.Prefs) string { return strings.Join(p.AdvertiseTags, ",") },
+	"hostname":           func(p *ipn.Prefs) string { return p.Hostname },
+	"cert-domains":       func(p *ipn.Prefs) string { return strings.Join(p.CertDomains, ",") },
+	"always-on-peers":    func(p *ipn.Prefs) string { return strings.Join(p.AlwaysOnPeers, ",") },
+	"keepalive-interval": func(p *ipn.Prefs) string { return (time.Duration(p.KeepaliveSeconds) * time.Second).String() },
+	"peer-idle-timeout":  func(p *ipn.Prefs) string { return (time.Duration(p.PeerIdleSeconds) * time.Second).String() },
+	"listen-port":        func(p *ipn.Prefs) string { return fmt.Sprint(p.ListenPort) },
+	"derp-map-file":      func(p *ipn.Prefs) string { return p.DERPMapPath },
+	"preferred-derp":     func(p *ipn.Prefs) string { return fmt.Sprint(p.PreferredDERP) },
+	"advertise-services": func(p *ipn.Prefs) string {
+		ss := make([]string, len(p.AdvertiseServicePorts))
+		for i, port := range p.AdvertiseServicePorts {
+			ss[i] = fmt.Sprint(port)
+		}
+		return strings.Join(ss, ",")
+	},
+	"advertise-routes": func(p *ipn.Prefs) string {
+		var ss []string
+		for _, r := range p.AdvertiseRoutes {
+			if r != ipv4default && r != ipv6default {
+				ss = append(ss, r.String())
+			}
+		}
+		sort.Strings(ss)
+		return strings.Join(ss, ",")
+	},
+	"advertise-exit-node": func(p *ipn.Prefs) string {
+		for _, r := range p.AdvertiseRoutes {
+			if r == ipv4default || r == ipv6default {
+				return "true"
+			}
+		}
+		return "false"
+	},
+	"exit-node": func(p *ipn.Prefs) string {
+		if p.ExitNodeIP.IsZero() {
+			return string(p.ExitNodeID)
+		}
+		return p.ExitNodeIP.String()
+	},
+	"update-check":            func(p *ipn.Prefs) string { return fmt.Sprint(!p.NoUpdateCheck) },
+	"auto-update":             func(p *ipn.Prefs) string { return fmt.Sprint(p.AutoUpdate) },
+	"confirm-network-changes": func(p *ipn.Prefs) string { return fmt.Sprint(p.ConfirmNetworkChanges) },
+	"ephemeral":               func(p *ipn.Prefs) string { return fmt.Sprint(p.Ephemeral) },
+	"app-connector-domains":   func(p *ipn.Prefs) string { return strings.Join(p.AppConnectorDomains, ",") },
+	"ssh":                     func(p *ipn.Prefs) string { return fmt.Sprint(p.RunSSH) },
+	"ssh-users":               func(p *ipn.Prefs) string { return strings.Join(p.SSHUsers, ",") },
+	"snat-subnet-routes":      func(p *ipn.Prefs) string { return fmt.Sprint(!p.NoSNAT) },
+	"netfilter-mode": func(p *ipn.Prefs) string {
+		switch p.NetfilterMode {
+		case preftype.NetfilterOff:
+			return "off"
+		case preftype.NetfilterNoDivert:
+			return "nodivert"
+		}
+		return "on"
+	},
+}
+
+// checkForAccidentalSettingReverts returns an error if running "up"
+// with the flags set in fs would change a setting in cur that was
+// previously set (that is, isn't the flag's default) and whose flag
+// wasn't given. The error includes the "tailscale up" command that
+// keeps every earlier setting and makes the requested changes.
+//
+// Once tailscaled finds the exit node in the netmap, it records it by
+// ID rather than IP, so nm is used to find the IP of cur's exit node.
+func checkForAccidentalSettingReverts(fs *flag.FlagSet, cur, want *ipn.Prefs, nm *netmap.NetworkMap) error {
+	if cur.ExitNodeIP.IsZero() && cur.ExitNodeID != "" {
+		if ip := exitNodeIP(cur.ExitNodeID, nm); !ip.IsZero() {
+			cur = cur.Clone()
+			cur.ExitNodeID, cur.ExitNodeIP = "", ip
+		}
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var reverted []string
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		prefVal, ok := upFlagPrefs[f.Name]
+		if !ok {
+			return
+		}
+		curVal, wantVal := prefVal(cur), prefVal(want)
+		if !explicit[f.Name] && curVal != wantVal && curVal != f.DefValue {
+			reverted = append(reverted, f.Name)
+			wantVal = curVal
+		}
+		if wantVal != f.DefValue {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, shellQuote(wantVal)))
+		}
+	})
+	if len(reverted) == 0 {
+		return nil
+	}
+	return fmt.Errorf("'tailscale up' without --reset would change settings made earlier that weren't specified: --%s\n\n"+
+		"To keep them, run:\n\n\ttailscale up %s\n\nor to return them to their defaults, add --reset.",
+		strings.Join(reverted, ", --"), strings.Join(args, " "))
+}
+
+// exitNodeIP returns the Tailscale IP of the peer in nm with ID id, or
+// the zero IP if there's none.
+func exitNodeIP(id tailcfg.StableNodeID, nm *netmap.NetworkMap) netaddr.IP {
+	if nm == nil {
+		return netaddr.IP{}
+	}
+	for _, p := range nm.Peers {
+		if p.StableID != id {
+			continue
+		}
+		for _, a := range p.Addresses {
+			if a.IsSingleIP() {
+				return a.IP
+			}
+		}
+	}
+	return netaddr.IP{}
+}
+
+// printQRCode prints s to stderr as a QR code.
+func printQRCode(s string) {
+	q, err := qrcode.Encode(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "QR code: %v\n\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", q.Terminal())
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.,:/@=+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
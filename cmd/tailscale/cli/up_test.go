@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
+)
+
+// upTestFlagSet returns a FlagSet with the same flags and defaults as
+// upFlagSet that parses args without touching upArgs.
+func upTestFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	upFlagSet.VisitAll(func(f *flag.Flag) {
+		fs.String(f.Name, f.DefValue, f.Usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// upDefaultPrefs returns the prefs "tailscale up" sends with no flags.
+func upDefaultPrefs() *ipn.Prefs {
+	p := ipn.NewPrefs()
+	p.RouteAll = false
+	if defaultNetfilterMode() == "off" {
+		p.NetfilterMode = preftype.NetfilterOff
+	}
+	return p
+}
+
+func TestCheckForAccidentalSettingReverts(t *testing.T) {
+	exitNode := &tailcfg.Node{
+		ID:        2,
+		StableID:  "nexit",
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32")},
+	}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{exitNode}}
+
+	tests := []struct {
+		name    string
+		args    []string
+		cur     func(*ipn.Prefs)
+		want    func(*ipn.Prefs)
+		nm      *netmap.NetworkMap
+		wantErr string // substring of the error; empty means no error
+	}{
+		{
+			name: "nothing_set",
+		},
+		{
+			name: "default_login_server_empty",
+			cur:  func(p *ipn.Prefs) { p.ControlURL = "" },
+		},
+		{
+			name:    "accept_routes_reverted",
+			cur:     func(p *ipn.Prefs) { p.RouteAll = true },
+			wantErr: "--accept-routes\n\nTo keep them, run:\n\n\ttailscale up --accept-routes=true\n",
+		},
+		{
+			name: "accept_routes_turned_off",
+			args: []string{"--accept-routes=false"},
+			cur:  func(p *ipn.Prefs) { p.RouteAll = true },
+		},
+		{
+			name:    "keeps_explicit_flags_in_suggestion",
+			args:    []string{"--shields-up=true"},
+			cur:     func(p *ipn.Prefs) { p.Hostname = "foo bar" },
+			want:    func(p *ipn.Prefs) { p.ShieldsUp = true },
+			wantErr: "tailscale up --hostname='foo bar' --shields-up=true\n",
+		},
+		{
+			name:    "exit_node_by_ip_reverted",
+			cur:     func(p *ipn.Prefs) { p.ExitNodeIP = netaddr.MustParseIP("100.64.0.2") },
+			wantErr: "--exit-node=100.64.0.2",
+		},
+		{
+			// tailscaled replaces ExitNodeIP with ExitNodeID once
+			// the exit node is in the netmap.
+			name:    "exit_node_by_id_reverted",
+			cur:     func(p *ipn.Prefs) { p.ExitNodeID = "nexit" },
+			nm:      nm,
+			wantErr: "tailscale up --exit-node=100.64.0.2\n",
+		},
+		{
+			name: "exit_node_by_id_kept",
+			args: []string{"--exit-node=100.64.0.2"},
+			cur:  func(p *ipn.Prefs) { p.ExitNodeID = "nexit" },
+			want: func(p *ipn.Prefs) { p.ExitNodeIP = netaddr.MustParseIP("100.64.0.2") },
+			nm:   nm,
+		},
+		{
+			name: "exit_node_by_id_changed",
+			args: []string{"--exit-node=100.64.0.3"},
+			cur:  func(p *ipn.Prefs) { p.ExitNodeID = "nexit" },
+			want: func(p *ipn.Prefs) { p.ExitNodeIP = netaddr.MustParseIP("100.64.0.3") },
+			nm:   nm,
+		},
+		{
+			name:    "exit_node_by_id_not_in_netmap",
+			cur:     func(p *ipn.Prefs) { p.ExitNodeID = "ngone" },
+			nm:      nm,
+			wantErr: "--exit-node",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur, want := upDefaultPrefs(), upDefaultPrefs()
+			if tt.cur != nil {
+				tt.cur(cur)
+			}
+			if tt.want != nil {
+				tt.want(want)
+			}
+			err := checkForAccidentalSettingReverts(upTestFlagSet(t, tt.args...), cur, want, tt.nm)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("no error; want one containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error = %q; want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/ipn"
 	"tailscale.com/version"
+	"tailscale.com/version/updatecheck"
 )
 
 var versionCmd = &ffcli.Command{
@@ -22,6 +23,7 @@ var versionCmd = &ffcli.Command{
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("version", flag.ExitOnError)
 		fs.BoolVar(&versionArgs.daemon, "daemon", false, "also print local node's daemon version")
+		fs.BoolVar(&versionArgs.check, "check", false, "check whether a newer release is available")
 		return fs
 	})(),
 	Exec: runVersion,
@@ -29,12 +31,16 @@ var versionCmd = &ffcli.Command{
 
 var versionArgs struct {
 	daemon bool // also check local node's daemon version
+	check  bool // check for a newer release
 }
 
 func runVersion(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		log.Fatalf("too many non-flag arguments: %q", args)
 	}
+	if versionArgs.check {
+		return runVersionCheck(ctx)
+	}
 	if !versionArgs.daemon {
 		fmt.Println(version.String())
 		return nil
@@ -68,3 +74,25 @@ func runVersion(ctx context.Context, args []string) error {
 		return ctx.Err()
 	}
 }
+
+func runVersionCheck(ctx context.Context) error {
+	res, err := updatecheck.Check(ctx)
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	fmt.Printf("Current: %s\n", res.Current)
+	fmt.Printf("Latest:  %s\n", res.Latest.Version)
+	if !res.UpdateAvailable {
+		fmt.Println("No update available.")
+		return nil
+	}
+	if res.Latest.SecurityFix {
+		fmt.Println("An update is available, and it fixes a security problem.")
+	} else {
+		fmt.Println("An update is available.")
+	}
+	if res.Latest.ChangelogURL != "" {
+		fmt.Printf("Changes: %s\n", res.Latest.ChangelogURL)
+	}
+	return nil
+}
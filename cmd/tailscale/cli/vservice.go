@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var vserviceCmd = &ffcli.Command{
+	Name:       "vservice",
+	ShortUsage: "vservice <add|status|remove> [args...]",
+	ShortHelp:  "Load balance a local address across several peers",
+	LongHelp: strings.TrimSpace(`
+A virtual service is a local address on which tailscaled accepts TCP
+connections and forwards each to one of several peers offering the
+same service, skipping peers that fail health checks. For example:
+
+  tailscale vservice add db 5432 tag:db
+  tailscale vservice add --balance=least-latency api 127.0.0.1:8080 group:api
+  psql -h 127.0.0.1 -p 5432
+
+Backends are peer names, Tailscale IPs, peer groups ("group:NAME") or
+ACL tags that the control server granted peers ("tag:NAME"). With MagicDNS, the service is
+also reachable as <name>.svc.<tailnet domain>.
+`),
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "add",
+			ShortUsage: "vservice add [flags] <name> <[ip:]port> <backend> [backend...]",
+			ShortHelp:  "Add or replace a virtual service",
+			FlagSet: (func() *flag.FlagSet {
+				fs := flag.NewFlagSet("add", flag.ExitOnError)
+				fs.UintVar(&vserviceArgs.port, "port", 0, "port to connect to on the backends (default: the local port)")
+				fs.StringVar(&vserviceArgs.balance, "balance", ipn.BalanceRoundRobin, "load balancing policy: "+ipn.BalanceRoundRobin+" or "+ipn.BalanceLeastLatency)
+				return fs
+			})(),
+			Exec: runVServiceAdd,
+		},
+		{
+			Name:       "status",
+			ShortUsage: "vservice status",
+			ShortHelp:  "Show virtual services and the health of their backends",
+			Exec:       runVServiceStatus,
+		},
+		{
+			Name:       "remove",
+			ShortUsage: "vservice remove <name>",
+			ShortHelp:  "Remove a virtual service",
+			Exec:       runVServiceRemove,
+		},
+	},
+}
+
+var vserviceArgs struct {
+	port    uint
+	balance string
+}
+
+func runVServiceAdd(ctx context.Context, args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: vservice add [flags] <name> <[ip:]port> <backend> [backend...]")
+	}
+	addr, err := parseVServiceAddr(args[1])
+	if err != nil {
+		return err
+	}
+	if vserviceArgs.port > 65535 {
+		return fmt.Errorf("invalid port %d", vserviceArgs.port)
+	}
+	vs := ipn.VirtualService{
+		Name:     args[0],
+		Addr:     addr,
+		Backends: args[2:],
+		Port:     uint16(vserviceArgs.port),
+		Balance:  vserviceArgs.balance,
+	}
+	if vs.Balance == ipn.BalanceRoundRobin {
+		vs.Balance = ""
+	}
+	if err := vs.Check(); err != nil {
+		return err
+	}
+	services, err := tailscale.VirtualServices(ctx)
+	if err != nil {
+		return err
+	}
+	var replaced bool
+	for i := range services {
+		if services[i].Name == vs.Name {
+			services[i] = vs
+			replaced = true
+		}
+	}
+	if !replaced {
+		services = append(services, vs)
+	}
+	if _, err := tailscale.SetVirtualServices(ctx, services); err != nil {
+		return err
+	}
+	fmt.Printf("added %v\n", vs)
+	return nil
+}
+
+// parseVServiceAddr parses a virtual service's local address, which
+// may be just a port on 127.0.0.1.
+func parseVServiceAddr(s string) (netaddr.IPPort, error) {
+	if port, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return netaddr.IPPort{IP: netaddr.IPv4(127, 0, 0, 1), Port: uint16(port)}, nil
+	}
+	ipp, err := netaddr.ParseIPPort(s)
+	if err != nil {
+		return netaddr.IPPort{}, fmt.Errorf("invalid address %q; want [ip:]port", s)
+	}
+	return ipp, nil
+}
+
+func runVServiceStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	st, err := tailscale.VirtualServiceStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if len(st) == 0 {
+		fmt.Println("no virtual services")
+		return nil
+	}
+	for _, s := range st {
+		if s.Error != "" {
+			fmt.Printf("%s %s: %s\n", s.Name, s.Addr, s.Error)
+			continue
+		}
+		fmt.Printf("%s %s:\n", s.Name, s.Addr)
+		if len(s.Backends) == 0 {
+			fmt.Println("  no backends")
+		}
+		for _, be := range s.Backends {
+			health := "down"
+			if be.Healthy {
+				health = "up"
+			}
+			fmt.Printf("  %-30s %-21s %-4s %6.1fms  %d active, %d total\n",
+				be.Peer, be.Addr, health, be.LatencySeconds*1000, be.ActiveConns, be.TotalConns)
+		}
+	}
+	return nil
+}
+
+func runVServiceRemove(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: vservice remove <name>")
+	}
+	services, err := tailscale.VirtualServices(ctx)
+	if err != nil {
+		return err
+	}
+	var keep []ipn.VirtualService
+	for _, vs := range services {
+		if vs.Name != args[0] {
+			keep = append(keep, vs)
+		}
+	}
+	if len(keep) == len(services) {
+		return fmt.Errorf("no virtual service %q", args[0])
+	}
+	_, err = tailscale.SetVirtualServices(ctx, keep)
+	return err
+}
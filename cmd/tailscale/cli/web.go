@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/net/interfaces"
+)
+
+var webCmd = &ffcli.Command{
+	Name:       "web",
+	ShortUsage: "web [--listen=addr] [--cgi]",
+	ShortHelp:  "Run a web server for controlling Tailscale",
+	LongHelp: strings.TrimSpace(`
+"tailscale web" serves tailscaled's small web UI, which shows the
+login state and peers, and has toggles for common preferences. It's
+meant for appliances such as NAS boxes and routers whose users don't
+have a shell to run the CLI from.
+
+The web UI does whatever the user running it is allowed to do, and
+has no authentication of its own: anyone who can reach it can change
+Tailscale's settings. By default it only listens on localhost. On an
+appliance, run it with --cgi behind the appliance's own
+authenticated web server instead of exposing it directly.
+`),
+	Exec: runWeb,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("web", flag.ExitOnError)
+		fs.StringVar(&webArgs.listen, "listen", "localhost:8088", "address to listen on")
+		fs.BoolVar(&webArgs.cgi, "cgi", false, "run as a CGI script, serving one request")
+		return fs
+	})(),
+}
+
+var webArgs struct {
+	listen string
+	cgi    bool
+}
+
+func runWeb(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	if webArgs.cgi {
+		return cgi.Serve(webProxy{})
+	}
+
+	ln, err := net.Listen("tcp", webArgs.listen)
+	if err != nil {
+		return err
+	}
+	h := webProxy{}
+	if ta, ok := ln.Addr().(*net.TCPAddr); ok && ta.IP.IsLoopback() {
+		h.loopbackOnly = true
+	}
+	fmt.Printf("Serving Tailscale web UI at %v ...\n", interfaces.HTTPOfListener(ln))
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	err = http.Serve(ln, h)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// webProxy forwards the web UI's requests to tailscaled, which
+// serves the UI from its LocalAPI.
+type webProxy struct {
+	// loopbackOnly is whether the server only listens on loopback,
+	// in which case tailscaled requires requests to name a loopback
+	// host, so that other sites can't reach the UI by DNS rebinding.
+	loopbackOnly bool
+}
+
+func (p webProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://local-tailscaled.sock/localapi/v0/web", r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// tailscaled checks the browser's Host and origin headers itself.
+	req.Host = r.Host
+	for _, k := range []string{"Content-Type", "Origin", "Referer", "Sec-Fetch-Site"} {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set(ipn.WebPathHeader, r.URL.Path)
+	req.Header.Set(ipn.WebLoopbackOnlyHeader, strconv.FormatBool(p.loopbackOnly))
+
+	res, err := tailscale.DoLocalRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for _, k := range []string{"Content-Type", "Location"} {
+		if v := res.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/net/handover"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+)
+
+// handoverSignal, if non-nil, is the signal on which tailscaled
+// re-execs its binary, handing the new process its TUN device, UDP
+// sockets and LocalAPI listener. It's how to upgrade tailscaled in
+// place: replace the binary, then send the signal.
+var handoverSignal os.Signal // non-nil on some platforms
+
+// inheritedPacketListener is a PacketListener for magicsock that
+// returns the UDP sockets inherited from the previous tailscaled the
+// first time each is asked for, so we keep the port peers know, and
+// new sockets after that.
+type inheritedPacketListener struct {
+	mu    sync.Mutex
+	conns map[string]net.PacketConn // "udp4" or "udp6" => socket
+}
+
+// newInheritedPacketListener returns a PacketListener for the UDP
+// sockets inherited from the previous tailscaled, or nil if there
+// are none.
+func newInheritedPacketListener(logf logger.Logf) *inheritedPacketListener {
+	l := &inheritedPacketListener{conns: map[string]net.PacketConn{}}
+	for _, network := range []string{"udp4", "udp6"} {
+		f := handover.Take(network)
+		if f == nil {
+			continue
+		}
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			logf("handover: ignoring inherited %s socket: %v", network, err)
+			continue
+		}
+		l.conns[network] = pc
+	}
+	if len(l.conns) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l *inheritedPacketListener) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	l.mu.Lock()
+	pc := l.conns[network]
+	delete(l.conns, network)
+	l.mu.Unlock()
+	if pc != nil {
+		return pc, nil
+	}
+	return netns.Listener().ListenPacket(ctx, network, addr)
+}
+
+// inheritedLocalAPIListener returns the LocalAPI listener inherited
+// from the previous tailscaled, or nil if there isn't one.
+func inheritedLocalAPIListener(logf logger.Logf) net.Listener {
+	f := handover.Take("localapi")
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		logf("handover: ignoring inherited LocalAPI listener: %v", err)
+		return nil
+	}
+	return ln
+}
+
+// handOverOnSignal execs a new tailscaled on handoverSignal, passing
+// it e's TUN device (unless it's a fake one, for userspace networking)
+// and UDP sockets, and the LocalAPI listener ln. e must be the engine
+// as returned by wgengine.NewUserspaceEngine. Before exec, the
+// backend from lbf saves its session for the new process to resume.
+func handOverOnSignal(logf logger.Logf, e wgengine.Engine, isUserspace bool, ln net.Listener, lbf *ipnlocal.LocalBackendFuture) {
+	if handoverSignal == nil {
+		return
+	}
+	tunDev, magicConn := e.(wgengine.InternalsGetter).GetInternals()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, handoverSignal)
+	go func() {
+		for s := range c {
+			var files []handover.File
+			if tf, ok := tunDev.Unwrap().(interface{ File() *os.File }); ok && !isUserspace {
+				files = append(files, handover.File{Name: "tun", Conn: tf.File()})
+			}
+			pc4, pc6 := magicConn.PacketConns()
+			for name, pc := range map[string]net.PacketConn{"udp4": pc4, "udp6": pc6} {
+				if sc, ok := pc.(syscall.Conn); ok {
+					files = append(files, handover.File{Name: name, Conn: sc})
+				}
+			}
+			if sc, ok := ln.(syscall.Conn); ok {
+				files = append(files, handover.File{Name: "localapi", Conn: sc})
+			}
+			logf("tailscaled got signal %v; handing over to new process", s)
+			lbf.Get().PrepareHandover()
+			err := handover.Exec(files)
+			logf("handover failed; carrying on: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,10 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+// Register the built-in SSH server, run with "tailscale up --ssh".
+import _ "tailscale.com/ssh/tailssh"
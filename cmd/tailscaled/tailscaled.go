@@ -29,14 +29,22 @@ import (
 	"time"
 
 	"github.com/go-multierror/multierror"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
+	"tailscale.com/logtail"
+	"tailscale.com/net/handover"
+	"tailscale.com/net/httpproxy"
+	"tailscale.com/net/proxypolicy"
 	"tailscale.com/net/socks5"
 	"tailscale.com/paths"
+	"tailscale.com/safesocket"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/nettype"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
@@ -83,9 +91,15 @@ var args struct {
 	tunname    string // tun name, "userspace-networking", or comma-separated list thereof
 	port       uint16
 	statepath  string
+	encState   bool // encrypt the state file at rest
 	socketpath string
+	configpath string
+	certDNS    string // DNS-01 provider for custom certificate domains
 	verbose    int
-	socksAddr  string // listen address for SOCKS5 server
+	noLogs     bool     // don't upload logs to the log server
+	logFormat  string   // local log format; see logpolicy.NewLocalSink
+	socksAddr  string   // listen address for SOCKS5 server
+	proxies    []string // proxy listener configs; see proxypolicy.ParseListenerConfig
 }
 
 var (
@@ -110,13 +124,19 @@ func main() {
 
 	printVersion := false
 	flag.IntVar(&args.verbose, "verbose", 0, "log verbosity level; 0 is default, 1 or higher are increasingly verbose")
+	flag.BoolVar(&args.noLogs, "no-logs-no-support", false, "disable uploading logs to the Tailscale log server; logs are still written locally, but Tailscale can't help debug problems")
+	flag.StringVar(&args.logFormat, "log-format", "text", "where and how to write logs locally: "+logpolicy.LocalFormats)
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
+	flag.Var(flagtype.StringsValue(&args.proxies), "proxy", `optional proxy listener, as "socks5|http://[ip]:port[?src=CIDRs&dst=CIDRs&ports=PORTs]" to restrict its clients and destinations; may be repeated`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
-	flag.Var(flagtype.PortValue(&args.port, magicsock.DefaultPort), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
-	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
+	flag.Var(flagtype.PortValue(&args.port, magicsock.DefaultPort), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select. Overridden by the ListenPort pref (tailscale up --listen-port)")
+	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file; or 'mem:' for ephemeral state, 'kube:<secret>' for a Kubernetes secret, or an AWS SSM parameter ARN")
+	flag.BoolVar(&args.encState, "encrypt-state", false, "encrypt the state file at rest using the OS key store (DPAPI, Keychain or TPM); existing plaintext state is migrated")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.StringVar(&args.configpath, "config", "", "path of a config file (JSON, with comments allowed) of prefs such as Hostname, AdvertiseRoutes and AuthKey to apply at startup")
+	flag.StringVar(&args.certDNS, "cert-dns-provider", "", `provider that publishes the DNS-01 challenge records of the CertDomains pref, as "name[:arg]", e.g. "exec:/path/to/hook"`)
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -167,8 +187,19 @@ func main() {
 func run() error {
 	var err error
 
-	pol := logpolicy.New("tailnode.log.tailscale.io")
+	sink, err := logpolicy.NewLocalSink(args.logFormat)
+	if err != nil {
+		log.Printf("--log-format: %v", err)
+		return err
+	}
+	if args.noLogs {
+		logtail.Disable()
+	}
+	pol := logpolicy.NewWithSink("tailnode.log.tailscale.io", sink)
 	pol.SetVerbosityLevel(args.verbose)
+	if args.noLogs {
+		log.Printf("Log uploading disabled by --no-logs-no-support; logs are only written locally.")
+	}
 	defer func() {
 		// Finish uploading logs after closing everything else.
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -201,6 +232,15 @@ func run() error {
 		log.Fatalf("--state is required")
 	}
 
+	var conf *ipn.ConfigFile
+	if args.configpath != "" {
+		var err error
+		conf, err = ipn.LoadConfigFile(args.configpath)
+		if err != nil {
+			log.Fatalf("--config: %v", err)
+		}
+	}
+
 	var debugMux *http.ServeMux
 	if args.debug != "" {
 		debugMux = newDebugMux()
@@ -213,12 +253,23 @@ func run() error {
 	}
 	pol.Logtail.SetLinkMonitor(linkMon)
 
-	var socksListener net.Listener
+	var proxyConfigs []proxypolicy.ListenerConfig
 	if args.socksAddr != "" {
+		proxyConfigs = append(proxyConfigs, proxypolicy.ListenerConfig{Type: "socks5", Addr: args.socksAddr})
+	}
+	for _, s := range args.proxies {
+		lc, err := proxypolicy.ParseListenerConfig(s)
+		if err != nil {
+			log.Fatalf("--proxy: %v", err)
+		}
+		proxyConfigs = append(proxyConfigs, lc)
+	}
+	proxyListeners := make([]net.Listener, len(proxyConfigs))
+	for i, lc := range proxyConfigs {
 		var err error
-		socksListener, err = net.Listen("tcp", args.socksAddr)
+		proxyListeners[i], err = net.Listen("tcp", lc.Addr)
 		if err != nil {
-			log.Fatalf("SOCKS5 listener: %v", err)
+			log.Fatalf("%s proxy listener: %v", lc.Type, err)
 		}
 	}
 
@@ -242,35 +293,54 @@ func run() error {
 		}
 	}
 
-	if socksListener != nil {
-		srv := &socks5.Server{
-			Logf: logger.WithPrefix(logf, "socks5: "),
-		}
+	// The proxies and the LocalAPI's /dial endpoint resolve peers'
+	// names from the netmap, and dial through netstack if it's in use.
+	var mu sync.Mutex
+	var dns netstack.DNSMap
+	e.AddNetworkMapCallback(func(nm *netmap.NetworkMap) {
+		mu.Lock()
+		defer mu.Unlock()
+		dns = netstack.DNSMapFromNetworkMap(nm)
+	})
+	resolve := func(ctx context.Context, addr string) (netaddr.IPPort, error) {
+		mu.Lock()
+		m := dns
+		mu.Unlock()
+		return m.Resolve(ctx, addr)
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		if useNetstack {
-			srv.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return ns.DialContextTCP(ctx, addr)
-			}
-		} else {
-			var mu sync.Mutex
-			var dns netstack.DNSMap
-			e.AddNetworkMapCallback(func(nm *netmap.NetworkMap) {
-				mu.Lock()
-				defer mu.Unlock()
-				dns = netstack.DNSMapFromNetworkMap(nm)
-			})
-			srv.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
-				ipp, err := dns.Resolve(ctx, addr)
-				if err != nil {
-					return nil, err
-				}
-				var d net.Dialer
-				return d.DialContext(ctx, network, ipp.String())
+			c, err := ns.DialContextTCP(ctx, addr)
+			if err != nil {
+				return nil, err
 			}
+			return c, nil
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	for i, lc := range proxyConfigs {
+		startProxy(logf, lc, proxyListeners[i], resolve, dial)
+	}
+	tailnetDial := func(ctx context.Context, addr string) (net.Conn, error) {
+		ipp, err := resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, "tcp", ipp.String())
+	}
+
+	// Listen for the LocalAPI here rather than in ipnserver.Run, so
+	// we have the listener to hand over.
+	ln := inheritedLocalAPIListener(logf)
+	if ln == nil {
+		ln, _, err = safesocket.Listen(args.socketpath, 41112)
+		if err != nil {
+			logf("safesocket.Listen: %v", err)
+			return err
 		}
-		go func() {
-			log.Fatalf("SOCKS5 server exited: %v", srv.Serve(socksListener))
-		}()
 	}
+	handOverOnSignal(logf, e, useNetstack, ln, localBEFuture)
 
 	e = wgengine.NewWatchdog(e)
 
@@ -296,12 +366,18 @@ func run() error {
 	opts := ipnserver.Options{
 		SocketPath:         args.socketpath,
 		Port:               41112,
+		Listener:           ln,
 		StatePath:          args.statepath,
+		EncryptState:       args.encState,
 		AutostartStateKey:  globalStateKey,
 		LegacyConfigPath:   paths.LegacyConfigPath(),
+		Config:             conf,
 		SurviveDisconnects: true,
 		DebugMux:           debugMux,
 		OnBackendCreated:   localBEFuture.Set,
+		NetstackRouter:     useNetstack,
+		TailnetDial:        tailnetDial,
+		CertDNSProvider:    args.certDNS,
 	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
@@ -317,19 +393,26 @@ func createEngine(logf logger.Logf, linkMon *monitor.Mon) (e wgengine.Engine, is
 	if args.tunname == "" {
 		return nil, false, errors.New("no --tun value specified")
 	}
+	var pl nettype.PacketListener
+	if ipl := newInheritedPacketListener(logf); ipl != nil {
+		pl = ipl
+	}
 	var errs []error
 	for _, name := range strings.Split(args.tunname, ",") {
 		logf("wgengine.NewUserspaceEngine(tun %q) ...", name)
 		conf := wgengine.Config{
-			ListenPort:  args.port,
-			LinkMonitor: linkMon,
+			ListenPort:     args.port,
+			LinkMonitor:    linkMon,
+			PacketListener: pl,
 		}
 		isUserspace = name == "userspace-networking"
 		if isUserspace {
 			conf.TUN = tstun.NewFakeTUN()
 			conf.RouterGen = router.NewFake
+			conf.RespondToPings = true
 		} else {
 			conf.TUNName = name
+			conf.TUNFile = handover.Take("tun")
 		}
 		e, err := wgengine.NewUserspaceEngine(logf, conf)
 		if err == nil {
@@ -341,6 +424,32 @@ func createEngine(logf logger.Logf, linkMon *monitor.Mon) (e wgengine.Engine, is
 	return nil, false, multierror.New(errs)
 }
 
+// startProxy starts serving the proxy configured by lc on ln,
+// enforcing lc's policy before dialing destinations with dial.
+func startProxy(logf logger.Logf, lc proxypolicy.ListenerConfig, ln net.Listener,
+	resolve func(context.Context, string) (netaddr.IPPort, error),
+	dial func(context.Context, string, string) (net.Conn, error)) {
+	logf = logger.WithPrefix(logf, fmt.Sprintf("%s %s: ", lc.Type, ln.Addr()))
+	policy := lc.Policy
+	ln = policy.Listener(ln, logf)
+	dialer := policy.Dialer(resolve, dial)
+
+	var serve func(net.Listener) error
+	switch lc.Type {
+	case "socks5":
+		srv := &socks5.Server{Logf: logf, Dialer: dialer}
+		serve = srv.Serve
+	case "http":
+		srv := &httpproxy.Server{Logf: logf, Dialer: dialer}
+		serve = srv.Serve
+	default:
+		log.Fatalf("unknown proxy type %q", lc.Type)
+	}
+	go func() {
+		log.Fatalf("%s proxy server exited: %v", lc.Type, serve(ln))
+	}()
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -59,6 +59,7 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 	changes <- svc.Status{State: svc.StartPending}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	doneCh := make(chan struct{})
 	go func() {
 		defer close(doneCh)
@@ -66,14 +67,17 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 		ipnserver.BabysitProc(ctx, args, log.Printf)
 	}()
 
-	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop}
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
 
 	for ctx.Err() == nil {
 		select {
 		case <-doneCh:
+			cancel()
 		case cmd := <-r:
 			switch cmd.Cmd {
-			case svc.Stop:
+			case svc.Stop, svc.Shutdown:
+				log.Printf("service: got %v; stopping", cmd.Cmd)
 				cancel()
 			case svc.Interrogate:
 				changes <- cmd.CurrentStatus
@@ -81,10 +85,17 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 		}
 	}
 
-	changes <- svc.Status{State: svc.StopPending}
+	// Wait for the subprocess to close the engine and undo its
+	// network changes, so they're not left behind.
+	changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(stopWaitHint / time.Millisecond)}
+	<-doneCh
 	return false, windows.NO_ERROR
 }
 
+// stopWaitHint is how long we tell Windows stopping the service may
+// take. It's longer than ipnserver's wait for the subprocess to exit.
+const stopWaitHint = 20 * time.Second
+
 func beWindowsSubprocess() bool {
 	if beFirewallKillswitch() {
 		return true
@@ -98,18 +109,23 @@ func beWindowsSubprocess() bool {
 	log.Printf("Program starting: v%v: %#v", version.Long, os.Args)
 	log.Printf("subproc mode: logid=%v", logid)
 
+	// The parent closes our stdin when the service is stopping, or
+	// it's gone when the parent dies. Either way, shut down cleanly.
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		b := make([]byte, 16)
 		for {
 			_, err := os.Stdin.Read(b)
 			if err != nil {
-				log.Fatalf("stdin err (parent process died): %v", err)
+				log.Printf("stdin err (parent process stopping or died): %v; shutting down", err)
+				cancel()
+				return
 			}
 		}
 	}()
 
-	err := startIPNServer(context.Background(), logid)
-	if err != nil {
+	err := startIPNServer(ctx, logid)
+	if err != nil && ctx.Err() == nil {
 		log.Fatalf("ipnserver: %v", err)
 	}
 	return true
@@ -205,6 +221,8 @@ func startIPNServer(ctx context.Context, logid string) error {
 		Port:               41112,
 		SurviveDisconnects: false,
 		StatePath:          args.statepath,
+		EncryptState:       args.encState,
+		CertDNSProvider:    args.certDNS,
 	}
 	if err != nil {
 		// Return nicer errors to users, annotated with logids, which helps
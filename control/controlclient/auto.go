@@ -125,6 +125,7 @@ type Client struct {
 	paused          bool // whether we should stop making HTTP requests
 	unpauseWaiters  []chan struct{}
 	loggedIn        bool       // true if currently logged in
+	resuming        bool       // true if resuming an earlier session, until its first netmap
 	loginGoal       *LoginGoal // non-nil if some login activity is desired
 	synced          bool       // true if our netmap is up-to-date
 	hostinfo        *tailcfg.Hostinfo
@@ -172,6 +173,15 @@ func NewNoStart(opts Options) (*Client, error) {
 		authDone: make(chan struct{}),
 		mapDone:  make(chan struct{}),
 	}
+	if direct.resumed {
+		// Skip registration and go straight to polling for
+		// netmaps. If that doesn't work, mapRoutine falls back
+		// to logging in.
+		c.logf("resuming earlier session")
+		c.loggedIn = true
+		c.resuming = true
+		c.state = StateAuthenticated
+	}
 	c.authCtx, c.authCancel = context.WithCancel(context.Background())
 	c.mapCtx, c.mapCancel = context.WithCancel(context.Background())
 	c.unregisterHealthWatch = health.RegisterWatcher(c.onHealthChange)
@@ -443,6 +453,18 @@ func (c *Client) Expiry() *time.Time {
 	return c.expiry
 }
 
+// SetDNS sends the SetDNSRequest request to the control plane server,
+// requesting a DNS record be created or updated.
+func (c *Client) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
+	return c.direct.SetDNS(ctx, req)
+}
+
+// SubmitTKASignature sends the tailnet lock signature sig of the
+// node key signed to the control plane server.
+func (c *Client) SubmitTKASignature(ctx context.Context, signed tailcfg.NodeKey, sig []byte) error {
+	return c.direct.SubmitTKASignature(ctx, signed, sig)
+}
+
 // Direct returns the underlying direct client object. Used in tests
 // only.
 func (c *Client) Direct() *Direct {
@@ -540,6 +562,7 @@ func (c *Client) mapRoutine() {
 
 				c.synced = true
 				c.inPollNetMap = true
+				c.resuming = false
 				if c.loggedIn {
 					c.state = StateSynchronized
 				}
@@ -573,6 +596,9 @@ func (c *Client) mapRoutine() {
 
 			if err != nil {
 				report(err, "PollNetMap")
+				if ctx.Err() == nil && c.stopResuming() {
+					continue
+				}
 				bo.BackOff(ctx, err)
 				continue
 			}
@@ -581,6 +607,27 @@ func (c *Client) mapRoutine() {
 	}
 }
 
+// stopResuming is called when a map poll fails. If the Client was
+// resuming an earlier session, which might no longer be valid, it
+// falls back to logging in as usual and reports true.
+func (c *Client) stopResuming() bool {
+	c.mu.Lock()
+	if !c.resuming {
+		c.mu.Unlock()
+		return false
+	}
+	c.logf("resumed session failed; logging in")
+	c.resuming = false
+	c.loggedIn = false
+	c.state = StateNotAuthenticated
+	if c.loginGoal == nil {
+		c.loginGoal = &LoginGoal{wantLoggedIn: true, flags: LoginDefault}
+	}
+	c.mu.Unlock()
+	c.cancelAuth()
+	return true
+}
+
 func (c *Client) AuthCantContinue() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -670,6 +717,12 @@ func (c *Client) Login(t *oauth2.Token, flags LoginFlags) {
 	c.logf("client.Login(%v, %v)", t != nil, flags)
 
 	c.mu.Lock()
+	if c.resuming && t == nil && flags == LoginDefault {
+		// Already logged in as far as we know; mapRoutine falls
+		// back to logging in if the resumed session is rejected.
+		c.mu.Unlock()
+		return
+	}
 	c.loginGoal = &LoginGoal{
 		wantLoggedIn: true,
 		token:        t,
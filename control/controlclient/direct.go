@@ -67,6 +67,8 @@ type Direct struct {
 	machinePrivKey         wgkey.Private
 	debugFlags             []string
 	keepSharerAndUserSplit bool
+	ephemeral              bool
+	skipIPForwardingCheck  bool
 
 	mu           sync.Mutex // mutex guards the following fields
 	serverKey    wgkey.Key
@@ -79,6 +81,7 @@ type Direct struct {
 	endpoints     []string
 	everEndpoints bool   // whether we've ever had non-empty endpoints
 	localPort     uint16 // or zero to mean auto
+	resumed       bool   // whether opts.Resume was used
 }
 
 type Options struct {
@@ -92,13 +95,28 @@ type Options struct {
 	NewDecompressor   func() (Decompressor, error)
 	KeepAlive         bool
 	Logf              logger.Logf
-	HTTPTestClient    *http.Client // optional HTTP client to use (for tests only)
-	DebugFlags        []string     // debug settings to send to control
-	LinkMonitor       *monitor.Mon // optional link monitor
+	HTTPTestClient    *http.Client   // optional HTTP client to use (for tests only)
+	DebugFlags        []string       // debug settings to send to control
+	LinkMonitor       *monitor.Mon   // optional link monitor
+	Netns             *netns.Binding // optional interface binding of the control connection
+
+	// Resume, if non-nil, is the state of an earlier session of the
+	// same node to resume instead of registering again. It's
+	// ignored if it doesn't match Persist or has expired.
+	Resume *ResumeState
 
 	// KeepSharerAndUserSplit controls whether the client
 	// understands Node.Sharer. If false, the Sharer is mapped to the User.
 	KeepSharerAndUserSplit bool
+
+	// Ephemeral is whether to register the node as ephemeral, for
+	// control to delete once it goes offline or logs out.
+	Ephemeral bool
+
+	// SkipIPForwardingCheck is whether to not warn control that the
+	// OS doesn't forward IP packets for advertised routes, because
+	// the node forwards them itself, in userspace.
+	SkipIPForwardingCheck bool
 }
 
 type Decompressor interface {
@@ -135,7 +153,7 @@ func NewDirect(opts Options) (*Direct, error) {
 			UseLastGood:      true,
 			LookupIPFallback: dnsfallback.Lookup,
 		}
-		dialer := netns.NewDialer()
+		dialer := opts.Netns.NewDialer()
 		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.Proxy = tshttpproxy.ProxyFromEnvironment
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
@@ -160,6 +178,16 @@ func NewDirect(opts Options) (*Direct, error) {
 		debugFlags:             opts.DebugFlags,
 		keepSharerAndUserSplit: opts.KeepSharerAndUserSplit,
 		linkMon:                opts.LinkMonitor,
+		ephemeral:              opts.Ephemeral,
+		skipIPForwardingCheck:  opts.SkipIPForwardingCheck,
+	}
+	if opts.Resume.validFor(opts.Persist, opts.TimeNow()) {
+		c.serverKey = opts.Resume.ServerKey
+		if !opts.Resume.Expiry.IsZero() {
+			exp := opts.Resume.Expiry
+			c.expiry = &exp
+		}
+		c.resumed = true
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(NewHostinfo())
@@ -266,6 +294,69 @@ func (c *Direct) TryLogout(ctx context.Context) error {
 	return nil
 }
 
+// SendLogout tells control that the node is logging out by asking
+// it to expire the node key now, which for an ephemeral node also
+// deletes the node. It's best effort: unlike TryLogout, it doesn't
+// change the client's state, and it does nothing if the node never
+// registered.
+func (c *Direct) SendLogout(ctx context.Context) error {
+	c.mu.Lock()
+	persist := c.persist
+	serverKey := c.serverKey
+	hostinfo := c.hostinfo.Clone()
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() || serverKey.IsZero() {
+		return nil
+	}
+	request := tailcfg.RegisterRequest{
+		Version:   1,
+		NodeKey:   tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		Hostinfo:  hostinfo,
+		Expiry:    time.Unix(123, 0), // far in the past
+		Ephemeral: c.ephemeral,
+	}
+	request.Auth.Provider = persist.Provider
+	request.Auth.LoginName = persist.LoginName
+	c.logf("RegisterReq: logout node=%v", request.NodeKey.ShortString())
+	_, err := c.sendRegisterRequest(ctx, serverKey, &request)
+	return err
+}
+
+// sendRegisterRequest sends request to control and returns its
+// response.
+func (c *Direct) sendRegisterRequest(ctx context.Context, serverKey wgkey.Key, request *tailcfg.RegisterRequest) (*tailcfg.RegisterResponse, error) {
+	bodyData, err := encode(request, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return nil, err
+	}
+	body := bytes.NewReader(bodyData)
+
+	u := fmt.Sprintf("%s/machine/%s", c.serverURL, c.machinePrivKey.Public().HexString())
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("register request: %v", err)
+	}
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("register request: http %d: %.200s",
+			res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	resp := new(tailcfg.RegisterResponse)
+	if err := decode(res, resp, &serverKey, &c.machinePrivKey); err != nil {
+		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, c.machinePrivKey.Public(), err)
+		return nil, fmt.Errorf("register request: %v", err)
+	}
+	return resp, nil
+}
+
 func (c *Direct) TryLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags) (url string, err error) {
 	c.logf("direct.TryLogin(token=%v, flags=%v)", t != nil, flags)
 	return c.doLoginOrRegen(ctx, t, flags, false, "")
@@ -358,6 +449,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		NodeKey:    tailcfg.NodeKey(tryingNewKey.Public()),
 		Hostinfo:   hostinfo,
 		Followup:   url,
+		Ephemeral:  c.ephemeral,
 	}
 	c.logf("RegisterReq: onode=%v node=%v fup=%v",
 		request.OldNodeKey.ShortString(),
@@ -366,34 +458,10 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	request.Auth.Provider = persist.Provider
 	request.Auth.LoginName = persist.LoginName
 	request.Auth.AuthKey = authKey
-	bodyData, err := encode(request, &serverKey, &c.machinePrivKey)
+	resp, err := c.sendRegisterRequest(ctx, serverKey, &request)
 	if err != nil {
 		return regen, url, err
 	}
-	body := bytes.NewReader(bodyData)
-
-	u := fmt.Sprintf("%s/machine/%s", c.serverURL, c.machinePrivKey.Public().HexString())
-	req, err := http.NewRequest("POST", u, body)
-	if err != nil {
-		return regen, url, err
-	}
-	req = req.WithContext(ctx)
-
-	res, err := c.httpc.Do(req)
-	if err != nil {
-		return regen, url, fmt.Errorf("register request: %v", err)
-	}
-	if res.StatusCode != 200 {
-		msg, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		return regen, url, fmt.Errorf("register request: http %d: %.200s",
-			res.StatusCode, strings.TrimSpace(string(msg)))
-	}
-	resp := tailcfg.RegisterResponse{}
-	if err := decode(res, &resp, &serverKey, &c.machinePrivKey); err != nil {
-		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, c.machinePrivKey.Public(), err)
-		return regen, url, fmt.Errorf("register request: %v", err)
-	}
 	// Log without PII:
 	c.logf("RegisterReq: got response; nodeKeyExpired=%v, machineAuthorized=%v; authURL=%v",
 		resp.NodeKeyExpired, resp.MachineAuthorized, resp.AuthURL != "")
@@ -547,7 +615,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 		OmitPeers:  cb == nil,
 	}
 	var extraDebugFlags []string
-	if hostinfo != nil && c.linkMon != nil && ipForwardingBroken(hostinfo.RoutableIPs, c.linkMon.InterfaceState()) {
+	if hostinfo != nil && c.linkMon != nil && !c.skipIPForwardingCheck && ipForwardingBroken(hostinfo.RoutableIPs, c.linkMon.InterfaceState()) {
 		extraDebugFlags = append(extraDebugFlags, "warn-ip-forwarding-off")
 	}
 	if health.RouterHealth() != nil {
@@ -608,6 +676,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 	defer res.Body.Close()
 
 	health.NoteMapRequestHeard(request)
+	if t, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		health.NoteControlTime(t)
+	}
 
 	if cb == nil {
 		io.Copy(ioutil.Discard, res.Body)
@@ -844,6 +915,85 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 	return nil
 }
 
+// SetDNS sends the SetDNSRequest request to the control plane server,
+// requesting a DNS record be created or updated.
+func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
+	c.mu.Lock()
+	persist := c.persist
+	serverURL := c.serverURL
+	serverKey := c.serverKey
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("privateNodeKey is zero")
+	}
+	r := *req
+	r.Version = 1
+	r.NodeKey = tailcfg.NodeKey(persist.PrivateNodeKey.Public())
+
+	bodyData, err := encode(r, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	u := fmt.Sprintf("%s/machine/%s/set-dns", serverURL, machinePubKey.HexString())
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("set-dns response: %v, %.200s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SubmitTKASignature sends the tailnet lock signature sig of the node
+// key signed to the control plane server, for it to distribute to the
+// tailnet's nodes.
+func (c *Direct) SubmitTKASignature(ctx context.Context, signed tailcfg.NodeKey, sig []byte) error {
+	c.mu.Lock()
+	persist := c.persist
+	serverURL := c.serverURL
+	serverKey := c.serverKey
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("privateNodeKey is zero")
+	}
+	r := tailcfg.TKASignRequest{
+		Version:   1,
+		NodeKey:   tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		SignedKey: signed,
+		Signature: sig,
+	}
+	bodyData, err := encode(r, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	u := fmt.Sprintf("%s/machine/%s/tka/sign", serverURL, machinePubKey.HexString())
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("tka/sign response: %v, %.200s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
 func decode(res *http.Response, v interface{}, serverKey *wgkey.Key, mkey *wgkey.Private) error {
 	defer res.Body.Close()
 	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
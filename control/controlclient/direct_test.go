@@ -10,8 +10,10 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/persist"
 	"tailscale.com/types/wgkey"
 )
 
@@ -158,6 +160,41 @@ func TestNewDirect(t *testing.T) {
 	}
 }
 
+func TestResumeStateValidFor(t *testing.T) {
+	nodePriv, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPriv, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey := otherPriv.Public()
+	p := persist.Persist{PrivateNodeKey: nodePriv}
+	nodeKey := tailcfg.NodeKey(nodePriv.Public())
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		rs   *ResumeState
+		p    persist.Persist
+		want bool
+	}{
+		{"nil", nil, p, false},
+		{"no_server_key", &ResumeState{NodeKey: nodeKey}, p, false},
+		{"no_node_key", &ResumeState{ServerKey: serverKey, NodeKey: nodeKey}, persist.Persist{}, false},
+		{"other_node", &ResumeState{ServerKey: serverKey, NodeKey: tailcfg.NodeKey(otherPriv.Public())}, p, false},
+		{"expired", &ResumeState{ServerKey: serverKey, NodeKey: nodeKey, Expiry: now.Add(-time.Minute)}, p, false},
+		{"no_expiry", &ResumeState{ServerKey: serverKey, NodeKey: nodeKey}, p, true},
+		{"unexpired", &ResumeState{ServerKey: serverKey, NodeKey: nodeKey, Expiry: now.Add(time.Hour)}, p, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rs.validFor(tt.p, now); got != tt.want {
+			t.Errorf("%s: validFor = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestNewHostinfo(t *testing.T) {
 	hi := NewHostinfo()
 	if hi == nil {
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/wgkey"
+)
+
+// ResumeState is what a Client needs to pick up an earlier session of
+// the same node, such as one from before tailscaled restarted,
+// without registering with the control server again: it goes
+// straight to polling for netmaps. If that fails, the Client falls
+// back to registering as usual.
+type ResumeState struct {
+	ServerKey wgkey.Key
+	NodeKey   tailcfg.NodeKey
+	Expiry    time.Time // of NodeKey; zero if unknown
+}
+
+// validFor reports whether rs, which may be nil, can resume a session
+// of the node with the persisted state p at time now.
+func (rs *ResumeState) validFor(p persist.Persist, now time.Time) bool {
+	if rs == nil || rs.ServerKey.IsZero() || p.PrivateNodeKey.IsZero() {
+		return false
+	}
+	if rs.NodeKey != tailcfg.NodeKey(p.PrivateNodeKey.Public()) {
+		return false
+	}
+	return rs.Expiry.IsZero() || rs.Expiry.After(now)
+}
+
+// ResumeState returns the state needed to resume the current session
+// later, or nil if there's no registered session.
+func (c *Direct) ResumeState() *ResumeState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serverKey.IsZero() || c.persist.PrivateNodeKey.IsZero() {
+		return nil
+	}
+	rs := &ResumeState{
+		ServerKey: c.serverKey,
+		NodeKey:   tailcfg.NodeKey(c.persist.PrivateNodeKey.Public()),
+	}
+	if c.expiry != nil {
+		rs.Expiry = *c.expiry
+	}
+	return rs
+}
@@ -61,6 +61,7 @@ Login:
 Steady state:
 * server occasionally sends frameKeepAlive (or framePing)
 * client responds to any framePing with a framePong
+* client sends framePing if frameServerInfo had acksPings; server responds with framePong
 * client sends frameSendPacket
 * server then sends frameRecvPacket to recipient
 */
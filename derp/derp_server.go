@@ -8,6 +8,7 @@ package derp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	crand "crypto/rand"
@@ -22,8 +23,10 @@ import (
 	"log"
 	"math/big"
 	"math/rand"
+	"net"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +35,7 @@ import (
 	"go4.org/mem"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"tailscale.com/disco"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
@@ -120,6 +124,13 @@ type Server struct {
 	multiForwarderCreated    expvar.Int
 	multiForwarderDeleted    expvar.Int
 	removePktForwardOther    expvar.Int
+	packetsThrottled         expvar.Int // send frames delayed by ClientLimits
+	connsRejectedReason      metrics.LabelMap
+
+	// Set before serving begins; see SetClientLimits and
+	// SetVerifyClient.
+	limits           ClientLimits
+	verifyClientFunc func(clientKey key.Public, remoteAddr string) error
 
 	mu          sync.Mutex
 	closed      bool
@@ -138,6 +149,31 @@ type Server struct {
 	// because it includes intra-region forwarded packets as the
 	// src.
 	sentTo map[key.Public]map[key.Public]int64 // src => dst => dst's latest sclient.connNum
+	// connsPerIP is the number of non-mesh clients connected from
+	// each IP, for ClientLimits.MaxConnsPerIP.
+	connsPerIP map[string]int
+}
+
+// ClientLimits are limits on the clients of a Server, to protect it
+// from abuse. Trusted mesh peers are exempt. Zero values mean no
+// limit.
+type ClientLimits struct {
+	// BytesPerSecond and PacketsPerSecond limit the rate at which
+	// each client may send packets. A client over its limit isn't
+	// disconnected and its packets aren't dropped; the server just
+	// stops reading from it until it's back under, so TCP pushes
+	// back on the client. Up to a second's worth may be sent in a
+	// burst.
+	BytesPerSecond   int
+	PacketsPerSecond int
+
+	// MaxConns is the maximum number of clients that may be
+	// connected at once.
+	MaxConns int
+
+	// MaxConnsPerIP is the maximum number of clients that may be
+	// connected at once from each IP address.
+	MaxConnsPerIP int
 }
 
 // PacketForwarder is something that can forward packets.
@@ -175,6 +211,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		limitedLogf:          logger.RateLimitedFn(logf, 30*time.Second, 5, 100),
 		packetsRecvByKind:    metrics.LabelMap{Label: "kind"},
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
+		connsRejectedReason:  metrics.LabelMap{Label: "reason"},
 		clients:              map[key.Public]*sclient{},
 		clientsEver:          map[key.Public]bool{},
 		clientsMesh:          map[key.Public]PacketForwarder{},
@@ -182,6 +219,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		memSys0:              ms.Sys,
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.Public]map[key.Public]int64{},
+		connsPerIP:           map[string]int{},
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -203,6 +241,23 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// SetClientLimits sets limits on the server's clients.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientLimits(l ClientLimits) {
+	s.limits = l
+}
+
+// SetVerifyClient sets a func that's called with the public key and
+// remote address of each new client, other than trusted mesh peers.
+// If it returns an error, the client is rejected. It can be used to
+// only admit the nodes of a particular tailnet.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClient(f func(clientKey key.Public, remoteAddr string) error) {
+	s.verifyClientFunc = f
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -436,8 +491,19 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
-		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	canMesh := clientInfo != nil && clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey
+	if !canMesh {
+		// The connection limits are cheap to check, unlike the
+		// verify func, so they go first.
+		ip := remoteIP(remoteAddr)
+		if err := s.admitClient(clientKey, ip); err != nil {
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
+		defer s.releaseClient(ip)
+		if err := s.verifyClient(clientKey, remoteAddr); err != nil {
+			s.connsRejectedReason.Get("verify").Add(1)
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
 	}
 
 	// At this point we trust the client so we don't time out.
@@ -459,10 +525,13 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		connectedAt: time.Now(),
 		sendQueue:   make(chan pkt, perClientSendQueueDepth),
 		peerGone:    make(chan key.Public),
-		canMesh:     clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		sendPongCh:  make(chan [8]byte, 1),
+		canMesh:     canMesh,
 	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		c.initLimiters(s.limits)
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -510,13 +579,17 @@ func (c *sclient) run(ctx context.Context) error {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
 		case frameSendPacket:
-			err = c.handleFrameSendPacket(ft, fl)
+			if err = c.throttle(ctx, fl); err == nil {
+				err = c.handleFrameSendPacket(ft, fl)
+			}
 		case frameForwardPacket:
 			err = c.handleFrameForwardPacket(ft, fl)
 		case frameWatchConns:
 			err = c.handleFrameWatchConns(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
+		case framePing:
+			err = c.handleFramePing(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
@@ -526,11 +599,85 @@ func (c *sclient) run(ctx context.Context) error {
 	}
 }
 
+// initLimiters sets up c's rate limiters according to l.
+func (c *sclient) initLimiters(l ClientLimits) {
+	if l.BytesPerSecond > 0 {
+		// Allow at least one maximum size frame through, or
+		// throttle could never admit it.
+		burst := l.BytesPerSecond
+		if min := MaxPacketSize + keyLen; burst < min {
+			burst = min
+		}
+		c.bytesLimit = rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst)
+	}
+	if l.PacketsPerSecond > 0 {
+		c.pktsLimit = rate.NewLimiter(rate.Limit(l.PacketsPerSecond), l.PacketsPerSecond)
+	}
+}
+
+// throttle waits, before reading a send packet frame of frameLen
+// bytes from c, until c is within its rate limits.
+func (c *sclient) throttle(ctx context.Context, frameLen uint32) error {
+	now := time.Now()
+	var delay time.Duration
+	if c.bytesLimit != nil {
+		n := int(frameLen)
+		if n > c.bytesLimit.Burst() {
+			// Oversized; recvPacket rejects it.
+			n = c.bytesLimit.Burst()
+		}
+		if d := c.bytesLimit.ReserveN(now, n).DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if c.pktsLimit != nil {
+		if d := c.pktsLimit.ReserveN(now, 1).DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	c.s.packetsThrottled.Add(1)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *sclient) handleUnknownFrame(ft frameType, fl uint32) error {
 	_, err := io.CopyN(ioutil.Discard, c.br, int64(fl))
 	return err
 }
 
+// handleFramePing queues a pong reply to the client's ping for
+// sendLoop to write.
+func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
+	if fl < 8 {
+		return fmt.Errorf("framePing wrong size")
+	}
+	var data [8]byte
+	if _, err := io.ReadFull(c.br, data[:]); err != nil {
+		return err
+	}
+	if extra := int64(fl) - 8; extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.sendPongCh <- data:
+	default:
+		// A pong is already pending; the client only needs one
+		// reply to know the connection is alive.
+	}
+	return nil
+}
+
 func (c *sclient) handleFrameNotePreferred(ft frameType, fl uint32) error {
 	if fl != 1 {
 		return fmt.Errorf("frameNotePreferred wrong size")
@@ -636,6 +783,8 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -682,6 +831,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 		select {
 		case <-dst.done:
 			s.packetsDropped.Add(1)
+			dst.packetsDropped.Add(1)
 			s.packetsDroppedGone.Add(1)
 			if debug {
 				c.logf("dropping packet for shutdown client %x", dstKey)
@@ -698,6 +848,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 		select {
 		case <-dst.sendQueue:
 			s.packetsDropped.Add(1)
+			dst.packetsDropped.Add(1)
 			s.packetsDroppedQueueHead.Add(1)
 			if verboseDropKeys[dstKey] {
 				// Generate a full string including src and dst, so
@@ -716,6 +867,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	// this case to keep reader unblocked.
 	s.packetsDropped.Add(1)
 	s.packetsDroppedQueueTail.Add(1)
+	dst.packetsDropped.Add(1)
 	if verboseDropKeys[dstKey] {
 		// Generate a full string including src and dst, so
 		// the limiter kicks in once per src.
@@ -749,12 +901,54 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
-	// TODO(crawshaw): implement policy constraints on who can use the DERP server
-	// TODO(bradfitz): ... and at what rate.
+func (s *Server) verifyClient(clientKey key.Public, remoteAddr string) error {
+	if s.verifyClientFunc == nil {
+		return nil
+	}
+	return s.verifyClientFunc(clientKey, remoteAddr)
+}
+
+// remoteIP returns the IP address part of remoteAddr, or all of it if
+// it's not an ip:port.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// admitClient checks whether a new non-mesh client with key clientKey
+// connecting from ip fits within the server's connection limits, and
+// if so counts it. Each successful call must be paired with a call to
+// releaseClient. A client replacing its own previous connection is
+// always admitted, as that connection is about to close.
+func (s *Server) admitClient(clientKey key.Public, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[clientKey] == nil {
+		if max := s.limits.MaxConns; max > 0 && len(s.clients) >= max {
+			s.connsRejectedReason.Get("max_conns").Add(1)
+			return fmt.Errorf("server at its limit of %d clients", max)
+		}
+		if max := s.limits.MaxConnsPerIP; max > 0 && s.connsPerIP[ip] >= max {
+			s.connsRejectedReason.Get("max_conns_per_ip").Add(1)
+			return fmt.Errorf("%s at its limit of %d clients", ip, max)
+		}
+	}
+	s.connsPerIP[ip]++
 	return nil
 }
 
+// releaseClient undoes a successful admitClient call.
+func (s *Server) releaseClient(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
 func (s *Server) sendServerKey(bw *bufio.Writer) error {
 	buf := make([]byte, 0, len(magic)+len(s.publicKey))
 	buf = append(buf, magic...)
@@ -764,6 +958,10 @@ func (s *Server) sendServerKey(bw *bufio.Writer) error {
 
 type serverInfo struct {
 	Version int `json:"version,omitempty"`
+
+	// AcksPings is whether the server replies to framePing from
+	// clients with a framePong.
+	AcksPings bool `json:"acksPings,omitempty"`
 }
 
 func (s *Server) sendServerInfo(bw *bufio.Writer, clientKey key.Public) error {
@@ -771,7 +969,7 @@ func (s *Server) sendServerInfo(bw *bufio.Writer, clientKey key.Public) error {
 	if _, err := crand.Read(nonce[:]); err != nil {
 		return err
 	}
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion, AcksPings: true})
 	if err != nil {
 		return err
 	}
@@ -896,8 +1094,18 @@ type sclient struct {
 	sendQueue  chan pkt        // packets queued to this client; never closed
 	peerGone   chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate chan struct{}   // write request to write peerStateChange
+	sendPongCh chan [8]byte    // write request to reply to a client's ping
 	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
 
+	// Rate limits from ClientLimits, or nil. Used only by run.
+	bytesLimit *rate.Limiter
+	pktsLimit  *rate.Limiter
+
+	// Per-client stats, for ClientStats. Safe for concurrent use.
+	packetsRecv, bytesRecv expvar.Int // sent by the client
+	packetsSent, bytesSent expvar.Int // written to the client
+	packetsDropped         expvar.Int // destined to the client but dropped
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -970,6 +1178,7 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			select {
 			case <-c.sendQueue:
 				c.s.packetsDropped.Add(1)
+				c.packetsDropped.Add(1)
 				c.s.packetsDroppedGone.Add(1)
 				if debug {
 					c.logf("dropping packet for shutdown %x", c.key)
@@ -1003,6 +1212,9 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			continue
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
+			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 			continue
@@ -1025,6 +1237,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			continue
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 		}
@@ -1041,6 +1255,16 @@ func (c *sclient) sendKeepAlive() error {
 	return writeFrameHeader(c.bw, frameKeepAlive, 0)
 }
 
+// sendPong sends a pong frame echoing a client's ping, without flushing.
+func (c *sclient) sendPong(data [8]byte) error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw, framePong, 8); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1116,12 +1340,15 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 		if err != nil {
 			c.s.packetsDropped.Add(1)
 			c.s.packetsDroppedWrite.Add(1)
+			c.packetsDropped.Add(1)
 			if debug {
 				c.logf("dropping packet to %x: %v", c.key, err)
 			}
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1290,12 +1517,53 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("packets_throttled", &s.packetsThrottled)
+	m.Set("counter_connections_rejected_reason", &s.connsRejectedReason)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long)
 	m.Set("version", &expvarVersion)
 	return m
 }
 
+// ClientStats are the stats of a client's current connection to a
+// Server, as returned by Server.ClientStats.
+type ClientStats struct {
+	Key         key.Public
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Mesh        bool // whether the client is a trusted mesh peer
+
+	PacketsRecv, BytesRecv int64 // data packets sent by the client
+	PacketsSent, BytesSent int64 // data packets written to the client
+	PacketsDropped         int64 // packets for the client that were dropped
+}
+
+// ClientStats returns the stats of all clients currently connected
+// to s, sorted by key. The counters start at zero for each new
+// connection.
+func (s *Server) ClientStats() []ClientStats {
+	s.mu.Lock()
+	ret := make([]ClientStats, 0, len(s.clients))
+	for _, c := range s.clients {
+		ret = append(ret, ClientStats{
+			Key:            c.key,
+			RemoteAddr:     c.remoteAddr,
+			ConnectedAt:    c.connectedAt,
+			Mesh:           c.canMesh,
+			PacketsRecv:    c.packetsRecv.Value(),
+			BytesRecv:      c.bytesRecv.Value(),
+			PacketsSent:    c.packetsSent.Value(),
+			BytesSent:      c.bytesSent.Value(),
+			PacketsDropped: c.packetsDropped.Value(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Key[:], ret[j].Key[:]) < 0
+	})
+	return ret
+}
+
 func (s *Server) ConsistencyCheck() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
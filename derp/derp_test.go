@@ -20,6 +20,7 @@ import (
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -196,6 +197,27 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(0)
 	recvNothing(1)
 
+	stats := map[key.Public]ClientStats{}
+	for _, st := range s.ClientStats() {
+		stats[st.Key] = st
+	}
+	if len(stats) != numClients {
+		t.Errorf("ClientStats has %d clients; want %d", len(stats), numClients)
+	}
+	for i, want := range []ClientStats{
+		{PacketsRecv: 1, BytesRecv: int64(len(msg1))},
+		{PacketsRecv: 1, BytesRecv: int64(len(msg2)), PacketsSent: 1, BytesSent: int64(len(msg1))},
+		{PacketsSent: 1, BytesSent: int64(len(msg2))},
+	} {
+		got := stats[clientKeys[i]]
+		want.Key = clientKeys[i]
+		want.RemoteAddr = fmt.Sprintf("test-client-%d", i)
+		want.ConnectedAt = got.ConnectedAt
+		if got != want {
+			t.Errorf("client %d stats = %+v; want %+v", i, got, want)
+		}
+	}
+
 	wantActive(3, 0)
 	clients[0].NotePreferred(true)
 	wantActive(3, 1)
@@ -610,6 +632,98 @@ func (c *testClient) close(t *testing.T) {
 	c.nc.Close()
 }
 
+func TestClientLimits(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	banned := newPrivateKey(t)
+	s.SetClientLimits(ClientLimits{MaxConns: 2, MaxConnsPerIP: 1})
+	var verifies int32
+	s.SetVerifyClient(func(k key.Public, remoteAddr string) error {
+		atomic.AddInt32(&verifies, 1)
+		if k == banned.Public() {
+			return errors.New("banned")
+		}
+		return nil
+	})
+
+	connect := func(priv key.Private, remoteAddr string) error {
+		cin, cout := nettest.NewConn(remoteAddr, 1024)
+		go s.Accept(cin, bufio.NewReadWriter(bufio.NewReader(cin), bufio.NewWriter(cin)), remoteAddr)
+		c, err := NewClient(priv, cout, bufio.NewReadWriter(bufio.NewReader(cout), bufio.NewWriter(cout)), t.Logf)
+		if err != nil {
+			return err
+		}
+		m, err := c.Recv()
+		if err != nil {
+			cout.Close()
+			return err
+		}
+		if _, ok := m.(ServerInfoMessage); !ok {
+			return fmt.Errorf("first Recv was unexpected type %T", m)
+		}
+		return nil
+	}
+
+	k1, k2, k3 := newPrivateKey(t), newPrivateKey(t), newPrivateKey(t)
+	steps := []struct {
+		name       string
+		priv       key.Private
+		remoteAddr string
+		wantOK     bool
+	}{
+		{"first", k1, "1.2.3.4:1", true},
+		{"same-ip", k2, "1.2.3.4:2", false},
+		{"unverified", banned, "5.6.7.8:1", false},
+		{"second", k2, "5.6.7.8:2", true},
+		{"over-max", k3, "9.9.9.9:1", false},
+		{"replace", k1, "1.2.3.4:3", true},
+	}
+	for _, st := range steps {
+		err := connect(st.priv, st.remoteAddr)
+		if (err == nil) != st.wantOK {
+			t.Fatalf("%s: err = %v; want ok=%v", st.name, err, st.wantOK)
+		}
+	}
+	for reason, want := range map[string]int64{
+		"verify":           1,
+		"max_conns":        1,
+		"max_conns_per_ip": 1,
+	} {
+		if got := s.connsRejectedReason.Get(reason).Value(); got != want {
+			t.Errorf("rejected for %s = %d; want %d", reason, got, want)
+		}
+	}
+	// Clients over the limits are rejected without calling the
+	// (possibly expensive) verify func.
+	if got := atomic.LoadInt32(&verifies); got != 4 {
+		t.Errorf("verify func called %d times; want 4", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	c := &sclient{s: s}
+	c.initLimiters(ClientLimits{PacketsPerSecond: 10})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 10; i++ {
+		if err := c.throttle(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.packetsThrottled.Value(); n != 0 {
+		t.Fatalf("throttled %d packets within burst", n)
+	}
+	cancel()
+	if err := c.throttle(ctx, 100); err == nil {
+		t.Fatal("throttle over limit didn't wait")
+	}
+	if n := s.packetsThrottled.Value(); n != 1 {
+		t.Errorf("throttled %d packets; want 1", n)
+	}
+}
+
 // TestWatch tests the connection watcher mechanism used by regional
 // DERP nodes to mesh up with each other.
 func TestWatch(t *testing.T) {
@@ -812,6 +926,14 @@ func TestClientRecv(t *testing.T) {
 			},
 			want: PingMessage{1, 2, 3, 4, 5, 6, 7, 8},
 		},
+		{
+			name: "pong",
+			input: []byte{
+				byte(framePong), 0, 0, 0, 8,
+				1, 2, 3, 4, 5, 6, 7, 8,
+			},
+			want: PongMessage{1, 2, 3, 4, 5, 6, 7, 8},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -849,6 +971,43 @@ func TestClientSendPong(t *testing.T) {
 
 }
 
+func TestServerAcksPings(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+
+	cin, cout := nettest.NewConn("client", 1024)
+	go s.Accept(cin, bufio.NewReadWriter(bufio.NewReader(cin), bufio.NewWriter(cin)), "client")
+	c, err := NewClient(newPrivateKey(t), cout, bufio.NewReadWriter(bufio.NewReader(cout), bufio.NewWriter(cout)), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si, ok := m.(ServerInfoMessage); !ok || !si.AcksPings {
+		t.Fatalf("first Recv = %#v; want ServerInfoMessage with AcksPings", m)
+	}
+
+	ping := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := c.SendPing(ping); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := c.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(KeepAliveMessage); ok {
+			continue
+		}
+		if pong, ok := m.(PongMessage); !ok || pong != PongMessage(ping) {
+			t.Fatalf("Recv = %#v; want PongMessage(%v)", m, ping)
+		}
+		break
+	}
+}
+
 func BenchmarkSendRecv(b *testing.B) {
 	for _, size := range []int{10, 100, 1000, 10000} {
 		b.Run(fmt.Sprintf("msgsize=%d", size), func(b *testing.B) { benchmarkSendRecvSize(b, size) })
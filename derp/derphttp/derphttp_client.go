@@ -32,6 +32,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tshttpproxy"
@@ -51,6 +52,17 @@ type Client struct {
 	DNSCache  *dnscache.Resolver // optional; nil means no caching
 	MeshKey   string             // optional; for trusted clients
 
+	// NAT64Prefix optionally returns the NAT64 prefix of the
+	// current network, if any. When it returns a non-zero prefix,
+	// nodes with an IPv4 literal are also dialed via their
+	// NAT64-synthesized IPv6 address.
+	NAT64Prefix func() netaddr.IPPrefix
+
+	// Netns optionally sets the interface that connections to the
+	// server bind to. If nil, the OS is asked for the default
+	// route's on each dial.
+	Netns *netns.Binding
+
 	privateKey key.Private
 	logf       logger.Logf
 
@@ -69,6 +81,7 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	live         *connLiveness // for pingLoop, or nil
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -130,6 +143,15 @@ func (c *Client) ServerPublicKey() key.Public {
 	return c.serverPubKey
 }
 
+// IsConnected reports whether c currently has a connection to the
+// server. A connection that broke is only noticed by the next failed
+// Send or Recv.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil
+}
+
 func urlPort(u *url.URL) string {
 	if p := u.Port(); p != "" {
 		return p
@@ -234,6 +256,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if err != nil {
 		return nil, 0, err
 	}
+	setTCPUserTimeout(tcpConn, tcpUserTimeout)
 
 	// Now that we have a TCP connection, force close it if the
 	// TLS handshake + DERP setup takes too long.
@@ -360,7 +383,7 @@ func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 	host := c.url.Hostname()
 	hostOrIP := host
 
-	dialer := netns.NewDialer()
+	dialer := c.Netns.NewDialer()
 
 	if c.DNSCache != nil {
 		ip, _, err := c.DNSCache.LookupIP(ctx, host)
@@ -457,7 +480,7 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 }
 
 func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
-	return netns.NewDialer().DialContext(ctx, proto, addr)
+	return c.Netns.NewDialer().DialContext(ctx, proto, addr)
 }
 
 // shouldDialProto reports whether an explicitly provided IPv4 or IPv6
@@ -530,6 +553,9 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 	if shouldDialProto(n.IPv6, netaddr.IP.Is6) {
 		startDial(n.IPv6, "tcp6")
 	}
+	if ip6, ok := c.nat64Addr(n.IPv4); ok {
+		startDial(ip6.String(), "tcp6")
+	}
 	if nwait == 0 {
 		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
 	}
@@ -561,6 +587,23 @@ func firstStr(a, b string) string {
 	return b
 }
 
+// nat64Addr returns the NAT64-synthesized IPv6 address of the
+// IPv4 literal ip4, if the client knows of a NAT64 prefix.
+func (c *Client) nat64Addr(ip4 string) (netaddr.IP, bool) {
+	if c.NAT64Prefix == nil || ip4 == "" {
+		return netaddr.IP{}, false
+	}
+	pfx := c.NAT64Prefix()
+	if pfx.IsZero() {
+		return netaddr.IP{}, false
+	}
+	ip, err := netaddr.ParseIP(ip4)
+	if err != nil || !ip.Is4() {
+		return netaddr.IP{}, false
+	}
+	return nat64.Synthesize(pfx, ip)
+}
+
 // dialNodeUsingProxy connects to n using a CONNECT to the HTTP(s) proxy in proxyURL.
 func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, proxyURL *url.URL) (proxyConn net.Conn, err error) {
 	pu := proxyURL
@@ -626,25 +669,35 @@ func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, pr
 }
 
 func (c *Client) Send(dstKey key.Public, b []byte) error {
-	client, _, err := c.connect(context.TODO(), "derphttp.Client.Send")
-	if err != nil {
-		return err
-	}
-	if err := client.Send(dstKey, b); err != nil {
-		c.closeForReconnect(client)
-	}
-	return err
+	return c.sendWithRetry("derphttp.Client.Send", func(client *derp.Client) error {
+		return client.Send(dstKey, b)
+	})
 }
 
 func (c *Client) ForwardPacket(from, to key.Public, b []byte) error {
-	client, _, err := c.connect(context.TODO(), "derphttp.Client.ForwardPacket")
-	if err != nil {
-		return err
-	}
-	if err := client.ForwardPacket(from, to, b); err != nil {
+	return c.sendWithRetry("derphttp.Client.ForwardPacket", func(client *derp.Client) error {
+		return client.ForwardPacket(from, to, b)
+	})
+}
+
+// sendWithRetry calls send with the current connection. If that
+// fails, it reconnects and tries once more, so a packet queued while
+// the old connection was dying isn't lost.
+func (c *Client) sendWithRetry(caller string, send func(*derp.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		client, _, err := c.connect(context.TODO(), caller)
+		if err != nil {
+			return err
+		}
+		err = send(client)
+		if err == nil {
+			return nil
+		}
 		c.closeForReconnect(client)
+		if attempt > 0 || c.isClosed() {
+			return err
+		}
 	}
-	return err
 }
 
 // SendPong sends a reply to a ping, with the ping's provided
@@ -743,14 +796,27 @@ func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	m, err = client.Recv()
-	if err != nil {
-		c.closeForReconnect(client)
-		if c.isClosed() {
-			err = ErrClientClosed
+	for {
+		m, err = client.Recv()
+		if err != nil {
+			c.closeForReconnect(client)
+			if c.isClosed() {
+				err = ErrClientClosed
+			}
+			return m, connGen, err
+		}
+		c.noteRecv(client)
+		switch m := m.(type) {
+		case derp.ServerInfoMessage:
+			if m.AcksPings {
+				c.startPingLoop(client)
+			}
+		case derp.PongMessage:
+			// A reply to pingLoop; nothing for the caller.
+			continue
 		}
+		return m, connGen, nil
 	}
-	return m, connGen, err
 }
 
 func (c *Client) isClosed() bool {
@@ -797,6 +863,7 @@ func (c *Client) closeForReconnect(brokenClient *derp.Client) {
 		c.netConn = nil
 	}
 	c.client = nil
+	c.live = nil
 }
 
 var ErrClientClosed = errors.New("derphttp.Client closed")
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derphttp
+
+import (
+	"crypto/rand"
+	"time"
+
+	"tailscale.com/derp"
+)
+
+const (
+	// pingIdle is how long a connection can go without receiving
+	// anything from the server before pingLoop pings it.
+	pingIdle = 15 * time.Second
+
+	// pingTimeout is how long pingLoop waits for the server to
+	// send anything after a ping before giving up on the
+	// connection.
+	pingTimeout = 5 * time.Second
+
+	// tcpUserTimeout is how long the kernel lets data sent to the
+	// server go unacknowledged before dropping the connection, on
+	// platforms that support it.
+	tcpUserTimeout = 15 * time.Second
+)
+
+// connLiveness is the state pingLoop needs to watch one connection.
+type connLiveness struct {
+	client *derp.Client
+	recv   chan struct{} // sent to (without blocking) on each received message
+}
+
+// startPingLoop starts watching client, the current connection, for
+// liveness. It's called once the server has said it acks pings.
+func (c *Client) startPingLoop(client *derp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != client || c.ctx == nil {
+		return
+	}
+	c.live = &connLiveness{
+		client: client,
+		recv:   make(chan struct{}, 1),
+	}
+	go c.pingLoop(c.live)
+}
+
+// noteRecv notes that a message was received on client, for pingLoop.
+func (c *Client) noteRecv(client *derp.Client) {
+	c.mu.Lock()
+	live := c.live
+	c.mu.Unlock()
+	if live == nil || live.client != client {
+		return
+	}
+	select {
+	case live.recv <- struct{}{}:
+	default:
+	}
+}
+
+// pingLoop pings the server whenever live's connection has been idle
+// for pingIdle, and closes the connection for reconnect if the server
+// doesn't answer within pingTimeout. A relay connection that's
+// silently dropped (by a NAT or a sleeping laptop's network, say) is
+// thus noticed in seconds instead of whenever the OS gives up on it.
+//
+// It returns once the connection is no longer current.
+func (c *Client) pingLoop(live *connLiveness) {
+	t := time.NewTimer(pingIdle)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-live.recv:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(pingIdle)
+			continue
+		case <-t.C:
+		}
+
+		if !c.isCurrent(live.client) {
+			return
+		}
+		var data [8]byte
+		rand.Read(data[:])
+		if err := live.client.SendPing(data); err != nil {
+			c.closeForReconnect(live.client)
+			return
+		}
+		t.Reset(pingTimeout)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-live.recv:
+			// The pong, or anything else: the connection's alive.
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(pingIdle)
+		case <-t.C:
+			if !c.isCurrent(live.client) {
+				return
+			}
+			c.logf("derphttp: no reply to ping in %v; reconnecting", pingTimeout)
+			c.closeForReconnect(live.client)
+			return
+		}
+	}
+}
+
+// isCurrent reports whether client is c's current connection.
+func (c *Client) isCurrent(client *derp.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client == client
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package derphttp
+
+import (
+	"net"
+	"time"
+)
+
+// setTCPUserTimeout does nothing; TCP_USER_TIMEOUT is Linux-only.
+func setTCPUserTimeout(nc net.Conn, d time.Duration) {}
@@ -97,10 +97,16 @@ func appendMsgHeader(b []byte, t MessageType, ver uint8, dataLen int) (all, data
 
 type Ping struct {
 	TxID [12]byte
+
+	// Padding is the number of zero bytes that follow TxID, to
+	// probe whether packets of a given size get through. Receivers
+	// that predate it ignore the extra bytes, as they do any at the
+	// end of a message.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePing, v0, 12)
+	ret, d := appendMsgHeader(b, TypePing, v0, 12+m.Padding)
 	copy(d, m.TxID[:])
 	return ret
 }
@@ -111,6 +117,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	}
 	m = new(Ping)
 	copy(m.TxID[:], p)
+	m.Padding = len(p) - 12
 	return m, nil
 }
 
@@ -212,6 +219,9 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
 	case *Ping:
+		if m.Padding > 0 {
+			return fmt.Sprintf("ping tx=%x padding=%d", m.TxID[:6], m.Padding)
+		}
 		return fmt.Sprintf("ping tx=%x", m.TxID[:6])
 	case *Pong:
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
@@ -7,6 +7,8 @@
 package health
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -25,11 +27,31 @@ var (
 	lastMapPollEndedAt      time.Time
 	lastStreamedMapResponse time.Time
 	derpHomeRegion          int
+	derpHomeSince           time.Time // when derpHomeRegion last changed
 	derpRegionConnected     = map[int]bool{}
 	derpRegionLastFrame     = map[int]time.Time{}
 	lastMapRequestHeard     time.Time // time we got a 200 from control for a MapRequest
 	ipnState                string
 	ipnWantRunning          bool
+	updateAvailable         string // latest version, if newer than ours
+	updateSecurityFix       bool   // updateAvailable fixes a security problem
+	controlClockSkew        time.Duration
+)
+
+const (
+	// tooIdle is how long a connection to control or the home DERP
+	// server may go without any message before it's considered
+	// broken. Both send keep-alives more often than this.
+	tooIdle = 2*time.Minute + 5*time.Second
+
+	// mapPollGrace is how long we may be out of a map poll, such
+	// as between polls, before control is considered unreachable.
+	mapPollGrace = 30 * time.Second
+
+	// maxClockSkew is how far our clock may be from control's
+	// before it's reported. Node key expiry and TLS certificate
+	// checks both depend on it.
+	maxClockSkew = 2 * time.Minute
 )
 
 type watchHandle byte
@@ -56,12 +78,85 @@ func SetRouterHealth(err error) { set("router", err) }
 // RouterHealth returns the wgengine/router.Router error state.
 func RouterHealth() error { return get("router") }
 
+// SetReconfigHealth sets the state of applying the latest network
+// config. A failed config is rolled back, so an error here means the
+// node is running with an older config than it should be.
+func SetReconfigHealth(err error) { set("reconfig", err) }
+
+// ReconfigHealth returns the network config error state.
+func ReconfigHealth() error { return get("reconfig") }
+
+// SetNetworkChangesHealth sets the state of network changes waiting
+// for the user to accept them (see ipn.Prefs.ConfirmNetworkChanges).
+func SetNetworkChangesHealth(err error) { set("network-changes", err) }
+
+// SetIPForwardingHealth sets the state of the OS forwarding IP
+// packets, which advertising routes needs.
+func SetIPForwardingHealth(err error) { set("ip-forwarding", err) }
+
 // SetNetworkCategoryHealth sets the state of setting the network adaptor's category.
 // This only applies on Windows.
 func SetNetworkCategoryHealth(err error) { set("network-category", err) }
 
 func NetworkCategoryHealth() error { return get("network-category") }
 
+// SetDNSHealth sets the state of applying the DNS config to the OS.
+func SetDNSHealth(err error) { set("dns", err) }
+
+// DNSHealth returns the last error from applying the DNS config to
+// the OS, or nil if it succeeded.
+func DNSHealth() error { return get("dns") }
+
+// SetLinkMonitorHealth sets the state of receiving network change
+// events from the OS. While it's failing, changes of network go
+// unnoticed.
+func SetLinkMonitorHealth(err error) { set("link-monitor", err) }
+
+// Warnings returns the current health problems, one per subsystem,
+// sorted.
+func Warnings() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var ret []string
+	for key, err := range m {
+		if err != nil {
+			ret = append(ret, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	for key, err := range checksLocked(time.Now()) {
+		ret = append(ret, fmt.Sprintf("%s: %v", key, err))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// SetUpdateAvailable notes that Tailscale version latest, which is
+// newer than this one, is available, and whether it fixes a security
+// problem. An empty latest means we're up to date, or don't know.
+func SetUpdateAvailable(latest string, securityFix bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	updateAvailable = latest
+	updateSecurityFix = latest != "" && securityFix
+}
+
+// Notices returns low-severity health items that, unlike Warnings,
+// don't mean anything is wrong, sorted.
+func Notices() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var ret []string
+	if updateAvailable != "" {
+		msg := fmt.Sprintf("update-available: Tailscale %s is available", updateAvailable)
+		if updateSecurityFix {
+			msg += " and fixes a security problem"
+		}
+		ret = append(ret, msg)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func get(key string) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -75,7 +170,6 @@ func set(key string, err error) {
 	if !ok && err == nil {
 		// Initial happy path.
 		m[key] = nil
-		selfCheckLocked()
 		return
 	}
 	if ok && (old == nil) == (err == nil) {
@@ -88,7 +182,6 @@ func set(key string, err error) {
 		return
 	}
 	m[key] = err
-	selfCheckLocked()
 	for _, cb := range watchers {
 		go cb(key, err)
 	}
@@ -100,7 +193,6 @@ func GotStreamedMapResponse() {
 	mu.Lock()
 	defer mu.Unlock()
 	lastStreamedMapResponse = time.Now()
-	selfCheckLocked()
 }
 
 // SetInPollNetMap records that we're in
@@ -122,8 +214,18 @@ func SetInPollNetMap(v bool) {
 func SetMagicSockDERPHome(region int) {
 	mu.Lock()
 	defer mu.Unlock()
+	if region != derpHomeRegion {
+		derpHomeSince = time.Now()
+	}
 	derpHomeRegion = region
-	selfCheckLocked()
+}
+
+// NoteControlTime notes control's clock reading t, such as from an
+// HTTP response's Date header, received just now.
+func NoteControlTime(t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	controlClockSkew = time.Since(t)
 }
 
 // NoteMapRequestHeard notes whenever we successfully sent a map request
@@ -136,21 +238,18 @@ func NoteMapRequestHeard(mr *tailcfg.MapRequest) {
 	// SetDERPRegionConnectedState
 
 	lastMapRequestHeard = time.Now()
-	selfCheckLocked()
 }
 
 func SetDERPRegionConnectedState(region int, connected bool) {
 	mu.Lock()
 	defer mu.Unlock()
 	derpRegionConnected[region] = connected
-	selfCheckLocked()
 }
 
 func NoteDERPRegionReceivedFrame(region int) {
 	mu.Lock()
 	defer mu.Unlock()
 	derpRegionLastFrame[region] = time.Now()
-	selfCheckLocked()
 }
 
 // state is an ipn.State.String() value: "Running", "Stopped", "NeedsLogin", etc.
@@ -159,17 +258,43 @@ func SetIPNState(state string, wantRunning bool) {
 	defer mu.Unlock()
 	ipnState = state
 	ipnWantRunning = wantRunning
-	selfCheckLocked()
 }
 
-func selfCheckLocked() {
-	// TODO: check states against each other.
-	// For staticcheck for now:
-	_ = inMapPollSince
-	_ = lastMapPollEndedAt
-	_ = lastStreamedMapResponse
-	_ = derpHomeRegion
-	_ = lastMapRequestHeard
-	_ = ipnState
-	_ = ipnWantRunning
+// checksLocked returns the problems inferred as of now from what
+// other packages have noted about control, DERP and the clock, keyed
+// by subsystem.
+func checksLocked(now time.Time) map[string]error {
+	ret := map[string]error{}
+	if d := controlClockSkew; d > maxClockSkew {
+		ret["clock"] = fmt.Errorf("local clock is %v ahead of control's", d.Round(time.Second))
+	} else if d < -maxClockSkew {
+		ret["clock"] = fmt.Errorf("local clock is %v behind control's", (-d).Round(time.Second))
+	}
+	if ipnState != "Running" || !ipnWantRunning {
+		// Not meant to be connected to anything.
+		return ret
+	}
+
+	if inMapPoll {
+		last := inMapPollSince
+		if lastStreamedMapResponse.After(last) {
+			last = lastStreamedMapResponse
+		}
+		if d := now.Sub(last); d > tooIdle {
+			ret["control"] = fmt.Errorf("no message from coordination server in %v", d.Round(time.Second))
+		}
+	} else if !lastMapPollEndedAt.IsZero() {
+		if d := now.Sub(lastMapPollEndedAt); d > mapPollGrace {
+			ret["control"] = fmt.Errorf("coordination server unreachable for %v", d.Round(time.Second))
+		}
+	}
+
+	if rid := derpHomeRegion; rid != 0 && now.Sub(derpHomeSince) > mapPollGrace {
+		if !derpRegionConnected[rid] {
+			ret["derp"] = fmt.Errorf("not connected to home DERP region %v", rid)
+		} else if d := now.Sub(derpRegionLastFrame[rid]); d > tooIdle {
+			ret["derp"] = fmt.Errorf("no message from home DERP region %v in %v", rid, d.Round(time.Second))
+		}
+	}
+	return ret
 }
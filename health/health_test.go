@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestChecks(t *testing.T) {
+	now := time.Now()
+	reset := func() {
+		ipnState, ipnWantRunning = "Running", true
+		inMapPoll, inMapPollSince = true, now.Add(-time.Hour)
+		lastStreamedMapResponse = now.Add(-time.Minute)
+		lastMapPollEndedAt = time.Time{}
+		derpHomeRegion, derpHomeSince = 1, now.Add(-time.Hour)
+		derpRegionConnected = map[int]bool{1: true}
+		derpRegionLastFrame = map[int]time.Time{1: now.Add(-time.Minute)}
+		controlClockSkew = 0
+	}
+	defer func() {
+		reset()
+		ipnState, ipnWantRunning = "", false
+		derpHomeRegion = 0
+	}()
+
+	tests := []struct {
+		name  string
+		setup func()
+		want  []string
+	}{
+		{"healthy", func() {}, nil},
+		{"stopped", func() {
+			ipnWantRunning = false
+			inMapPoll = false
+			lastMapPollEndedAt = now.Add(-time.Hour)
+		}, nil},
+		{"map-poll-idle", func() {
+			lastStreamedMapResponse = now.Add(-5 * time.Minute)
+		}, []string{"control"}},
+		{"between-map-polls", func() {
+			inMapPoll = false
+			lastMapPollEndedAt = now.Add(-5 * time.Second)
+		}, nil},
+		{"control-unreachable", func() {
+			inMapPoll = false
+			lastMapPollEndedAt = now.Add(-5 * time.Minute)
+		}, []string{"control"}},
+		{"derp-disconnected", func() {
+			derpRegionConnected[1] = false
+		}, []string{"derp"}},
+		{"derp-new-home", func() {
+			derpHomeRegion, derpHomeSince = 2, now
+		}, nil},
+		{"derp-idle", func() {
+			derpRegionLastFrame[1] = now.Add(-5 * time.Minute)
+		}, []string{"derp"}},
+		{"clock-ahead", func() {
+			controlClockSkew = 10 * time.Minute
+		}, []string{"clock"}},
+		{"clock-behind-stopped", func() {
+			ipnState = "Stopped"
+			controlClockSkew = -10 * time.Minute
+		}, []string{"clock"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			tt.setup()
+			var got []string
+			for k := range checksLocked(now) {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q; want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %q; want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Conditions of an AlertRule.
+const (
+	// AlertDERPOnly fires when traffic to a peer has been relayed
+	// through DERP, with no direct path, for longer than Threshold.
+	AlertDERPOnly = "derp-only"
+
+	// AlertHandshakeAge fires when a peer that was sent traffic in
+	// the last Threshold has had no WireGuard handshake in that time.
+	AlertHandshakeAge = "handshake-age"
+
+	// AlertKeyExpiry fires when the node key expires within
+	// Threshold.
+	AlertKeyExpiry = "key-expiry"
+)
+
+// An AlertRule is a condition that tailscaled checks periodically,
+// and the local actions it takes when the condition starts or stops
+// holding. It's for small deployments with no monitoring of their
+// own.
+type AlertRule struct {
+	// Name names the rule in alerts.
+	Name string
+
+	// Condition is AlertDERPOnly, AlertHandshakeAge or
+	// AlertKeyExpiry.
+	Condition string
+
+	// Threshold is the condition's duration, such as "10m" or
+	// "72h", in time.ParseDuration format.
+	Threshold string
+
+	// Peer optionally limits a per-peer condition to the peer with
+	// this name or Tailscale IP. Empty means any peer.
+	Peer string `json:",omitempty"`
+
+	// Webhook is an http or https URL to POST a JSON description of
+	// each alert to.
+	Webhook string `json:",omitempty"`
+
+	// Exec is the path of a program to run for each alert, with
+	// the alert in TS_ALERT_* environment variables.
+	Exec string `json:",omitempty"`
+
+	// EventLog is whether to write alerts to the Windows event
+	// log. It has no effect on other platforms.
+	EventLog bool `json:",omitempty"`
+}
+
+// Check reports whether r is a valid rule.
+func (r AlertRule) Check() error {
+	if r.Name == "" {
+		return errors.New("no name")
+	}
+	switch r.Condition {
+	case AlertDERPOnly, AlertHandshakeAge:
+	case AlertKeyExpiry:
+		if r.Peer != "" {
+			return fmt.Errorf("%s is not a per-peer condition", r.Condition)
+		}
+	default:
+		return fmt.Errorf("unknown condition %q; want %q, %q or %q", r.Condition, AlertDERPOnly, AlertHandshakeAge, AlertKeyExpiry)
+	}
+	if d, err := time.ParseDuration(r.Threshold); err != nil || d <= 0 {
+		return fmt.Errorf("invalid threshold %q; want a positive duration such as \"10m\"", r.Threshold)
+	}
+	if r.Webhook == "" && r.Exec == "" && !r.EventLog {
+		return errors.New("no action; want Webhook, Exec or EventLog")
+	}
+	if r.Webhook != "" {
+		u, err := url.Parse(r.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q", r.Webhook)
+		}
+	}
+	return nil
+}
+
+// ThresholdDuration returns r's Threshold. It's zero if r doesn't
+// pass Check.
+func (r AlertRule) ThresholdDuration() time.Duration {
+	d, _ := time.ParseDuration(r.Threshold)
+	return d
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+// ConfigFile is the contents of tailscaled's declarative config file
+// (tailscaled --config). It's applied to the prefs each time
+// tailscaled starts, so a node can be configured reproducibly without
+// running "tailscale up".
+//
+// The file is JSON, but may have comments and trailing commas
+// ("HuJSON"). Fields that are omitted leave the corresponding prefs
+// as they are.
+type ConfigFile struct {
+	// AuthKey is a node auth key to log in with if the node isn't
+	// logged in, or "file:" followed by the path of a file
+	// containing one.
+	AuthKey string `json:",omitempty"`
+
+	// Hostname overrides the OS hostname.
+	Hostname string `json:",omitempty"`
+
+	// AdvertiseRoutes are the subnet routes to advertise.
+	AdvertiseRoutes []netaddr.IPPrefix `json:",omitempty"`
+
+	// AdvertiseExitNode is whether to offer to be an exit node.
+	AdvertiseExitNode *bool `json:",omitempty"`
+
+	// ExitNode is the Tailscale IP of the exit node to use. The
+	// zero IP ("") stops using one.
+	ExitNode *netaddr.IP `json:",omitempty"`
+
+	// AdvertiseTags are the ACL tags to request.
+	AdvertiseTags []string `json:",omitempty"`
+
+	// AcceptRoutes is whether to accept other nodes' subnet routes.
+	AcceptRoutes *bool `json:",omitempty"`
+
+	// AcceptDNS is whether to use the DNS settings from the admin
+	// panel.
+	AcceptDNS *bool `json:",omitempty"`
+
+	// Ephemeral is whether to register as an ephemeral node. See
+	// Prefs.Ephemeral.
+	Ephemeral *bool `json:",omitempty"`
+
+	// Alerts are threshold alerts for tailscaled to check. Unlike
+	// the other fields, they're not prefs; they apply only while
+	// tailscaled runs with this config.
+	Alerts []AlertRule `json:",omitempty"`
+}
+
+// LoadConfigFile reads and checks the config file at path, resolving
+// a "file:" AuthKey.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseConfigFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.AuthKey, err = ResolveAuthKey(c.AuthKey); err != nil {
+		return nil, fmt.Errorf("%s: AuthKey: %w", path, err)
+	}
+	return c, nil
+}
+
+// ResolveAuthKey returns the auth key v. If v is "file:" followed by
+// a path, such as that of a mounted secret, the key is read from
+// that file instead, ignoring surrounding whitespace.
+func ResolveAuthKey(v string) (string, error) {
+	if !strings.HasPrefix(v, "file:") {
+		return v, nil
+	}
+	kb, err := ioutil.ReadFile(strings.TrimPrefix(v, "file:"))
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(kb))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", strings.TrimPrefix(v, "file:"))
+	}
+	return key, nil
+}
+
+// ParseConfigFile parses and checks the contents of a config file.
+func ParseConfigFile(b []byte) (*ConfigFile, error) {
+	b, err := standardizeHuJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	c := new(ConfigFile)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	for _, r := range c.AdvertiseRoutes {
+		if r != r.Masked() {
+			return nil, fmt.Errorf("AdvertiseRoutes: %s has non-address bits set; expected %s", r, r.Masked())
+		}
+	}
+	for _, tag := range c.AdvertiseTags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("AdvertiseTags: %q: %v", tag, err)
+		}
+	}
+	names := map[string]bool{}
+	for _, r := range c.Alerts {
+		if err := r.Check(); err != nil {
+			return nil, fmt.Errorf("alert %q: %v", r.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate alert %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	if len(c.Hostname) > 256 {
+		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(c.Hostname))
+	}
+	return c, nil
+}
+
+var (
+	exitRoute4 = netaddr.MustParseIPPrefix("0.0.0.0/0")
+	exitRoute6 = netaddr.MustParseIPPrefix("::/0")
+)
+
+// ApplyTo sets the fields of p that c specifies. Applying the same
+// config more than once has no further effect.
+func (c *ConfigFile) ApplyTo(p *Prefs) {
+	if c.Hostname != "" {
+		p.Hostname = c.Hostname
+	}
+	if c.AdvertiseRoutes != nil || c.AdvertiseExitNode != nil {
+		wasExitNode := false
+		var routes []netaddr.IPPrefix
+		for _, r := range p.AdvertiseRoutes {
+			if r == exitRoute4 || r == exitRoute6 {
+				wasExitNode = true
+			} else if c.AdvertiseRoutes == nil {
+				routes = append(routes, r)
+			}
+		}
+		if c.AdvertiseRoutes != nil {
+			routes = append(routes, c.AdvertiseRoutes...)
+		}
+		if c.AdvertiseExitNode != nil {
+			wasExitNode = *c.AdvertiseExitNode
+		}
+		if wasExitNode {
+			routes = append(routes, exitRoute4, exitRoute6)
+		}
+		p.AdvertiseRoutes = routes
+	}
+	if c.ExitNode != nil {
+		p.ExitNodeIP = *c.ExitNode
+	}
+	if c.AdvertiseTags != nil {
+		p.AdvertiseTags = append([]string(nil), c.AdvertiseTags...)
+	}
+	if c.AcceptRoutes != nil {
+		p.RouteAll = *c.AcceptRoutes
+	}
+	if c.AcceptDNS != nil {
+		p.CorpDNS = *c.AcceptDNS
+	}
+	if c.Ephemeral != nil {
+		p.Ephemeral = *c.Ephemeral
+	}
+}
+
+// standardizeHuJSON returns b, a JSON document that may also have
+// comments and trailing commas, as standard JSON.
+func standardizeHuJSON(b []byte) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	var inString bool
+	for i := 0; i < len(b); i++ {
+		ch := b[i]
+		switch {
+		case inString:
+			out = append(out, ch)
+			if ch == '\\' && i+1 < len(b) {
+				i++
+				out = append(out, b[i])
+			} else if ch == '"' {
+				inString = false
+			}
+		case ch == '"':
+			inString = true
+			out = append(out, ch)
+		case ch == '/' && i+1 < len(b) && b[i+1] == '/':
+			for i < len(b) && b[i] != '\n' {
+				i++
+			}
+			out = append(out, '\n')
+		case ch == '/' && i+1 < len(b) && b[i+1] == '*':
+			end := bytes.Index(b[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("unterminated /* comment")
+			}
+			i += 2 + end + 1
+			out = append(out, ' ')
+		case ch == ']' || ch == '}':
+			// Drop a trailing comma before the closing bracket.
+			j := len(out) - 1
+			for j >= 0 && isJSONSpace(out[j]) {
+				j--
+			}
+			if j >= 0 && out[j] == ',' {
+				out = append(out[:j], out[j+1:]...)
+			}
+			out = append(out, ch)
+		default:
+			out = append(out, ch)
+		}
+	}
+	return out, nil
+}
+
+func isJSONSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	c, err := ParseConfigFile([]byte(`
+// Managed by config management.
+{
+	"AuthKey": "tskey-123", /* not a real one */
+	"Hostname": "web-1",
+	"AdvertiseRoutes": ["10.0.0.0/8", "192.168.0.0/24",],
+	"AdvertiseExitNode": true,
+	"AdvertiseTags": ["tag:web"],
+	"AcceptDNS": false,
+	"Alerts": [
+		{"Name": "relayed", "Condition": "derp-only", "Threshold": "10m", "Exec": "/usr/local/bin/page"},
+	],
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthKey != "tskey-123" || c.Hostname != "web-1" || len(c.AdvertiseRoutes) != 2 ||
+		c.AdvertiseExitNode == nil || !*c.AdvertiseExitNode || c.AcceptDNS == nil || *c.AcceptDNS ||
+		len(c.Alerts) != 1 || c.Alerts[0].ThresholdDuration() != 10*time.Minute {
+		t.Errorf("got %+v", c)
+	}
+
+	for _, bad := range []string{
+		`{"Hostnmae": "typo"}`,
+		`{"AdvertiseRoutes": ["10.0.0.1/8"]}`,
+		`{"AdvertiseTags": ["web"]}`,
+		`{"Hostname": "x" /* unterminated}`,
+		`{"Alerts": [{"Name": "a", "Condition": "derp-only", "Threshold": "10m"}]}`,
+		`{"Alerts": [{"Name": "a", "Condition": "slow", "Threshold": "10m", "EventLog": true}]}`,
+		`{"Alerts": [{"Name": "a", "Condition": "key-expiry", "Threshold": "-1h", "EventLog": true}]}`,
+		`{"Alerts": [{"Name": "a", "Condition": "key-expiry", "Threshold": "72h", "Peer": "b", "EventLog": true}]}`,
+		`{"Alerts": [{"Name": "a", "Condition": "key-expiry", "Threshold": "72h", "Webhook": "ftp://x/"}]}`,
+		`{"Alerts": [
+			{"Name": "a", "Condition": "key-expiry", "Threshold": "72h", "EventLog": true},
+			{"Name": "a", "Condition": "derp-only", "Threshold": "10m", "EventLog": true},
+		]}`,
+	} {
+		if _, err := ParseConfigFile([]byte(bad)); err == nil {
+			t.Errorf("ParseConfigFile(%s) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestConfigFileApplyTo(t *testing.T) {
+	yes, no := true, false
+	exitIP := netaddr.MustParseIP("100.64.0.1")
+	subnet := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	tests := []struct {
+		name string
+		c    ConfigFile
+		p    Prefs
+		want Prefs
+	}{
+		{
+			name: "empty",
+			p:    Prefs{Hostname: "h", RouteAll: true},
+			want: Prefs{Hostname: "h", RouteAll: true},
+		},
+		{
+			name: "fields",
+			c:    ConfigFile{Hostname: "web-1", ExitNode: &exitIP, AdvertiseTags: []string{"tag:web"}, AcceptRoutes: &no, Ephemeral: &yes},
+			p:    Prefs{Hostname: "h", RouteAll: true, CorpDNS: true},
+			want: Prefs{Hostname: "web-1", ExitNodeIP: exitIP, AdvertiseTags: []string{"tag:web"}, CorpDNS: true, Ephemeral: true},
+		},
+		{
+			name: "routes",
+			c:    ConfigFile{AdvertiseRoutes: []netaddr.IPPrefix{subnet}, AdvertiseExitNode: &yes},
+			p:    Prefs{AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.0.0/24")}},
+			want: Prefs{AdvertiseRoutes: []netaddr.IPPrefix{subnet, exitRoute4, exitRoute6}},
+		},
+		{
+			name: "stop-exit-node-keep-subnets",
+			c:    ConfigFile{AdvertiseExitNode: &no},
+			p:    Prefs{AdvertiseRoutes: []netaddr.IPPrefix{exitRoute4, subnet, exitRoute6}},
+			want: Prefs{AdvertiseRoutes: []netaddr.IPPrefix{subnet}},
+		},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		tt.c.ApplyTo(&p)
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: got %+v; want %+v", tt.name, p, tt.want)
+		}
+		tt.c.ApplyTo(&p)
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: applying twice got %+v; want %+v", tt.name, p, tt.want)
+		}
+	}
+}
+
+func TestResolveAuthKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte("tskey-123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "tskey-abc", want: "tskey-abc"},
+		{in: "file:" + path, want: "tskey-123"},
+		{in: "file:" + empty, wantErr: true},
+		{in: "file:" + filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveAuthKey(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ResolveAuthKey(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ResolveAuthKey(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
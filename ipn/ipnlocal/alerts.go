@@ -0,0 +1,265 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/sched"
+)
+
+const (
+	// alertCheckInterval is how often alert rules are checked.
+	alertCheckInterval = 30 * time.Second
+
+	// alertActionTimeout is how long a webhook or Exec action may
+	// take.
+	alertActionTimeout = 30 * time.Second
+)
+
+// alertSelf is the subject of alerts about the node itself rather
+// than a peer.
+const alertSelf = "self"
+
+// An alertEvent is an alert rule starting or stopping firing for a
+// subject (a peer, or alertSelf).
+type alertEvent struct {
+	Rule    string    `json:"rule"`
+	Subject string    `json:"subject"`
+	Firing  bool      `json:"firing"`
+	Detail  string    `json:"detail"`
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+}
+
+func (ev alertEvent) String() string {
+	state := "resolved"
+	if ev.Firing {
+		state = "FIRING"
+	}
+	return fmt.Sprintf("alert %q %s for %s: %s", ev.Rule, state, ev.Subject, ev.Detail)
+}
+
+type alertKey struct {
+	rule, subject string
+}
+
+// alerter tracks which alert rules are firing, for alertTask.
+type alerter struct {
+	since  map[alertKey]time.Time // when the condition started holding
+	firing map[alertKey]string    // detail of each firing alert
+}
+
+func newAlerter() *alerter {
+	return &alerter{
+		since:  map[alertKey]time.Time{},
+		firing: map[alertKey]string{},
+	}
+}
+
+// update checks rules against st and keyExpiry at time now and
+// returns the alerts that started or stopped firing.
+func (a *alerter) update(rules []ipn.AlertRule, st *ipnstate.Status, keyExpiry time.Time, now time.Time) []alertEvent {
+	var events []alertEvent
+	seen := map[alertKey]bool{}
+	for _, r := range rules {
+		for subject, detail := range alertConditions(r, st, keyExpiry, now) {
+			k := alertKey{r.Name, subject}
+			seen[k] = true
+			since, ok := a.since[k]
+			if !ok {
+				since = now
+				a.since[k] = now
+			}
+			if r.Condition == ipn.AlertDERPOnly {
+				// The other conditions have their duration
+				// built in; this one has to hold for it.
+				if now.Sub(since) < r.ThresholdDuration() {
+					continue
+				}
+				detail = fmt.Sprintf("%s for %v", detail, now.Sub(since).Round(time.Second))
+			}
+			if _, ok := a.firing[k]; !ok {
+				a.firing[k] = detail
+				events = append(events, alertEvent{Rule: r.Name, Subject: subject, Firing: true, Detail: detail, Time: now})
+			}
+		}
+	}
+	for k := range a.since {
+		if !seen[k] {
+			delete(a.since, k)
+		}
+	}
+	for k, detail := range a.firing {
+		if !seen[k] {
+			delete(a.firing, k)
+			events = append(events, alertEvent{Rule: k.rule, Subject: k.subject, Firing: false, Detail: detail, Time: now})
+		}
+	}
+	return events
+}
+
+// alertConditions returns the subjects for which r's condition holds
+// at now, with a description of each.
+func alertConditions(r ipn.AlertRule, st *ipnstate.Status, keyExpiry time.Time, now time.Time) map[string]string {
+	threshold := r.ThresholdDuration()
+	ret := map[string]string{}
+	if r.Condition == ipn.AlertKeyExpiry {
+		if !keyExpiry.IsZero() && keyExpiry.Sub(now) < threshold {
+			ret[alertSelf] = fmt.Sprintf("node key expires %s", keyExpiry.UTC().Format(time.RFC3339))
+		}
+		return ret
+	}
+	if st == nil {
+		return ret
+	}
+	for _, ps := range st.Peer {
+		if r.Peer != "" && !peerStatusMatches(ps, st.MagicDNSSuffix, r.Peer) {
+			continue
+		}
+		name := ps.DNSName
+		if name == "" {
+			name = ps.TailAddr
+		}
+		switch r.Condition {
+		case ipn.AlertDERPOnly:
+			if ps.PathType == "derp" {
+				ret[name] = fmt.Sprintf("relayed via DERP %s", ps.Relay)
+			}
+		case ipn.AlertHandshakeAge:
+			if ps.LastWrite.IsZero() || now.Sub(ps.LastWrite) > threshold {
+				// Idle peers are expected to have old
+				// handshakes.
+				continue
+			}
+			if ps.LastHandshake.IsZero() {
+				ret[name] = "no WireGuard handshake"
+			} else if age := now.Sub(ps.LastHandshake); age > threshold {
+				ret[name] = fmt.Sprintf("last WireGuard handshake %v ago", age.Round(time.Second))
+			}
+		}
+	}
+	return ret
+}
+
+// peerStatusMatches reports whether ps has the name or Tailscale IP
+// target.
+func peerStatusMatches(ps *ipnstate.PeerStatus, magicDNSSuffix, target string) bool {
+	target = strings.TrimSuffix(target, ".")
+	name := strings.TrimSuffix(ps.DNSName, ".")
+	return target == ps.TailAddr ||
+		strings.EqualFold(target, name) ||
+		strings.EqualFold(target, strings.TrimSuffix(name, "."+strings.TrimSuffix(magicDNSSuffix, "."))) ||
+		strings.EqualFold(target, ps.HostName)
+}
+
+// SetAlertRules sets the alert rules for tailscaled to check, replacing
+// any previous ones. The rules must have passed AlertRule.Check.
+func (b *LocalBackend) SetAlertRules(rules []ipn.AlertRule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.alertRules = append([]ipn.AlertRule(nil), rules...)
+	if len(rules) > 0 && !b.alertTaskAdded {
+		b.alertTaskAdded = true
+		b.sched.Add("alerts", b.alertTask())
+	}
+}
+
+// alertTask is the scheduled task that checks the alert rules.
+func (b *LocalBackend) alertTask() sched.Task {
+	a := newAlerter()
+	return sched.Task{
+		Interval: alertCheckInterval,
+		Func: func(context.Context) error {
+			b.checkAlerts(a)
+			return nil
+		},
+	}
+}
+
+// checkAlerts checks the alert rules, using a to track which are
+// firing, and takes the actions of those that started or stopped.
+func (b *LocalBackend) checkAlerts(a *alerter) {
+	b.mu.Lock()
+	rules := b.alertRules
+	var keyExpiry time.Time
+	var node string
+	if b.netMap != nil {
+		keyExpiry = b.netMap.Expiry
+		node = b.netMap.Name
+	}
+	b.mu.Unlock()
+
+	events := a.update(rules, b.Status(), keyExpiry, time.Now())
+	for _, ev := range events {
+		ev.Node = node
+		b.logf("%v", ev)
+		for _, r := range rules {
+			if r.Name == ev.Rule {
+				go b.runAlertActions(r, ev)
+			}
+		}
+	}
+}
+
+// runAlertActions takes r's actions for ev.
+func (b *LocalBackend) runAlertActions(r ipn.AlertRule, ev alertEvent) {
+	ctx, cancel := context.WithTimeout(b.ctx, alertActionTimeout)
+	defer cancel()
+	if r.Webhook != "" {
+		if err := postAlertWebhook(ctx, r.Webhook, ev); err != nil {
+			b.logf("alert %q: webhook: %v", r.Name, err)
+		}
+	}
+	if r.Exec != "" {
+		cmd := exec.CommandContext(ctx, r.Exec)
+		cmd.Env = append(os.Environ(),
+			"TS_ALERT_RULE="+ev.Rule,
+			"TS_ALERT_SUBJECT="+ev.Subject,
+			fmt.Sprintf("TS_ALERT_FIRING=%v", ev.Firing),
+			"TS_ALERT_DETAIL="+ev.Detail,
+			"TS_ALERT_NODE="+ev.Node,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			b.logf("alert %q: %s: %v: %s", r.Name, r.Exec, err, bytes.TrimSpace(out))
+		}
+	}
+	if r.EventLog {
+		if err := writeAlertEventLog(ev); err != nil {
+			b.logf("alert %q: event log: %v", r.Name, err)
+		}
+	}
+}
+
+func postAlertWebhook(ctx context.Context, url string, ev alertEvent) error {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package ipnlocal
+
+func writeAlertEventLog(ev alertEvent) error { return nil }
@@ -0,0 +1,22 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import "golang.org/x/sys/windows/svc/eventlog"
+
+// alertEventID is the event ID of alerts in the Windows event log.
+const alertEventID = 100
+
+func writeAlertEventLog(ev alertEvent) error {
+	l, err := eventlog.Open("Tailscale")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if ev.Firing {
+		return l.Warning(alertEventID, ev.String())
+	}
+	return l.Info(alertEventID, ev.String())
+}
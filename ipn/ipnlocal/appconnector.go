@@ -0,0 +1,379 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// appConnectorResolveInterval is how often an app connector
+	// resolves its domains again, to pick up addresses that have
+	// changed, and stops advertising routes that have expired.
+	appConnectorResolveInterval = 30 * time.Minute
+
+	// appRouteMinLifetime is the least time an app connector keeps
+	// advertising a route after last seeing its address in an
+	// answer, however short the answer's TTL, so that peers'
+	// connections to addresses they looked up a while ago keep
+	// working.
+	appRouteMinLifetime = time.Hour
+
+	// maxAppRoutes caps the routes an app connector advertises.
+	// Once it's reached, the routes closest to expiring make way
+	// for new ones.
+	maxAppRoutes = 1000
+)
+
+// appRoute is a route that an app connector learned.
+type appRoute struct {
+	domain  string    // the AppConnectorDomains entry it was learned for
+	expires time.Time // when to stop advertising it, unless seen again
+}
+
+// updateAppConnector starts or stops resolving the AppConnectorDomains
+// prefs to match the current prefs and netmap, and stops advertising
+// routes learned for domains that were removed.
+func (b *LocalBackend) updateAppConnector() {
+	b.mu.Lock()
+	var domains []string
+	if b.prefs != nil && b.prefs.WantRunning && b.netMap != nil {
+		domains = b.prefs.AppConnectorDomains
+	}
+	if strings.Join(domains, ",") == strings.Join(b.appDomains, ",") {
+		b.mu.Unlock()
+		return
+	}
+	b.appDomains = append([]string(nil), domains...)
+	if b.appResolveCancel != nil {
+		b.appResolveCancel()
+		b.appResolveCancel = nil
+	}
+	removed := 0
+	for ip, r := range b.appRoutes {
+		if !containsString(domains, r.domain) {
+			delete(b.appRoutes, ip)
+			removed++
+		}
+	}
+	if len(domains) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.appResolveCancel = cancel
+		go b.appConnectorResolveLoop(ctx, b.appDomains)
+	}
+	// Tell peers which domains to send this node queries for.
+	hi := b.hostinfo
+	if hi != nil {
+		hi.AppConnectorDomains = b.appDomains
+		hi.RoutableIPs = b.routableIPsLocked()
+	}
+	nm, prefs, routes := b.netMap, b.prefs, b.appRoutesLocked()
+	b.mu.Unlock()
+
+	b.logf("app connector: domains %q", domains)
+	if hi != nil {
+		b.doSetHostinfoFilterServices(hi)
+	}
+	if removed > 0 {
+		b.logf("app connector: no longer advertising %d routes", removed)
+		b.updateFilter(nm, prefs, routes)
+		b.authReconfig()
+	}
+}
+
+// appConnectorResolveLoop resolves domains, other than wildcards,
+// every appConnectorResolveInterval until ctx is done, and advertises
+// routes to their addresses. Addresses under wildcards are learned
+// only from the DNS answers that the node serves peers.
+func (b *LocalBackend) appConnectorResolveLoop(ctx context.Context, domains []string) {
+	for {
+		b.expireAppRoutes(time.Now())
+		for _, d := range domains {
+			if strings.HasPrefix(d, "*.") {
+				continue
+			}
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, d)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				b.logf("app connector: resolving %s: %v", d, err)
+				continue
+			}
+			var ips []netaddr.IP
+			for _, a := range addrs {
+				if ip, ok := netaddr.FromStdIP(a.IP); ok {
+					ips = append(ips, ip)
+				}
+			}
+			b.advertiseAppRoutes(d, ips, 0)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(appConnectorResolveInterval):
+		}
+	}
+}
+
+// observeAppConnectorDNS advertises routes to the addresses in resp,
+// a DNS response served to a peer, if they answer a query for one of
+// the AppConnectorDomains.
+func (b *LocalBackend) observeAppConnectorDNS(resp []byte) {
+	b.mu.Lock()
+	domains := b.appDomains
+	b.mu.Unlock()
+	if len(domains) == 0 {
+		return
+	}
+	if domain, ips, ttl := appConnectorAnswer(domains, resp); domain != "" {
+		b.advertiseAppRoutes(domain, ips, ttl)
+	}
+}
+
+// isAppConnector reports whether the node is an app connector for
+// any domains.
+func (b *LocalBackend) isAppConnector() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.appDomains) > 0
+}
+
+// advertiseAppRoutes adds single-IP routes to ips, learned for the
+// AppConnectorDomains entry domain from an answer with the given TTL,
+// to the advertised routes, or extends their lifetime if they're
+// already advertised.
+func (b *LocalBackend) advertiseAppRoutes(domain string, ips []netaddr.IP, ttl time.Duration) {
+	if ttl < appRouteMinLifetime {
+		ttl = appRouteMinLifetime
+	}
+	expires := time.Now().Add(ttl)
+
+	b.mu.Lock()
+	if !containsString(b.appDomains, domain) {
+		// Removed while resolving.
+		b.mu.Unlock()
+		return
+	}
+	added := 0
+	for _, ip := range ips {
+		if !isAppRouteIP(ip) {
+			continue
+		}
+		if r, ok := b.appRoutes[ip]; ok {
+			if expires.After(r.expires) {
+				b.appRoutes[ip] = appRoute{domain: domain, expires: expires}
+			}
+			continue
+		}
+		if b.appRoutes == nil {
+			b.appRoutes = map[netaddr.IP]appRoute{}
+		}
+		if len(b.appRoutes) >= maxAppRoutes {
+			b.evictAppRouteLocked()
+		}
+		b.appRoutes[ip] = appRoute{domain: domain, expires: expires}
+		added++
+	}
+	if added == 0 || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.hostinfo.RoutableIPs = b.routableIPsLocked()
+	hi := b.hostinfo
+	nm, prefs, routes := b.netMap, b.prefs, b.appRoutesLocked()
+	b.mu.Unlock()
+
+	b.logf("app connector: advertising %d new routes for %s", added, domain)
+	b.doSetHostinfoFilterServices(hi)
+	b.updateFilter(nm, prefs, routes)
+	b.authReconfig()
+}
+
+// evictAppRouteLocked stops advertising the app connector route that
+// expires soonest, to make room for another. b.mu must be held.
+func (b *LocalBackend) evictAppRouteLocked() {
+	var oldest netaddr.IP
+	var oldestExpires time.Time
+	for ip, r := range b.appRoutes {
+		if oldest.IsZero() || r.expires.Before(oldestExpires) {
+			oldest, oldestExpires = ip, r.expires
+		}
+	}
+	delete(b.appRoutes, oldest)
+}
+
+// expireAppRoutes stops advertising the app connector routes that
+// have expired by now.
+func (b *LocalBackend) expireAppRoutes(now time.Time) {
+	b.mu.Lock()
+	removed := 0
+	for ip, r := range b.appRoutes {
+		if now.After(r.expires) {
+			delete(b.appRoutes, ip)
+			removed++
+		}
+	}
+	if removed == 0 || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.hostinfo.RoutableIPs = b.routableIPsLocked()
+	hi := b.hostinfo
+	nm, prefs, routes := b.netMap, b.prefs, b.appRoutesLocked()
+	b.mu.Unlock()
+
+	b.logf("app connector: %d routes expired", removed)
+	b.doSetHostinfoFilterServices(hi)
+	b.updateFilter(nm, prefs, routes)
+	b.authReconfig()
+}
+
+// isAppRouteIP reports whether ip may be advertised as a route for an
+// app connector domain. Addresses that only make sense on this node
+// or its local network, and Tailscale's own, are not.
+func isAppRouteIP(ip netaddr.IP) bool {
+	return !ip.IsZero() && !ip.IsUnspecified() && !ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !tsaddr.IsTailscaleIP(ip)
+}
+
+// appRoutesLocked returns the routes learned for the
+// AppConnectorDomains prefs, sorted.
+func (b *LocalBackend) appRoutesLocked() []netaddr.IPPrefix {
+	routes := make([]netaddr.IPPrefix, 0, len(b.appRoutes))
+	for ip := range b.appRoutes {
+		routes = append(routes, netaddr.IPPrefix{IP: ip, Bits: ip.BitLen()})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].IP.Less(routes[j].IP) })
+	return routes
+}
+
+// routableIPsLocked returns the routes to advertise in Hostinfo: the
+// AdvertiseRoutes prefs and the routes learned by the app connector.
+func (b *LocalBackend) routableIPsLocked() []netaddr.IPPrefix {
+	var routes []netaddr.IPPrefix
+	if b.prefs != nil {
+		routes = append(routes, b.prefs.AdvertiseRoutes...)
+	}
+	return append(routes, b.appRoutesLocked()...)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appConnectorMatch returns the entry of domains that name falls
+// under, or the empty string if none. An entry "*.example.com"
+// matches the subdomains of example.com, but not example.com itself.
+func appConnectorMatch(domains []string, name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, d := range domains {
+		if sub := strings.TrimPrefix(d, "*."); sub != d {
+			if strings.HasSuffix(name, "."+sub) {
+				return d
+			}
+		} else if name == d {
+			return d
+		}
+	}
+	return ""
+}
+
+// appConnectorAnswer returns the entry of domains that the question
+// of the DNS response resp falls under, the addresses it was answered
+// with, following any CNAMEs, and the longest TTL among them. It
+// returns the empty string if resp isn't a successful response for
+// one of domains.
+func appConnectorAnswer(domains []string, resp []byte) (domain string, ips []netaddr.IP, ttl time.Duration) {
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil || !h.Response || h.RCode != dns.RCodeSuccess {
+		return "", nil, 0
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", nil, 0
+	}
+	domain = appConnectorMatch(domains, q.Name.String())
+	if domain == "" {
+		return "", nil, 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", nil, 0
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return "", nil, 0
+		}
+		switch ah.Type {
+		case dns.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return "", nil, 0
+			}
+			ips = append(ips, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case dns.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return "", nil, 0
+			}
+			ips = append(ips, netaddr.IPFrom16(r.AAAA).Unmap())
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return "", nil, 0
+			}
+			continue
+		}
+		if d := time.Duration(ah.TTL) * time.Second; d > ttl {
+			ttl = d
+		}
+	}
+	return domain, ips, ttl
+}
+
+// appConnectorDNSRoutes returns the peer API DNS-over-HTTP endpoints
+// of the app connectors among nm's peers, by the AppConnectorDomains
+// entries they route. If more than one peer routes an entry, the
+// first in nm.Peers wins.
+func appConnectorDNSRoutes(nm *netmap.NetworkMap) map[string]string {
+	var routes map[string]string
+	for _, peer := range nm.Peers {
+		if len(peer.Hostinfo.AppConnectorDomains) == 0 {
+			continue
+		}
+		base := peerAPIBase(nm, peer)
+		if base == "" {
+			continue
+		}
+		for _, d := range peer.Hostinfo.AppConnectorDomains {
+			if _, ok := routes[d]; ok {
+				continue
+			}
+			if routes == nil {
+				routes = map[string]string{}
+			}
+			routes[d] = base + "/v0/dns-query"
+		}
+	}
+	return routes
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"io"
+
+	"tailscale.com/wgengine/capture"
+)
+
+// StreamDebugCapture writes the packets going through the TUN device
+// that match f (nil for all) to w as a pcap stream, until ctx is done
+// or writing to w fails.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer, f *capture.Filter) error {
+	s := capture.NewSink(w, f)
+	defer s.Close()
+
+	b.captureMu.Lock()
+	if b.captureSinks == nil {
+		b.captureSinks = map[*capture.Sink]bool{}
+	}
+	b.captureSinks[s] = true
+	if len(b.captureSinks) == 1 {
+		b.e.InstallCaptureHook(b.capturePacket)
+	}
+	b.captureMu.Unlock()
+	b.logf("capture: started (filter %q)", f)
+
+	defer func() {
+		b.captureMu.Lock()
+		delete(b.captureSinks, s)
+		if len(b.captureSinks) == 0 {
+			b.e.InstallCaptureHook(nil)
+		}
+		b.captureMu.Unlock()
+		b.logf("capture: stopped; %d packets dropped", s.Dropped())
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.Done():
+		return s.Err()
+	}
+}
+
+// capturePacket is the engine's capture hook while any
+// StreamDebugCapture calls are running.
+func (b *LocalBackend) capturePacket(dir capture.Direction, pkt []byte) {
+	b.captureMu.Lock()
+	defer b.captureMu.Unlock()
+	for s := range b.captureSinks {
+		s.LogPacket(dir, pkt)
+	}
+}
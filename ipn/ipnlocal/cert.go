@@ -0,0 +1,387 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"tailscale.com/ipn"
+	"tailscale.com/util/sched"
+	"tailscale.com/version"
+)
+
+// certRenewBefore is how long before expiry a cached certificate is
+// replaced.
+const certRenewBefore = 30 * 24 * time.Hour
+
+const (
+	// certRenewalInterval is how often the certificates GetCertPEM
+	// has returned are checked for renewal, so that they're renewed
+	// even if nothing asks for them again before they expire.
+	certRenewalInterval = 24 * time.Hour
+
+	// certRenewalRetry is how soon a failed renewal is retried, at
+	// first.
+	certRenewalRetry = time.Hour
+)
+
+// domainCert is the state of the certificate for one domain.
+type domainCert struct {
+	// mu serializes reading the certificate from the state store and
+	// getting it from ACME, so concurrent callers share one ACME
+	// order. It's held for as long as an order takes.
+	mu sync.Mutex
+
+	pair *certPair // or nil if not loaded yet; guarded by LocalBackend.mu
+}
+
+// certPair is a parsed certificate chain and its private key.
+type certPair struct {
+	certPEM, keyPEM []byte
+	leaf            *x509.Certificate
+	tls             *tls.Certificate
+}
+
+func newCertPair(certPEM, keyPEM []byte) (*certPair, error) {
+	tc, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	tc.Leaf = leaf
+	return &certPair{certPEM: certPEM, keyPEM: keyPEM, leaf: leaf, tls: &tc}, nil
+}
+
+// acmeDirectoryURL returns the ACME server to get certificates from:
+// Let's Encrypt, unless overridden for testing against its staging
+// environment or another server.
+func acmeDirectoryURL() string {
+	if v := os.Getenv("TS_DEBUG_ACME_DIRECTORY_URL"); v != "" {
+		return v
+	}
+	return acme.LetsEncryptURL
+}
+
+// GetCertPEM returns a publicly trusted certificate chain and private
+// key, in PEM form, for domain, which must be the node's MagicDNS
+// name or one of the custom domains in its CertDomains prefs.
+// Certificates are cached in memory and in the state store, and
+// renewed in the background when they're within certRenewBefore of
+// expiring.
+func (b *LocalBackend) GetCertPEM(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	p, err := b.getCert(ctx, domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.certPEM, p.keyPEM, nil
+}
+
+// getCert returns the certificate for domain, from memory if it's
+// there and unexpired, without blocking on any renewal under way.
+func (b *LocalBackend) getCert(ctx context.Context, domain string) (*certPair, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if err := b.checkCertDomain(domain); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	if b.certs == nil {
+		b.certs = map[string]*domainCert{}
+	}
+	dc := b.certs[domain]
+	if dc == nil {
+		dc = new(domainCert)
+		b.certs[domain] = dc
+	}
+	p := dc.pair
+	b.mu.Unlock()
+
+	if p != nil && time.Now().Before(p.leaf.NotAfter) {
+		return p, nil
+	}
+	return b.loadCert(ctx, domain, dc, false)
+}
+
+// loadCert returns the certificate for domain, whose state is dc: the
+// one in memory or else the state store, if it hasn't expired, or
+// else a new one from ACME. If renew is set, a certificate that's due
+// for renewal is replaced too.
+func (b *LocalBackend) loadCert(ctx context.Context, domain string, dc *domainCert, renew bool) (*certPair, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	b.mu.Lock()
+	p := dc.pair
+	b.mu.Unlock()
+	fromStore := p == nil
+	if fromStore {
+		certPEM, keyPEM, err := b.readCert(domain)
+		switch {
+		case err == nil:
+			if p, err = newCertPair(certPEM, keyPEM); err != nil {
+				b.logf("cert: ignoring invalid cached certificate for %s: %v", domain, err)
+			}
+		case !errors.Is(err, ipn.ErrStateNotExist):
+			return nil, err
+		}
+	}
+	now := time.Now()
+	if p != nil && now.Before(p.leaf.NotAfter) && (!renew || certFresh(p.leaf, now)) {
+		if fromStore && !certFresh(p.leaf, now) {
+			// Loaded from the store already due for renewal, as
+			// after a restart: renew it soon, not at the task's
+			// next run, but in the background.
+			b.sched.RunNow("cert-renewal")
+		}
+		b.setCert(dc, p)
+		return p, nil
+	}
+
+	dp, err := b.dnsChallengeProvider(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	b.logf("cert: getting certificate for %s", domain)
+	certPEM, keyPEM, err := b.getCertFromACME(ctx, domain, dp)
+	if err != nil {
+		return nil, fmt.Errorf("getting certificate for %s: %w", domain, err)
+	}
+	if p, err = newCertPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("getting certificate for %s: %w", domain, err)
+	}
+	if err := b.store.WriteState(certStateKey(domain), append(certPEM, keyPEM...)); err != nil {
+		return nil, err
+	}
+	b.setCert(dc, p)
+	return p, nil
+}
+
+func (b *LocalBackend) setCert(dc *domainCert, p *certPair) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dc.pair = p
+}
+
+// certRenewalTask is the scheduled task that renews the certificates
+// GetCertPEM has returned, when they're near expiry.
+func (b *LocalBackend) certRenewalTask() sched.Task {
+	return sched.Task{
+		Interval: certRenewalInterval,
+		Jitter:   0.1,
+		Retry:    certRenewalRetry,
+		Func:     b.renewCerts,
+	}
+}
+
+// renewCerts renews the certificates in memory that are near expiry.
+func (b *LocalBackend) renewCerts(ctx context.Context) error {
+	b.mu.Lock()
+	certs := make(map[string]*domainCert, len(b.certs))
+	for d, dc := range b.certs {
+		if dc.pair != nil {
+			certs[d] = dc
+		}
+	}
+	b.mu.Unlock()
+
+	var firstErr error
+	for d, dc := range certs {
+		if _, err := b.loadCert(ctx, d, dc, true); err != nil {
+			b.logf("cert: renewing %s: %v", d, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func certStateKey(domain string) ipn.StateKey {
+	return ipn.StateKey("_cert-" + domain)
+}
+
+// readCert returns the cached certificate chain and private key for
+// domain.
+func (b *LocalBackend) readCert(domain string) (certPEM, keyPEM []byte, err error) {
+	pair, err := b.store.ReadState(certStateKey(domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	for rest := pair; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, nil, fmt.Errorf("invalid cached certificate for %s", domain)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// certFresh reports whether leaf is valid for at least
+// certRenewBefore after now.
+func certFresh(leaf *x509.Certificate, now time.Time) bool {
+	return now.Add(certRenewBefore).Before(leaf.NotAfter)
+}
+
+// getCertFromACME gets a new certificate for domain, proving control
+// of it with a DNS-01 challenge whose TXT record is set via dp.
+func (b *LocalBackend) getCertFromACME(ctx context.Context, domain string, dp DNSChallengeProvider) (certPEM, keyPEM []byte, err error) {
+	accountKey, err := b.acmeAccountKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	ac := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: acmeDirectoryURL(),
+		UserAgent:    "tailscaled/" + version.Long,
+	}
+	if _, err := ac.GetReg(ctx, ""); errors.Is(err, acme.ErrNoAccount) {
+		if _, err := ac.Register(ctx, new(acme.Account), acme.AcceptTOS); err != nil {
+			return nil, nil, fmt.Errorf("ACME register: %w", err)
+		}
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("ACME account: %w", err)
+	}
+
+	order, err := ac.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: domain}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("ACME order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		az, err := ac.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		}
+		if az.Status == acme.StatusValid {
+			continue
+		}
+		var ch *acme.Challenge
+		for _, c := range az.Challenges {
+			if c.Type == "dns-01" {
+				ch = c
+				break
+			}
+		}
+		if ch == nil {
+			return nil, nil, errors.New("ACME server offered no dns-01 challenge")
+		}
+		rec, err := ac.DNS01ChallengeRecord(ch.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		recName := "_acme-challenge." + domain
+		if err := dp.SetTXT(ctx, recName, rec); err != nil {
+			return nil, nil, fmt.Errorf("setting DNS-01 challenge record: %w", err)
+		}
+		defer func() {
+			if err := dp.RemoveTXT(context.Background(), recName, rec); err != nil {
+				b.logf("cert: removing DNS-01 challenge record: %v", err)
+			}
+		}()
+		if _, err := ac.Accept(ctx, ch); err != nil {
+			return nil, nil, fmt.Errorf("ACME accept: %w", err)
+		}
+		if _, err := ac.WaitAuthorization(ctx, az.URI); err != nil {
+			return nil, nil, fmt.Errorf("ACME authorization: %w", err)
+		}
+	}
+	order, err = ac.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ACME order: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ders, _, err := ac.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ACME finalize: %w", err)
+	}
+	var buf bytes.Buffer
+	for _, der := range ders {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// acmeAccountKey returns the node's ACME account key, generating and
+// storing it on first use.
+func (b *LocalBackend) acmeAccountKey() (crypto.Signer, error) {
+	pemKey, err := b.store.ReadState(ipn.ACMEAccountKeyStateKey)
+	if err == nil {
+		block, _ := pem.Decode(pemKey)
+		if block == nil {
+			return nil, errors.New("invalid ACME account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pemKey = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := b.store.WriteState(ipn.ACMEAccountKeyStateKey, pemKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetCertificate returns the node's certificate for hi.ServerName,
+// for use as a tls.Config.GetCertificate func by servers running in
+// tailscaled.
+func (b *LocalBackend) GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hi == nil || hi.ServerName == "" {
+		return nil, errors.New("missing SNI server name")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	p, err := b.getCert(ctx, hi.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	return p.tls, nil
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/sched"
+)
+
+// testCert returns a self-signed certificate for domain, valid until
+// notAfter, and its private key, in PEM form.
+func testCert(t *testing.T, domain string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestReadCert(t *testing.T) {
+	store := &ipn.MemoryStore{}
+	b := &LocalBackend{logf: t.Logf, store: store}
+
+	if _, _, err := b.readCert("foo.example.com"); err != ipn.ErrStateNotExist {
+		t.Errorf("readCert of missing cert = %v; want ErrStateNotExist", err)
+	}
+
+	certPEM, keyPEM := testCert(t, "foo.example.com", time.Now().Add(60*24*time.Hour))
+	if err := store.WriteState(certStateKey("foo.example.com"), append(certPEM, keyPEM...)); err != nil {
+		t.Fatal(err)
+	}
+	gotCert, gotKey, err := b.readCert("foo.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotCert, certPEM) || !bytes.Equal(gotKey, keyPEM) {
+		t.Error("readCert didn't split the cached pair back into cert and key")
+	}
+
+	if err := store.WriteState(certStateKey("bad.example.com"), certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.readCert("bad.example.com"); err == nil {
+		t.Error("readCert of cert without key succeeded")
+	}
+}
+
+func TestCertFresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		want     bool
+	}{
+		{"new", now.Add(89 * 24 * time.Hour), true},
+		{"due_for_renewal", now.Add(certRenewBefore - time.Hour), false},
+		{"expired", now.Add(-time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newCertPair(testCert(t, "foo.example.com", tt.notAfter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := certFresh(p.leaf, now); got != tt.want {
+				t.Errorf("certFresh = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACMEAccountKey(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf, store: &ipn.MemoryStore{}}
+	k1, err := b.acmeAccountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := b.acmeAccountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := k1.Public().(*ecdsa.PublicKey), k2.Public().(*ecdsa.PublicKey)
+	if !p1.Equal(p2) {
+		t.Error("ACME account key not persisted between calls")
+	}
+}
+
+func TestGetCertPEMCached(t *testing.T) {
+	oldCNAME, oldHost := lookupCNAME, lookupHost
+	defer func() { lookupCNAME, lookupHost = oldCNAME, oldHost }()
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		t.Errorf("unexpected CNAME lookup of %q", host)
+		return "", errors.New("no lookups")
+	}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		t.Errorf("unexpected host lookup of %q", host)
+		return nil, errors.New("no lookups")
+	}
+
+	store := &ipn.MemoryStore{}
+	b := &LocalBackend{
+		logf:   t.Logf,
+		store:  store,
+		netMap: &netmap.NetworkMap{Name: "node.foo.ts.net."},
+		prefs:  &ipn.Prefs{CertDomains: []string{"app.example.com"}},
+	}
+	certPEM, keyPEM := testCert(t, "app.example.com", time.Now().Add(60*24*time.Hour))
+	if err := store.WriteState(certStateKey("app.example.com"), append(certPEM, keyPEM...)); err != nil {
+		t.Fatal(err)
+	}
+
+	gotCert, _, err := b.GetCertPEM(context.Background(), "App.Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotCert, certPEM) {
+		t.Error("GetCertPEM didn't return the cached certificate")
+	}
+	if _, _, err := b.GetCertPEM(context.Background(), "other.example.com"); err == nil {
+		t.Error("GetCertPEM of a domain not in CertDomains succeeded")
+	}
+}
+
+func TestCertRenewal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &ipn.MemoryStore{}
+	b := &LocalBackend{
+		logf:   t.Logf,
+		store:  store,
+		netMap: &netmap.NetworkMap{Name: "node.foo.ts.net."},
+		sched:  sched.New(ctx, t.Logf),
+	}
+	renewalRuns := make(chan bool, 1)
+	b.sched.Add("cert-renewal", sched.Task{
+		Interval: time.Hour,
+		Func: func(context.Context) error {
+			renewalRuns <- true
+			return nil
+		},
+	})
+	// Due for renewal, but still valid.
+	certPEM, keyPEM := testCert(t, "node.foo.ts.net", time.Now().Add(certRenewBefore/2))
+	if err := store.WriteState(certStateKey("node.foo.ts.net"), append(certPEM, keyPEM...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serving it doesn't wait on a renewal, which would fail here
+	// for lack of a control client.
+	gotCert, _, err := b.GetCertPEM(context.Background(), "node.foo.ts.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotCert, certPEM) {
+		t.Error("GetCertPEM didn't return the cached certificate")
+	}
+	// It starts the renewal task early, though.
+	select {
+	case <-renewalRuns:
+	case <-time.After(5 * time.Second):
+		t.Error("cert-renewal task didn't run for a certificate due for renewal")
+	}
+
+	// Later calls are served from memory, including for TLS.
+	if err := store.WriteState(certStateKey("node.foo.ts.net"), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := b.GetCertificate(&tls.ClientHelloInfo{ServerName: "node.foo.ts.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tc.Certificate[0], tc.Leaf.Raw) || tc.Leaf.DNSNames[0] != "node.foo.ts.net" {
+		t.Errorf("GetCertificate returned a certificate for %v", tc.Leaf.DNSNames)
+	}
+
+	// The renewal task does try to renew it, and keeps serving the
+	// old one when that fails.
+	if err := b.renewCerts(context.Background()); err == nil || !strings.Contains(err.Error(), "control server") {
+		t.Errorf("renewCerts = %v; want an error getting a new certificate", err)
+	}
+	if _, _, err := b.GetCertPEM(context.Background(), "node.foo.ts.net"); err != nil {
+		t.Errorf("GetCertPEM after failed renewal: %v", err)
+	}
+}
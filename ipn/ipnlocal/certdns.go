@@ -0,0 +1,232 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// A DNSChallengeProvider publishes the TXT records of ACME DNS-01
+// challenges, proving control of a domain to the certificate
+// authority.
+//
+// The node's MagicDNS name uses the control server as its provider.
+// Custom domains in the CertDomains pref use the provider named by
+// tailscaled's --cert-dns-provider flag (see SetCertDNSProvider),
+// which is either built in ("exec") or registered with
+// RegisterDNSChallengeProvider.
+type DNSChallengeProvider interface {
+	// SetTXT creates the TXT record name with value. It should
+	// return once the record is visible to public resolvers.
+	SetTXT(ctx context.Context, name, value string) error
+
+	// RemoveTXT removes the TXT record created by SetTXT, once the
+	// challenge is done.
+	RemoveTXT(ctx context.Context, name, value string) error
+}
+
+// NewDNSChallengeProviderFunc returns a DNSChallengeProvider. The arg
+// is the part of the provider spec after the provider's name and a
+// colon, if any, such as a path or an account name. Secrets shouldn't
+// be passed in arg, as it's visible in tailscaled's command line.
+type NewDNSChallengeProviderFunc func(logf logger.Logf, arg string) (DNSChallengeProvider, error)
+
+var (
+	dnsProvidersMu sync.Mutex
+	dnsProviders   = map[string]NewDNSChallengeProviderFunc{
+		"exec": newExecDNSProvider,
+	}
+)
+
+// RegisterDNSChallengeProvider registers fn as the constructor of the
+// DNS-01 provider called name. It must be called during init.
+func RegisterDNSChallengeProvider(name string, fn NewDNSChallengeProviderFunc) {
+	dnsProvidersMu.Lock()
+	defer dnsProvidersMu.Unlock()
+	if _, dup := dnsProviders[name]; dup {
+		panic("duplicate DNS challenge provider " + name)
+	}
+	dnsProviders[name] = fn
+}
+
+// newDNSChallengeProvider returns the provider described by spec, of
+// the form "name" or "name:arg".
+func newDNSChallengeProvider(logf logger.Logf, spec string) (DNSChallengeProvider, error) {
+	if spec == "" {
+		return nil, errors.New("no DNS challenge provider for custom certificate domains; start tailscaled with --cert-dns-provider")
+	}
+	name, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i != -1 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	dnsProvidersMu.Lock()
+	fn := dnsProviders[name]
+	dnsProvidersMu.Unlock()
+	if fn == nil {
+		return nil, fmt.Errorf("unknown DNS challenge provider %q", name)
+	}
+	return fn(logger.WithPrefix(logf, "cert-dns-"+name+": "), arg)
+}
+
+// controlDNSProvider is the DNSChallengeProvider for the node's
+// MagicDNS name, whose records are managed by the control server.
+type controlDNSProvider struct {
+	cc *controlclient.Client
+}
+
+func (p controlDNSProvider) SetTXT(ctx context.Context, name, value string) error {
+	return p.cc.SetDNS(ctx, &tailcfg.SetDNSRequest{
+		Name:  name,
+		Type:  "TXT",
+		Value: value,
+	})
+}
+
+func (controlDNSProvider) RemoveTXT(context.Context, string, string) error {
+	// The control server replaces the record on the next SetTXT.
+	return nil
+}
+
+// execDNSProvider is the "exec:/path/to/hook" provider. It runs the
+// hook program as
+//
+//	hook set <name> <value>
+//	hook remove <name> <value>
+//
+// so users can drive any DNS provider's API or CLI from a script.
+type execDNSProvider struct {
+	logf logger.Logf
+	path string
+}
+
+func newExecDNSProvider(logf logger.Logf, path string) (DNSChallengeProvider, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf(`exec DNS provider hook %q must be an absolute path, as in "exec:/path/to/hook"`, path)
+	}
+	return &execDNSProvider{logf: logf, path: path}, nil
+}
+
+func (p *execDNSProvider) SetTXT(ctx context.Context, name, value string) error {
+	return p.run(ctx, "set", name, value)
+}
+
+func (p *execDNSProvider) RemoveTXT(ctx context.Context, name, value string) error {
+	return p.run(ctx, "remove", name, value)
+}
+
+func (p *execDNSProvider) run(ctx context.Context, verb, name, value string) error {
+	out, err := exec.CommandContext(ctx, p.path, verb, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s %s: %v: %s", p.path, verb, name, err, strings.TrimSpace(string(out)))
+	}
+	if len(out) > 0 {
+		p.logf("%s %s: %s", verb, name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkCertDomain reports an error unless domain is the node's
+// MagicDNS name or one of the CertDomains prefs. It's cheap enough to
+// run per TLS handshake; the DNS checks of custom domains are left to
+// dnsChallengeProvider, when a certificate is actually needed.
+func (b *LocalBackend) checkCertDomain(domain string) error {
+	b.mu.Lock()
+	nm := b.netMap
+	var certDomains []string
+	if b.prefs != nil {
+		certDomains = b.prefs.CertDomains
+	}
+	b.mu.Unlock()
+	if nm == nil {
+		return errors.New("no netmap; not connected to a tailnet")
+	}
+	name := strings.TrimSuffix(nm.Name, ".")
+	if name == "" {
+		return errors.New("node has no DNS name")
+	}
+	if domain != name && !isCertDomain(certDomains, domain) {
+		return fmt.Errorf("invalid domain %q; must be this node's name %q or one of its CertDomains", domain, name)
+	}
+	return nil
+}
+
+// dnsChallengeProvider returns the DNSChallengeProvider for domain,
+// which checkCertDomain has accepted. Custom domains must also point
+// at the node.
+func (b *LocalBackend) dnsChallengeProvider(ctx context.Context, domain string) (DNSChallengeProvider, error) {
+	b.mu.Lock()
+	nm := b.netMap
+	cc := b.c
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, errors.New("no netmap; not connected to a tailnet")
+	}
+	if domain == strings.TrimSuffix(nm.Name, ".") {
+		if cc == nil {
+			return nil, errors.New("not connected to control server")
+		}
+		return controlDNSProvider{cc}, nil
+	}
+	if err := checkDomainPointsAtNode(ctx, domain, nm); err != nil {
+		return nil, err
+	}
+	return newDNSChallengeProvider(b.logf, b.certDNSProvider)
+}
+
+// isCertDomain reports whether domain is one of certDomains.
+func isCertDomain(certDomains []string, domain string) bool {
+	for _, d := range certDomains {
+		if strings.TrimSuffix(strings.ToLower(d), ".") == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCNAME and lookupHost are net.DefaultResolver's methods, or
+// fakes in tests.
+var (
+	lookupCNAME = net.DefaultResolver.LookupCNAME
+	lookupHost  = net.DefaultResolver.LookupHost
+)
+
+// checkDomainPointsAtNode reports an error unless domain is a CNAME
+// for the node's MagicDNS name, or resolves to its Tailscale IPs, so
+// that a certificate for domain is useful on this node.
+func checkDomainPointsAtNode(ctx context.Context, domain string, nm *netmap.NetworkMap) error {
+	name := strings.TrimSuffix(nm.Name, ".")
+	if cname, err := lookupCNAME(ctx, domain); err == nil && strings.EqualFold(strings.TrimSuffix(cname, "."), name) {
+		return nil
+	}
+	addrs, err := lookupHost(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("custom certificate domain %q: %w", domain, err)
+	}
+	for _, a := range addrs {
+		ip, err := netaddr.ParseIP(a)
+		if err != nil {
+			continue
+		}
+		for _, pfx := range nm.Addresses {
+			if pfx.IsSingleIP() && pfx.IP == ip {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("custom certificate domain %q is neither a CNAME for %q nor resolves to its Tailscale IPs", domain, name)
+}
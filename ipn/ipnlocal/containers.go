@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nsjoin"
+)
+
+// AttachContainer gives the network namespace target, either a
+// process ID or a named namespace, connectivity to the tailnet
+// through this node. See package nsjoin.
+func (b *LocalBackend) AttachContainer(target string) (nsjoin.Attachment, error) {
+	tunName, err := b.tunInterfaceName()
+	if err != nil {
+		return nsjoin.Attachment{}, err
+	}
+	return b.nsJoinManager().Attach(target, tunName)
+}
+
+// DetachContainer undoes the container attachment with the given ID.
+func (b *LocalBackend) DetachContainer(id string) error {
+	return b.nsJoinManager().Detach(id)
+}
+
+// Containers returns the current container attachments.
+func (b *LocalBackend) Containers() []nsjoin.Attachment {
+	return b.nsJoinManager().List()
+}
+
+func (b *LocalBackend) nsJoinManager() *nsjoin.Manager {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.nsJoin == nil {
+		b.nsJoin = nsjoin.NewManager(b.logf)
+	}
+	return b.nsJoin
+}
+
+func (b *LocalBackend) detachContainers() {
+	b.mu.Lock()
+	m := b.nsJoin
+	b.mu.Unlock()
+	if m == nil {
+		return
+	}
+	if err := m.Close(); err != nil {
+		b.logf("detaching containers: %v", err)
+	}
+}
+
+// tunInterfaceName returns the name of the OS network interface that
+// has this node's Tailscale IPs.
+func (b *LocalBackend) tunInterfaceName() (string, error) {
+	b.mu.Lock()
+	nm := b.netMap
+	b.mu.Unlock()
+	if nm == nil {
+		return "", errors.New("not connected to a tailnet")
+	}
+	mine := map[netaddr.IP]bool{}
+	for _, pfx := range nm.Addresses {
+		mine[pfx.IP] = true
+	}
+	var name string
+	err := interfaces.ForeachInterfaceAddress(func(iface interfaces.Interface, pfx netaddr.IPPrefix) {
+		if name == "" && mine[pfx.IP] {
+			name = iface.Name
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", errors.New("no Tailscale network interface; containers can't be attached in userspace networking mode")
+	}
+	return name, nil
+}
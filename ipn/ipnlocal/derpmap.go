@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/sched"
+)
+
+// derpMapFilePollInterval is how often the DERPMapPath pref's file is
+// checked for changes.
+const derpMapFilePollInterval = 10 * time.Second
+
+// derpMapFile is the contents of the DERPMapPath pref's file.
+type derpMapFile struct {
+	// OmitDefaultRegions is whether to use only the file's regions,
+	// ignoring the control server's.
+	OmitDefaultRegions bool `json:",omitempty"`
+
+	// Regions are merged into the control server's DERP map by
+	// region ID. A null region removes the control server's region
+	// of that ID.
+	Regions map[int]*tailcfg.DERPRegion
+}
+
+// loadDERPMapFile reads and validates the DERP map file at path.
+func loadDERPMapFile(path string) (*derpMapFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := new(derpMapFile)
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for id, r := range f.Regions {
+		if r == nil {
+			continue
+		}
+		if id <= 0 || r.RegionID != id {
+			return nil, fmt.Errorf("%s: region %d has RegionID %d; must be equal and positive", path, id, r.RegionID)
+		}
+		if len(r.Nodes) == 0 {
+			return nil, fmt.Errorf("%s: region %d has no nodes", path, id)
+		}
+	}
+	if f.OmitDefaultRegions && len(f.Regions) == 0 {
+		return nil, errors.New(path + ": OmitDefaultRegions set with no regions")
+	}
+	return f, nil
+}
+
+// effectiveDERPMap returns the DERP map magicsock should use, given the
+// control server's map (which may be nil) and the DERPMapPath pref's
+// file (nil if unset). It doesn't modify its arguments.
+func effectiveDERPMap(control *tailcfg.DERPMap, f *derpMapFile) *tailcfg.DERPMap {
+	if f == nil {
+		return control
+	}
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}
+	if control != nil && (f == nil || !f.OmitDefaultRegions) {
+		for id, r := range control.Regions {
+			dm.Regions[id] = r
+		}
+	}
+	for id, r := range f.Regions {
+		if r == nil {
+			delete(dm.Regions, id)
+		} else {
+			dm.Regions[id] = r
+		}
+	}
+	return dm
+}
+
+// updateDERPMap gives the engine the DERP map from the current netmap,
+// as modified by the DERPMapPath pref, and the PreferredDERP pref. It
+// does nothing before the first netmap.
+//
+// The preferred region isn't enforced through the map, by marking the
+// others Avoid, as the node would then have no home DERP while the
+// preferred region is down. magicsock picks it only when reachable.
+func (b *LocalBackend) updateDERPMap() {
+	b.mu.Lock()
+	if b.netMap == nil || b.prefs == nil {
+		b.mu.Unlock()
+		return
+	}
+	dm := effectiveDERPMap(b.netMap.DERPMap, b.derpMapFile)
+	preferred := b.prefs.PreferredDERP
+	b.mu.Unlock()
+
+	b.e.SetDERPMap(dm)
+	b.e.SetPreferredDERP(preferred)
+}
+
+// setDERPMapPathLocked starts watching the DERP map file at path, if
+// it's not already being watched, and stops watching the previous one.
+//
+// b.mu must be held.
+func (b *LocalBackend) setDERPMapPathLocked(path string) {
+	if path == b.derpMapPath {
+		return
+	}
+	b.derpMapPath = path
+	b.derpMapFile = nil
+	if path == "" {
+		b.sched.Remove("derp-map-file")
+		return
+	}
+	b.sched.Add("derp-map-file", b.derpMapFileTask(path))
+	b.sched.RunNow("derp-map-file")
+}
+
+// derpMapFileTask returns the scheduled task that loads the DERP map
+// file at path, and again whenever its size or modification time
+// changes. If the file can't be loaded, the last good version stays
+// in effect.
+func (b *LocalBackend) derpMapFileTask(path string) sched.Task {
+	var lastMod time.Time
+	var lastSize int64 = -1
+	var lastErr string
+	load := func(ctx context.Context) error {
+		fi, err := os.Stat(path)
+		if err == nil && (!fi.ModTime().Equal(lastMod) || fi.Size() != lastSize) {
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			var f *derpMapFile
+			if f, err = loadDERPMapFile(path); err == nil {
+				b.mu.Lock()
+				current := ctx.Err() == nil
+				if current {
+					b.derpMapFile = f
+				}
+				b.mu.Unlock()
+				if !current {
+					return nil
+				}
+				b.logf("derpmap: loaded %d regions from %s", len(f.Regions), path)
+				b.updateDERPMap()
+			}
+		}
+		if err == nil {
+			lastErr = ""
+		} else if err.Error() != lastErr {
+			lastErr = err.Error()
+			b.logf("derpmap: %v; keeping previous DERP map", err)
+		}
+		return err
+	}
+	return sched.Task{
+		Interval: derpMapFilePollInterval,
+		Func:     load,
+	}
+}
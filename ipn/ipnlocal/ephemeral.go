@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+)
+
+// ephemeralLogoutTimeout is how long Shutdown waits for control to
+// acknowledge an ephemeral node's logout.
+const ephemeralLogoutTimeout = 5 * time.Second
+
+// storedPrefs returns p serialized for the state store. An ephemeral
+// node's Persist is left out, so its node key and login are kept
+// only in memory and a restarted tailscaled registers a new node.
+func storedPrefs(p *ipn.Prefs) []byte {
+	if p.Ephemeral && p.Persist != nil {
+		p = p.Clone()
+		p.Persist = nil
+	}
+	return p.ToBytes()
+}
+
+// logoutEphemeral tells control that the ephemeral node cli is
+// logged in as is going away, so control deletes it now rather than
+// once it notices the node is offline. It's best effort; the node is
+// deleted eventually either way.
+func (b *LocalBackend) logoutEphemeral(cli *controlclient.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), ephemeralLogoutTimeout)
+	defer cancel()
+	if err := cli.Direct().SendLogout(ctx); err != nil {
+		b.logf("ephemeral node logout: %v", err)
+		return
+	}
+	b.logf("ephemeral node logged out")
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/tailcfg"
+)
+
+// healthSummaryDebounce is how long health changes are collected
+// before the health summary in Hostinfo is recomputed. Each
+// SetHostinfo restarts the map poll, so flapping warnings mustn't
+// cause one each.
+const healthSummaryDebounce = 10 * time.Second
+
+// healthSummaryLoop keeps the health summary in b's Hostinfo up to
+// date as health changes, until b shuts down.
+func (b *LocalBackend) healthSummaryLoop() {
+	unregister := health.RegisterWatcher(func(string, error) { b.pokeHealthSummary() })
+	defer unregister()
+
+	debounce(b.ctx, b.healthSummaryWake, healthSummaryDebounce, b.updateHealthSummary)
+}
+
+// debounce calls f once d has passed since the first of a burst of
+// values from wake, until ctx is done. Values arriving while a call
+// is pending are merged into it.
+func debounce(ctx context.Context, wake <-chan struct{}, d time.Duration, f func()) {
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+			if timerC == nil {
+				timer = time.NewTimer(d)
+				timerC = timer.C
+			}
+		case <-timerC:
+			timerC = nil
+			f()
+		}
+	}
+}
+
+// pokeHealthSummary asks healthSummaryLoop to check whether the health
+// summary changed.
+func (b *LocalBackend) pokeHealthSummary() {
+	select {
+	case b.healthSummaryWake <- struct{}{}:
+	default:
+	}
+}
+
+// healthSummaryLocked returns the node's current health summary.
+//
+// b.mu must be held.
+func (b *LocalBackend) healthSummaryLocked() *tailcfg.HealthSummary {
+	hs := &tailcfg.HealthSummary{
+		Warnings: len(health.Warnings()),
+		Updated:  time.Now().UTC().Truncate(time.Second),
+	}
+	if b.netMap != nil {
+		hs.KeyExpiry = b.netMap.Expiry
+	}
+	return hs
+}
+
+// healthSummaryChanged reports whether the health summary hs differs
+// from old in more than when it was computed.
+func healthSummaryChanged(old, hs *tailcfg.HealthSummary) bool {
+	return old == nil || old.Warnings != hs.Warnings || !old.KeyExpiry.Equal(hs.KeyExpiry)
+}
+
+// updateHealthSummary sends control a new health summary in Hostinfo,
+// if it changed.
+func (b *LocalBackend) updateHealthSummary() {
+	b.mu.Lock()
+	if b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	hs := b.healthSummaryLocked()
+	if !healthSummaryChanged(b.hostinfo.Health, hs) {
+		b.mu.Unlock()
+		return
+	}
+	hi := b.hostinfo.Clone()
+	hi.Health = hs
+	b.hostinfo = hi
+	b.mu.Unlock()
+
+	b.doSetHostinfoFilterServices(hi)
+}
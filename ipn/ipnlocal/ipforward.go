@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/net/ipforward"
+	"tailscale.com/util/sched"
+)
+
+// ipForwardCheckInterval is how often the OS's IP forwarding setting
+// is checked while the node advertises routes, as it can be changed
+// at any time.
+const ipForwardCheckInterval = time.Minute
+
+// checkIPForwarding updates the IP forwarding health warning for the
+// current prefs.
+func (b *LocalBackend) checkIPForwarding() {
+	b.mu.Lock()
+	var routes []netaddr.IPPrefix
+	if b.prefs != nil {
+		routes = b.prefs.AdvertiseRoutes
+	}
+	b.mu.Unlock()
+
+	var err error
+	if len(routes) > 0 && !b.netstackRouter {
+		err = ipforward.Check(routes)
+	}
+	health.SetIPForwardingHealth(err)
+}
+
+// ipForwardCheckTask is the scheduled task that runs
+// checkIPForwarding.
+func (b *LocalBackend) ipForwardCheckTask() sched.Task {
+	return sched.Task{
+		Interval: ipForwardCheckInterval,
+		Func: func(context.Context) error {
+			b.checkIPForwarding()
+			return nil
+		},
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"runtime"
 	"strings"
@@ -24,6 +25,7 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nsjoin"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/portlist"
 	"tailscale.com/tailcfg"
@@ -33,9 +35,12 @@ import (
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/wgkey"
+	"tailscale.com/util/sched"
 	"tailscale.com/util/systemd"
 	"tailscale.com/version"
+	"tailscale.com/version/updatecheck"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/router/dns"
@@ -72,6 +77,7 @@ type LocalBackend struct {
 	statsLogf         logger.Logf        // for printing peers stats on change
 	e                 wgengine.Engine
 	store             ipn.StateStore
+	sched             *sched.Scheduler // periodic tasks; see Tasks
 	backendLogID      string
 	unregisterLinkMon func()
 	portpoll          *portlist.Poller // may be nil
@@ -79,12 +85,23 @@ type LocalBackend struct {
 	gotPortPollRes    chan struct{}    // closed upon first readPoller result
 	serverURL         string           // tailcontrol URL
 	newDecompressor   func() (controlclient.Decompressor, error)
+	netstackRouter    bool // advertised routes are forwarded by netstack
+
+	// tailnetDial, if non-nil, makes TCP connections through the
+	// tailnet for DialTailnet.
+	tailnetDial func(ctx context.Context, addr string) (net.Conn, error)
+
+	// certDNSProvider is the DNS-01 provider spec for the
+	// CertDomains pref. It comes from tailscaled's flags, not prefs,
+	// as the exec provider runs a program as tailscaled's user.
+	certDNSProvider string
 
 	filterHash string
 
 	// The mutex protects the following elements.
 	mu             sync.Mutex
 	notify         func(ipn.Notify)
+	notifyWatchers map[chan ipn.Notify]int // LocalAPI watchers to number of dropped notifications; see WatchNotifications
 	c              *controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
 	userID         string       // current controlling user ID (for Windows, primarily)
@@ -95,20 +112,80 @@ type LocalBackend struct {
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is not mutated in-place once set.
-	netMap       *netmap.NetworkMap
-	nodeByAddr   map[netaddr.IP]*tailcfg.Node
-	activeLogin  string // last logged LoginName from netMap
-	engineStatus ipn.EngineStatus
-	endpoints    []string
-	blocked      bool
-	authURL      string
-	interact     bool
-	prevIfState  *interfaces.State
+	netMap           *netmap.NetworkMap
+	nodeByAddr       map[netaddr.IP]*tailcfg.Node
+	activeLogin      string // last logged LoginName from netMap
+	engineStatus     ipn.EngineStatus
+	endpoints        []string
+	openServices     []tailcfg.Service // all local listeners last seen by portpoll
+	blocked          bool
+	authURL          string
+	loginURL         string // last auth URL sent to frontends, until login finishes
+	interact         bool
+	prevIfState      *interfaces.State
+	locationNetwork  string    // network ID whose location prefs were last considered
+	sshServer        SSHServer // or nil; created on first use
+	sshListeners     map[netaddr.IP]net.Listener
+	nsJoin           *nsjoin.Manager // or nil; created on first use
+	serveListeners   map[netaddr.IPPort]*serveListener
+	peerAPIListeners map[netaddr.IP]*peerAPIListener
+	peerAPIPort      uint16               // port of peerAPIListeners, or 0 before the first listen
+	vservices        map[string]*vservice // by name
+
+	// certs are the certificates GetCertPEM has been asked for, by
+	// domain. Those that loaded are renewed by the cert-renewal task.
+	certs map[string]*domainCert
+
+	// appDomains are the AppConnectorDomains being resolved by the
+	// goroutine that appResolveCancel stops, and appRoutes the
+	// routes learned for them, by address.
+	appDomains       []string
+	appResolveCancel context.CancelFunc
+	appRoutes        map[netaddr.IP]appRoute
+
+	// netLock is the tailnet lock state of the login with StateKey
+	// netLockKey, loaded on first use, and netLockFiltered are the
+	// peers it dropped from the last netmap. netLockPeers are the
+	// peers of netMap as control sent them, before filtering, to
+	// filter again when the trusted keys change.
+	netLock         *networkLockState
+	netLockKey      ipn.StateKey
+	netLockFiltered []*ipnstate.LockedOutPeer
+	netLockPeers    []*tailcfg.Node
+
+	// derpMapPath is the DERPMapPath pref being watched, if any, and
+	// derpMapFile is its last good contents, or nil.
+	derpMapPath string
+	derpMapFile *derpMapFile
+
+	// healthSummaryWake wakes healthSummaryLoop to check whether
+	// the health summary in hostinfo changed.
+	healthSummaryWake chan struct{}
+
+	// natKeepalive is the default keepalive interval, in seconds,
+	// for the NAT of the last NetInfo; see natKeepaliveSeconds.
+	natKeepalive uint16
+
+	alertRules     []ipn.AlertRule // from SetAlertRules
+	alertTaskAdded bool
+
+	// acceptedNet is the network config last accepted with the
+	// ConfirmNetworkChanges pref, loaded lazily from the state store
+	// (acceptedNetLoaded), and pendingNet is a change to it from the
+	// tailnet waiting to be accepted, or nil.
+	acceptedNet       *ipn.NetworkConfig
+	acceptedNetLoaded bool
+	pendingNet        *ipn.NetworkConfig
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
 	statusChanged *sync.Cond
+
+	// captureMu guards captureSinks. It's separate from mu because
+	// capturePacket runs on the data path.
+	captureMu    sync.Mutex
+	captureSinks map[*capture.Sink]bool
 }
 
 // NewLocalBackend returns a new LocalBackend that is ready to run,
@@ -128,19 +205,27 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 	}
 
 	b := &LocalBackend{
-		ctx:            ctx,
-		ctxCancel:      cancel,
-		logf:           logf,
-		keyLogf:        logger.LogOnChange(logf, 5*time.Minute, time.Now),
-		statsLogf:      logger.LogOnChange(logf, 5*time.Minute, time.Now),
-		e:              e,
-		store:          store,
-		backendLogID:   logid,
-		state:          ipn.NoState,
-		portpoll:       portpoll,
-		gotPortPollRes: make(chan struct{}),
+		ctx:               ctx,
+		ctxCancel:         cancel,
+		logf:              logf,
+		keyLogf:           logger.LogOnChange(logf, 5*time.Minute, time.Now),
+		statsLogf:         logger.LogOnChange(logf, 5*time.Minute, time.Now),
+		e:                 e,
+		store:             store,
+		backendLogID:      logid,
+		state:             ipn.NoState,
+		portpoll:          portpoll,
+		gotPortPollRes:    make(chan struct{}),
+		healthSummaryWake: make(chan struct{}, 1),
 	}
 	b.statusChanged = sync.NewCond(&b.statusLock)
+	b.sched = sched.New(ctx, logf)
+	go b.healthSummaryLoop()
+	if updatecheck.Enabled() {
+		b.sched.Add("update-check", b.updateCheckTask())
+	}
+	b.sched.Add("ip-forward-check", b.ipForwardCheckTask())
+	b.sched.Add("cert-renewal", b.certRenewalTask())
 
 	linkMon := e.GetLinkMonitor()
 	// Call our linkChange code once with the current state, and
@@ -179,7 +264,9 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 
 	// If the local network configuration has changed, our filter may
 	// need updating to tweak default routes.
-	b.updateFilter(b.netMap, b.prefs)
+	b.updateFilter(b.netMap, b.prefs, b.appRoutesLocked())
+
+	go b.applyNetworkLocation()
 }
 
 // Shutdown halts the backend and all its sub-components. The backend
@@ -187,12 +274,23 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 func (b *LocalBackend) Shutdown() {
 	b.mu.Lock()
 	cli := b.c
+	ephemeral := b.prefs != nil && b.prefs.Ephemeral
 	b.mu.Unlock()
 
 	b.unregisterLinkMon()
 	if cli != nil {
+		if ephemeral {
+			b.logoutEphemeral(cli)
+		} else {
+			b.saveResumeState(cli)
+		}
 		cli.Shutdown()
 	}
+	b.closeSSHListeners()
+	b.closeServeListeners()
+	b.closeVirtualServices()
+	b.closePeerAPIListeners()
+	b.detachContainers()
 	b.ctxCancel()
 	b.e.Close()
 	b.e.Wait()
@@ -206,6 +304,68 @@ func (b *LocalBackend) Status() *ipnstate.Status {
 	return sb.Status()
 }
 
+// FilterStats returns the packet counters of the current packet
+// filter, or nil if there isn't one.
+func (b *LocalBackend) FilterStats() *filter.Stats {
+	f := b.e.GetFilter()
+	if f == nil {
+		return nil
+	}
+	return f.Stats()
+}
+
+// Tasks returns the status of tailscaled's periodic tasks.
+func (b *LocalBackend) Tasks() []sched.TaskStatus {
+	return b.sched.Status()
+}
+
+// RunTask runs the periodic task called name now, rather than at its
+// next scheduled time. It reports whether there's such a task.
+func (b *LocalBackend) RunTask(name string) bool {
+	return b.sched.RunNow(name)
+}
+
+// DNSQueryLog returns the MagicDNS resolver's query log.
+func (b *LocalBackend) DNSQueryLog() *tsdns.QueryLog {
+	return b.e.DNSQueryLog()
+}
+
+// DebugMagicsock returns magicsock's path discovery state.
+func (b *LocalBackend) DebugMagicsock() *ipnstate.MagicsockDebug {
+	return b.e.DebugMagicsock()
+}
+
+// LinkEvents returns the network changes the link monitor most
+// recently noticed, oldest first.
+func (b *LocalBackend) LinkEvents() []ipnstate.LinkEvent {
+	evs := b.e.GetLinkMonitor().RecentEvents()
+	ret := make([]ipnstate.LinkEvent, len(evs))
+	for i, ev := range evs {
+		ret[i] = ipnstate.LinkEvent{Time: ev.Time, Changed: ev.Changed, State: ev.State}
+	}
+	return ret
+}
+
+// DNSStatus returns the DNS configuration b has programmed into the
+// OS and the MagicDNS resolver.
+func (b *LocalBackend) DNSStatus() *ipnstate.DNSStatus {
+	st := b.e.DNSStatus()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st.AcceptDNS = b.prefs != nil && b.prefs.CorpDNS
+	if b.netMap != nil {
+		st.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
+	}
+	return st
+}
+
+// QueryDNS answers the DNS query message with the MagicDNS resolver,
+// which forwards queries for non-Tailscale names upstream, and
+// returns the response message.
+func (b *LocalBackend) QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	return b.e.QueryDNS(ctx, query)
+}
+
 // UpdateStatus implements ipnstate.StatusUpdater.
 func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	b.e.UpdateStatus(sb)
@@ -214,7 +374,15 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	defer b.mu.Unlock()
 
 	sb.SetBackendState(b.state.String())
-	sb.SetAuthURL(b.authURL)
+	if b.authURL != "" {
+		sb.SetAuthURL(b.authURL)
+	} else {
+		sb.SetAuthURL(b.loginURL)
+	}
+	sb.SetSelfHostinfo(b.hostinfo.Clone())
+	for _, w := range health.Warnings() {
+		sb.AddHealth(w)
+	}
 
 	// TODO: hostinfo, and its networkinfo
 	// TODO: EngineStatus copy (and deprecate it?)
@@ -228,20 +396,29 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			if p.LastSeen != nil {
 				lastSeen = *p.LastSeen
 			}
-			var tailAddr string
+			var ip4s, ip6s []netaddr.IP
 			for _, addr := range p.Addresses {
-				// The peer struct currently only allows a single
-				// Tailscale IP address. For compatibility with the
-				// old display, make sure it's the IPv4 address.
-				if addr.IP.Is4() && addr.IsSingleIP() && tsaddr.IsTailscaleIP(addr.IP) {
-					tailAddr = addr.IP.String()
-					break
+				if !addr.IsSingleIP() || !tsaddr.IsTailscaleIP(addr.IP) {
+					continue
 				}
+				if addr.IP.Is4() {
+					ip4s = append(ip4s, addr.IP)
+				} else {
+					ip6s = append(ip6s, addr.IP)
+				}
+			}
+			// TailAddr only allows for a single Tailscale IP
+			// address. For compatibility with the old display,
+			// make sure it's the IPv4 address.
+			var tailAddr string
+			if len(ip4s) > 0 {
+				tailAddr = ip4s[0].String()
 			}
 			sb.AddPeer(key.Public(p.Key), &ipnstate.PeerStatus{
 				InNetworkMap: true,
 				UserID:       p.User,
 				TailAddr:     tailAddr,
+				TailscaleIPs: append(ip4s, ip6s...),
 				HostName:     p.Hostinfo.Hostname,
 				DNSName:      p.Name,
 				OS:           p.Hostinfo.OS,
@@ -250,6 +427,10 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 				LastSeen:     lastSeen,
 				ShareeNode:   p.Hostinfo.ShareeNode,
 				ExitNode:     p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+				Services:     p.Hostinfo.Services,
+				Tags:         p.Hostinfo.RequestTags,
+				Version:      p.Hostinfo.IPNVersion,
+				Health:       p.Hostinfo.Health,
 			})
 		}
 	}
@@ -292,6 +473,44 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetNetstackRouter sets whether advertised routes are forwarded by
+// netstack, in userspace, rather than by the OS, whose IP forwarding
+// setting then doesn't matter. It must be called before Start.
+func (b *LocalBackend) SetNetstackRouter(v bool) {
+	b.netstackRouter = v
+}
+
+// SetTailnetDialer sets the func that DialTailnet uses to make TCP
+// connections through the tailnet: through netstack in userspace
+// networking mode, or the OS otherwise. It must be called before
+// Start.
+func (b *LocalBackend) SetTailnetDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	b.tailnetDial = dial
+}
+
+// SetCertDNSProvider sets the DNS-01 challenge provider used to get
+// certificates for the CertDomains pref, as "name" or "name:arg". It
+// must be called before Start.
+func (b *LocalBackend) SetCertDNSProvider(spec string) {
+	b.certDNSProvider = spec
+}
+
+// DialTailnet makes a TCP connection to addr, a host:port where host
+// is a peer's MagicDNS name or an IP reachable over the tailnet, on
+// behalf of a LocalAPI client.
+func (b *LocalBackend) DialTailnet(ctx context.Context, addr string) (net.Conn, error) {
+	if b.tailnetDial == nil {
+		return nil, errors.New("dialing not supported by this tailscaled")
+	}
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	if state != ipn.Running {
+		return nil, fmt.Errorf("tailscale is not running (state %v)", state)
+	}
+	return b.tailnetDial(ctx, addr)
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -306,6 +525,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		return
 	}
 	if st.LoginFinished != nil {
+		b.mu.Lock()
+		b.loginURL = ""
+		b.mu.Unlock()
 		// Auth completed, unblock the engine
 		b.blockEngineUpdates(false)
 		b.authReconfig()
@@ -321,6 +543,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	stateKey := b.stateKey
 	netMap := b.netMap
 	interact := b.interact
+	appRoutes := b.appRoutesLocked()
 
 	if st.Persist != nil {
 		if !b.prefs.Persist.Equals(st.Persist) {
@@ -334,6 +557,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		prefsChanged = true
 	}
 	if st.NetMap != nil {
+		st.NetMap = b.networkLockFilterLocked(st.NetMap)
 		if b.findExitNodeIDLocked(st.NetMap) {
 			prefsChanged = true
 		}
@@ -358,7 +582,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	// Now complete the lock-free parts of what we started while locked.
 	if prefsChanged {
 		if stateKey != "" {
-			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+			if err := b.store.WriteState(stateKey, storedPrefs(prefs)); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
 			}
 		}
@@ -374,12 +598,12 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			}
 		}
 
-		b.updateFilter(st.NetMap, prefs)
+		b.updateFilter(st.NetMap, prefs, appRoutes)
 		b.e.SetNetworkMap(st.NetMap)
 		if !dnsMapsEqual(st.NetMap, netMap) {
 			b.updateDNSMap(st.NetMap)
 		}
-		b.e.SetDERPMap(st.NetMap.DERPMap)
+		b.updateDERPMap()
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
 	}
@@ -398,27 +622,33 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 // findExitNodeIDLocked updates b.prefs to reference an exit node by ID,
 // rather than by IP. It returns whether prefs was mutated.
 func (b *LocalBackend) findExitNodeIDLocked(nm *netmap.NetworkMap) (prefsChanged bool) {
+	return findExitNodeID(b.prefs, nm)
+}
+
+// findExitNodeID updates prefs to reference an exit node in nm by
+// ID, rather than by IP. It returns whether prefs was mutated.
+func findExitNodeID(prefs *ipn.Prefs, nm *netmap.NetworkMap) (prefsChanged bool) {
 	// If we have a desired IP on file, try to find the corresponding
 	// node.
-	if b.prefs.ExitNodeIP.IsZero() {
+	if prefs.ExitNodeIP.IsZero() {
 		return false
 	}
 
 	// IP takes precedence over ID, so if both are set, clear ID.
-	if b.prefs.ExitNodeID != "" {
-		b.prefs.ExitNodeID = ""
+	if prefs.ExitNodeID != "" {
+		prefs.ExitNodeID = ""
 		prefsChanged = true
 	}
 
 	for _, peer := range nm.Peers {
 		for _, addr := range peer.Addresses {
-			if !addr.IsSingleIP() || addr.IP != b.prefs.ExitNodeIP {
+			if !addr.IsSingleIP() || addr.IP != prefs.ExitNodeIP {
 				continue
 			}
 			// Found the node being referenced, upgrade prefs to
 			// reference it directly for next time.
-			b.prefs.ExitNodeID = peer.StableID
-			b.prefs.ExitNodeIP = netaddr.IP{}
+			prefs.ExitNodeID = peer.StableID
+			prefs.ExitNodeIP = netaddr.IP{}
 			return true
 		}
 	}
@@ -499,6 +729,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		hostinfo.Services = b.hostinfo.Services // keep any previous session and netinfo
 		hostinfo.NetInfo = b.hostinfo.NetInfo
 	}
+	hostinfo.Health = b.healthSummaryLocked()
 	b.hostinfo = hostinfo
 	b.state = ipn.NoState
 
@@ -509,7 +740,8 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	b.inServerMode = b.prefs.ForceDaemon
 	b.serverURL = b.prefs.ControlURL
-	hostinfo.RoutableIPs = append(hostinfo.RoutableIPs, b.prefs.AdvertiseRoutes...)
+	hostinfo.RoutableIPs = append(hostinfo.RoutableIPs, b.routableIPsLocked()...)
+	hostinfo.AppConnectorDomains = b.appDomains
 	hostinfo.RequestTags = append(hostinfo.RequestTags, b.prefs.AdvertiseTags...)
 	if b.inServerMode || runtime.GOOS == "windows" {
 		b.logf("Start: serverMode=%v", b.inServerMode)
@@ -520,9 +752,20 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.setNetMapLocked(nil)
 	persistv := b.prefs.Persist
 	machinePrivKey := b.machinePrivKey
+	stateKey := b.stateKey
+	wantRunning := b.prefs.WantRunning
+	ephemeral := b.prefs.Ephemeral
 	b.mu.Unlock()
 
-	b.updateFilter(nil, nil)
+	b.checkIPForwarding()
+	go b.applyNetworkLocation()
+
+	var resume *resumeState
+	if wantRunning {
+		resume = b.takeResumeState(stateKey, persistv)
+	}
+
+	b.updateFilter(nil, nil, nil)
 
 	if b.portpoll != nil {
 		b.portpollOnce.Do(func() {
@@ -556,18 +799,22 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		persistv = &persist.Persist{}
 	}
 	cli, err := controlclient.New(controlclient.Options{
-		MachinePrivateKey: machinePrivKey,
-		Logf:              logger.WithPrefix(b.logf, "control: "),
-		Persist:           *persistv,
-		ServerURL:         b.serverURL,
-		AuthKey:           opts.AuthKey,
-		Hostinfo:          hostinfo,
-		KeepAlive:         true,
-		NewDecompressor:   b.newDecompressor,
-		HTTPTestClient:    opts.HTTPTestClient,
-		DiscoPublicKey:    discoPublic,
-		DebugFlags:        controlDebugFlags,
-		LinkMonitor:       b.e.GetLinkMonitor(),
+		MachinePrivateKey:     machinePrivKey,
+		Logf:                  logger.WithPrefix(b.logf, "control: "),
+		Persist:               *persistv,
+		ServerURL:             b.serverURL,
+		AuthKey:               opts.AuthKey,
+		Hostinfo:              hostinfo,
+		KeepAlive:             true,
+		NewDecompressor:       b.newDecompressor,
+		HTTPTestClient:        opts.HTTPTestClient,
+		DiscoPublicKey:        discoPublic,
+		DebugFlags:            controlDebugFlags,
+		LinkMonitor:           b.e.GetLinkMonitor(),
+		Netns:                 b.e.GetNetnsBinding(),
+		Resume:                resume.controlState(),
+		Ephemeral:             ephemeral,
+		SkipIPForwardingCheck: b.netstackRouter,
 	})
 	if err != nil {
 		return err
@@ -578,6 +825,13 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	endpoints := b.endpoints
 	b.mu.Unlock()
 
+	if resume != nil {
+		// Configure the engine from the saved netmap now, rather
+		// than waiting for the control server to send one.
+		b.logf("resume: resuming session saved %v ago", time.Since(resume.SavedAt).Round(time.Millisecond))
+		b.setClientStatus(controlclient.Status{NetMap: resume.NetMap})
+	}
+
 	if endpoints != nil {
 		cli.UpdateEndpoints(0, endpoints)
 	}
@@ -593,9 +847,12 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		prefs.Persist.LegacyFrontendPrivateMachineKey.IsZero() {
 		prefs.Persist.LegacyFrontendPrivateMachineKey = b.machinePrivKey
 	}
+	b.setDERPMapPathLocked(prefs.DERPMapPath)
 
 	b.mu.Unlock()
 
+	b.e.SetListenPort(prefs.ListenPort)
+
 	blid := b.backendLogID
 	b.logf("Backend: logs: be:%v fe:%v", blid, opts.FrontendLogID)
 	b.send(ipn.Notify{BackendLogID: &blid})
@@ -606,8 +863,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 }
 
 // updateFilter updates the packet filter in wgengine based on the
-// given netMap and user preferences.
-func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs) {
+// given netMap and user preferences, and the routes advertised by the
+// app connector.
+func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs, appRoutes []netaddr.IPPrefix) {
 	// NOTE(danderson): keep change detection as the first thing in
 	// this function. Don't try to optimize by returning early, more
 	// likely than not you'll just end up breaking the change
@@ -656,6 +914,9 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 			}
 		}
 	}
+	for _, r := range appRoutes {
+		localNetsB.AddPrefix(r)
+	}
 	localNets := localNetsB.IPSet()
 	logNets := logNetsB.IPSet()
 
@@ -784,6 +1045,19 @@ func (b *LocalBackend) updateDNSMap(netMap *netmap.NetworkMap) {
 	}
 	set(netMap.Name, netMap.Addresses)
 
+	// Virtual services are named <name>.svc.<tailnet domain>.
+	b.mu.Lock()
+	var vservices []ipn.VirtualService
+	if b.prefs != nil {
+		vservices = b.prefs.VirtualServices
+	}
+	b.mu.Unlock()
+	if suffix := netMap.MagicDNSSuffix(); suffix != "" {
+		for _, vs := range vservices {
+			nameToIP[vs.Name+".svc."+suffix+"."] = vs.Addr.IP
+		}
+	}
+
 	dnsMap := tsdns.NewMap(nameToIP, magicDNSRootDomains(netMap))
 	// map diff will be logged in tsdns.Resolver.SetMap.
 	b.e.SetDNSMap(dnsMap)
@@ -798,23 +1072,21 @@ func (b *LocalBackend) readPoller() {
 		if !ok {
 			return
 		}
-		sl := []tailcfg.Service{}
+		sl := make([]tailcfg.Service, 0, len(ports))
 		for _, p := range ports {
-			s := tailcfg.Service{
+			sl = append(sl, tailcfg.Service{
 				Proto:       tailcfg.ServiceProto(p.Proto),
 				Port:        p.Port,
 				Description: p.Process,
-			}
-			if policy.IsInterestingService(s, version.OS()) {
-				sl = append(sl, s)
-			}
+			})
 		}
 
 		b.mu.Lock()
 		if b.hostinfo == nil {
 			b.hostinfo = new(tailcfg.Hostinfo)
 		}
-		b.hostinfo.Services = sl
+		b.openServices = sl
+		b.hostinfo.Services = advertisedServices(sl, b.prefs)
 		hi := b.hostinfo
 		b.mu.Unlock()
 
@@ -827,21 +1099,105 @@ func (b *LocalBackend) readPoller() {
 	}
 }
 
-// send delivers n to the connected frontend. If no frontend is
-// connected, the notification is dropped without being delivered.
+// advertisedServices returns the subset of open that should be
+// reported to peers in Hostinfo.Services, given the user's prefs.
+//
+// If prefs has a non-empty AdvertiseServicePorts allowlist, exactly
+// the open services on those ports are returned. Otherwise the
+// platform default policy applies.
+func advertisedServices(open []tailcfg.Service, prefs *ipn.Prefs) []tailcfg.Service {
+	ret := []tailcfg.Service{}
+	for _, s := range open {
+		if prefs != nil && len(prefs.AdvertiseServicePorts) > 0 {
+			if portInList(s.Port, prefs.AdvertiseServicePorts) {
+				ret = append(ret, s)
+			}
+			continue
+		}
+		if policy.IsInterestingService(s, version.OS()) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func portInList(port uint16, ports []uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers n to the connected frontend and to any LocalAPI
+// watchers. If nobody is listening, the notification is dropped
+// without being delivered.
 func (b *LocalBackend) send(n ipn.Notify) {
+	n.Version = version.Long
+
 	b.mu.Lock()
 	notify := b.notify
+	watched := len(b.notifyWatchers) > 0
+	for ch, dropped := range b.notifyWatchers {
+		select {
+		case ch <- n:
+		default:
+			// Watcher isn't keeping up. Drop it on the
+			// floor rather than block the backend.
+			if dropped == 0 {
+				b.logf("notify watcher not keeping up; dropping notifications")
+			}
+			b.notifyWatchers[ch] = dropped + 1
+		}
+	}
 	b.mu.Unlock()
 
 	if notify != nil {
-		n.Version = version.Long
 		notify(n)
-	} else {
+	} else if !watched {
 		b.logf("nil notify callback; dropping %+v", n)
 	}
 }
 
+// WatchNotifications calls fn with each notification sent by the
+// backend until ctx is done or fn returns false.
+//
+// Notifications are buffered per watcher; if fn is too slow to keep
+// up, notifications are dropped and the number dropped is logged when
+// the watch ends.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, fn func(ipn.Notify) (keepGoing bool)) {
+	ch := make(chan ipn.Notify, 128)
+
+	b.mu.Lock()
+	if b.notifyWatchers == nil {
+		b.notifyWatchers = map[chan ipn.Notify]int{}
+	}
+	b.notifyWatchers[ch] = 0
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		dropped := b.notifyWatchers[ch]
+		delete(b.notifyWatchers, ch)
+		b.mu.Unlock()
+		if dropped > 0 {
+			b.logf("notify watcher dropped %d notifications", dropped)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-ch:
+			if !fn(n) {
+				return
+			}
+		}
+	}
+}
+
 // popBrowserAuthNow shuts down the data plane and sends an auth URL
 // to the connected frontend, if any.
 func (b *LocalBackend) popBrowserAuthNow() {
@@ -849,6 +1205,9 @@ func (b *LocalBackend) popBrowserAuthNow() {
 	url := b.authURL
 	b.interact = false
 	b.authURL = ""
+	if url != "" {
+		b.loginURL = url
+	}
 	b.mu.Unlock()
 
 	b.logf("popBrowserAuthNow: url=%v", url != "")
@@ -861,6 +1220,15 @@ func (b *LocalBackend) popBrowserAuthNow() {
 	}
 }
 
+// LoginURL returns the URL the user needs to visit to finish an
+// interactive login, or the empty string if no login is waiting on
+// one.
+func (b *LocalBackend) LoginURL() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loginURL
+}
+
 // initMachineKeyLocked is called to initialize b.machinePrivKey.
 //
 // b.prefs must already be initialized.
@@ -953,7 +1321,7 @@ func (b *LocalBackend) writeServerModeStartState(userID string, prefs *ipn.Prefs
 		// check block above. That one won't fire in the case
 		// where the Windows client started up in client mode.
 		// This happens when we transition into server mode:
-		if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+		if err := b.store.WriteState(stateKey, storedPrefs(prefs)); err != nil {
 			b.logf("WriteState error: %v", err)
 		}
 	} else {
@@ -975,6 +1343,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs, legac
 	// logging), but revert it if we return an error so a later SetPrefs
 	// call can't pick it up if it's bogus.
 	b.stateKey = key
+	b.acceptedNet, b.acceptedNetLoaded, b.pendingNet = nil, false, nil
 	defer func() {
 		if err != nil {
 			b.stateKey = ""
@@ -1000,7 +1369,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs, legac
 		// Backend owns the state, but frontend is trying to migrate
 		// state into the backend.
 		b.logf("importing frontend prefs into backend store; frontend prefs: %s", prefs.Pretty())
-		if err := b.store.WriteState(key, prefs.ToBytes()); err != nil {
+		if err := b.store.WriteState(key, storedPrefs(prefs)); err != nil {
 			return fmt.Errorf("store.WriteState: %v", err)
 		}
 	}
@@ -1197,9 +1566,15 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 	if newp == nil {
 		panic("SetPrefs got nil prefs")
 	}
-
 	b.mu.Lock()
+	b.setPrefsLockedOnEntry(newp)
+}
 
+// setPrefsLockedOnEntry is SetPrefs, for callers that have already
+// locked b.mu to derive newp from the current prefs. It unlocks b.mu
+// once newp is in place, before propagating it, and returns a copy of
+// the prefs it set.
+func (b *LocalBackend) setPrefsLockedOnEntry(newp *ipn.Prefs) *ipn.Prefs {
 	netMap := b.netMap
 	stateKey := b.stateKey
 
@@ -1207,25 +1582,31 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
 	b.prefs = newp
 	b.inServerMode = newp.ForceDaemon
+	b.setDERPMapPathLocked(newp.DERPMapPath)
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
 
 	oldHi := b.hostinfo
 	newHi := oldHi.Clone()
-	newHi.RoutableIPs = append([]netaddr.IPPrefix(nil), b.prefs.AdvertiseRoutes...)
+	newHi.RoutableIPs = b.routableIPsLocked()
+	if b.openServices != nil {
+		newHi.Services = advertisedServices(b.openServices, newp)
+	}
 	applyPrefsToHostinfo(newHi, newp)
 	b.hostinfo = newHi
 	hostInfoChanged := !oldHi.Equal(newHi)
 	userID := b.userID
+	appRoutes := b.appRoutesLocked()
 
 	b.mu.Unlock()
 
 	if stateKey != "" {
-		if err := b.store.WriteState(stateKey, newp.ToBytes()); err != nil {
+		if err := b.store.WriteState(stateKey, storedPrefs(newp)); err != nil {
 			b.logf("Failed to save new controlclient state: %v", err)
 		}
 	}
 	b.writeServerModeStartState(userID, newp)
+	b.checkIPForwarding()
 
 	// [GRINDER STATS LINE] - please don't remove (used for log parsing)
 	b.logf("SetPrefs: %v", newp.Pretty())
@@ -1248,10 +1629,15 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
-	b.updateFilter(netMap, newp)
+	b.updateFilter(netMap, newp, appRoutes)
 
+	b.updateDERPMap()
 	if netMap != nil {
-		b.e.SetDERPMap(netMap.DERPMap)
+		b.updateDNSMap(netMap)
+	}
+
+	if oldp.ListenPort != newp.ListenPort {
+		b.e.SetListenPort(newp.ListenPort)
 	}
 
 	if oldp.WantRunning != newp.WantRunning {
@@ -1261,6 +1647,7 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 	}
 
 	b.send(ipn.Notify{Prefs: newp})
+	return newp.Clone()
 }
 
 // doSetHostinfoFilterServices calls SetHostinfo on the controlclient,
@@ -1276,6 +1663,10 @@ func (b *LocalBackend) doSetHostinfoFilterServices(hi *tailcfg.Hostinfo) {
 
 	b.mu.Lock()
 	cli := b.c
+	// The peer API is always advertised, so peers can find it.
+	if peerAPI := b.peerAPIServicesLocked(); len(peerAPI) > 0 {
+		hi2.Services = append(append([]tailcfg.Service(nil), hi2.Services...), peerAPI...)
+	}
 	b.mu.Unlock()
 
 	// b.c might not be started yet
@@ -1284,6 +1675,36 @@ func (b *LocalBackend) doSetHostinfoFilterServices(hi *tailcfg.Hostinfo) {
 	}
 }
 
+// EditPrefs changes the prefs that mp edits, leaving the rest as
+// they are, and returns the resulting prefs. Only what changed is
+// applied, as by SetPrefs, so unrelated settings aren't disturbed.
+func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	b.mu.Lock()
+	if b.prefs == nil {
+		b.mu.Unlock()
+		return nil, errors.New("no prefs")
+	}
+	newp := b.prefs.Clone()
+	mp.ApplyTo(newp)
+	if mp.ExitNodeIPSet && b.netMap != nil {
+		findExitNodeID(newp, b.netMap)
+	}
+	if newp.Equals(b.prefs) {
+		b.mu.Unlock()
+		return newp, nil
+	}
+	// Apply the edit without unlocking, so that it can't undo a
+	// concurrent SetPrefs or EditPrefs.
+	return b.setPrefsLockedOnEntry(newp), nil
+}
+
+// Prefs returns a copy of the current preferences.
+func (b *LocalBackend) Prefs() *ipn.Prefs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefs.Clone()
+}
+
 // NetMap returns the latest cached network map received from
 // controlclient, or nil if no network map was received yet.
 func (b *LocalBackend) NetMap() *netmap.NetworkMap {
@@ -1307,12 +1728,20 @@ func (b *LocalBackend) blockEngineUpdates(block bool) {
 // updates are not currently blocked, based on the cached netmap and
 // user prefs.
 func (b *LocalBackend) authReconfig() {
+	defer b.updateSSHListeners()
+	defer b.updateServeListeners()
+	defer b.updateVirtualServices()
+	defer b.updatePeerAPIListeners()
+	defer b.updateAppConnector()
+
 	b.mu.Lock()
 	blocked := b.blocked
 	uc := b.prefs
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
+	natKeepalive := b.natKeepalive
+	appRoutes := b.appRoutesLocked()
 	b.mu.Unlock()
 
 	if blocked {
@@ -1347,8 +1776,10 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	applyPeerLivenessPrefs(cfg, nm, uc, natKeepalive)
 
 	rcfg := routerConfig(cfg, uc)
+	rcfg.SubnetRoutes = append(rcfg.SubnetRoutes, appRoutes...)
 
 	// If CorpDNS is false, rcfg.DNS remains the zero value.
 	if uc.CorpDNS {
@@ -1357,14 +1788,40 @@ func (b *LocalBackend) authReconfig() {
 			b.logf("[unexpected] dns proxied but no nameservers")
 			proxied = false
 		}
+		// With an exit node and no nameservers of its own, route
+		// queries through MagicDNS to the exit node's resolvers,
+		// rather than to whatever the local network handed out.
+		exitURL := exitNodeDNSURL(nm, uc.ExitNodeID)
+		if exitURL != "" && len(nm.DNS.Nameservers) == 0 {
+			proxied = true
+		}
+		b.e.SetDNSExitNode(exitURL, b.tailnetDial)
+		// Send queries for app connectors' domains to them, so
+		// that they advertise routes for the addresses this node
+		// is told, if it accepts their routes. That needs MagicDNS
+		// to proxy all queries, so only do it when the rest have
+		// nameservers or an exit node to go to.
+		var appURLs map[string]string
+		if uc.RouteAll {
+			appURLs = appConnectorDNSRoutes(nm)
+		}
+		if len(appURLs) > 0 && (len(nm.DNS.Nameservers) > 0 || exitURL != "") {
+			proxied = true
+		}
+		b.e.SetDNSAppConnectors(appURLs, b.tailnetDial)
 		rcfg.DNS = dns.Config{
 			Nameservers: nm.DNS.Nameservers,
 			Domains:     nm.DNS.Domains,
 			PerDomain:   nm.DNS.PerDomain,
 			Proxied:     proxied,
 		}
+	} else {
+		b.e.SetDNSExitNode("", nil)
+		b.e.SetDNSAppConnectors(nil, nil)
 	}
 
+	rcfg = b.confirmNetworkConfig(uc, rcfg)
+
 	err = b.e.Reconfig(cfg, rcfg)
 	if err == wgengine.ErrNoChanges {
 		return
@@ -1372,6 +1829,24 @@ func (b *LocalBackend) authReconfig() {
 	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, flags, err)
 }
 
+// exitNodeDNSURL returns the URL of the DNS-over-HTTP endpoint on the
+// peer API of the exit node exitNodeID, or the empty string if there's
+// no exit node or it doesn't run the peer API.
+func exitNodeDNSURL(nm *netmap.NetworkMap, exitNodeID tailcfg.StableNodeID) string {
+	if exitNodeID.IsZero() {
+		return ""
+	}
+	for _, peer := range nm.Peers {
+		if peer.StableID == exitNodeID {
+			if base := peerAPIBase(nm, peer); base != "" {
+				return base + "/v0/dns-query"
+			}
+			break
+		}
+	}
+	return ""
+}
+
 // magicDNSRootDomains returns the subset of nm.DNS.Domains that are the search domains for MagicDNS.
 // Each entry has a trailing period.
 func magicDNSRootDomains(nm *netmap.NetworkMap) []string {
@@ -1386,6 +1861,22 @@ var (
 	ipv6Default = netaddr.MustParseIPPrefix("::/0")
 )
 
+// advertisesExitNode reports whether the node advertises itself as an
+// exit node, with a default route.
+func (b *LocalBackend) advertisesExitNode() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil {
+		return false
+	}
+	for _, r := range b.prefs.AdvertiseRoutes {
+		if r == ipv4Default || r == ipv6Default {
+			return true
+		}
+	}
+	return false
+}
+
 // peerRoutes returns the routerConfig.Routes to access peers.
 // If there are over cgnatThreshold CGNAT routes, one big CGNAT route
 // is used instead.
@@ -1421,6 +1912,97 @@ func peerRoutes(peers []wgcfg.Peer, cgnatThreshold int) (routes []netaddr.IPPref
 	return routes
 }
 
+// applyPeerLivenessPrefs applies the AlwaysOnPeers, KeepaliveSeconds
+// and PeerIdleSeconds prefs to cfg, the wireguard config of nm.
+// natKeepalive is the keepalive interval to use if KeepaliveSeconds
+// is zero, as returned by natKeepaliveSeconds.
+func applyPeerLivenessPrefs(cfg *wgcfg.Config, nm *netmap.NetworkMap, prefs *ipn.Prefs, natKeepalive uint16) {
+	cfg.PeerIdleTimeout = time.Duration(prefs.PeerIdleSeconds) * time.Second
+	keepalive := prefs.KeepaliveSeconds
+	if keepalive == 0 {
+		keepalive = natKeepalive
+	}
+	if keepalive == 0 {
+		keepalive = defaultKeepaliveSeconds
+	}
+	alwaysOn := map[wgcfg.Key]bool{}
+	for _, peer := range nm.Peers {
+		if peerMatchesAny(peer, nm, prefs.AlwaysOnPeers) {
+			alwaysOn[wgcfg.Key(peer.Key)] = true
+		}
+	}
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		if p.PersistentKeepalive != 0 || alwaysOn[p.PublicKey] {
+			p.PersistentKeepalive = keepalive
+		}
+	}
+}
+
+// Keepalive intervals, in seconds, picked by natKeepaliveSeconds.
+const (
+	defaultKeepaliveSeconds = 25 // as in nmcfg; when the NAT is unknown
+	hardNATKeepaliveSeconds = 10 // mapping varies by destination
+	easyNATKeepaliveSeconds = 60 // mapping doesn't vary by destination
+)
+
+// natKeepaliveSeconds returns the keepalive interval to use on the
+// network described by ni, which may be nil.
+//
+// NATs whose mappings vary by destination IP are usually cheap or
+// hostile ones (hotel and cafe hotspots, carrier-grade NATs) that also
+// expire idle mappings quickly, so they get short keepalives. Home
+// routers with endpoint-independent mappings generally keep them for
+// minutes, so keepalives there can be rarer, saving battery. Mobile
+// links keep the default either way, as their carriers' NATs are
+// often stricter than they look.
+func natKeepaliveSeconds(ni *tailcfg.NetInfo) uint16 {
+	if ni == nil || ni.WorkingUDP.EqualBool(false) {
+		// Without UDP, peers are only reached over DERP, whose
+		// connection has its own keepalives.
+		return defaultKeepaliveSeconds
+	}
+	varies, ok := ni.MappingVariesByDestIP.Get()
+	switch {
+	case !ok:
+		return defaultKeepaliveSeconds
+	case varies:
+		return hardNATKeepaliveSeconds
+	case ni.LinkType == "mobile":
+		return defaultKeepaliveSeconds
+	}
+	return easyNATKeepaliveSeconds
+}
+
+// peerMatchesAny reports whether peer is named by any of names, as
+// MagicDNS names (with or without nm's suffix), Tailscale IPs, stable
+// node IDs, or "*" for any peer.
+func peerMatchesAny(peer *tailcfg.Node, nm *netmap.NetworkMap, names []string) bool {
+	fqdn := strings.TrimSuffix(peer.Name, ".")
+	short := fqdn
+	if suffix := nm.MagicDNSSuffix(); suffix != "" {
+		short = strings.TrimSuffix(fqdn, "."+strings.Trim(suffix, "."))
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+		switch {
+		case name == "*",
+			strings.EqualFold(name, fqdn),
+			strings.EqualFold(name, short),
+			name == string(peer.StableID):
+			return true
+		}
+		if ip, err := netaddr.ParseIP(name); err == nil {
+			for _, pfx := range peer.Addresses {
+				if pfx.IsSingleIP() && pfx.IP == ip {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // routerConfig produces a router.Config from a wireguard config and IPN prefs.
 func routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router.Config {
 	rs := &router.Config{
@@ -1539,6 +2121,11 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 			systemd.Status("Stopped; run 'tailscale up' to log in")
 		}
 	case ipn.Starting, ipn.NeedsMachineAuth:
+		if newState == ipn.Starting {
+			systemd.Status("Starting; connecting to the tailnet")
+		} else {
+			systemd.Status("Needs machine authorization by an admin")
+		}
 		b.authReconfig()
 		// Needed so that UpdateEndpoints can run
 		b.e.RequestStatus()
@@ -1658,6 +2245,7 @@ func (b *LocalBackend) requestEngineStatusAndWait() {
 func (b *LocalBackend) Logout() {
 	b.mu.Lock()
 	c := b.c
+	b.loginURL = ""
 	b.setNetMapLocked(nil)
 	b.mu.Unlock()
 
@@ -1696,8 +2284,15 @@ func (b *LocalBackend) setNetInfo(ni *tailcfg.NetInfo) {
 	if b.hostinfo != nil {
 		b.hostinfo.NetInfo = ni.Clone()
 	}
+	keepalive := natKeepaliveSeconds(ni)
+	keepaliveChanged := keepalive != b.natKeepalive
+	b.natKeepalive = keepalive
 	b.mu.Unlock()
 
+	if keepaliveChanged {
+		b.logf("netinfo: NAT mapping varies=%q, link=%q; keepalive now %ds", ni.MappingVariesByDestIP, ni.LinkType, keepalive)
+		b.authReconfig()
+	}
 	if c == nil {
 		return
 	}
@@ -1712,6 +2307,9 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 			login = "<missing-profile>"
 		}
 	}
+	if nm != nil && (b.netMap == nil || !nm.Expiry.Equal(b.netMap.Expiry)) {
+		b.pokeHealthSummary()
+	}
 	b.netMap = nm
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
@@ -1720,6 +2318,7 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 
 	if nm == nil {
 		b.nodeByAddr = nil
+		b.netLockPeers = nil
 		return
 	}
 
@@ -5,13 +5,32 @@
 package ipnlocal
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/router/dns"
 	"tailscale.com/wgengine/wgcfg"
 )
 
@@ -265,3 +284,919 @@ func TestPeerRoutes(t *testing.T) {
 	}
 
 }
+
+func TestAdvertisedServices(t *testing.T) {
+	open := []tailcfg.Service{
+		{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+		{Proto: tailcfg.TCP, Port: 80, Description: "nginx"},
+		{Proto: tailcfg.UDP, Port: 53, Description: "dnsmasq"},
+	}
+	ports := func(svcs []tailcfg.Service) (ret []uint16) {
+		for _, s := range svcs {
+			ret = append(ret, s.Port)
+		}
+		return ret
+	}
+
+	if got := ports(advertisedServices(nil, nil)); len(got) != 0 {
+		t.Errorf("no open services: got %v; want none", got)
+	}
+
+	// With an allowlist, exactly the listed ports are advertised,
+	// regardless of protocol or the default policy.
+	prefs := &ipn.Prefs{AdvertiseServicePorts: []uint16{22, 53, 443}}
+	if got, want := ports(advertisedServices(open, prefs)), []uint16{22, 53}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with allowlist: got %v; want %v", got, want)
+	}
+}
+
+func TestWatchNotifications(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan ipn.Notify, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.WatchNotifications(ctx, func(n ipn.Notify) bool {
+			got <- n
+			return false
+		})
+	}()
+
+	// Wait for the watcher to register before sending.
+	for {
+		b.mu.Lock()
+		n := len(b.notifyWatchers)
+		b.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	st := ipn.Running
+	b.send(ipn.Notify{State: &st})
+	select {
+	case n := <-got:
+		if n.State == nil || *n.State != ipn.Running {
+			t.Errorf("got state %v; want %v", n.State, ipn.Running)
+		}
+		if n.Version == "" {
+			t.Errorf("notification missing version")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	<-done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.notifyWatchers) != 0 {
+		t.Errorf("watcher not removed after fn returned false")
+	}
+}
+
+func TestWatchNotificationsDrops(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	ch := make(chan ipn.Notify, 1)
+	b.notifyWatchers = map[chan ipn.Notify]int{ch: 0}
+
+	for i := 0; i < 3; i++ {
+		b.send(ipn.Notify{})
+	}
+	if len(ch) != 1 {
+		t.Errorf("buffered %d notifications; want 1", len(ch))
+	}
+	if got := b.notifyWatchers[ch]; got != 2 {
+		t.Errorf("dropped = %d; want 2", got)
+	}
+}
+
+func TestCheckDomainPointsAtNode(t *testing.T) {
+	oldCNAME, oldHost := lookupCNAME, lookupHost
+	defer func() { lookupCNAME, lookupHost = oldCNAME, oldHost }()
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		if host == "cname.example.com" {
+			return "node.foo.ts.net.", nil
+		}
+		return host + ".", nil
+	}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "a.example.com":
+			return []string{"203.0.113.1", "100.64.1.2"}, nil
+		case "elsewhere.example.com":
+			return []string{"203.0.113.1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	nm := &netmap.NetworkMap{
+		Name:      "node.foo.ts.net.",
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.1.2/32")},
+	}
+	tests := []struct {
+		domain string
+		ok     bool
+	}{
+		{"cname.example.com", true},
+		{"a.example.com", true},
+		{"elsewhere.example.com", false},
+		{"missing.example.com", false},
+	}
+	for _, tt := range tests {
+		err := checkDomainPointsAtNode(context.Background(), tt.domain, nm)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v; want ok=%v", tt.domain, err, tt.ok)
+		}
+	}
+}
+
+func TestNewDNSChallengeProvider(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"", false},
+		{"exec:/usr/local/bin/hook", true},
+		{"exec:hook", false},
+		{"exec", false},
+		{"nosuchprovider:x", false},
+	}
+	for _, tt := range tests {
+		_, err := newDNSChallengeProvider(t.Logf, tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v; want ok=%v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestApplyPeerLivenessPrefs(t *testing.T) {
+	keyA := tailcfg.NodeKey{1}
+	keyB := tailcfg.NodeKey{2}
+	keyC := tailcfg.NodeKey{3}
+	nm := &netmap.NetworkMap{
+		Name: "me.foo.ts.net.",
+		Peers: []*tailcfg.Node{
+			{Key: keyA, Name: "server.foo.ts.net.", StableID: "nA", Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")}},
+			{Key: keyB, Name: "phone.foo.ts.net.", StableID: "nB", Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32")}},
+			{Key: keyC, Name: "laptop.foo.ts.net.", StableID: "nC", Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.3/32")}},
+		},
+	}
+	newCfg := func() *wgcfg.Config {
+		return &wgcfg.Config{Peers: []wgcfg.Peer{
+			{PublicKey: wgcfg.Key(keyA)},
+			{PublicKey: wgcfg.Key(keyB)},
+			{PublicKey: wgcfg.Key(keyC), PersistentKeepalive: 25}, // control asked
+		}}
+	}
+	keepalives := func(cfg *wgcfg.Config) []uint16 {
+		var ret []uint16
+		for _, p := range cfg.Peers {
+			ret = append(ret, p.PersistentKeepalive)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name         string
+		prefs        *ipn.Prefs
+		natKeepalive uint16
+		want         []uint16
+	}{
+		{"default", &ipn.Prefs{}, 0, []uint16{0, 0, 25}},
+		{"short-name", &ipn.Prefs{AlwaysOnPeers: []string{"server"}}, 0, []uint16{25, 0, 25}},
+		{"fqdn", &ipn.Prefs{AlwaysOnPeers: []string{"server.foo.ts.net."}}, 0, []uint16{25, 0, 25}},
+		{"ip-and-id", &ipn.Prefs{AlwaysOnPeers: []string{"100.64.0.2", "nA"}}, 0, []uint16{25, 25, 25}},
+		{"spaces", &ipn.Prefs{AlwaysOnPeers: []string{"server", " 100.64.0.2 "}}, 0, []uint16{25, 25, 25}},
+		{"all", &ipn.Prefs{AlwaysOnPeers: []string{"*"}, KeepaliveSeconds: 10}, 0, []uint16{10, 10, 10}},
+		{"interval-only", &ipn.Prefs{KeepaliveSeconds: 15}, 0, []uint16{0, 0, 15}},
+		{"nat", &ipn.Prefs{AlwaysOnPeers: []string{"server"}}, 60, []uint16{60, 0, 60}},
+		{"pref-over-nat", &ipn.Prefs{KeepaliveSeconds: 15}, 60, []uint16{0, 0, 15}},
+	}
+	for _, tt := range tests {
+		cfg := newCfg()
+		applyPeerLivenessPrefs(cfg, nm, tt.prefs, tt.natKeepalive)
+		if got := keepalives(cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: keepalives = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	cfg := newCfg()
+	applyPeerLivenessPrefs(cfg, nm, &ipn.Prefs{PeerIdleSeconds: 90}, 0)
+	if cfg.PeerIdleTimeout != 90*time.Second {
+		t.Errorf("PeerIdleTimeout = %v; want 90s", cfg.PeerIdleTimeout)
+	}
+}
+
+func TestNATKeepaliveSeconds(t *testing.T) {
+	tests := []struct {
+		name string
+		ni   *tailcfg.NetInfo
+		want uint16
+	}{
+		{"nil", nil, 25},
+		{"unknown", &tailcfg.NetInfo{WorkingUDP: "true"}, 25},
+		{"no-udp", &tailcfg.NetInfo{WorkingUDP: "false", MappingVariesByDestIP: "true"}, 25},
+		{"hard", &tailcfg.NetInfo{WorkingUDP: "true", MappingVariesByDestIP: "true"}, 10},
+		{"easy", &tailcfg.NetInfo{WorkingUDP: "true", MappingVariesByDestIP: "false"}, 60},
+		{"easy-mobile", &tailcfg.NetInfo{WorkingUDP: "true", MappingVariesByDestIP: "false", LinkType: "mobile"}, 25},
+		{"hard-mobile", &tailcfg.NetInfo{WorkingUDP: "true", MappingVariesByDestIP: "true", LinkType: "mobile"}, 10},
+	}
+	for _, tt := range tests {
+		if got := natKeepaliveSeconds(tt.ni); got != tt.want {
+			t.Errorf("%s: got %d; want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEffectiveDERPMap(t *testing.T) {
+	region := func(id int) *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{
+			RegionID: id,
+			Nodes:    []*tailcfg.DERPNode{{Name: fmt.Sprint(id), RegionID: id}},
+		}
+	}
+	control := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: region(1),
+		2: region(2),
+		3: region(3),
+	}}
+	// regions returns dm's region IDs, with "!" after those to avoid.
+	regions := func(dm *tailcfg.DERPMap) string {
+		var sb strings.Builder
+		for _, id := range dm.RegionIDs() {
+			fmt.Fprintf(&sb, "%d", id)
+			if dm.Regions[id].Avoid {
+				sb.WriteString("!")
+			}
+			sb.WriteString(" ")
+		}
+		return strings.TrimSpace(sb.String())
+	}
+
+	tests := []struct {
+		name string
+		file *derpMapFile
+		want string
+	}{
+		{"control", nil, "1 2 3"},
+		{"merge", &derpMapFile{Regions: map[int]*tailcfg.DERPRegion{900: region(900), 2: nil}}, "1 3 900"},
+		{"omit-default", &derpMapFile{OmitDefaultRegions: true, Regions: map[int]*tailcfg.DERPRegion{900: region(900)}}, "900"},
+	}
+	for _, tt := range tests {
+		got := effectiveDERPMap(control, tt.file)
+		if s := regions(got); s != tt.want {
+			t.Errorf("%s: regions = %q; want %q", tt.name, s, tt.want)
+		}
+	}
+	if s := regions(control); s != "1 2 3" {
+		t.Errorf("control map modified: %q", s)
+	}
+}
+
+func TestLoadDERPMapFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"ok", `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "900a", "RegionID": 900, "HostName": "derp.example.com"}]}}}`, false},
+		{"remove", `{"Regions": {"1": null}}`, false},
+		{"id-mismatch", `{"Regions": {"900": {"RegionID": 901, "Nodes": [{"Name": "901a"}]}}}`, true},
+		{"no-nodes", `{"Regions": {"900": {"RegionID": 900}}}`, true},
+		{"omit-everything", `{"OmitDefaultRegions": true}`, true},
+		{"bad-json", `{`, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		if err := ioutil.WriteFile(path, []byte(tt.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadDERPMapFile(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v; wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVirtualServiceTargets(t *testing.T) {
+	peer := func(name, ip string, tags ...string) *tailcfg.Node {
+		return &tailcfg.Node{
+			Name:      name + ".foo.ts.net.",
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip + "/32")},
+			Tags:      tags,
+		}
+	}
+	nm := &netmap.NetworkMap{
+		Name: "me.foo.ts.net.",
+		Peers: []*tailcfg.Node{
+			peer("db2", "100.64.0.2", "tag:db"),
+			peer("db1", "100.64.0.1", "tag:db"),
+			peer("web", "100.64.0.3", "tag:web"),
+			peer("cache", "100.64.0.4"),
+			{
+				// Asks for tag:db, but control didn't grant it.
+				Name:      "rogue.foo.ts.net.",
+				Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.5/32")},
+				Hostinfo:  tailcfg.Hostinfo{RequestTags: []string{"tag:db"}},
+			},
+		},
+	}
+	groups := ipn.PeerGroups{"caches": {"cache"}}
+	addr := netaddr.MustParseIPPort("127.0.0.1:5432")
+
+	tests := []struct {
+		backends []string
+		want     string
+	}{
+		{[]string{"tag:db"}, "db1=100.64.0.1:5432 db2=100.64.0.2:5432"},
+		{[]string{"group:caches", "web"}, "cache=100.64.0.4:5432 web=100.64.0.3:5432"},
+		{[]string{"100.64.0.2", "tag:nope"}, "db2=100.64.0.2:5432"},
+		{[]string{"group:nope"}, ""},
+	}
+	for _, tt := range tests {
+		vs := ipn.VirtualService{Name: "svc", Addr: addr, Backends: tt.backends}
+		var got []string
+		for _, tg := range virtualServiceTargets(vs, nm, groups) {
+			got = append(got, fmt.Sprintf("%s=%v", strings.TrimSuffix(tg.peer, ".foo.ts.net"), tg.addr))
+		}
+		if s := strings.Join(got, " "); s != tt.want {
+			t.Errorf("%q: targets = %q; want %q", tt.backends, s, tt.want)
+		}
+	}
+}
+
+func TestVirtualServiceForward(t *testing.T) {
+	// Each backend writes its name and hangs up.
+	backend := func(name string) netaddr.IPPort {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, name)
+				c.Close()
+			}
+		}()
+		return netaddr.MustParseIPPort(ln.Addr().String())
+	}
+	// down is an address nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := netaddr.MustParseIPPort(ln.Addr().String())
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &vservice{
+		logf:   t.Logf,
+		vs:     ipn.VirtualService{Name: "svc"},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.setBackends([]vsTarget{
+		{peer: "a", addr: backend("a")},
+		{peer: "b", addr: backend("b")},
+		{peer: "down", addr: down},
+	})
+	get := func() string {
+		c, sc := net.Pipe()
+		go s.forward(sc)
+		defer c.Close()
+		b, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, get())
+	}
+	// The third connection fails over from the down backend to the
+	// next one, after which the down one is skipped as unhealthy.
+	if s, want := strings.Join(got, ""), "abbaba"; s != want {
+		t.Errorf("round robin got %q; want %q", s, want)
+	}
+	for _, be := range s.status() {
+		if healthy := be.Peer != "down"; be.Healthy != healthy {
+			t.Errorf("backend %s: Healthy = %v; want %v", be.Peer, be.Healthy, healthy)
+		}
+	}
+
+	s.vs.Balance = ipn.BalanceLeastLatency
+	if got := get(); got != "a" && got != "b" {
+		t.Errorf("least latency got %q", got)
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	st := &ipnstate.Status{
+		MagicDNSSuffix: "example.ts.net",
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {DNSName: "a.example.ts.net.", HostName: "a", TailAddr: "100.64.0.1", PathType: "derp", Relay: "nyc",
+				LastWrite: now, LastHandshake: now},
+			{2}: {DNSName: "b.example.ts.net.", HostName: "b", TailAddr: "100.64.0.2", PathType: "direct",
+				LastWrite: now.Add(10 * time.Minute), LastHandshake: now.Add(-10 * time.Minute)},
+			{3}: {DNSName: "c.example.ts.net.", HostName: "c", TailAddr: "100.64.0.3", PathType: "direct",
+				LastWrite: now.Add(-time.Hour), LastHandshake: now.Add(-2 * time.Hour)},
+		},
+	}
+	rules := []ipn.AlertRule{
+		{Name: "relayed", Condition: ipn.AlertDERPOnly, Threshold: "10m", Peer: "a"},
+		{Name: "stale", Condition: ipn.AlertHandshakeAge, Threshold: "5m"},
+		{Name: "expiring", Condition: ipn.AlertKeyExpiry, Threshold: "72h"},
+	}
+	keyExpiry := now.Add(48 * time.Hour)
+
+	type evKey struct {
+		rule, subject string
+		firing        bool
+	}
+	check := func(name string, events []alertEvent, want ...evKey) {
+		t.Helper()
+		got := map[evKey]bool{}
+		for _, ev := range events {
+			got[evKey{ev.Rule, ev.Subject, ev.Firing}] = true
+		}
+		wantm := map[evKey]bool{}
+		for _, k := range want {
+			wantm[k] = true
+		}
+		if !reflect.DeepEqual(got, wantm) {
+			t.Errorf("%s: got %v; want %v", name, got, wantm)
+		}
+	}
+
+	a := newAlerter()
+	check("first", a.update(rules, st, keyExpiry, now),
+		evKey{"stale", "b.example.ts.net.", true},
+		evKey{"expiring", alertSelf, true})
+	check("unchanged", a.update(rules, st, keyExpiry, now.Add(5*time.Minute)))
+	check("derp-only threshold", a.update(rules, st, keyExpiry, now.Add(10*time.Minute)),
+		evKey{"relayed", "a.example.ts.net.", true})
+
+	st.Peer[key.Public{1}].PathType = "direct"
+	st.Peer[key.Public{2}].LastHandshake = now.Add(11 * time.Minute)
+	check("resolved", a.update(rules, st, now.Add(100*time.Hour), now.Add(11*time.Minute)),
+		evKey{"relayed", "a.example.ts.net.", false},
+		evKey{"stale", "b.example.ts.net.", false},
+		evKey{"expiring", alertSelf, false})
+}
+
+func TestNetworkConfigConfirmation(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	rcfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.1/32")},
+		Routes: []netaddr.IPPrefix{
+			pfx("100.64.0.2/32"),
+			pfx("10.0.0.0/8"),
+			pfx("fd7a:115c:a1e0::/48"),
+			pfx("0.0.0.0/0"),
+		},
+		DNS: dns.Config{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}, Proxied: true},
+	}
+	nc := networkConfigOf(rcfg)
+	want := &ipn.NetworkConfig{
+		Routes:      []netaddr.IPPrefix{pfx("0.0.0.0/0"), pfx("10.0.0.0/8")},
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		Proxied:     true,
+	}
+	if !nc.Equal(want) {
+		t.Errorf("networkConfigOf = %+v; want %+v", nc, want)
+	}
+
+	// Nothing accepted: only the routes to Tailscale IPs.
+	got := withNetworkConfig(rcfg, nil)
+	if wantRoutes := []netaddr.IPPrefix{pfx("100.64.0.2/32"), pfx("fd7a:115c:a1e0::/48")}; !reflect.DeepEqual(got.Routes, wantRoutes) {
+		t.Errorf("routes = %v; want %v", got.Routes, wantRoutes)
+	}
+	if !got.DNS.Equal(dns.Config{}) {
+		t.Errorf("DNS = %+v; want none", got.DNS)
+	}
+	if !reflect.DeepEqual(got.LocalAddrs, rcfg.LocalAddrs) {
+		t.Errorf("LocalAddrs = %v; want %v", got.LocalAddrs, rcfg.LocalAddrs)
+	}
+
+	// An earlier accepted config replaces the new one's.
+	accepted := &ipn.NetworkConfig{Routes: []netaddr.IPPrefix{pfx("192.168.0.0/24")}, Domains: []string{"corp.example.com"}}
+	got = withNetworkConfig(rcfg, accepted)
+	if !networkConfigOf(got).Equal(accepted) {
+		t.Errorf("got %+v; want %+v", networkConfigOf(got), accepted)
+	}
+	if len(rcfg.Routes) != 4 {
+		t.Errorf("withNetworkConfig modified its argument")
+	}
+}
+
+func TestStoredPrefs(t *testing.T) {
+	p := ipn.NewPrefs()
+	p.Hostname = "ci-1"
+	p.Persist = &persist.Persist{LoginName: "ci@example.com"}
+
+	got, err := ipn.PrefsFromBytes(storedPrefs(p), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(p) {
+		t.Errorf("non-ephemeral prefs changed: got %v; want %v", got.Pretty(), p.Pretty())
+	}
+
+	p.Ephemeral = true
+	got, err = ipn.PrefsFromBytes(storedPrefs(p), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Persist != nil {
+		t.Errorf("ephemeral node's Persist was stored: %v", got.Persist)
+	}
+	if !got.Ephemeral || got.Hostname != "ci-1" {
+		t.Errorf("ephemeral node's other prefs not stored: %v", got.Pretty())
+	}
+	if p.Persist == nil {
+		t.Errorf("storedPrefs modified its argument")
+	}
+}
+
+func TestAppConnectorMatch(t *testing.T) {
+	domains := []string{"example.com", "*.example.net"}
+	tests := []struct {
+		name, want string
+	}{
+		{"example.com.", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"www.example.com.", ""},
+		{"www.example.net.", "*.example.net"},
+		{"a.b.example.net", "*.example.net"},
+		{"example.net.", ""},
+		{"badexample.net.", ""},
+	}
+	for _, tt := range tests {
+		if got := appConnectorMatch(domains, tt.name); got != tt.want {
+			t.Errorf("appConnectorMatch(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppConnectorAnswer(t *testing.T) {
+	response := func(name string, rcode dnsmessage.RCode) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: rcode})
+		q := dnsmessage.MustNewName(name)
+		cname := dnsmessage.MustNewName("cdn.example.org.")
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: q, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		b.StartAnswers()
+		b.CNAMEResource(dnsmessage.ResourceHeader{Name: q, Class: dnsmessage.ClassINET}, dnsmessage.CNAMEResource{CNAME: cname})
+		b.AResource(dnsmessage.ResourceHeader{Name: cname, Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}})
+		b.AAAAResource(dnsmessage.ResourceHeader{Name: cname, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 15: 1}})
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	domains := []string{"example.com"}
+
+	domain, ips, ttl := appConnectorAnswer(domains, response("example.com.", dnsmessage.RCodeSuccess))
+	want := []netaddr.IP{netaddr.IPv4(1, 2, 3, 4), netaddr.MustParseIP("2001::1")}
+	if domain != "example.com" || !reflect.DeepEqual(ips, want) || ttl != 300*time.Second {
+		t.Errorf("got %q, %v, %v; want %q, %v, 5m", domain, ips, ttl, "example.com", want)
+	}
+	if domain, _, _ := appConnectorAnswer(domains, response("example.org.", dnsmessage.RCodeSuccess)); domain != "" {
+		t.Errorf("other domain matched %q", domain)
+	}
+	if domain, _, _ := appConnectorAnswer(domains, response("example.com.", dnsmessage.RCodeServerFailure)); domain != "" {
+		t.Errorf("failed response matched %q", domain)
+	}
+}
+
+func TestAppRoutesExpireAndCap(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+
+	domains := []string{"example.com", "*.example.net"}
+	lb.mu.Lock()
+	lb.prefs = ipn.NewPrefs()
+	lb.prefs.WantRunning = true
+	lb.prefs.AppConnectorDomains = domains
+	lb.hostinfo = &tailcfg.Hostinfo{}
+	lb.blocked = true // keep authReconfig from reconfiguring the fake engine
+	lb.netMap = &netmap.NetworkMap{}
+	lb.appDomains = domains // as if already started, so no resolving happens
+	lb.mu.Unlock()
+
+	advertised := func() int {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return len(lb.hostinfo.RoutableIPs)
+	}
+
+	ip := func(i int) netaddr.IP { return netaddr.IPv4(192, 0, byte(i>>8), byte(i)) }
+	lb.advertiseAppRoutes("example.com", []netaddr.IP{ip(1), ip(2)}, time.Minute)
+	lb.advertiseAppRoutes("example.com", []netaddr.IP{ip(2)}, 3*time.Hour)
+	lb.advertiseAppRoutes("example.org", []netaddr.IP{ip(3)}, time.Minute)
+	if got := advertised(); got != 2 {
+		t.Fatalf("advertising %d routes; want 2", got)
+	}
+
+	// A short TTL still keeps a route for appRouteMinLifetime.
+	lb.expireAppRoutes(time.Now().Add(appRouteMinLifetime / 2))
+	if got := advertised(); got != 2 {
+		t.Errorf("advertising %d routes before any expired; want 2", got)
+	}
+	lb.expireAppRoutes(time.Now().Add(2 * appRouteMinLifetime))
+	if got := advertised(); got != 1 {
+		t.Errorf("advertising %d routes after the short-lived one expired; want 1", got)
+	}
+
+	// Past maxAppRoutes, the routes expiring soonest make way.
+	var many []netaddr.IP
+	for i := 10; i < 10+maxAppRoutes; i++ {
+		many = append(many, ip(i))
+	}
+	lb.advertiseAppRoutes("*.example.net", many, 0)
+	if got := advertised(); got != maxAppRoutes {
+		t.Errorf("advertising %d routes; want the cap of %d", got, maxAppRoutes)
+	}
+	lb.mu.Lock()
+	_, keptLongLived := lb.appRoutes[ip(2)]
+	_, keptLast := lb.appRoutes[ip(9+maxAppRoutes)]
+	lb.mu.Unlock()
+	if !keptLongLived || !keptLast {
+		t.Errorf("kept long-lived route: %v, newest route: %v; want both", keptLongLived, keptLast)
+	}
+}
+
+func TestAppConnectorDNSRoutes(t *testing.T) {
+	self := netaddr.MustParseIPPrefix("100.64.0.1/32")
+	connector := func(id tailcfg.NodeID, ip string, domains ...string) *tailcfg.Node {
+		return &tailcfg.Node{
+			ID:        id,
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip + "/32")},
+			Hostinfo: tailcfg.Hostinfo{
+				Services:            []tailcfg.Service{{Proto: tailcfg.PeerAPI4, Port: 1234}},
+				AppConnectorDomains: domains,
+			},
+		}
+	}
+	nm := &netmap.NetworkMap{
+		Addresses: []netaddr.IPPrefix{self},
+		Peers: []*tailcfg.Node{
+			{ID: 2, Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32")}},
+			connector(3, "100.64.0.3", "example.com", "*.example.net"),
+			connector(4, "100.64.0.4", "example.com", "example.org"),
+		},
+	}
+	got := appConnectorDNSRoutes(nm)
+	want := map[string]string{
+		"example.com":   "http://100.64.0.3:1234/v0/dns-query",
+		"*.example.net": "http://100.64.0.3:1234/v0/dns-query",
+		"example.org":   "http://100.64.0.4:1234/v0/dns-query",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("appConnectorDNSRoutes = %v; want %v", got, want)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	store := &ipn.MemoryStore{}
+	b := &LocalBackend{logf: t.Logf, store: store}
+
+	lp, err := b.Profiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.LoginProfiles{Current: ipn.DefaultProfileName, Profiles: []string{ipn.DefaultProfileName}}
+	if !reflect.DeepEqual(lp, want) {
+		t.Errorf("initial profiles = %+v; want %+v", lp, want)
+	}
+
+	if err := b.DeleteProfile("work"); err != errNoBackendState {
+		t.Errorf("DeleteProfile without state key = %v; want errNoBackendState", err)
+	}
+
+	b.stateKey = "_daemon"
+	b.mu.Lock()
+	err = b.saveProfilesLocked(&ipn.LoginProfiles{Current: "default", Profiles: []string{"default", "work"}})
+	b.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := ipn.NewPrefs()
+	work.Persist = &persist.Persist{LoginName: "me@work"}
+	if err := store.WriteState(ipn.ProfileStateKey("work"), work.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.DeleteProfile("default"); err == nil {
+		t.Error("deleting the current profile succeeded")
+	}
+	if err := b.DeleteProfile("nope"); err == nil {
+		t.Error("deleting a missing profile succeeded")
+	}
+	if err := b.DeleteProfile("work"); err != nil {
+		t.Fatalf("DeleteProfile(work): %v", err)
+	}
+	lp, err = b.Profiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lp.Profiles, []string{"default"}) {
+		t.Errorf("profiles after delete = %q", lp.Profiles)
+	}
+	bs, err := store.ReadState(ipn.ProfileStateKey("work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ipn.PrefsFromBytes(bs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Persist != nil && p.Persist.LoginName != "" {
+		t.Errorf("deleted profile still has login %q", p.Persist.LoginName)
+	}
+}
+
+type fakeSSHServer struct{}
+
+func (fakeSSHServer) HandleSSHConn(c net.Conn) error { return c.Close() }
+
+func TestSetPrefsEnablesSSH(t *testing.T) {
+	oldNew := newSSHServer
+	defer func() { newSSHServer = oldNew }()
+	hostKeys := make(chan []byte, 1)
+	newSSHServer = func(logf logger.Logf, lb *LocalBackend, hostKeyPEM []byte) (SSHServer, error) {
+		hostKeys <- hostKeyPEM
+		return fakeSSHServer{}, nil
+	}
+
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+
+	lb.mu.Lock()
+	lb.prefs = ipn.NewPrefs()
+	lb.prefs.WantRunning = true
+	lb.hostinfo = &tailcfg.Hostinfo{}
+	lb.blocked = true // keep authReconfig from reconfiguring the fake engine
+	lb.netMap = &netmap.NetworkMap{
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("127.0.0.1/32")},
+	}
+	lb.mu.Unlock()
+
+	p := ipn.NewPrefs()
+	p.WantRunning = true
+	p.RunSSH = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.SetPrefs(p)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("SetPrefs with RunSSH deadlocked")
+	}
+
+	select {
+	case key := <-hostKeys:
+		if !strings.Contains(string(key), "PRIVATE KEY") {
+			t.Errorf("host key = %q; want a PEM private key", key)
+		}
+	default:
+		t.Fatal("SSH server not created")
+	}
+	lb.mu.Lock()
+	srv := lb.sshServer
+	lb.mu.Unlock()
+	if srv == nil {
+		t.Error("backend has no SSH server after enabling RunSSH")
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wake := make(chan struct{})
+	calls := make(chan time.Time, 10)
+	go debounce(ctx, wake, 50*time.Millisecond, func() { calls <- time.Now() })
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wake <- struct{}{}
+	}
+	select {
+	case at := <-calls:
+		if d := at.Sub(start); d < 50*time.Millisecond {
+			t.Errorf("called after %v; want at least the debounce delay", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("debounced func not called")
+	}
+	select {
+	case <-calls:
+		t.Fatal("burst of wakes caused more than one call")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	wake <- struct{}{}
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("debounced func not called for a later wake")
+	}
+}
+
+func TestUpdateHealthSummary(t *testing.T) {
+	expiry := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	old := &tailcfg.HealthSummary{Warnings: len(health.Warnings()), KeyExpiry: expiry, Updated: time.Unix(1, 0)}
+	b := &LocalBackend{
+		logf:     t.Logf,
+		netMap:   &netmap.NetworkMap{Expiry: expiry},
+		hostinfo: &tailcfg.Hostinfo{Health: old},
+	}
+
+	b.updateHealthSummary()
+	if b.hostinfo.Health != old {
+		t.Errorf("summary replaced though nothing changed: %+v", b.hostinfo.Health)
+	}
+
+	b.netMap = &netmap.NetworkMap{Expiry: expiry.Add(time.Hour)}
+	b.updateHealthSummary()
+	if got := b.hostinfo.Health; got == old || !got.KeyExpiry.Equal(expiry.Add(time.Hour)) {
+		t.Errorf("summary not updated for new key expiry: %+v", got)
+	}
+	if old.KeyExpiry != expiry {
+		t.Error("previous Hostinfo modified in place")
+	}
+}
+
+func TestEditPrefsConcurrent(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+
+	lb.mu.Lock()
+	lb.prefs = ipn.NewPrefs()
+	lb.hostinfo = &tailcfg.Hostinfo{}
+	lb.blocked = true // keep authReconfig from reconfiguring the fake engine
+	lb.mu.Unlock()
+
+	// Edits of different prefs mustn't undo each other, however
+	// they interleave.
+	for i := 0; i < 20; i++ {
+		hostname := fmt.Sprintf("host%d", i)
+		shieldsUp := i%2 == 0
+		done := make(chan error, 2)
+		go func() {
+			_, err := lb.EditPrefs(&ipn.MaskedPrefs{Prefs: ipn.Prefs{Hostname: hostname}, HostnameSet: true})
+			done <- err
+		}()
+		go func() {
+			_, err := lb.EditPrefs(&ipn.MaskedPrefs{Prefs: ipn.Prefs{ShieldsUp: shieldsUp}, ShieldsUpSet: true})
+			done <- err
+		}()
+		for j := 0; j < 2; j++ {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if p := lb.Prefs(); p.Hostname != hostname || p.ShieldsUp != shieldsUp {
+			t.Fatalf("round %d: hostname=%q, shields up=%v; want %q, %v", i, p.Hostname, p.ShieldsUp, hostname, shieldsUp)
+		}
+	}
+}
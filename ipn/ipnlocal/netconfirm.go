@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/router/dns"
+)
+
+// netConfirmStateKey returns the StateKey under which the network
+// configuration accepted for key is saved.
+func netConfirmStateKey(key ipn.StateKey) ipn.StateKey {
+	return "_netconfirm-" + key
+}
+
+// isTailscaleIPRoute reports whether r is a route to Tailscale IPs,
+// which never needs confirming.
+func isTailscaleIPRoute(r netaddr.IPPrefix) bool {
+	return tsaddr.CGNATRange().Contains(r.IP) && r.Bits >= tsaddr.CGNATRange().Bits ||
+		tsaddr.TailscaleULARange().Contains(r.IP) && r.Bits >= tsaddr.TailscaleULARange().Bits
+}
+
+// networkConfigOf returns the part of rcfg that the
+// ConfirmNetworkChanges pref holds for confirmation.
+func networkConfigOf(rcfg *router.Config) *ipn.NetworkConfig {
+	nc := &ipn.NetworkConfig{
+		Nameservers: rcfg.DNS.Nameservers,
+		Domains:     rcfg.DNS.Domains,
+		PerDomain:   rcfg.DNS.PerDomain,
+		Proxied:     rcfg.DNS.Proxied,
+	}
+	for _, r := range rcfg.Routes {
+		if !isTailscaleIPRoute(r) {
+			nc.Routes = append(nc.Routes, r)
+		}
+	}
+	sort.Slice(nc.Routes, func(i, j int) bool {
+		if nc.Routes[i].IP != nc.Routes[j].IP {
+			return nc.Routes[i].IP.Less(nc.Routes[j].IP)
+		}
+		return nc.Routes[i].Bits < nc.Routes[j].Bits
+	})
+	return nc
+}
+
+// withNetworkConfig returns a copy of rcfg with nc's routes and DNS in
+// place of its own.
+func withNetworkConfig(rcfg *router.Config, nc *ipn.NetworkConfig) *router.Config {
+	ret := *rcfg
+	ret.Routes = nil
+	for _, r := range rcfg.Routes {
+		if isTailscaleIPRoute(r) {
+			ret.Routes = append(ret.Routes, r)
+		}
+	}
+	ret.DNS = dns.Config{}
+	if nc != nil {
+		ret.Routes = append(ret.Routes, nc.Routes...)
+		ret.DNS = dns.Config{
+			Nameservers: nc.Nameservers,
+			Domains:     nc.Domains,
+			PerDomain:   nc.PerDomain,
+			Proxied:     nc.Proxied,
+		}
+	}
+	return &ret
+}
+
+// confirmNetworkConfig returns the router config to apply in place of
+// rcfg. Without the ConfirmNetworkChanges pref, that's rcfg. With it,
+// rcfg's routes and DNS are only used if the user accepted them;
+// otherwise they're held as pending and the accepted ones are used.
+func (b *LocalBackend) confirmNetworkConfig(prefs *ipn.Prefs, rcfg *router.Config) *router.Config {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !prefs.ConfirmNetworkChanges {
+		b.pendingNet = nil
+		health.SetNetworkChangesHealth(nil)
+		return rcfg
+	}
+	accepted := b.acceptedNetworkConfigLocked()
+	want := networkConfigOf(rcfg)
+	if want.Equal(accepted) {
+		b.pendingNet = nil
+		health.SetNetworkChangesHealth(nil)
+		return rcfg
+	}
+	if !want.Equal(b.pendingNet) {
+		b.pendingNet = want
+		b.logf("network changes from the tailnet are waiting to be accepted: routes=%v dns=%v", want.Routes, want.Nameservers)
+	}
+	health.SetNetworkChangesHealth(errors.New(`routes or DNS changed by the tailnet are waiting to be accepted; see "tailscale netchanges"`))
+	return withNetworkConfig(rcfg, accepted)
+}
+
+// acceptedNetworkConfigLocked returns the network config the user
+// accepted last, loading it from the state store the first time. It
+// returns nil if none was accepted.
+//
+// b.mu must be held.
+func (b *LocalBackend) acceptedNetworkConfigLocked() *ipn.NetworkConfig {
+	if b.acceptedNetLoaded || b.stateKey == "" {
+		return b.acceptedNet
+	}
+	b.acceptedNetLoaded = true
+	j, err := b.store.ReadState(netConfirmStateKey(b.stateKey))
+	if err != nil {
+		if err != ipn.ErrStateNotExist {
+			b.logf("reading accepted network config: %v", err)
+		}
+		return nil
+	}
+	nc := new(ipn.NetworkConfig)
+	if err := json.Unmarshal(j, nc); err != nil {
+		b.logf("reading accepted network config: %v", err)
+		return nil
+	}
+	b.acceptedNet = nc
+	return nc
+}
+
+// NetworkChanges returns the accepted network config and any pending
+// change to it, for the ConfirmNetworkChanges pref.
+func (b *LocalBackend) NetworkChanges() *ipn.NetworkChanges {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &ipn.NetworkChanges{
+		Accepted: b.acceptedNetworkConfigLocked(),
+		Pending:  b.pendingNet,
+	}
+}
+
+// AcceptNetworkChanges applies the pending network config change,
+// which must be want (so the user accepts exactly what they were
+// shown), and remembers it as accepted.
+func (b *LocalBackend) AcceptNetworkChanges(want *ipn.NetworkConfig) error {
+	b.mu.Lock()
+	pending := b.pendingNet
+	if pending == nil {
+		b.mu.Unlock()
+		return errors.New("no network changes are waiting to be accepted")
+	}
+	if !pending.Equal(want) {
+		b.mu.Unlock()
+		return errors.New("the pending network changes changed; review them again")
+	}
+	b.acceptedNet = pending
+	b.acceptedNetLoaded = true
+	b.pendingNet = nil
+	stateKey := b.stateKey
+	b.mu.Unlock()
+
+	if stateKey != "" {
+		j, err := json.Marshal(pending)
+		if err != nil {
+			return err
+		}
+		if err := b.store.WriteState(netConfirmStateKey(stateKey), j); err != nil {
+			return fmt.Errorf("saving accepted network config: %w", err)
+		}
+	}
+	b.logf("network changes accepted: routes=%v dns=%v", pending.Routes, pending.Nameservers)
+	b.authReconfig()
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tailscale.com/ipn"
+)
+
+// NetworkLocations returns the prefs to apply on particular
+// networks, and the ID of the current one.
+func (b *LocalBackend) NetworkLocations() (*ipn.NetworkLocations, error) {
+	id := b.e.GetLinkMonitor().NetworkID()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prefs, err := b.loadNetworkLocationsLocked()
+	if err != nil {
+		return nil, err
+	}
+	return &ipn.NetworkLocations{Current: id, Prefs: prefs}, nil
+}
+
+func (b *LocalBackend) loadNetworkLocationsLocked() (map[string]ipn.LocationPrefs, error) {
+	bs, err := b.store.ReadState(ipn.NetworkLocationsStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return map[string]ipn.LocationPrefs{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefs := map[string]ipn.LocationPrefs{}
+	if err := json.Unmarshal(bs, &prefs); err != nil {
+		return nil, fmt.Errorf("invalid %s state: %w", ipn.NetworkLocationsStateKey, err)
+	}
+	return prefs, nil
+}
+
+// SaveNetworkLocation remembers the current exit node and shields up
+// prefs for the network with the given ID, or for the current
+// network if it's empty, to be applied whenever the machine joins
+// that network.
+func (b *LocalBackend) SaveNetworkLocation(network string) error {
+	return b.editNetworkLocation(network, true)
+}
+
+// DeleteNetworkLocation forgets the prefs for the network with the
+// given ID, or for the current network if it's empty.
+func (b *LocalBackend) DeleteNetworkLocation(network string) error {
+	return b.editNetworkLocation(network, false)
+}
+
+func (b *LocalBackend) editNetworkLocation(network string, save bool) error {
+	current := b.e.GetLinkMonitor().NetworkID()
+	if network == "" {
+		network = current
+	}
+	if network == "" {
+		return errors.New("can't identify the current network")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil {
+		return errors.New("no prefs")
+	}
+	prefs, err := b.loadNetworkLocationsLocked()
+	if err != nil {
+		return err
+	}
+	if save {
+		prefs[network] = ipn.LocationPrefsOf(b.prefs)
+		if network == current {
+			// The prefs already match; don't apply them again
+			// until the machine rejoins the network.
+			b.locationNetwork = current
+		}
+	} else {
+		if _, ok := prefs[network]; !ok {
+			return fmt.Errorf("no prefs saved for network %q", network)
+		}
+		delete(prefs, network)
+	}
+	bs, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	return b.store.WriteState(ipn.NetworkLocationsStateKey, bs)
+}
+
+// applyNetworkLocation applies the prefs saved for the current
+// network, if any, when the machine has joined a different network
+// since it last did so. Prefs the user changes while on a network
+// stick until the machine leaves it.
+func (b *LocalBackend) applyNetworkLocation() {
+	id := b.e.GetLinkMonitor().NetworkID()
+	b.mu.Lock()
+	if b.prefs == nil || id == b.locationNetwork {
+		b.mu.Unlock()
+		return
+	}
+	b.locationNetwork = id
+	prefs, err := b.loadNetworkLocationsLocked()
+	if err != nil {
+		b.mu.Unlock()
+		b.logf("network locations: %v", err)
+		return
+	}
+	lp, ok := prefs[id]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	newp := b.prefs.Clone()
+	changed := lp.ApplyTo(newp)
+	b.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	b.logf("joined network %q; applying its location prefs", id)
+	b.SetPrefs(newp)
+}
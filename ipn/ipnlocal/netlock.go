@@ -0,0 +1,347 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/netmap"
+)
+
+// debugTailnetLock enables the parts of tailnet lock that need the
+// control server: signing node keys with "tailscale lock init" and
+// "tailscale lock sign". They need a control server that accepts
+// signatures at /machine/<mkey>/tka/sign and hands them out in
+// tailcfg.Node.KeySignature, which no control server does yet.
+var debugTailnetLock, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_TAILNET_LOCK"))
+
+var errNetworkLockUnsupported = errors.New("tailnet lock needs a control server that distributes node key signatures; set TS_DEBUG_TAILNET_LOCK=1 in tailscaled's environment to use one that does")
+
+// networkLockStateKey returns the StateKey under which the tailnet
+// lock state of key is saved.
+func networkLockStateKey(key ipn.StateKey) ipn.StateKey {
+	return "_network-lock-" + key
+}
+
+// networkLockState is the saved tailnet lock state of a login.
+type networkLockState struct {
+	// Authority is the set of trusted signing keys. Tailnet lock
+	// is enabled if there are any.
+	Authority tka.Authority
+
+	// SigningKey is this node's signing key, if it has one.
+	SigningKey *tka.PrivateKey `json:",omitempty"`
+}
+
+func (st *networkLockState) enabled() bool { return len(st.Authority.Keys) > 0 }
+
+// loadNetworkLockLocked returns the tailnet lock state of the current
+// login, reading it from the store the first time.
+func (b *LocalBackend) loadNetworkLockLocked() (*networkLockState, error) {
+	if b.netLock != nil && b.netLockKey == b.stateKey {
+		return b.netLock, nil
+	}
+	key := networkLockStateKey(b.stateKey)
+	st := new(networkLockState)
+	bs, err := b.store.ReadState(key)
+	switch {
+	case errors.Is(err, ipn.ErrStateNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(bs, st); err != nil {
+			return nil, fmt.Errorf("invalid %s state: %w", key, err)
+		}
+	}
+	b.netLock, b.netLockKey = st, b.stateKey
+	return st, nil
+}
+
+func (b *LocalBackend) saveNetworkLockLocked(st *networkLockState) error {
+	bs, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := b.store.WriteState(networkLockStateKey(b.stateKey), bs); err != nil {
+		return err
+	}
+	b.netLock, b.netLockKey = st, b.stateKey
+	return nil
+}
+
+// networkLockFilterLocked returns nm without the peers whose node keys
+// aren't signed by a trusted key, if tailnet lock is enabled. It
+// remembers the peers it dropped for NetworkLockStatus.
+func (b *LocalBackend) networkLockFilterLocked(nm *netmap.NetworkMap) *netmap.NetworkMap {
+	if nm == nil {
+		return nil
+	}
+	var verify func(*tailcfg.Node) error
+	st, err := b.loadNetworkLockLocked()
+	b.netLockPeers = nm.Peers
+	switch {
+	case err != nil:
+		// Without the trusted keys there's no telling which
+		// peers are genuine, so trust none of them.
+		b.logf("network-lock: %v", err)
+		verify = func(*tailcfg.Node) error { return err }
+	case st.enabled():
+		verify = func(p *tailcfg.Node) error { return st.Authority.VerifyNodeKey(p.Key, p.KeySignature) }
+	default:
+		b.netLockFiltered = nil
+		return nm
+	}
+
+	var filtered []*ipnstate.LockedOutPeer
+	peers := make([]*tailcfg.Node, 0, len(nm.Peers))
+	for _, p := range nm.Peers {
+		if err := verify(p); err != nil {
+			filtered = append(filtered, &ipnstate.LockedOutPeer{
+				Name:    p.Name,
+				NodeKey: p.Key,
+				Error:   err.Error(),
+			})
+			continue
+		}
+		peers = append(peers, p)
+	}
+	if len(filtered) != len(b.netLockFiltered) {
+		b.logf("network-lock: ignoring %d of %d peers without a trusted signature", len(filtered), len(nm.Peers))
+	}
+	b.netLockFiltered = filtered
+	if len(filtered) == 0 {
+		return nm
+	}
+	nm2 := *nm
+	nm2.Peers = peers
+	return &nm2
+}
+
+// NetworkLockStatus returns the state of tailnet lock on this node.
+func (b *LocalBackend) NetworkLockStatus() (*ipnstate.NetworkLockStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, err := b.loadNetworkLockLocked()
+	if err != nil {
+		return nil, err
+	}
+	s := &ipnstate.NetworkLockStatus{
+		Enabled:       st.enabled(),
+		TrustedKeys:   append([]tka.PublicKey(nil), st.Authority.Keys...),
+		FilteredPeers: b.netLockFiltered,
+	}
+	if st.SigningKey != nil {
+		pub := st.SigningKey.Public()
+		s.PublicKey = &pub
+	}
+	if nm := b.netMap; nm != nil {
+		s.NodeKey = nm.NodeKey
+		if s.Enabled && nm.SelfNode != nil {
+			s.NodeKeySigned = st.Authority.VerifyNodeKey(nm.NodeKey, nm.SelfNode.KeySignature) == nil
+		}
+	}
+	return s, nil
+}
+
+// NetworkLockInit enables tailnet lock on this node. It trusts a new
+// signing key for this node, along with the signing keys of other
+// nodes in trusted, and signs this node's own node key.
+//
+// From then on, peers are ignored unless their node keys are signed
+// by a trusted key. Tailnet lock is only enabled once control has
+// accepted the signature of this node's key, so that a failure leaves
+// the node talking to its peers as before.
+func (b *LocalBackend) NetworkLockInit(ctx context.Context, trusted []tka.PublicKey) error {
+	if !debugTailnetLock {
+		return errNetworkLockUnsupported
+	}
+	b.mu.Lock()
+	st, err := b.loadNetworkLockLocked()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if st.enabled() {
+		b.mu.Unlock()
+		return errors.New("tailnet lock is already enabled")
+	}
+	key := st.SigningKey
+	if key == nil {
+		k, err := tka.NewPrivateKey()
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		key = &k
+		// Saving the signing key alone leaves tailnet lock off,
+		// and keeps the key the same if signing fails and the
+		// user tries again.
+		if err := b.saveNetworkLockLocked(&networkLockState{SigningKey: key}); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	stateKey := b.stateKey
+	nm := b.netMap
+	b.mu.Unlock()
+
+	if nm == nil {
+		return errors.New("not logged in; this node's key must be signed before tailnet lock can be enabled")
+	}
+	if err := b.submitNodeKeySignature(ctx, key, nm.NodeKey); err != nil {
+		return fmt.Errorf("signing this node's key: %w", err)
+	}
+
+	ns := &networkLockState{SigningKey: key}
+	ns.Authority.Add(key.Public())
+	for _, k := range trusted {
+		ns.Authority.Add(k)
+	}
+	b.mu.Lock()
+	if b.stateKey != stateKey {
+		b.mu.Unlock()
+		return errors.New("login changed while enabling tailnet lock")
+	}
+	if err := b.saveNetworkLockLocked(ns); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Unlock()
+
+	b.logf("network-lock: enabled, trusting %d keys", len(ns.Authority.Keys))
+	b.networkLockRefilter()
+	return nil
+}
+
+// NetworkLockSign signs the node key nk with this node's signing key,
+// and sends the signature to the control server to distribute to the
+// tailnet's nodes.
+func (b *LocalBackend) NetworkLockSign(ctx context.Context, nk tailcfg.NodeKey) error {
+	if !debugTailnetLock {
+		return errNetworkLockUnsupported
+	}
+	b.mu.Lock()
+	st, err := b.loadNetworkLockLocked()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if st.SigningKey == nil {
+		return errors.New("this node has no signing key; see \"tailscale lock init\"")
+	}
+	return b.submitNodeKeySignature(ctx, st.SigningKey, nk)
+}
+
+// submitNodeKeySignature signs nk with key and sends the signature to
+// the control server.
+func (b *LocalBackend) submitNodeKeySignature(ctx context.Context, key *tka.PrivateKey, nk tailcfg.NodeKey) error {
+	b.mu.Lock()
+	cc := b.c
+	b.mu.Unlock()
+	if cc == nil {
+		return errors.New("not connected to control server")
+	}
+	return cc.SubmitTKASignature(ctx, nk, key.SignNodeKey(nk))
+}
+
+// NetworkLockModify trusts the signing keys in add and stops trusting
+// those in remove. Tailnet lock must already be enabled, and at least
+// one key must remain trusted; use NetworkLockDisable to trust none.
+//
+// The trusted keys are per node: other locked nodes keep trusting
+// what they did until the same change is made on them.
+func (b *LocalBackend) NetworkLockModify(add, remove []tka.PublicKey) error {
+	b.mu.Lock()
+	st, err := b.loadNetworkLockLocked()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if !st.enabled() {
+		b.mu.Unlock()
+		return errors.New("tailnet lock is not enabled; see \"tailscale lock init\"")
+	}
+	ns := &networkLockState{SigningKey: st.SigningKey}
+	ns.Authority.Keys = append(ns.Authority.Keys, st.Authority.Keys...)
+	for _, k := range add {
+		ns.Authority.Add(k)
+	}
+	for _, k := range remove {
+		if !ns.Authority.Remove(k) {
+			b.mu.Unlock()
+			return fmt.Errorf("signing key %v is not trusted", k)
+		}
+	}
+	if !ns.enabled() {
+		b.mu.Unlock()
+		return errors.New("can't remove every trusted key; use \"tailscale lock disable\" to turn tailnet lock off")
+	}
+	if err := b.saveNetworkLockLocked(ns); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Unlock()
+
+	b.logf("network-lock: now trusting %d keys", len(ns.Authority.Keys))
+	b.networkLockRefilter()
+	return nil
+}
+
+// NetworkLockDisable turns tailnet lock off on this node, forgetting
+// its trusted keys. The node keeps its own signing key, which a later
+// NetworkLockInit reuses.
+func (b *LocalBackend) NetworkLockDisable() error {
+	b.mu.Lock()
+	st, err := b.loadNetworkLockLocked()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if !st.enabled() {
+		b.mu.Unlock()
+		return nil
+	}
+	if err := b.saveNetworkLockLocked(&networkLockState{SigningKey: st.SigningKey}); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Unlock()
+
+	b.logf("network-lock: disabled")
+	b.networkLockRefilter()
+	return nil
+}
+
+// networkLockRefilter applies the current trusted keys to the current
+// netmap now, rather than waiting for the next one from control.
+// Peers that were dropped from it are considered again.
+func (b *LocalBackend) networkLockRefilter() {
+	b.mu.Lock()
+	if b.netMap == nil {
+		b.mu.Unlock()
+		return
+	}
+	nm := *b.netMap
+	nm.Peers = b.netLockPeers
+	nmf := b.networkLockFilterLocked(&nm)
+	b.setNetMapLocked(nmf)
+	prefs := b.prefs
+	appRoutes := b.appRoutesLocked()
+	b.mu.Unlock()
+
+	b.updateFilter(nmf, prefs, appRoutes)
+	b.e.SetNetworkMap(nmf)
+	b.send(ipn.Notify{NetMap: nmf})
+	b.authReconfig()
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func newNetworkLockBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Shutdown)
+
+	lb.mu.Lock()
+	lb.prefs = ipn.NewPrefs()
+	lb.blocked = true // keep authReconfig from reconfiguring the fake engine
+	lb.mu.Unlock()
+	return lb
+}
+
+func mustSigningKey(t *testing.T) tka.PrivateKey {
+	t.Helper()
+	k, err := tka.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestNetworkLockInitNeedsControl(t *testing.T) {
+	old := debugTailnetLock
+	defer func() { debugTailnetLock = old }()
+
+	lb := newNetworkLockBackend(t)
+	lb.mu.Lock()
+	lb.setNetMapLocked(&netmap.NetworkMap{
+		NodeKey: tailcfg.NodeKey{1},
+		Peers:   []*tailcfg.Node{{ID: 2, Key: tailcfg.NodeKey{2}}},
+	})
+	lb.mu.Unlock()
+
+	debugTailnetLock = false
+	if err := lb.NetworkLockInit(context.Background(), nil); err != errNetworkLockUnsupported {
+		t.Fatalf("NetworkLockInit without TS_DEBUG_TAILNET_LOCK = %v; want %v", err, errNetworkLockUnsupported)
+	}
+	if err := lb.NetworkLockSign(context.Background(), tailcfg.NodeKey{2}); err != errNetworkLockUnsupported {
+		t.Fatalf("NetworkLockSign without TS_DEBUG_TAILNET_LOCK = %v; want %v", err, errNetworkLockUnsupported)
+	}
+
+	// With no control client, signing this node's key fails, which
+	// must leave tailnet lock off and the peers alone.
+	debugTailnetLock = true
+	if err := lb.NetworkLockInit(context.Background(), nil); err == nil {
+		t.Fatal("NetworkLockInit succeeded without a control client")
+	}
+	st, err := lb.NetworkLockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Enabled {
+		t.Error("tailnet lock enabled after signing failed")
+	}
+	if st.PublicKey == nil {
+		t.Error("signing key not kept for a retry")
+	}
+	if got := len(lb.NetMap().Peers); got != 1 {
+		t.Errorf("%d peers after failed init; want 1", got)
+	}
+}
+
+func TestNetworkLockRefilter(t *testing.T) {
+	lb := newNetworkLockBackend(t)
+	self, other := mustSigningKey(t), mustSigningKey(t)
+	signed := &tailcfg.Node{ID: 2, Key: tailcfg.NodeKey{2}}
+	signed.KeySignature = self.SignNodeKey(signed.Key)
+	otherSigned := &tailcfg.Node{ID: 3, Key: tailcfg.NodeKey{3}}
+	otherSigned.KeySignature = other.SignNodeKey(otherSigned.Key)
+
+	lb.mu.Lock()
+	st := &networkLockState{SigningKey: &self}
+	st.Authority.Add(self.Public())
+	if err := lb.saveNetworkLockLocked(st); err != nil {
+		t.Fatal(err)
+	}
+	nm := &netmap.NetworkMap{
+		NodeKey:   tailcfg.NodeKey{1},
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+		Peers:     []*tailcfg.Node{signed, otherSigned},
+	}
+	lb.setNetMapLocked(lb.networkLockFilterLocked(nm))
+	lb.mu.Unlock()
+
+	peerIDs := func() (ids []tailcfg.NodeID) {
+		for _, p := range lb.NetMap().Peers {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	if got := peerIDs(); len(got) != 1 || got[0] != signed.ID {
+		t.Fatalf("peers = %v; want only %v", got, signed.ID)
+	}
+
+	// A change made to the current netmap since, like this expiry,
+	// must survive refiltering.
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+	lb.mu.Lock()
+	nm2 := *lb.netMap
+	nm2.Expiry = expiry
+	lb.setNetMapLocked(&nm2)
+	lb.mu.Unlock()
+
+	if err := lb.NetworkLockModify([]tka.PublicKey{other.Public()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := peerIDs(); len(got) != 2 {
+		t.Errorf("after trusting the other key, peers = %v; want both", got)
+	}
+	if got := lb.NetMap().Expiry; !got.Equal(expiry) {
+		t.Errorf("expiry = %v after refilter; want %v", got, expiry)
+	}
+
+	if err := lb.NetworkLockModify(nil, []tka.PublicKey{self.Public()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := peerIDs(); len(got) != 1 || got[0] != otherSigned.ID {
+		t.Errorf("after removing this node's key, peers = %v; want only %v", got, otherSigned.ID)
+	}
+
+	if err := lb.NetworkLockDisable(); err != nil {
+		t.Fatal(err)
+	}
+	if got := peerIDs(); len(got) != 2 {
+		t.Errorf("after disabling, peers = %v; want both", got)
+	}
+
+	// After logout there's no netmap to refilter, and the peers
+	// from before mustn't come back.
+	lb.mu.Lock()
+	lb.setNetMapLocked(nil)
+	lb.mu.Unlock()
+	lb.networkLockRefilter()
+	if nm := lb.NetMap(); nm != nil {
+		t.Errorf("netmap = %v after refilter with none; want nil", nm)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// The peer API is an HTTP server that tailscaled runs on each of the
+// node's Tailscale IPs, for other nodes to use. Callers are
+// identified solely by their source Tailscale IP, which WireGuard
+// has already verified by the time a connection reaches the server.
+//
+// The server's port is chosen at random, and advertised to peers in
+// Hostinfo.Services with the PeerAPI4 and PeerAPI6 protocols.
+
+// peerAPIListener is the peer API server on one Tailscale IP.
+type peerAPIListener struct {
+	ip  netaddr.IP
+	srv *http.Server
+}
+
+// peerAPIHandler handles one peer API request.
+type peerAPIHandler struct {
+	b          *LocalBackend
+	remoteAddr netaddr.IPPort
+	peerNode   *tailcfg.Node
+	peerUser   tailcfg.UserProfile
+	isSelf     bool // peer is owned by the same user as this node
+}
+
+// updatePeerAPIListeners starts or stops the peer API servers on the
+// node's Tailscale IPs to match the current prefs and netmap, and
+// updates the advertised services if their ports changed.
+func (b *LocalBackend) updatePeerAPIListeners() {
+	b.mu.Lock()
+	want := map[netaddr.IP]bool{}
+	if b.prefs != nil && b.prefs.WantRunning && b.netMap != nil {
+		for _, pfx := range b.netMap.Addresses {
+			if pfx.IsSingleIP() {
+				want[pfx.IP] = true
+			}
+		}
+	}
+	oldSvcs := b.peerAPIServicesLocked()
+	for ip, pl := range b.peerAPIListeners {
+		if !want[ip] {
+			pl.srv.Close()
+			delete(b.peerAPIListeners, ip)
+		}
+	}
+	if b.peerAPIListeners == nil {
+		b.peerAPIListeners = map[netaddr.IP]*peerAPIListener{}
+	}
+	for ip := range want {
+		if _, ok := b.peerAPIListeners[ip]; ok {
+			continue
+		}
+		ln, err := b.listenPeerAPILocked(ip)
+		if err != nil {
+			b.logf("peerapi: can't listen on %v: %v", ip, err)
+			continue
+		}
+		b.logf("peerapi: serving on %v", ln.Addr())
+		pl := &peerAPIListener{ip: ip}
+		pl.srv = &http.Server{
+			Handler:  http.HandlerFunc(b.servePeerAPI),
+			ErrorLog: logger.StdLogger(logger.WithPrefix(b.logf, "peerapi: ")),
+		}
+		b.peerAPIListeners[ip] = pl
+		go pl.srv.Serve(ln)
+	}
+	changed := !servicesEqual(oldSvcs, b.peerAPIServicesLocked())
+	hi := b.hostinfo
+	b.mu.Unlock()
+
+	if changed && hi != nil {
+		b.doSetHostinfoFilterServices(hi)
+	}
+}
+
+// listenPeerAPILocked listens for the peer API on ip, using the same
+// port as on the node's other IPs if possible.
+func (b *LocalBackend) listenPeerAPILocked(ip netaddr.IP) (net.Listener, error) {
+	if b.peerAPIPort != 0 {
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(b.peerAPIPort))))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	if b.peerAPIPort == 0 {
+		b.peerAPIPort = uint16(ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ln, nil
+}
+
+// peerAPIServicesLocked returns the services advertising the peer API.
+func (b *LocalBackend) peerAPIServicesLocked() (ret []tailcfg.Service) {
+	for ip := range b.peerAPIListeners {
+		proto := tailcfg.PeerAPI4
+		if ip.Is6() {
+			proto = tailcfg.PeerAPI6
+		}
+		ret = append(ret, tailcfg.Service{Proto: proto, Port: b.peerAPIPort})
+	}
+	if len(ret) == 2 && ret[0].Proto > ret[1].Proto {
+		ret[0], ret[1] = ret[1], ret[0]
+	}
+	return ret
+}
+
+func servicesEqual(a, b []tailcfg.Service) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Proto != b[i].Proto || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *LocalBackend) closePeerAPIListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ip, pl := range b.peerAPIListeners {
+		pl.srv.Close()
+		delete(b.peerAPIListeners, ip)
+	}
+}
+
+// peerAPIBase returns the base URL of peer's peer API, or the empty
+// string if it doesn't advertise one on an address family this node
+// has.
+func peerAPIBase(nm *netmap.NetworkMap, peer *tailcfg.Node) string {
+	if nm == nil || peer == nil {
+		return ""
+	}
+	var have4, have6 bool
+	for _, pfx := range nm.Addresses {
+		if pfx.IsSingleIP() {
+			if pfx.IP.Is4() {
+				have4 = true
+			} else {
+				have6 = true
+			}
+		}
+	}
+	var port4, port6 uint16
+	for _, s := range peer.Hostinfo.Services {
+		switch s.Proto {
+		case tailcfg.PeerAPI4:
+			port4 = s.Port
+		case tailcfg.PeerAPI6:
+			port6 = s.Port
+		}
+	}
+	for _, pfx := range peer.Addresses {
+		if !pfx.IsSingleIP() {
+			continue
+		}
+		var port uint16
+		if pfx.IP.Is4() && have4 {
+			port = port4
+		} else if pfx.IP.Is6() && have6 {
+			port = port6
+		}
+		if port != 0 {
+			return "http://" + net.JoinHostPort(pfx.IP.String(), strconv.Itoa(int(port)))
+		}
+	}
+	return ""
+}
+
+func (b *LocalBackend) servePeerAPI(w http.ResponseWriter, r *http.Request) {
+	ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	n, u, ok := b.WhoIs(ipp)
+	if !ok {
+		b.logf("peerapi: unknown peer %v", ipp)
+		http.Error(w, "unknown peer", http.StatusForbidden)
+		return
+	}
+	h := &peerAPIHandler{
+		b:          b,
+		remoteAddr: ipp,
+		peerNode:   n,
+		peerUser:   u,
+	}
+	if self := b.SelfNode(); self != nil {
+		h.isSelf = self.User == n.User && n.Sharer.IsZero()
+	}
+	switch r.URL.Path {
+	case "/v0/hello":
+		h.serveHello(w, r)
+	case "/v0/goroutines":
+		h.serveGoroutines(w, r)
+	case "/v0/dns-query":
+		h.serveDNSQuery(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *peerAPIHandler) serveHello(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><h1>Hello, %s (%v)</h1>\n", html.EscapeString(h.peerUser.DisplayName), h.remoteAddr.IP)
+	fmt.Fprintf(w, "<p>You are %s, on node %s.</p>\n", html.EscapeString(h.peerUser.LoginName), html.EscapeString(h.peerNode.ComputedName))
+}
+
+func (h *peerAPIHandler) serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	if !h.isSelf {
+		http.Error(w, "not owner", http.StatusForbidden)
+		return
+	}
+	buf := make([]byte, 2<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf)
+}
+
+// maxPeerDNSQuerySize is the largest DNS query that serveDNSQuery
+// accepts, the most that fits in a TCP DNS message.
+const maxPeerDNSQuerySize = 65535
+
+// serveDNSQuery answers a DNS query message POSTed by a peer using
+// this node as its exit node or app connector, with the system's
+// resolvers, so that the peer's queries leave from here like its
+// other traffic does. An app connector learns routes to advertise
+// from the answers.
+func (h *peerAPIHandler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.b.advertisesExitNode() && !h.b.isAppConnector() {
+		http.Error(w, "not an exit node or app connector", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPeerDNSQuerySize+1))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(query) == 0 || len(query) > maxPeerDNSQuerySize {
+		http.Error(w, "invalid DNS message size", 400)
+		return
+	}
+	resp, err := tsdns.QuerySystem(r.Context(), h.b.e.GetNetnsBinding(), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.b.observeAppConnectorDNS(resp)
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
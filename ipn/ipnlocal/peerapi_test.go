@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestPeerAPIBase(t *testing.T) {
+	pfxs := func(ss ...string) (ret []netaddr.IPPrefix) {
+		for _, s := range ss {
+			ret = append(ret, netaddr.MustParseIPPrefix(s))
+		}
+		return ret
+	}
+	peer := &tailcfg.Node{
+		Addresses: pfxs("100.64.1.1/32", "fd7a:115c:a1e0::1/128"),
+		Hostinfo: tailcfg.Hostinfo{
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.TCP, Port: 22},
+				{Proto: tailcfg.PeerAPI4, Port: 444},
+				{Proto: tailcfg.PeerAPI6, Port: 666},
+			},
+		},
+	}
+	tests := []struct {
+		name string
+		self []netaddr.IPPrefix
+		peer *tailcfg.Node
+		want string
+	}{
+		{"v4", pfxs("100.64.1.2/32"), peer, "http://100.64.1.1:444"},
+		{"v6-only", pfxs("fd7a:115c:a1e0::2/128"), peer, "http://[fd7a:115c:a1e0::1]:666"},
+		{"no-peerapi", pfxs("100.64.1.2/32"), &tailcfg.Node{Addresses: pfxs("100.64.1.1/32")}, ""},
+		{"nil-peer", pfxs("100.64.1.2/32"), nil, ""},
+	}
+	for _, tt := range tests {
+		got := peerAPIBase(&netmap.NetworkMap{Addresses: tt.self}, tt.peer)
+		if got != tt.want {
+			t.Errorf("%s: peerAPIBase = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExitNodeDNSURL(t *testing.T) {
+	exit := &tailcfg.Node{
+		StableID:  "exit",
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.1.1/32")},
+		Hostinfo: tailcfg.Hostinfo{
+			Services: []tailcfg.Service{{Proto: tailcfg.PeerAPI4, Port: 444}},
+		},
+	}
+	nm := &netmap.NetworkMap{
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.1.2/32")},
+		Peers:     []*tailcfg.Node{exit},
+	}
+	tests := []struct {
+		id   tailcfg.StableNodeID
+		want string
+	}{
+		{"exit", "http://100.64.1.1:444/v0/dns-query"},
+		{"", ""},
+		{"other", ""},
+	}
+	for _, tt := range tests {
+		if got := exitNodeDNSURL(nm, tt.id); got != tt.want {
+			t.Errorf("exitNodeDNSURL(%q) = %q; want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tailscale.com/ipn"
+)
+
+// PeerGroups returns the user's locally defined peer groups.
+func (b *LocalBackend) PeerGroups() (ipn.PeerGroups, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loadPeerGroupsLocked()
+}
+
+func (b *LocalBackend) loadPeerGroupsLocked() (ipn.PeerGroups, error) {
+	bs, err := b.store.ReadState(ipn.PeerGroupsStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return ipn.PeerGroups{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups := ipn.PeerGroups{}
+	if err := json.Unmarshal(bs, &groups); err != nil {
+		return nil, fmt.Errorf("invalid %s state: %w", ipn.PeerGroupsStateKey, err)
+	}
+	return groups, nil
+}
+
+// SetPeerGroup sets the members of the named peer group, creating
+// it if needed. If members is empty, the group is deleted.
+//
+// Members are peer names (MagicDNS names or hostnames) or Tailscale
+// IPs. They're not checked against the current netmap, so a group
+// may name peers that are currently absent.
+func (b *LocalBackend) SetPeerGroup(name string, members []string) error {
+	if err := ipn.CheckPeerGroupName(name); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	groups, err := b.loadPeerGroupsLocked()
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		delete(groups, name)
+	} else {
+		groups[name] = members
+	}
+	bs, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	if err := b.store.WriteState(ipn.PeerGroupsStateKey, bs); err != nil {
+		return err
+	}
+	// Virtual services may select peers by group.
+	go b.updateVirtualServices()
+	return nil
+}
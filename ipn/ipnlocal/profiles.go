@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tailscale.com/ipn"
+)
+
+var errNoBackendState = errors.New("login profiles require tailscaled to own its state (run it with --state)")
+
+// Profiles returns the backend's login profiles.
+func (b *LocalBackend) Profiles() (*ipn.LoginProfiles, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loadProfilesLocked()
+}
+
+// loadProfilesLocked returns the stored profile list, or a list with
+// just the default profile if none has been stored yet.
+// b.mu must be held.
+func (b *LocalBackend) loadProfilesLocked() (*ipn.LoginProfiles, error) {
+	bs, err := b.store.ReadState(ipn.ProfilesStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return &ipn.LoginProfiles{
+			Current:  ipn.DefaultProfileName,
+			Profiles: []string{ipn.DefaultProfileName},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lp := new(ipn.LoginProfiles)
+	if err := json.Unmarshal(bs, lp); err != nil {
+		return nil, fmt.Errorf("invalid %s state: %w", ipn.ProfilesStateKey, err)
+	}
+	return lp, nil
+}
+
+func (b *LocalBackend) saveProfilesLocked(lp *ipn.LoginProfiles) error {
+	bs, err := json.Marshal(lp)
+	if err != nil {
+		return err
+	}
+	return b.store.WriteState(ipn.ProfilesStateKey, bs)
+}
+
+// SwitchProfile saves the current prefs, including the node key,
+// under the current profile's name, and restarts the backend with
+// the named profile's prefs. If the profile doesn't exist, it's
+// created with empty prefs for the same control server, and the
+// backend will need to be logged in.
+//
+// It only works when the backend owns its state; that is, when it
+// was started with an ipn.Options.StateKey.
+func (b *LocalBackend) SwitchProfile(name string) error {
+	if err := ipn.CheckProfileName(name); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	key := b.stateKey
+	if key == "" || b.prefs == nil {
+		b.mu.Unlock()
+		return errNoBackendState
+	}
+	lp, err := b.loadProfilesLocked()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if lp.Current == name {
+		b.mu.Unlock()
+		return nil
+	}
+
+	var newp *ipn.Prefs
+	bs, err := b.store.ReadState(ipn.ProfileStateKey(name))
+	switch {
+	case err == nil:
+		newp, err = ipn.PrefsFromBytes(bs, false)
+		if err != nil {
+			b.mu.Unlock()
+			return fmt.Errorf("loading profile %q: %w", name, err)
+		}
+	case errors.Is(err, ipn.ErrStateNotExist):
+		newp = ipn.NewPrefs()
+		newp.ControlURL = b.prefs.ControlURL
+		lp.Profiles = append(lp.Profiles, name)
+	default:
+		b.mu.Unlock()
+		return err
+	}
+
+	// Stop the control client first so it can't write the old
+	// profile's node key into the new profile's prefs.
+	if b.c != nil {
+		b.c.Shutdown()
+	}
+	if err := b.store.WriteState(ipn.ProfileStateKey(lp.Current), storedPrefs(b.prefs)); err != nil {
+		b.mu.Unlock()
+		return fmt.Errorf("saving profile %q: %w", lp.Current, err)
+	}
+	if err := b.store.WriteState(key, storedPrefs(newp)); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.logf("switching from profile %q to %q", lp.Current, name)
+	lp.Current = name
+	if err := b.saveProfilesLocked(lp); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	opts := ipn.Options{
+		StateKey: key,
+		Notify:   b.notify,
+	}
+	if b.hostinfo != nil {
+		opts.FrontendLogID = b.hostinfo.FrontendLogID
+	}
+	b.setNetMapLocked(nil)
+	b.mu.Unlock()
+
+	b.stopEngineAndWait()
+	return b.Start(opts)
+}
+
+// DeleteProfile deletes the named profile, which must not be the
+// current one.
+//
+// The profile's node key is forgotten without logging it out, so the
+// node remains in its tailnet until it expires or is removed by an
+// admin.
+func (b *LocalBackend) DeleteProfile(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stateKey == "" {
+		return errNoBackendState
+	}
+	lp, err := b.loadProfilesLocked()
+	if err != nil {
+		return err
+	}
+	if name == lp.Current {
+		return fmt.Errorf("can't delete the current profile %q", name)
+	}
+	found := false
+	for i, p := range lp.Profiles {
+		if p == name {
+			lp.Profiles = append(lp.Profiles[:i], lp.Profiles[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no profile %q", name)
+	}
+	// StateStore has no delete, so overwrite the saved prefs with
+	// empty ones to drop the node key.
+	if err := b.store.WriteState(ipn.ProfileStateKey(name), ipn.NewPrefs().ToBytes()); err != nil {
+		return err
+	}
+	return b.saveProfilesLocked(lp)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+)
+
+// resumeMaxAge is how old a saved session can be and still be
+// resumed. Resuming is for quick restarts, such as upgrades; after
+// longer than this, the saved netmap is likely stale enough that it's
+// better to wait for a fresh one.
+const resumeMaxAge = 5 * time.Minute
+
+// resumeState is the session state saved on shutdown, so that the
+// next tailscaled can configure the engine from the saved netmap
+// right away and resume polling the control server without
+// registering again.
+type resumeState struct {
+	SavedAt time.Time
+	Control *controlclient.ResumeState
+	NetMap  *netmap.NetworkMap
+}
+
+// controlState returns the control client part of rs, which may be
+// nil.
+func (rs *resumeState) controlState() *controlclient.ResumeState {
+	if rs == nil {
+		return nil
+	}
+	return rs.Control
+}
+
+func resumeStateKey(key ipn.StateKey) ipn.StateKey {
+	return "_resume-" + key
+}
+
+// saveResumeState saves the current session of cli, if it's up, for
+// the next tailscaled to resume. It's called on shutdown.
+func (b *LocalBackend) saveResumeState(cli *controlclient.Client) {
+	b.mu.Lock()
+	key := b.stateKey
+	nm := b.netMap
+	state := b.state
+	b.mu.Unlock()
+	if key == "" || nm == nil || state != ipn.Running {
+		return
+	}
+	cs := cli.Direct().ResumeState()
+	if cs == nil || cs.NodeKey != nm.NodeKey {
+		return
+	}
+	j, err := json.Marshal(&resumeState{
+		SavedAt: time.Now(),
+		Control: cs,
+		NetMap:  nm,
+	})
+	if err != nil {
+		b.logf("resume: %v", err)
+		return
+	}
+	if err := b.store.WriteState(resumeStateKey(key), j); err != nil {
+		b.logf("resume: saving session: %v", err)
+		return
+	}
+	b.logf("resume: saved session for restart")
+}
+
+// PrepareHandover saves the current session for the tailscaled that's
+// about to replace this process by handing over its TUN device and
+// sockets, so that it resumes rather than registering again and
+// waiting for a full netmap. Unlike Shutdown, it leaves the engine
+// and the devices being handed over alone.
+func (b *LocalBackend) PrepareHandover() {
+	b.mu.Lock()
+	cli := b.c
+	b.mu.Unlock()
+	if cli != nil {
+		b.saveResumeState(cli)
+	}
+}
+
+// takeResumeState returns the session saved by the previous
+// tailscaled for the state key and node, or nil if there isn't one or
+// it's too old. The saved session is removed, so it's only resumed
+// once.
+func (b *LocalBackend) takeResumeState(key ipn.StateKey, p *persist.Persist) *resumeState {
+	if key == "" || p == nil || p.PrivateNodeKey.IsZero() {
+		return nil
+	}
+	j, err := b.store.ReadState(resumeStateKey(key))
+	if err != nil {
+		if !errors.Is(err, ipn.ErrStateNotExist) {
+			b.logf("resume: %v", err)
+		}
+		return nil
+	}
+	if len(j) == 0 {
+		return nil
+	}
+	if err := b.store.WriteState(resumeStateKey(key), nil); err != nil {
+		b.logf("resume: clearing saved session: %v", err)
+		return nil
+	}
+	rs := new(resumeState)
+	if err := json.Unmarshal(j, rs); err != nil {
+		b.logf("resume: invalid saved session: %v", err)
+		return nil
+	}
+	if age := time.Since(rs.SavedAt); age < 0 || age > resumeMaxAge {
+		b.logf("resume: saved session is too old (%v)", age.Round(time.Second))
+		return nil
+	}
+	nodeKey := tailcfg.NodeKey(p.PrivateNodeKey.Public())
+	if rs.Control == nil || rs.NetMap == nil || rs.NetMap.NodeKey != rs.Control.NodeKey || rs.Control.NodeKey != nodeKey {
+		b.logf("resume: saved session is for a different node key")
+		return nil
+	}
+	return rs
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// serveListener is a listener for one of the Serve prefs' handlers on
+// one of the node's Tailscale IPs.
+type serveListener struct {
+	h   ipn.ServeHandler
+	srv *http.Server
+}
+
+// SetServe replaces the Serve prefs with handlers.
+func (b *LocalBackend) SetServe(handlers []ipn.ServeHandler) error {
+	seen := map[uint16]bool{}
+	for _, h := range handlers {
+		if err := h.Check(); err != nil {
+			return fmt.Errorf("port %d: %w", h.Port, err)
+		}
+		if seen[h.Port] {
+			return fmt.Errorf("port %d is served more than once", h.Port)
+		}
+		if h.Port == SSHPort {
+			return fmt.Errorf("port %d is reserved for SSH", SSHPort)
+		}
+		seen[h.Port] = true
+	}
+	b.mu.Lock()
+	if b.prefs == nil {
+		b.mu.Unlock()
+		return errors.New("no prefs")
+	}
+	p := b.prefs.Clone()
+	b.mu.Unlock()
+	p.Serve = handlers
+	b.SetPrefs(p)
+	return nil
+}
+
+// updateServeListeners starts or stops the HTTP servers for the Serve
+// prefs on the node's Tailscale IPs to match the current prefs and
+// netmap.
+func (b *LocalBackend) updateServeListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	want := map[netaddr.IPPort]ipn.ServeHandler{}
+	if b.prefs != nil && b.prefs.WantRunning && b.netMap != nil {
+		for _, pfx := range b.netMap.Addresses {
+			if !pfx.IsSingleIP() {
+				continue
+			}
+			for _, h := range b.prefs.Serve {
+				want[netaddr.IPPort{IP: pfx.IP, Port: h.Port}] = h
+			}
+		}
+	}
+	for ipp, sl := range b.serveListeners {
+		if h, ok := want[ipp]; !ok || h != sl.h {
+			b.logf("serve: stopped serving %v on %v", sl.h, ipp)
+			sl.srv.Close()
+			delete(b.serveListeners, ipp)
+		}
+	}
+	if b.serveListeners == nil {
+		b.serveListeners = map[netaddr.IPPort]*serveListener{}
+	}
+	for ipp, h := range want {
+		if _, ok := b.serveListeners[ipp]; ok {
+			continue
+		}
+		sl, err := b.startServeLocked(ipp, h)
+		if err != nil {
+			b.logf("serve: can't serve %v on %v: %v", h, ipp, err)
+			continue
+		}
+		b.logf("serve: serving %v on %v", h, ipp)
+		b.serveListeners[ipp] = sl
+	}
+}
+
+func (b *LocalBackend) startServeLocked(ipp netaddr.IPPort, h ipn.ServeHandler) (*serveListener, error) {
+	handler, err := b.newServeHandler(h)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(ipp.IP.String(), strconv.Itoa(int(ipp.Port))))
+	if err != nil {
+		return nil, err
+	}
+	if h.HTTPS {
+		cert, err := b.serveCertLocked()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{
+			GetCertificate: func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if b.wantsCustomCert(hi.ServerName) {
+					return b.GetCertificate(hi)
+				}
+				return &cert, nil
+			},
+		})
+	}
+	srv := &http.Server{
+		Handler:  handler,
+		ErrorLog: logger.StdLogger(logger.WithPrefix(b.logf, "serve: ")),
+	}
+	go srv.Serve(ln)
+	return &serveListener{h: h, srv: srv}, nil
+}
+
+func (b *LocalBackend) closeServeListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ipp, sl := range b.serveListeners {
+		sl.srv.Close()
+		delete(b.serveListeners, ipp)
+	}
+}
+
+// newServeHandler returns the HTTP handler for h. Requests are
+// annotated with the Tailscale identity of the peer making them.
+func (b *LocalBackend) newServeHandler(h ipn.ServeHandler) (http.Handler, error) {
+	var next http.Handler
+	if h.Proxy != "" {
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		next = httputil.NewSingleHostReverseProxy(u)
+	} else {
+		next = http.FileServer(http.Dir(h.Path))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Tailscale-User-Login")
+		r.Header.Del("Tailscale-User-Name")
+		if ipp, err := netaddr.ParseIPPort(r.RemoteAddr); err == nil {
+			if _, u, ok := b.WhoIs(ipp); ok {
+				r.Header.Set("Tailscale-User-Login", u.LoginName)
+				r.Header.Set("Tailscale-User-Name", u.DisplayName)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// wantsCustomCert reports whether TLS clients of the Serve handlers
+// asking for serverName should get its publicly trusted certificate
+// rather than the self-signed one, because it's one of the
+// CertDomains prefs.
+func (b *LocalBackend) wantsCustomCert(serverName string) bool {
+	if serverName == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefs != nil && isCertDomain(b.prefs.CertDomains, strings.TrimSuffix(strings.ToLower(serverName), "."))
+}
+
+// serveCertLocked returns the certificate for the Serve prefs' HTTPS
+// handlers, generating and storing it on first use. It's
+// self-signed for the node's names and Tailscale IPs, so clients must
+// be told to trust it.
+func (b *LocalBackend) serveCertLocked() (tls.Certificate, error) {
+	pemCert, err := b.store.ReadState(ipn.ServeCertStateKey)
+	if err == nil {
+		return tls.X509KeyPair(pemCert, pemCert)
+	}
+	if !errors.Is(err, ipn.ErrStateNotExist) {
+		return tls.Certificate{}, err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Tailscale serve"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if nm := b.netMap; nm != nil {
+		if name := strings.TrimSuffix(nm.Name, "."); name != "" {
+			tmpl.Subject.CommonName = name
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+		for _, pfx := range nm.Addresses {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, pfx.IP.IPAddr().IP)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pemCert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := b.store.WriteState(ipn.ServeCertStateKey, pemCert); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(pemCert, pemCert)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// SSHServer is the built-in SSH server that tailscaled runs on the
+// node's Tailscale IPs when the RunSSH pref is set.
+//
+// It's implemented by package tailssh, which registers itself with
+// RegisterNewSSHServer. Binaries that don't import tailssh don't
+// include an SSH server, and ignore RunSSH.
+type SSHServer interface {
+	// HandleSSHConn handles a connection to the SSH port of one of
+	// the node's Tailscale IPs. It's run in its own goroutine.
+	HandleSSHConn(net.Conn) error
+}
+
+// SSHPort is the TCP port the built-in SSH server listens on.
+const SSHPort = 22
+
+// newSSHServerFunc returns a new SSHServer using the PEM-encoded host
+// private key hostKeyPEM.
+type newSSHServerFunc func(logf logger.Logf, lb *LocalBackend, hostKeyPEM []byte) (SSHServer, error)
+
+var newSSHServer newSSHServerFunc // or nil
+
+// RegisterNewSSHServer registers fn as the constructor of the SSH
+// server. It must be called during init.
+func RegisterNewSSHServer(fn newSSHServerFunc) {
+	newSSHServer = fn
+}
+
+// updateSSHListeners starts or stops listening for SSH connections on
+// the node's Tailscale IPs to match the current prefs and netmap.
+func (b *LocalBackend) updateSSHListeners() {
+	// The server is created without b.mu held, as reading (or
+	// creating) the host key takes it.
+	b.mu.Lock()
+	needServer := b.sshServer == nil && len(b.wantSSHAddrsLocked()) > 0
+	b.mu.Unlock()
+	var newSrv SSHServer
+	if needServer {
+		var err error
+		newSrv, err = b.newSSHServer()
+		if err != nil {
+			b.logf("ssh: can't start server: %v", err)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	want := b.wantSSHAddrsLocked()
+	for ip, ln := range b.sshListeners {
+		if !want[ip] {
+			b.logf("ssh: stopped listening on %v", ip)
+			ln.Close()
+			delete(b.sshListeners, ip)
+		}
+	}
+	if len(want) == 0 {
+		return
+	}
+	if b.sshServer == nil {
+		if newSrv == nil {
+			// Prefs changed to want SSH since we checked; the
+			// next update will create the server.
+			return
+		}
+		b.sshServer = newSrv
+	}
+	if b.sshListeners == nil {
+		b.sshListeners = map[netaddr.IP]net.Listener{}
+	}
+	for ip := range want {
+		if _, ok := b.sshListeners[ip]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(SSHPort)))
+		if err != nil {
+			b.logf("ssh: can't listen on %v: %v", ip, err)
+			continue
+		}
+		b.logf("ssh: listening on %v", ln.Addr())
+		b.sshListeners[ip] = ln
+		go b.acceptSSH(ln, b.sshServer)
+	}
+}
+
+// wantSSHAddrsLocked returns the Tailscale IPs the SSH server should
+// listen on, which is none if it's disabled.
+// b.mu must be held.
+func (b *LocalBackend) wantSSHAddrsLocked() map[netaddr.IP]bool {
+	want := map[netaddr.IP]bool{}
+	if newSSHServer != nil && b.prefs != nil && b.prefs.RunSSH && b.prefs.WantRunning && b.netMap != nil {
+		for _, pfx := range b.netMap.Addresses {
+			if pfx.IsSingleIP() {
+				want[pfx.IP] = true
+			}
+		}
+	}
+	return want
+}
+
+// newSSHServer returns a new SSH server with the node's host key.
+// b.mu must not be held.
+func (b *LocalBackend) newSSHServer() (SSHServer, error) {
+	hostKey, err := b.sshHostKeyPEM()
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+	return newSSHServer(logger.WithPrefix(b.logf, "ssh: "), b, hostKey)
+}
+
+func (b *LocalBackend) acceptSSH(ln net.Listener, srv SSHServer) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := srv.HandleSSHConn(c); err != nil {
+				b.logf("ssh: connection from %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (b *LocalBackend) closeSSHListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ip, ln := range b.sshListeners {
+		ln.Close()
+		delete(b.sshListeners, ip)
+	}
+}
+
+// SelfNode returns the node's own netmap entry, or nil if there's no
+// netmap yet.
+func (b *LocalBackend) SelfNode() *tailcfg.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return nil
+	}
+	return b.netMap.SelfNode
+}
+
+// sshHostKeyPEM returns the SSH server's host private key, in PKCS #8
+// PEM form, generating and storing it on first use.
+func (b *LocalBackend) sshHostKeyPEM() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pemKey, err := b.store.ReadState(ipn.SSHHostKeyStateKey)
+	if err == nil {
+		return pemKey, nil
+	}
+	if !errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pemKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := b.store.WriteState(ipn.SSHHostKeyStateKey, pemKey); err != nil {
+		return nil, err
+	}
+	return pemKey, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/util/sched"
+	"tailscale.com/version/autoupdate"
+	"tailscale.com/version/updatecheck"
+)
+
+const (
+	// updateCheckInterval is how often tailscaled checks for a newer
+	// release, unless the NoUpdateCheck pref is set.
+	updateCheckInterval = 24 * time.Hour
+
+	// updateCheckDelay is how long after starting tailscaled first
+	// checks, to stay out of the way of connecting.
+	updateCheckDelay = 5 * time.Minute
+
+	// updateCheckRetry is how soon a failed check is retried, at
+	// first.
+	updateCheckRetry = time.Hour
+
+	// autoUpdateTimeout bounds downloading and installing a release
+	// when the AutoUpdate pref is set.
+	autoUpdateTimeout = 15 * time.Minute
+)
+
+// updateCheckTask is the scheduled task that checks for a newer
+// Tailscale release and reports it in health.Notices. It's only
+// scheduled if updatecheck.Enabled.
+func (b *LocalBackend) updateCheckTask() sched.Task {
+	return sched.Task{
+		Interval: updateCheckInterval,
+		Delay:    updateCheckDelay,
+		Jitter:   0.1,
+		Retry:    updateCheckRetry,
+		Func:     b.checkForUpdate,
+	}
+}
+
+// checkForUpdate checks for a newer Tailscale release, unless the
+// NoUpdateCheck pref is set, and installs it if the AutoUpdate pref
+// is.
+func (b *LocalBackend) checkForUpdate(ctx context.Context) error {
+	b.mu.Lock()
+	disabled := b.prefs != nil && b.prefs.NoUpdateCheck
+	autoUpdate := b.prefs != nil && b.prefs.AutoUpdate
+	b.mu.Unlock()
+	if disabled {
+		health.SetUpdateAvailable("", false)
+		return nil
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	res, err := updatecheck.Check(checkCtx)
+	if err != nil {
+		return fmt.Errorf("update check: %w", err)
+	}
+	if res.UpdateAvailable {
+		b.logf("update check: Tailscale %s is available (security fix: %v)", res.Latest.Version, res.Latest.SecurityFix)
+		health.SetUpdateAvailable(res.Latest.Version, res.Latest.SecurityFix)
+	} else {
+		health.SetUpdateAvailable("", false)
+	}
+	if res.UpdateAvailable && autoUpdate {
+		b.autoUpdate(ctx, &res.Latest)
+	}
+	return nil
+}
+
+// autoUpdate installs rel. Failures are logged rather than returned,
+// as retrying the check sooner wouldn't help; the health notice stays
+// up until the new version runs.
+func (b *LocalBackend) autoUpdate(ctx context.Context, rel *updatecheck.Release) {
+	ctx, cancel := context.WithTimeout(ctx, autoUpdateTimeout)
+	defer cancel()
+	b.logf("auto-update: installing Tailscale %s", rel.Version)
+	switch err := autoupdate.Update(ctx, b.logf, rel); {
+	case errors.Is(err, autoupdate.ErrNotSupported):
+		b.logf("auto-update: %v; update Tailscale by hand", err)
+	case err != nil:
+		b.logf("auto-update: installing %s: %v", rel.Version, err)
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// vserviceCheckInterval is how often virtual service backends
+	// are health checked.
+	vserviceCheckInterval = 10 * time.Second
+
+	// vserviceDialTimeout is how long connecting to a backend may
+	// take, for both health checks and forwarded connections.
+	vserviceDialTimeout = 3 * time.Second
+)
+
+// vservice is a running VirtualService: its listener and the state
+// of its backends.
+type vservice struct {
+	logf   logger.Logf
+	vs     ipn.VirtualService
+	ln     net.Listener // nil if err is set
+	err    error        // why listening failed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	backends   []*vsBackend
+	noBackends bool // whether the last setBackends had none, to log once
+	next       int  // for round robin
+}
+
+// vsBackend is a peer that a vservice forwards to.
+type vsBackend struct {
+	peer string // MagicDNS name
+	addr netaddr.IPPort
+
+	// The following are guarded by vservice.mu.
+	healthy   bool
+	latency   time.Duration // of the last successful dial, or 0 if none
+	lastCheck time.Time
+	active    int
+	total     uint64
+}
+
+// vsTarget is a backend as selected from the netmap.
+type vsTarget struct {
+	peer string
+	addr netaddr.IPPort
+}
+
+// SetVirtualServices replaces the VirtualServices prefs with services.
+func (b *LocalBackend) SetVirtualServices(services []ipn.VirtualService) error {
+	names := map[string]bool{}
+	addrs := map[netaddr.IPPort]bool{}
+	for _, s := range services {
+		if err := s.Check(); err != nil {
+			return fmt.Errorf("virtual service %q: %w", s.Name, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate virtual service %q", s.Name)
+		}
+		if addrs[s.Addr] {
+			return fmt.Errorf("virtual service %q: address %v is already in use", s.Name, s.Addr)
+		}
+		names[s.Name] = true
+		addrs[s.Addr] = true
+	}
+	b.mu.Lock()
+	if b.prefs == nil {
+		b.mu.Unlock()
+		return errors.New("no prefs")
+	}
+	p := b.prefs.Clone()
+	b.mu.Unlock()
+	p.VirtualServices = services
+	b.SetPrefs(p)
+	return nil
+}
+
+// VirtualServiceStatus returns the state of the VirtualServices prefs.
+func (b *LocalBackend) VirtualServiceStatus() []ipnstate.VirtualServiceStatus {
+	b.mu.Lock()
+	var services []ipn.VirtualService
+	if b.prefs != nil {
+		services = b.prefs.VirtualServices
+	}
+	running := make(map[string]*vservice, len(b.vservices))
+	for name, s := range b.vservices {
+		running[name] = s
+	}
+	b.mu.Unlock()
+
+	ret := make([]ipnstate.VirtualServiceStatus, 0, len(services))
+	for _, vs := range services {
+		st := ipnstate.VirtualServiceStatus{
+			Name: vs.Name,
+			Addr: vs.Addr.String(),
+		}
+		s := running[vs.Name]
+		switch {
+		case s == nil:
+			st.Error = "not running"
+		case s.err != nil:
+			st.Error = s.err.Error()
+		default:
+			st.Backends = s.status()
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// updateVirtualServices starts or stops the virtual services to match
+// the current prefs, and points them at the peers currently selected
+// by their backends.
+func (b *LocalBackend) updateVirtualServices() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	want := map[string]ipn.VirtualService{}
+	if b.prefs != nil && b.prefs.WantRunning && b.netMap != nil {
+		for _, vs := range b.prefs.VirtualServices {
+			want[vs.Name] = vs
+		}
+	}
+	for name, s := range b.vservices {
+		if vs, ok := want[name]; !ok || !vs.Equal(s.vs) || s.err != nil {
+			if s.err == nil {
+				b.logf("vservice: stopped %v", s.vs)
+			}
+			s.close()
+			delete(b.vservices, name)
+		}
+	}
+	if len(want) == 0 {
+		return
+	}
+	if b.vservices == nil {
+		b.vservices = map[string]*vservice{}
+	}
+	groups, err := b.loadPeerGroupsLocked()
+	if err != nil {
+		b.logf("vservice: can't load peer groups: %v", err)
+	}
+	for name, vs := range want {
+		s, ok := b.vservices[name]
+		if !ok {
+			s = b.startVirtualServiceLocked(vs)
+			b.vservices[name] = s
+			if s.err != nil {
+				b.logf("vservice: can't start %v: %v", vs, s.err)
+				continue
+			}
+			b.logf("vservice: started %v", vs)
+		}
+		if s.err == nil {
+			s.setBackends(virtualServiceTargets(vs, b.netMap, groups))
+		}
+	}
+}
+
+func (b *LocalBackend) startVirtualServiceLocked(vs ipn.VirtualService) *vservice {
+	ctx, cancel := context.WithCancel(b.ctx)
+	s := &vservice{
+		logf:   logger.WithPrefix(b.logf, "vservice "+vs.Name+": "),
+		vs:     vs,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.ln, s.err = net.Listen("tcp", vs.Addr.String())
+	if s.err != nil {
+		cancel()
+		return s
+	}
+	go s.acceptLoop()
+	go s.checkLoop()
+	return s
+}
+
+func (b *LocalBackend) closeVirtualServices() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, s := range b.vservices {
+		s.close()
+		delete(b.vservices, name)
+	}
+}
+
+// virtualServiceTargets returns the backends of vs, as selected from
+// the peers in nm, sorted by peer name.
+func virtualServiceTargets(vs ipn.VirtualService, nm *netmap.NetworkMap, groups ipn.PeerGroups) []vsTarget {
+	var ret []vsTarget
+	for _, peer := range nm.Peers {
+		if !peerIsVirtualServiceBackend(peer, nm, groups, vs.Backends) {
+			continue
+		}
+		ip, ok := peerDialIP(peer)
+		if !ok {
+			continue
+		}
+		ret = append(ret, vsTarget{
+			peer: strings.TrimSuffix(peer.Name, "."),
+			addr: netaddr.IPPort{IP: ip, Port: vs.BackendPort()},
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].peer < ret[j].peer })
+	return ret
+}
+
+// peerIsVirtualServiceBackend reports whether peer is selected by any
+// of the VirtualService backends sels.
+func peerIsVirtualServiceBackend(peer *tailcfg.Node, nm *netmap.NetworkMap, groups ipn.PeerGroups, sels []string) bool {
+	for _, sel := range sels {
+		if strings.HasPrefix(sel, ipn.TagPrefix) {
+			// Only the tags control granted count; RequestTags
+			// are whatever the peer claims.
+			for _, tag := range peer.Tags {
+				if tag == sel {
+					return true
+				}
+			}
+			continue
+		}
+		if name, ok := ipn.ParsePeerGroupTarget(sel); ok {
+			if peerMatchesAny(peer, nm, groups[name]) {
+				return true
+			}
+			continue
+		}
+		if peerMatchesAny(peer, nm, []string{sel}) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerDialIP returns the Tailscale IP to connect to peer on,
+// preferring IPv4.
+func peerDialIP(peer *tailcfg.Node) (ip netaddr.IP, ok bool) {
+	for _, pfx := range peer.Addresses {
+		if !pfx.IsSingleIP() {
+			continue
+		}
+		if pfx.IP.Is4() {
+			return pfx.IP, true
+		}
+		if !ok {
+			ip, ok = pfx.IP, true
+		}
+	}
+	return ip, ok
+}
+
+// setBackends replaces s's backends with targets, keeping the state
+// of those it already had.
+func (s *vservice) setBackends(targets []vsTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := map[netaddr.IPPort]*vsBackend{}
+	for _, be := range s.backends {
+		old[be.addr] = be
+	}
+	s.backends = make([]*vsBackend, 0, len(targets))
+	for _, t := range targets {
+		be, ok := old[t.addr]
+		if !ok {
+			be = &vsBackend{addr: t.addr, healthy: true}
+		}
+		be.peer = t.peer
+		s.backends = append(s.backends, be)
+	}
+	if len(targets) == 0 && !s.noBackends {
+		s.logf("no peers match backends %q", s.vs.Backends)
+	}
+	s.noBackends = len(targets) == 0
+}
+
+// pick returns the backend to try next, skipping those in tried, or
+// nil if there are none left. Unhealthy backends are only tried once
+// no healthy ones are left, as the health checks may be stale.
+func (s *vservice) pick(tried map[*vsBackend]bool) *vsBackend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cands []*vsBackend
+	for _, be := range s.backends {
+		if be.healthy && !tried[be] {
+			cands = append(cands, be)
+		}
+	}
+	if len(cands) == 0 {
+		for _, be := range s.backends {
+			if !tried[be] {
+				cands = append(cands, be)
+			}
+		}
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+	if s.vs.Balance == ipn.BalanceLeastLatency {
+		best := cands[0]
+		for _, be := range cands[1:] {
+			if fasterBackend(be, best) {
+				best = be
+			}
+		}
+		return best
+	}
+	be := cands[s.next%len(cands)]
+	s.next++
+	return be
+}
+
+// fasterBackend reports whether a connected faster than b the last
+// time each was dialed. Backends not dialed yet are the slowest.
+func fasterBackend(a, b *vsBackend) bool {
+	if a.latency == 0 {
+		return false
+	}
+	return b.latency == 0 || a.latency < b.latency
+}
+
+// dial connects to be, recording the outcome in be's health.
+func (s *vservice) dial(ctx context.Context, be *vsBackend) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, vserviceDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	start := time.Now()
+	c, err := d.DialContext(ctx, "tcp", be.addr.String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	be.lastCheck = time.Now()
+	if err != nil {
+		if be.healthy {
+			s.logf("backend %s (%v) is down: %v", be.peer, be.addr, err)
+		}
+		be.healthy = false
+		return nil, err
+	}
+	if !be.healthy {
+		s.logf("backend %s (%v) is up", be.peer, be.addr)
+	}
+	be.healthy = true
+	be.latency = time.Since(start)
+	return c, nil
+}
+
+func (s *vservice) acceptLoop() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.logf("accept: %v", err)
+			}
+			return
+		}
+		go s.forward(c)
+	}
+}
+
+// forward forwards the local connection c to a backend, trying each
+// in turn until one accepts the connection.
+func (s *vservice) forward(c net.Conn) {
+	defer c.Close()
+	tried := map[*vsBackend]bool{}
+	for {
+		be := s.pick(tried)
+		if be == nil {
+			s.logf("no reachable backends for connection from %v", c.RemoteAddr())
+			return
+		}
+		tried[be] = true
+		bc, err := s.dial(s.ctx, be)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		be.active++
+		be.total++
+		s.mu.Unlock()
+
+		proxyConns(s.ctx, c, bc)
+
+		s.mu.Lock()
+		be.active--
+		s.mu.Unlock()
+		return
+	}
+}
+
+// proxyConns copies between a and b until either side is done or ctx
+// is, then closes b.
+func proxyConns(ctx context.Context, a, b net.Conn) {
+	defer b.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// checkLoop health checks s's backends until s is closed.
+func (s *vservice) checkLoop() {
+	t := time.NewTicker(vserviceCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		backends := append([]*vsBackend(nil), s.backends...)
+		s.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, be := range backends {
+			wg.Add(1)
+			go func(be *vsBackend) {
+				defer wg.Done()
+				if c, err := s.dial(s.ctx, be); err == nil {
+					c.Close()
+				}
+			}(be)
+		}
+		wg.Wait()
+	}
+}
+
+func (s *vservice) status() []ipnstate.VirtualServiceBackend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]ipnstate.VirtualServiceBackend, 0, len(s.backends))
+	for _, be := range s.backends {
+		ret = append(ret, ipnstate.VirtualServiceBackend{
+			Peer:           be.peer,
+			Addr:           be.addr.String(),
+			Healthy:        be.healthy,
+			LatencySeconds: be.latency.Seconds(),
+			LastCheck:      be.lastCheck,
+			ActiveConns:    be.active,
+			TotalConns:     be.total,
+		})
+	}
+	return ret
+}
+
+func (s *vservice) close() {
+	s.cancel()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
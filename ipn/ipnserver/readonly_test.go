@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/wgengine"
+)
+
+func TestServeReadonly(t *testing.T) {
+	eng, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ipnlocal.NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, eng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+	s := &server{b: b, logf: t.Logf}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveReadonly(ctx, ln)
+	}()
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/localapi/v0/status", http.StatusOK},
+		{"GET", "/localapi/v0/prefs", http.StatusOK},
+		{"POST", "/localapi/v0/login-interactive", http.StatusForbidden},
+		{"PATCH", "/localapi/v0/prefs", http.StatusForbidden},
+		{"GET", "/localapi/v0/goroutines", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "http://"+ln.Addr().String()+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s %s: status = %v; want %v", tt.method, tt.path, res.StatusCode, tt.want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveReadonly didn't return after its context was done")
+	}
+}
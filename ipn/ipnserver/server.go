@@ -33,6 +33,7 @@ import (
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/localapi"
+	ipnstore "tailscale.com/ipn/store"
 	"tailscale.com/log/filelogger"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netstat"
@@ -55,9 +56,21 @@ type Options struct {
 	// frontend connections.
 	Port int
 
+	// Listener, if non-nil, is an already open listener for frontend
+	// connections, such as one inherited from a previous tailscaled,
+	// to use instead of listening on SocketPath or Port. Run closes
+	// it when it returns.
+	Listener net.Listener
+
 	// StatePath is the path to the stored agent state.
+	// See store.New for the non-file schemes it may also use.
 	StatePath string
 
+	// EncryptState is whether the state file at StatePath is
+	// encrypted at rest with a key protected by the OS key store.
+	// See store.EncryptedFileStore.
+	EncryptState bool
+
 	// AutostartStateKey, if non-empty, immediately starts the agent
 	// using the given StateKey. If empty, the agent stays idle and
 	// waits for a frontend to start it.
@@ -73,6 +86,11 @@ type Options struct {
 	// tailscaled is done.
 	LegacyConfigPath string
 
+	// Config, if non-nil, is the declarative config to apply to
+	// the prefs of AutostartStateKey's state once it starts. Its
+	// alert rules apply either way.
+	Config *ipn.ConfigFile
+
 	// SurviveDisconnects specifies how the server reacts to its
 	// frontend disconnecting. If true, the server keeps running on
 	// its existing state, and accepts new frontend connections. If
@@ -93,11 +111,41 @@ type Options struct {
 	// to register a debug handler.
 	DebugMux *http.ServeMux
 
+	// NetstackRouter is whether the engine's netstack forwards
+	// packets for advertised routes, in userspace networking mode,
+	// rather than the OS.
+	NetstackRouter bool
+
+	// TailnetDial, if non-nil, makes TCP connections through the
+	// tailnet to a host:port, for the LocalAPI's /dial endpoint.
+	TailnetDial func(ctx context.Context, addr string) (net.Conn, error)
+
+	// CertDNSProvider, if non-empty, is the DNS-01 challenge
+	// provider for the CertDomains pref, as "name" or "name:arg".
+	// See ipnlocal.DNSChallengeProvider.
+	CertDNSProvider string
+
 	// OnBackendCreated, if non-nil, is called once when the LocalBackend
 	// is created.
 	OnBackendCreated func(*ipnlocal.LocalBackend)
 }
 
+// applyConfigFile applies c to b's prefs, if that changes them.
+func applyConfigFile(logf logger.Logf, b *ipnlocal.LocalBackend, c *ipn.ConfigFile) {
+	old := b.Prefs()
+	if old == nil {
+		// Start failed.
+		return
+	}
+	p := old.Clone()
+	c.ApplyTo(p)
+	if p.Equals(old) {
+		return
+	}
+	logf("ipnserver: applying config file: %v", p.Pretty())
+	b.SetPrefs(p)
+}
+
 // server is an IPN backend and its set of 0 or more active connections
 // talking to an IPN backend.
 type server struct {
@@ -608,9 +656,13 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	runDone := make(chan struct{})
 	defer close(runDone)
 
-	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
-	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+	var err error
+	listen := opts.Listener
+	if listen == nil {
+		listen, _, err = safesocket.Listen(opts.SocketPath, uint16(opts.Port))
+		if err != nil {
+			return fmt.Errorf("safesocket.Listen: %v", err)
+		}
 	}
 
 	server := &server{
@@ -632,9 +684,13 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 
 	var store ipn.StateStore
 	if opts.StatePath != "" {
-		store, err = ipn.NewFileStore(opts.StatePath)
+		if opts.EncryptState {
+			store, err = ipnstore.NewEncryptedFileStore(logf, opts.StatePath)
+		} else {
+			store, err = ipnstore.New(logf, opts.StatePath)
+		}
 		if err != nil {
-			return fmt.Errorf("ipn.NewFileStore(%q): %v", opts.StatePath, err)
+			return fmt.Errorf("opening state store %q: %v", opts.StatePath, err)
 		}
 		if opts.AutostartStateKey == "" {
 			autoStartKey, err := store.ReadState(ipn.ServerModeStartKey)
@@ -742,6 +798,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetNetstackRouter(opts.NetstackRouter)
+	b.SetTailnetDialer(opts.TailnetDial)
+	b.SetCertDNSProvider(opts.CertDNSProvider)
 
 	if opts.OnBackendCreated != nil {
 		opts.OnBackendCreated(b)
@@ -756,19 +815,41 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	server.b = b
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 
+	if runtime.GOOS == "windows" {
+		if rl, err := safesocket.ListenReadonly(); err != nil {
+			logf("ipnserver: read-only pipe: %v", err)
+		} else {
+			go server.serveReadonly(ctx, rl)
+		}
+	}
+
 	if opts.AutostartStateKey != "" {
+		var authKey string
+		if opts.Config != nil {
+			authKey = opts.Config.AuthKey
+		}
 		server.bs.GotCommand(context.TODO(), &ipn.Command{
 			Version: version.Long,
 			Start: &ipn.StartArgs{
 				Opts: ipn.Options{
 					StateKey:         opts.AutostartStateKey,
 					LegacyConfigPath: opts.LegacyConfigPath,
+					AuthKey:          authKey,
 				},
 			},
 		})
+		if opts.Config != nil {
+			applyConfigFile(logf, b, opts.Config)
+		}
+	} else if opts.Config != nil {
+		logf("ipnserver: ignoring config file prefs; no state to autostart")
+	}
+	if opts.Config != nil && len(opts.Config.Alerts) > 0 {
+		b.SetAlertRules(opts.Config.Alerts)
 	}
 
 	systemd.Ready()
+	go systemd.Watchdog(ctx, func() { b.State() })
 	for i := 1; ctx.Err() == nil; i++ {
 		var c net.Conn
 		var err error
@@ -790,9 +871,15 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	return ctx.Err()
 }
 
+// subprocStopTimeout is how long BabysitProc waits for the subprocess
+// to shut down after its context is done before killing it.
+const subprocStopTimeout = 15 * time.Second
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
-// restarting the process on any crashes.
+// restarting the process on any crashes. When ctx is done, it closes
+// the subprocess's stdin, asking it to shut down, and kills it if it
+// hasn't within subprocStopTimeout.
 //
 // It's only currently (2020-10-29) used on Windows.
 func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
@@ -811,11 +898,15 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 	}
 
 	var proc struct {
-		mu sync.Mutex
-		p  *os.Process
+		mu     sync.Mutex
+		p      *os.Process
+		stdin  *os.File      // write side of p's stdin
+		exited chan struct{} // closed when p exits
 	}
 
 	done := make(chan struct{})
+	stopped := make(chan struct{}) // closed when BabysitProc returns
+	defer close(stopped)
 	go func() {
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -825,13 +916,32 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 			logf("BabysitProc: got signal: %v", sig)
 			close(done)
 		case <-ctx.Done():
-			logf("BabysitProc: context done")
-			sig = os.Kill
+			logf("BabysitProc: context done; stopping subprocess")
 			close(done)
+
+			// Closing its stdin asks the subprocess to shut
+			// down cleanly. Give it a while before killing it.
+			proc.mu.Lock()
+			if proc.stdin != nil {
+				proc.stdin.Close()
+			}
+			exited := proc.exited
+			proc.mu.Unlock()
+			select {
+			case <-exited:
+				return
+			case <-stopped:
+				return
+			case <-time.After(subprocStopTimeout):
+				logf("BabysitProc: subprocess didn't stop in %v; killing it", subprocStopTimeout)
+			}
+			sig = os.Kill
 		}
 
 		proc.mu.Lock()
-		proc.p.Signal(sig)
+		if proc.p != nil {
+			proc.p.Signal(sig)
+		}
 		proc.mu.Unlock()
 	}()
 
@@ -892,16 +1002,23 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 		if err != nil {
 			log.Printf("starting subprocess failed: %v", err)
 		} else {
+			exited := make(chan struct{})
 			proc.mu.Lock()
 			proc.p = cmd.Process
+			proc.stdin = wStdin
+			proc.exited = exited
 			proc.mu.Unlock()
 
 			err = cmd.Wait()
+			close(exited)
 			log.Printf("subprocess exited: %v", err)
 		}
 
 		// If the process finishes, clean up the write side of the
 		// pipe. We'll make a new one when we restart the subproc.
+		proc.mu.Lock()
+		proc.stdin = nil
+		proc.mu.Unlock()
 		wStdin.Close()
 
 		if os.Getenv("TS_DEBUG_RESTART_CRASHED") == "0" {
@@ -1006,6 +1123,27 @@ func (s *server) localhostHandler(ci connIdentity) http.Handler {
 	})
 }
 
+// serveReadonly serves the LocalAPI on ln with read permission only,
+// until ctx is done. Unlike the main listener, it doesn't check who's
+// connecting or lock the server to their user; it's for non-elevated
+// users and tools that only want to see the status.
+func (s *server) serveReadonly(ctx context.Context, ln net.Listener) {
+	lah := localapi.NewHandler(s.b)
+	lah.PermitRead = true
+	hs := &http.Server{
+		Handler:     lah,
+		IdleTimeout: 5 * time.Second,
+		ErrorLog:    logger.StdLogger(s.logf),
+	}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	if err := hs.Serve(ln); err != nil && ctx.Err() == nil {
+		s.logf("ipnserver: read-only pipe: %v", err)
+	}
+}
+
 func serveHTMLStatus(w http.ResponseWriter, b *ipnlocal.LocalBackend) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	st := b.Status()
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// PeerConnStats are the statistics of the connection to one peer, as
+// served by the LocalAPI's /peer-stats endpoint. They're a subset of
+// PeerStatus, with the DERP relay and direct path broken out.
+type PeerConnStats struct {
+	PublicKey key.Public
+	DNSName   string
+	TailAddr  string // Tailscale IP
+
+	// PathType is as in PeerStatus: "direct", "derp",
+	// "direct+derp", or empty if there's no active path.
+	PathType string
+
+	// Endpoint is the ip:port of the direct path, if any.
+	Endpoint string `json:",omitempty"`
+
+	// DERPRegion is the code of the peer's home DERP region, used
+	// when PathType includes "derp".
+	DERPRegion string `json:",omitempty"`
+
+	LastHandshake time.Time // zero if never
+	RxBytes       int64
+	TxBytes       int64
+
+	// Latencies are recent disco ping round-trip times, most recent
+	// first.
+	Latencies []LatencySample
+
+	// Paths are the measured qualities of the direct paths to the
+	// peer's endpoints, best first.
+	Paths []PathQuality `json:",omitempty"`
+}
+
+// ConnStats returns the connection statistics of the peers in s,
+// ordered as by SortPeers.
+func (s *Status) ConnStats() []PeerConnStats {
+	peers := make([]*PeerStatus, 0, len(s.Peer))
+	for _, ps := range s.Peer {
+		peers = append(peers, ps)
+	}
+	SortPeers(peers)
+	ret := make([]PeerConnStats, 0, len(peers))
+	for _, ps := range peers {
+		ret = append(ret, PeerConnStats{
+			PublicKey:     ps.PublicKey,
+			DNSName:       ps.DNSName,
+			TailAddr:      ps.TailAddr,
+			PathType:      ps.PathType,
+			Endpoint:      ps.CurAddr,
+			DERPRegion:    ps.Relay,
+			LastHandshake: ps.LastHandshake,
+			RxBytes:       ps.RxBytes,
+			TxBytes:       ps.TxBytes,
+			Latencies:     ps.Latencies,
+			Paths:         ps.Paths,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+func TestConnStats(t *testing.T) {
+	hs := time.Unix(1e9, 0)
+	sb := new(StatusBuilder)
+	sb.AddPeer(key.Public{2}, &PeerStatus{DNSName: "b.example.com.", RxBytes: 10, LastHandshake: hs})
+	sb.AddPeer(key.Public{2}, &PeerStatus{
+		CurAddr:  "1.2.3.4:41641",
+		Relay:    "sea",
+		PathType: "direct",
+		Latencies: []LatencySample{
+			{Endpoint: "1.2.3.4:41641", At: hs, LatencySeconds: 0.01},
+		},
+		Paths: []PathQuality{
+			{Endpoint: "1.2.3.4:41641", LatencySeconds: 0.01, Pings: 1},
+		},
+	})
+	sb.AddPeer(key.Public{1}, &PeerStatus{DNSName: "a.example.com.", Relay: "nyc", PathType: "derp"})
+
+	got := sb.Status().ConnStats()
+	if len(got) != 2 {
+		t.Fatalf("got %d peers; want 2", len(got))
+	}
+	a, b := got[0], got[1]
+	if a.DNSName != "a.example.com." || a.PathType != "derp" || a.DERPRegion != "nyc" || a.Endpoint != "" {
+		t.Errorf("a = %+v", a)
+	}
+	if b.PublicKey != (key.Public{2}) || b.PathType != "direct" || b.Endpoint != "1.2.3.4:41641" ||
+		b.RxBytes != 10 || !b.LastHandshake.Equal(hs) || len(b.Latencies) != 1 || len(b.Paths) != 1 {
+		t.Errorf("b = %+v", b)
+	}
+}
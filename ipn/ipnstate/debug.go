@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import "time"
+
+// MagicsockDebug is magicsock's path discovery state, as served by
+// the LocalAPI's /debug-magicsock endpoint for bug reports.
+type MagicsockDebug struct {
+	LocalPort uint16
+	DERPHome  int      // home DERP region ID; 0 if none
+	Endpoints []string // this node's endpoints, as last sent to control
+
+	// Peers are the peers magicsock has done path discovery with,
+	// sorted by NodeKey.
+	Peers []PeerEndpointsDebug
+}
+
+// PeerEndpointsDebug is magicsock's path discovery state for a peer.
+type PeerEndpointsDebug struct {
+	NodeKey  string // short form
+	DiscoKey string // short form
+	DERP     string `json:",omitempty"` // DERP address, if any
+
+	// BestAddr is the direct path packets are sent on, if any, and
+	// TrustBestAddrUntil when it's next reconfirmed.
+	BestAddr               string `json:",omitempty"`
+	BestAddrLatencySeconds float64
+	TrustBestAddrUntil     time.Time
+
+	LastSend     time.Time // when we last sent the peer data
+	LastFullPing time.Time // when we last pinged all its endpoints
+
+	Endpoints []EndpointDebug
+}
+
+// EndpointDebug is the state of one of a peer's candidate endpoints.
+type EndpointDebug struct {
+	Addr string
+
+	LastPing        time.Time // when we last pinged it
+	LastGotPing     time.Time // when it last pinged us, if it's not in the netmap
+	CallMeMaybeTime time.Time // when the peer last advertised it to us
+
+	// LastPongAt is when we last got a pong from it, and
+	// LastPongLatencySeconds how long that took.
+	LastPongAt             time.Time
+	LastPongLatencySeconds float64
+}
+
+// LinkEvent is a network change tailscaled's link monitor noticed, as
+// served by the LocalAPI's /debug-link-events endpoint.
+type LinkEvent struct {
+	Time    time.Time
+	Changed bool   // whether the interfaces' state changed
+	State   string // summary of the interfaces' state afterwards
+}
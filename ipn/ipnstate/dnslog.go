@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import "time"
+
+// DNSQueryLog is the MagicDNS resolver's log of recent queries, as
+// served by the LocalAPI's /dns-query-log endpoint.
+type DNSQueryLog struct {
+	Enabled bool
+	// WithAnswers is whether the log records the answers to queries,
+	// not just the names queried.
+	WithAnswers bool
+	Queries     []DNSQuery // oldest first
+}
+
+// DNSQuery is a DNS query handled by tailscaled's resolver.
+type DNSQuery struct {
+	Time time.Time
+	Name string // the queried name, in canonical form
+	Type string // the query type, such as "A" or "AAAA"
+
+	// Resolver is who answered: "magicdns" for the resolver itself,
+	// or the upstream nameserver's ip:port. It's empty if nobody did.
+	Resolver       string `json:",omitempty"`
+	LatencySeconds float64
+
+	// RCode is the response code, such as "Success" or "NameError",
+	// or "Timeout" or an error message if there was no response.
+	RCode string
+
+	// Answers are the answer records, such as "A 100.101.102.103",
+	// if the log records answers.
+	Answers []string `json:",omitempty"`
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import "inet.af/netaddr"
+
+// DNSStatus is the DNS configuration tailscaled has programmed, as
+// served by the LocalAPI's /dns-status endpoint.
+type DNSStatus struct {
+	// AcceptDNS is whether the node uses the tailnet's DNS settings
+	// at all (the CorpDNS pref, "tailscale up --accept-dns").
+	AcceptDNS bool
+
+	// MagicDNSSuffix is the tailnet's MagicDNS domain, if it has
+	// MagicDNS enabled.
+	MagicDNSSuffix string `json:",omitempty"`
+
+	// Nameservers and Domains are the nameservers and search domains
+	// the OS was told to use, and PerDomain whether to use them only
+	// for names in Domains.
+	Nameservers []netaddr.IP
+	Domains     []string
+	PerDomain   bool
+
+	// Proxied is whether Nameservers is tailscaled's own resolver,
+	// which answers for Tailscale names and forwards other queries to
+	// Upstreams (as ip:port).
+	Proxied   bool
+	Upstreams []string `json:",omitempty"`
+
+	// Error is why the configuration couldn't be applied to the OS,
+	// if it couldn't.
+	Error string `json:",omitempty"`
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/dnsname"
+)
+
+// OnlineHandshakeAge is how recent a peer's last WireGuard handshake
+// must be for StatusFilter to consider it online.
+const OnlineHandshakeAge = 3 * time.Minute
+
+// StatusFilter selects and pages through a subset of a Status's
+// peers, so that callers on very large tailnets don't need to fetch
+// (and the daemon doesn't need to encode) every peer.
+//
+// The zero value selects all peers.
+type StatusFilter struct {
+	// Name, if non-empty, is a shell glob (as used by path.Match)
+	// that a peer's MagicDNS base name or its hostname must match.
+	Name string
+
+	// Tag, if non-empty, selects only peers advertising this ACL tag.
+	Tag string
+
+	// Peers, if non-empty, selects only the named peers. Each is a
+	// MagicDNS name (with or without the MagicDNS suffix), hostname,
+	// or Tailscale IP.
+	Peers []string
+
+	// Group, if non-empty, is the name of a peer group (see
+	// ipn.PeerGroups) whose members are selected as if they were in
+	// Peers. Filter doesn't know about groups; the caller (such as
+	// the LocalAPI) must expand Group into Peers before filtering.
+	Group string
+
+	// Online, if non-nil, selects only peers that are online (or
+	// offline, if false), as determined by whether their last
+	// WireGuard handshake is within OnlineHandshakeAge.
+	Online *bool
+
+	// Offset and Limit select a page of the matching peers, in
+	// SortPeers order. A zero Limit means no limit.
+	Offset int
+	Limit  int
+
+	// Summary, if true, trims each peer to just the fields
+	// identifying it and its address; see PeerStatus.Summary.
+	Summary bool
+}
+
+// IsZero reports whether f selects all peers in full.
+func (f StatusFilter) IsZero() bool {
+	return f.Name == "" && f.Tag == "" && len(f.Peers) == 0 && f.Group == "" &&
+		f.Online == nil && f.Offset == 0 && f.Limit == 0 && !f.Summary
+}
+
+// Values returns f encoded as URL query parameters, as parsed by
+// StatusFilterFromValues.
+func (f StatusFilter) Values() url.Values {
+	v := url.Values{}
+	if f.Name != "" {
+		v.Set("name", f.Name)
+	}
+	if f.Tag != "" {
+		v.Set("tag", f.Tag)
+	}
+	for _, p := range f.Peers {
+		v.Add("peer", p)
+	}
+	if f.Group != "" {
+		v.Set("group", f.Group)
+	}
+	if f.Online != nil {
+		v.Set("online", strconv.FormatBool(*f.Online))
+	}
+	if f.Offset != 0 {
+		v.Set("offset", strconv.Itoa(f.Offset))
+	}
+	if f.Limit != 0 {
+		v.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if f.Summary {
+		v.Set("peers", "summary")
+	}
+	return v
+}
+
+// StatusFilterFromValues parses a StatusFilter from URL query
+// parameters, as produced by StatusFilter.Values.
+func StatusFilterFromValues(v url.Values) (StatusFilter, error) {
+	f := StatusFilter{
+		Name:    v.Get("name"),
+		Tag:     v.Get("tag"),
+		Peers:   v["peer"],
+		Group:   v.Get("group"),
+		Summary: v.Get("peers") == "summary",
+	}
+	if f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			return StatusFilter{}, err
+		}
+	}
+	if s := v.Get("online"); s != "" {
+		on, err := strconv.ParseBool(s)
+		if err != nil {
+			return StatusFilter{}, err
+		}
+		f.Online = &on
+	}
+	var err error
+	if s := v.Get("offset"); s != "" {
+		if f.Offset, err = strconv.Atoi(s); err != nil || f.Offset < 0 {
+			return StatusFilter{}, fmt.Errorf("invalid offset %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 0 {
+			return StatusFilter{}, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	return f, nil
+}
+
+// Filter returns a copy of s with only the peers selected by f, and
+// with only the users those peers (and the local node) belong to.
+// now is the current time, for the Online filter.
+func (s *Status) Filter(f StatusFilter, now time.Time) *Status {
+	if f.IsZero() {
+		return s
+	}
+	var peers []*PeerStatus
+	for _, ps := range s.Peer {
+		if f.matches(s, ps, now) {
+			peers = append(peers, ps)
+		}
+	}
+	SortPeers(peers)
+
+	s2 := *s
+	total := len(peers)
+	s2.PeerTotal = &total
+	if f.Offset >= len(peers) {
+		peers = nil
+	} else {
+		peers = peers[f.Offset:]
+	}
+	if f.Limit > 0 && len(peers) > f.Limit {
+		peers = peers[:f.Limit]
+	}
+
+	s2.Peer = make(map[key.Public]*PeerStatus, len(peers))
+	s2.User = make(map[tailcfg.UserID]tailcfg.UserProfile)
+	addUser := func(id tailcfg.UserID) {
+		if up, ok := s.User[id]; ok {
+			s2.User[id] = up
+		}
+	}
+	if s.Self != nil {
+		addUser(s.Self.UserID)
+	}
+	for _, ps := range peers {
+		if f.Summary {
+			ps = ps.Summary()
+		}
+		s2.Peer[ps.PublicKey] = ps
+		addUser(ps.UserID)
+	}
+	return &s2
+}
+
+func (f StatusFilter) matches(s *Status, ps *PeerStatus, now time.Time) bool {
+	if f.Name != "" {
+		base := dnsname.TrimSuffix(ps.DNSName, s.MagicDNSSuffix)
+		okBase, _ := path.Match(f.Name, base)
+		okHost, _ := path.Match(f.Name, ps.HostName)
+		if !okBase && !okHost {
+			return false
+		}
+	}
+	if f.Tag != "" {
+		found := false
+		for _, t := range ps.Tags {
+			if t == f.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Peers) > 0 {
+		found := false
+		for _, name := range f.Peers {
+			if peerHasName(s, ps, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Online != nil {
+		online := !ps.LastHandshake.IsZero() && now.Sub(ps.LastHandshake) < OnlineHandshakeAge
+		if online != *f.Online {
+			return false
+		}
+	}
+	return true
+}
+
+// FindPeer returns the peer whose MagicDNS name, hostname or one of
+// whose Tailscale IPs is name, or nil if there's none. If several
+// match, which is returned is unspecified.
+func (s *Status) FindPeer(name string) *PeerStatus {
+	for _, ps := range s.Peer {
+		if peerHasName(s, ps, name) {
+			return ps
+		}
+	}
+	return nil
+}
+
+// peerHasName reports whether name is one of ps's MagicDNS names,
+// its hostname, or one of its Tailscale IPs.
+func peerHasName(s *Status, ps *PeerStatus, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ip := range ps.TailscaleIPs {
+		if name == ip.String() {
+			return true
+		}
+	}
+	return name == ps.TailAddr ||
+		name == ps.HostName ||
+		strings.TrimSuffix(name, ".") == strings.TrimSuffix(ps.DNSName, ".") ||
+		name == dnsname.TrimSuffix(ps.DNSName, s.MagicDNSSuffix)
+}
+
+// Summary returns a copy of ps with only the fields that identify
+// the peer and its address.
+func (ps *PeerStatus) Summary() *PeerStatus {
+	return &PeerStatus{
+		PublicKey:    ps.PublicKey,
+		HostName:     ps.HostName,
+		DNSName:      ps.DNSName,
+		OS:           ps.OS,
+		UserID:       ps.UserID,
+		TailAddr:     ps.TailAddr,
+		TailscaleIPs: ps.TailscaleIPs,
+		Tags:         ps.Tags,
+		ExitNode:     ps.ExitNode,
+	}
+}
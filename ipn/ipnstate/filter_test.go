@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestStatusFilter(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	st := &Status{
+		MagicDNSSuffix: "example.com",
+		Self:           &PeerStatus{UserID: 1},
+		Peer:           map[key.Public]*PeerStatus{},
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "self@example.com"},
+			2: {ID: 2, LoginName: "a@example.com"},
+			3: {ID: 3, LoginName: "b@example.com"},
+		},
+	}
+	add := func(k byte, name string, user tailcfg.UserID, tags []string, handshake time.Time) {
+		st.Peer[key.Public{k}] = &PeerStatus{
+			PublicKey:     key.Public{k},
+			DNSName:       name + ".example.com.",
+			HostName:      name + "-host",
+			UserID:        user,
+			Tags:          tags,
+			LastHandshake: handshake,
+			RxBytes:       1,
+		}
+	}
+	add(1, "web-1", 2, []string{"tag:web"}, now.Add(-time.Minute))
+	add(2, "web-2", 2, []string{"tag:web"}, time.Time{})
+	add(3, "db-1", 3, []string{"tag:db"}, now.Add(-time.Minute))
+	add(4, "web-3", 2, []string{"tag:web"}, now.Add(-time.Hour))
+
+	yes, no := true, false
+	tests := []struct {
+		name      string
+		f         StatusFilter
+		want      []string
+		wantUsers []tailcfg.UserID
+		wantTotal int
+	}{
+		{"name", StatusFilter{Name: "web-*"}, []string{"web-1", "web-2", "web-3"}, []tailcfg.UserID{1, 2}, 3},
+		{"hostname", StatusFilter{Name: "db-1-host"}, []string{"db-1"}, []tailcfg.UserID{1, 3}, 1},
+		{"tag", StatusFilter{Tag: "tag:db"}, []string{"db-1"}, []tailcfg.UserID{1, 3}, 1},
+		{"online", StatusFilter{Online: &yes}, []string{"db-1", "web-1"}, []tailcfg.UserID{1, 2, 3}, 2},
+		{"offline", StatusFilter{Online: &no, Tag: "tag:web"}, []string{"web-2", "web-3"}, []tailcfg.UserID{1, 2}, 2},
+		{"peers", StatusFilter{Peers: []string{"web-1", "db-1-host", "web-3.example.com"}}, []string{"db-1", "web-1", "web-3"}, []tailcfg.UserID{1, 2, 3}, 3},
+		{"page", StatusFilter{Offset: 1, Limit: 2}, []string{"web-1", "web-2"}, []tailcfg.UserID{1, 2}, 4},
+		{"past-end", StatusFilter{Offset: 10}, nil, []tailcfg.UserID{1}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := st.Filter(tt.f, now)
+			var names []string
+			for _, ps := range got.Peer {
+				names = append(names, ps.HostName[:len(ps.HostName)-len("-host")])
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("peers = %q; want %q", names, tt.want)
+			}
+			var users []tailcfg.UserID
+			for id := range got.User {
+				users = append(users, id)
+			}
+			sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+			if !reflect.DeepEqual(users, tt.wantUsers) {
+				t.Errorf("users = %v; want %v", users, tt.wantUsers)
+			}
+			if got.PeerTotal == nil || *got.PeerTotal != tt.wantTotal {
+				t.Errorf("PeerTotal = %v; want %d", got.PeerTotal, tt.wantTotal)
+			}
+		})
+	}
+
+	got := st.Filter(StatusFilter{Summary: true, Limit: 1}, now)
+	for _, ps := range got.Peer {
+		if ps.RxBytes != 0 || ps.DNSName == "" {
+			t.Errorf("summary peer = %+v; want only identifying fields", ps)
+		}
+	}
+}
+
+func TestStatusFilterZeroTotal(t *testing.T) {
+	st := &Status{Peer: map[key.Public]*PeerStatus{
+		{1}: {HostName: "a"},
+	}}
+	got := st.Filter(StatusFilter{Name: "nomatch"}, time.Now())
+	j, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"PeerTotal":0`) {
+		t.Errorf("filtered status JSON %s lacks PeerTotal of 0", j)
+	}
+}
+
+func TestStatusFilterValues(t *testing.T) {
+	on := false
+	f := StatusFilter{Name: "web-*", Tag: "tag:web", Peers: []string{"a", "b"}, Group: "prod", Online: &on, Offset: 5, Limit: 10, Summary: true}
+	got, err := StatusFilterFromValues(f.Values())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("round trip = %+v; want %+v", got, f)
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	ip4 := netaddr.MustParseIP("100.101.102.103")
+	ip6 := netaddr.MustParseIP("fd7a:115c:a1e0::1")
+	web := &PeerStatus{
+		DNSName:      "web-1.example.com.",
+		HostName:     "web-1-host",
+		TailAddr:     ip4.String(),
+		TailscaleIPs: []netaddr.IP{ip4, ip6},
+	}
+	st := &Status{
+		MagicDNSSuffix: "example.com",
+		Peer: map[key.Public]*PeerStatus{
+			{1}: web,
+			{2}: {DNSName: "db-1.example.com.", HostName: "db-1-host"},
+		},
+	}
+	for _, name := range []string{"web-1", "web-1-host", "web-1.example.com", "web-1.example.com.", ip4.String(), ip6.String()} {
+		if got := st.FindPeer(name); got != web {
+			t.Errorf("FindPeer(%q) = %v; want web-1", name, got)
+		}
+	}
+	for _, name := range []string{"", "web-2", "100.101.102.104"} {
+		if got := st.FindPeer(name); got != nil {
+			t.Errorf("FindPeer(%q) = %v; want nil", name, got)
+		}
+	}
+}
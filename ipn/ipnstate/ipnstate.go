@@ -40,6 +40,16 @@ type Status struct {
 
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
+
+	// PeerTotal, if non-nil, is the number of peers that matched
+	// the StatusFilter that produced this Status, before its Offset
+	// and Limit were applied. It's nil if the Status wasn't filtered.
+	PeerTotal *int `json:",omitempty"`
+
+	// Health contains the node's health problems, one per line,
+	// such as IP forwarding being off while it advertises routes.
+	// It's empty if there aren't any.
+	Health []string `json:",omitempty"`
 }
 
 func (s *Status) Peers() []key.Public {
@@ -57,6 +67,25 @@ type PeerStatusLite struct {
 	NodeKey          tailcfg.NodeKey
 }
 
+// LatencySample is a disco ping round-trip time to one of a peer's
+// endpoints.
+type LatencySample struct {
+	Endpoint       string    // ip:port pinged
+	At             time.Time // when the pong arrived
+	LatencySeconds float64
+}
+
+// PathQuality is the measured quality of the direct path to one of a
+// peer's endpoints, from its recent disco pings.
+type PathQuality struct {
+	Endpoint       string  // ip:port pinged
+	LatencySeconds float64 // mean round-trip time
+	JitterSeconds  float64 // mean change in round-trip time between pongs
+	Loss           float64 // fraction of pings unanswered, from 0 to 1
+	Pings          int     // number of pings the measurements cover
+	MTU            int     // largest padded ping, in bytes of IP packet, that got a pong; 0 if none yet
+}
+
 type PeerStatus struct {
 	PublicKey key.Public
 	HostName  string // HostInfo's Hostname (not a DNS name or necessarily unique)
@@ -64,13 +93,28 @@ type PeerStatus struct {
 	OS        string // HostInfo.OS
 	UserID    tailcfg.UserID
 
-	TailAddr string // Tailscale IP
+	TailAddr     string       // Tailscale IP
+	TailscaleIPs []netaddr.IP // all of the peer's Tailscale IPs, IPv4 first
 
 	// Endpoints:
 	Addrs   []string
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PathType is how packets to the peer are currently sent: "direct"
+	// to CurAddr, "derp" via the Relay region, or "direct+derp" while
+	// an expired direct path is being reconfirmed. It's empty if
+	// nothing has been sent to the peer.
+	PathType string `json:",omitempty"`
+
+	// Latencies are recent disco ping round-trip times to the peer's
+	// endpoints, most recent first.
+	Latencies []LatencySample `json:",omitempty"`
+
+	// Paths are the measured qualities of the direct paths to the
+	// peer's endpoints that have been probed, best first.
+	Paths []PathQuality `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
@@ -80,6 +124,19 @@ type PeerStatus struct {
 	KeepAlive     bool
 	ExitNode      bool // true if this is the currently selected exit node.
 
+	// Services are the services the peer advertises in its Hostinfo.
+	Services []tailcfg.Service `json:",omitempty"`
+
+	// Tags are the ACL tags the peer advertises in its Hostinfo.
+	Tags []string `json:",omitempty"`
+
+	// Version is the peer's Tailscale version, from its Hostinfo.
+	Version string `json:",omitempty"`
+
+	// Health is the health summary the peer publishes in its
+	// Hostinfo, or nil if it doesn't.
+	Health *tailcfg.HealthSummary `json:",omitempty"`
+
 	// ShareeNode indicates this node exists in the netmap because
 	// it's owned by a shared-to user and that node might connect
 	// to us. These nodes should be hidden by "tailscale status"
@@ -117,6 +174,13 @@ func (sb *StatusBuilder) SetAuthURL(v string) {
 	sb.st.AuthURL = v
 }
 
+// AddHealth adds health problem v to the status.
+func (sb *StatusBuilder) AddHealth(v string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.st.Health = append(sb.st.Health, v)
+}
+
 func (sb *StatusBuilder) SetMagicDNSSuffix(v string) {
 	sb.mu.Lock()
 	defer sb.mu.Unlock()
@@ -137,6 +201,18 @@ func (sb *StatusBuilder) SetSelfStatus(ss *PeerStatus) {
 	sb.st.Self = ss
 }
 
+// SetSelfHostinfo sets the parts of the local machine's status that
+// come from its Hostinfo. It must be called after SetSelfStatus.
+func (sb *StatusBuilder) SetSelfHostinfo(hi *tailcfg.Hostinfo) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.st.Self == nil || hi == nil {
+		return
+	}
+	sb.st.Self.Version = hi.IPNVersion
+	sb.st.Self.Health = hi.Health
+}
+
 // AddUser adds a user profile to the status.
 func (sb *StatusBuilder) AddUser(id tailcfg.UserID, up tailcfg.UserProfile) {
 	sb.mu.Lock()
@@ -205,6 +281,9 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.TailAddr; v != "" {
 		e.TailAddr = v
 	}
+	if v := st.TailscaleIPs; v != nil {
+		e.TailscaleIPs = v
+	}
 	if v := st.OS; v != "" {
 		e.OS = st.OS
 	}
@@ -214,6 +293,27 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PathType; v != "" {
+		e.PathType = v
+	}
+	if v := st.Latencies; v != nil {
+		e.Latencies = v
+	}
+	if v := st.Paths; v != nil {
+		e.Paths = v
+	}
+	if v := st.Services; v != nil {
+		e.Services = v
+	}
+	if v := st.Tags; v != nil {
+		e.Tags = v
+	}
+	if v := st.Version; v != "" {
+		e.Version = v
+	}
+	if v := st.Health; v != nil {
+		e.Health = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
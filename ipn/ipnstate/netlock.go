@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+)
+
+// NetworkLockStatus is the state of tailnet lock on this node, as
+// served by the LocalAPI's /tka/status endpoint.
+type NetworkLockStatus struct {
+	// Enabled is whether the node ignores peers whose node keys
+	// aren't signed by one of TrustedKeys.
+	Enabled     bool
+	TrustedKeys []tka.PublicKey `json:",omitempty"`
+
+	// PublicKey is the public half of this node's signing key, if
+	// it has one, with which it can sign other nodes' keys.
+	PublicKey *tka.PublicKey `json:",omitempty"`
+
+	// NodeKey is this node's node key, and NodeKeySigned whether
+	// it has a trusted signature, without which the tailnet's other
+	// locked nodes ignore it.
+	NodeKey       tailcfg.NodeKey
+	NodeKeySigned bool
+
+	// FilteredPeers are the peers in the netmap that are being
+	// ignored for lack of a trusted signature.
+	FilteredPeers []*LockedOutPeer `json:",omitempty"`
+}
+
+// LockedOutPeer is a peer ignored by tailnet lock.
+type LockedOutPeer struct {
+	Name    string
+	NodeKey tailcfg.NodeKey
+	Error   string // why its signature isn't trusted
+}
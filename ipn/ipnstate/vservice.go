@@ -0,0 +1,38 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import "time"
+
+// VirtualServiceStatus is the state of one of the VirtualServices
+// prefs, as served by the LocalAPI's /virtual-services/status endpoint.
+type VirtualServiceStatus struct {
+	Name string
+	Addr string // the local address it listens on
+
+	// Error is why it's not listening, if it's not.
+	Error string `json:",omitempty"`
+
+	Backends []VirtualServiceBackend
+}
+
+// VirtualServiceBackend is the state of one of the peers that a
+// virtual service forwards to.
+type VirtualServiceBackend struct {
+	Peer string // the peer's MagicDNS name
+	Addr string // the ip:port connected to
+
+	// Healthy is whether the last health check or connection to the
+	// backend succeeded. Backends are healthy until shown otherwise.
+	Healthy bool
+
+	// LatencySeconds is how long the last successful connection took
+	// to establish, or zero if none has.
+	LatencySeconds float64 `json:",omitempty"`
+
+	LastCheck   time.Time `json:",omitempty"`
+	ActiveConns int       // connections currently forwarded to it
+	TotalConns  uint64    // connections forwarded to it in total
+}
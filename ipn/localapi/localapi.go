@@ -3,17 +3,113 @@
 // license that can be found in the LICENSE file.
 
 // Package localapi contains the HTTP server handlers for tailscaled's API server.
+//
+// The LocalAPI is served over tailscaled's IPC socket (a Unix socket or
+// Windows named pipe) under the /localapi/v0/ path prefix. Its endpoints are:
+//
+//	GET  /localapi/v0/status      the current ipnstate.Status, as JSON; see ipnstate.StatusFilter
+//	                              for the query parameters that select and page through peers
+//	GET  /localapi/v0/peer-stats  per-peer connection statistics, as a JSON []ipnstate.PeerConnStats
+//	GET  /localapi/v0/filter-stats  the packet filter's per-rule and drop counters, as a JSON filter.Stats
+//	GET  /localapi/v0/dns-query-log  the MagicDNS resolver's recent queries, as a JSON
+//	                              ipnstate.DNSQueryLog; requires write access
+//	POST /localapi/v0/dns-query-log?enable=BOOL&answers=BOOL  turn the query log on or off,
+//	                              and set whether it records answers
+//	GET  /localapi/v0/dns-status  the DNS configuration tailscaled has programmed into the OS and
+//	                              its resolver, as a JSON ipnstate.DNSStatus
+//	POST /localapi/v0/dns-query   answer the DNS message in the body, in DNS-over-HTTPS
+//	                              (application/dns-message) form, as MagicDNS would
+//	GET  /localapi/v0/prefs       the current ipn.Prefs, as JSON
+//	POST /localapi/v0/prefs       replace the ipn.Prefs with the JSON request body
+//	PATCH /localapi/v0/prefs      change only the prefs that the JSON ipn.MaskedPrefs body marks as set
+//	GET  /localapi/v0/netmap      the current netmap.NetworkMap, as JSON
+//	GET  /localapi/v0/watch       a stream of newline-delimited JSON ipn.Notify values; while a
+//	                              login is pending, the first has the auth URL in BrowseToURL
+//	GET  /localapi/v0/profiles    the login profiles, as a JSON ipn.LoginProfiles
+//	POST /localapi/v0/profiles/switch?name=NAME  switch to (or create) profile NAME
+//	POST /localapi/v0/profiles/delete?name=NAME  delete profile NAME
+//	GET  /localapi/v0/network-locations  the prefs applied on particular networks and the current
+//	                              network's ID, as a JSON ipn.NetworkLocations
+//	POST /localapi/v0/network-locations/save?network=ID  remember the current exit node and shields
+//	                              up prefs for network ID, or for the current network if omitted
+//	POST /localapi/v0/network-locations/delete?network=ID  forget the prefs for network ID, or for
+//	                              the current network if omitted
+//	GET  /localapi/v0/groups      the user's peer groups, as a JSON ipn.PeerGroups
+//	POST /localapi/v0/groups?name=NAME  set peer group NAME's members to the JSON []string body
+//	GET  /localapi/v0/serve       the services served on the node's Tailscale IPs, as a JSON []ipn.ServeHandler
+//	POST /localapi/v0/serve       replace the served services with the JSON []ipn.ServeHandler body
+//	GET  /localapi/v0/virtual-services  the load balanced virtual services, as a JSON []ipn.VirtualService
+//	POST /localapi/v0/virtual-services  replace the virtual services with the JSON []ipn.VirtualService body
+//	GET  /localapi/v0/virtual-services/status  the virtual services' backends and their health, as a
+//	                              JSON []ipnstate.VirtualServiceStatus
+//	GET  /localapi/v0/cert?domain=NAME&type=pair|cert|key  a TLS certificate and/or key for the
+//	                              node's DNS name or CertDomains pref NAME, as PEM; requires write access
+//	GET  /localapi/v0/containers  the container network namespaces attached to the tailnet, as JSON
+//	POST /localapi/v0/containers/attach?target=PID|NETNS  attach a container's network namespace
+//	POST /localapi/v0/containers/detach?id=ID  detach an attached namespace
+//	GET  /localapi/v0/network-changes  the accepted network config and any pending change, for the
+//	                              ConfirmNetworkChanges pref, as a JSON ipn.NetworkChanges
+//	POST /localapi/v0/network-changes/accept  apply the pending change, which must equal the JSON
+//	                              ipn.NetworkConfig body
+//	POST /localapi/v0/login-interactive  start an interactive login; its URL appears in status
+//	GET  /localapi/v0/web         the web UI's HTML page, for "tailscale web" to proxy to
+//	POST /localapi/v0/web         a web UI form submission, which must be same-origin; see ipn.WebPathHeader
+//	GET  /localapi/v0/tka/status  the state of tailnet lock on this node, as a JSON
+//	                              ipnstate.NetworkLockStatus
+//	POST /localapi/v0/tka/init    enable tailnet lock, trusting a new signing key for this node and
+//	                              the other signing keys in the JSON []tka.PublicKey body
+//	POST /localapi/v0/tka/sign?nodekey=KEY  sign node key KEY with this node's signing key and send
+//	                              the signature to the control server
+//	POST /localapi/v0/tka/add     trust the signing keys in the JSON []tka.PublicKey body
+//	POST /localapi/v0/tka/remove  stop trusting the signing keys in the JSON []tka.PublicKey body
+//	POST /localapi/v0/tka/disable  turn tailnet lock off, forgetting the trusted keys
+//	POST /localapi/v0/dial        connect to the host:port in the Dial-Host and Dial-Port headers
+//	                              through the tailnet and, with "Upgrade: ts-dial", switch
+//	                              protocols to proxy the TCP stream; requires write access
+//	GET  /localapi/v0/whois       the node and user owning the "addr" IP:port
+//	GET  /localapi/v0/goroutines  a dump of tailscaled's goroutines
+//	GET  /localapi/v0/tasks       tailscaled's periodic tasks and when they last and next run, as a
+//	                              JSON []sched.TaskStatus
+//	POST /localapi/v0/tasks/run?name=NAME  run periodic task NAME now
+//	GET  /localapi/v0/pprof?name=NAME&seconds=N  pprof profile NAME ("profile" for CPU, "heap",
+//	                              "goroutine", "allocs", "block", "mutex" or "threadcreate"), in the
+//	                              pprof format; CPU profiles last N seconds (default 30); requires
+//	                              write access
+//	GET  /localapi/v0/debug-magicsock  magicsock's path discovery state for each peer, as a
+//	                              JSON ipnstate.MagicsockDebug
+//	GET  /localapi/v0/debug-link-events  the network changes tailscaled recently noticed, as a
+//	                              JSON []ipnstate.LinkEvent
+//	GET  /localapi/v0/debug-capture?filter=EXPR  a pcap stream of the packets going through the
+//	                              TUN device, optionally filtered; requires write access
+//
+// Private keys are never returned by the LocalAPI, other than the
+// TLS certificate keys from /cert.
 package localapi
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/wgkey"
+	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 )
 
 func NewHandler(b *ipnlocal.LocalBackend) *Handler {
@@ -56,11 +152,165 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveWhoIs(w, r)
 	case "/localapi/v0/goroutines":
 		h.serveGoroutines(w, r)
+	case "/localapi/v0/tasks":
+		h.serveTasks(w, r)
+	case "/localapi/v0/tasks/run":
+		h.serveRunTask(w, r)
+	case "/localapi/v0/pprof":
+		h.servePprof(w, r)
+	case "/localapi/v0/debug-magicsock":
+		h.serveDebugMagicsock(w, r)
+	case "/localapi/v0/debug-link-events":
+		h.serveDebugLinkEvents(w, r)
+	case "/localapi/v0/debug-capture":
+		h.serveDebugCapture(w, r)
+	case "/localapi/v0/status":
+		h.serveStatus(w, r)
+	case "/localapi/v0/peer-stats":
+		h.servePeerStats(w, r)
+	case "/localapi/v0/filter-stats":
+		h.serveFilterStats(w, r)
+	case "/localapi/v0/dns-query-log":
+		h.serveDNSQueryLog(w, r)
+	case "/localapi/v0/dns-query":
+		h.serveDNSQuery(w, r)
+	case "/localapi/v0/dns-status":
+		h.serveDNSStatus(w, r)
+	case "/localapi/v0/prefs":
+		h.servePrefs(w, r)
+	case "/localapi/v0/netmap":
+		h.serveNetMap(w, r)
+	case "/localapi/v0/watch":
+		h.serveWatch(w, r)
+	case "/localapi/v0/profiles":
+		h.serveProfiles(w, r)
+	case "/localapi/v0/profiles/switch", "/localapi/v0/profiles/delete":
+		h.serveProfileAction(w, r)
+	case "/localapi/v0/network-locations":
+		h.serveNetworkLocations(w, r)
+	case "/localapi/v0/network-locations/save", "/localapi/v0/network-locations/delete":
+		h.serveNetworkLocationAction(w, r)
+	case "/localapi/v0/groups":
+		h.serveGroups(w, r)
+	case "/localapi/v0/serve":
+		h.serveServe(w, r)
+	case "/localapi/v0/virtual-services":
+		h.serveVirtualServices(w, r)
+	case "/localapi/v0/virtual-services/status":
+		h.serveVirtualServiceStatus(w, r)
+	case "/localapi/v0/cert":
+		h.serveCert(w, r)
+	case "/localapi/v0/containers":
+		h.serveContainers(w, r)
+	case "/localapi/v0/containers/attach", "/localapi/v0/containers/detach":
+		h.serveContainerAction(w, r)
+	case "/localapi/v0/network-changes":
+		h.serveNetworkChanges(w, r)
+	case "/localapi/v0/network-changes/accept":
+		h.serveAcceptNetworkChanges(w, r)
+	case "/localapi/v0/login-interactive":
+		h.serveLoginInteractive(w, r)
+	case "/localapi/v0/web":
+		h.serveWeb(w, r)
+	case "/localapi/v0/tka/status":
+		h.serveTKAStatus(w, r)
+	case "/localapi/v0/tka/init":
+		h.serveTKAInit(w, r)
+	case "/localapi/v0/tka/sign":
+		h.serveTKASign(w, r)
+	case "/localapi/v0/tka/add":
+		h.serveTKAModify(w, r, true)
+	case "/localapi/v0/tka/remove":
+		h.serveTKAModify(w, r, false)
+	case "/localapi/v0/tka/disable":
+		h.serveTKADisable(w, r)
+	case "/localapi/v0/dial":
+		h.serveDial(w, r)
 	default:
 		io.WriteString(w, "tailscaled\n")
 	}
 }
 
+// serveDial connects to a host and port through the tailnet and
+// hijacks the request's connection to proxy the TCP stream to it, so
+// that clients on machines without a TUN device can reach peers.
+func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
+	// The connection is made with tailscaled's access to the tailnet,
+	// so require write access.
+	if !h.PermitWrite {
+		http.Error(w, "dial access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	serveDialProxy(w, r, h.b.DialTailnet)
+}
+
+// serveDialProxy dials the host and port in r's Dial-Host and
+// Dial-Port headers with dial, then hijacks r's connection and proxies
+// the TCP stream between the two.
+//
+// Each direction is half-closed when its source reaches EOF, so that
+// a client can send a request, close its side, and still read the
+// whole response. The connections are closed once both directions are
+// done.
+func serveDialProxy(w http.ResponseWriter, r *http.Request, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	if r.Header.Get("Upgrade") != "ts-dial" {
+		http.Error(w, "missing 'Upgrade: ts-dial' header", http.StatusBadRequest)
+		return
+	}
+	host, port := r.Header.Get("Dial-Host"), r.Header.Get("Dial-Port")
+	if host == "" || port == "" {
+		http.Error(w, "missing Dial-Host or Dial-Port header", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection hijacking unsupported", http.StatusInternalServerError)
+		return
+	}
+	outConn, err := dial(r.Context(), net.JoinHostPort(host, port))
+	if err != nil {
+		http.Error(w, "dial failure: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outConn.Close()
+
+	reqConn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer reqConn.Close()
+	io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: ts-dial\r\nConnection: upgrade\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(reqConn, outConn)
+		closeWrite(reqConn)
+		done <- true
+	}()
+	go func() {
+		// Read from brw, which may have buffered the start of the stream.
+		io.Copy(outConn, brw)
+		closeWrite(outConn)
+		done <- true
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite shuts down the writing side of c, if it supports that.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
 func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "whois access denied", http.StatusForbidden)
@@ -109,3 +359,775 @@ func (h *Handler) serveGoroutines(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(buf)
 }
+
+// maxCPUProfile is the longest CPU profile servePprof takes.
+const maxCPUProfile = 5 * time.Minute
+
+func (h *Handler) servePprof(w http.ResponseWriter, r *http.Request) {
+	// Profiles can include memory contents (heap) and stacks
+	// (goroutine), so require write access, as for goroutines.
+	if !h.PermitWrite {
+		http.Error(w, "profile access denied", http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	if name != "profile" {
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		p.WriteTo(w, 0)
+		return
+	}
+
+	d := 30 * time.Second
+	if v := r.FormValue("seconds"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			http.Error(w, "invalid 'seconds' parameter", 400)
+			return
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d > maxCPUProfile {
+		http.Error(w, "profile too long; the maximum is "+maxCPUProfile.String(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Most likely another CPU profile is already running.
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer pprof.StopCPUProfile()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+func (h *Handler) serveDebugMagicsock(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "magicsock debug access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.DebugMagicsock())
+}
+
+func (h *Handler) serveDebugLinkEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "link events access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.LinkEvents())
+}
+
+func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
+	// Packet contents are at least as sensitive as anything else
+	// the LocalAPI returns, so require write access.
+	if !h.PermitWrite {
+		http.Error(w, "debug capture access denied", http.StatusForbidden)
+		return
+	}
+	f, err := capture.ParseFilter(r.FormValue("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	h.b.StreamDebugCapture(r.Context(), w, f)
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "status access denied", http.StatusForbidden)
+		return
+	}
+	f, err := ipnstate.StatusFilterFromValues(r.URL.Query())
+	if err != nil {
+		http.Error(w, "invalid status filter: "+err.Error(), 400)
+		return
+	}
+	if f.Group != "" {
+		groups, err := h.b.PeerGroups()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		members, ok := groups[f.Group]
+		if !ok {
+			http.Error(w, "no such peer group", 404)
+			return
+		}
+		f.Peers = append(f.Peers, members...)
+	}
+	writeJSON(w, h.b.Status().Filter(f, time.Now()))
+}
+
+func (h *Handler) servePeerStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "peer stats access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.Status().ConnStats())
+}
+
+func (h *Handler) serveFilterStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "filter stats access denied", http.StatusForbidden)
+		return
+	}
+	st := h.b.FilterStats()
+	if st == nil {
+		http.Error(w, "no packet filter", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, st)
+}
+
+func (h *Handler) serveDNSStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "DNS status access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.DNSStatus())
+}
+
+func (h *Handler) serveTasks(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "tasks access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.Tasks())
+}
+
+func (h *Handler) serveRunTask(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "run task access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	if !h.b.RunTask(name) {
+		http.Error(w, "no such task", http.StatusNotFound)
+	}
+}
+
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// The names a user looks up say a lot about what they're doing,
+	// so require write access even to read the log.
+	if !h.PermitWrite {
+		http.Error(w, "DNS query log access denied", http.StatusForbidden)
+		return
+	}
+	l := h.b.DNSQueryLog()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		on, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "invalid enable value", 400)
+			return
+		}
+		var answers bool
+		if v := r.FormValue("answers"); v != "" {
+			answers, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid answers value", 400)
+				return
+			}
+		}
+		l.SetEnabled(on, answers)
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, l.Snapshot())
+}
+
+// maxDNSMessageSize is the largest DNS message that serveDNSQuery
+// accepts, the most that fits in a TCP DNS message.
+const maxDNSMessageSize = 65535
+
+func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "DNS query access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDNSMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(query) == 0 || len(query) > maxDNSMessageSize {
+		http.Error(w, "invalid DNS message size", 400)
+		return
+	}
+	resp, err := h.b.QueryDNS(r.Context(), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "prefs access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "prefs write access denied", http.StatusForbidden)
+			return
+		}
+		p := new(ipn.Prefs)
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			http.Error(w, "invalid JSON prefs: "+err.Error(), 400)
+			return
+		}
+		h.b.SetPrefs(p)
+	case "PATCH":
+		if !h.PermitWrite {
+			http.Error(w, "prefs write access denied", http.StatusForbidden)
+			return
+		}
+		mp := new(ipn.MaskedPrefs)
+		if err := json.NewDecoder(r.Body).Decode(mp); err != nil {
+			http.Error(w, "invalid JSON masked prefs: "+err.Error(), 400)
+			return
+		}
+		if _, err := h.b.EditPrefs(mp); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		http.Error(w, "use GET, POST or PATCH", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, redactPrefs(h.b.Prefs()))
+}
+
+func (h *Handler) serveNetMap(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netmap access denied", http.StatusForbidden)
+		return
+	}
+	nm := h.b.NetMap()
+	if nm == nil {
+		http.Error(w, "no netmap", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, redactNetMap(nm))
+}
+
+// serveWatch streams the backend's notifications to the client as
+// newline-delimited JSON until the client goes away. The first
+// notification sent describes the current state, prefs and netmap,
+// and has BrowseToURL set if an interactive login is waiting on it.
+func (h *Handler) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "watch access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	st := h.b.State()
+	first := ipn.Notify{
+		Version: version.Long,
+		State:   &st,
+		Prefs:   h.b.Prefs(),
+		NetMap:  h.b.NetMap(),
+	}
+	if url := h.b.LoginURL(); url != "" {
+		// Let watchers that connect after the login URL was
+		// sent, such as remote tooling on a headless machine,
+		// still find it.
+		first.BrowseToURL = &url
+	}
+	if err := enc.Encode(redactNotify(first)); err != nil {
+		return
+	}
+	f.Flush()
+
+	h.b.WatchNotifications(r.Context(), func(n ipn.Notify) bool {
+		if err := enc.Encode(redactNotify(n)); err != nil {
+			return false
+		}
+		f.Flush()
+		return true
+	})
+}
+
+func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "profiles access denied", http.StatusForbidden)
+		return
+	}
+	lp, err := h.b.Profiles()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, lp)
+}
+
+func (h *Handler) serveProfileAction(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "profiles write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/switch") {
+		err = h.b.SwitchProfile(name)
+	} else {
+		err = h.b.DeleteProfile(name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	h.serveProfiles(w, r)
+}
+
+func (h *Handler) serveNetworkLocations(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "network locations access denied", http.StatusForbidden)
+		return
+	}
+	nl, err := h.b.NetworkLocations()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, nl)
+}
+
+func (h *Handler) serveNetworkLocationAction(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network locations write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	network := r.FormValue("network")
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/save") {
+		err = h.b.SaveNetworkLocation(network)
+	} else {
+		err = h.b.DeleteNetworkLocation(network)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	h.serveNetworkLocations(w, r)
+}
+
+func (h *Handler) serveNetworkChanges(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "network changes access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.NetworkChanges())
+}
+
+func (h *Handler) serveAcceptNetworkChanges(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network changes write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	want := new(ipn.NetworkConfig)
+	if err := json.NewDecoder(r.Body).Decode(want); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := h.b.AcceptNetworkChanges(want); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, h.b.NetworkChanges())
+}
+
+func (h *Handler) serveGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "groups access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "groups write access denied", http.StatusForbidden)
+			return
+		}
+		var members []string
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			http.Error(w, "invalid JSON members: "+err.Error(), 400)
+			return
+		}
+		if err := h.b.SetPeerGroup(r.FormValue("name"), members); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	groups, err := h.b.PeerGroups()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, groups)
+}
+
+func (h *Handler) serveServe(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "serve access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "serve write access denied", http.StatusForbidden)
+			return
+		}
+		var handlers []ipn.ServeHandler
+		if err := json.NewDecoder(r.Body).Decode(&handlers); err != nil {
+			http.Error(w, "invalid JSON handlers: "+err.Error(), 400)
+			return
+		}
+		if err := h.b.SetServe(handlers); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	handlers := []ipn.ServeHandler{}
+	if p := h.b.Prefs(); p != nil {
+		handlers = append(handlers, p.Serve...)
+	}
+	writeJSON(w, handlers)
+}
+
+func (h *Handler) serveVirtualServices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "virtual services access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "virtual services write access denied", http.StatusForbidden)
+			return
+		}
+		var services []ipn.VirtualService
+		if err := json.NewDecoder(r.Body).Decode(&services); err != nil {
+			http.Error(w, "invalid JSON virtual services: "+err.Error(), 400)
+			return
+		}
+		if err := h.b.SetVirtualServices(services); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	services := []ipn.VirtualService{}
+	if p := h.b.Prefs(); p != nil {
+		services = append(services, p.VirtualServices...)
+	}
+	writeJSON(w, services)
+}
+
+func (h *Handler) serveVirtualServiceStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "virtual services access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.VirtualServiceStatus())
+}
+
+func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "cert access denied", http.StatusForbidden)
+		return
+	}
+	domain := r.FormValue("domain")
+	if domain == "" {
+		http.Error(w, "missing 'domain' parameter", 400)
+		return
+	}
+	typ := r.FormValue("type")
+	switch typ {
+	case "":
+		typ = "pair"
+	case "pair", "cert", "key":
+	default:
+		http.Error(w, "invalid 'type' parameter; want pair, cert or key", 400)
+		return
+	}
+	certPEM, keyPEM, err := h.b.GetCertPEM(r.Context(), domain)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if typ == "pair" || typ == "cert" {
+		w.Write(certPEM)
+	}
+	if typ == "pair" || typ == "key" {
+		w.Write(keyPEM)
+	}
+}
+
+func (h *Handler) serveContainers(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "containers access denied", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, h.b.Containers())
+}
+
+func (h *Handler) serveContainerAction(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "containers write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/attach") {
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "missing 'target' parameter", 400)
+			return
+		}
+		a, err := h.b.AttachContainer(target)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, a)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing 'id' parameter", 400)
+		return
+	}
+	if err := h.b.DetachContainer(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.serveContainers(w, r)
+}
+
+func (h *Handler) serveLoginInteractive(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "login access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.b.State() == ipn.NoState {
+		http.Error(w, "backend not started; run 'tailscale up'", http.StatusConflict)
+		return
+	}
+	h.b.StartLoginInteractive()
+}
+
+func (h *Handler) serveTKAStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "tailnet lock access denied", http.StatusForbidden)
+		return
+	}
+	st, err := h.b.NetworkLockStatus()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, st)
+}
+
+func (h *Handler) serveTKAInit(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "tailnet lock write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var keys []tka.PublicKey
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "invalid JSON keys: "+err.Error(), 400)
+		return
+	}
+	if err := h.b.NetworkLockInit(r.Context(), keys); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.serveTKAStatus(w, r)
+}
+
+func (h *Handler) serveTKASign(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "tailnet lock write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var nk tailcfg.NodeKey
+	if err := nk.UnmarshalText([]byte(r.FormValue("nodekey"))); err != nil {
+		http.Error(w, "invalid nodekey: "+err.Error(), 400)
+		return
+	}
+	if err := h.b.NetworkLockSign(r.Context(), nk); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	io.WriteString(w, "{}\n")
+}
+
+// serveTKAModify trusts (if add) or stops trusting the signing keys in
+// the request body.
+func (h *Handler) serveTKAModify(w http.ResponseWriter, r *http.Request, add bool) {
+	if !h.PermitWrite {
+		http.Error(w, "tailnet lock write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var keys []tka.PublicKey
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "invalid JSON keys: "+err.Error(), 400)
+		return
+	}
+	var err error
+	if add {
+		err = h.b.NetworkLockModify(keys, nil)
+	} else {
+		err = h.b.NetworkLockModify(nil, keys)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.serveTKAStatus(w, r)
+}
+
+func (h *Handler) serveTKADisable(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "tailnet lock write access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.b.NetworkLockDisable(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.serveTKAStatus(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, "JSON encoding error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// redactPrefs returns a copy of p without its private keys.
+func redactPrefs(p *ipn.Prefs) *ipn.Prefs {
+	if p == nil || p.Persist == nil {
+		return p
+	}
+	p2 := p.Clone()
+	p2.Persist = &persist.Persist{
+		Provider:  p.Persist.Provider,
+		LoginName: p.Persist.LoginName,
+	}
+	return p2
+}
+
+// redactNetMap returns a shallow copy of nm without its private key.
+func redactNetMap(nm *netmap.NetworkMap) *netmap.NetworkMap {
+	if nm == nil {
+		return nil
+	}
+	nm2 := *nm
+	nm2.PrivateKey = wgkey.Private{}
+	return &nm2
+}
+
+func redactNotify(n ipn.Notify) ipn.Notify {
+	n.Prefs = redactPrefs(n.Prefs)
+	n.NetMap = redactNetMap(n.NetMap)
+	return n
+}
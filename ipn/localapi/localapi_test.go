@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeDialHalfClose(t *testing.T) {
+	// The upstream is like an HTTP/1.0 server: it reads the whole
+	// request, up to EOF, before it answers.
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, _ := ioutil.ReadAll(c)
+		c.Write([]byte("got " + string(req)))
+	}()
+
+	var dialed string
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = addr
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", upstream.Addr().String())
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveDialProxy(w, r, dial)
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, _ := http.NewRequest("POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	req.Header = http.Header{
+		"Upgrade":    []string{"ts-dial"},
+		"Connection": []string{"upgrade"},
+		"Dial-Host":  []string{"peer"},
+		"Dial-Port":  []string{"80"},
+	}
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %v; want 101", res.Status)
+	}
+	if dialed != "peer:80" {
+		t.Errorf("dialed %q; want peer:80", dialed)
+	}
+
+	c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "got GET / HTTP/1.0\r\n\r\n"; string(got) != want {
+		t.Errorf("response = %q; want %q", got, want)
+	}
+}
+
+func TestServeDialBadRequest(t *testing.T) {
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		t.Errorf("unexpected dial of %q", addr)
+		return nil, net.ErrClosed
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveDialProxy(w, r, dial)
+	}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL, "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %v; want 400", res.Status)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// serveWeb serves the web UI. All requests go to the same path: GETs
+// render the page and POSTs, with an "action" form value, change
+// things and redirect back to it. That lets the proxy serve the UI at
+// any path, as CGI scripts are.
+func (h *Handler) serveWeb(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(ipn.WebLoopbackOnlyHeader) == "true" && !isLoopbackHost(r.Host) {
+		http.Error(w, "invalid Host header", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		if !h.PermitRead {
+			http.Error(w, "web access denied", http.StatusForbidden)
+			return
+		}
+		var buf bytes.Buffer
+		writeWebPage(&buf, h.b.Status(), h.b.Prefs())
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(buf.Bytes())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "web access denied", http.StatusForbidden)
+			return
+		}
+		if err := checkSameOrigin(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := h.doWebAction(r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		path := r.Header.Get(ipn.WebPathHeader)
+		if path == "" {
+			path = r.URL.Path
+		}
+		http.Redirect(w, r, path, http.StatusSeeOther)
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// webPrefs are the boolean prefs the web UI has toggles for.
+var webPrefs = []struct {
+	name  string // form field name
+	label string
+	field func(*ipn.MaskedPrefs) (v, set *bool)
+}{
+	{"connected", "Connected", func(mp *ipn.MaskedPrefs) (v, set *bool) { return &mp.WantRunning, &mp.WantRunningSet }},
+	{"routes", "Use subnet routes from other machines", func(mp *ipn.MaskedPrefs) (v, set *bool) { return &mp.RouteAll, &mp.RouteAllSet }},
+	{"dns", "Use Tailscale DNS settings", func(mp *ipn.MaskedPrefs) (v, set *bool) { return &mp.CorpDNS, &mp.CorpDNSSet }},
+	{"shields", "Block incoming connections", func(mp *ipn.MaskedPrefs) (v, set *bool) { return &mp.ShieldsUp, &mp.ShieldsUpSet }},
+	{"ssh", "Run Tailscale SSH server", func(mp *ipn.MaskedPrefs) (v, set *bool) { return &mp.RunSSH, &mp.RunSSHSet }},
+}
+
+func (h *Handler) doWebAction(r *http.Request) error {
+	switch action := r.FormValue("action"); action {
+	case "login":
+		if h.b.State() == ipn.NoState {
+			return errors.New("backend not started; run 'tailscale up'")
+		}
+		h.b.StartLoginInteractive()
+		return nil
+	case "prefs":
+		mp := new(ipn.MaskedPrefs)
+		for _, wp := range webPrefs {
+			v, set := wp.field(mp)
+			*v, *set = r.FormValue(wp.name) == "on", true
+		}
+		_, err := h.b.EditPrefs(mp)
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+func writeWebPage(buf *bytes.Buffer, st *ipnstate.Status, prefs *ipn.Prefs) {
+	f := func(format string, args ...interface{}) { fmt.Fprintf(buf, format, args...) }
+
+	needsLogin := st.BackendState == ipn.NeedsLogin.String() || st.BackendState == ipn.NoState.String()
+	f(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+`)
+	if needsLogin && st.AuthURL == "" || st.BackendState == ipn.Starting.String() {
+		// Waiting on tailscaled; check back shortly.
+		f("<meta http-equiv=\"refresh\" content=\"3\">\n")
+	}
+	f(`<title>Tailscale</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>Tailscale</h1>
+`)
+	f("<p>State: <b>%s</b></p>\n", html.EscapeString(st.BackendState))
+
+	if needsLogin {
+		if st.AuthURL != "" {
+			f("<p><a href=\"%s\" target=\"_blank\" rel=\"noopener\">Log in</a> to connect this machine to your tailnet.</p>\n", html.EscapeString(st.AuthURL))
+		} else {
+			f("<form method=\"post\"><input type=\"hidden\" name=\"action\" value=\"login\"><button>Log in</button></form>\n")
+		}
+	}
+	if st.Self != nil && !st.Self.UserID.IsZero() {
+		login := st.User[st.Self.UserID].LoginName
+		f("<p>Logged in as <b>%s</b> on <b>%s</b>", html.EscapeString(login), html.EscapeString(strings.TrimSuffix(st.Self.DNSName, ".")))
+		ips := make([]string, 0, len(st.TailscaleIPs))
+		for _, ip := range st.TailscaleIPs {
+			ips = append(ips, ip.String())
+		}
+		f(" (%s)</p>\n", strings.Join(ips, ", "))
+	}
+
+	if prefs != nil {
+		mp := &ipn.MaskedPrefs{Prefs: *prefs}
+		f("<h2>Settings</h2>\n<form method=\"post\">\n<input type=\"hidden\" name=\"action\" value=\"prefs\">\n")
+		for _, wp := range webPrefs {
+			checked := ""
+			if v, _ := wp.field(mp); *v {
+				checked = " checked"
+			}
+			f("<label><input type=\"checkbox\" name=\"%s\"%s> %s</label><br>\n", wp.name, checked, wp.label)
+		}
+		f("<p><button>Save</button></p>\n</form>\n")
+	}
+
+	var peers []*ipnstate.PeerStatus
+	for _, k := range st.Peers() {
+		if ps := st.Peer[k]; !ps.ShareeNode {
+			peers = append(peers, ps)
+		}
+	}
+	ipnstate.SortPeers(peers)
+	f("<h2>Machines</h2>\n")
+	if len(peers) == 0 {
+		f("<p class=\"muted\">No other machines.</p>\n")
+	} else {
+		f("<table>\n<tr><th>Name</th><th>Address</th><th>Owner</th><th>OS</th><th>Activity</th></tr>\n")
+		for _, ps := range peers {
+			activity := "idle"
+			if !ps.LastWrite.IsZero() && time.Since(ps.LastWrite) < 2*time.Minute {
+				activity = "active"
+			}
+			f("<tr><td>%s</td><td>%v</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				html.EscapeString(webPeerName(st, ps)),
+				ps.TailAddr,
+				html.EscapeString(webPeerOwner(st, ps)),
+				html.EscapeString(ps.OS),
+				activity,
+			)
+		}
+		f("</table>\n")
+	}
+	f("</body>\n</html>\n")
+}
+
+// webPeerName returns ps's MagicDNS name without the tailnet's
+// suffix, or its quoted hostname if it has none, as "tailscale
+// status" shows it.
+func webPeerName(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+	if name := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix); name != "" {
+		return name
+	}
+	return fmt.Sprintf("(%q)", dnsname.SanitizeHostname(ps.HostName))
+}
+
+// webPeerOwner returns the login name of ps's owner, up to and
+// including the "@", as "tailscale status" shows it.
+func webPeerOwner(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+	if ps.UserID.IsZero() {
+		return "-"
+	}
+	u, ok := st.User[ps.UserID]
+	if !ok {
+		return fmt.Sprint(ps.UserID)
+	}
+	if i := strings.Index(u.LoginName, "@"); i != -1 {
+		return u.LoginName[:i+1]
+	}
+	return u.LoginName
+}
+
+// checkSameOrigin returns an error if r might be a cross-site
+// request, so that other sites can't change settings by having the
+// user's browser POST to the web UI.
+func checkSameOrigin(r *http.Request) error {
+	if s := r.Header.Get("Sec-Fetch-Site"); s != "" && s != "same-origin" {
+		return errors.New("cross-site request refused")
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return errors.New("request has no Origin or Referer")
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return errors.New("cross-site request refused")
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether the Host header value hostport
+// names localhost or a loopback IP.
+func isLoopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netaddr.ParseIP(strings.Trim(host, "[]"))
+	return err == nil && ip.IsLoopback()
+}
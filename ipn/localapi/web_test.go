@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+// The requests below are all refused before the handler looks at
+// its backend, so the tests don't need one.
+
+func TestServeWebRejectsHost(t *testing.T) {
+	h := &Handler{PermitRead: true, PermitWrite: true}
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "http://local-tailscaled.sock/localapi/v0/web", nil)
+		req.Host = "evil.example.com:8088"
+		req.Header.Set(ipn.WebLoopbackOnlyHeader, "true")
+		req.Header.Set("Origin", "http://evil.example.com:8088")
+		rec := httptest.NewRecorder()
+		h.serveWeb(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s with Host %q: status = %v; want 403", method, req.Host, rec.Code)
+		}
+	}
+}
+
+func TestServeWebRejectsOrigin(t *testing.T) {
+	h := &Handler{PermitRead: true, PermitWrite: true}
+	tests := []struct {
+		name   string
+		header map[string]string
+	}{
+		{"cross_origin", map[string]string{"Origin": "http://evil.example.com"}},
+		{"cross_referer", map[string]string{"Referer": "http://evil.example.com/page"}},
+		{"fetch_site", map[string]string{"Origin": "http://localhost:8088", "Sec-Fetch-Site": "cross-site"}},
+		{"no_origin", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://local-tailscaled.sock/localapi/v0/web", strings.NewReader("action=prefs&shields=on"))
+			req.Host = "localhost:8088"
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set(ipn.WebLoopbackOnlyHeader, "true")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.serveWeb(rec, req)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("status = %v; want 403", rec.Code)
+			}
+		})
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8088/", nil)
+	req.Header.Set("Origin", "http://localhost:8088")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	if err := checkSameOrigin(req); err != nil {
+		t.Errorf("same origin: %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "http://localhost:8088/", nil)
+	req.Header.Set("Referer", "http://localhost:8088/tailscale")
+	if err := checkSameOrigin(req); err != nil {
+		t.Errorf("same-origin Referer: %v", err)
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"localhost":         true,
+		"localhost:8088":    true,
+		"127.0.0.1:8088":    true,
+		"[::1]:8088":        true,
+		"::1":               true,
+		"100.101.102.103":   false,
+		"evil.example.com":  false,
+		"localhost.evil.io": false,
+	} {
+		if got := isLoopbackHost(host); got != want {
+			t.Errorf("isLoopbackHost(%q) = %v; want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"inet.af/netaddr"
+)
+
+// MaskedPrefs is an edit of some of the prefs: the Prefs fields whose
+// corresponding "Set" field is true. It lets clients such as
+// "tailscale set" change individual prefs at runtime without
+// restating the rest.
+type MaskedPrefs struct {
+	Prefs
+
+	AdvertiseRoutesSet bool `json:",omitempty"`
+	ShieldsUpSet       bool `json:",omitempty"`
+	HostnameSet        bool `json:",omitempty"`
+	WantRunningSet     bool `json:",omitempty"`
+	RouteAllSet        bool `json:",omitempty"`
+	CorpDNSSet         bool `json:",omitempty"`
+	RunSSHSet          bool `json:",omitempty"`
+
+	// ExitNodeIPSet sets the exit node by IP, clearing ExitNodeID,
+	// which the backend finds again from the netmap. A zero
+	// ExitNodeIP turns off the exit node.
+	ExitNodeIPSet bool `json:",omitempty"`
+}
+
+// IsEmpty reports whether mp edits no prefs.
+func (mp *MaskedPrefs) IsEmpty() bool {
+	return !mp.AdvertiseRoutesSet && !mp.ShieldsUpSet && !mp.HostnameSet && !mp.ExitNodeIPSet &&
+		!mp.WantRunningSet && !mp.RouteAllSet && !mp.CorpDNSSet && !mp.RunSSHSet
+}
+
+// ApplyTo sets the prefs in p that mp edits, and reports whether any
+// of them changed.
+func (mp *MaskedPrefs) ApplyTo(p *Prefs) bool {
+	old := p.Clone()
+	if mp.AdvertiseRoutesSet {
+		p.AdvertiseRoutes = append([]netaddr.IPPrefix(nil), mp.AdvertiseRoutes...)
+	}
+	if mp.ShieldsUpSet {
+		p.ShieldsUp = mp.ShieldsUp
+	}
+	if mp.HostnameSet {
+		p.Hostname = mp.Hostname
+	}
+	if mp.WantRunningSet {
+		p.WantRunning = mp.WantRunning
+	}
+	if mp.RouteAllSet {
+		p.RouteAll = mp.RouteAll
+	}
+	if mp.CorpDNSSet {
+		p.CorpDNS = mp.CorpDNS
+	}
+	if mp.RunSSHSet {
+		p.RunSSH = mp.RunSSH
+	}
+	if mp.ExitNodeIPSet {
+		p.ExitNodeIP = mp.ExitNodeIP
+		p.ExitNodeID = ""
+	}
+	return !old.Equals(p)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestMaskedPrefsApplyTo(t *testing.T) {
+	p := NewPrefs()
+	p.Hostname = "old"
+	p.ExitNodeID = "nExit"
+	p.AdvertiseRoutes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")}
+
+	if (&MaskedPrefs{}).ApplyTo(p) {
+		t.Error("empty edit: changed")
+	}
+
+	mp := &MaskedPrefs{
+		Prefs: Prefs{
+			ShieldsUp: true,
+			Hostname:  "ignored",
+		},
+		ShieldsUpSet: true,
+	}
+	if !mp.ApplyTo(p) {
+		t.Fatal("shields up: no change")
+	}
+	if !p.ShieldsUp || p.Hostname != "old" || p.ExitNodeID != "nExit" || len(p.AdvertiseRoutes) != 1 {
+		t.Errorf("after shields up: %v", p.Pretty())
+	}
+	if mp.ApplyTo(p) {
+		t.Error("reapplying shields up: changed")
+	}
+
+	mp = &MaskedPrefs{RouteAllSet: true, CorpDNSSet: true}
+	if !mp.ApplyTo(p) {
+		t.Fatal("clearing route all and DNS: no change")
+	}
+	if p.RouteAll || p.CorpDNS || !p.WantRunning || !p.ShieldsUp {
+		t.Errorf("after clearing route all and DNS: %v", p.Pretty())
+	}
+
+	mp = &MaskedPrefs{ExitNodeIPSet: true, AdvertiseRoutesSet: true}
+	if !mp.ApplyTo(p) {
+		t.Fatal("clearing exit node and routes: no change")
+	}
+	if p.ExitNodeID != "" || !p.ExitNodeIP.IsZero() || len(p.AdvertiseRoutes) != 0 || !p.ShieldsUp {
+		t.Errorf("after clearing: %v", p.Pretty())
+	}
+}
+
+func TestMaskedPrefsJSON(t *testing.T) {
+	j := []byte(`{"ShieldsUp":true,"ShieldsUpSet":true,"Hostname":"h"}`)
+	var mp MaskedPrefs
+	if err := json.Unmarshal(j, &mp); err != nil {
+		t.Fatal(err)
+	}
+	if !mp.ShieldsUp || !mp.ShieldsUpSet || mp.Hostname != "h" || mp.HostnameSet {
+		t.Errorf("got %+v", mp)
+	}
+	if mp.IsEmpty() {
+		t.Error("IsEmpty = true")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"inet.af/netaddr"
+)
+
+// NetworkConfig is the part of the OS network configuration that, with
+// the ConfirmNetworkChanges pref, changes only once the user accepts
+// it: the routes into Tailscale other than to Tailscale IPs (that is,
+// subnet and exit node routes), and the DNS configuration.
+type NetworkConfig struct {
+	Routes      []netaddr.IPPrefix `json:",omitempty"`
+	Nameservers []netaddr.IP       `json:",omitempty"`
+	Domains     []string           `json:",omitempty"`
+	PerDomain   bool               `json:",omitempty"`
+	Proxied     bool               `json:",omitempty"`
+}
+
+// Equal reports whether c and c2 are the same configuration. A nil
+// NetworkConfig equals an empty one.
+func (c *NetworkConfig) Equal(c2 *NetworkConfig) bool {
+	if c == nil {
+		c = &NetworkConfig{}
+	}
+	if c2 == nil {
+		c2 = &NetworkConfig{}
+	}
+	return compareIPNets(c.Routes, c2.Routes) &&
+		compareIPs(c.Nameservers, c2.Nameservers) &&
+		compareStrings(c.Domains, c2.Domains) &&
+		c.PerDomain == c2.PerDomain &&
+		c.Proxied == c2.Proxied
+}
+
+func compareIPs(a, b []netaddr.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NetworkChanges is the network configuration in use with the
+// ConfirmNetworkChanges pref, and any change to it that's waiting to be
+// accepted.
+type NetworkChanges struct {
+	// Accepted is the configuration the OS is configured with. It's
+	// nil if none has been accepted yet.
+	Accepted *NetworkConfig
+
+	// Pending is the configuration the tailnet now calls for, if it
+	// differs from Accepted.
+	Pending *NetworkConfig `json:",omitempty"`
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+// NetworkLocations are prefs that the backend applies whenever the
+// machine joins particular networks, such as always using an exit
+// node on a coffee shop's Wi-Fi but not at home.
+type NetworkLocations struct {
+	// Current is the ID of the network the machine is on, as from
+	// monitor.Mon.NetworkID, or empty if it's unknown. It's not
+	// stored.
+	Current string `json:",omitempty"`
+
+	// Prefs are the prefs to apply on each network, keyed by
+	// network ID.
+	Prefs map[string]LocationPrefs
+}
+
+// LocationPrefs are the prefs that a network location sets.
+type LocationPrefs struct {
+	// ExitNodeID and ExitNodeIP are the exit node to use on the
+	// network, as in Prefs. If both are zero, no exit node is
+	// used.
+	ExitNodeID tailcfg.StableNodeID `json:",omitempty"`
+	ExitNodeIP netaddr.IP
+
+	// ShieldsUp is whether to block incoming connections on the
+	// network, as in Prefs.
+	ShieldsUp bool `json:",omitempty"`
+}
+
+// LocationPrefsOf returns p's prefs that a network location sets.
+func LocationPrefsOf(p *Prefs) LocationPrefs {
+	return LocationPrefs{
+		ExitNodeID: p.ExitNodeID,
+		ExitNodeIP: p.ExitNodeIP,
+		ShieldsUp:  p.ShieldsUp,
+	}
+}
+
+// ApplyTo sets the prefs in p that lp covers, and reports whether
+// any of them changed.
+func (lp LocationPrefs) ApplyTo(p *Prefs) bool {
+	if LocationPrefsOf(p) == lp {
+		return false
+	}
+	p.ExitNodeID = lp.ExitNodeID
+	p.ExitNodeIP = lp.ExitNodeIP
+	p.ShieldsUp = lp.ShieldsUp
+	return true
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestLocationPrefsApplyTo(t *testing.T) {
+	p := NewPrefs()
+	p.ExitNodeIP = netaddr.MustParseIP("100.64.0.1")
+	p.RouteAll = true
+
+	home := LocationPrefs{}
+	if !home.ApplyTo(p) {
+		t.Fatal("clearing exit node: no change")
+	}
+	if !p.ExitNodeIP.IsZero() || !p.RouteAll {
+		t.Fatalf("after home: ExitNodeIP=%v RouteAll=%v", p.ExitNodeIP, p.RouteAll)
+	}
+	if home.ApplyTo(p) {
+		t.Error("reapplying home: changed")
+	}
+
+	cafe := LocationPrefs{ExitNodeID: "nExit", ShieldsUp: true}
+	if !cafe.ApplyTo(p) {
+		t.Fatal("applying cafe: no change")
+	}
+	if got := LocationPrefsOf(p); got != cafe {
+		t.Errorf("after cafe: got %+v; want %+v", got, cafe)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "strings"
+
+// PeerGroupPrefix is the prefix that marks a command line target
+// as a peer group, as in "tailscale ping group:prod".
+const PeerGroupPrefix = "group:"
+
+// PeerGroups are named groups of peers that the user has defined
+// locally, to use as targets of other commands.
+//
+// Groups are kept by the local daemon only; they're not shared with
+// the control server or other nodes, and they have no effect on
+// access control.
+type PeerGroups map[string][]string // group name => peer names
+
+// CheckPeerGroupName returns an error if name isn't a valid peer
+// group name. The rules are the same as for profile names.
+func CheckPeerGroupName(name string) error {
+	return checkLocalName("peer group", name)
+}
+
+// ParsePeerGroupTarget reports whether the command line target s
+// refers to a peer group (that is, has the "group:" prefix) and, if
+// so, returns the group's name.
+func ParsePeerGroupTarget(s string) (name string, ok bool) {
+	if !strings.HasPrefix(s, PeerGroupPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(s, PeerGroupPrefix), true
+}
@@ -22,7 +22,7 @@ import (
 	"tailscale.com/types/preftype"
 )
 
-//go:generate go run tailscale.com/cmd/cloner -type=Prefs -output=prefs_clone.go
+//go:generate go run tailscale.com/cmd/cloner -type=Prefs,VirtualService -output=prefs_clone.go
 
 // Prefs are the user modifiable settings of the Tailscale node agent.
 type Prefs struct {
@@ -139,6 +139,115 @@ type Prefs struct {
 	// Tailscale, if at all.
 	NetfilterMode preftype.NetfilterMode
 
+	// ListenPort, if non-zero, is the UDP port to listen on for
+	// WireGuard and peer-to-peer traffic, overriding tailscaled's
+	// --port flag. Pinning it lets firewall administrators open a
+	// specific inbound port.
+	ListenPort uint16 `json:",omitempty"`
+
+	// AlwaysOnPeers are peers whose WireGuard sessions are kept up
+	// with persistent keepalives, rather than removed when idle, so
+	// that servers behind NAT stay reachable. Peers are named by
+	// MagicDNS name (with or without the tailnet suffix), Tailscale
+	// IP, or stable node ID; "*" means all peers.
+	AlwaysOnPeers []string `json:",omitempty"`
+
+	// KeepaliveSeconds is the WireGuard persistent keepalive interval
+	// for AlwaysOnPeers and for peers the control server asks to keep
+	// alive. Zero means to pick one based on the NAT that netcheck
+	// found on the current network: shorter behind NATs whose
+	// mappings vary by destination, which tend to expire them
+	// quickly, and longer behind ones that don't.
+	KeepaliveSeconds uint16 `json:",omitempty"`
+
+	// PeerIdleSeconds is how long a peer may be idle before its
+	// WireGuard session is removed, until it's used again. Lower
+	// values save battery on mobile devices. Zero means the default
+	// of 5 minutes; the minimum is 30 seconds.
+	PeerIdleSeconds int `json:",omitempty"`
+
+	// DERPMapPath, if non-empty, is the path of a JSON file of DERP
+	// regions, for self-hosted DERP servers. Its regions are merged
+	// into the control server's DERP map by region ID, a null region
+	// removing the control server's, or replace them all if the file
+	// sets "OmitDefaultRegions". Changes to the file are picked up
+	// without restarting tailscaled.
+	DERPMapPath string `json:",omitempty"`
+
+	// PreferredDERP, if non-zero, is the ID of the DERP region to use
+	// as the node's home region, rather than the one with the lowest
+	// measured latency. If that region isn't in the DERP map or
+	// can't be reached, the usual selection applies.
+	PreferredDERP int `json:",omitempty"`
+
+	// AdvertiseServicePorts, if non-empty, is an allowlist of local
+	// ports that may be reported to peers as services in
+	// Hostinfo.Services. Listening ports not in the list are never
+	// reported. If empty, the default policy from
+	// policy.IsInterestingService is used instead.
+	AdvertiseServicePorts []uint16 `json:",omitempty"`
+
+	// RunSSH specifies whether tailscaled should run its built-in
+	// SSH server on the node's Tailscale IPs, authenticating users
+	// by their Tailscale identity rather than SSH keys.
+	RunSSH bool `json:",omitempty"`
+
+	// SSHUsers, if non-empty, is the list of local accounts that the
+	// built-in SSH server permits logins as. If empty, any account
+	// but root may be logged in as. root is only permitted if it's
+	// listed explicitly.
+	SSHUsers []string `json:",omitempty"`
+
+	// Serve is the list of local services that tailscaled serves over
+	// HTTP or HTTPS on the node's Tailscale IPs, at most one per
+	// port. It's managed by "tailscale serve".
+	Serve []ServeHandler `json:",omitempty"`
+
+	// VirtualServices are local addresses that tailscaled forwards to
+	// one of several peers each, balancing the load among them. It's
+	// managed by "tailscale vservice".
+	VirtualServices []VirtualService `json:",omitempty"`
+
+	// CertDomains are user-owned domain names, CNAMEd to the node's
+	// MagicDNS name or resolving to its Tailscale IPs, that
+	// tailscaled may get TLS certificates for, in addition to the
+	// MagicDNS name. HTTPS Serve handlers present them to clients
+	// asking for these names.
+	// Their DNS-01 challenge records are published by the provider
+	// given to tailscaled's --cert-dns-provider flag.
+	CertDomains []string `json:",omitempty"`
+
+	// NoUpdateCheck disables tailscaled's daily check for a newer
+	// Tailscale release. "tailscale version --check" still works.
+	NoUpdateCheck bool `json:",omitempty"`
+
+	// AutoUpdate specifies that tailscaled installs newer releases
+	// found by the update check, rather than only reporting them. It
+	// has no effect if NoUpdateCheck is set.
+	AutoUpdate bool `json:",omitempty"`
+
+	// ConfirmNetworkChanges specifies that changes to the subnet and
+	// exit node routes and DNS configuration from the tailnet are
+	// held until the user accepts them locally (with "tailscale
+	// netchanges accept"), rather than applied to the OS right away.
+	// See NetworkConfig.
+	ConfirmNetworkChanges bool `json:",omitempty"`
+
+	// Ephemeral specifies that the node registers as ephemeral, for
+	// short-lived machines such as CI runners and autoscaled
+	// containers: control deletes it soon after it goes offline.
+	// Its node key and login (Persist) are then kept only in
+	// memory, not in the state store, and tailscaled logs it out
+	// when it shuts down cleanly.
+	Ephemeral bool `json:",omitempty"`
+
+	// AppConnectorDomains, if non-empty, makes the node an app
+	// connector for these domains: it advertises routes to the IPs
+	// they resolve to, as learned by resolving them and from the DNS
+	// answers it serves peers, so that peers reach those services
+	// through it. A leading "*." matches all subdomains.
+	AppConnectorDomains []string `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -182,9 +291,60 @@ func (p *Prefs) pretty(goos string) string {
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
+	if len(p.AdvertiseServicePorts) > 0 {
+		fmt.Fprintf(&sb, "services=%v ", p.AdvertiseServicePorts)
+	}
+	if p.RunSSH {
+		sb.WriteString("ssh=true ")
+	}
+	if len(p.SSHUsers) > 0 {
+		fmt.Fprintf(&sb, "sshusers=%s ", strings.Join(p.SSHUsers, ","))
+	}
+	if len(p.Serve) > 0 {
+		fmt.Fprintf(&sb, "serve=%v ", p.Serve)
+	}
+	if len(p.VirtualServices) > 0 {
+		fmt.Fprintf(&sb, "vservices=%v ", p.VirtualServices)
+	}
+	if len(p.CertDomains) > 0 {
+		fmt.Fprintf(&sb, "certdomains=%s ", strings.Join(p.CertDomains, ","))
+	}
 	if goos == "linux" {
 		fmt.Fprintf(&sb, "nf=%v ", p.NetfilterMode)
 	}
+	if p.ListenPort != 0 {
+		fmt.Fprintf(&sb, "port=%v ", p.ListenPort)
+	}
+	if len(p.AlwaysOnPeers) > 0 {
+		fmt.Fprintf(&sb, "alwayson=%s ", strings.Join(p.AlwaysOnPeers, ","))
+	}
+	if p.KeepaliveSeconds != 0 {
+		fmt.Fprintf(&sb, "keepalive=%ds ", p.KeepaliveSeconds)
+	}
+	if p.PeerIdleSeconds != 0 {
+		fmt.Fprintf(&sb, "idle=%ds ", p.PeerIdleSeconds)
+	}
+	if p.DERPMapPath != "" {
+		fmt.Fprintf(&sb, "derpmap=%q ", p.DERPMapPath)
+	}
+	if p.PreferredDERP != 0 {
+		fmt.Fprintf(&sb, "derp=%d ", p.PreferredDERP)
+	}
+	if p.NoUpdateCheck {
+		sb.WriteString("updatecheck=false ")
+	}
+	if p.AutoUpdate {
+		sb.WriteString("autoupdate=true ")
+	}
+	if p.ConfirmNetworkChanges {
+		sb.WriteString("confirmnet=true ")
+	}
+	if p.Ephemeral {
+		sb.WriteString("ephemeral=true ")
+	}
+	if len(p.AppConnectorDomains) > 0 {
+		fmt.Fprintf(&sb, "appconnector=%s ", strings.Join(p.AppConnectorDomains, ","))
+	}
 	if p.ControlURL != "" && p.ControlURL != "https://login.tailscale.com" {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
 	}
@@ -225,12 +385,29 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.ShieldsUp == p2.ShieldsUp &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
+		p.ListenPort == p2.ListenPort &&
+		compareStrings(p.AlwaysOnPeers, p2.AlwaysOnPeers) &&
+		p.KeepaliveSeconds == p2.KeepaliveSeconds &&
+		p.PeerIdleSeconds == p2.PeerIdleSeconds &&
+		p.DERPMapPath == p2.DERPMapPath &&
+		p.PreferredDERP == p2.PreferredDERP &&
 		p.Hostname == p2.Hostname &&
 		p.OSVersion == p2.OSVersion &&
 		p.DeviceModel == p2.DeviceModel &&
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		comparePorts(p.AdvertiseServicePorts, p2.AdvertiseServicePorts) &&
+		p.RunSSH == p2.RunSSH &&
+		compareStrings(p.SSHUsers, p2.SSHUsers) &&
+		compareServeHandlers(p.Serve, p2.Serve) &&
+		compareVirtualServices(p.VirtualServices, p2.VirtualServices) &&
+		compareStrings(p.CertDomains, p2.CertDomains) &&
+		p.NoUpdateCheck == p2.NoUpdateCheck &&
+		p.AutoUpdate == p2.AutoUpdate &&
+		p.ConfirmNetworkChanges == p2.ConfirmNetworkChanges &&
+		p.Ephemeral == p2.Ephemeral &&
+		compareStrings(p.AppConnectorDomains, p2.AppConnectorDomains) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -258,6 +435,42 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
+func comparePorts(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareServeHandlers(a, b []ServeHandler) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareVirtualServices(a, b []VirtualService) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func NewPrefs() *Prefs {
 	return &Prefs{
 		// Provide default values for options which might be missing
@@ -31,7 +31,7 @@ func fieldsOf(t reflect.Type) (fields []string) {
 func TestPrefsEqual(t *testing.T) {
 	tstest.PanicOnLog()
 
-	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "ExitNodeID", "ExitNodeIP", "CorpDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "OSVersion", "DeviceModel", "NotepadURLs", "ForceDaemon", "AdvertiseRoutes", "NoSNAT", "NetfilterMode", "Persist"}
+	prefsHandles := []string{"ControlURL", "RouteAll", "AllowSingleHosts", "ExitNodeID", "ExitNodeIP", "CorpDNS", "WantRunning", "ShieldsUp", "AdvertiseTags", "Hostname", "OSVersion", "DeviceModel", "NotepadURLs", "ForceDaemon", "AdvertiseRoutes", "NoSNAT", "NetfilterMode", "ListenPort", "AlwaysOnPeers", "KeepaliveSeconds", "PeerIdleSeconds", "DERPMapPath", "PreferredDERP", "AdvertiseServicePorts", "RunSSH", "SSHUsers", "Serve", "VirtualServices", "CertDomains", "NoUpdateCheck", "AutoUpdate", "ConfirmNetworkChanges", "Ephemeral", "AppConnectorDomains", "Persist"}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
 		t.Errorf("Prefs.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, prefsHandles)
@@ -188,6 +188,124 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{ListenPort: 41641},
+			&Prefs{ListenPort: 0},
+			false,
+		},
+		{
+			&Prefs{ListenPort: 41641},
+			&Prefs{ListenPort: 41641},
+			true,
+		},
+
+		{
+			&Prefs{AlwaysOnPeers: []string{"server"}},
+			&Prefs{AlwaysOnPeers: []string{"*"}},
+			false,
+		},
+		{
+			&Prefs{AlwaysOnPeers: []string{"server"}, KeepaliveSeconds: 10, PeerIdleSeconds: 60},
+			&Prefs{AlwaysOnPeers: []string{"server"}, KeepaliveSeconds: 10, PeerIdleSeconds: 60},
+			true,
+		},
+		{
+			&Prefs{PeerIdleSeconds: 60},
+			&Prefs{PeerIdleSeconds: 120},
+			false,
+		},
+
+		{
+			&Prefs{DERPMapPath: "/etc/tailscale/derp.json", PreferredDERP: 900},
+			&Prefs{DERPMapPath: "/etc/tailscale/derp.json", PreferredDERP: 900},
+			true,
+		},
+		{
+			&Prefs{DERPMapPath: "/etc/tailscale/derp.json"},
+			&Prefs{DERPMapPath: "/etc/tailscale/other.json"},
+			false,
+		},
+		{
+			&Prefs{PreferredDERP: 1},
+			&Prefs{PreferredDERP: 2},
+			false,
+		},
+
+		{
+			&Prefs{RunSSH: true},
+			&Prefs{RunSSH: false},
+			false,
+		},
+		{
+			&Prefs{RunSSH: true},
+			&Prefs{RunSSH: true},
+			true,
+		},
+		{
+			&Prefs{SSHUsers: []string{"alice"}},
+			&Prefs{SSHUsers: []string{"alice", "root"}},
+			false,
+		},
+
+		{
+			&Prefs{NoUpdateCheck: true},
+			&Prefs{NoUpdateCheck: false},
+			false,
+		},
+		{
+			&Prefs{AutoUpdate: true},
+			&Prefs{AutoUpdate: false},
+			false,
+		},
+		{
+			&Prefs{ConfirmNetworkChanges: true},
+			&Prefs{ConfirmNetworkChanges: false},
+			false,
+		},
+		{
+			&Prefs{Ephemeral: true},
+			&Prefs{Ephemeral: false},
+			false,
+		},
+		{
+			&Prefs{AppConnectorDomains: []string{"example.com"}},
+			&Prefs{AppConnectorDomains: []string{"example.com", "*.example.com"}},
+			false,
+		},
+
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 80, Proxy: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 80, Path: "/srv"}}},
+			false,
+		},
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 443, HTTPS: true, Path: "/srv"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 443, HTTPS: true, Path: "/srv"}}},
+			true,
+		},
+
+		{
+			&Prefs{VirtualServices: []VirtualService{{Name: "db", Addr: netaddr.MustParseIPPort("127.0.0.1:5432"), Backends: []string{"tag:db"}}}},
+			&Prefs{VirtualServices: []VirtualService{{Name: "db", Addr: netaddr.MustParseIPPort("127.0.0.1:5432"), Backends: []string{"tag:db"}}}},
+			true,
+		},
+		{
+			&Prefs{VirtualServices: []VirtualService{{Name: "db", Addr: netaddr.MustParseIPPort("127.0.0.1:5432"), Backends: []string{"tag:db"}}}},
+			&Prefs{VirtualServices: []VirtualService{{Name: "db", Addr: netaddr.MustParseIPPort("127.0.0.1:5432"), Backends: []string{"group:db"}}}},
+			false,
+		},
+
+		{
+			&Prefs{CertDomains: []string{"app.example.com"}},
+			&Prefs{CertDomains: []string{"www.example.com"}},
+			false,
+		},
+		{
+			&Prefs{CertDomains: []string{"app.example.com"}},
+			&Prefs{CertDomains: []string{"app.example.com"}},
+			true,
+		},
+
 		{
 			&Prefs{AdvertiseRoutes: nil},
 			&Prefs{AdvertiseRoutes: []netaddr.IPPrefix{}},
@@ -225,6 +343,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{AdvertiseServicePorts: []uint16{22, 80}},
+			&Prefs{AdvertiseServicePorts: []uint16{22}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseServicePorts: []uint16{22, 80}},
+			&Prefs{AdvertiseServicePorts: []uint16{22, 80}},
+			true,
+		},
+
 		{
 			&Prefs{Persist: &persist.Persist{}},
 			&Prefs{Persist: &persist.Persist{LoginName: "dave"}},
@@ -391,6 +520,13 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				ListenPort: 41641,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off port=41641 Persist=nil}`,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.p.pretty(tt.os)
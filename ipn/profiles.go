@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+)
+
+// DefaultProfileName is the name of the login profile that
+// tailscaled starts with before any others are created.
+const DefaultProfileName = "default"
+
+// LoginProfiles is the set of login profiles known to the backend.
+//
+// Each profile has its own Prefs, including its node key, so
+// switching between profiles (for instance, between tailnets, or
+// between users of one tailnet) doesn't require logging out and
+// back in.
+type LoginProfiles struct {
+	// Current is the name of the profile in use.
+	Current string
+	// Profiles are the names of all profiles, including Current,
+	// in the order they were created.
+	Profiles []string
+}
+
+// ProfileStateKey returns the StateKey under which the named
+// profile's prefs are saved while it's not in use.
+func ProfileStateKey(name string) StateKey {
+	return StateKey("profile-" + name)
+}
+
+// CheckProfileName returns an error if name isn't a valid profile
+// name. Names are 1 to 64 characters of ASCII letters, digits,
+// '-', '_' and '.'.
+func CheckProfileName(name string) error {
+	return checkLocalName("profile", name)
+}
+
+// checkLocalName checks a name for a locally-defined kind of object,
+// such as a profile or a peer group.
+func checkLocalName(kind, name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("invalid %s name %q: must be 1 to 64 characters", kind, name)
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid %s name %q: invalid character %q", kind, name, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckProfileName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"default", true},
+		{"work.example-1_b", true},
+		{"", false},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"has space", false},
+		{"../etc", false},
+		{"ünicode", false},
+	}
+	for _, tt := range tests {
+		err := CheckProfileName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckProfileName(%q) = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestProfileStateKey(t *testing.T) {
+	if got, want := ProfileStateKey("work"), StateKey("profile-work"); got != want {
+		t.Errorf("ProfileStateKey = %q; want %q", got, want)
+	}
+}
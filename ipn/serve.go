@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// ServeHandler configures tailscaled to serve HTTP or HTTPS on a port
+// of the node's Tailscale IPs, either by reverse proxying to a local
+// server or by serving local files.
+//
+// Exactly one of Proxy and Path must be set.
+type ServeHandler struct {
+	// Port is the TCP port on the node's Tailscale IPs to serve on.
+	Port uint16
+
+	// HTTPS specifies whether to serve HTTPS instead of plain HTTP.
+	HTTPS bool `json:",omitempty"`
+
+	// Proxy, if non-empty, is the base URL of the local HTTP server
+	// to proxy requests to, such as "http://127.0.0.1:3000".
+	Proxy string `json:",omitempty"`
+
+	// Path, if non-empty, is the absolute path of a local file or
+	// directory to serve.
+	Path string `json:",omitempty"`
+}
+
+// Check reports whether h is a valid handler.
+func (h ServeHandler) Check() error {
+	if h.Port == 0 {
+		return errors.New("missing port")
+	}
+	switch {
+	case h.Proxy != "" && h.Path != "":
+		return errors.New("only one of proxy and path may be set")
+	case h.Proxy != "":
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q; want http://host:port", h.Proxy)
+		}
+	case h.Path != "":
+		if !filepath.IsAbs(h.Path) {
+			return fmt.Errorf("path %q is not absolute", h.Path)
+		}
+	default:
+		return errors.New("missing proxy or path")
+	}
+	return nil
+}
+
+func (h ServeHandler) String() string {
+	scheme := "http"
+	if h.HTTPS {
+		scheme = "https"
+	}
+	target := h.Proxy
+	if target == "" {
+		target = h.Path
+	}
+	return fmt.Sprintf("%s:%d->%s", scheme, h.Port, target)
+}
+
+// ParseServeTarget returns a handler for port that serves target,
+// which is either a local port number or URL to proxy to, or the
+// absolute path of files to serve.
+func ParseServeTarget(port uint16, https bool, target string) (ServeHandler, error) {
+	h := ServeHandler{Port: port, HTTPS: https}
+	if n, err := strconv.ParseUint(target, 10, 16); err == nil && n != 0 {
+		h.Proxy = "http://127.0.0.1:" + target
+	} else if filepath.IsAbs(target) {
+		h.Path = target
+	} else {
+		h.Proxy = target
+	}
+	return h, h.Check()
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestParseServeTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		https   bool
+		want    ServeHandler
+		wantErr bool
+	}{
+		{target: "3000", want: ServeHandler{Port: 80, Proxy: "http://127.0.0.1:3000"}},
+		{target: "http://10.0.0.1:8080", https: true, want: ServeHandler{Port: 80, HTTPS: true, Proxy: "http://10.0.0.1:8080"}},
+		{target: "/srv/www", want: ServeHandler{Port: 80, Path: "/srv/www"}},
+		{target: "srv/www", wantErr: true},
+		{target: "ftp://foo", wantErr: true},
+		{target: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseServeTarget(80, tt.https, tt.target)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseServeTarget(%q) = %v; want error", tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseServeTarget(%q) = %v, %v; want %v", tt.target, got, err, tt.want)
+		}
+	}
+}
@@ -44,6 +44,33 @@ const (
 	// the server should start with the Prefs JSON loaded from
 	// StateKey "user-1234".
 	ServerModeStartKey = StateKey("server-mode-start-key")
+
+	// ProfilesStateKey is the key under which the backend stores
+	// its list of login profiles, as a JSON LoginProfiles.
+	ProfilesStateKey = StateKey("_profiles")
+
+	// PeerGroupsStateKey is the key under which the backend stores
+	// the user's named groups of peers, as a JSON PeerGroups.
+	PeerGroupsStateKey = StateKey("_peer-groups")
+
+	// NetworkLocationsStateKey is the key under which the backend
+	// stores the prefs to apply on particular networks, as a JSON
+	// map of network ID to LocationPrefs.
+	NetworkLocationsStateKey = StateKey("_network-locations")
+
+	// SSHHostKeyStateKey is the key under which the built-in SSH
+	// server's host private key is stored, in PKCS #8 PEM form.
+	SSHHostKeyStateKey = StateKey("_ssh-host-key")
+
+	// ServeCertStateKey is the key under which the self-signed
+	// certificate and private key for "tailscale serve" HTTPS
+	// handlers are stored, in PEM form.
+	ServeCertStateKey = StateKey("_serve-cert")
+
+	// ACMEAccountKeyStateKey is the key under which the ACME
+	// account key used to get certificates for the node's DNS name
+	// is stored, in PEM form.
+	ACMEAccountKeyStateKey = StateKey("_acme-account-key")
 )
 
 // StateStore persists state, and produces it back on request.
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"tailscale.com/awsssm"
+	"tailscale.com/ipn"
+)
+
+// AWSStore is a StateStore that keeps all state as a single JSON
+// object in an AWS SSM Parameter Store SecureString parameter.
+//
+// Credentials are taken from the standard AWS environment variables.
+type AWSStore struct {
+	client *awsssm.Client
+	name   string
+
+	mu    sync.Mutex
+	cache map[ipn.StateKey][]byte
+}
+
+// NewAWSStore returns a new AWSStore that persists to the SSM
+// parameter with the given ARN, loading its current contents.
+func NewAWSStore(arn string) (*AWSStore, error) {
+	a, err := awsssm.ParseARN(arn)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := awsssm.CredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s := &AWSStore{
+		client: &awsssm.Client{Region: a.Region, Creds: creds},
+		name:   a.Name,
+		cache:  map[ipn.StateKey][]byte{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	v, err := s.client.GetParameter(ctx, s.name)
+	switch {
+	case err == awsssm.ErrParameterNotFound:
+		// Start empty; the parameter is created on first write.
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal([]byte(v), &s.cache); err != nil {
+			return nil, fmt.Errorf("parsing SSM parameter %q: %w", s.name, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *AWSStore) String() string { return fmt.Sprintf("AWSStore(%q)", s.name) }
+
+// ReadState implements the StateStore interface.
+func (s *AWSStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.cache[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+//
+// The cache is only updated once the parameter has been written, so
+// a failed write isn't visible to later reads.
+func (s *AWSStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := make(map[ipn.StateKey][]byte, len(s.cache)+1)
+	for k, v := range s.cache {
+		next[k] = v
+	}
+	next[id] = append([]byte(nil), bs...)
+	j, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.client.PutParameter(ctx, s.name, string(j)); err != nil {
+		return err
+	}
+	s.cache = next
+	return nil
+}
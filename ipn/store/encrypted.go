@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// encryptedMagic prefixes state files written by EncryptedFileStore.
+// It's followed by a 12 byte AES-GCM nonce and the sealed JSON state.
+const encryptedMagic = "tailscale-state-aes256gcm-v1\n"
+
+// errNoKeyStore is returned by platformStateKey when the platform
+// has no supported OS key store.
+var errNoKeyStore = errors.New("no supported OS key store on this platform")
+
+// getStateKey returns the 32 byte key used to encrypt the state file
+// at statePath, creating and protecting a new one if needed.
+// It's a variable for tests.
+var getStateKey = platformStateKey
+
+// EncryptedFileStore is a StateStore like ipn.FileStore, but whose
+// file is encrypted at rest with a key protected by the OS: DPAPI on
+// Windows, the System keychain on macOS, and a TPM-sealed key on Linux
+// (where a TPM and tpm2-tools are available).
+//
+// An existing plaintext state file is transparently migrated to the
+// encrypted format when opened.
+type EncryptedFileStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu    sync.RWMutex
+	cache map[ipn.StateKey][]byte
+}
+
+func (s *EncryptedFileStore) String() string { return fmt.Sprintf("EncryptedFileStore(%q)", s.path) }
+
+// NewEncryptedFileStore returns a new encrypted file store that
+// persists to path. It's an error for path to name one of the
+// non-file stores New supports.
+func NewEncryptedFileStore(logf logger.Logf, path string) (*EncryptedFileStore, error) {
+	if !IsFilePath(path) {
+		return nil, fmt.Errorf("state encryption is only supported for state files, not %q", path)
+	}
+	key, err := getStateKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("getting state encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &EncryptedFileStore{
+		path:  path,
+		aead:  aead,
+		cache: map[ipn.StateKey][]byte{},
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) || (err == nil && len(bs) == 0):
+		// Write out an initial file, to verify that we can write
+		// to the path.
+		os.MkdirAll(filepath.Dir(path), 0755) // best effort
+		if err := s.saveLocked(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case err != nil:
+		return nil, err
+	case bytes.HasPrefix(bs, []byte(encryptedMagic)):
+		plain, err := s.open(bs[len(encryptedMagic):])
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %s: %w", path, err)
+		}
+		if err := json.Unmarshal(plain, &s.cache); err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		// A plaintext state file from ipn.FileStore.
+		if err := json.Unmarshal(bs, &s.cache); err != nil {
+			return nil, err
+		}
+		logf("store: migrating plaintext state in %s to encrypted", path)
+		if err := s.saveLocked(); err != nil {
+			return nil, fmt.Errorf("migrating %s to encrypted state: %w", path, err)
+		}
+		return s, nil
+	}
+}
+
+func (s *EncryptedFileStore) open(sealed []byte) ([]byte, error) {
+	ns := s.aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("truncated state file")
+	}
+	return s.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(encryptedMagic))
+}
+
+// saveLocked encrypts and writes s.cache to disk.
+// s.mu must be held (or s not yet shared).
+func (s *EncryptedFileStore) saveLocked() error {
+	plain, err := json.Marshal(s.cache)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append([]byte(encryptedMagic), nonce...)
+	out = s.aead.Seal(out, nonce, plain, []byte(encryptedMagic))
+	return atomicfile.WriteFile(s.path, out, 0600)
+}
+
+// ReadState implements the StateStore interface.
+func (s *EncryptedFileStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bs, ok := s.cache[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *EncryptedFileStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.cache[id], bs) {
+		return nil
+	}
+	s.cache[id] = append([]byte(nil), bs...)
+	return s.saveLocked()
+}
+
+// newStateKey returns a new random 32 byte key.
+func newStateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	systemKeychain  = "/Library/Keychains/System.keychain"
+	keychainService = "com.tailscale.tailscaled.state-key"
+)
+
+// platformStateKey returns the state key, kept in the System
+// keychain as a generic password whose account is the state path.
+func platformStateKey(statePath string) ([]byte, error) {
+	out, err := exec.Command("/usr/bin/security", "find-generic-password",
+		"-s", keychainService, "-a", statePath, "-w", systemKeychain).Output()
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(out)))
+	}
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 44 { // errSecItemNotFound
+		return nil, fmt.Errorf("reading state key from keychain: %w", err)
+	}
+
+	if strings.ContainsAny(statePath, "\"\\\n") {
+		return nil, fmt.Errorf("state path %q can't be used as a keychain account", statePath)
+	}
+	key, err := newStateKey()
+	if err != nil {
+		return nil, err
+	}
+	// Run the command from security's interactive mode, which reads
+	// it from stdin, rather than putting the key in argv where any
+	// local user could see it in ps.
+	var stderr bytes.Buffer
+	cmd := exec.Command("/usr/bin/security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -s %s -a \"%s\" -w %s %s\n",
+		keychainService, statePath, hex.EncodeToString(key), systemKeychain))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("adding state key to keychain: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	// security -i doesn't reflect a failed command in its exit
+	// status, so read the key back to be sure it was stored.
+	out, err = exec.Command("/usr/bin/security", "find-generic-password",
+		"-s", keychainService, "-a", statePath, "-w", systemKeychain).Output()
+	if err != nil || strings.TrimSpace(string(out)) != hex.EncodeToString(key) {
+		return nil, fmt.Errorf("adding state key to keychain failed: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	return key, nil
+}
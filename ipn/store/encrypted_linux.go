@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// platformStateKey returns the state key, sealed to the machine's
+// TPM with tpm2-tools. The sealed object's public and private parts
+// are kept next to the state file; only this machine's TPM can
+// unseal them.
+func platformStateKey(statePath string) ([]byte, error) {
+	if !haveTPM() {
+		return nil, errNoKeyStore
+	}
+	pubPath, privPath := statePath+".key.pub", statePath+".key.priv"
+
+	dir, err := ioutil.TempDir("", "tailscaled-tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary := filepath.Join(dir, "primary.ctx")
+	if err := tpm2("tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(privPath); os.IsNotExist(err) {
+		key, err := newStateKey()
+		if err != nil {
+			return nil, err
+		}
+		// Pass the key on stdin so it never touches the disk in the clear.
+		if err := tpm2In(key, "tpm2_create", "-Q", "-C", primary, "-i", "-", "-u", pubPath, "-r", privPath); err != nil {
+			os.Remove(pubPath)
+			os.Remove(privPath)
+			return nil, err
+		}
+		return key, nil
+	}
+
+	sealed := filepath.Join(dir, "sealed.ctx")
+	if err := tpm2("tpm2_load", "-Q", "-C", primary, "-u", pubPath, "-r", privPath, "-c", sealed); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("tpm2_unseal", "-c", sealed).Output()
+	if err != nil {
+		return nil, fmt.Errorf("tpm2_unseal: %w", err)
+	}
+	return out, nil
+}
+
+// haveTPM reports whether the machine has a TPM 2.0 resource manager
+// device and tpm2-tools installed.
+func haveTPM() bool {
+	if _, err := os.Stat("/dev/tpmrm0"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("tpm2_unseal")
+	return err == nil
+}
+
+func tpm2(name string, args ...string) error {
+	return tpm2In(nil, name, args...)
+}
+
+// tpm2In is like tpm2 but gives the command stdin as its standard
+// input.
+func tpm2In(stdin []byte, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
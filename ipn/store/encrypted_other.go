@@ -0,0 +1,11 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows,!darwin,!linux
+
+package store
+
+func platformStateKey(statePath string) ([]byte, error) {
+	return nil, errNoKeyStore
+}
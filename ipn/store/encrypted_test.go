@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestEncryptedFileStoreMigration(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	defer func(old func(string) ([]byte, error)) { getStateKey = old }(getStateKey)
+	getStateKey = func(string) ([]byte, error) { return key, nil }
+
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+
+	// Start with a plaintext state file, as ipn.FileStore writes.
+	fs, err := ipn.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteState("foo", []byte("secret-node-key")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewEncryptedFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "secret-node-key" {
+		t.Fatalf("ReadState after migration = %q, %v", got, err)
+	}
+	if err := s.WriteState("bar", []byte("more")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(encryptedMagic)) {
+		t.Errorf("state file not encrypted after migration: %q", raw)
+	}
+	if bytes.Contains(raw, []byte("secret-node-key")) || bytes.Contains(raw, []byte("c2VjcmV0LW5vZGUta2V5")) {
+		t.Errorf("state file contains plaintext state")
+	}
+
+	// Reopen the now-encrypted file.
+	s2, err := NewEncryptedFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[ipn.StateKey]string{"foo": "secret-node-key", "bar": "more"} {
+		if got, err := s2.ReadState(id); err != nil || string(got) != want {
+			t.Errorf("ReadState(%q) = %q, %v; want %q", id, got, err, want)
+		}
+	}
+
+	// A different key must fail to decrypt it.
+	key = bytes.Repeat([]byte{0x43}, 32)
+	if _, err := NewEncryptedFileStore(t.Logf, path); err == nil {
+		t.Errorf("opening with the wrong key succeeded")
+	}
+}
+
+func TestEncryptedFileStoreRejectsNonFile(t *testing.T) {
+	for _, path := range []string{"mem:", "kube:tailscale", "arn:aws:ssm:us-east-1:123456789012:parameter/ts"} {
+		if _, err := NewEncryptedFileStore(t.Logf, path); err == nil {
+			t.Errorf("NewEncryptedFileStore(%q) succeeded; want error", path)
+		}
+	}
+}
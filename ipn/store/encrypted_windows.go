@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/atomicfile"
+)
+
+var (
+	crypt32                = windows.NewLazySystemDLL("crypt32.dll")
+	cryptProtectDataProc   = crypt32.NewProc("CryptProtectData")
+	cryptUnprotectDataProc = crypt32.NewProc("CryptUnprotectData")
+)
+
+const (
+	cryptProtectUIForbidden  = 0x1
+	cryptProtectLocalMachine = 0x4
+)
+
+// dataBlob is the Win32 DATA_BLOB structure.
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+// platformStateKey returns the state key, kept DPAPI-protected with
+// machine scope in a file next to the state file.
+func platformStateKey(statePath string) ([]byte, error) {
+	keyPath := statePath + ".key"
+	sealed, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		return dpapi(cryptUnprotectDataProc, sealed)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := newStateKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err = dpapi(cryptProtectDataProc, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(keyPath, sealed, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// dpapi calls CryptProtectData or CryptUnprotectData (proc) on b.
+func dpapi(proc *windows.LazyProc, b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, windows.ERROR_INVALID_PARAMETER
+	}
+	in := dataBlob{size: uint32(len(b)), data: &b[0]}
+	var out dataBlob
+	r, _, err := proc.Call(
+		uintptr(unsafe.Pointer(&in)),
+		0, // description
+		0, // optional entropy
+		0, // reserved
+		0, // prompt struct
+		cryptProtectUIForbidden|cryptProtectLocalMachine,
+		uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.data)))
+	return append([]byte(nil), (*[1 << 30]byte)(unsafe.Pointer(out.data))[:out.size:out.size]...), nil
+}
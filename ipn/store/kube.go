@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/kube"
+)
+
+// KubeStore is a StateStore that keeps each state key as a data key
+// of a Kubernetes Secret.
+type KubeStore struct {
+	client     *kube.Client
+	secretName string
+}
+
+// NewKubeStore returns a new KubeStore that persists to the named
+// secret in the namespace of the pod it runs in.
+func NewKubeStore(secretName string) (*KubeStore, error) {
+	if secretName == "" {
+		return nil, errors.New("kube: state store requires a secret name")
+	}
+	c, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &KubeStore{client: c, secretName: secretName}, nil
+}
+
+func (s *KubeStore) String() string { return fmt.Sprintf("KubeStore(%q)", s.secretName) }
+
+// ReadState implements the StateStore interface.
+func (s *KubeStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if err != nil {
+		if err == kube.ErrNotFound {
+			return nil, ipn.ErrStateNotExist
+		}
+		return nil, err
+	}
+	b, ok := secret.Data[sanitizeKey(id)]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return b, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *KubeStore) WriteState(id ipn.StateKey, bs []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data := map[string][]byte{sanitizeKey(id): bs}
+	err := s.client.PatchSecretData(ctx, s.secretName, data)
+	if err == kube.ErrNotFound {
+		return s.client.CreateSecret(ctx, &kube.Secret{
+			Metadata: kube.ObjectMeta{Name: s.secretName},
+			Data:     data,
+		})
+	}
+	return err
+}
+
+// sanitizeKey maps id to a valid Secret data key, which may only
+// contain alphanumerics, '-', '_' and '.'.
+//
+// Other bytes, and '.' itself, are escaped as '.' followed by two hex
+// digits, so distinct ids always map to distinct keys while the
+// common keys ("_daemon", "profile-foo") are left as they are.
+func sanitizeKey(id ipn.StateKey) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, ".%02x", c)
+		}
+	}
+	return b.String()
+}
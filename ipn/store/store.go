@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package store provides the ipn.StateStore implementations that
+// tailscaled can persist its state to, selected by the --state flag.
+package store
+
+import (
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// New returns a StateStore for path, which is one of:
+//
+//	mem:                     an ephemeral in-memory store
+//	kube:<secret-name>       a Kubernetes Secret in the pod's namespace
+//	arn:aws:ssm:<region>:<account>:parameter/<name>
+//	                         an AWS SSM Parameter Store parameter
+//	anything else            the path of a JSON state file
+func New(logf logger.Logf, path string) (ipn.StateStore, error) {
+	switch {
+	case path == "mem:":
+		logf("store: using ephemeral in-memory state")
+		return &ipn.MemoryStore{}, nil
+	case strings.HasPrefix(path, "kube:"):
+		return NewKubeStore(strings.TrimPrefix(path, "kube:"))
+	case strings.HasPrefix(path, "arn:"):
+		return NewAWSStore(path)
+	}
+	return ipn.NewFileStore(path)
+}
+
+// IsFilePath reports whether New treats path as the path of a state
+// file, rather than one of the other kinds of store.
+func IsFilePath(path string) bool {
+	return path != "mem:" && !strings.HasPrefix(path, "kube:") && !strings.HasPrefix(path, "arn:")
+}
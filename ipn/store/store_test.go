@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"tailscale.com/awsssm"
+	"tailscale.com/ipn"
+	"tailscale.com/kube"
+)
+
+func TestNewMem(t *testing.T) {
+	s, err := New(t.Logf, "mem:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*ipn.MemoryStore); !ok {
+		t.Fatalf("New(mem:) = %T; want *ipn.MemoryStore", s)
+	}
+}
+
+// fakeKube is a fake Kubernetes API server holding Secrets in the
+// "default" namespace.
+type fakeKube struct {
+	mu      sync.Mutex
+	secrets map[string]map[string][]byte
+}
+
+func (f *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const prefix = "/api/v1/namespaces/default/secrets"
+	switch {
+	case r.Method == "POST" && r.URL.Path == prefix:
+		var s kube.Secret
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, ok := f.secrets[s.Metadata.Name]; ok {
+			http.Error(w, "exists", http.StatusConflict)
+			return
+		}
+		f.secrets[s.Metadata.Name] = s.Data
+	case len(r.URL.Path) > len(prefix)+1:
+		name := r.URL.Path[len(prefix)+1:]
+		data, ok := f.secrets[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(kube.Secret{Metadata: kube.ObjectMeta{Name: name}, Data: data})
+		case "PATCH":
+			var patch kube.Secret
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			for k, v := range patch.Data {
+				data[k] = v
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestKubeStore(t *testing.T) {
+	srv := httptest.NewServer(&fakeKube{secrets: map[string]map[string][]byte{}})
+	defer srv.Close()
+
+	s := &KubeStore{
+		client:     &kube.Client{URL: srv.URL, Namespace: "default"},
+		secretName: "tailscale",
+	}
+	if _, err := s.ReadState("foo"); err != ipn.ErrStateNotExist {
+		t.Fatalf("ReadState before write = %v; want ErrStateNotExist", err)
+	}
+	writes := []struct {
+		id   ipn.StateKey
+		data string
+	}{
+		{"foo", "bar"},  // creates the secret
+		{"baz", "quux"}, // patches it
+		{"foo", "bar2"}, // overwrites a key
+		{"user-S-1/5", "x"},
+	}
+	for _, w := range writes {
+		if err := s.WriteState(w.id, []byte(w.data)); err != nil {
+			t.Fatalf("WriteState(%q): %v", w.id, err)
+		}
+	}
+	want := map[ipn.StateKey]string{"foo": "bar2", "baz": "quux", "user-S-1/5": "x"}
+	for id, data := range want {
+		got, err := s.ReadState(id)
+		if err != nil {
+			t.Fatalf("ReadState(%q): %v", id, err)
+		}
+		if string(got) != data {
+			t.Errorf("ReadState(%q) = %q; want %q", id, got, data)
+		}
+	}
+	if _, err := s.ReadState("missing"); err != ipn.ErrStateNotExist {
+		t.Errorf("ReadState(missing) = %v; want ErrStateNotExist", err)
+	}
+}
+
+func TestSanitizeKey(t *testing.T) {
+	tests := []struct {
+		id   ipn.StateKey
+		want string
+	}{
+		{"_daemon", "_daemon"},
+		{"profile-work", "profile-work"},
+		{"user-S-1/5", "user-S-1.2f5"},
+		{"user-S-1_5", "user-S-1_5"},
+		{"a.b", "a.2eb"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeKey(tt.id); got != tt.want {
+			t.Errorf("sanitizeKey(%q) = %q; want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+// failingSSM is a fake SSM endpoint on which every call fails.
+func failingSSM(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, `{"__type":"InternalServerError","message":"nope"}`, 500)
+}
+
+func TestAWSStoreFailedWrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(failingSSM))
+	defer srv.Close()
+
+	s := &AWSStore{
+		client: &awsssm.Client{Region: "us-east-1", Endpoint: srv.URL},
+		name:   "tailscale",
+		cache:  map[ipn.StateKey][]byte{"foo": []byte("bar")},
+	}
+	if err := s.WriteState("foo", []byte("new")); err == nil {
+		t.Fatal("WriteState succeeded; want error")
+	}
+	if err := s.WriteState("baz", []byte("x")); err == nil {
+		t.Fatal("WriteState succeeded; want error")
+	}
+	got, err := s.ReadState("foo")
+	if err != nil || string(got) != "bar" {
+		t.Errorf("ReadState(foo) = %q, %v; want unchanged \"bar\"", got, err)
+	}
+	if _, err := s.ReadState("baz"); err != ipn.ErrStateNotExist {
+		t.Errorf("ReadState(baz) = %v; want ErrStateNotExist", err)
+	}
+}
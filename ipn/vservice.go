@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// Load balancing policies of a VirtualService.
+const (
+	BalanceRoundRobin   = "round-robin"   // take turns among healthy backends
+	BalanceLeastLatency = "least-latency" // use the healthy backend that connects fastest
+)
+
+// TagPrefix is the prefix of a VirtualService backend selecting
+// peers by ACL tag, as in "tag:db".
+const TagPrefix = "tag:"
+
+// A VirtualService is a local TCP address on which tailscaled accepts
+// connections and forwards each to one of several peers offering the
+// same service, such as any of three database replicas. Backends are
+// health checked, and unhealthy ones are skipped.
+type VirtualService struct {
+	// Name names the service. It must be a valid DNS label. With
+	// MagicDNS, "<Name>.svc.<tailnet domain>" resolves to Addr's IP.
+	Name string
+
+	// Addr is the local address to listen on, usually a loopback
+	// address such as 127.0.0.1:5432.
+	Addr netaddr.IPPort
+
+	// Backends select the peers to forward to. Each is a peer's name
+	// or Tailscale IP, a peer group as "group:NAME", or an ACL tag
+	// as "tag:NAME", matching the peers the control server granted
+	// it to.
+	Backends []string
+
+	// Port is the backends' port. Zero means Addr's port.
+	Port uint16 `json:",omitempty"`
+
+	// Balance is the load balancing policy, BalanceRoundRobin (the
+	// default if empty) or BalanceLeastLatency.
+	Balance string `json:",omitempty"`
+}
+
+// Check reports whether s is a valid virtual service.
+func (s VirtualService) Check() error {
+	if s.Name == "" || dnsname.SanitizeLabel(s.Name) != s.Name {
+		return fmt.Errorf("invalid name %q; must be a lowercase DNS label", s.Name)
+	}
+	if s.Addr.IP.IsZero() || s.Addr.Port == 0 {
+		return fmt.Errorf("invalid listen address %v", s.Addr)
+	}
+	if len(s.Backends) == 0 {
+		return errors.New("no backends")
+	}
+	for _, be := range s.Backends {
+		if be == "" || be == TagPrefix || be == PeerGroupPrefix {
+			return fmt.Errorf("invalid backend %q", be)
+		}
+	}
+	switch s.Balance {
+	case "", BalanceRoundRobin, BalanceLeastLatency:
+	default:
+		return fmt.Errorf("unknown balance policy %q; want %q or %q", s.Balance, BalanceRoundRobin, BalanceLeastLatency)
+	}
+	return nil
+}
+
+// Equal reports whether s and s2 are the same.
+func (s VirtualService) Equal(s2 VirtualService) bool {
+	return s.Name == s2.Name &&
+		s.Addr == s2.Addr &&
+		compareStrings(s.Backends, s2.Backends) &&
+		s.Port == s2.Port &&
+		s.Balance == s2.Balance
+}
+
+// BackendPort returns the port to connect to on the backends.
+func (s VirtualService) BackendPort() uint16 {
+	if s.Port != 0 {
+		return s.Port
+	}
+	return s.Addr.Port
+}
+
+func (s VirtualService) String() string {
+	balance := s.Balance
+	if balance == "" {
+		balance = BalanceRoundRobin
+	}
+	return fmt.Sprintf("%s:%v->%s:%d(%s)", s.Name, s.Addr, strings.Join(s.Backends, ","), s.BackendPort(), balance)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestVirtualServiceCheck(t *testing.T) {
+	addr := netaddr.MustParseIPPort("127.0.0.1:5432")
+	tests := []struct {
+		name string
+		s    VirtualService
+		ok   bool
+	}{
+		{"ok", VirtualService{Name: "db", Addr: addr, Backends: []string{"tag:db"}}, true},
+		{"least-latency", VirtualService{Name: "db", Addr: addr, Backends: []string{"db1", "100.64.0.2"}, Balance: BalanceLeastLatency}, true},
+		{"bad-name", VirtualService{Name: "My DB", Addr: addr, Backends: []string{"tag:db"}}, false},
+		{"no-addr", VirtualService{Name: "db", Backends: []string{"tag:db"}}, false},
+		{"no-backends", VirtualService{Name: "db", Addr: addr}, false},
+		{"empty-tag", VirtualService{Name: "db", Addr: addr, Backends: []string{"tag:"}}, false},
+		{"bad-balance", VirtualService{Name: "db", Addr: addr, Backends: []string{"tag:db"}, Balance: "random"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.s.Check(); (err == nil) != tt.ok {
+			t.Errorf("%s: Check = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+// Headers that the proxy in front of the LocalAPI's web UI, such as
+// "tailscale web", sets to describe the browser's request. The proxy
+// forwards the browser's Host, Origin, Referer and Sec-Fetch-Site
+// headers unchanged.
+const (
+	// WebPathHeader is the path the browser requested, which the
+	// web UI redirects back to after a form submission.
+	WebPathHeader = "Tailscale-Web-Path"
+
+	// WebLoopbackOnlyHeader, if "true", says that the proxy only
+	// listens on loopback, in which case requests must name a
+	// loopback host, so that other sites can't reach the UI by DNS
+	// rebinding.
+	WebLoopbackOnlyHeader = "Tailscale-Web-Loopback-Only"
+)
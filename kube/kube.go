@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package kube is a minimal client for the Kubernetes API, just
+// sufficient to read and write Secrets from within a pod.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// saPath is where Kubernetes mounts a pod's service account
+// credentials.
+const saPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ErrNotFound is returned by Client.GetSecret when the secret
+// doesn't exist.
+var ErrNotFound = errors.New("kube: not found")
+
+// Secret is a Kubernetes Secret, with only the fields this package
+// uses.
+type Secret struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// ObjectMeta is the metadata common to all Kubernetes objects.
+type ObjectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Status is the error object returned by the Kubernetes API.
+type Status struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("kube: %s (%s, %d)", s.Message, s.Reason, s.Code)
+}
+
+// Client is a Kubernetes API client, scoped to a single namespace.
+type Client struct {
+	// URL is the base URL of the API server,
+	// such as "https://10.0.0.1:443".
+	URL string
+	// Namespace is the namespace to operate in.
+	Namespace string
+	// Token is the bearer token used to authenticate, if non-empty.
+	Token string
+	// HTTPClient is the HTTP client to use; nil means
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// NewInClusterClient returns a Client configured from the service
+// account and environment that Kubernetes provides to pods.
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kube: not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST unset)")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(saPath, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ns, err := ioutil.ReadFile(filepath.Join(saPath, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(saPath, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("kube: no certificates found in service account ca.crt")
+	}
+	return &Client{
+		URL:       "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(ns)),
+		Token:     strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		},
+	}, nil
+}
+
+func (c *Client) secretURL(name string) string {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets", c.URL, url.PathEscape(c.Namespace))
+	if name != "" {
+		u += "/" + url.PathEscape(name)
+	}
+	return u
+}
+
+// do sends an API request with the JSON encoding of in as its body,
+// if non-nil, and decodes the JSON response into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, u, contentType string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		st := new(Status)
+		if err := json.Unmarshal(slurp, st); err != nil || st.Message == "" {
+			return fmt.Errorf("kube: %s %s: %s", method, u, res.Status)
+		}
+		return st
+	}
+	if out != nil {
+		return json.Unmarshal(slurp, out)
+	}
+	return nil
+}
+
+// GetSecret returns the named secret.
+// It returns ErrNotFound if the secret doesn't exist.
+func (c *Client) GetSecret(ctx context.Context, name string) (*Secret, error) {
+	s := new(Secret)
+	if err := c.do(ctx, "GET", c.secretURL(name), "", nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateSecret creates s.
+func (c *Client) CreateSecret(ctx context.Context, s *Secret) error {
+	s.APIVersion, s.Kind = "v1", "Secret"
+	s.Metadata.Namespace = c.Namespace
+	return c.do(ctx, "POST", c.secretURL(""), "application/json", s, nil)
+}
+
+// PatchSecretData sets the given data keys of the named secret,
+// leaving its other keys alone.
+func (c *Client) PatchSecretData(ctx context.Context, name string, data map[string][]byte) error {
+	patch := struct {
+		Data map[string][]byte `json:"data"`
+	}{data}
+	return c.do(ctx, "PATCH", c.secretURL(name), "application/merge-patch+json", patch, nil)
+}
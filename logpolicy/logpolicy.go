@@ -40,6 +40,10 @@ import (
 	"tailscale.com/version"
 )
 
+// maxLogBufferFileSize is the size of each of the two files logs are
+// buffered in before upload.
+const maxLogBufferFileSize = 50 << 20
+
 // Config represents an instance of logs in a collection.
 type Config struct {
 	Collection string
@@ -95,15 +99,6 @@ func (stderrWriter) Write(buf []byte) (int, error) {
 	return os.Stderr.Write(buf)
 }
 
-type logWriter struct {
-	logger *log.Logger
-}
-
-func (l logWriter) Write(buf []byte) (int, error) {
-	l.logger.Printf("%s", buf)
-	return len(buf), nil
-}
-
 // logsDir returns the directory to use for log configuration and
 // buffer storage.
 func logsDir(logf logger.Logf) string {
@@ -308,9 +303,9 @@ func tryFixLogStateLocation(dir, cmdname string) {
 	}
 }
 
-// New returns a new log policy (a logger and its instance ID) for a
-// given collection name.
-func New(collection string) *Policy {
+// consoleLogFlags returns the log package flags for logs written to
+// stderr.
+func consoleLogFlags() int {
 	var lflags int
 	if term.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -325,8 +320,19 @@ func New(collection string) *Policy {
 		// anyway, no need to add one.
 		lflags = 0
 	}
-	console := log.New(stderrWriter{}, "", lflags)
+	return lflags
+}
+
+// New returns a new log policy (a logger and its instance ID) for a
+// given collection name, which writes logs locally as plain text on
+// stderr.
+func New(collection string) *Policy {
+	return NewWithSink(collection, newTextSink())
+}
 
+// NewWithSink is like New, but writes logs locally to sink, such as
+// one from NewLocalSink.
+func NewWithSink(collection string, sink logtail.LevelWriter) *Policy {
 	var earlyErrBuf bytes.Buffer
 	earlyLogf := func(format string, a ...interface{}) {
 		fmt.Fprintf(&earlyErrBuf, format, a...)
@@ -389,7 +395,7 @@ func New(collection string) *Policy {
 	c := logtail.Config{
 		Collection: newc.Collection,
 		PrivateID:  newc.PrivateID,
-		Stderr:     logWriter{console},
+		Stderr:     sink,
 		NewZstdEncoder: func() logtail.Encoder {
 			w, err := smallzstd.NewEncoder(nil)
 			if err != nil {
@@ -407,12 +413,16 @@ func New(collection string) *Policy {
 		c.HTTPC = &http.Client{Transport: newLogtailTransport(u.Host)}
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{})
+	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{
+		// Bound how much is buffered on disk while the log
+		// server is unreachable.
+		MaxFileSize: maxLogBufferFileSize,
+	})
 	if filchBuf != nil {
 		c.Buffer = filchBuf
 	}
 	lw := logtail.NewLogger(c, log.Printf)
-	log.SetFlags(0) // other logflags are set on console, not here
+	log.SetFlags(0) // other logflags are set by the local sink, not here
 	log.SetOutput(lw)
 
 	log.Printf("Program starting: v%v, Go %v: %#v",
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+// LocalFormats are the formats NewLocalSink accepts, for flag help.
+const LocalFormats = "text, json, syslog or eventlog"
+
+// NewLocalSink returns where to write logs locally, in the given
+// format:
+//
+//	text      plain text on stderr, as by default
+//	json      a JSON object per line on stdout, with "time", "level"
+//	          (the verbosity level, 0 for normal) and "msg" fields
+//	syslog    the local syslog daemon, with verbose lines at debug
+//	          severity; not on Windows
+//	eventlog  the Windows Event Log, under the "Tailscale" source;
+//	          Windows only
+func NewLocalSink(format string) (logtail.LevelWriter, error) {
+	switch format {
+	case "", "text":
+		return newTextSink(), nil
+	case "json":
+		return jsonSink{}, nil
+	case "syslog":
+		return newSyslogSink()
+	case "eventlog":
+		return newEventLogSink()
+	}
+	return nil, fmt.Errorf("unknown log format %q; want %s", format, LocalFormats)
+}
+
+// textSink writes plain text logs to stderr, with timestamps if
+// nothing else (a terminal or journald) adds them.
+type textSink struct {
+	logger *log.Logger
+}
+
+func newTextSink() textSink {
+	return textSink{log.New(stderrWriter{}, "", consoleLogFlags())}
+}
+
+func (s textSink) Write(buf []byte) (int, error) {
+	s.logger.Printf("%s", buf)
+	return len(buf), nil
+}
+
+func (s textSink) WriteLevel(level int, buf []byte) (int, error) {
+	return s.Write(buf)
+}
+
+// jsonSink writes logs to stdout as JSON objects, one per line.
+type jsonSink struct{}
+
+type jsonLogLine struct {
+	Time  time.Time `json:"time"`
+	Level int       `json:"level"`
+	Msg   string    `json:"msg"`
+}
+
+func (s jsonSink) Write(buf []byte) (int, error) {
+	return s.WriteLevel(0, buf)
+}
+
+func (jsonSink) WriteLevel(level int, buf []byte) (int, error) {
+	j, err := json.Marshal(jsonLogLine{
+		Time:  time.Now().UTC(),
+		Level: level,
+		Msg:   string(bytes.TrimRight(buf, "\n")),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stdout.Write(append(j, '\n')); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package logpolicy
+
+import (
+	"errors"
+	"log/syslog"
+
+	"tailscale.com/logtail"
+	"tailscale.com/version"
+)
+
+// syslogSink writes logs to the local syslog daemon.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (logtail.LevelWriter, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, version.CmdName())
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) Write(buf []byte) (int, error) {
+	return s.WriteLevel(0, buf)
+}
+
+func (s syslogSink) WriteLevel(level int, buf []byte) (int, error) {
+	var err error
+	if level > 0 {
+		err = s.w.Debug(string(buf))
+	} else {
+		err = s.w.Info(string(buf))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func newEventLogSink() (logtail.LevelWriter, error) {
+	return nil, errors.New("the eventlog log format is only supported on Windows")
+}
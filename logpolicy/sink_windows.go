@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+	"tailscale.com/logtail"
+)
+
+// logEventID is the event ID of log lines in the Windows Event Log.
+const logEventID = 1
+
+// eventLogSink writes logs to the Windows Event Log.
+type eventLogSink struct {
+	l *eventlog.Log
+}
+
+func newEventLogSink() (logtail.LevelWriter, error) {
+	l, err := eventlog.Open("Tailscale")
+	if err != nil {
+		return nil, err
+	}
+	return eventLogSink{l}, nil
+}
+
+func (s eventLogSink) Write(buf []byte) (int, error) {
+	return s.WriteLevel(0, buf)
+}
+
+func (s eventLogSink) WriteLevel(level int, buf []byte) (int, error) {
+	// The Event Log has no debug severity, so verbose lines are
+	// informational too.
+	if err := s.l.Info(logEventID, strings.TrimRight(string(buf), "\n")); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func newSyslogSink() (logtail.LevelWriter, error) {
+	return nil, errors.New("the syslog log format isn't supported on Windows; use eventlog")
+}
@@ -19,17 +19,27 @@ var stderrFD = 2 // a variable for testing
 
 type Options struct {
 	ReplaceStderr bool // dup over fd 2 so everything written to stderr comes here
+
+	// MaxFileSize, if non-zero, is the size in bytes at which the
+	// file being written is rotated. If the other file hasn't been
+	// read out yet by then, its unread logs are dropped, so the two
+	// files together hold at most about twice this.
+	// Writes to the replaced stderr aren't counted.
+	MaxFileSize int64
 }
 
 // A Filch uses two alternating files as a simplistic ring buffer.
 type Filch struct {
 	OrigStderr *os.File
 
-	mu        sync.Mutex
-	cur       *os.File
-	alt       *os.File
-	altscan   *bufio.Scanner
-	recovered int64
+	mu          sync.Mutex
+	cur         *os.File
+	alt         *os.File
+	altscan     *bufio.Scanner
+	altRead     int64 // bytes of alt returned by TryReadLine
+	recovered   int64
+	maxFileSize int64
+	writeSize   int64 // bytes written to cur by Write
 }
 
 // TryReadline implements the logtail.Buffer interface.
@@ -44,6 +54,7 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 	}
 
 	f.cur, f.alt = f.alt, f.cur
+	f.writeSize = 0
 	if f.OrigStderr != nil {
 		if err := dup2Stderr(f.cur); err != nil {
 			return nil, err
@@ -54,12 +65,15 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 	}
 	f.altscan = bufio.NewScanner(f.alt)
 	f.altscan.Split(splitLines)
+	f.altRead = 0
 	return f.scan()
 }
 
 func (f *Filch) scan() ([]byte, error) {
 	if f.altscan.Scan() {
-		return f.altscan.Bytes(), nil
+		b := f.altscan.Bytes()
+		f.altRead += int64(len(b))
+		return b, nil
 	}
 	err := f.altscan.Err()
 	err2 := f.alt.Truncate(0)
@@ -86,9 +100,57 @@ func (f *Filch) Write(b []byte) (int, error) {
 		bnl := make([]byte, len(b)+1)
 		copy(bnl, b)
 		bnl[len(bnl)-1] = '\n'
-		return f.cur.Write(bnl)
+		b = bnl
+	}
+	if f.maxFileSize > 0 && f.writeSize > 0 && f.writeSize+int64(len(b)) > f.maxFileSize {
+		if err := f.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.cur.Write(b)
+	f.writeSize += int64(n)
+	return n, err
+}
+
+// rotateLocked makes the full cur file the one to be read out next,
+// dropping any logs in alt that haven't been read yet, and continues
+// writing to the emptied alt.
+func (f *Filch) rotateLocked() error {
+	fi, err := f.alt.Stat()
+	if err != nil {
+		return err
+	}
+	var dropped int64
+	if f.altscan != nil {
+		dropped = fi.Size() - f.altRead
+	}
+	f.altscan = nil
+	if err := f.alt.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f.cur, f.alt = f.alt, f.cur
+	f.writeSize = 0
+	if f.OrigStderr != nil {
+		if err := dup2Stderr(f.cur); err != nil {
+			return err
+		}
 	}
-	return f.cur.Write(b)
+	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.altscan = bufio.NewScanner(f.alt)
+	f.altscan.Split(splitLines)
+	f.altRead = 0
+
+	if dropped > 0 {
+		n, _ := fmt.Fprintf(f.cur, "filch: buffer full; dropped %d bytes of unread logs\n", dropped)
+		f.writeSize += int64(n)
+	}
+	return nil
 }
 
 // Close closes the Filch, releasing all os resources.
@@ -150,7 +212,8 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 	}
 
 	f = &Filch{
-		OrigStderr: os.Stderr, // temporary, for past logs recovery
+		OrigStderr:  os.Stderr, // temporary, for past logs recovery
+		maxFileSize: opts.MaxFileSize,
 	}
 
 	// Neither, either, or both files may exist and contain logs from
@@ -77,6 +77,22 @@ func TestQueue(t *testing.T) {
 	f.close(t)
 }
 
+func TestMaxFileSize(t *testing.T) {
+	filePrefix := t.TempDir()
+	f := newFilchTest(t, filePrefix, Options{MaxFileSize: 10})
+
+	f.write(t, "line one")
+	f.write(t, "line two") // rotates; "line one" is now read next
+	f.read(t, "line one")
+	f.write(t, "line three") // rotates; nothing unread is dropped
+	f.write(t, "line four")  // rotates; unread "line two" is dropped
+	f.read(t, "line three")
+	f.read(t, "filch: buffer full; dropped 9 bytes of unread logs")
+	f.read(t, "line four")
+	f.readEOF(t)
+	f.close(t)
+}
+
 func TestRecover(t *testing.T) {
 	t.Run("empty", func(t *testing.T) {
 		filePrefix := t.TempDir()
@@ -19,6 +19,7 @@ import (
 
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/syncs"
 	tslogger "tailscale.com/types/logger"
 	"tailscale.com/wgengine/monitor"
 )
@@ -27,6 +28,28 @@ import (
 // Config.BaseURL isn't provided.
 const DefaultHost = "log.tailscale.io"
 
+var logtailDisabled syncs.AtomicBool
+
+// Disable disables uploading logs to the log server for the rest of
+// the process's lifetime. Logs are still written to stderr (Config.Stderr)
+// but are no longer buffered, and any already buffered are discarded.
+// It can't be undone.
+func Disable() {
+	logtailDisabled.Set(true)
+}
+
+// LevelWriter is implemented by Config.Stderr writers that want to
+// know the verbosity level of each log line, such as to map it to a
+// syslog severity. Logger calls WriteLevel instead of Write on them.
+type LevelWriter interface {
+	io.Writer
+
+	// WriteLevel writes a log line of the given verbosity level,
+	// with its "[vN] " prefix removed. buf might not end in a
+	// newline.
+	WriteLevel(level int, buf []byte) (int, error)
+}
+
 type Encoder interface {
 	EncodeAll(src, dst []byte) []byte
 	Close() error
@@ -267,6 +290,14 @@ func (l *Logger) uploading(ctx context.Context) {
 
 	for {
 		body := l.drainPending()
+		if logtailDisabled.Get() {
+			select {
+			case <-l.shutdownStart:
+				return
+			default:
+			}
+			continue
+		}
 		origlen := -1 // sentinel value: uncompressed
 		// Don't attempt to compress tiny bodies; not worth the CPU cycles.
 		if l.zstdEncoder != nil && len(body) > 256 {
@@ -514,7 +545,9 @@ func (l *Logger) Write(buf []byte) (int, error) {
 		return 0, nil
 	}
 	level, buf := parseAndRemoveLogLevel(buf)
-	if l.stderr != nil && l.stderr != ioutil.Discard && level <= l.stderrLevel {
+	if lw, ok := l.stderr.(LevelWriter); ok && level <= l.stderrLevel {
+		lw.WriteLevel(level, buf)
+	} else if l.stderr != nil && l.stderr != ioutil.Discard && level <= l.stderrLevel {
 		if buf[len(buf)-1] == '\n' {
 			l.stderr.Write(buf)
 		} else {
@@ -524,6 +557,9 @@ func (l *Logger) Write(buf []byte) (int, error) {
 			l.stderr.Write(withNL)
 		}
 	}
+	if logtailDisabled.Get() {
+		return len(buf), nil
+	}
 	b := l.encode(buf)
 	_, err := l.send(b)
 	return len(buf), err
@@ -7,10 +7,12 @@ package logtail
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -253,6 +255,36 @@ func TestLoggerWriteLength(t *testing.T) {
 	}
 }
 
+type levelWriter struct {
+	lines []string
+}
+
+func (w *levelWriter) Write(buf []byte) (int, error) {
+	panic("Write called on LevelWriter")
+}
+
+func (w *levelWriter) WriteLevel(level int, buf []byte) (int, error) {
+	w.lines = append(w.lines, fmt.Sprintf("%d %s", level, buf))
+	return len(buf), nil
+}
+
+func TestLoggerLevelWriter(t *testing.T) {
+	w := new(levelWriter)
+	lg := &Logger{
+		stderr:      w,
+		stderrLevel: 1,
+		timeNow:     time.Now,
+		buffer:      NewMemoryBuffer(1024),
+	}
+	lg.Write([]byte("plain\n"))
+	lg.Write([]byte("[v1] chatty\n"))
+	lg.Write([]byte("[v2] chattier\n"))
+	want := []string{"0 plain\n", "1 chatty\n"}
+	if !reflect.DeepEqual(w.lines, want) {
+		t.Errorf("got %q; want %q", w.lines, want)
+	}
+}
+
 func TestParseAndRemoveLogLevel(t *testing.T) {
 	tests := []struct {
 		log       string
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package handover lets a running tailscaled replace itself with a
+// new binary while keeping its open TUN device, UDP sockets and
+// LocalAPI listener, so that an upgrade doesn't tear down the
+// interface, its routes, or the ports peers know to reach it on.
+//
+// The old process marks the files to keep as inherited, records
+// their descriptors in an environment variable, and execs the new
+// binary in its place (keeping its PID, so service managers don't
+// notice). The new process picks them up with Take.
+//
+// WireGuard session keys live only in memory and aren't handed over,
+// so peers re-handshake with the new process. That takes a round
+// trip rather than the seconds it takes to set up a new interface
+// and rediscover endpoints.
+package handover
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// envVar names the environment variable through which the old process
+// tells the new one which descriptors it inherited, as a
+// comma-separated list of name=fd pairs.
+const envVar = "TS_HANDOVER_FDS"
+
+// ErrNotSupported is returned by Exec on platforms where handover
+// isn't implemented.
+var ErrNotSupported = errors.New("handover not supported on this platform")
+
+// File is an open file, socket or listener to pass to the new process.
+type File struct {
+	// Name is how the new process asks for the file with Take.
+	Name string
+
+	// Conn is the file to pass. It's typically an *os.File, a
+	// *net.UDPConn or a *net.UnixListener.
+	Conn syscall.Conn
+}
+
+var (
+	inheritedOnce sync.Once
+	inheritedMu   sync.Mutex
+	inherited     map[string]*os.File
+)
+
+// Take returns the file called name that this process inherited from
+// the process it replaced, or nil if there's no such file. Each file
+// can only be taken once; the caller owns it.
+func Take(name string) *os.File {
+	inheritedOnce.Do(loadInherited)
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	f := inherited[name]
+	delete(inherited, name)
+	return f
+}
+
+// Inherited reports whether this process was started by Exec.
+func Inherited() bool {
+	inheritedOnce.Do(loadInherited)
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	return inherited != nil
+}
+
+func loadInherited() {
+	v := os.Getenv(envVar)
+	if v == "" {
+		return
+	}
+	// Don't pass the list on to any of our own children, which
+	// don't have the descriptors.
+	os.Unsetenv(envVar)
+	fds, err := parseFDs(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "handover: ignoring %s: %v\n", envVar, err)
+		return
+	}
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	inherited = make(map[string]*os.File, len(fds))
+	for name, fd := range fds {
+		inherited[name] = newFile(fd, name)
+	}
+}
+
+// formatFDs returns the envVar value for the named descriptors.
+func formatFDs(names []string, fds []int) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%d", name, fds[i])
+	}
+	return sb.String()
+}
+
+// parseFDs parses an envVar value.
+func parseFDs(v string) (map[string]int, error) {
+	ret := map[string]int{}
+	for _, kv := range strings.Split(v, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed entry %q", kv)
+		}
+		name := kv[:i]
+		fd, err := strconv.Atoi(kv[i+1:])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("bad descriptor in %q", kv)
+		}
+		if _, dup := ret[name]; dup {
+			return nil, fmt.Errorf("duplicate name %q", name)
+		}
+		ret[name] = fd
+	}
+	return ret, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handover
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Exec replaces the current process with a new run of its executable,
+// with the same arguments, passing it files. The executable is looked
+// up again by path, so a binary upgraded in place since this process
+// started is the one that runs.
+//
+// Exec only returns if the exec fails, in which case the current
+// process carries on as before.
+func Exec(files []File) error {
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	fds := make([]int, 0, len(files))
+	defer func() {
+		// Only reached if the exec failed.
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
+	for _, f := range files {
+		fd, err := dup(f.Conn)
+		if err != nil {
+			return fmt.Errorf("handover: %s: %w", f.Name, err)
+		}
+		names = append(names, f.Name)
+		fds = append(fds, fd)
+	}
+
+	env := []string{envVar + "=" + formatFDs(names, fds)}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envVar+"=") {
+			env = append(env, kv)
+		}
+	}
+	if err := syscall.Exec(exe, os.Args, env); err != nil {
+		return fmt.Errorf("handover: exec %s: %w", exe, err)
+	}
+	panic("unreachable")
+}
+
+// dup returns a copy of c's descriptor that survives exec.
+func dup(c syscall.Conn) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	nfd := -1
+	var dupErr error
+	// Unlike the File methods of os and net, this doesn't switch
+	// the descriptor to blocking mode, which would affect the
+	// original too. dup(2) clears close-on-exec on the copy.
+	err = rc.Control(func(fd uintptr) {
+		nfd, dupErr = syscall.Dup(int(fd))
+	})
+	if err != nil {
+		return -1, err
+	}
+	return nfd, dupErr
+}
+
+// executable returns the path of the current process's executable.
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	// If the binary was replaced since we started, the kernel
+	// reports the old, unlinked one as such. We want whatever is at
+	// that path now.
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+func newFile(fd int, name string) *os.File {
+	// The old process's sockets were non-blocking. Keep it that way
+	// so os and net use the runtime poller rather than a thread per
+	// blocked read.
+	syscall.SetNonblock(fd, true)
+	return os.NewFile(uintptr(fd), name)
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package handover
+
+import "os"
+
+// Exec returns ErrNotSupported on this platform.
+func Exec(files []File) error {
+	return ErrNotSupported
+}
+
+func newFile(fd int, name string) *os.File {
+	return os.NewFile(uintptr(fd), name)
+}
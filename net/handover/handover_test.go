@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handover
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFDs(t *testing.T) {
+	v := formatFDs([]string{"tun", "udp4", "localapi"}, []int{7, 8, 12})
+	if want := "tun=7,udp4=8,localapi=12"; v != want {
+		t.Errorf("formatFDs = %q; want %q", v, want)
+	}
+	got, err := parseFDs(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"tun": 7, "udp4": 8, "localapi": 12}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFDs = %v; want %v", got, want)
+	}
+
+	for _, bad := range []string{"tun", "=3", "tun=x", "tun=-1", "tun=3,tun=4", "tun=3,"} {
+		if _, err := parseFDs(bad); err == nil {
+			t.Errorf("parseFDs(%q) succeeded; want error", bad)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httpproxy is an HTTP proxy server implementation for
+// userspace networking in Tailscale. It supports CONNECT tunnels and
+// plain HTTP requests with absolute URLs.
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// Server is an HTTP proxy server.
+type Server struct {
+	// Logf optionally specifies the logger to use.
+	// If nil, the standard logger is used.
+	Logf logger.Logf
+
+	// Dialer optionally specifies the dialer to use for outgoing connections.
+	// If nil, the net package's standard dialer is used.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	rpOnce sync.Once
+	rp     *httputil.ReverseProxy // for plain HTTP requests; shared so its Transport reuses connections
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := s.Dialer
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = dialer.DialContext
+	}
+	return dial(ctx, network, addr)
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	logf := s.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	logf(format, args...)
+}
+
+// Serve accepts and handles incoming connections on the given listener.
+func (s *Server) Serve(l net.Listener) error {
+	hs := &http.Server{
+		Handler:  s,
+		ErrorLog: logger.StdLogger(s.logf),
+	}
+	return hs.Serve(l)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		s.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "proxy only supports CONNECT and absolute http:// URLs", http.StatusBadRequest)
+		return
+	}
+	s.reverseProxy().ServeHTTP(w, r)
+}
+
+func (s *Server) reverseProxy() *httputil.ReverseProxy {
+	s.rpOnce.Do(func() {
+		s.rp = &httputil.ReverseProxy{
+			Director: func(*http.Request) {},
+			Transport: &http.Transport{
+				DialContext:           s.dial,
+				ResponseHeaderTimeout: time.Minute,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			ErrorLog: logger.StdLogger(s.logf),
+		}
+	})
+	return s.rp
+}
+
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	back, err := s.dial(ctx, "tcp", r.Host)
+	if err != nil {
+		s.logf("CONNECT %s from %v: %v", r.Host, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer back.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't hijack connection", http.StatusInternalServerError)
+		return
+	}
+	front, bufrw, err := hj.Hijack()
+	if err != nil {
+		s.logf("hijack: %v", err)
+		return
+	}
+	defer front.Close()
+	if _, err := io.WriteString(front, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		// Bytes the client sent after the CONNECT request may
+		// already be buffered.
+		_, err := io.Copy(back, bufrw.Reader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(front, back)
+		errc <- err
+	}()
+	<-errc
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newProxy(t *testing.T) (s *Server, proxyURL *url.URL, dials *int32) {
+	dials = new(int32)
+	s = &Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	ps := httptest.NewServer(s)
+	t.Cleanup(ps.Close)
+	u, err := url.Parse(ps.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, u, dials
+}
+
+func TestPlainHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	s, proxyURL, dials := newProxy(t)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := 0; i < 3; i++ {
+		res, err := c.Get(backend.URL + "/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello /x" {
+			t.Errorf("body = %q", body)
+		}
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Errorf("proxy dialed the backend %d times for 3 requests; want 1", n)
+	}
+	if rp := s.reverseProxy(); rp != s.reverseProxy() {
+		t.Error("reverse proxy not reused")
+	}
+}
+
+func TestRejectsRelativeURL(t *testing.T) {
+	s := &Server{Logf: t.Logf}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/foo", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c) // echo
+	}()
+
+	_, proxyURL, _ := newProxy(t)
+	c, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nping", ln.Addr(), ln.Addr())
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("CONNECT status = %v", res.Status)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); !strings.EqualFold(got, "ping") {
+		t.Errorf("echoed %q; want %q", got, "ping")
+	}
+}
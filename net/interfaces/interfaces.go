@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"inet.af/netaddr"
 	"tailscale.com/net/tsaddr"
@@ -54,7 +55,8 @@ func Tailscale() (net.IP, *net.Interface, error) {
 // maybeTailscaleInterfaceName reports whether s is an interface
 // name that might be used by Tailscale.
 func maybeTailscaleInterfaceName(s string) bool {
-	return s == "Tailscale" ||
+	return isRegisteredInterface(s) ||
+		s == "Tailscale" ||
 		strings.HasPrefix(s, "wg") ||
 		strings.HasPrefix(s, "ts") ||
 		strings.HasPrefix(s, "tailscale") ||
@@ -113,7 +115,9 @@ func LocalAddresses() (regular, loopback []netaddr.IP, err error) {
 				if tsaddr.IsTailscaleIP(ip) {
 					continue
 				}
-				if linkLocalIPv4.Contains(ip) {
+				// Link-local addresses are only reachable
+				// with a zone that peers can't know.
+				if linkLocalIPv4.Contains(ip) || linkLocalIPv6.Contains(ip) {
 					continue
 				}
 				if ip.IsLoopback() || ifcIsLoopback {
@@ -225,6 +229,12 @@ type State struct {
 	// the Interface maps above; it's only used for debugging.
 	DefaultRouteInterface string
 
+	// DefaultRouteInterfaceIndex is the index of the interface
+	// holding the IPv4 default route, or 0 if unknown. Unlike
+	// DefaultRouteInterface, it can be used to bind sockets to that
+	// interface.
+	DefaultRouteInterfaceIndex int
+
 	// HTTPProxy is the HTTP proxy to use.
 	HTTPProxy string
 
@@ -321,8 +331,9 @@ func (s *State) RemoveUninterestingInterfacesAndAddresses() {
 }
 
 // RemoveTailscaleInterfaces modifes s to remove any interfaces that
-// are owned by this process. (TODO: make this true; currently it
-// uses some heuristics)
+// are owned by this process: those registered with
+// RegisterTailscaleInterface, plus some heuristics for interfaces
+// created by other means.
 func (s *State) RemoveTailscaleInterfaces() {
 	for name, pfxs := range s.InterfaceIPs {
 		if isTailscaleInterface(name, pfxs) {
@@ -351,13 +362,60 @@ func isTailscaleInterface(name string, ips []netaddr.IPPrefix) bool {
 		// macOS NetworkExtensions and utun devices.
 		return true
 	}
-	return name == "Tailscale" || // as it is on Windows
-		strings.HasPrefix(name, "tailscale") // TODO: use --tun flag value, etc; see TODO in method doc
+	return isRegisteredInterface(name) ||
+		name == "Tailscale" || // as it is on Windows
+		strings.HasPrefix(name, "tailscale")
+}
+
+var (
+	registeredMu sync.Mutex
+	registered   = map[string]int{} // interface name => number of registrations
+)
+
+// RegisterTailscaleInterface notes that the interface named name is a
+// TUN device of one of this process's engines, so that it's treated
+// as a Tailscale interface whatever its name. Several engines in one
+// process can each register their own. It returns a func to undo the
+// registration.
+func RegisterTailscaleInterface(name string) (unregister func()) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered[name]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			registeredMu.Lock()
+			defer registeredMu.Unlock()
+			if registered[name]--; registered[name] == 0 {
+				delete(registered, name)
+			}
+		})
+	}
+}
+
+func isRegisteredInterface(name string) bool {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	return registered[name] > 0
 }
 
 // getPAC, if non-nil, returns the current PAC file URL.
 var getPAC func() string
 
+// defaultRouteInterfaceIndex returns the index of the interface with
+// the given name, as returned by DefaultRouteInterface, or 0. It's
+// replaced on Windows, where that name is only descriptive.
+var defaultRouteInterfaceIndex = func(name string) int {
+	if name == "" {
+		return 0
+	}
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0
+	}
+	return ifc.Index
+}
+
 // GetState returns the state of all the current machine's network interfaces.
 //
 // It does not set the returned State.IsExpensive. The caller can populate that.
@@ -385,6 +443,7 @@ func GetState() (*State, error) {
 	}
 
 	s.DefaultRouteInterface, _ = DefaultRouteInterface()
+	s.DefaultRouteInterfaceIndex = defaultRouteInterfaceIndex(s.DefaultRouteInterface)
 
 	if s.AnyInterfaceUp() {
 		req, err := http.NewRequest("GET", LoginEndpointForProxyDetermination, nil)
@@ -488,6 +547,7 @@ var (
 	private3      = mustCIDR("192.168.0.0/16")
 	privatev4s    = []netaddr.IPPrefix{private1, private2, private3}
 	linkLocalIPv4 = mustCIDR("169.254.0.0/16")
+	linkLocalIPv6 = mustCIDR("fe80::/10")
 	v6Global1     = mustCIDR("2000::/3")
 )
 
@@ -160,7 +160,8 @@ func defaultRouteInterfaceProcNet() (string, error) {
 		netmask := fields[7]
 
 		if strings.HasPrefix(ifc, "tailscale") ||
-			strings.HasPrefix(ifc, "wg") {
+			strings.HasPrefix(ifc, "wg") ||
+			isRegisteredInterface(ifc) {
 			continue
 		}
 		if ip == "00000000" && netmask == "00000000" {
@@ -31,6 +31,27 @@ func TestGetState(t *testing.T) {
 	t.Logf("As string without Tailscale:\n\t%s", st)
 }
 
+func TestRegisterTailscaleInterface(t *testing.T) {
+	const name = "test-ts-if0"
+	if isTailscaleInterface(name, nil) {
+		t.Fatalf("%s is a Tailscale interface before registration", name)
+	}
+	unreg1 := RegisterTailscaleInterface(name)
+	unreg2 := RegisterTailscaleInterface(name)
+	if !isTailscaleInterface(name, nil) {
+		t.Fatalf("%s isn't a Tailscale interface after registration", name)
+	}
+	unreg1()
+	unreg1() // no-op
+	if !isTailscaleInterface(name, nil) {
+		t.Fatalf("%s unregistered while still registered by a second engine", name)
+	}
+	unreg2()
+	if isTailscaleInterface(name, nil) {
+		t.Fatalf("%s is still a Tailscale interface after unregistration", name)
+	}
+}
+
 func TestLikelyHomeRouterIP(t *testing.T) {
 	gw, my, ok := LikelyHomeRouterIP()
 	if !ok {
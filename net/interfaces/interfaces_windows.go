@@ -23,6 +23,7 @@ import (
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPWindows
 	getPAC = getPACWindows
+	defaultRouteInterfaceIndex = defaultRouteInterfaceIndexWindows
 }
 
 /*
@@ -152,6 +153,14 @@ func DefaultRouteInterface() (string, error) {
 	return fmt.Sprintf("%s (%s)", iface.FriendlyName(), iface.Description()), nil
 }
 
+func defaultRouteInterfaceIndexWindows(string) int {
+	iface, err := GetWindowsDefault(windows.AF_INET)
+	if err != nil || iface == nil {
+		return 0
+	}
+	return int(iface.IfIndex)
+}
+
 var (
 	winHTTP                  = windows.NewLazySystemDLL("winhttp.dll")
 	detectAutoProxyConfigURL = winHTTP.NewProc("WinHttpDetectAutoProxyConfigUrl")
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ipforward checks whether the OS forwards IP packets, which
+// a subnet router or exit node needs to relay traffic.
+package ipforward
+
+import (
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// Check returns an error explaining how to turn on IP forwarding if
+// the OS doesn't forward packets of an IP family that routes
+// includes, or if it can't tell. It returns nil if forwarding is on,
+// and on platforms where it doesn't know how to check.
+func Check(routes []netaddr.IPPrefix) error {
+	return check(routes, forwarding)
+}
+
+// check is Check, with the OS's forwarding settings read by
+// forwarding.
+func check(routes []netaddr.IPPrefix, forwarding func(v6 bool) (on bool, setting string, err error)) error {
+	var want4, want6 bool
+	for _, r := range routes {
+		if r.IP.Is4() {
+			want4 = true
+		} else {
+			want6 = true
+		}
+	}
+	for _, v6 := range []bool{false, true} {
+		if v6 && !want6 || !v6 && !want4 {
+			continue
+		}
+		on, setting, err := forwarding(v6)
+		if err != nil {
+			return fmt.Errorf("couldn't check whether IP forwarding is on (%v); advertised routes won't work without it", err)
+		}
+		if !on {
+			return fmt.Errorf("IP forwarding is off, so traffic for advertised routes is dropped; %s", enableHint(setting))
+		}
+	}
+	return nil
+}
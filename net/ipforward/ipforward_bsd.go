@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin freebsd openbsd netbsd dragonfly
+
+package ipforward
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// forwarding reports whether the IPv4 or IPv6 forwarding sysctl is
+// on, and its name.
+func forwarding(v6 bool) (on bool, setting string, err error) {
+	setting = "net.inet.ip.forwarding"
+	if v6 {
+		setting = "net.inet6.ip6.forwarding"
+	}
+	out, err := exec.Command("sysctl", "-n", setting).Output()
+	if err != nil {
+		return false, setting, fmt.Errorf("sysctl %s: %v", setting, err)
+	}
+	n, err := strconv.Atoi(string(bytes.TrimSpace(out)))
+	if err != nil {
+		return false, setting, fmt.Errorf("unexpected %s value %q", setting, bytes.TrimSpace(out))
+	}
+	return n != 0, setting, nil
+}
+
+func enableHint(setting string) string {
+	return fmt.Sprintf("turn it on with \"sysctl %s=1\", and add \"%s=1\" to /etc/sysctl.conf to keep it on after reboots", setting, setting)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipforward
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// forwarding reports whether the IPv4 or IPv6 forwarding sysctl is
+// on, and its name.
+func forwarding(v6 bool) (on bool, setting string, err error) {
+	setting = "net.ipv4.ip_forward"
+	if v6 {
+		setting = "net.ipv6.conf.all.forwarding"
+	}
+	bs, err := ioutil.ReadFile("/proc/sys/" + strings.ReplaceAll(setting, ".", "/"))
+	if err != nil {
+		return false, setting, err
+	}
+	switch v := string(bytes.TrimSpace(bs)); v {
+	case "0":
+		return false, setting, nil
+	case "1", "2":
+		return true, setting, nil
+	default:
+		return false, setting, fmt.Errorf("unexpected %s value %q", setting, v)
+	}
+}
+
+func enableHint(setting string) string {
+	return fmt.Sprintf("turn it on with \"sysctl -w %s=1\", and add \"%s = 1\" to /etc/sysctl.conf to keep it on after reboots", setting, setting)
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!windows,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package ipforward
+
+// forwarding reports that forwarding is on, as there's no known way
+// to check it on this platform.
+func forwarding(v6 bool) (on bool, setting string, err error) {
+	return true, "", nil
+}
+
+func enableHint(setting string) string { return "" }
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipforward
+
+import (
+	"errors"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestCheck(t *testing.T) {
+	v4Route := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	v6Route := netaddr.MustParseIPPrefix("fd00::/64")
+	tests := []struct {
+		name    string
+		routes  []netaddr.IPPrefix
+		on4     bool
+		on6     bool
+		err     error
+		wantErr bool
+	}{
+		{name: "no_routes"},
+		{name: "v4_on", routes: []netaddr.IPPrefix{v4Route}, on4: true},
+		{name: "v4_off", routes: []netaddr.IPPrefix{v4Route}, on6: true, wantErr: true},
+		{name: "v4_only_ignores_v6", routes: []netaddr.IPPrefix{v4Route}, on4: true, on6: false},
+		{name: "v6_off", routes: []netaddr.IPPrefix{v4Route, v6Route}, on4: true, wantErr: true},
+		{name: "both_on", routes: []netaddr.IPPrefix{v4Route, v6Route}, on4: true, on6: true},
+		{name: "unreadable", routes: []netaddr.IPPrefix{v4Route}, err: errors.New("permission denied"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checked []bool
+			forwarding := func(v6 bool) (bool, string, error) {
+				checked = append(checked, v6)
+				if v6 {
+					return tt.on6, "ip6", tt.err
+				}
+				return tt.on4, "ip4", tt.err
+			}
+			err := check(tt.routes, forwarding)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v; want error: %v", err, tt.wantErr)
+			}
+			for _, v6 := range checked {
+				if !hasFamily(tt.routes, v6) {
+					t.Errorf("checked forwarding for IPv6=%v, with no such routes advertised", v6)
+				}
+			}
+		})
+	}
+}
+
+func hasFamily(routes []netaddr.IPPrefix, v6 bool) bool {
+	for _, r := range routes {
+		if r.IP.Is6() == v6 {
+			return true
+		}
+	}
+	return false
+}
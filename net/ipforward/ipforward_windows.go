@@ -0,0 +1,38 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipforward
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// forwarding reports whether IP routing is on, per the IPEnableRouter
+// registry value of the IPv4 or IPv6 stack, and the value's path.
+func forwarding(v6 bool) (on bool, setting string, err error) {
+	path := `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
+	if v6 {
+		path = `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`
+	}
+	setting = `HKLM\` + path + `\IPEnableRouter`
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return false, setting, err
+	}
+	defer k.Close()
+	v, _, err := k.GetIntegerValue("IPEnableRouter")
+	if err == registry.ErrNotExist {
+		return false, setting, nil
+	}
+	if err != nil {
+		return false, setting, err
+	}
+	return v != 0, setting, nil
+}
+
+func enableHint(setting string) string {
+	return fmt.Sprintf("turn it on by setting the DWORD %s to 1 and rebooting", setting)
+}
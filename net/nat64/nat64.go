@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nat64 discovers NAT64 prefixes (RFC 7050) and converts
+// between IPv4 addresses and their IPv4-embedded IPv6 form (RFC 6052).
+//
+// It's used on IPv6-only networks to reach IPv4-only destinations,
+// such as DERP servers or peer endpoints, via the network's NAT64
+// gateway.
+package nat64
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// WellKnownPrefix is the RFC 6052 well-known NAT64 prefix.
+var WellKnownPrefix = netaddr.MustParseIPPrefix("64:ff9b::/96")
+
+// ipv4OnlyName is the name that RFC 7050 says has only A records
+// (192.0.0.170 and 192.0.0.171), so any AAAA answer for it was
+// synthesized by a DNS64 resolver.
+const ipv4OnlyName = "ipv4only.arpa"
+
+var wellKnownIPv4s = []netaddr.IP{
+	netaddr.IPv4(192, 0, 0, 170),
+	netaddr.IPv4(192, 0, 0, 171),
+}
+
+// CLATPrefix is the IPv4 Service Continuity Prefix (RFC 7335) that a
+// 464XLAT CLAT (RFC 6877) gives the host's IPv4 address from, when it
+// provides IPv4 connectivity on an IPv6-only network.
+var CLATPrefix = netaddr.MustParseIPPrefix("192.0.0.0/29")
+
+// validPrefixBits are the NAT64 prefix lengths permitted by RFC 6052
+// section 2.2.
+var validPrefixBits = []uint8{32, 40, 48, 56, 64, 96}
+
+// Resolver is the subset of *net.Resolver used by DiscoverPrefix.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ErrNoNAT64 is returned by DiscoverPrefix when the network's
+// resolver doesn't appear to be doing DNS64.
+var ErrNoNAT64 = errors.New("nat64: no DNS64 prefix found")
+
+// DiscoverPrefix discovers the network's NAT64 prefix using the
+// RFC 7050 heuristic: it looks up ipv4only.arpa and checks the AAAA
+// answers for the well-known IPv4 addresses embedded at one of the
+// RFC 6052 offsets.
+//
+// If r is nil, net.DefaultResolver is used.
+func DiscoverPrefix(ctx context.Context, r Resolver) (netaddr.IPPrefix, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, ipv4OnlyName)
+	if err != nil {
+		return netaddr.IPPrefix{}, err
+	}
+	for _, a := range addrs {
+		ip, ok := netaddr.FromStdIP(a.IP)
+		if !ok || !ip.Is6() {
+			continue
+		}
+		if pfx, ok := prefixOf(ip); ok {
+			return pfx, nil
+		}
+	}
+	return netaddr.IPPrefix{}, ErrNoNAT64
+}
+
+// prefixOf returns the NAT64 prefix of ip, if ip is one of the
+// RFC 7050 well-known IPv4 addresses embedded in some valid prefix.
+func prefixOf(ip netaddr.IP) (netaddr.IPPrefix, bool) {
+	for _, bits := range validPrefixBits {
+		pfx := netaddr.IPPrefix{IP: ip, Bits: bits}.Masked()
+		v4, ok := Extract(pfx, ip)
+		if !ok {
+			continue
+		}
+		for _, wk := range wellKnownIPv4s {
+			if v4 == wk {
+				return pfx, true
+			}
+		}
+	}
+	return netaddr.IPPrefix{}, false
+}
+
+// byteOffsets returns the positions within the 16 byte IPv6 address
+// at which the four IPv4 bytes are stored for a prefix of length
+// bits, per RFC 6052 section 2.2. Byte 8 (bits 64 to 71, the "u"
+// octet) is always skipped.
+func byteOffsets(bits uint8) (off [4]int, ok bool) {
+	switch bits {
+	case 32:
+		return [4]int{4, 5, 6, 7}, true
+	case 40:
+		return [4]int{5, 6, 7, 9}, true
+	case 48:
+		return [4]int{6, 7, 9, 10}, true
+	case 56:
+		return [4]int{7, 9, 10, 11}, true
+	case 64:
+		return [4]int{9, 10, 11, 12}, true
+	case 96:
+		return [4]int{12, 13, 14, 15}, true
+	}
+	return off, false
+}
+
+// Synthesize returns the IPv4-embedded IPv6 address for ip4 within
+// the NAT64 prefix pfx. It reports false if pfx isn't a valid NAT64
+// prefix or ip4 isn't an IPv4 address.
+func Synthesize(pfx netaddr.IPPrefix, ip4 netaddr.IP) (netaddr.IP, bool) {
+	off, ok := byteOffsets(pfx.Bits)
+	if !ok || !pfx.IP.Is6() || !ip4.Is4() {
+		return netaddr.IP{}, false
+	}
+	a16 := pfx.Masked().IP.As16()
+	a4 := ip4.As4()
+	for i, o := range off {
+		a16[o] = a4[i]
+	}
+	return netaddr.IPFrom16(a16), true
+}
+
+// Extract returns the IPv4 address embedded in ip, if ip is within
+// the NAT64 prefix pfx.
+func Extract(pfx netaddr.IPPrefix, ip netaddr.IP) (netaddr.IP, bool) {
+	off, ok := byteOffsets(pfx.Bits)
+	if !ok || !ip.Is6() || !pfx.Contains(ip) {
+		return netaddr.IP{}, false
+	}
+	a16 := ip.As16()
+	if pfx.Bits < 96 && a16[8] != 0 {
+		// The u octet must be zero.
+		return netaddr.IP{}, false
+	}
+	var a4 [4]byte
+	for i, o := range off {
+		a4[i] = a16[o]
+	}
+	return netaddr.IPv4(a4[0], a4[1], a4[2], a4[3]), true
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat64
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestSynthesizeExtract(t *testing.T) {
+	// Examples from RFC 6052 section 2.4.
+	ip4 := netaddr.MustParseIP("192.0.2.33")
+	tests := []struct {
+		pfx  string
+		want string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	}
+	for _, tt := range tests {
+		pfx := netaddr.MustParseIPPrefix(tt.pfx)
+		got, ok := Synthesize(pfx, ip4)
+		if !ok {
+			t.Errorf("Synthesize(%v) failed", pfx)
+			continue
+		}
+		if want := netaddr.MustParseIP(tt.want); got != want {
+			t.Errorf("Synthesize(%v) = %v; want %v", pfx, got, want)
+		}
+		back, ok := Extract(pfx, got)
+		if !ok || back != ip4 {
+			t.Errorf("Extract(%v, %v) = %v, %v; want %v", pfx, got, back, ok, ip4)
+		}
+	}
+	if _, ok := Synthesize(netaddr.MustParseIPPrefix("2001:db8::/33"), ip4); ok {
+		t.Errorf("Synthesize with invalid prefix length succeeded")
+	}
+	if _, ok := Extract(WellKnownPrefix, netaddr.MustParseIP("2001:db8::1")); ok {
+		t.Errorf("Extract of address outside prefix succeeded")
+	}
+}
+
+type fakeResolver []string
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) (ret []net.IPAddr, err error) {
+	for _, s := range r {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return ret, nil
+}
+
+func TestDiscoverPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers fakeResolver
+		want    string // or empty for ErrNoNAT64
+	}{
+		{"well-known", fakeResolver{"64:ff9b::c000:aa", "64:ff9b::c000:ab"}, "64:ff9b::/96"},
+		{"network-specific-64", fakeResolver{"2001:db8:122:344:c0:0:aa00:0"}, "2001:db8:122:344::/64"},
+		{"no-dns64", fakeResolver{"192.0.0.170", "192.0.0.171"}, ""},
+		{"unrelated-v6", fakeResolver{"2001:db8::1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DiscoverPrefix(context.Background(), tt.answers)
+			if tt.want == "" {
+				if err != ErrNoNAT64 {
+					t.Fatalf("got %v, %v; want ErrNoNAT64", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := netaddr.MustParseIPPrefix(tt.want); got != want {
+				t.Errorf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
@@ -93,6 +94,17 @@ type Report struct {
 	GlobalV4 string // ip:port of global IPv4
 	GlobalV6 string // [ip]:port of global IPv6
 
+	// NAT64Prefix is the network's NAT64 prefix, as discovered via
+	// RFC 7050 on IPv6-only networks. It's the zero value if the
+	// network has IPv4, no NAT64 was found, or discovery hadn't
+	// finished when the report was made.
+	NAT64Prefix netaddr.IPPrefix
+
+	// CLAT is whether the machine's only IPv4 addresses are from a
+	// local 464XLAT CLAT, meaning the network is IPv6-only and IPv4
+	// is translated on the machine itself.
+	CLAT bool
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -156,12 +168,36 @@ type Client struct {
 	// If nil, portmap discovery is not done.
 	PortMapper *portmapper.Client // lazily initialized on first use
 
+	// GetInterfaceState optionally returns the machine's current
+	// interface state, such as from a link monitor, to avoid
+	// scanning the interfaces for every report. If nil,
+	// interfaces.GetState is used.
+	GetInterfaceState func() *interfaces.State
+
+	// Netns optionally sets the interface that the client's
+	// ephemeral sockets bind to. If nil, the OS is asked for the
+	// default route's on each listen.
+	Netns *netns.Binding
+
+	// nat64Resolver is the resolver used for NAT64 prefix
+	// discovery, or nil for net.DefaultResolver. It's for tests.
+	nat64Resolver nat64.Resolver
+
 	mu       sync.Mutex            // guards following
 	nextFull bool                  // do a full region scan, even if last != nil
 	prev     map[time.Time]*Report // some previous reports
 	last     *Report               // most recent report
 	lastFull time.Time             // time of last full (non-incremental) report
 	curState *reportState          // non-nil if we're in a call to GetReportn
+	nat64    *nat64Discovery       // most recent NAT64 prefix discovery, or nil
+}
+
+// nat64Discovery is a NAT64 prefix discovery for one link state.
+type nat64Discovery struct {
+	key  string        // the nat64Key of the interface state it's for
+	done chan struct{} // closed once pfx and err are set
+	pfx  netaddr.IPPrefix
+	err  error
 }
 
 // STUNConn is the interface required by the netcheck Client when
@@ -180,6 +216,15 @@ func (c *Client) enoughRegions() int {
 	return 3
 }
 
+func (c *Client) interfaceState() (*interfaces.State, error) {
+	if c.GetInterfaceState != nil {
+		if st := c.GetInterfaceState(); st != nil {
+			return st, nil
+		}
+	}
+	return interfaces.GetState()
+}
+
 func (c *Client) logf(format string, a ...interface{}) {
 	if c.Logf != nil {
 		c.Logf(format, a...)
@@ -704,6 +749,89 @@ func (rs *reportState) probePortMapServices() {
 	rs.setOptBool(&rs.report.PCP, res.PCP)
 }
 
+// nat64Timeout is how long NAT64 prefix discovery waits for its DNS
+// lookup.
+const nat64Timeout = 10 * time.Second
+
+// nat64DiscoveryFor returns the NAT64 prefix discovery for the link
+// state st, starting it in the background if there's none yet.
+//
+// Results are kept until the link state changes, except for failed
+// lookups, which are retried on the next call.
+func (c *Client) nat64DiscoveryFor(st *interfaces.State) *nat64Discovery {
+	key := nat64Key(st)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.nat64; d != nil && d.key == key {
+		select {
+		case <-d.done:
+			if d.err == nil || d.err == nat64.ErrNoNAT64 {
+				return d
+			}
+		default:
+			return d
+		}
+	}
+	d := &nat64Discovery{key: key, done: make(chan struct{})}
+	c.nat64 = d
+	go c.discoverNAT64(d)
+	return d
+}
+
+func (c *Client) discoverNAT64(d *nat64Discovery) {
+	defer close(d.done)
+	ctx, cancel := context.WithTimeout(context.Background(), nat64Timeout)
+	defer cancel()
+	d.pfx, d.err = nat64.DiscoverPrefix(ctx, c.nat64Resolver)
+	if d.err != nil && d.err != nat64.ErrNoNAT64 {
+		c.logf("[v1] NAT64 discovery: %v", d.err)
+	}
+}
+
+// nat64Key returns the link state that NAT64 discovery results are
+// kept for: the default route interface and the up interfaces'
+// addresses.
+func nat64Key(st *interfaces.State) string {
+	var addrs []string
+	for name, up := range st.InterfaceUp {
+		if !up {
+			continue
+		}
+		for _, pfx := range st.InterfaceIPs[name] {
+			addrs = append(addrs, name+"="+pfx.IP.String())
+		}
+	}
+	sort.Strings(addrs)
+	return fmt.Sprintf("def=%s addrs=%v", st.DefaultRouteInterface, addrs)
+}
+
+// ipv6Only reports whether st is an IPv6-only network: one with
+// global IPv6 and no IPv4, or none except from a local CLAT. clat is
+// whether there's a CLAT.
+func ipv6Only(st *interfaces.State) (v6only, clat bool) {
+	if !st.HaveV6Global {
+		return false, false
+	}
+	native4 := false
+	for name, up := range st.InterfaceUp {
+		if !up {
+			continue
+		}
+		for _, pfx := range st.InterfaceIPs[name] {
+			ip := pfx.IP
+			if !ip.Is4() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if nat64.CLATPrefix.Contains(ip) {
+				clat = true
+			} else {
+				native4 = true
+			}
+		}
+	}
+	return !native4, clat
+}
+
 func newReport() *Report {
 	return &Report{
 		RegionLatency:   make(map[int]time.Duration),
@@ -764,14 +892,14 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		c.curState = nil
 	}()
 
-	ifState, err := interfaces.GetState()
+	ifState, err := c.interfaceState()
 	if err != nil {
 		c.logf("[v1] interfaces: %v", err)
 		return nil, err
 	}
 
 	// Create a UDP4 socket used for sending to our discovered IPv4 address.
-	rs.pc4Hair, err = netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	rs.pc4Hair, err = c.Netns.Listener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
 		c.logf("udp4: %v", err)
 		return nil, err
@@ -783,6 +911,17 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		go rs.probePortMapServices()
 	}
 
+	// On IPv6-only networks, see whether there's a NAT64 gateway we
+	// can use to reach IPv4-only destinations. The report doesn't
+	// wait for the lookup beyond the STUN probes; if it's still
+	// running then, a later report picks up its result.
+	var nat64d *nat64Discovery
+	v6only, clat := ipv6Only(ifState)
+	rs.report.CLAT = clat
+	if !c.SkipExternalNetwork && v6only {
+		nat64d = c.nat64DiscoveryFor(ifState)
+	}
+
 	// At least the Apple Airport Extreme doesn't allow hairpin
 	// sends from a private socket until it's seen traffic from
 	// that src IP:port to something else out on the internet.
@@ -799,7 +938,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	if f := c.GetSTUNConn4; f != nil {
 		rs.pc4 = f()
 	} else {
-		u4, err := netns.Listener().ListenPacket(ctx, "udp4", c.udpBindAddr())
+		u4, err := c.Netns.Listener().ListenPacket(ctx, "udp4", c.udpBindAddr())
 		if err != nil {
 			c.logf("udp4: %v", err)
 			return nil, err
@@ -812,7 +951,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		if f := c.GetSTUNConn6; f != nil {
 			rs.pc6 = f()
 		} else {
-			u6, err := netns.Listener().ListenPacket(ctx, "udp6", c.udpBindAddr())
+			u6, err := c.Netns.Listener().ListenPacket(ctx, "udp6", c.udpBindAddr())
 			if err != nil {
 				c.logf("udp6: %v", err)
 			} else {
@@ -855,6 +994,16 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		rs.waitPortMap.Wait()
 		c.vlogf("portMap done")
 	}
+	if nat64d != nil {
+		select {
+		case <-nat64d.done:
+			rs.mu.Lock()
+			rs.report.NAT64Prefix = nat64d.pfx
+			rs.mu.Unlock()
+		default:
+			c.vlogf("NAT64 discovery still running; not waiting for it")
+		}
+	}
 	rs.stopTimers()
 
 	// Try HTTPS latency check if all STUN probes failed due to UDP presumably being blocked.
@@ -901,7 +1050,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	report := rs.report.Clone()
 	rs.mu.Unlock()
 
-	c.addReportHistoryAndSetPreferredDERP(report)
+	c.addReportHistoryAndSetPreferredDERP(report, dm)
 	c.logConciseReport(report, dm)
 
 	return report, nil
@@ -989,6 +1138,12 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		if r.GlobalV6 != "" {
 			fmt.Fprintf(w, " v6a=%v", r.GlobalV6)
 		}
+		if !r.NAT64Prefix.IsZero() {
+			fmt.Fprintf(w, " nat64=%v", r.NAT64Prefix)
+		}
+		if r.CLAT {
+			fmt.Fprintf(w, " clat=true")
+		}
 		fmt.Fprintf(w, " derp=%v", r.PreferredDERP)
 		if r.PreferredDERP != 0 {
 			fmt.Fprintf(w, " derpdist=")
@@ -1022,7 +1177,9 @@ func (c *Client) timeNow() time.Time {
 
 // addReportHistoryAndSetPreferredDERP adds r to the set of recent Reports
 // and mutates r.PreferredDERP to contain the best recent one.
-func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
+// Regions that dm (which may be nil) says to avoid aren't picked, even
+// if they were measured.
+func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report, dm *tailcfg.DERPMap) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -1059,6 +1216,9 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
 	var bestAny time.Duration
 	var oldRegionCurLatency time.Duration
 	for regionID, d := range r.RegionLatency {
+		if dm != nil && dm.Regions[regionID] != nil && dm.Regions[regionID].Avoid {
+			continue
+		}
 		if regionID == prevDERP {
 			oldRegionCurLatency = d
 		}
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -142,6 +143,7 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 	tests := []struct {
 		name        string
 		steps       []step
+		avoid       int // region to mark Avoid in the DERP map, if non-zero
 		wantDERP    int // want PreferredDERP on final step
 		wantPrevLen int // wanted len(c.prev)
 	}{
@@ -213,6 +215,15 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 			wantPrevLen: 2,
 			wantDERP:    2, // 2 got fast enough
 		},
+		{
+			name: "avoided_region_not_picked",
+			steps: []step{
+				{0, report("d1", 2, "d2", 3)},
+			},
+			avoid:       1,
+			wantPrevLen: 1,
+			wantDERP:    2,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -220,9 +231,15 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 			c := &Client{
 				TimeNow: func() time.Time { return fakeTime },
 			}
+			var dm *tailcfg.DERPMap
+			if tt.avoid != 0 {
+				dm = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+					tt.avoid: {RegionID: tt.avoid, Avoid: true},
+				}}
+			}
 			for _, s := range tt.steps {
 				fakeTime = fakeTime.Add(s.after)
-				c.addReportHistoryAndSetPreferredDERP(s.r)
+				c.addReportHistoryAndSetPreferredDERP(s.r, dm)
 			}
 			lastReport := tt.steps[len(tt.steps)-1].r
 			if got, want := len(c.prev), tt.wantPrevLen; got != want {
@@ -645,3 +662,111 @@ func TestSortRegions(t *testing.T) {
 		t.Errorf("got %v; want %v", got, want)
 	}
 }
+
+func TestIPv6Only(t *testing.T) {
+	state := func(addrs ...string) *interfaces.State {
+		st := &interfaces.State{
+			InterfaceIPs: map[string][]netaddr.IPPrefix{},
+			InterfaceUp:  map[string]bool{},
+		}
+		for _, a := range addrs {
+			i := strings.Index(a, "=")
+			name, pfx := a[:i], netaddr.MustParseIPPrefix(a[i+1:])
+			st.InterfaceUp[name] = true
+			st.InterfaceIPs[name] = append(st.InterfaceIPs[name], pfx)
+			if pfx.IP.Is6() && !pfx.IP.IsLinkLocalUnicast() {
+				st.HaveV6Global = true
+			} else if pfx.IP.Is4() {
+				st.HaveV4 = true
+			}
+		}
+		return st
+	}
+	tests := []struct {
+		name       string
+		st         *interfaces.State
+		wantV6Only bool
+		wantCLAT   bool
+	}{
+		{"dual-stack", state("eth0=192.168.0.2/24", "eth0=2001:db8::2/64"), false, false},
+		{"v4-only", state("eth0=192.168.0.2/24"), false, false},
+		{"v6-only", state("rmnet0=2001:db8::2/64"), true, false},
+		{"v6-only-clat", state("rmnet0=2001:db8::2/64", "v4-rmnet0=192.0.0.4/32"), true, true},
+		{"clat-and-wifi", state("rmnet0=2001:db8::2/64", "v4-rmnet0=192.0.0.4/32", "wlan0=10.0.0.5/24"), false, true},
+	}
+	for _, tt := range tests {
+		v6only, clat := ipv6Only(tt.st)
+		if v6only != tt.wantV6Only || clat != tt.wantCLAT {
+			t.Errorf("%s: ipv6Only = %v, %v; want %v, %v", tt.name, v6only, clat, tt.wantV6Only, tt.wantCLAT)
+		}
+	}
+}
+
+// blockingResolver answers lookups with the well-known NAT64 prefix's
+// synthesized ipv4only.arpa addresses once unblocked.
+type blockingResolver struct {
+	unblock chan struct{}
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	select {
+	case <-r.unblock:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []net.IPAddr{{IP: net.ParseIP("64:ff9b::c000:aa")}}, nil
+}
+
+func (r *blockingResolver) numLookups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestNAT64DiscoveryCached(t *testing.T) {
+	r := &blockingResolver{unblock: make(chan struct{})}
+	c := &Client{Logf: t.Logf, nat64Resolver: r}
+	st := &interfaces.State{
+		InterfaceIPs: map[string][]netaddr.IPPrefix{"rmnet0": {netaddr.MustParseIPPrefix("2001:db8::2/64")}},
+		InterfaceUp:  map[string]bool{"rmnet0": true},
+		HaveV6Global: true,
+	}
+
+	d := c.nat64DiscoveryFor(st)
+	select {
+	case <-d.done:
+		t.Fatal("discovery finished before the lookup returned")
+	default:
+	}
+	if d2 := c.nat64DiscoveryFor(st); d2 != d {
+		t.Error("second call started another discovery while the first was running")
+	}
+
+	close(r.unblock)
+	<-d.done
+	if want := netaddr.MustParseIPPrefix("64:ff9b::/96"); d.pfx != want {
+		t.Errorf("prefix = %v; want %v", d.pfx, want)
+	}
+	if d2 := c.nat64DiscoveryFor(st); d2 != d {
+		t.Error("result wasn't reused for the same link state")
+	}
+	if n := r.numLookups(); n != 1 {
+		t.Errorf("%d lookups for one link state; want 1", n)
+	}
+
+	st2 := &interfaces.State{
+		InterfaceIPs: map[string][]netaddr.IPPrefix{"wlan0": {netaddr.MustParseIPPrefix("2001:db8:1::5/64")}},
+		InterfaceUp:  map[string]bool{"wlan0": true},
+		HaveV6Global: true,
+	}
+	<-c.nat64DiscoveryFor(st2).done
+	if n := r.numLookups(); n != 2 {
+		t.Errorf("%d lookups after a link change; want 2", n)
+	}
+}
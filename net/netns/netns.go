@@ -17,13 +17,14 @@ package netns
 import (
 	"context"
 	"net"
+	"sync/atomic"
 )
 
 // Listener returns a new net.Listener with its Control hook func
 // initialized as necessary to run in logical network namespace that
 // doesn't route back into Tailscale.
 func Listener() *net.ListenConfig {
-	return &net.ListenConfig{Control: control}
+	return (*Binding)(nil).Listener()
 }
 
 // NewDialer returns a new Dialer using a net.Dialer with its Control
@@ -31,7 +32,7 @@ func Listener() *net.ListenConfig {
 // namespace that doesn't route back into Tailscale. It also handles
 // using a SOCKS if configured in the environment with ALL_PROXY.
 func NewDialer() Dialer {
-	return FromDialer(new(net.Dialer))
+	return (*Binding)(nil).NewDialer()
 }
 
 // FromDialer returns sets d.Control as necessary to run in a logical
@@ -39,7 +40,67 @@ func NewDialer() Dialer {
 // handles using a SOCKS if configured in the environment with
 // ALL_PROXY.
 func FromDialer(d *net.Dialer) Dialer {
-	d.Control = control
+	return (*Binding)(nil).FromDialer(d)
+}
+
+// A Binding is the physical interface that the sockets of one user,
+// such as a wgengine.Engine and the clients it owns, bind to on OSes
+// that do so. Its methods are like the package-level funcs of the same
+// names, which use a nil *Binding: one that asks the OS for the
+// interface with the default route on each dial or listen.
+//
+// The zero value is ready for use, and behaves like nil until
+// SetDefaultInterface is called.
+type Binding struct {
+	iface atomic.Value // of *defaultInterface
+}
+
+type defaultInterface struct {
+	name  string
+	index int
+}
+
+// SetDefaultInterface records the physical interface that the link
+// monitor found to hold the default route, by name and index, for b's
+// sockets to bind to. When it's called with an empty name, the OS is
+// asked on each dial or listen again.
+//
+// The interface must not be Tailscale's own; binding to it is what
+// keeps Tailscale's sockets from routing into the tunnel when an exit
+// node is in use.
+func (b *Binding) SetDefaultInterface(name string, index int) {
+	b.iface.Store(&defaultInterface{name, index})
+}
+
+// defaultInterface returns the interface recorded by
+// SetDefaultInterface, if any. b may be nil.
+func (b *Binding) defaultInterface() (name string, index int, ok bool) {
+	if b == nil {
+		return "", 0, false
+	}
+	d, _ := b.iface.Load().(*defaultInterface)
+	if d == nil || d.name == "" {
+		return "", 0, false
+	}
+	return d.name, d.index, true
+}
+
+// Listener is like the package-level Listener, but binds to b's
+// interface. b may be nil.
+func (b *Binding) Listener() *net.ListenConfig {
+	return &net.ListenConfig{Control: b.control}
+}
+
+// NewDialer is like the package-level NewDialer, but binds to b's
+// interface. b may be nil.
+func (b *Binding) NewDialer() Dialer {
+	return b.FromDialer(new(net.Dialer))
+}
+
+// FromDialer is like the package-level FromDialer, but binds to b's
+// interface. b may be nil.
+func (b *Binding) FromDialer(d *net.Dialer) Dialer {
+	d.Control = b.control
 	if wrapDialer != nil {
 		return wrapDialer(d)
 	}
@@ -56,6 +117,17 @@ func IsSOCKSDialer(d Dialer) bool {
 	return !ok
 }
 
+// isLocalhost reports whether address, as passed to a Control hook,
+// is a loopback address, which mustn't be bound to an interface.
+func isLocalhost(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // wrapDialer, if non-nil, specifies a function to wrap a dialer in a
 // SOCKS-using dialer. It's set conditionally by socks.go.
 var wrapDialer func(Dialer) Dialer
@@ -20,15 +20,19 @@ import (
 //
 // It's intentionally the same signature as net.Dialer.Control
 // and net.ListenConfig.Control.
-func control(network, address string, c syscall.RawConn) error {
-	if strings.HasPrefix(address, "127.") || address == "::1" {
+func (b *Binding) control(network, address string, c syscall.RawConn) error {
+	if isLocalhost(address) {
 		// Don't bind to an interface for localhost connections.
 		return nil
 	}
-	idx, err := interfaces.DefaultRouteInterfaceIndex()
-	if err != nil {
-		log.Printf("netns: DefaultRouteInterfaceIndex: %v", err)
-		return nil
+	_, idx, ok := b.defaultInterface()
+	if !ok || idx == 0 {
+		var err error
+		idx, err = interfaces.DefaultRouteInterfaceIndex()
+		if err != nil {
+			log.Printf("netns: DefaultRouteInterfaceIndex: %v", err)
+			return nil
+		}
 	}
 	v6 := strings.Contains(address, "]:") || strings.HasSuffix(network, "6") // hacky test for v6
 	proto := unix.IPPROTO_IP
@@ -39,7 +43,7 @@ func control(network, address string, c syscall.RawConn) error {
 	}
 
 	var sockErr error
-	err = c.Control(func(fd uintptr) {
+	err := c.Control(func(fd uintptr) {
 		sockErr = unix.SetsockoptInt(int(fd), proto, opt, idx)
 	})
 	if err != nil {
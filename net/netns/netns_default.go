@@ -9,6 +9,6 @@ package netns
 import "syscall"
 
 // control does nothing to c.
-func control(network, address string, c syscall.RawConn) error {
+func (b *Binding) control(network, address string, c syscall.RawConn) error {
 	return nil
 }
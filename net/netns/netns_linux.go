@@ -61,13 +61,17 @@ func ignoreErrors() bool {
 //
 // It's intentionally the same signature as net.Dialer.Control
 // and net.ListenConfig.Control.
-func control(network, address string, c syscall.RawConn) error {
+func (b *Binding) control(network, address string, c syscall.RawConn) error {
 	var sockErr error
 	err := c.Control(func(fd uintptr) {
-		if ipRuleAvailable() {
+		switch {
+		case ipRuleAvailable():
 			sockErr = setBypassMark(fd)
-		} else {
-			sockErr = bindToDevice(fd)
+		case isLocalhost(address):
+			// Binding to the default interface would make
+			// loopback unreachable.
+		default:
+			sockErr = b.bindToDevice(fd)
 		}
 	})
 	if err != nil {
@@ -87,8 +91,14 @@ func setBypassMark(fd uintptr) error {
 	return nil
 }
 
-func bindToDevice(fd uintptr) error {
-	ifc, err := interfaces.DefaultRouteInterface()
+// bindToDevice binds fd to the interface with the default route, as
+// recorded in b or, failing that, as found in the routing table.
+func (b *Binding) bindToDevice(fd uintptr) error {
+	ifc, _, ok := b.defaultInterface()
+	var err error
+	if !ok {
+		ifc, err = interfaces.DefaultRouteInterface()
+	}
 	if err != nil {
 		// Make sure we bind to *some* interface,
 		// or we could get a routing loop.
@@ -40,3 +40,46 @@ func TestDial(t *testing.T) {
 	defer c.Close()
 	t.Logf("got addr %v", c.RemoteAddr())
 }
+
+func TestIsLocalhost(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:41112", true},
+		{"127.1.2.3:80", true},
+		{"[::1]:80", true},
+		{"::1", true},
+		{"localhost:80", false}, // Control sees addresses, not names
+		{"100.101.102.103:80", false},
+		{"[fd7a:115c:a1e0::1]:80", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLocalhost(tt.address); got != tt.want {
+			t.Errorf("isLocalhost(%q) = %v; want %v", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestBindingDefaultInterface(t *testing.T) {
+	var nilBinding *Binding
+	if _, _, ok := nilBinding.defaultInterface(); ok {
+		t.Fatal("nil Binding has a default interface")
+	}
+	var b, other Binding
+	if _, _, ok := b.defaultInterface(); ok {
+		t.Fatal("default interface set before SetDefaultInterface")
+	}
+	b.SetDefaultInterface("eth0", 2)
+	if name, idx, ok := b.defaultInterface(); name != "eth0" || idx != 2 || !ok {
+		t.Errorf("defaultInterface = %q, %d, %v; want eth0, 2, true", name, idx, ok)
+	}
+	if _, _, ok := other.defaultInterface(); ok {
+		t.Error("setting one Binding's default interface set another's")
+	}
+	b.SetDefaultInterface("", 0)
+	if _, _, ok := b.defaultInterface(); ok {
+		t.Error("default interface still set after clearing")
+	}
+}
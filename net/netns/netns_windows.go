@@ -6,7 +6,6 @@ package netns
 
 import (
 	"math/bits"
-	"strings"
 	"syscall"
 
 	"golang.org/x/sys/windows"
@@ -28,8 +27,8 @@ func interfaceIndex(iface *winipcfg.IPAdapterAddresses) uint32 {
 
 // control binds c to the Windows interface that holds a default
 // route, and is not the Tailscale WinTun interface.
-func control(network, address string, c syscall.RawConn) error {
-	if strings.HasPrefix(address, "127.") {
+func (b *Binding) control(network, address string, c syscall.RawConn) error {
+	if isLocalhost(address) {
 		// Don't bind to an interface for localhost connections,
 		// otherwise we get:
 		//   connectex: The requested address is not valid in its context
@@ -47,11 +46,18 @@ func control(network, address string, c syscall.RawConn) error {
 	}
 
 	if canV4 {
-		iface, err := interfaces.GetWindowsDefault(windows.AF_INET)
-		if err != nil {
-			return err
+		// Use the link monitor's idea of the IPv4 default interface
+		// if b has one, rather than walking the routing table for
+		// each socket.
+		_, idx, ok := b.defaultInterface()
+		if !ok || idx == 0 {
+			iface, err := interfaces.GetWindowsDefault(windows.AF_INET)
+			if err != nil {
+				return err
+			}
+			idx = int(interfaceIndex(iface))
 		}
-		if err := bindSocket4(c, interfaceIndex(iface)); err != nil {
+		if err := bindSocket4(c, uint32(idx)); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nsjoin gives other network namespaces, such as those of
+// containers, connectivity to the tailnet through the host's
+// tailscaled.
+//
+// Each attached namespace gets one end of a veth pair, with a route
+// to the Tailscale CGNAT range via the host end. The host masquerades
+// the namespace's traffic to the tailnet as its own Tailscale IP, so
+// to the rest of the tailnet the namespace looks like the host.
+package nsjoin
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// Attachment is a network namespace attached to the tailnet.
+type Attachment struct {
+	// ID identifies the attachment. It's also the name of the host
+	// end of the veth pair.
+	ID string
+
+	// Target is the attached namespace, as given to Attach.
+	Target string
+
+	// HostAddr and NSAddr are the addresses of the host and
+	// namespace ends of the veth pair.
+	HostAddr netaddr.IPPrefix
+	NSAddr   netaddr.IPPrefix
+}
+
+// ErrNotSupported is returned by Attach on platforms without network
+// namespaces.
+var ErrNotSupported = errors.New("attaching network namespaces is only supported on Linux")
+
+// linkNet is the network that veth pair addresses are allocated
+// from, one /30 per attachment. It's deliberately outside the
+// Tailscale CGNAT range, as the router drops forwarded packets to
+// the tailnet that claim to be from it.
+var linkNet = netaddr.MustParseIPPrefix("169.254.83.0/24")
+
+// maxAttachments is the number of /30s in linkNet.
+const maxAttachments = 1 << (32 - 24 - 2)
+
+// linkAddrs returns the host and namespace addresses of the nth
+// attachment's veth pair.
+func linkAddrs(n int) (host, ns netaddr.IPPrefix) {
+	b := linkNet.IP.As4()
+	host = netaddr.IPPrefix{IP: netaddr.IPv4(b[0], b[1], b[2], byte(4*n+1)), Bits: 30}
+	ns = netaddr.IPPrefix{IP: netaddr.IPv4(b[0], b[1], b[2], byte(4*n+2)), Bits: 30}
+	return host, ns
+}
+
+// nsPath returns the path of the network namespace file for target,
+// which is either a process ID or the name of a namespace in
+// /var/run/netns, as created by "ip netns add".
+func nsPath(target string) (string, error) {
+	if target == "" {
+		return "", errors.New("empty target")
+	}
+	if pid, err := strconv.Atoi(target); err == nil {
+		if pid <= 1 {
+			return "", fmt.Errorf("invalid pid %d", pid)
+		}
+		return "/proc/" + target + "/ns/net", nil
+	}
+	if strings.ContainsAny(target, "/\x00") || target == "." || target == ".." {
+		return "", fmt.Errorf("invalid namespace name %q", target)
+	}
+	return "/var/run/netns/" + target, nil
+}
+
+// Manager attaches network namespaces to the tailnet and keeps track
+// of them. Attachments don't outlive the Manager's process; call
+// Close to undo them on shutdown.
+type Manager struct {
+	logf logger.Logf
+	run  func(args ...string) error // runs a command; swapped out in tests
+
+	mu   sync.Mutex
+	atts map[int]*attachment // keyed by linkAddrs slot
+}
+
+type attachment struct {
+	Attachment
+	tunName string
+}
+
+// NewManager returns a new Manager.
+func NewManager(logf logger.Logf) *Manager {
+	return &Manager{
+		logf: logger.WithPrefix(logf, "nsjoin: "),
+		run:  runCommand,
+		atts: map[int]*attachment{},
+	}
+}
+
+// Attach attaches the network namespace target, either a process ID
+// or the name of a namespace in /var/run/netns, to the tailnet via
+// the Tailscale interface tunName.
+func (m *Manager) Attach(target, tunName string) (Attachment, error) {
+	path, err := nsPath(target)
+	if err != nil {
+		return Attachment{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slot := -1
+	for n := 0; n < maxAttachments; n++ {
+		if a, ok := m.atts[n]; ok {
+			if a.Target == target {
+				return Attachment{}, fmt.Errorf("%s is already attached as %s", target, a.ID)
+			}
+		} else if slot == -1 {
+			slot = n
+		}
+	}
+	if slot == -1 {
+		return Attachment{}, fmt.Errorf("too many attachments (max %d)", maxAttachments)
+	}
+	a := &attachment{tunName: tunName}
+	a.ID = fmt.Sprintf("ts-c%d", slot)
+	a.Target = target
+	a.HostAddr, a.NSAddr = linkAddrs(slot)
+	if err := m.attach(a, path); err != nil {
+		return Attachment{}, err
+	}
+	m.atts[slot] = a
+	m.logf("attached %s as %s (%v)", target, a.ID, a.NSAddr.IP)
+	return a.Attachment, nil
+}
+
+// Detach undoes the attachment with the given ID.
+func (m *Manager) Detach(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for slot, a := range m.atts {
+		if a.ID == id {
+			delete(m.atts, slot)
+			m.logf("detached %s (%s)", a.Target, a.ID)
+			return m.detach(a)
+		}
+	}
+	return fmt.Errorf("no attachment %q", id)
+}
+
+// List returns the current attachments, ordered by address.
+func (m *Manager) List() []Attachment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]Attachment, 0, len(m.atts))
+	for _, a := range m.atts {
+		ret = append(ret, a.Attachment)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].HostAddr.IP.Less(ret[j].HostAddr.IP) })
+	return ret
+}
+
+// Close undoes all attachments.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var firstErr error
+	for slot, a := range m.atts {
+		delete(m.atts, slot)
+		if err := m.detach(a); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func runCommand(args ...string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %q failed: %w\n%s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
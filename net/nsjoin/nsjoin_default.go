@@ -0,0 +1,11 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package nsjoin
+
+func (m *Manager) attach(a *attachment, path string) error { return ErrNotSupported }
+
+func (m *Manager) detach(a *attachment) error { return ErrNotSupported }
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nsjoin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"tailscale.com/net/tsaddr"
+)
+
+// readIPForward reports whether IPv4 forwarding is enabled. It's a
+// variable for tests.
+var readIPForward = func() (bool, error) {
+	v, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return false, err
+	}
+	return string(bytes.TrimSpace(v)) == "1", nil
+}
+
+// nsExists reports whether the namespace file at path exists. It's a
+// variable for tests.
+var nsExists = func(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (m *Manager) attach(a *attachment, path string) error {
+	if a.tunName == "" {
+		return errors.New("no Tailscale interface")
+	}
+	if !nsExists(path) {
+		return fmt.Errorf("network namespace %s not found", a.Target)
+	}
+	fwd, err := readIPForward()
+	if err != nil {
+		return err
+	}
+	if !fwd {
+		return errors.New("IPv4 forwarding is disabled; enable it with sysctl net.ipv4.ip_forward=1")
+	}
+
+	nsIf := a.ID + "-ns"
+	nsenter := func(args ...string) []string {
+		return append([]string{"nsenter", "--net=" + path}, args...)
+	}
+	cmds := [][]string{
+		{"ip", "link", "add", a.ID, "type", "veth", "peer", "name", nsIf},
+		{"ip", "link", "set", nsIf, "netns", a.Target},
+		{"ip", "addr", "add", a.HostAddr.String(), "dev", a.ID},
+		{"ip", "link", "set", a.ID, "up"},
+		nsenter("ip", "addr", "add", a.NSAddr.String(), "dev", nsIf),
+		nsenter("ip", "link", "set", nsIf, "up"),
+		nsenter("ip", "route", "add", tsaddr.CGNATRange().String(), "via", a.HostAddr.IP.String(), "dev", nsIf),
+		append([]string{"iptables", "-t", "nat", "-A"}, masqArgs(a)...),
+	}
+	for i, args := range cmds {
+		if err := m.run(args...); err != nil {
+			if i > 0 {
+				// Deleting the host end also deletes the namespace
+				// end, wherever it is.
+				m.run("ip", "link", "del", a.ID)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) detach(a *attachment) error {
+	var firstErr error
+	for _, args := range [][]string{
+		append([]string{"iptables", "-t", "nat", "-D"}, masqArgs(a)...),
+		{"ip", "link", "del", a.ID},
+	} {
+		if err := m.run(args...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// masqArgs returns the iptables rule, minus the command, that
+// masquerades a's traffic to the tailnet.
+func masqArgs(a *attachment) []string {
+	return []string{"POSTROUTING", "-s", a.NSAddr.Masked().String(), "-o", a.tunName, "-j", "MASQUERADE"}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nsjoin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttachDetach(t *testing.T) {
+	defer func(f func() (bool, error)) { readIPForward = f }(readIPForward)
+	defer func(f func(string) bool) { nsExists = f }(nsExists)
+	readIPForward = func() (bool, error) { return true, nil }
+	nsExists = func(string) bool { return true }
+
+	var cmds []string
+	m := NewManager(t.Logf)
+	m.run = func(args ...string) error {
+		cmds = append(cmds, strings.Join(args, " "))
+		return nil
+	}
+
+	a, err := m.Attach("1234", "tailscale0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != "ts-c0" || a.HostAddr.String() != "169.254.83.1/30" || a.NSAddr.String() != "169.254.83.2/30" {
+		t.Errorf("attachment = %+v", a)
+	}
+	want := []string{
+		"ip link add ts-c0 type veth peer name ts-c0-ns",
+		"ip link set ts-c0-ns netns 1234",
+		"ip addr add 169.254.83.1/30 dev ts-c0",
+		"ip link set ts-c0 up",
+		"nsenter --net=/proc/1234/ns/net ip addr add 169.254.83.2/30 dev ts-c0-ns",
+		"nsenter --net=/proc/1234/ns/net ip link set ts-c0-ns up",
+		"nsenter --net=/proc/1234/ns/net ip route add 100.64.0.0/10 via 169.254.83.1 dev ts-c0-ns",
+		"iptables -t nat -A POSTROUTING -s 169.254.83.0/30 -o tailscale0 -j MASQUERADE",
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("attach ran:\n%s\nwant:\n%s", strings.Join(cmds, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := m.Attach("1234", "tailscale0"); err == nil {
+		t.Error("attaching twice succeeded")
+	}
+	b, err := m.Attach("web", "tailscale0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != "ts-c1" || b.NSAddr.String() != "169.254.83.6/30" {
+		t.Errorf("second attachment = %+v", b)
+	}
+	if got := m.List(); len(got) != 2 || got[0].ID != "ts-c0" || got[1].ID != "ts-c1" {
+		t.Errorf("List = %+v", got)
+	}
+
+	cmds = nil
+	if err := m.Detach("ts-c0"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"iptables -t nat -D POSTROUTING -s 169.254.83.0/30 -o tailscale0 -j MASQUERADE",
+		"ip link del ts-c0",
+	}
+	if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("detach ran:\n%s\nwant:\n%s", strings.Join(cmds, "\n"), strings.Join(want, "\n"))
+	}
+	if err := m.Detach("ts-c0"); err == nil {
+		t.Error("detaching twice succeeded")
+	}
+
+	// The freed slot is reused.
+	c, err := m.Attach("db", "tailscale0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != "ts-c0" {
+		t.Errorf("third attachment ID = %q; want ts-c0", c.ID)
+	}
+}
+
+func TestNSPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"1234", "/proc/1234/ns/net"},
+		{"web", "/var/run/netns/web"},
+		{"1", ""},
+		{"", ""},
+		{"..", ""},
+		{"a/b", ""},
+	}
+	for _, tt := range tests {
+		got, err := nsPath(tt.target)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("nsPath(%q) = %q; want error", tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("nsPath(%q) = %q, %v; want %q", tt.target, got, err, tt.want)
+		}
+	}
+}
@@ -4,6 +4,8 @@
 
 package packet
 
+import "strconv"
+
 // IPProto is an IP subprotocol as defined by the IANA protocol
 // numbers list
 // (https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml),
@@ -24,6 +26,14 @@ const (
 	TCP    IPProto = 0x06
 	UDP    IPProto = 0x11
 
+	// Encapsulation protocols, which subnet routers pass through
+	// without parsing.
+	IPv4Encap IPProto = 0x04 // IPv4 in IP ("IPIP")
+	IPv6Encap IPProto = 0x29 // IPv6 in IPv4 ("6in4")
+	GRE       IPProto = 0x2f
+	ESP       IPProto = 0x32 // IPsec
+	AH        IPProto = 0x33 // IPsec
+
 	// TSMP is the Tailscale Message Protocol (our ICMP-ish
 	// thing), an IP protocol used only between Tailscale nodes
 	// (still encrypted by WireGuard) that communicates why things
@@ -60,7 +70,37 @@ func (p IPProto) String() string {
 		return "TCP"
 	case TSMP:
 		return "TSMP"
-	default:
+	case IPv4Encap:
+		return "IPIP"
+	case IPv6Encap:
+		return "6in4"
+	case GRE:
+		return "GRE"
+	case ESP:
+		return "ESP"
+	case AH:
+		return "AH"
+	case Unknown:
 		return "Unknown"
+	default:
+		return "IPProto-" + strconv.Itoa(int(p))
+	}
+}
+
+// HasPorts reports whether packets of protocol p have ports that
+// the filter matches.
+func (p IPProto) HasPorts() bool {
+	return p == TCP || p == UDP
+}
+
+// isIPv6ExtensionHeader reports whether p, as an IPv6 next header
+// value, is an extension header rather than an upper layer protocol.
+func isIPv6ExtensionHeader(p IPProto) bool {
+	switch p {
+	case 0, 43, 44, 60, 135, 139, 140, 253, 254:
+		// Hop-by-hop options, routing, fragment, destination
+		// options, mobility, HIP, shim6 and experimental.
+		return true
 	}
+	return false
 }
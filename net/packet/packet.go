@@ -214,9 +214,19 @@ func (q *Parsed) decode4(b []byte) {
 			// Inter-tailscale messages.
 			q.dataofs = q.subofs
 			return
-		default:
+		case Fragment, ICMPv6:
+			// Fragment's number is reserved, and we use it
+			// internally. ICMPv6 is meaningless in IPv4.
 			q.IPProto = Unknown
 			return
+		default:
+			// Some other protocol, such as an encapsulation
+			// like 6in4 or GRE. Keep its number, with no
+			// ports, and leave it to the filter.
+			q.Src.Port = 0
+			q.Dst.Port = 0
+			q.dataofs = q.subofs
+			return
 		}
 	} else {
 		// This is a fragment other than the first one.
@@ -266,9 +276,9 @@ func (q *Parsed) decode6(b []byte) {
 	// should not fragment, which makes fragmentation on the open
 	// internet extremely uncommon.
 	//
-	// This also means we don't support IPSec headers (AH/ESP), or
-	// IPv6 jumbo frames. Those will get marked Unknown and
-	// dropped.
+	// This also means we don't support IPv6 jumbo frames, which
+	// will get marked Unknown and dropped. IPsec's AH and ESP are
+	// passed on like any other protocol, without parsing.
 	q.subofs = 40
 	sub := b[q.subofs:]
 	sub = sub[:len(sub):len(sub)] // help the compiler do bounds check elimination
@@ -306,8 +316,14 @@ func (q *Parsed) decode6(b []byte) {
 		q.dataofs = q.subofs
 		return
 	default:
-		q.IPProto = Unknown
-		return
+		if q.IPProto == Fragment || q.IPProto == ICMPv4 || q.IPProto == IGMP || isIPv6ExtensionHeader(q.IPProto) {
+			q.IPProto = Unknown
+			return
+		}
+		// Some other protocol; see decode4.
+		q.Src.Port = 0
+		q.Dst.Port = 0
+		q.dataofs = q.subofs
 	}
 }
 
@@ -335,6 +351,30 @@ func (q *Parsed) ICMP4Header() ICMP4Header {
 	}
 }
 
+func (q *Parsed) IP6Header() IP6Header {
+	if q.IPVersion != 6 {
+		panic("IP6Header called on non-IPv6 Parsed")
+	}
+	ipid := binary.BigEndian.Uint32(q.b[:4]) & 0x000FFFFF
+	return IP6Header{
+		IPID:    ipid,
+		IPProto: q.IPProto,
+		Src:     q.Src.IP,
+		Dst:     q.Dst.IP,
+	}
+}
+
+func (q *Parsed) ICMP6Header() ICMP6Header {
+	if q.IPVersion != 6 {
+		panic("ICMP6Header called on non-IPv6 Parsed")
+	}
+	return ICMP6Header{
+		IP6Header: q.IP6Header(),
+		Type:      ICMP6Type(q.b[q.subofs+0]),
+		Code:      ICMP6Code(q.b[q.subofs+1]),
+	}
+}
+
 func (q *Parsed) UDP4Header() UDP4Header {
 	if q.IPVersion != 4 {
 		panic("IP4Header called on non-IPv4 Parsed")
@@ -364,6 +404,64 @@ func (q *Parsed) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
+// ClampTCPMSS lowers the maximum segment size option of a TCP SYN or
+// SYN-ACK packet to mss, if it's currently larger, and fixes up the TCP
+// checksum to match. The packet is modified in place.
+// It reports whether the packet was modified.
+func (q *Parsed) ClampTCPMSS(mss uint16) bool {
+	if q.IPProto != TCP || q.TCPFlags&TCPSyn == 0 {
+		return false
+	}
+	if q.subofs+tcpHeaderLength > q.dataofs || q.dataofs > q.length {
+		return false
+	}
+	tcp := q.b[q.subofs:q.dataofs]
+	for i := tcpHeaderLength; i < len(tcp); {
+		switch tcp[i] {
+		case 0: // end of option list
+			return false
+		case 1: // no-op
+			i++
+			continue
+		}
+		if i+1 >= len(tcp) {
+			return false
+		}
+		n := int(tcp[i+1])
+		if n < 2 || i+n > len(tcp) {
+			return false
+		}
+		if tcp[i] == 2 && n == 4 { // MSS
+			off := i + 2
+			if binary.BigEndian.Uint16(tcp[off:off+2]) <= mss {
+				return false
+			}
+			// Incrementally update the checksum (RFC 1624) over the
+			// 16-bit words covering the option value, which need
+			// not be word-aligned.
+			start, end := off&^1, (off+3)&^1
+			sum := ^binary.BigEndian.Uint16(tcp[16:18])
+			for j := start; j < end; j += 2 {
+				sum = onesAdd(sum, ^binary.BigEndian.Uint16(tcp[j:j+2]))
+			}
+			binary.BigEndian.PutUint16(tcp[off:off+2], mss)
+			for j := start; j < end; j += 2 {
+				sum = onesAdd(sum, binary.BigEndian.Uint16(tcp[j:j+2]))
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], ^sum)
+			return true
+		}
+		i += n
+	}
+	return false
+}
+
+// onesAdd returns the ones' complement sum of a and b.
+func onesAdd(a, b uint16) uint16 {
+	s := uint32(a) + uint32(b)
+	return uint16(s&0xffff + s>>16)
+}
+
 // IsError reports whether q is an ICMP "Error" packet.
 func (q *Parsed) IsError() bool {
 	switch q.IPProto {
@@ -377,8 +475,11 @@ func (q *Parsed) IsError() bool {
 		if len(q.b) < q.subofs+8 {
 			return false
 		}
+		// All of ICMPv6's error types, unlike ICMPv4's, matter:
+		// IPv6 routers don't fragment, so path MTU discovery
+		// depends on getting Packet Too Big back.
 		t := ICMP6Type(q.b[q.subofs])
-		return t == ICMP6Unreachable || t == ICMP6TimeExceeded
+		return t == ICMP6Unreachable || t == ICMP6PacketTooBig || t == ICMP6TimeExceeded || t == ICMP6ParamProblem
 	default:
 		return false
 	}
@@ -6,6 +6,7 @@ package packet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 
@@ -305,6 +306,29 @@ var ipv4TSMPDecode = Parsed{
 	Dst:       mustIPPort("100.74.70.3:0"),
 }
 
+var sixIn4PacketBuffer = []byte{
+	// IPv4 header with protocol 41 (6in4)
+	0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, 0x29, 0x00, 0x00,
+	// source ip
+	0x01, 0x02, 0x03, 0x04,
+	// destination ip
+	0x05, 0x06, 0x07, 0x08,
+	// start of the encapsulated IPv6 header
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3b, 0x40,
+}
+
+var sixIn4PacketDecode = Parsed{
+	b:       sixIn4PacketBuffer,
+	subofs:  20,
+	dataofs: 20,
+	length:  len(sixIn4PacketBuffer),
+
+	IPVersion: 4,
+	IPProto:   IPv6Encap,
+	Src:       mustIPPort("1.2.3.4:0"),
+	Dst:       mustIPPort("5.6.7.8:0"),
+}
+
 func TestParsedString(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -320,6 +344,7 @@ func TestParsedString(t *testing.T) {
 		{"igmp", igmpPacketDecode, "IGMP{192.168.1.82:0 > 224.0.0.251:0}"},
 		{"unknown", unknownPacketDecode, "Unknown{???}"},
 		{"ipv4_tsmp", ipv4TSMPDecode, "TSMP{100.94.12.14:0 > 100.74.70.3:0}"},
+		{"6in4", sixIn4PacketDecode, "6in4{1.2.3.4:0 > 5.6.7.8:0}"},
 	}
 
 	for _, tt := range tests {
@@ -357,6 +382,7 @@ func TestDecode(t *testing.T) {
 		{"unknown", unknownPacketBuffer, unknownPacketDecode},
 		{"invalid4", invalid4RequestBuffer, invalid4RequestDecode},
 		{"ipv4_tsmp", ipv4TSMPBuffer, ipv4TSMPDecode},
+		{"6in4", sixIn4PacketBuffer, sixIn4PacketDecode},
 	}
 
 	for _, tt := range tests {
@@ -378,6 +404,74 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestClampTCPMSS(t *testing.T) {
+	// tcp6Sum returns the ones' complement sum of an IPv6 TCP
+	// packet's pseudo-header and segment, including the checksum.
+	// Clamping must leave it unchanged.
+	tcp6Sum := func(b []byte) uint16 {
+		seg := b[40:]
+		var sum uint16
+		for i := 8; i < 40; i += 2 {
+			sum = onesAdd(sum, binary.BigEndian.Uint16(b[i:]))
+		}
+		sum = onesAdd(sum, uint16(len(seg)))
+		sum = onesAdd(sum, uint16(TCP))
+		for i := 0; i < len(seg); i += 2 {
+			sum = onesAdd(sum, binary.BigEndian.Uint16(seg[i:]))
+		}
+		return sum
+	}
+
+	aligned := append([]byte(nil), tcp6RequestBuffer...)
+	// Same options, but with the MSS value at an odd offset.
+	unaligned := append([]byte(nil), tcp6RequestBuffer...)
+	copy(unaligned[60:], []byte{
+		0x01, 0x02, 0x04, 0x05, 0xa0, 0x04, 0x02, 0x08, 0x0a, 0xca,
+		0x76, 0xa6, 0x8e, 0x00, 0x00, 0x00, 0x00, 0x03, 0x03, 0x07,
+	})
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		mss     uint16
+		mssOff  int
+		changed bool
+	}{
+		{"lower", aligned, 1200, 62, true},
+		{"lower_unaligned", unaligned, 1200, 63, true},
+		{"already_lower", append([]byte(nil), tcp6RequestBuffer...), 1460, 62, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldMSS := binary.BigEndian.Uint16(tt.buf[tt.mssOff:])
+			before := tcp6Sum(tt.buf)
+
+			var p Parsed
+			p.Decode(tt.buf)
+			if got := p.ClampTCPMSS(tt.mss); got != tt.changed {
+				t.Fatalf("ClampTCPMSS = %v; want %v", got, tt.changed)
+			}
+
+			wantMSS := oldMSS
+			if tt.changed {
+				wantMSS = tt.mss
+			}
+			if got := binary.BigEndian.Uint16(tt.buf[tt.mssOff:]); got != wantMSS {
+				t.Errorf("MSS = %d; want %d", got, wantMSS)
+			}
+			if after := tcp6Sum(tt.buf); after != before {
+				t.Errorf("checksum sum changed: %#x -> %#x", before, after)
+			}
+		})
+	}
+
+	var p Parsed
+	p.Decode(udp4RequestBuffer)
+	if p.ClampTCPMSS(100) {
+		t.Errorf("ClampTCPMSS modified a UDP packet")
+	}
+}
+
 func BenchmarkDecode(b *testing.B) {
 	benches := []struct {
 		name string
@@ -443,6 +537,76 @@ func TestMarshalRequest(t *testing.T) {
 	}
 }
 
+func TestICMP6EchoResponse(t *testing.T) {
+	req := Generate(ICMP6Header{
+		IP6Header: IP6Header{
+			IPID: 0x12345,
+			Src:  netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+			Dst:  netaddr.MustParseIP("fd7a:115c:a1e0::2"),
+		},
+		Type: ICMP6EchoRequest,
+	}, []byte("\x00\x01\x00\x02ping"))
+
+	var p Parsed
+	p.Decode(req)
+	if !p.IsEchoRequest() {
+		t.Fatalf("generated request %v isn't an echo request", &p)
+	}
+
+	h := p.ICMP6Header()
+	h.ToResponse()
+	resp := Generate(h, p.Payload())
+
+	var q Parsed
+	q.Decode(resp)
+	if !q.IsEchoResponse() {
+		t.Fatalf("generated response %v isn't an echo response", &q)
+	}
+	if q.Src != p.Dst || q.Dst != p.Src {
+		t.Errorf("response %v isn't from %v to %v", &q, p.Dst, p.Src)
+	}
+	if got, want := string(q.Payload()), "\x00\x01\x00\x02ping"; got != want {
+		t.Errorf("response payload = %q; want %q", got, want)
+	}
+
+	// The checksum over the pseudo-header and ICMPv6 message,
+	// including the checksum itself, must come out as zero.
+	pseudo := make([]byte, len(resp))
+	copy(pseudo, resp)
+	q.IP6Header().marshalPseudo(pseudo)
+	if sum := ip4Checksum(pseudo); sum != 0 {
+		t.Errorf("bad ICMPv6 checksum; verification sum = %#x", sum)
+	}
+}
+
+func TestICMP6IsError(t *testing.T) {
+	tests := []struct {
+		typ  ICMP6Type
+		want bool
+	}{
+		{ICMP6Unreachable, true},
+		{ICMP6PacketTooBig, true},
+		{ICMP6TimeExceeded, true},
+		{ICMP6ParamProblem, true},
+		{ICMP6EchoRequest, false},
+		{ICMP6EchoReply, false},
+	}
+	for _, tt := range tests {
+		b := Generate(ICMP6Header{
+			IP6Header: IP6Header{
+				Src: netaddr.MustParseIP("2001:db8::1"),
+				Dst: netaddr.MustParseIP("fd7a:115c:a1e0::2"),
+			},
+			Type: tt.typ,
+		}, []byte("\x00\x00\x05\x00"))
+		var p Parsed
+		p.Decode(b)
+		if got := p.IsError(); got != tt.want {
+			t.Errorf("%v: IsError = %v; want %v", tt.typ, got, tt.want)
+		}
+	}
+}
+
 func TestMarshalResponse(t *testing.T) {
 	var buf [64]byte
 
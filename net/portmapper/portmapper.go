@@ -44,6 +44,7 @@ const trustServiceStillAvailableDuration = 10 * time.Minute
 type Client struct {
 	logf         logger.Logf
 	ipAndGateway func() (gw, ip netaddr.IP, ok bool)
+	netns        *netns.Binding // or nil
 
 	mu sync.Mutex // guards following, and all fields thereof
 
@@ -80,6 +81,7 @@ type pmpMapping struct {
 	internal netaddr.IPPort
 	useUntil time.Time // the mapping's lifetime minus renewal interval
 	epoch    uint32
+	netns    *netns.Binding // of the Client that made it, to release it
 }
 
 // externalValid reports whether m.external is valid, with both its IP and Port populated.
@@ -89,7 +91,7 @@ func (m *pmpMapping) externalValid() bool {
 
 // release does a best effort fire-and-forget release of the PMP mapping m.
 func (m *pmpMapping) release() {
-	uc, err := netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
+	uc, err := m.netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
 	if err != nil {
 		return
 	}
@@ -113,6 +115,13 @@ func (c *Client) SetGatewayLookupFunc(f func() (gw, myIP netaddr.IP, ok bool)) {
 	c.ipAndGateway = f
 }
 
+// SetNetnsBinding sets the interface binding of the client's sockets.
+// It must be called before the client is used. If not called, the OS
+// is asked for the default route's interface on each listen.
+func (c *Client) SetNetnsBinding(b *netns.Binding) {
+	c.netns = b
+}
+
 // NoteNetworkDown should be called when the network has transitioned to a down state.
 // It's too late to release port mappings at this point (the user might've just turned off
 // their wifi), but we can make sure we invalidate mappings for later when the network
@@ -257,6 +266,7 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 	m := &pmpMapping{
 		gw:       gw,
 		internal: netaddr.IPPort{IP: myIP, Port: localPort},
+		netns:    c.netns,
 	}
 
 	// prevPort is the port we had most previously, if any. We try
@@ -288,7 +298,7 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 
 	c.mu.Unlock()
 
-	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	uc, err := c.netns.Listener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
 		return netaddr.IPPort{}, err
 	}
@@ -458,7 +468,7 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 		}
 	}()
 
-	uc, err := netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
+	uc, err := c.netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
 	if err != nil {
 		c.logf("ProbePCP: %v", err)
 		return res, err
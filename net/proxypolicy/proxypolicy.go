@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proxypolicy restricts who may use tailscaled's SOCKS5 and
+// HTTP proxy listeners, and where they may connect to.
+//
+// Each listener has its own Policy, so one userspace gateway can
+// serve several applications with different access.
+package proxypolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// Policy is the access policy of a proxy listener. The zero value
+// allows everything.
+type Policy struct {
+	// Sources, if non-empty, are the client addresses that may use
+	// the listener. Connections from other addresses are closed
+	// without being served.
+	Sources []netaddr.IPPrefix
+
+	// Dests, if non-empty, are the addresses that clients may
+	// connect to through the listener.
+	Dests []netaddr.IPPrefix
+
+	// Ports, if non-empty, are the ports that clients may connect
+	// to through the listener.
+	Ports []uint16
+}
+
+// ErrNotAllowed is returned by dialers from Dialer for destinations
+// the policy doesn't allow.
+var ErrNotAllowed = errors.New("destination not allowed by proxy policy")
+
+// AllowSource reports whether the policy allows clients from ip.
+func (p *Policy) AllowSource(ip netaddr.IP) bool {
+	return len(p.Sources) == 0 || containsIP(p.Sources, ip)
+}
+
+// AllowDest reports whether the policy allows connections to ipp.
+func (p *Policy) AllowDest(ipp netaddr.IPPort) bool {
+	if len(p.Dests) > 0 && !containsIP(p.Dests, ipp.IP) {
+		return false
+	}
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, port := range p.Ports {
+		if port == ipp.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(pfxs []netaddr.IPPrefix, ip netaddr.IP) bool {
+	ip = ip.Unmap()
+	for _, pfx := range pfxs {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener returns a listener that only accepts connections from
+// sources the policy allows, closing and logging the others.
+func (p *Policy) Listener(ln net.Listener, logf logger.Logf) net.Listener {
+	if len(p.Sources) == 0 {
+		return ln
+	}
+	return &filteredListener{Listener: ln, p: p, logf: logf}
+}
+
+type filteredListener struct {
+	net.Listener
+	p    *Policy
+	logf logger.Logf
+}
+
+func (ln *filteredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ipp, err := netaddr.ParseIPPort(c.RemoteAddr().String())
+		if err == nil && ln.p.AllowSource(ipp.IP) {
+			return c, nil
+		}
+		ln.logf("rejected connection from %v", c.RemoteAddr())
+		c.Close()
+	}
+}
+
+// Dialer returns a dialer that resolves the destination address with
+// resolve, checks it against the policy, and only then dials the
+// resolved address with dial.
+func (p *Policy) Dialer(
+	resolve func(ctx context.Context, addr string) (netaddr.IPPort, error),
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ipp, err := resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !p.AllowDest(ipp) {
+			return nil, fmt.Errorf("%s: %w", addr, ErrNotAllowed)
+		}
+		return dial(ctx, network, ipp.String())
+	}
+}
+
+// ListenerConfig is the configuration of one proxy listener.
+type ListenerConfig struct {
+	Type   string // "socks5" or "http"
+	Addr   string // listen address, as [ip]:port
+	Policy Policy
+}
+
+// ParseListenerConfig parses a listener configuration of the form
+//
+//	TYPE://[IP]:PORT[?src=CIDR,...&dst=CIDR,...&ports=PORT,...]
+//
+// where TYPE is "socks5" or "http". Bare IPs are accepted in place
+// of CIDRs.
+func ParseListenerConfig(s string) (ListenerConfig, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenerConfig{}, err
+	}
+	lc := ListenerConfig{Type: u.Scheme, Addr: u.Host}
+	if lc.Type != "socks5" && lc.Type != "http" {
+		return ListenerConfig{}, fmt.Errorf("%q: unknown proxy type %q; want socks5 or http", s, lc.Type)
+	}
+	if _, _, err := net.SplitHostPort(lc.Addr); err != nil {
+		return ListenerConfig{}, fmt.Errorf("%q: invalid listen address: %v", s, err)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return ListenerConfig{}, fmt.Errorf("%q: unexpected path %q", s, u.Path)
+	}
+	q := u.Query()
+	for k := range q {
+		if k != "src" && k != "dst" && k != "ports" {
+			return ListenerConfig{}, fmt.Errorf("%q: unknown parameter %q", s, k)
+		}
+	}
+	if lc.Policy.Sources, err = parsePrefixes(q["src"]); err != nil {
+		return ListenerConfig{}, fmt.Errorf("%q: src: %v", s, err)
+	}
+	if lc.Policy.Dests, err = parsePrefixes(q["dst"]); err != nil {
+		return ListenerConfig{}, fmt.Errorf("%q: dst: %v", s, err)
+	}
+	for _, v := range splitValues(q["ports"]) {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return ListenerConfig{}, fmt.Errorf("%q: invalid port %q", s, v)
+		}
+		lc.Policy.Ports = append(lc.Policy.Ports, uint16(port))
+	}
+	return lc, nil
+}
+
+func parsePrefixes(vals []string) ([]netaddr.IPPrefix, error) {
+	var ret []netaddr.IPPrefix
+	for _, v := range splitValues(vals) {
+		if !strings.Contains(v, "/") {
+			ip, err := netaddr.ParseIP(v)
+			if err != nil {
+				return nil, err
+			}
+			bits := uint8(128)
+			if ip.Is4() {
+				bits = 32
+			}
+			ret = append(ret, netaddr.IPPrefix{IP: ip, Bits: bits})
+			continue
+		}
+		pfx, err := netaddr.ParseIPPrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, pfx)
+	}
+	return ret, nil
+}
+
+// splitValues splits each of vals on commas, skipping empty values.
+func splitValues(vals []string) []string {
+	var ret []string
+	for _, v := range vals {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				ret = append(ret, f)
+			}
+		}
+	}
+	return ret
+}
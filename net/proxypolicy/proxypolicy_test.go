@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxypolicy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseListenerConfig(t *testing.T) {
+	lc, err := ParseListenerConfig("socks5://127.0.0.1:1080?src=127.0.0.1,10.0.0.0/8&dst=100.101.102.0/24&ports=22,443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc.Type != "socks5" || lc.Addr != "127.0.0.1:1080" {
+		t.Errorf("got %+v", lc)
+	}
+	p := &lc.Policy
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.1", false},
+	} {
+		if got := p.AllowSource(netaddr.MustParseIP(tt.ip)); got != tt.want {
+			t.Errorf("AllowSource(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		ipp  string
+		want bool
+	}{
+		{"100.101.102.103:22", true},
+		{"100.101.102.103:80", false},
+		{"100.101.103.1:22", false},
+	} {
+		if got := p.AllowDest(netaddr.MustParseIPPort(tt.ipp)); got != tt.want {
+			t.Errorf("AllowDest(%s) = %v; want %v", tt.ipp, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"ftp://127.0.0.1:21",
+		"http://127.0.0.1",
+		"http://127.0.0.1:8080?src=nope",
+		"http://127.0.0.1:8080?ports=0",
+		"http://127.0.0.1:8080?foo=bar",
+	} {
+		if _, err := ParseListenerConfig(bad); err == nil {
+			t.Errorf("ParseListenerConfig(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	p := &Policy{Dests: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")}}
+	resolve := func(ctx context.Context, addr string) (netaddr.IPPort, error) {
+		return netaddr.MustParseIPPort("100.64.0.2:80"), nil
+	}
+	var dialed bool
+	dial := p.Dialer(resolve, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, errors.New("unreachable")
+	})
+	if _, err := dial(context.Background(), "tcp", "foo:80"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("dial error = %v; want ErrNotAllowed", err)
+	}
+	if dialed {
+		t.Error("disallowed destination was dialed")
+	}
+}
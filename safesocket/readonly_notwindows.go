@@ -0,0 +1,17 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package safesocket
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoReadonlyPipe = errors.New("read-only pipe is only supported on Windows")
+
+func listenReadonly() (net.Listener, error) { return nil, errNoReadonlyPipe }
+func connectReadonly() (net.Conn, error)    { return nil, errNoReadonlyPipe }
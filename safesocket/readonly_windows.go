@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// readonlyPipeSDDL is the security descriptor of the read-only pipe.
+// SYSTEM and Administrators have full access. Other logged-in users
+// may read and write data (0x12008b is FILE_GENERIC_READ|FILE_WRITE_DATA)
+// but, unlike with GENERIC_WRITE, can't create instances of the pipe
+// to impersonate tailscaled.
+const readonlyPipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;0x12008b;;;AU)"
+
+// Not all in x/sys/windows yet.
+const (
+	pipeRejectRemoteClients = 0x8        // PIPE_REJECT_REMOTE_CLIENTS
+	securitySQOSPresent     = 0x00100000 // SECURITY_SQOS_PRESENT
+	securityIdentification  = 0x00010000 // SECURITY_IDENTIFICATION
+)
+
+func listenReadonly() (net.Listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(readonlyPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		name: ReadonlyPipeName,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	// Create the first instance now, so we fail if someone else
+	// already has the name.
+	l.next, err = l.newPipe(true)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func connectReadonly() (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(ReadonlyPipeName)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		0, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_OVERLAPPED|securitySQOSPresent|securityIdentification,
+		0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: ReadonlyPipeName, Err: err}
+	}
+	return newPipeConn(h), nil
+}
+
+// pipeListener is a net.Listener for a named pipe.
+type pipeListener struct {
+	name string
+	sa   *windows.SecurityAttributes
+
+	mu        sync.Mutex
+	next      windows.Handle // pipe instance for the next Accept, or 0
+	accepting bool           // an Accept is waiting for a client on next
+	closed    bool
+}
+
+func (l *pipeListener) newPipe(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return 0, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	h, err := windows.CreateNamedPipe(name, flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|pipeRejectRemoteClients,
+		windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, l.sa)
+	if err != nil {
+		return 0, &os.PathError{Op: "CreateNamedPipe", Path: l.name, Err: err}
+	}
+	return h, nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if l.accepting {
+		l.mu.Unlock()
+		return nil, errors.New("concurrent Accept")
+	}
+	h := l.next
+	if h == 0 {
+		var err error
+		h, err = l.newPipe(false)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.next = h
+	}
+	l.accepting = true
+	l.mu.Unlock()
+
+	_, err := waitIO(h, func(o *windows.Overlapped) error {
+		err := windows.ConnectNamedPipe(h, o)
+		if err == windows.ERROR_PIPE_CONNECTED {
+			// A client connected before we called
+			// ConnectNamedPipe.
+			return nil
+		}
+		return err
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepting = false
+	l.next = 0
+	if err != nil {
+		windows.CloseHandle(h)
+		if l.closed {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return newPipeConn(h), nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.next != 0 {
+		if l.accepting {
+			// Accept closes it.
+			windows.CancelIoEx(l.next, nil)
+		} else {
+			windows.CloseHandle(l.next)
+			l.next = 0
+		}
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.name) }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a net.Conn for one end of a named pipe opened for
+// overlapped I/O.
+//
+// It supports read deadlines, which net/http's server needs to abort
+// its background reads. Write deadlines are ignored.
+type pipeConn struct {
+	h windows.Handle
+
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	closed    bool
+	reading   bool
+	rdeadline time.Time
+	rtimer    *time.Timer // cancels the pending Read at rdeadline, or nil
+}
+
+func newPipeConn(h windows.Handle) *pipeConn {
+	return &pipeConn{h: h}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if !c.rdeadline.IsZero() && !time.Now().Before(c.rdeadline) {
+		c.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.reading = true
+	c.armReadTimerLocked()
+	c.mu.Unlock()
+
+	n, err := waitIO(c.h, func(o *windows.Overlapped) error {
+		return windows.ReadFile(c.h, b, nil, o)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading = false
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+		c.rtimer = nil
+	}
+	switch {
+	case err == nil && n == 0, err == windows.ERROR_BROKEN_PIPE, err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return 0, io.EOF
+	case err == windows.ERROR_OPERATION_ABORTED:
+		if c.closed {
+			return int(n), net.ErrClosed
+		}
+		return int(n), os.ErrDeadlineExceeded
+	case err != nil:
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// armReadTimerLocked arranges for the pending Read to be cancelled
+// at the read deadline. c.mu must be held.
+func (c *pipeConn) armReadTimerLocked() {
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+		c.rtimer = nil
+	}
+	if !c.reading || c.rdeadline.IsZero() {
+		return
+	}
+	c.rtimer = time.AfterFunc(time.Until(c.rdeadline), func() {
+		// This also cancels any Write, which Write retries.
+		windows.CancelIoEx(c.h, nil)
+	})
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := waitIO(c.h, func(o *windows.Overlapped) error {
+			return windows.WriteFile(c.h, b[written:], nil, o)
+		})
+		written += int(n)
+		if err != nil {
+			if err == windows.ERROR_OPERATION_ABORTED {
+				// Cancelled by Close or a read deadline;
+				// retry unless closed.
+				c.mu.Lock()
+				closed := c.closed
+				c.mu.Unlock()
+				if !closed {
+					continue
+				}
+				return written, net.ErrClosed
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		if c.rtimer != nil {
+			c.rtimer.Stop()
+			c.rtimer = nil
+		}
+		c.mu.Unlock()
+		windows.CancelIoEx(c.h, nil)
+		windows.CloseHandle(c.h)
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(ReadonlyPipeName) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(ReadonlyPipeName) }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline = t
+	c.armReadTimerLocked()
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// waitIO starts an overlapped operation on h with start and waits for
+// it to finish, returning the number of bytes transferred.
+func waitIO(h windows.Handle, start func(*windows.Overlapped) error) (uint32, error) {
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(ev)
+	o := &windows.Overlapped{HEvent: ev}
+	if err := start(o); err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+	var n uint32
+	err = windows.GetOverlappedResult(h, o, &n, true)
+	return n, err
+}
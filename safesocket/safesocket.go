@@ -48,6 +48,22 @@ func Listen(path string, port uint16) (_ net.Listener, gotPort uint16, _ error)
 	return listen(path, port)
 }
 
+// ReadonlyPipeName is the Windows named pipe on which tailscaled
+// serves the read-only LocalAPI to users who aren't administrators.
+const ReadonlyPipeName = `\\.\pipe\tailscale-readonly`
+
+// ListenReadonly returns a listener on ReadonlyPipeName, which any
+// logged-in user may connect to. It's only supported on Windows.
+func ListenReadonly() (net.Listener, error) {
+	return listenReadonly()
+}
+
+// ConnectReadonly connects to ReadonlyPipeName. It's only supported on
+// Windows.
+func ConnectReadonly() (net.Conn, error) {
+	return connectReadonly()
+}
+
 var (
 	ErrTokenNotFound = errors.New("no token found")
 	ErrNoTokenOnOS   = errors.New("no token on " + runtime.GOOS)
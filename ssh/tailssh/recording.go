@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package tailssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SessionInfo describes an SSH session, for recording.
+type SessionInfo struct {
+	ID        string    // random session ID
+	Start     time.Time // when the session's command started
+	LocalUser string    // local account the session runs as
+	PeerUser  string    // Tailscale login name of the connecting user
+	PeerNode  string    // name of the connecting node
+	PeerAddr  string    // Tailscale IP:port of the connecting node
+	Command   string    // command run, or "(login shell)" or "(sftp)"
+
+	PTY        bool   // whether the session has a terminal
+	Term       string // value of TERM, if PTY
+	Cols, Rows int    // initial terminal size, if PTY
+}
+
+// A SessionRecorder records SSH sessions.
+type SessionRecorder interface {
+	// StartSession is called before a session's command runs. The
+	// returned writer receives a copy of the session's output
+	// (stdout, and stderr too if the session has a PTY) until the
+	// session ends and it's closed.
+	//
+	// If StartSession returns an error, the session isn't run.
+	StartSession(SessionInfo) (io.WriteCloser, error)
+}
+
+// CastRecorder is a SessionRecorder that writes each session to a
+// file in Dir in asciinema's asciicast v2 format, which can be played
+// back with "asciinema play".
+type CastRecorder struct {
+	Dir string
+}
+
+// StartSession implements SessionRecorder.
+func (r *CastRecorder) StartSession(si SessionInfo) (io.WriteCloser, error) {
+	if err := os.MkdirAll(r.Dir, 0700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("ssh-%s-%s.cast", si.Start.UTC().Format("20060102T150405Z"), si.ID)
+	f, err := os.OpenFile(filepath.Join(r.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cw := &castWriter{f: f, bw: bufio.NewWriter(f), start: si.Start}
+	if err := cw.writeHeader(si); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+type castWriter struct {
+	start time.Time
+
+	mu sync.Mutex
+	f  *os.File
+	bw *bufio.Writer
+}
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func (w *castWriter) writeHeader(si SessionInfo) error {
+	h := castHeader{
+		Version:   2,
+		Width:     si.Cols,
+		Height:    si.Rows,
+		Timestamp: si.Start.Unix(),
+		Command:   si.Command,
+		Title:     fmt.Sprintf("%s from %s (%s) as %s", si.PeerUser, si.PeerNode, si.PeerAddr, si.LocalUser),
+	}
+	if si.Term != "" {
+		h.Env = map[string]string{"TERM": si.Term}
+	}
+	if h.Width == 0 {
+		h.Width, h.Height = 80, 24
+	}
+	j, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(append(j, '\n')); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// Write writes an output event for p.
+func (w *castWriter) Write(p []byte) (int, error) {
+	j, err := json.Marshal([]interface{}{
+		time.Since(w.start).Seconds(),
+		"o",
+		string(p),
+	})
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.bw.Write(append(j, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *castWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.bw.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,552 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+// Package tailssh is an SSH server integrated into tailscaled.
+//
+// It authenticates clients by their Tailscale identity, as
+// established by WireGuard, instead of by SSH keys or passwords:
+// a connection to one of the node's Tailscale IPs comes from a known
+// peer node owned by a known user, and that user is permitted to log
+// in if they also own this node. Which local accounts they may log
+// in as is limited by the SSHUsers pref; root is refused unless it's
+// listed there.
+//
+// Importing this package registers the server with ipnlocal; it's
+// then run when the RunSSH pref is set (tailscale up --ssh).
+package tailssh
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	ipnlocal.RegisterNewSSHServer(func(logf logger.Logf, lb *ipnlocal.LocalBackend, hostKeyPEM []byte) (ipnlocal.SSHServer, error) {
+		return newServer(logf, lb, hostKeyPEM)
+	})
+}
+
+var (
+	recorderMu sync.Mutex
+	recorder   SessionRecorder
+)
+
+// SetSessionRecorder sets the recorder that subsequent SSH sessions
+// are recorded with, or disables recording if r is nil.
+//
+// By default, if the TS_SSH_RECORD_DIR environment variable is set,
+// sessions are recorded to that directory by a CastRecorder.
+func SetSessionRecorder(r SessionRecorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	recorder = r
+}
+
+func init() {
+	if dir := os.Getenv("TS_SSH_RECORD_DIR"); dir != "" {
+		SetSessionRecorder(&CastRecorder{Dir: dir})
+	}
+}
+
+func currentRecorder() SessionRecorder {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	return recorder
+}
+
+type server struct {
+	logf logger.Logf
+	lb   *ipnlocal.LocalBackend
+	cfg  *ssh.ServerConfig
+}
+
+func newServer(logf logger.Logf, lb *ipnlocal.LocalBackend, hostKeyPEM []byte) (*server, error) {
+	signer, err := ssh.ParsePrivateKey(hostKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+	cfg := &ssh.ServerConfig{
+		// Clients are authenticated by their Tailscale identity
+		// in HandleSSHConn, before the SSH handshake starts, so
+		// no SSH-level authentication is needed.
+		NoClientAuth:  true,
+		ServerVersion: "SSH-2.0-Tailscale",
+	}
+	cfg.AddHostKey(signer)
+	return &server{logf: logf, lb: lb, cfg: cfg}, nil
+}
+
+// peerIdentity is who's on the other end of a connection, according
+// to the netmap.
+type peerIdentity struct {
+	node *tailcfg.Node
+	user tailcfg.UserProfile
+	addr netaddr.IPPort
+}
+
+// HandleSSHConn implements ipnlocal.SSHServer.
+func (srv *server) HandleSSHConn(c net.Conn) error {
+	defer c.Close()
+	id, err := srv.authorize(c.RemoteAddr())
+	if err != nil {
+		// Don't say why to the client.
+		return err
+	}
+	sc, chans, reqs, err := ssh.NewServerConn(c, srv.cfg)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	logf := logger.WithPrefix(srv.logf, fmt.Sprintf("%s@%s: ", id.user.LoginName, id.node.ComputedName))
+
+	lu, err := lookupLocalUser(sc.User())
+	if err == nil {
+		err = checkLocalUser(srv.lb.Prefs().SSHUsers, lu)
+	}
+	if err != nil {
+		logf("rejecting local user %q: %v", sc.User(), err)
+		return nil
+	}
+	logf("accepted connection from %v as local user %q", id.addr, lu.Username)
+
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			logf("accepting channel: %v", err)
+			continue
+		}
+		ss := &session{
+			logf: logf,
+			ch:   ch,
+			id:   id,
+			lu:   lu,
+			sc:   sc,
+		}
+		go ss.run(chReqs)
+	}
+	return nil
+}
+
+// authorize returns the identity of the peer at remote, or an error
+// if it isn't permitted to log in.
+//
+// A peer is permitted if it's owned by the same Tailscale user that
+// owns this node, and wasn't shared into the tailnet from elsewhere.
+func (srv *server) authorize(remote net.Addr) (*peerIdentity, error) {
+	ta, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected remote address type %T", remote)
+	}
+	ip, ok := netaddr.FromStdIP(ta.IP)
+	if !ok {
+		return nil, fmt.Errorf("bad remote IP %v", ta.IP)
+	}
+	ipp := netaddr.IPPort{IP: ip, Port: uint16(ta.Port)}
+	node, up, ok := srv.lb.WhoIs(ipp)
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %v", ipp)
+	}
+	self := srv.lb.SelfNode()
+	if self == nil {
+		return nil, errors.New("no netmap")
+	}
+	if err := checkAccess(self, node); err != nil {
+		return nil, fmt.Errorf("peer %v (%s): %w", ipp, up.LoginName, err)
+	}
+	return &peerIdentity{node: node, user: up, addr: ipp}, nil
+}
+
+// checkAccess reports whether peer may log in to self.
+func checkAccess(self, peer *tailcfg.Node) error {
+	switch {
+	case peer.User.IsZero():
+		return errors.New("peer has no owner")
+	case peer.Sharer != 0:
+		return errors.New("peer is shared in from another tailnet")
+	case peer.Hostinfo.ShareeNode:
+		return errors.New("peer belongs to a sharee")
+	case peer.User != self.User:
+		return errors.New("peer is owned by a different user")
+	}
+	return nil
+}
+
+// checkLocalUser reports whether a client may log in as lu, given
+// allowed, the SSHUsers pref. If allowed is empty, any account but
+// root (uid 0) is permitted.
+func checkLocalUser(allowed []string, lu *localUser) error {
+	if len(allowed) == 0 {
+		if lu.uid == 0 {
+			return errors.New("root logins must be enabled with --ssh-users")
+		}
+		return nil
+	}
+	for _, name := range allowed {
+		if name == lu.Username {
+			return nil
+		}
+	}
+	return errors.New("not in --ssh-users")
+}
+
+// localUser is a local account that SSH sessions run as.
+type localUser struct {
+	*user.User
+	uid, gid uint32
+	groups   []uint32
+	shell    string
+}
+
+func lookupLocalUser(name string) (*localUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getuid() != 0 && int(uid) != os.Getuid() {
+		return nil, errors.New("tailscaled isn't running as root, so can only log in as its own user")
+	}
+	lu := &localUser{User: u, uid: uint32(uid), gid: uint32(gid), shell: loginShell(u.Username)}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gids {
+		if n, err := strconv.ParseUint(g, 10, 32); err == nil {
+			lu.groups = append(lu.groups, uint32(n))
+		}
+	}
+	return lu, nil
+}
+
+// loginShell returns the login shell of the named user from
+// /etc/passwd, or /bin/sh if it can't be found.
+func loginShell(username string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	for bs.Scan() {
+		fields := strings.Split(bs.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// session is an SSH session channel.
+type session struct {
+	logf logger.Logf
+	ch   ssh.Channel
+	id   *peerIdentity
+	lu   *localUser
+	sc   *ssh.ServerConn
+
+	env []string // client-requested environment, "K=V"
+
+	mu   sync.Mutex
+	pty  *os.File // or nil; the PTY master
+	term string
+	cols uint32
+	rows uint32
+}
+
+// sftpServers are the usual locations of OpenSSH's sftp-server,
+// which the "sftp" subsystem runs.
+var sftpServers = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+}
+
+func (ss *session) run(reqs <-chan *ssh.Request) {
+	defer ss.ch.Close()
+	started := false // a shell, exec or subsystem request was accepted
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			ok = ss.handlePTYReq(req.Payload)
+		case "window-change":
+			ok = ss.handleWindowChange(req.Payload)
+		case "env":
+			var kv struct{ Name, Value string }
+			if ssh.Unmarshal(req.Payload, &kv) == nil && acceptEnv(kv.Name) {
+				ss.env = append(ss.env, kv.Name+"="+kv.Value)
+				ok = true
+			}
+		case "shell", "exec", "subsystem":
+			// Only one command may run per session, as in RFC
+			// 4254 section 6.5.
+			if started {
+				break
+			}
+			var cmd *exec.Cmd
+			var desc string
+			cmd, desc, ok = ss.command(req)
+			if ok {
+				started = true
+				req.Reply(true, nil)
+				go func() {
+					code := ss.runCommand(cmd, desc)
+					ss.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+					ss.ch.Close()
+				}()
+				continue
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// acceptEnv reports whether the client may set the named environment
+// variable, as with OpenSSH's usual AcceptEnv settings.
+func acceptEnv(name string) bool {
+	return name == "LANG" || strings.HasPrefix(name, "LC_") || name == "COLORTERM"
+}
+
+func (ss *session) handlePTYReq(payload []byte) bool {
+	var req struct {
+		Term                 string
+		Cols, Rows, PxW, PxH uint32
+		Modes                string
+	}
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.pty != nil {
+		return false
+	}
+	ptm, err := openPTY()
+	if err != nil {
+		ss.logf("opening pty: %v", err)
+		return false
+	}
+	// The terminal modes in req.Modes are ignored; the PTY starts
+	// with the kernel's defaults, which suit interactive shells.
+	ss.pty, ss.term, ss.cols, ss.rows = ptm, req.Term, req.Cols, req.Rows
+	setWinsize(ptm, req.Cols, req.Rows)
+	return true
+}
+
+func (ss *session) handleWindowChange(payload []byte) bool {
+	var req struct {
+		Cols, Rows, PxW, PxH uint32
+	}
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.pty == nil {
+		return false
+	}
+	ss.cols, ss.rows = req.Cols, req.Rows
+	setWinsize(ss.pty, req.Cols, req.Rows)
+	return true
+}
+
+// command returns the command to run for a shell, exec or subsystem
+// request, and a description of it for logs and recordings.
+func (ss *session) command(req *ssh.Request) (cmd *exec.Cmd, desc string, ok bool) {
+	shell := ss.lu.shell
+	switch req.Type {
+	case "shell":
+		cmd = exec.Command(shell)
+		cmd.Args[0] = "-" + filepath.Base(shell) // login shell
+		desc = "(login shell)"
+	case "exec":
+		var p struct{ Command string }
+		if ssh.Unmarshal(req.Payload, &p) != nil {
+			return nil, "", false
+		}
+		cmd = exec.Command(shell, "-c", p.Command)
+		desc = p.Command
+	case "subsystem":
+		var p struct{ Name string }
+		if ssh.Unmarshal(req.Payload, &p) != nil || p.Name != "sftp" {
+			return nil, "", false
+		}
+		for _, path := range sftpServers {
+			if _, err := os.Stat(path); err == nil {
+				cmd = exec.Command(path)
+				break
+			}
+		}
+		if cmd == nil {
+			ss.logf("sftp requested, but no sftp-server found")
+			return nil, "", false
+		}
+		desc = "(sftp)"
+	}
+	cmd.Dir = ss.lu.HomeDir
+	cmd.Env = ss.environ()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if uint32(os.Getuid()) != ss.lu.uid {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    ss.lu.uid,
+			Gid:    ss.lu.gid,
+			Groups: ss.lu.groups,
+		}
+	}
+	return cmd, desc, true
+}
+
+func (ss *session) environ() []string {
+	la := ss.sc.LocalAddr().(*net.TCPAddr)
+	env := []string{
+		"HOME=" + ss.lu.HomeDir,
+		"USER=" + ss.lu.Username,
+		"LOGNAME=" + ss.lu.Username,
+		"SHELL=" + ss.lu.shell,
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		fmt.Sprintf("SSH_CLIENT=%s %d %d", ss.id.addr.IP, ss.id.addr.Port, la.Port),
+		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ss.id.addr.IP, ss.id.addr.Port, la.IP, la.Port),
+	}
+	ss.mu.Lock()
+	if ss.pty != nil && ss.term != "" {
+		env = append(env, "TERM="+ss.term)
+	}
+	ss.mu.Unlock()
+	return append(env, ss.env...)
+}
+
+// runCommand runs cmd connected to the session's channel, through its
+// PTY if it has one, and returns its exit code.
+func (ss *session) runCommand(cmd *exec.Cmd, desc string) (exitCode int) {
+	ss.mu.Lock()
+	ptm := ss.pty
+	info := SessionInfo{
+		ID:        newSessionID(),
+		Start:     time.Now(),
+		LocalUser: ss.lu.Username,
+		PeerUser:  ss.id.user.LoginName,
+		PeerNode:  ss.id.node.ComputedName,
+		PeerAddr:  ss.id.addr.String(),
+		Command:   desc,
+		PTY:       ptm != nil,
+		Term:      ss.term,
+		Cols:      int(ss.cols),
+		Rows:      int(ss.rows),
+	}
+	ss.mu.Unlock()
+
+	var out io.Writer = ss.ch
+	if r := currentRecorder(); r != nil {
+		rec, err := r.StartSession(info)
+		if err != nil {
+			// Fail closed: if recording was asked for, don't run
+			// unrecorded sessions.
+			ss.logf("session %s: starting recording: %v", info.ID, err)
+			fmt.Fprintf(ss.ch.Stderr(), "tailscale: session recording failed; refusing to start session\r\n")
+			return 1
+		}
+		defer rec.Close()
+		out = io.MultiWriter(ss.ch, rec)
+	}
+	ss.logf("session %s: running %s", info.ID, desc)
+
+	if ptm == nil {
+		// Not cmd.Stdin = ss.ch: Wait would then block copying
+		// stdin until the client sends EOF, even after the process
+		// has exited.
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			ss.logf("session %s: %v", info.ID, err)
+			return 1
+		}
+		cmd.Stdout = out
+		cmd.Stderr = ss.ch.Stderr()
+		if err := cmd.Start(); err != nil {
+			ss.logf("session %s: %v", info.ID, err)
+			return 1
+		}
+		go func() {
+			// Ends at client EOF, or once the channel is closed
+			// after the process exits.
+			io.Copy(stdin, ss.ch)
+			stdin.Close()
+		}()
+		return exitStatus(cmd.Wait())
+	}
+
+	pts, err := openPTS(ptm)
+	if err != nil {
+		ss.logf("session %s: opening pts: %v", info.ID, err)
+		return 1
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0 // child's stdin
+	err = cmd.Start()
+	pts.Close()
+	if err != nil {
+		ss.logf("session %s: %v", info.ID, err)
+		return 1
+	}
+	go io.Copy(ptm, ss.ch)
+	io.Copy(out, ptm) // until the process and its children exit
+	code := exitStatus(cmd.Wait())
+	ptm.Close()
+	return code
+}
+
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return 1
+}
+
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckAccess(t *testing.T) {
+	self := &tailcfg.Node{User: 1}
+	tests := []struct {
+		name string
+		peer *tailcfg.Node
+		ok   bool
+	}{
+		{"same-user", &tailcfg.Node{User: 1}, true},
+		{"other-user", &tailcfg.Node{User: 2}, false},
+		{"no-user", &tailcfg.Node{}, false},
+		{"shared-in", &tailcfg.Node{User: 1, Sharer: 3}, false},
+		{"sharee", &tailcfg.Node{User: 1, Hostinfo: tailcfg.Hostinfo{ShareeNode: true}}, false},
+	}
+	for _, tt := range tests {
+		err := checkAccess(self, tt.peer)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkAccess = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckLocalUser(t *testing.T) {
+	alice := &localUser{User: &user.User{Username: "alice"}, uid: 1000}
+	root := &localUser{User: &user.User{Username: "root"}, uid: 0}
+	tests := []struct {
+		name    string
+		allowed []string
+		lu      *localUser
+		ok      bool
+	}{
+		{"default-user", nil, alice, true},
+		{"default-root", nil, root, false},
+		{"listed", []string{"bob", "alice"}, alice, true},
+		{"unlisted", []string{"bob"}, alice, false},
+		{"root-listed", []string{"root"}, root, true},
+		{"root-unlisted", []string{"alice"}, root, false},
+	}
+	for _, tt := range tests {
+		err := checkLocalUser(tt.allowed, tt.lu)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkLocalUser = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// fakeChannel is an ssh.Channel whose client never sends EOF: reads
+// block until it's closed.
+type fakeChannel struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func newFakeChannel() *fakeChannel { return &fakeChannel{closed: make(chan struct{})} }
+
+func (c *fakeChannel) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *fakeChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+func (c *fakeChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeChannel) CloseWrite() error { return nil }
+
+func (c *fakeChannel) SendRequest(string, bool, []byte) (bool, error) { return true, nil }
+
+func (c *fakeChannel) Stderr() io.ReadWriter { return c }
+
+func TestRunCommandNoStdinEOF(t *testing.T) {
+	ch := newFakeChannel()
+	defer ch.Close()
+	ss := &session{
+		logf: t.Logf,
+		ch:   ch,
+		id:   &peerIdentity{node: &tailcfg.Node{}},
+		lu:   &localUser{User: &user.User{Username: "alice"}},
+	}
+	cmd := exec.Command("/bin/sh", "-c", "echo hi; exit 3")
+
+	done := make(chan int, 1)
+	go func() { done <- ss.runCommand(cmd, "test") }()
+	select {
+	case code := <-done:
+		if code != 3 {
+			t.Errorf("exit code = %d; want 3", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runCommand didn't return after the command exited")
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if got := ch.out.String(); got != "hi\n" {
+		t.Errorf("output = %q; want %q", got, "hi\n")
+	}
+}
+
+func TestCastRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tailssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &CastRecorder{Dir: dir}
+	w, err := r.StartSession(SessionInfo{
+		ID:        "abc",
+		Start:     time.Now(),
+		LocalUser: "alice",
+		PeerUser:  "alice@example.com",
+		Command:   "(login shell)",
+		PTY:       true,
+		Term:      "xterm",
+		Cols:      100,
+		Rows:      30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if len(files) != 1 {
+		t.Fatalf("got %d recordings; want 1", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	if !bs.Scan() {
+		t.Fatal("no header")
+	}
+	var h castHeader
+	if err := json.Unmarshal(bs.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || h.Width != 100 || h.Height != 30 || h.Env["TERM"] != "xterm" {
+		t.Errorf("header = %+v", h)
+	}
+	if !bs.Scan() {
+		t.Fatal("no event")
+	}
+	var ev []interface{}
+	if err := json.Unmarshal(bs.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 3 || ev[1] != "o" || ev[2] != "hello\r\n" {
+		t.Errorf("event = %v", ev)
+	}
+}
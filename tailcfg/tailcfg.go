@@ -36,7 +36,8 @@ import (
 //    10: 2021-01-17: client understands MapResponse.PeerSeenChange
 //    11: 2021-03-03: client understands IPv6, multiple default routes, and goroutine dumping
 //    12: 2021-03-04: client understands PingRequest
-const CurrentMapRequestVersion = 11
+//    13: 2021-03-19: client understands FilterRule.IPProto
+const CurrentMapRequestVersion = 13
 
 type StableID string
 
@@ -187,6 +188,20 @@ type Node struct {
 
 	MachineAuthorized bool `json:",omitempty"` // TODO(crawshaw): replace with MachineStatus
 
+	// Tags are the ACL tags the control server granted the node,
+	// out of those it asked for in Hostinfo.RequestTags. Unlike
+	// RequestTags, which the node reports itself, these can be
+	// trusted for access decisions.
+	Tags []string `json:",omitempty"`
+
+	// KeySignature, if non-empty, is a tailnet lock signature of
+	// Key, a JSON tka.NodeKeySignature. Nodes with tailnet lock
+	// enabled ignore peers without a valid one.
+	//
+	// It's proposed, along with TKASignRequest, and not yet set
+	// by any control server; see ipnlocal's TS_DEBUG_TAILNET_LOCK.
+	KeySignature []byte `json:",omitempty"`
+
 	// The following three computed fields hold the various names that can
 	// be used for this node in UIs. They are populated from controlclient
 	// (not from control) by calling node.InitDisplayNames. These can be
@@ -377,6 +392,12 @@ type ServiceProto string
 const (
 	TCP = ServiceProto("tcp")
 	UDP = ServiceProto("udp")
+
+	// PeerAPI4 and PeerAPI6 are the pseudo-protocols of the services
+	// advertising the node's peer API HTTP server, on its Tailscale
+	// IPv4 and IPv6 addresses respectively.
+	PeerAPI4 = ServiceProto("peerapi4")
+	PeerAPI6 = ServiceProto("peerapi6")
 )
 
 type Service struct {
@@ -410,11 +431,35 @@ type Hostinfo struct {
 	RequestTags   []string           `json:",omitempty"` // set of ACL tags this node wants to claim
 	Services      []Service          `json:",omitempty"` // services advertised by this machine
 	NetInfo       *NetInfo           `json:",omitempty"`
+	Health        *HealthSummary     `json:",omitempty"` // summary of the node's health, for peers
+
+	// AppConnectorDomains are the domains this node is an app
+	// connector for, whose queries peers send to its peer API so
+	// that it learns the addresses to advertise routes for. An
+	// entry "*.example.com" covers the subdomains of example.com.
+	AppConnectorDomains []string `json:",omitempty"`
 
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Equal.
 }
 
+// HealthSummary is a compact summary of a node's health, which it
+// publishes in its Hostinfo so that any node in the tailnet can show
+// an overview of the fleet.
+type HealthSummary struct {
+	// Warnings is the number of current health warnings.
+	Warnings int `json:",omitempty"`
+
+	// KeyExpiry is when the node's key expires, or the zero value
+	// if it doesn't.
+	KeyExpiry time.Time
+
+	// Updated is when the summary last changed. Nodes only
+	// republish it when it does, so an old value on its own doesn't
+	// mean the summary is stale.
+	Updated time.Time
+}
+
 // NetInfo contains information about the host's network state.
 type NetInfo struct {
 	// MappingVariesByDestIP says whether the host's NAT mappings
@@ -558,6 +603,10 @@ type RegisterRequest struct {
 	Expiry   time.Time // requested key expiry, server policy may override
 	Followup string    // response waits until AuthURL is visited
 	Hostinfo *Hostinfo
+
+	// Ephemeral is whether the node asks to be ephemeral: deleted
+	// by control soon after it goes offline or logs out.
+	Ephemeral bool `json:",omitempty"`
 }
 
 // Clone makes a deep copy of RegisterRequest.
@@ -694,6 +743,14 @@ type FilterRule struct {
 	// DstPorts are the port ranges to allow once a source IP
 	// matches (is in the CIDR described by SrcIPs & SrcBits).
 	DstPorts []NetPortRange
+
+	// IPProto are the IP protocol numbers to match.
+	//
+	// If empty, it means TCP, UDP, ICMPv4 and ICMPv6, the only
+	// protocols clients before MapRequest.Version 13 allow. For
+	// protocols without ports, such as GRE (47) or 6in4 (41),
+	// only the IPs of DstPorts are matched.
+	IPProto []int `json:",omitempty"`
 }
 
 var FilterAllowAll = []FilterRule{
@@ -736,6 +793,61 @@ type PingRequest struct {
 	Log bool `json:",omitempty"`
 }
 
+// SetDNSRequest is a request to add a DNS record.
+//
+// This is used for ACME DNS-01 challenges (so people can use
+// LetsEncrypt, etc).
+//
+// The request is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
+// using the local machine key, and sent to:
+//	https://login.tailscale.com/machine/<mkey hex>/set-dns
+type SetDNSRequest struct {
+	// Version indicates what level of SetDNSRequest functionality
+	// the client understands. Currently this type only has
+	// one version; this field should always be 1 for now.
+	Version int
+
+	// NodeKey is the client's current node key.
+	NodeKey NodeKey
+
+	// Name is the domain name for which to create a record.
+	// For ACME DNS-01 challenges, it should be the node's
+	// MagicDNS name with the prefix "_acme-challenge.".
+	Name string
+
+	// Type is the DNS record type. For ACME DNS-01 challenges, it
+	// should be "TXT".
+	Type string
+
+	// Value is the value to add.
+	Value string
+}
+
+// TKASignRequest submits a tailnet lock signature of a node key to
+// the control plane server, to distribute to the tailnet's nodes in
+// that node's Node.KeySignature.
+//
+// It's a proposal: no control server implements it yet, and clients
+// only send it with TS_DEBUG_TAILNET_LOCK set.
+//
+// The request is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
+// using the local machine key, and sent to:
+//	https://login.tailscale.com/machine/<mkey hex>/tka/sign
+type TKASignRequest struct {
+	// Version is the version of the request; it's 1 for now.
+	Version int
+
+	// NodeKey is the client's current node key.
+	NodeKey NodeKey
+
+	// SignedKey is the node key that Signature signs, which may be
+	// another node's.
+	SignedKey NodeKey
+
+	// Signature is the JSON tka.NodeKeySignature.
+	Signature []byte
+}
+
 type MapResponse struct {
 	// KeepAlive, if set, represents an empty message just to keep
 	// the connection alive. When true, all other fields except
@@ -937,6 +1049,8 @@ func (n *Node) Equal(n2 *Node) bool {
 		n.Created.Equal(n2.Created) &&
 		eqTimePtr(n.LastSeen, n2.LastSeen) &&
 		n.MachineAuthorized == n2.MachineAuthorized &&
+		eqStrings(n.Tags, n2.Tags) &&
+		bytes.Equal(n.KeySignature, n2.KeySignature) &&
 		n.ComputedName == n2.ComputedName &&
 		n.computedHostIfDifferent == n2.computedHostIfDifferent &&
 		n.ComputedNameWithHost == n2.ComputedNameWithHost
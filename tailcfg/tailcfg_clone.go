@@ -55,6 +55,8 @@ func (src *Node) Clone() *Node {
 		dst.LastSeen = new(time.Time)
 		*dst.LastSeen = *src.LastSeen
 	}
+	dst.Tags = append(src.Tags[:0:0], src.Tags...)
+	dst.KeySignature = append(src.KeySignature[:0:0], src.KeySignature...)
 	return dst
 }
 
@@ -79,6 +81,8 @@ var _NodeNeedsRegeneration = Node(struct {
 	LastSeen                *time.Time
 	KeepAlive               bool
 	MachineAuthorized       bool
+	Tags                    []string
+	KeySignature            []byte
 	ComputedName            string
 	computedHostIfDifferent string
 	ComputedNameWithHost    string
@@ -96,27 +100,34 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	dst.RequestTags = append(src.RequestTags[:0:0], src.RequestTags...)
 	dst.Services = append(src.Services[:0:0], src.Services...)
 	dst.NetInfo = src.NetInfo.Clone()
+	if dst.Health != nil {
+		dst.Health = new(HealthSummary)
+		*dst.Health = *src.Health
+	}
+	dst.AppConnectorDomains = append(src.AppConnectorDomains[:0:0], src.AppConnectorDomains...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with command:
 //   tailscale.com/cmd/cloner -type User,Node,Hostinfo,NetInfo,Group,Role,Capability,Login,DNSConfig,RegisterResponse
 var _HostinfoNeedsRegeneration = Hostinfo(struct {
-	IPNVersion    string
-	FrontendLogID string
-	BackendLogID  string
-	OS            string
-	OSVersion     string
-	Package       string
-	DeviceModel   string
-	Hostname      string
-	ShieldsUp     bool
-	ShareeNode    bool
-	GoArch        string
-	RoutableIPs   []netaddr.IPPrefix
-	RequestTags   []string
-	Services      []Service
-	NetInfo       *NetInfo
+	IPNVersion          string
+	FrontendLogID       string
+	BackendLogID        string
+	OS                  string
+	OSVersion           string
+	Package             string
+	DeviceModel         string
+	Hostname            string
+	ShieldsUp           bool
+	ShareeNode          bool
+	GoArch              string
+	RoutableIPs         []netaddr.IPPrefix
+	RequestTags         []string
+	Services            []Service
+	NetInfo             *NetInfo
+	Health              *HealthSummary
+	AppConnectorDomains []string
 }{})
 
 // Clone makes a deep copy of NetInfo.
@@ -29,7 +29,8 @@ func TestHostinfoEqual(t *testing.T) {
 		"ShieldsUp", "ShareeNode",
 		"GoArch",
 		"RoutableIPs", "RequestTags",
-		"Services", "NetInfo",
+		"Services", "NetInfo", "Health",
+		"AppConnectorDomains",
 	}
 	if have := fieldsOf(reflect.TypeOf(Hostinfo{})); !reflect.DeepEqual(have, hiHandles) {
 		t.Errorf("Hostinfo.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
@@ -178,6 +179,16 @@ func TestHostinfoEqual(t *testing.T) {
 			&Hostinfo{},
 			false,
 		},
+		{
+			&Hostinfo{Health: &HealthSummary{Warnings: 1}},
+			&Hostinfo{Health: &HealthSummary{Warnings: 1}},
+			true,
+		},
+		{
+			&Hostinfo{Health: &HealthSummary{Warnings: 1}},
+			&Hostinfo{Health: &HealthSummary{Warnings: 2}},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -193,6 +204,7 @@ func TestNodeEqual(t *testing.T) {
 		"Key", "KeyExpiry", "Machine", "DiscoKey",
 		"Addresses", "AllowedIPs", "Endpoints", "DERP", "Hostinfo",
 		"Created", "LastSeen", "KeepAlive", "MachineAuthorized",
+		"Tags", "KeySignature",
 		"ComputedName", "computedHostIfDifferent", "ComputedNameWithHost",
 	}
 	if have := fieldsOf(reflect.TypeOf(Node{})); !reflect.DeepEqual(have, nodeHandles) {
@@ -360,6 +372,21 @@ func TestNodeEqual(t *testing.T) {
 			&Node{DERP: "bar"},
 			false,
 		},
+		{
+			&Node{KeySignature: []byte("sig")},
+			&Node{KeySignature: nil},
+			false,
+		},
+		{
+			&Node{KeySignature: []byte("sig")},
+			&Node{KeySignature: []byte("sig")},
+			true,
+		},
+		{
+			&Node{Tags: []string{"tag:web"}},
+			&Node{Tags: []string{"tag:db"}},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
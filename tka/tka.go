@@ -0,0 +1,199 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tka implements the tailnet key authority behind
+// "tailscale lock".
+//
+// With tailnet lock enabled, a node only talks to peers whose node
+// keys have been signed by one of a set of trusted signing keys. The
+// signing keys are generated and held by nodes in the tailnet, never
+// by the control server, which only passes signatures along. A
+// compromised control server can still hand a node new peers, but
+// can't make the node accept them.
+package tka
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+const (
+	publicKeyPrefix  = "tlpub:"
+	privateKeyPrefix = "tlpriv:"
+)
+
+// nodeKeySigContext is prepended to the node key to make the message
+// that's signed, so that signatures can't be confused with any other
+// use of the signing keys.
+const nodeKeySigContext = "tailscale-tka-node-key-v1:"
+
+var (
+	// ErrNoSignature is returned when verifying a node key that
+	// has no signature.
+	ErrNoSignature = errors.New("node key is not signed")
+
+	errUntrustedKey = errors.New("signed by an untrusted key")
+	errBadSignature = errors.New("invalid signature")
+)
+
+// PublicKey is a signing key's public half, an Ed25519 public key.
+type PublicKey [ed25519.PublicKeySize]byte
+
+func (k PublicKey) String() string { return publicKeyPrefix + hex.EncodeToString(k[:]) }
+
+// ShortString returns an abbreviated form of k, for logs.
+func (k PublicKey) ShortString() string { return fmt.Sprintf("[%x]", k[:4]) }
+
+func (k PublicKey) MarshalText() ([]byte, error) { return []byte(k.String()), nil }
+
+func (k *PublicKey) UnmarshalText(text []byte) error {
+	return unmarshalHex(k[:], publicKeyPrefix, text)
+}
+
+// ParsePublicKey parses a public key in its "tlpub:" text form.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	err := k.UnmarshalText([]byte(s))
+	return k, err
+}
+
+// PrivateKey is a signing key, held by a node in the tailnet. It's
+// the seed of an Ed25519 private key.
+type PrivateKey [ed25519.SeedSize]byte
+
+// NewPrivateKey returns a new random signing key.
+func NewPrivateKey() (PrivateKey, error) {
+	var k PrivateKey
+	if _, err := rand.Read(k[:]); err != nil {
+		return PrivateKey{}, err
+	}
+	return k, nil
+}
+
+// IsZero reports whether k is the zero value.
+func (k PrivateKey) IsZero() bool { return k == PrivateKey{} }
+
+// Public returns k's public key.
+func (k PrivateKey) Public() PublicKey {
+	var pub PublicKey
+	copy(pub[:], ed25519.NewKeyFromSeed(k[:]).Public().(ed25519.PublicKey))
+	return pub
+}
+
+func (k PrivateKey) MarshalText() ([]byte, error) {
+	return []byte(privateKeyPrefix + hex.EncodeToString(k[:])), nil
+}
+
+func (k *PrivateKey) UnmarshalText(text []byte) error {
+	return unmarshalHex(k[:], privateKeyPrefix, text)
+}
+
+func unmarshalHex(dst []byte, prefix string, text []byte) error {
+	s := string(text)
+	if !strings.HasPrefix(s, prefix) {
+		return fmt.Errorf("missing %q prefix", prefix)
+	}
+	b, err := hex.DecodeString(s[len(prefix):])
+	if err != nil {
+		return fmt.Errorf("after %q: %v", prefix, err)
+	}
+	if len(b) != len(dst) {
+		return fmt.Errorf("after %q: got %d bytes; want %d", prefix, len(b), len(dst))
+	}
+	copy(dst, b)
+	return nil
+}
+
+// NodeKeySignature is a signing key's signature of a node key. Its
+// JSON form is what's carried in tailcfg.Node.KeySignature.
+type NodeKeySignature struct {
+	NodeKey    tailcfg.NodeKey
+	SigningKey PublicKey
+	Signature  []byte
+}
+
+func nodeKeySigMessage(nk tailcfg.NodeKey) []byte {
+	return append([]byte(nodeKeySigContext), nk[:]...)
+}
+
+// SignNodeKey signs nk with k and returns the marshaled
+// NodeKeySignature.
+func (k PrivateKey) SignNodeKey(nk tailcfg.NodeKey) []byte {
+	priv := ed25519.NewKeyFromSeed(k[:])
+	sig := NodeKeySignature{
+		NodeKey:    nk,
+		SigningKey: k.Public(),
+		Signature:  ed25519.Sign(priv, nodeKeySigMessage(nk)),
+	}
+	j, err := json.Marshal(sig)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	return j
+}
+
+// Authority is the set of signing keys that a node trusts to sign
+// its peers' node keys.
+type Authority struct {
+	Keys []PublicKey
+}
+
+// Trusts reports whether a trusts signatures by k.
+func (a *Authority) Trusts(k PublicKey) bool {
+	for _, tk := range a.Keys {
+		if tk == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds k to a's keys, reporting whether it wasn't already trusted.
+func (a *Authority) Add(k PublicKey) bool {
+	if a.Trusts(k) {
+		return false
+	}
+	a.Keys = append(a.Keys, k)
+	return true
+}
+
+// Remove removes k from a's keys, reporting whether it was trusted.
+func (a *Authority) Remove(k PublicKey) bool {
+	for i, tk := range a.Keys {
+		if tk == k {
+			a.Keys = append(a.Keys[:i:i], a.Keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyNodeKey checks that sig, a marshaled NodeKeySignature, is a
+// signature of nk by one of a's keys.
+func (a *Authority) VerifyNodeKey(nk tailcfg.NodeKey, sig []byte) error {
+	if len(sig) == 0 {
+		return ErrNoSignature
+	}
+	var s NodeKeySignature
+	if err := json.Unmarshal(sig, &s); err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+	if s.NodeKey != nk {
+		return fmt.Errorf("signature is for %v, not %v", s.NodeKey.ShortString(), nk.ShortString())
+	}
+	if !a.Trusts(s.SigningKey) {
+		return errUntrustedKey
+	}
+	if !ed25519.Verify(s.SigningKey[:], nodeKeySigMessage(nk), s.Signature) {
+		return errBadSignature
+	}
+	return nil
+}
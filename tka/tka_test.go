@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func mustNewPrivateKey(t *testing.T) PrivateKey {
+	t.Helper()
+	k, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestVerifyNodeKey(t *testing.T) {
+	trusted := mustNewPrivateKey(t)
+	untrusted := mustNewPrivateKey(t)
+	a := &Authority{Keys: []PublicKey{trusted.Public()}}
+
+	nk := tailcfg.NodeKey{1, 2, 3}
+	other := tailcfg.NodeKey{4, 5, 6}
+
+	tampered := trusted.SignNodeKey(nk)
+	var s NodeKeySignature
+	if err := json.Unmarshal(tampered, &s); err != nil {
+		t.Fatal(err)
+	}
+	s.Signature[0] ^= 1
+	tampered, _ = json.Marshal(s)
+
+	tests := []struct {
+		name    string
+		sig     []byte
+		wantErr bool
+	}{
+		{"trusted", trusted.SignNodeKey(nk), false},
+		{"unsigned", nil, true},
+		{"untrusted", untrusted.SignNodeKey(nk), true},
+		{"other-node", trusted.SignNodeKey(other), true},
+		{"tampered", tampered, true},
+		{"garbage", []byte("not json"), true},
+	}
+	for _, tt := range tests {
+		err := a.VerifyNodeKey(nk, tt.sig)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: VerifyNodeKey = %v; want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if err := a.VerifyNodeKey(nk, nil); err != ErrNoSignature {
+		t.Errorf("unsigned: got %v; want ErrNoSignature", err)
+	}
+}
+
+func TestAuthorityAddRemove(t *testing.T) {
+	k1 := mustNewPrivateKey(t).Public()
+	k2 := mustNewPrivateKey(t).Public()
+	a := &Authority{Keys: []PublicKey{k1}}
+	orig := a.Keys
+
+	if a.Add(k1) {
+		t.Error("Add of trusted key reported a change")
+	}
+	if !a.Add(k2) || !a.Trusts(k2) {
+		t.Errorf("Add(k2) didn't trust it; keys = %v", a.Keys)
+	}
+	if !a.Remove(k1) || a.Trusts(k1) {
+		t.Errorf("Remove(k1) didn't distrust it; keys = %v", a.Keys)
+	}
+	if a.Remove(k1) {
+		t.Error("Remove of untrusted key reported a change")
+	}
+	if len(a.Keys) != 1 || a.Keys[0] != k2 {
+		t.Errorf("keys = %v; want just %v", a.Keys, k2)
+	}
+	if orig[0] != k1 {
+		t.Error("Remove modified the original key slice")
+	}
+}
+
+func TestKeyText(t *testing.T) {
+	priv := mustNewPrivateKey(t)
+	pub := priv.Public()
+
+	got, err := ParsePublicKey(pub.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != pub {
+		t.Errorf("ParsePublicKey(%q) = %v", pub, got)
+	}
+	if _, err := ParsePublicKey("tlpub:1234"); err == nil {
+		t.Error("ParsePublicKey accepted a short key")
+	}
+	if _, err := ParsePublicKey(hexOnly(pub.String())); err == nil {
+		t.Error("ParsePublicKey accepted a key without its prefix")
+	}
+
+	text, _ := priv.MarshalText()
+	var priv2 PrivateKey
+	if err := priv2.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if priv2 != priv {
+		t.Error("private key didn't round trip")
+	}
+}
+
+func hexOnly(s string) string { return s[len(publicKeyPrefix):] }
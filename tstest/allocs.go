@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// MinAllocsPerRun runs f repeatedly with testing.AllocsPerRun until
+// it makes at most budget allocations per run, or a few seconds have
+// passed. It returns an error describing the lowest count seen if the
+// budget was never met.
+//
+// Allocations made by other goroutines, such as the runtime's or
+// those of servers a test started, count against f, so a single
+// AllocsPerRun measurement is noisy. Taking the minimum over several
+// makes budgets reliable enough to enforce in tests.
+func MinAllocsPerRun(t testing.TB, budget uint64, f func()) error {
+	t.Helper()
+	const runs = 1000
+	deadline := time.Now().Add(5 * time.Second)
+	var min uint64
+	for i := 0; i == 0 || time.Now().Before(deadline); i++ {
+		n := uint64(testing.AllocsPerRun(runs, f))
+		if n <= budget {
+			return nil
+		}
+		if i == 0 || n < min {
+			min = n
+		}
+	}
+	return fmt.Errorf("got %d allocs per run; want at most %d", min, budget)
+}
@@ -44,3 +44,22 @@ func (p portValue) Set(v string) error {
 	*p.n = uint16(n)
 	return nil
 }
+
+type stringsValue struct{ s *[]string }
+
+// StringsValue returns a flag.Value that appends each of the flag's
+// values to dst, so the flag can be given more than once.
+func StringsValue(dst *[]string) flag.Value {
+	return stringsValue{dst}
+}
+
+func (v stringsValue) String() string {
+	if v.s == nil {
+		return ""
+	}
+	return strings.Join(*v.s, " ")
+}
+func (v stringsValue) Set(s string) error {
+	*v.s = append(*v.s, s)
+	return nil
+}
@@ -0,0 +1,540 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qrcode encodes short strings, such as login URLs, as QR
+// codes and renders them for terminals.
+//
+// It only implements what tailscale needs: byte mode, error
+// correction level L, and versions 1 through 10 (up to 271 bytes).
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	size    int
+	modules [][]bool // [y][x]; true is dark
+}
+
+// Size returns the width and height of the code in modules, not
+// counting the quiet zone around it.
+func (c *Code) Size() int { return c.size }
+
+// Dark reports whether the module at column x, row y is dark.
+// Coordinates outside the code are light.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.size || y >= c.size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// maxVersion is the largest QR version Encode produces.
+const maxVersion = 10
+
+// Per-version parameters for error correction level L, indexed by
+// version-1.
+var (
+	totalCodewords = [maxVersion]int{26, 44, 70, 100, 134, 172, 196, 242, 292, 346}
+	eccPerBlock    = [maxVersion]int{7, 10, 15, 20, 26, 18, 20, 24, 30, 18}
+	numBlocks      = [maxVersion]int{1, 1, 1, 1, 1, 2, 2, 2, 2, 4}
+)
+
+// ErrTooLong is returned by Encode when the data doesn't fit in the
+// largest supported QR version.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+// Encode encodes data as a QR code using the smallest version that
+// fits it.
+func Encode(data string) (*Code, error) {
+	for ver := 1; ver <= maxVersion; ver++ {
+		if len(data) <= capacity(ver) {
+			return encode(ver, data), nil
+		}
+	}
+	return nil, ErrTooLong
+}
+
+// capacity returns how many bytes fit in version ver.
+func capacity(ver int) int {
+	bits := dataCodewords(ver)*8 - 4 - countBits(ver)
+	return bits / 8
+}
+
+func dataCodewords(ver int) int {
+	return totalCodewords[ver-1] - eccPerBlock[ver-1]*numBlocks[ver-1]
+}
+
+// countBits returns the width of the byte mode character count.
+func countBits(ver int) int {
+	if ver < 10 {
+		return 8
+	}
+	return 16
+}
+
+func encode(ver int, data string) *Code {
+	c := newCode(ver)
+	c.drawCodewords(addECC(ver, encodeData(ver, data)))
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		p := c.penalty()
+		if best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // undo
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return &c.Code
+}
+
+// encodeData returns the data codewords for data in version ver,
+// including the mode, length and padding.
+func encodeData(ver int, data string) []byte {
+	var bb bitBuffer
+	bb.append(0x4, 4) // byte mode
+	bb.append(uint32(len(data)), countBits(ver))
+	for i := 0; i < len(data); i++ {
+		bb.append(uint32(data[i]), 8)
+	}
+	capBits := dataCodewords(ver) * 8
+	term := capBits - len(bb)
+	if term > 4 {
+		term = 4
+	}
+	bb.append(0, term)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := uint32(0xec); len(bb) < capBits; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	return bb.bytes()
+}
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, v>>uint(i)&1 != 0)
+	}
+}
+
+// bytes returns the whole bytes in bb, dropping any trailing bits.
+func (bb bitBuffer) bytes() []byte {
+	ret := make([]byte, len(bb)/8)
+	for i := 0; i < len(ret)*8; i++ {
+		if bb[i] {
+			ret[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return ret
+}
+
+// addECC splits data into blocks, appends the Reed-Solomon error
+// correction codewords of each block, and interleaves the result.
+func addECC(ver int, data []byte) []byte {
+	nBlocks := numBlocks[ver-1]
+	eccLen := eccPerBlock[ver-1]
+	raw := totalCodewords[ver-1]
+	nShort := nBlocks - raw%nBlocks
+	shortLen := raw / nBlocks
+
+	div := rsDivisor(eccLen)
+	var blocks [][]byte
+	for i, k := 0, 0; i < nBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= nShort {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := append([]byte(nil), dat...)
+		if i < nShort {
+			block = append(block, 0) // placeholder, skipped below
+		}
+		block = append(block, rsRemainder(dat, div)...)
+		blocks = append(blocks, block)
+	}
+
+	ret := make([]byte, 0, raw)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= nShort {
+				ret = append(ret, block[i])
+			}
+		}
+	}
+	return ret
+}
+
+// gfMul multiplies x and y in GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, highest power first, without the
+// leading 1.
+func rsDivisor(degree int) []byte {
+	ret := make([]byte, degree)
+	ret[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range ret {
+			ret[j] = gfMul(ret[j], root)
+			if j+1 < len(ret) {
+				ret[j] ^= ret[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return ret
+}
+
+// rsRemainder returns the error correction codewords for data.
+func rsRemainder(data, divisor []byte) []byte {
+	ret := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ ret[0]
+		copy(ret, ret[1:])
+		ret[len(ret)-1] = 0
+		for i, d := range divisor {
+			ret[i] ^= gfMul(d, factor)
+		}
+	}
+	return ret
+}
+
+// builder is a Code under construction.
+type builder struct {
+	Code
+	ver      int
+	function [][]bool // [y][x]; whether the module is a function pattern
+}
+
+func newCode(ver int) *builder {
+	size := 17 + 4*ver
+	c := &builder{ver: ver}
+	c.size = size
+	c.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	pos := alignmentPositions(ver)
+	last := len(pos) - 1
+	for i, y := range pos {
+		for j, x := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // overlaps a finder
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	c.drawFormatBits(0) // reserve; redrawn once the mask is chosen
+	c.drawVersion()
+	return c
+}
+
+func (c *builder) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *builder) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= c.size || y >= c.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *builder) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the row and column coordinates of the
+// alignment pattern centers of version ver.
+func alignmentPositions(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	n := ver/7 + 2
+	size := 17 + 4*ver
+	step := (ver*8 + n*3 + 5) / (n*4 - 4) * 2
+	ret := make([]int, n)
+	ret[0] = 6
+	for i, pos := n-1, size-7; i >= 1; i, pos = i-1, pos-step {
+		ret[i] = pos
+	}
+	return ret
+}
+
+// formatBits returns the 15-bit format information for error
+// correction level L and mask.
+func formatBits(mask int) uint32 {
+	data := uint32(1<<3 | mask) // L is 01
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *builder) drawFormatBits(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.size-15+i, bit(i))
+	}
+	c.set(8, c.size-8, true) // the dark module
+}
+
+// versionBits returns the 18-bit version information for ver.
+func versionBits(ver int) uint32 {
+	rem := uint32(ver)
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return uint32(ver)<<12 | rem
+}
+
+func (c *builder) drawVersion() {
+	if c.ver < 7 {
+		return
+	}
+	bits := versionBits(c.ver)
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 != 0
+		a, b := c.size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// drawCodewords places data in the non-function modules in the
+// zigzag order of the QR spec.
+func (c *builder) drawCodewords(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.size; vert++ {
+			y := vert
+			if upward {
+				y = c.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y][x] = data[i/8]>>uint(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs mask into the non-function modules. Applying it
+// twice undoes it.
+func (c *builder) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, per the four rules
+// of the QR spec used to pick a mask. Lower is better.
+func (c *builder) penalty() int {
+	n := c.size
+	p := 0
+	dark := 0
+	// finderLike matches 1:1:3:1:1 dark:light:dark:light:dark
+	// runs with four light modules on one side.
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for i := 0; i < n; i++ {
+		for _, line := range [][]bool{c.row(i), c.column(i)} {
+			run := 1
+			for j := 1; j <= n; j++ {
+				if j < n && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+			for j := 0; j+7 <= n; j++ {
+				if !matches(line[j:j+7], finderLike) {
+					continue
+				}
+				if lightRun(line, j-4, j) || lightRun(line, j+7, j+11) {
+					p += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				v := c.modules[y][x]
+				if c.modules[y][x+1] == v && c.modules[y+1][x] == v && c.modules[y+1][x+1] == v {
+					p += 3
+				}
+			}
+		}
+	}
+	// How far the dark proportion is from 50%, in steps of 5%.
+	k := abs(dark*20-n*n*10) / (n * n)
+	p += k * 10
+	return p
+}
+
+func (c *builder) row(y int) []bool { return c.modules[y] }
+
+func (c *builder) column(x int) []bool {
+	ret := make([]bool, c.size)
+	for y := range ret {
+		ret[y] = c.modules[y][x]
+	}
+	return ret
+}
+
+func matches(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lightRun reports whether line[from:to] is all light, treating
+// modules outside the code as light.
+func lightRun(line []bool, from, to int) bool {
+	for i := from; i < to; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// quietZone is how many light modules Terminal draws around the
+// code. The spec asks for four, but two scans fine and saves space.
+const quietZone = 2
+
+// Terminal renders c with Unicode half blocks, two rows of modules
+// per line of text. Light modules are drawn as blocks, so it's meant
+// for terminals with light text on a dark background.
+func (c *Code) Terminal() string {
+	var sb strings.Builder
+	for y := -quietZone; y < c.size+quietZone; y += 2 {
+		for x := -quietZone; x < c.size+quietZone; x++ {
+			top, bottom := !c.Dark(x, y), !c.Dark(x, y+1)
+			if y+1 >= c.size+quietZone {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
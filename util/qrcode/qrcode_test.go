@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qrcode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as 1-M, from the worked example at
+	// thonky.com/qr-code-tutorial.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	tests := []struct {
+		mask int
+		want uint32
+	}{
+		{0, 0x77c4}, // 111011111000100
+		{4, 0x662f}, // 110011000101111
+		{7, 0x6976}, // 110100101110110
+	}
+	for _, tt := range tests {
+		if got := formatBits(tt.mask); got != tt.want {
+			t.Errorf("formatBits(%d) = %015b; want %015b", tt.mask, got, tt.want)
+		}
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	if got, want := versionBits(7), uint32(0x07c94); got != want {
+		t.Errorf("versionBits(7) = %018b; want %018b", got, want)
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		6:  {6, 34},
+		7:  {6, 22, 38},
+		9:  {6, 26, 46},
+		10: {6, 28, 50},
+	}
+	for ver, want := range tests {
+		if got := alignmentPositions(ver); !reflect.DeepEqual(got, want) {
+			t.Errorf("version %d: got %v; want %v", ver, got, want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	want := []int{17, 32, 53, 78, 106, 134, 154, 192, 230, 271}
+	for i, w := range want {
+		if got := capacity(i + 1); got != w {
+			t.Errorf("capacity(%d) = %d; want %d", i+1, got, w)
+		}
+	}
+}
+
+// TestRoundTrip reads the format information and codewords back out
+// of encoded codes and checks they match what was put in.
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"https://login.tailscale.com/a/0123456789ab",
+		strings.Repeat("x", 134), // two blocks
+		strings.Repeat("y", 200), // version 8, with version info
+		strings.Repeat("z", 271), // blocks of unequal length
+	} {
+		c, err := Encode(s)
+		if err != nil {
+			t.Fatalf("Encode(%d bytes): %v", len(s), err)
+		}
+		ver := (c.Size() - 17) / 4
+		b := newCode(ver)
+
+		var format uint32
+		for i := 14; i >= 9; i-- {
+			format = format<<1 | bit(c.Dark(14-i, 8))
+		}
+		format = format<<1 | bit(c.Dark(7, 8))
+		format = format<<1 | bit(c.Dark(8, 8))
+		format = format<<1 | bit(c.Dark(8, 7))
+		for i := 5; i >= 0; i-- {
+			format = format<<1 | bit(c.Dark(8, i))
+		}
+		mask := -1
+		for m := 0; m < 8; m++ {
+			if formatBits(m) == format {
+				mask = m
+			}
+		}
+		if mask < 0 {
+			t.Fatalf("%d bytes: bad format bits %015b", len(s), format)
+		}
+
+		// Unmask a copy and read the codewords in placement order.
+		b.modules = make([][]bool, c.Size())
+		for y := range b.modules {
+			b.modules[y] = append([]bool(nil), c.modules[y]...)
+		}
+		b.applyMask(mask)
+		var got bitBuffer
+		for right := b.size - 1; right >= 1; right -= 2 {
+			if right == 6 {
+				right = 5
+			}
+			upward := (right+1)&2 == 0
+			for vert := 0; vert < b.size; vert++ {
+				y := vert
+				if upward {
+					y = b.size - 1 - vert
+				}
+				for j := 0; j < 2; j++ {
+					if x := right - j; !b.function[y][x] {
+						got = append(got, b.modules[y][x])
+					}
+				}
+			}
+		}
+
+		var data bitBuffer
+		data.append(0x4, 4)
+		data.append(uint32(len(s)), countBits(ver))
+		for _, ch := range []byte(s) {
+			data.append(uint32(ch), 8)
+		}
+		want := addECC(ver, encodeData(ver, s))
+		if !bytes.Equal(got.bytes()[:len(want)], want) {
+			t.Errorf("%d bytes: codewords don't round trip", len(s))
+		}
+		if !bytes.HasPrefix(got.bytes(), data.bytes()) && len(s) < 130 {
+			// Only single-block codes hold the data contiguously.
+			t.Errorf("%d bytes: data doesn't start the codewords", len(s))
+		}
+	}
+}
+
+func bit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestTooLong(t *testing.T) {
+	if _, err := Encode(strings.Repeat("x", 272)); err != ErrTooLong {
+		t.Errorf("got %v; want ErrTooLong", err)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	c, err := Encode("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	width := c.Size() + 2*quietZone
+	if len(lines) != (width+1)/2 {
+		t.Errorf("got %d lines; want %d", len(lines), (width+1)/2)
+	}
+	for _, l := range lines {
+		if n := len([]rune(l)); n != width {
+			t.Fatalf("line is %d wide; want %d", n, width)
+		}
+	}
+	if lines[0] != strings.Repeat("█", width) {
+		t.Errorf("first line isn't quiet zone: %q", lines[0])
+	}
+}
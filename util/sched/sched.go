@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sched runs named periodic tasks, with jitter and backoff,
+// and reports when each last ran and when it will next run.
+package sched
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// Task is periodic work for a Scheduler to run.
+type Task struct {
+	// Func does the work. Its context is canceled when the task is
+	// removed or the Scheduler's context is done.
+	Func func(context.Context) error
+
+	// Interval is how long after each run the task runs again.
+	Interval time.Duration
+
+	// Delay is how long after being added the task first runs.
+	// If zero, it's Interval.
+	Delay time.Duration
+
+	// Jitter is the fraction of Interval, from 0 to 1, by which
+	// each run is randomly moved earlier or later, so that many
+	// nodes don't all do the same thing at the same time.
+	Jitter float64
+
+	// Retry, if non-zero, is how long after a failed run the task
+	// is retried. It doubles with each consecutive failure, up to
+	// Interval.
+	Retry time.Duration
+}
+
+// TaskStatus is the state of a scheduled task.
+type TaskStatus struct {
+	Name     string
+	Interval time.Duration
+	Running  bool
+
+	// Runs is how many times the task has run.
+	Runs int
+
+	// LastStart is when the task's last run started, and
+	// LastDuration how long it took. Both are zero before its
+	// first run.
+	LastStart    time.Time
+	LastDuration time.Duration
+
+	// LastErr is the error from the task's last run, if it failed,
+	// and Failures is how many consecutive runs have failed.
+	LastErr  string `json:",omitempty"`
+	Failures int    `json:",omitempty"`
+
+	// NextRun is when the task will next run. It's zero while the
+	// task is running.
+	NextRun time.Time
+}
+
+// A Scheduler runs periodic tasks until its context is done.
+type Scheduler struct {
+	ctx  context.Context
+	logf logger.Logf
+
+	mu    sync.Mutex
+	tasks map[string]*task
+}
+
+type task struct {
+	name   string
+	t      Task
+	cancel context.CancelFunc
+	wake   chan struct{} // buffered; a send runs the task now
+
+	st TaskStatus // guarded by Scheduler.mu
+}
+
+// New returns a Scheduler that runs tasks until ctx is done.
+func New(ctx context.Context, logf logger.Logf) *Scheduler {
+	return &Scheduler{
+		ctx:   ctx,
+		logf:  logf,
+		tasks: map[string]*task{},
+	}
+}
+
+// Add starts running t as the task called name, replacing any task
+// already called that.
+func (s *Scheduler) Add(name string, t Task) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	tk := &task{
+		name:   name,
+		t:      t,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+	}
+	first := t.Delay
+	if first == 0 {
+		first = jitter(t.Interval, t.Jitter)
+	}
+	tk.st = TaskStatus{
+		Name:     name,
+		Interval: t.Interval,
+		NextRun:  time.Now().Add(first),
+	}
+
+	s.mu.Lock()
+	if old := s.tasks[name]; old != nil {
+		old.cancel()
+	}
+	s.tasks[name] = tk
+	s.mu.Unlock()
+
+	go s.run(ctx, tk, first)
+}
+
+// Remove stops running the task called name, if any. A run in
+// progress has its context canceled.
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tk := s.tasks[name]; tk != nil {
+		tk.cancel()
+		delete(s.tasks, name)
+	}
+}
+
+// RunNow runs the task called name as soon as possible, rather than
+// at its next scheduled time. It reports whether there's such a task.
+func (s *Scheduler) RunNow(name string) bool {
+	s.mu.Lock()
+	tk := s.tasks[name]
+	s.mu.Unlock()
+	if tk == nil {
+		return false
+	}
+	select {
+	case tk.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Status returns the status of each task, sorted by name.
+func (s *Scheduler) Status() []TaskStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]TaskStatus, 0, len(s.tasks))
+	for _, tk := range s.tasks {
+		ret = append(ret, tk.st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// run runs tk, first after the delay first, until ctx is done.
+func (s *Scheduler) run(ctx context.Context, tk *task, first time.Duration) {
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		start := time.Now()
+		s.mu.Lock()
+		tk.st.Running = true
+		tk.st.LastStart = start
+		tk.st.NextRun = time.Time{}
+		s.mu.Unlock()
+
+		err := tk.t.Func(ctx)
+
+		s.mu.Lock()
+		tk.st.Running = false
+		tk.st.Runs++
+		tk.st.LastDuration = time.Since(start)
+		if err != nil {
+			tk.st.LastErr = err.Error()
+			tk.st.Failures++
+		} else {
+			tk.st.LastErr = ""
+			tk.st.Failures = 0
+		}
+		d := nextDelay(tk.t, tk.st.Failures)
+		tk.st.NextRun = time.Now().Add(d)
+		s.mu.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			s.logf("[v1] sched: %s failed; next run in %v: %v", tk.name, d.Round(time.Second), err)
+		}
+		timer.Reset(d)
+	}
+}
+
+// nextDelay returns how long to wait before running t again after a
+// run that was its failures'th consecutive failure, or a success if
+// failures is zero.
+func nextDelay(t Task, failures int) time.Duration {
+	if failures == 0 || t.Retry == 0 {
+		return jitter(t.Interval, t.Jitter)
+	}
+	d := t.Retry
+	for i := 1; i < failures && d < t.Interval; i++ {
+		d *= 2
+	}
+	if d > t.Interval {
+		d = t.Interval
+	}
+	return jitter(d, t.Jitter)
+}
+
+// jitter returns d moved randomly earlier or later by up to frac of d.
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 || d <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	max := int64(float64(d) * frac)
+	if max == 0 {
+		return d
+	}
+	return d - time.Duration(max) + time.Duration(rand.Int63n(2*max+1))
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sched
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextDelay(t *testing.T) {
+	tk := Task{Interval: time.Hour, Retry: time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Hour},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := nextDelay(tk, tt.failures); got != tt.want {
+			t.Errorf("nextDelay(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	tk.Retry = 0
+	if got := nextDelay(tk, 3); got != time.Hour {
+		t.Errorf("without Retry, nextDelay(3) = %v; want %v", got, time.Hour)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		got := jitter(time.Hour, 0.1)
+		if got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("jitter(1h, 0.1) = %v; want within 6m of 1h", got)
+		}
+	}
+	if got := jitter(time.Hour, 0); got != time.Hour {
+		t.Errorf("jitter(1h, 0) = %v; want 1h", got)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New(ctx, t.Logf)
+
+	ran := make(chan bool, 10)
+	s.Add("fail", Task{
+		Interval: time.Hour,
+		Delay:    time.Millisecond,
+		Func: func(context.Context) error {
+			ran <- true
+			return errors.New("oops")
+		},
+	})
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task didn't run")
+	}
+
+	var st TaskStatus
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		st = s.Status()[0]
+		if st.Runs == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st.Name != "fail" || st.Runs != 1 || st.Failures != 1 || st.LastErr != "oops" || st.Running {
+		t.Errorf("status = %+v", st)
+	}
+	if d := time.Until(st.NextRun); d < 59*time.Minute {
+		t.Errorf("next run in %v; want about an hour", d)
+	}
+
+	if !s.RunNow("fail") {
+		t.Fatal("RunNow = false")
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task didn't run after RunNow")
+	}
+
+	s.Remove("fail")
+	if s.RunNow("fail") {
+		t.Error("RunNow after Remove = true")
+	}
+	if got := s.Status(); len(got) != 0 {
+		t.Errorf("status after Remove = %+v", got)
+	}
+}
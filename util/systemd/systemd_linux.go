@@ -7,10 +7,13 @@
 package systemd
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mdlayher/sdnotify"
 )
@@ -31,8 +34,9 @@ func (l *logOnce) logf(format string, args ...interface{}) {
 }
 
 var (
-	readyOnce  = &logOnce{}
-	statusOnce = &logOnce{}
+	readyOnce    = &logOnce{}
+	statusOnce   = &logOnce{}
+	watchdogOnce = &logOnce{}
 )
 
 func notifier() *sdnotify.Notifier {
@@ -76,3 +80,48 @@ func Status(format string, args ...interface{}) {
 		statusOnce.logf("systemd: error notifying: %v", err)
 	}
 }
+
+// Watchdog sends keep-alives to systemd's watchdog until ctx is done,
+// if the unit sets WatchdogSec. Before each keep-alive it calls alive,
+// which should exercise the process's main locks; if alive hangs, the
+// keep-alives stop and systemd restarts the process.
+func Watchdog(ctx context.Context, alive func()) {
+	interval, ok := watchdogInterval()
+	if !ok {
+		return
+	}
+	watchdog(ctx, interval/2, alive, func() {
+		if err := notifier().Notify("WATCHDOG=1"); err != nil {
+			watchdogOnce.logf("systemd: error notifying watchdog: %v", err)
+		}
+	})
+}
+
+// watchdog is Watchdog, calling alive and then keepAlive every
+// period.
+func watchdog(ctx context.Context, period time.Duration, alive, keepAlive func()) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		alive()
+		keepAlive()
+	}
+}
+
+// watchdogInterval returns the watchdog timeout systemd expects
+// keep-alives within, if it's watching this process.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package systemd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		wantOK    bool
+	}{
+		{"", "", 0, false},
+		{"bogus", "", 0, false},
+		{"0", "", 0, false},
+		{"30000000", "", 30 * time.Second, true},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second, true},
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0, false}, // another process's watchdog
+	}
+	defer os.Setenv("WATCHDOG_USEC", os.Getenv("WATCHDOG_USEC"))
+	defer os.Setenv("WATCHDOG_PID", os.Getenv("WATCHDOG_PID"))
+	for _, tt := range tests {
+		os.Setenv("WATCHDOG_USEC", tt.usec)
+		os.Setenv("WATCHDOG_PID", tt.pid)
+		got, ok := watchdogInterval()
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, %v; want %v, %v", tt.usec, tt.pid, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestWatchdogStopsWhenAliveHangs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hang := make(chan bool)
+	defer close(hang)
+	keepAlives := make(chan bool, 100)
+	alives := 0
+	go watchdog(ctx, time.Millisecond, func() {
+		alives++
+		if alives == 3 {
+			<-hang // as if the process's main lock were deadlocked
+		}
+	}, func() { keepAlives <- true })
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-keepAlives:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d keep-alives; want 2", i)
+		}
+	}
+	select {
+	case <-keepAlives:
+		t.Fatal("got a keep-alive while alive was hung")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -6,5 +6,8 @@
 
 package systemd
 
-func Ready()                        {}
-func Status(string, ...interface{}) {}
+import "context"
+
+func Ready()                           {}
+func Status(string, ...interface{})    {}
+func Watchdog(context.Context, func()) {}
@@ -0,0 +1,28 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package autoupdate installs a newer Tailscale release over the
+// running one, in whatever way this platform's installs are managed.
+package autoupdate
+
+import (
+	"context"
+	"errors"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/version/updatecheck"
+)
+
+// ErrNotSupported is returned by Update when tailscaled can't update
+// itself on this platform or installation, such as when it's managed
+// by an app store or built from source.
+var ErrNotSupported = errors.New("auto-update not supported on this platform")
+
+// Update installs rel, which must be from a manifest checked by
+// updatecheck. Depending on the platform, tailscaled may be restarted
+// by the installer before or after Update returns, or may need
+// restarting by hand to run the new version, which Update logs.
+func Update(ctx context.Context, logf logger.Logf, rel *updatecheck.Release) error {
+	return update(ctx, logf, rel)
+}
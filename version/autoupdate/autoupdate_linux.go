@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoupdate
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/version/distro"
+	"tailscale.com/version/updatecheck"
+)
+
+func update(ctx context.Context, logf logger.Logf, rel *updatecheck.Release) error {
+	switch distro.Get() {
+	case distro.Synology, distro.OpenWrt, distro.NixOS:
+		// Updated through the distro's own package center or
+		// configuration, not by us.
+		return ErrNotSupported
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Prefer whatever package manager installed us, so that it keeps
+	// track of the files and its repository's signature is checked.
+	switch {
+	case ownedBy("dpkg", "-S", exe):
+		if err := run(ctx, logf, "apt-get", "update", "-q"); err != nil {
+			return err
+		}
+		return run(ctx, logf, "apt-get", "install", "-y", "-q", "--only-upgrade", "tailscale="+rel.Version)
+	case ownedBy("rpm", "-qf", exe):
+		pm := "yum"
+		if _, err := exec.LookPath("dnf"); err == nil {
+			pm = "dnf"
+		}
+		return run(ctx, logf, pm, "install", "-y", "tailscale-"+rel.Version)
+	case ownedBy("pacman", "-Qo", exe), ownedBy("apk", "info", "--who-owns", exe):
+		// Arch doesn't support partial upgrades, and Alpine pins
+		// packages to its release branch; leave it to the system.
+		return ErrNotSupported
+	}
+	return updateTarball(ctx, logf, rel, exe)
+}
+
+// ownedBy reports whether the package manager query command name
+// args succeeds, meaning the file it asks about belongs to a package.
+func ownedBy(name string, args ...string) bool {
+	if _, err := exec.LookPath(name); err != nil {
+		return false
+	}
+	return exec.Command(name, args...).Run() == nil
+}
+
+func run(ctx context.Context, logf logger.Logf, name string, args ...string) error {
+	logf("autoupdate: running %s %s", name, strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v\n%s", name, err, out)
+	}
+	return nil
+}
+
+// updateTarball updates an install from the static tarball: the
+// tailscale and tailscaled binaries next to exe are replaced, and
+// tailscaled runs the new version when next restarted.
+func updateTarball(ctx context.Context, logf logger.Logf, rel *updatecheck.Release, exe string) error {
+	pkg := rel.Package("linux", runtime.GOARCH, "tgz")
+	if pkg == nil {
+		return fmt.Errorf("release %s has no tarball for %s", rel.Version, runtime.GOARCH)
+	}
+	dir := filepath.Dir(exe)
+	tmp, err := ioutil.TempDir("", "tailscale-update")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	tgz := filepath.Join(tmp, path.Base(pkg.URL))
+	if err := updatecheck.Download(ctx, pkg, tgz); err != nil {
+		return err
+	}
+
+	// Extract into dir under temporary names first, so a bad tarball
+	// doesn't leave a half-updated install.
+	newFiles, err := extractBinaries(tgz, dir)
+	for _, f := range newFiles {
+		if err != nil {
+			os.Remove(f + ".new")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(newFiles) == 0 {
+		return fmt.Errorf("%s has none of the installed binaries", pkg.URL)
+	}
+	for _, f := range newFiles {
+		if err := os.Rename(f+".new", f); err != nil {
+			return err
+		}
+	}
+	logf("autoupdate: installed %s in %s; restart tailscaled to run it", rel.Version, dir)
+	return nil
+}
+
+// extractBinaries writes the tailscale and tailscaled binaries in the
+// tarball tgz to dir, as NAME.new, if dir already has them. It returns
+// the paths (without ".new") it wrote.
+func extractBinaries(tgz, dir string) (written []string, err error) {
+	f, err := os.Open(tgz)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		name := path.Base(h.Name)
+		if h.Typeflag != tar.TypeReg || (name != "tailscale" && name != "tailscaled") {
+			continue
+		}
+		dst := filepath.Join(dir, name)
+		if _, err := os.Stat(dst); err != nil {
+			continue
+		}
+		written = append(written, dst)
+		out, err := os.OpenFile(dst+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return written, err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!windows
+
+package autoupdate
+
+import (
+	"context"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/version/updatecheck"
+)
+
+func update(ctx context.Context, logf logger.Logf, rel *updatecheck.Release) error {
+	// macOS and iOS update through the App Store, and the BSDs
+	// through their ports trees.
+	return ErrNotSupported
+}
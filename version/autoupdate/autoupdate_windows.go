@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autoupdate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/types/logger"
+	"tailscale.com/version/updatecheck"
+)
+
+// updateDirSDDL is the security descriptor of the directory the MSI
+// is downloaded to. Only SYSTEM and Administrators have access, so no
+// other user can replace the MSI between its SHA-256 being checked
+// and msiexec installing it as SYSTEM. The DACL is protected from
+// inheriting the parent's ACEs, and is inherited by the files in it.
+const updateDirSDDL = "D:P(A;OICI;GA;;;SY)(A;OICI;GA;;;BA)"
+
+func update(ctx context.Context, logf logger.Logf, rel *updatecheck.Release) error {
+	pkg := rel.Package("windows", runtime.GOARCH, "msi")
+	if pkg == nil {
+		return fmt.Errorf("release %s has no MSI for %s", rel.Version, runtime.GOARCH)
+	}
+	dir, err := makeUpdateDir()
+	if err != nil {
+		return err
+	}
+	msi := filepath.Join(dir, "tailscale-setup-"+rel.Version+"-"+runtime.GOARCH+".msi")
+	if err := updatecheck.Download(ctx, pkg, msi); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// The installer stops this service to replace its files and then
+	// starts the new one, so start it without waiting for it.
+	logf("autoupdate: installing %s", msi)
+	cmd := exec.Command("msiexec.exe", "/i", msi, "/quiet", "/norestart", "/log", msi+".log")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("running msiexec: %w", err)
+	}
+	return cmd.Process.Release()
+}
+
+// makeUpdateDir creates a new, randomly named directory in the
+// service's temp directory with updateDirSDDL's permissions.
+//
+// The directory is always created rather than reused, as one that
+// another user made beforehand would keep that user's permissions.
+// Other users can create entries in the temp directory, but can't
+// delete or rename ours.
+func makeUpdateDir() (string, error) {
+	sd, err := windows.SecurityDescriptorFromString(updateDirSDDL)
+	if err != nil {
+		return "", err
+	}
+	sa := &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(os.TempDir(), "tailscale-update-"+hex.EncodeToString(b[:]))
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return "", err
+	}
+	// CreateDirectory fails if dir already exists.
+	if err := windows.CreateDirectory(p, sa); err != nil {
+		return "", &os.PathError{Op: "CreateDirectory", Path: dir, Err: err}
+	}
+	return dir, nil
+}
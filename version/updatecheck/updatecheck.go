@@ -0,0 +1,235 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package updatecheck checks whether a newer Tailscale release is
+// available, using a signed release manifest.
+//
+// Tailscale doesn't publish such a manifest yet, so by default no
+// manifest URL or signing key is built in and checks are off; see
+// Enabled. Builds that have a manifest and key can set them at link
+// time:
+//
+//	go build -ldflags "-X tailscale.com/version/updatecheck.manifestURL=https://... \
+//	    -X tailscale.com/version/updatecheck.signingKeysHex=<hex ed25519 key>[,<key>...]"
+package updatecheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"tailscale.com/version"
+)
+
+// manifestURL is the URL of the release manifest, or empty if there
+// isn't one. Its signature is at manifestURL + ".sig". It's set at
+// link time; see the package docs.
+var manifestURL string
+
+// signingKeysHex is a comma-separated list of the hex ed25519 public
+// keys that may sign the release manifest. It's set at link time;
+// see the package docs.
+var signingKeysHex string
+
+// ErrNotConfigured is returned by Check when this build has no
+// release manifest URL or signing key.
+var ErrNotConfigured = errors.New("this build has no signed release manifest to check for updates")
+
+// Enabled reports whether this build has a release manifest URL and
+// at least one valid signing key, and so can check for updates.
+func Enabled() bool {
+	return manifestURL != "" && len(signingKeys()) > 0
+}
+
+// signingKeys returns the keys in signingKeysHex, skipping any that
+// don't parse.
+func signingKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, s := range strings.Split(signingKeysHex, ",") {
+		k, err := hex.DecodeString(strings.TrimSpace(s))
+		if err == nil && len(k) == ed25519.PublicKeySize {
+			keys = append(keys, ed25519.PublicKey(k))
+		}
+	}
+	return keys
+}
+
+// maxManifestSize is the most of the manifest or its signature that's
+// read.
+const maxManifestSize = 64 << 10
+
+// Release describes the latest Tailscale release.
+type Release struct {
+	// Version is the release's version, such as "1.6.0".
+	Version string
+
+	// SecurityFix is whether the release, or one since the version
+	// being checked, fixes a security problem.
+	SecurityFix bool `json:",omitempty"`
+
+	// ChangelogURL is where the release's changes are described.
+	ChangelogURL string `json:",omitempty"`
+
+	// Packages are the release's downloads, for auto-updating.
+	Packages []Package `json:",omitempty"`
+}
+
+// Package is a downloadable build of a release.
+type Package struct {
+	OS     string // GOOS, such as "windows"
+	Arch   string // GOARCH, such as "amd64"
+	Format string // "msi" or "tgz"
+	URL    string
+
+	// SHA256 is the hex SHA-256 of the file at URL. As it's part of
+	// the signed manifest, checking it verifies the download.
+	SHA256 string
+}
+
+// Package returns r's package for the given OS, architecture and
+// format, or nil if there isn't one.
+func (r *Release) Package(goos, goarch, format string) *Package {
+	for i := range r.Packages {
+		p := &r.Packages[i]
+		if p.OS == goos && p.Arch == goarch && p.Format == format {
+			return p
+		}
+	}
+	return nil
+}
+
+// Result is the result of a check.
+type Result struct {
+	Current         string  // version.Short of this binary
+	Latest          Release // the latest release
+	UpdateAvailable bool    // Latest is newer than Current
+}
+
+// Check fetches the release manifest and reports whether it's newer
+// than this binary. It returns ErrNotConfigured if !Enabled().
+func Check(ctx context.Context) (*Result, error) {
+	if !Enabled() {
+		return nil, ErrNotConfigured
+	}
+	manifest, err := fetch(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetch(ctx, manifestURL+".sig")
+	if err != nil {
+		return nil, err
+	}
+	rel, err := ParseRelease(manifest, sig, signingKeys())
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Current:         version.Short,
+		Latest:          *rel,
+		UpdateAvailable: newer(rel.Version, version.Short),
+	}, nil
+}
+
+// newer reports whether version latest is known to be newer than cur.
+// Versions that can't be compared, such as those of OSS builds
+// ("date.YYYYMMDD"), are never newer.
+func newer(latest, cur string) bool {
+	return version.AtLeast(latest, cur) && !version.AtLeast(cur, latest)
+}
+
+// ParseRelease parses a release manifest after checking that sig, a
+// base64 ed25519 signature of it, is by one of keys.
+func ParseRelease(manifest, sig []byte, keys []ed25519.PublicKey) (*Release, error) {
+	rawSig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest signature: %w", err)
+	}
+	verified := false
+	for _, k := range keys {
+		if ed25519.Verify(k, manifest, rawSig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("release manifest signature doesn't verify")
+	}
+	rel := new(Release)
+	if err := json.Unmarshal(manifest, rel); err != nil {
+		return nil, fmt.Errorf("parsing release manifest: %w", err)
+	}
+	if rel.Version == "" {
+		return nil, errors.New("release manifest has no version")
+	}
+	return rel, nil
+}
+
+// maxPackageSize is the most of a package that Download reads.
+const maxPackageSize = 256 << 20
+
+// Download fetches pkg to the file dst, removing it again unless its
+// SHA-256 matches the one in the manifest.
+func Download(ctx context.Context, pkg *Package, dst string) (err error) {
+	want, err := hex.DecodeString(pkg.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("bad SHA-256 %q for %s", pkg.SHA256, pkg.URL)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", pkg.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("fetching %s: %s", pkg.URL, res.Status)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(dst)
+		}
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(res.Body, maxPackageSize)); err != nil {
+		return fmt.Errorf("fetching %s: %w", pkg.URL, err)
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("%s doesn't match the release manifest's SHA-256", pkg.URL)
+	}
+	return f.Close()
+}
+
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %s", url, res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package updatecheck
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := []byte(`{"Version": "1.6.0", "SecurityFix": true, "ChangelogURL": "https://tailscale.com/changelog/"}`)
+	sign := func(priv ed25519.PrivateKey, b []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, b)) + "\n")
+	}
+
+	rel, err := ParseRelease(manifest, sign(priv, manifest), []ed25519.PublicKey{otherPub, pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != "1.6.0" || !rel.SecurityFix || rel.ChangelogURL != "https://tailscale.com/changelog/" {
+		t.Errorf("got %+v", rel)
+	}
+
+	if _, err := ParseRelease(manifest, sign(otherPriv, manifest), []ed25519.PublicKey{pub}); err == nil {
+		t.Error("wrong key verified")
+	}
+	tampered := []byte(`{"Version": "9.9.9"}`)
+	if _, err := ParseRelease(tampered, sign(priv, manifest), []ed25519.PublicKey{pub}); err == nil {
+		t.Error("tampered manifest verified")
+	}
+	noVersion := []byte(`{}`)
+	if _, err := ParseRelease(noVersion, sign(priv, noVersion), []ed25519.PublicKey{pub}); err == nil {
+		t.Error("manifest without version accepted")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	const body = "not really an msi"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	sum := sha256.Sum256([]byte(body))
+	dir := t.TempDir()
+
+	dst := filepath.Join(dir, "good.msi")
+	pkg := &Package{URL: ts.URL, SHA256: hex.EncodeToString(sum[:])}
+	if err := Download(context.Background(), pkg, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != body {
+		t.Errorf("downloaded %q, %v; want %q", got, err, body)
+	}
+
+	dst = filepath.Join(dir, "bad.msi")
+	sum[0]++
+	pkg.SHA256 = hex.EncodeToString(sum[:])
+	if err := Download(context.Background(), pkg, dst); err == nil {
+		t.Error("download with wrong SHA-256 succeeded")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("bad download left behind: %v", err)
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		latest, cur string
+		want        bool
+	}{
+		{"1.6.0", "1.4.4", true},
+		{"1.6.0", "1.6.0", false},
+		{"1.6.0", "1.6.0-t1234abcd-g5678", false},
+		{"1.6.1", "1.6.0-t1234abcd-g5678", true},
+		{"1.4.4", "1.6.0", false},
+		{"1.6.0", "date.20210303", false},
+	}
+	for _, tt := range tests {
+		if got := newer(tt.latest, tt.cur); got != tt.want {
+			t.Errorf("newer(%q, %q) = %v; want %v", tt.latest, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer func(u, k string) { manifestURL, signingKeysHex = u, k }(manifestURL, signingKeysHex)
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := hex.EncodeToString(pub)
+	tests := []struct {
+		url, keys string
+		want      bool
+	}{
+		{"", "", false},
+		{"https://example.com/release.json", "", false},
+		{"https://example.com/release.json", "not-hex", false},
+		{"", key, false},
+		{"https://example.com/release.json", key, true},
+		{"https://example.com/release.json", "bad, " + key, true},
+	}
+	for _, tt := range tests {
+		manifestURL, signingKeysHex = tt.url, tt.keys
+		if got := Enabled(); got != tt.want {
+			t.Errorf("Enabled with url %q, keys %q = %v; want %v", tt.url, tt.keys, got, tt.want)
+		}
+	}
+
+	manifestURL, signingKeysHex = "", ""
+	if _, err := Check(context.Background()); err != ErrNotConfigured {
+		t.Errorf("Check = %v; want ErrNotConfigured", err)
+	}
+}
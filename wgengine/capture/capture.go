@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capture writes copies of packets passing through the TUN
+// device in pcap format, for debugging.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/net/packet"
+)
+
+// Direction is the direction a captured packet was going.
+type Direction uint8
+
+const (
+	// FromLocal is a packet read from the TUN device, on its way
+	// from the local OS to a peer.
+	FromLocal Direction = iota
+	// FromPeer is a packet from a peer, on its way to be written to
+	// the TUN device.
+	FromPeer
+)
+
+func (d Direction) String() string {
+	if d == FromPeer {
+		return "FromPeer"
+	}
+	return "FromLocal"
+}
+
+// Callback is called with each packet passing through the TUN device
+// while a capture is running. It must not retain pkt or block.
+type Callback func(dir Direction, pkt []byte)
+
+// The pcap file format; see
+// https://wiki.wireshark.org/Development/LibpcapFileFormat.
+//
+// Packets are written with Linux "cooked" (SLL) link-layer headers
+// rather than as raw IP, because those say which way the packet went.
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapSnapLen      = 65535
+	linkTypeLinuxSLL = 113
+
+	sllHeaderLen    = 16
+	sllHost         = 0 // packet type: to us
+	sllOutgoing     = 4 // packet type: from us
+	arphrdNone      = 0xfffe
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86dd
+	recordHeaderLen = 16
+)
+
+// sinkQueueLen is how many packets a Sink buffers before dropping
+// them, if its writer can't keep up.
+const sinkQueueLen = 512
+
+var parsedPool = sync.Pool{New: func() interface{} { return new(packet.Parsed) }}
+
+// A Sink writes the packets given to LogPacket to an io.Writer as a
+// pcap stream. Writing happens on its own goroutine, so a slow writer
+// doesn't slow down the data path; packets are dropped instead.
+type Sink struct {
+	dropped uint64 // atomic; packets dropped due to a full ch; first for alignment
+
+	w      io.Writer
+	filter *Filter // or nil to capture everything
+
+	ch     chan []byte   // pcap records to write
+	closed chan struct{} // closed by Close
+	done   chan struct{} // closed when run returns
+	err    error         // set before done is closed
+
+	closeOnce sync.Once
+}
+
+// NewSink returns a Sink that writes the packets matching f, which
+// may be nil to match all packets, to w. If w has a Flush method, it's
+// called whenever the Sink has caught up, as for streaming over HTTP.
+//
+// The caller must call Close when done with the Sink.
+func NewSink(w io.Writer, f *Filter) *Sink {
+	s := &Sink{
+		w:      w,
+		filter: f,
+		ch:     make(chan []byte, sinkQueueLen),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	flusher, _ := s.w.(interface{ Flush() })
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeLinuxSLL)
+	if _, s.err = s.w.Write(hdr[:]); s.err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case rec := <-s.ch:
+			if _, s.err = s.w.Write(rec); s.err != nil {
+				return
+			}
+			if flusher != nil && len(s.ch) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// LogPacket queues pkt to be written, if it matches the Sink's
+// filter. It doesn't retain pkt.
+func (s *Sink) LogPacket(dir Direction, pkt []byte) {
+	if len(pkt) == 0 {
+		return
+	}
+	if s.filter != nil {
+		p := parsedPool.Get().(*packet.Parsed)
+		p.Decode(pkt)
+		ok := s.filter.Match(dir, p)
+		parsedPool.Put(p)
+		if !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	n := len(pkt)
+	if n > pcapSnapLen-sllHeaderLen {
+		n = pcapSnapLen - sllHeaderLen
+	}
+	rec := make([]byte, recordHeaderLen+sllHeaderLen+n)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(sllHeaderLen+n))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(sllHeaderLen+len(pkt)))
+
+	sll := rec[recordHeaderLen:]
+	pktType := uint16(sllOutgoing)
+	if dir == FromPeer {
+		pktType = sllHost
+	}
+	binary.BigEndian.PutUint16(sll[0:], pktType)
+	binary.BigEndian.PutUint16(sll[2:], arphrdNone)
+	// Link-layer address length and address are left zero.
+	etherType := uint16(etherTypeIPv4)
+	if pkt[0]>>4 == 6 {
+		etherType = etherTypeIPv6
+	}
+	binary.BigEndian.PutUint16(sll[14:], etherType)
+	copy(rec[recordHeaderLen+sllHeaderLen:], pkt[:n])
+
+	select {
+	case s.ch <- rec:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Done returns a channel that's closed when the Sink stops writing,
+// either because it was closed or because writing failed.
+func (s *Sink) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that stopped the Sink's writing, if any. It's
+// only valid after Done is closed.
+func (s *Sink) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Dropped returns the number of packets dropped because the writer
+// couldn't keep up.
+func (s *Sink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the Sink and waits for it to stop writing. Packets
+// still queued are discarded.
+func (s *Sink) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	<-s.done
+	return nil
+}
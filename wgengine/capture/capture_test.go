@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+func TestFilter(t *testing.T) {
+	tcp := &packet.Parsed{
+		IPVersion: 4,
+		IPProto:   packet.TCP,
+		Src:       netaddr.MustParseIPPort("100.101.102.103:41641"),
+		Dst:       netaddr.MustParseIPPort("100.64.0.1:22"),
+	}
+	udp6 := &packet.Parsed{
+		IPVersion: 6,
+		IPProto:   packet.UDP,
+		Src:       netaddr.MustParseIPPort("[fd7a:115c:a1e0::1]:53"),
+		Dst:       netaddr.MustParseIPPort("[fd7a:115c:a1e0::2]:5353"),
+	}
+	tests := []struct {
+		expr string
+		p    *packet.Parsed
+		dir  Direction
+		want bool
+	}{
+		{"", tcp, FromLocal, true},
+		{"tcp", tcp, FromLocal, true},
+		{"udp", tcp, FromLocal, false},
+		{"ip6 and udp", udp6, FromLocal, true},
+		{"port 22", tcp, FromLocal, true},
+		{"src port 22", tcp, FromLocal, false},
+		{"dst port 22", tcp, FromLocal, true},
+		{"host 100.64.0.1", tcp, FromLocal, true},
+		{"src host 100.64.0.1", tcp, FromLocal, false},
+		{"net 100.64.0.0/10", tcp, FromLocal, true},
+		{"net 100.64.0.0/10", udp6, FromLocal, false},
+		{"not tcp", tcp, FromLocal, false},
+		{"!tcp", udp6, FromLocal, true},
+		{"inbound", tcp, FromPeer, true},
+		{"outbound", tcp, FromPeer, false},
+		{"udp or (tcp and port 22)", tcp, FromLocal, true},
+		{"udp || (tcp && port 80)", tcp, FromLocal, false},
+		{"udp or tcp and port 80", udp6, FromLocal, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(tt.dir, tt.p); got != tt.want {
+			t.Errorf("%q matching %v: got %v; want %v", tt.expr, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"host",
+		"host example.com",
+		"port 70000",
+		"net 1.2.3.4",
+		"frobnicate",
+		"tcp udp",
+	} {
+		if f, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) = %q; want error", expr, f)
+		}
+	}
+}
+
+func TestSink(t *testing.T) {
+	pr, pw := io.Pipe()
+	f, err := ParseFilter("ip6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSink(pw, f)
+	defer s.Close()
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(pr, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(hdr[0:]); got != pcapMagic {
+		t.Errorf("magic = %#x", got)
+	}
+	if got := binary.LittleEndian.Uint32(hdr[20:]); got != linkTypeLinuxSLL {
+		t.Errorf("link type = %v", got)
+	}
+
+	ip4 := make([]byte, 20)
+	ip4[0] = 0x45
+	ip6 := make([]byte, 40)
+	ip6[0] = 0x60
+	s.LogPacket(FromLocal, ip4) // filtered out
+	s.LogPacket(FromPeer, ip6)
+
+	rec := make([]byte, recordHeaderLen+sllHeaderLen+len(ip6))
+	if _, err := io.ReadFull(pr, rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(rec[8:]); got != uint32(sllHeaderLen+len(ip6)) {
+		t.Errorf("captured length = %v", got)
+	}
+	sll := rec[recordHeaderLen:]
+	if got := binary.BigEndian.Uint16(sll[0:]); got != sllHost {
+		t.Errorf("packet type = %v; want %v", got, sllHost)
+	}
+	if got := binary.BigEndian.Uint16(sll[14:]); got != etherTypeIPv6 {
+		t.Errorf("protocol = %#x; want %#x", got, etherTypeIPv6)
+	}
+	if rec[recordHeaderLen+sllHeaderLen] != 0x60 {
+		t.Errorf("packet not copied")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// A Filter selects which packets to capture. It's parsed from a
+// subset of the tcpdump (pcap-filter) expression syntax:
+//
+//	[src|dst] host ADDR
+//	[src|dst] net CIDR
+//	[src|dst] port N       (TCP and UDP only)
+//	ip | ip6 | tcp | udp | icmp | icmp6
+//	inbound | outbound     (from a peer, or from the local OS)
+//
+// combined with "and" (or "&&"), "or" ("||"), "not" ("!") and
+// parentheses. Without "src" or "dst", host, net and port match
+// either. Unlike tcpdump, "and" is never implied.
+type Filter struct {
+	expr  string
+	match matcher
+}
+
+type matcher func(dir Direction, p *packet.Parsed) bool
+
+// ParseFilter parses the filter expression expr. An empty expr
+// returns a nil Filter, which matches every packet.
+func ParseFilter(expr string) (*Filter, error) {
+	toks := tokenize(expr)
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	ps := &filterParser{toks: toks}
+	m, err := ps.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter: %v", err)
+	}
+	if tok := ps.peek(); tok != "" {
+		return nil, fmt.Errorf("invalid capture filter: unexpected %q", tok)
+	}
+	return &Filter{expr: strings.Join(toks, " "), match: m}, nil
+}
+
+// String returns the filter's expression.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Match reports whether the packet p, going in direction dir, matches
+// the filter. A nil Filter matches everything.
+func (f *Filter) Match(dir Direction, p *packet.Parsed) bool {
+	if f == nil {
+		return true
+	}
+	return f.match(dir, p)
+}
+
+// tokenize splits expr into words, with parentheses and "!" as
+// tokens of their own.
+func tokenize(expr string) []string {
+	var toks []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			toks = append(toks, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			toks = append(toks, string(r))
+		case r == '!' && word.Len() == 0:
+			toks = append(toks, "!")
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return toks
+}
+
+type filterParser struct {
+	toks []string
+}
+
+func (ps *filterParser) peek() string {
+	if len(ps.toks) == 0 {
+		return ""
+	}
+	return ps.toks[0]
+}
+
+func (ps *filterParser) next() string {
+	tok := ps.peek()
+	if tok != "" {
+		ps.toks = ps.toks[1:]
+	}
+	return tok
+}
+
+func (ps *filterParser) parseOr() (matcher, error) {
+	m, err := ps.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for ps.peek() == "or" || ps.peek() == "||" {
+		ps.next()
+		m2, err := ps.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		m1 := m
+		m = func(dir Direction, p *packet.Parsed) bool { return m1(dir, p) || m2(dir, p) }
+	}
+	return m, nil
+}
+
+func (ps *filterParser) parseAnd() (matcher, error) {
+	m, err := ps.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for ps.peek() == "and" || ps.peek() == "&&" {
+		ps.next()
+		m2, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		m1 := m
+		m = func(dir Direction, p *packet.Parsed) bool { return m1(dir, p) && m2(dir, p) }
+	}
+	return m, nil
+}
+
+func (ps *filterParser) parseUnary() (matcher, error) {
+	switch tok := ps.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "not", "!":
+		m, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(dir Direction, p *packet.Parsed) bool { return !m(dir, p) }, nil
+	case "(":
+		m, err := ps.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if ps.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	default:
+		return ps.parsePrimitive(tok)
+	}
+}
+
+// Which addresses or ports a primitive matches.
+const (
+	srcOrDst = iota
+	srcOnly
+	dstOnly
+)
+
+func (ps *filterParser) parsePrimitive(tok string) (matcher, error) {
+	switch tok {
+	case "ip":
+		return func(_ Direction, p *packet.Parsed) bool { return p.IPVersion == 4 }, nil
+	case "ip6":
+		return func(_ Direction, p *packet.Parsed) bool { return p.IPVersion == 6 }, nil
+	case "tcp":
+		return protoMatcher(packet.TCP), nil
+	case "udp":
+		return protoMatcher(packet.UDP), nil
+	case "icmp":
+		return protoMatcher(packet.ICMPv4), nil
+	case "icmp6":
+		return protoMatcher(packet.ICMPv6), nil
+	case "inbound":
+		return func(dir Direction, _ *packet.Parsed) bool { return dir == FromPeer }, nil
+	case "outbound":
+		return func(dir Direction, _ *packet.Parsed) bool { return dir == FromLocal }, nil
+	}
+
+	which := srcOrDst
+	switch tok {
+	case "src":
+		which = srcOnly
+		tok = ps.next()
+	case "dst":
+		which = dstOnly
+		tok = ps.next()
+	}
+	arg := ps.next()
+	if arg == "" {
+		return nil, fmt.Errorf("%q needs an argument", tok)
+	}
+	switch tok {
+	case "host":
+		ip, err := netaddr.ParseIP(arg)
+		if err != nil {
+			return nil, err
+		}
+		return addrMatcher(which, func(a netaddr.IP) bool { return a == ip }), nil
+	case "net":
+		pfx, err := netaddr.ParseIPPrefix(arg)
+		if err != nil {
+			return nil, err
+		}
+		return addrMatcher(which, pfx.Contains), nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return portMatcher(which, uint16(port)), nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+func protoMatcher(proto packet.IPProto) matcher {
+	return func(_ Direction, p *packet.Parsed) bool {
+		return p.IPVersion != 0 && p.IPProto == proto
+	}
+}
+
+func addrMatcher(which int, match func(netaddr.IP) bool) matcher {
+	return func(_ Direction, p *packet.Parsed) bool {
+		if p.IPVersion == 0 {
+			return false
+		}
+		return which != dstOnly && match(p.Src.IP) ||
+			which != srcOnly && match(p.Dst.IP)
+	}
+}
+
+func portMatcher(which int, port uint16) matcher {
+	return func(_ Direction, p *packet.Parsed) bool {
+		if p.IPProto != packet.TCP && p.IPProto != packet.UDP {
+			return false
+		}
+		return which != dstOnly && p.Src.Port == port ||
+			which != srcOnly && p.Dst.Port == port
+	}
+}
@@ -36,11 +36,17 @@ type Filter struct {
 	// match is to drop the packet.
 	matches4 matches
 	matches6 matches
+	// rules4 and rules6 are the indexes in stats.rules of each of
+	// matches4 and matches6.
+	rules4, rules6 []int
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
 	// incoming packets don't get accepted by matches above.
 	state *filterState
+	// stats counts the packets each rule accepted, and the packets
+	// dropped for each reason.
+	stats *filterStats
 
 	shieldsUp bool
 }
@@ -166,21 +172,21 @@ func New(matches []Match, localNets *netaddr.IPSet, logIPs *netaddr.IPSet, share
 		}
 	}
 	f := &Filter{
-		logf:     logf,
-		matches4: matchesFamily(matches, netaddr.IP.Is4),
-		matches6: matchesFamily(matches, netaddr.IP.Is6),
-		local:    localNets,
-		logIPs:   logIPs,
-		state:    state,
+		logf:   logf,
+		local:  localNets,
+		logIPs: logIPs,
+		state:  state,
+		stats:  newFilterStats(matches),
 	}
+	f.matches4, f.rules4 = matchesFamily(matches, netaddr.IP.Is4)
+	f.matches6, f.rules6 = matchesFamily(matches, netaddr.IP.Is6)
 	return f
 }
 
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
-// and keep(dstNet.IP) are both true.
-func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
-	var ret matches
-	for _, m := range ms {
+// and keep(dstNet.IP) are both true, and the index in ms of each.
+func matchesFamily(ms matches, keep func(netaddr.IP) bool) (ret matches, idx []int) {
+	for i, m := range ms {
 		var retm Match
 		for _, src := range m.Srcs {
 			if keep(src.IP) {
@@ -192,11 +198,13 @@ func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
 				retm.Dsts = append(retm.Dsts, dst)
 			}
 		}
+		retm.IPProto = m.IPProto
 		if len(retm.Srcs) > 0 && len(retm.Dsts) > 0 {
 			ret = append(ret, retm)
+			idx = append(idx, i)
 		}
 	}
-	return ret
+	return ret, idx
 }
 
 func maybeHexdump(flag RunFlags, b []byte) string {
@@ -214,6 +222,15 @@ func maybeHexdump(flag RunFlags, b []byte) string {
 var acceptBucket = rate.NewLimiter(rate.Every(10*time.Second), 3)
 var dropBucket = rate.NewLimiter(rate.Every(5*time.Second), 10)
 
+// noteVerdict counts the verdict r on q, if it's a drop, and logs it,
+// rate limited, according to runflags.
+func (f *Filter) noteVerdict(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
+	if r == Drop {
+		f.stats.noteDrop(dir, why)
+	}
+	f.logRateLimit(runflags, q, dir, r, why)
+}
+
 func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
 	if !f.loggingAllowed(q) {
 		return
@@ -297,7 +314,7 @@ func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
 	default:
 		r, why = Drop, "not-ip"
 	}
-	f.logRateLimit(rf, q, dir, r, why)
+	f.noteVerdict(rf, q, dir, r, why)
 	return r
 }
 
@@ -311,7 +328,7 @@ func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
 		return r
 	}
 	r, why := f.runOut(q)
-	f.logRateLimit(rf, q, dir, r, why)
+	f.noteVerdict(rf, q, dir, r, why)
 	return r
 }
 
@@ -332,8 +349,9 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
 			return Accept, "icmp response ok"
-		} else if f.matches4.matchIPsOnly(q) {
+		} else if i := f.matches4.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
+			f.stats.noteRuleAccept(f.rules4[i])
 			return Accept, "icmp ok"
 		}
 	case packet.TCP:
@@ -348,7 +366,8 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 		if !q.IsTCPSyn() {
 			return Accept, "tcp non-syn"
 		}
-		if f.matches4.match(q) {
+		if i := f.matches4.match(q); i >= 0 {
+			f.stats.noteRuleAccept(f.rules4[i])
 			return Accept, "tcp ok"
 		}
 	case packet.UDP:
@@ -361,13 +380,16 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 		if ok {
 			return Accept, "udp cached"
 		}
-		if f.matches4.match(q) {
+		if i := f.matches4.match(q); i >= 0 {
+			f.stats.noteRuleAccept(f.rules4[i])
 			return Accept, "udp ok"
 		}
 	case packet.TSMP:
 		return Accept, "tsmp ok"
-	default:
+	case packet.IGMP:
 		return Drop, "Unknown proto"
+	default:
+		return f.runInOther(q, f.matches4, f.rules4)
 	}
 	return Drop, "no rules matched"
 }
@@ -389,8 +411,9 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
 			return Accept, "icmp response ok"
-		} else if f.matches6.matchIPsOnly(q) {
+		} else if i := f.matches6.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
+			f.stats.noteRuleAccept(f.rules6[i])
 			return Accept, "icmp ok"
 		}
 	case packet.TCP:
@@ -405,7 +428,8 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		if q.IPProto == packet.TCP && !q.IsTCPSyn() {
 			return Accept, "tcp non-syn"
 		}
-		if f.matches6.match(q) {
+		if i := f.matches6.match(q); i >= 0 {
+			f.stats.noteRuleAccept(f.rules6[i])
 			return Accept, "tcp ok"
 		}
 	case packet.UDP:
@@ -418,18 +442,41 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		if ok {
 			return Accept, "udp cached"
 		}
-		if f.matches6.match(q) {
+		if i := f.matches6.match(q); i >= 0 {
+			f.stats.noteRuleAccept(f.rules6[i])
 			return Accept, "udp ok"
 		}
 	default:
-		return Drop, "Unknown proto"
+		return f.runInOther(q, f.matches6, f.rules6)
+	}
+	return Drop, "no rules matched"
+}
+
+// runInOther runs the input filter for protocols that have no ports
+// and aren't handled specially, such as encapsulations like 6in4 and
+// GRE. They're allowed only by rules that name them, or as replies
+// to flows that went out. Having no ports, flows are tracked by
+// address pair alone.
+func (f *Filter) runInOther(q *packet.Parsed, ms matches, rules []int) (r Response, why string) {
+	t := flowtrack.Tuple{Src: q.Src, Dst: q.Dst}
+
+	f.state.mu.Lock()
+	_, ok := f.state.lru.Get(t)
+	f.state.mu.Unlock()
+
+	if ok {
+		return Accept, "proto cached"
+	}
+	if i := ms.matchIPsOnly(q); i >= 0 {
+		f.stats.noteRuleAccept(rules[i])
+		return Accept, "proto ok"
 	}
 	return Drop, "no rules matched"
 }
 
 // runIn runs the output-specific part of the filter logic.
 func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
-	if q.IPProto != packet.UDP {
+	if !tracksFlows(q.IPProto) {
 		return Accept, "ok out"
 	}
 
@@ -441,6 +488,17 @@ func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
 	return Accept, "ok out"
 }
 
+// tracksFlows reports whether the filter remembers outgoing packets
+// of protocol p, to let replies to them in: UDP, and protocols that
+// runInOther handles.
+func tracksFlows(p packet.IPProto) bool {
+	switch p {
+	case packet.TCP, packet.ICMPv4, packet.ICMPv6, packet.IGMP, packet.TSMP, packet.Unknown, packet.Fragment:
+		return false
+	}
+	return true
+}
+
 // direction is whether a packet was flowing in to this machine, or
 // flowing out.
 type direction int
@@ -471,28 +529,28 @@ func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
 		return Accept
 	}
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
+		f.noteVerdict(rf, q, dir, Drop, "too short")
 		return Drop
 	}
 
 	if q.Dst.IP.IsMulticast() {
-		f.logRateLimit(rf, q, dir, Drop, "multicast")
+		f.noteVerdict(rf, q, dir, Drop, "multicast")
 		return Drop
 	}
 	if q.Dst.IP.IsLinkLocalUnicast() && q.Dst.IP != gcpDNSAddr {
-		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
+		f.noteVerdict(rf, q, dir, Drop, "link-local-unicast")
 		return Drop
 	}
 
 	switch q.IPProto {
 	case packet.Unknown:
 		// Unknown packets are dangerous; always drop them.
-		f.logRateLimit(rf, q, dir, Drop, "unknown")
+		f.noteVerdict(rf, q, dir, Drop, "unknown")
 		return Drop
 	case packet.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
+		f.noteVerdict(rf, q, dir, Accept, "fragment")
 		return Accept
 	}
 
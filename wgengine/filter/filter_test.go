@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -16,6 +17,8 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
 )
 
@@ -156,6 +159,59 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestOtherProtos(t *testing.T) {
+	ms, err := MatchesFromFilterRules([]tailcfg.FilterRule{
+		{
+			SrcIPs:   []string{"8.1.1.1"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "1.2.3.0/24", Ports: tailcfg.PortRange{First: 0, Last: 65535}}},
+			IPProto:  []int{int(packet.IPv6Encap), int(packet.GRE)},
+		},
+		{
+			SrcIPs:   []string{"8.2.2.2"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "1.2.3.4", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var localNets netaddr.IPSetBuilder
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("1.2.3.0/24"))
+	acl := New(ms, localNets.IPSet(), localNets.IPSet(), nil, t.Logf)
+
+	tests := []struct {
+		want Response
+		p    packet.Parsed
+	}{
+		{Accept, parsed(packet.IPv6Encap, "8.1.1.1", "1.2.3.4", 0, 0)},
+		{Accept, parsed(packet.GRE, "8.1.1.1", "1.2.3.9", 0, 0)},
+		{Drop, parsed(packet.ESP, "8.1.1.1", "1.2.3.4", 0, 0)},
+		{Drop, parsed(packet.GRE, "8.2.2.2", "1.2.3.4", 0, 0)},
+		// The first rule names protocols, so the defaults don't apply.
+		{Drop, parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 0, 22)},
+		{Drop, parsed(packet.ICMPv4, "8.1.1.1", "1.2.3.4", 0, 0)},
+		{Accept, parsed(packet.TCP, "8.2.2.2", "1.2.3.4", 0, 22)},
+		{Accept, parsed(packet.ICMPv4, "8.2.2.2", "1.2.3.4", 0, 0)},
+	}
+	for i, tt := range tests {
+		if got, why := acl.runIn4(&tt.p); got != tt.want {
+			t.Errorf("#%d got=%v want=%v why=%q packet:%v", i, got, tt.want, why, tt.p)
+		}
+	}
+
+	// Replies to tunnels that go out are allowed back in.
+	in := parsed(packet.ESP, "8.3.3.3", "1.2.3.4", 0, 0)
+	out := parsed(packet.ESP, "1.2.3.4", "8.3.3.3", 0, 0)
+	if got := acl.RunIn(&in, 0); got != Drop {
+		t.Fatalf("unsolicited ESP got %v; want Drop", got)
+	}
+	if got := acl.RunOut(&out, 0); got != Accept {
+		t.Fatalf("outbound ESP got %v; want Accept", got)
+	}
+	if got := acl.RunIn(&in, 0); got != Accept {
+		t.Fatalf("ESP reply got %v; want Accept", got)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -201,6 +257,95 @@ func TestNoAllocs(t *testing.T) {
 	}
 }
 
+// TestFlowAllocs enforces that outbound UDP only allocates for a flow's
+// first packet (a new lru cache entry), not for the packets after it.
+func TestFlowAllocs(t *testing.T) {
+	acl := newFilter(t.Logf)
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"udp4", raw4(packet.UDP, "1.2.3.4", "8.1.1.1", 22, 999, 0)},
+		{"udp6", raw6(packet.UDP, "2001::2", "2001::1", 22, 999, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &packet.Parsed{}
+			q.Decode(tt.packet)
+			acl.RunOut(q, 0) // record the flow
+
+			err := tstest.MinAllocsPerRun(t, 0, func() {
+				q.Decode(tt.packet)
+				acl.RunOut(q, 0)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	acl := newFilter(t.Logf)
+	for _, p := range []packet.Parsed{
+		parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 999, 22),    // rule 0
+		parsed(packet.UDP, "8.2.2.2", "5.6.7.8", 999, 23),    // rule 0
+		parsed(packet.TCP, "::1", "2001::1", 999, 22),        // rule 6
+		parsed(packet.TCP, "8.3.3.3", "1.2.3.4", 999, 22),    // no rules matched
+		parsed(packet.TCP, "8.1.1.1", "16.32.48.64", 0, 443), // destination not allowed
+	} {
+		p := p
+		acl.RunIn(&p, 0)
+	}
+
+	st := acl.Stats()
+	if len(st.Rules) != 8 {
+		t.Fatalf("got %d rules; want 8", len(st.Rules))
+	}
+	wantAccepts := []uint64{2, 0, 0, 0, 0, 0, 1, 0}
+	for i, rs := range st.Rules {
+		if rs.Accepts != wantAccepts[i] {
+			t.Errorf("rule %d (%s): %d accepts; want %d", i, rs.Rule, rs.Accepts, wantAccepts[i])
+		}
+	}
+	wantDrops := []DropStats{
+		{Direction: "in", Reason: "destination not allowed", Count: 1},
+		{Direction: "in", Reason: "no rules matched", Count: 1},
+	}
+	if diff := cmp.Diff(st.Drops, wantDrops); diff != "" {
+		t.Errorf("wrong drops (-got+want)\n%s", diff)
+	}
+}
+
+func TestDropStatsConcurrent(t *testing.T) {
+	acl := newFilter(t.Logf)
+	const goroutines, perG = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perG; j++ {
+				p := parsed(packet.TCP, "8.3.3.3", "1.2.3.4", 999, 22)
+				acl.RunIn(&p, 0)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := []DropStats{{Direction: "in", Reason: "no rules matched", Count: goroutines * perG}}
+	if diff := cmp.Diff(acl.Stats().Drops, want); diff != "" {
+		t.Errorf("wrong drops (-got+want)\n%s", diff)
+	}
+
+	// Counting a drop for a reason already seen doesn't allocate.
+	p := parsed(packet.TCP, "8.3.3.3", "1.2.3.4", 999, 22)
+	if err := tstest.MinAllocsPerRun(t, 0, func() { acl.RunIn(&p, 0) }); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestParseIPSet(t *testing.T) {
 	tests := []struct {
 		host    string
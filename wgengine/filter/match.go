@@ -45,10 +45,36 @@ func (npr NetPortRange) String() string {
 }
 
 // Match matches packets from any IP address in Srcs to any ip:port in
-// Dsts.
+// Dsts, of the IP protocols in IPProto.
 type Match struct {
 	Dsts []NetPortRange
 	Srcs []netaddr.IPPrefix
+
+	// IPProto are the protocols to match. If empty, it means
+	// defaultProtos. Ports only apply to protocols with ports.
+	IPProto []packet.IPProto
+}
+
+// defaultProtos are the protocols a Match with no IPProto matches.
+var defaultProtos = []packet.IPProto{
+	packet.TCP,
+	packet.UDP,
+	packet.ICMPv4,
+	packet.ICMPv6,
+}
+
+// protoAllowed reports whether m matches packets of protocol p.
+func (m Match) protoAllowed(p packet.IPProto) bool {
+	protos := m.IPProto
+	if len(protos) == 0 {
+		protos = defaultProtos
+	}
+	for _, mp := range protos {
+		if mp == p {
+			return true
+		}
+	}
+	return false
 }
 
 func (m Match) String() string {
@@ -72,14 +98,23 @@ func (m Match) String() string {
 	} else {
 		ds = "[" + strings.Join(dsts, ",") + "]"
 	}
+	if len(m.IPProto) > 0 {
+		protos := make([]string, len(m.IPProto))
+		for i, p := range m.IPProto {
+			protos[i] = p.String()
+		}
+		return fmt.Sprintf("%v=>%v/%v", ss, ds, strings.Join(protos, ","))
+	}
 	return fmt.Sprintf("%v=>%v", ss, ds)
 }
 
 type matches []Match
 
-func (ms matches) match(q *packet.Parsed) bool {
-	for _, m := range ms {
-		if !ipInList(q.Src.IP, m.Srcs) {
+// match returns the index of the first Match in ms that matches q,
+// or -1 if none do.
+func (ms matches) match(q *packet.Parsed) int {
+	for i, m := range ms {
+		if !m.protoAllowed(q.IPProto) || !ipInList(q.Src.IP, m.Srcs) {
 			continue
 		}
 		for _, dst := range m.Dsts {
@@ -89,24 +124,25 @@ func (ms matches) match(q *packet.Parsed) bool {
 			if !dst.Ports.contains(q.Dst.Port) {
 				continue
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
-func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
-	for _, m := range ms {
-		if !ipInList(q.Src.IP, m.Srcs) {
+// matchIPsOnly is like match, but ignores ports.
+func (ms matches) matchIPsOnly(q *packet.Parsed) int {
+	for i, m := range ms {
+		if !m.protoAllowed(q.IPProto) || !ipInList(q.Src.IP, m.Srcs) {
 			continue
 		}
 		for _, dst := range m.Dsts {
 			if dst.Net.Contains(q.Dst.IP) {
-				return true
+				return i
 			}
 		}
 	}
-	return false
+	return -1
 }
 
 func ipInList(ip netaddr.IP, netlist []netaddr.IPPrefix) bool {
@@ -8,6 +8,7 @@ package filter
 
 import (
 	"inet.af/netaddr"
+	"tailscale.com/net/packet"
 )
 
 // Clone makes a deep copy of Match.
@@ -20,12 +21,14 @@ func (src *Match) Clone() *Match {
 	*dst = *src
 	dst.Dsts = append(src.Dsts[:0:0], src.Dsts...)
 	dst.Srcs = append(src.Srcs[:0:0], src.Srcs...)
+	dst.IPProto = append(src.IPProto[:0:0], src.IPProto...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with command:
 //   tailscale.com/cmd/cloner -type Match
 var _MatchNeedsRegeneration = Match(struct {
-	Dsts []NetPortRange
-	Srcs []netaddr.IPPrefix
+	Dsts    []NetPortRange
+	Srcs    []netaddr.IPPrefix
+	IPProto []packet.IPProto
 }{})
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are a Filter's packet counters, for debugging ACLs. They
+// count from when the Filter was created, which is usually when the
+// node last got a new packet filter from the control server.
+type Stats struct {
+	Since time.Time
+	// Rules has an entry for each of the filter's rules, in order.
+	Rules []RuleStats
+	// Drops counts dropped packets by direction and reason.
+	Drops []DropStats
+}
+
+// RuleStats are the counters of one filter rule.
+type RuleStats struct {
+	Rule string // the rule, as a Match string
+	// Accepts is the number of packets the rule accepted. Packets
+	// of established flows, such as TCP non-SYN packets, are
+	// accepted without consulting the rules and aren't counted.
+	Accepts uint64
+}
+
+// DropStats counts the packets dropped for one reason.
+type DropStats struct {
+	Direction string // "in" (from a peer) or "out" (to a peer)
+	Reason    string
+	Count     uint64
+}
+
+type dropKey struct {
+	dir direction
+	why string
+}
+
+// filterStats are the live counters behind Stats.
+type filterStats struct {
+	since       time.Time
+	rules       []Match
+	ruleAccepts []uint64 // atomic; parallel to rules
+
+	// drops holds a map[dropKey]*uint64 of atomic counters. It's
+	// copied on write, which happens only the first time a reason
+	// is seen, so that counting a drop takes no lock.
+	drops atomic.Value
+	mu    sync.Mutex // held while replacing drops
+}
+
+func newFilterStats(rules []Match) *filterStats {
+	s := &filterStats{
+		since:       time.Now(),
+		rules:       rules,
+		ruleAccepts: make([]uint64, len(rules)),
+	}
+	s.drops.Store(map[dropKey]*uint64{})
+	return s
+}
+
+func (s *filterStats) noteRuleAccept(rule int) {
+	atomic.AddUint64(&s.ruleAccepts[rule], 1)
+}
+
+func (s *filterStats) noteDrop(dir direction, why string) {
+	k := dropKey{dir, why}
+	if n, ok := s.drops.Load().(map[dropKey]*uint64)[k]; ok {
+		atomic.AddUint64(n, 1)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.drops.Load().(map[dropKey]*uint64)
+	if n, ok := old[k]; ok {
+		atomic.AddUint64(n, 1)
+		return
+	}
+	m := make(map[dropKey]*uint64, len(old)+1)
+	for k, n := range old {
+		m[k] = n
+	}
+	n := uint64(1)
+	m[k] = &n
+	s.drops.Store(m)
+}
+
+// Stats returns a snapshot of f's packet counters.
+func (f *Filter) Stats() *Stats {
+	s := f.stats
+	st := &Stats{
+		Since: s.since,
+		Rules: make([]RuleStats, len(s.rules)),
+	}
+	for i, m := range s.rules {
+		st.Rules[i] = RuleStats{
+			Rule:    m.String(),
+			Accepts: atomic.LoadUint64(&s.ruleAccepts[i]),
+		}
+	}
+	for k, n := range s.drops.Load().(map[dropKey]*uint64) {
+		st.Drops = append(st.Drops, DropStats{Direction: k.dir.String(), Reason: k.why, Count: atomic.LoadUint64(n)})
+	}
+	sort.Slice(st.Drops, func(i, j int) bool {
+		a, b := st.Drops[i], st.Drops[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Reason < b.Reason
+	})
+	return st
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/packet"
 	"tailscale.com/tailcfg"
 )
 
@@ -52,6 +53,21 @@ func MatchesFromFilterRules(pf []tailcfg.FilterRule) ([]Match, error) {
 			}
 		}
 
+		for _, p := range r.IPProto {
+			if p < 0 || p > 0xff || packet.IPProto(p) == packet.Unknown || packet.IPProto(p) == packet.Fragment {
+				if erracc == nil {
+					erracc = fmt.Errorf("invalid IP protocol %d", p)
+				}
+				continue
+			}
+			m.IPProto = append(m.IPProto, packet.IPProto(p))
+		}
+		if len(r.IPProto) > 0 && len(m.IPProto) == 0 {
+			// Don't let a rule for only invalid protocols
+			// widen to the default ones.
+			continue
+		}
+
 		mm = append(mm, m)
 	}
 	return mm, erracc
@@ -563,6 +563,12 @@ func (as *addrSet) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	if as.roamAddr != nil {
 		ps.CurAddr = ippDebugString(*as.roamAddr)
 	}
+	switch {
+	case ps.CurAddr != "":
+		ps.PathType = "direct"
+	case !as.lastSend.IsZero():
+		ps.PathType = "derp"
+	}
 }
 
 // Message types copied from wireguard-go/device/noise-protocol.go
@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math"
+	"math/bits"
 	"math/rand"
 	"net"
 	"os"
@@ -42,6 +43,7 @@ import (
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/portmapper"
@@ -118,7 +120,6 @@ type Conn struct {
 	// struct. Initialized once at construction, then constant.
 
 	logf             logger.Logf
-	port             uint16 // the preferred port from opts.Port; 0 means auto
 	epFunc           func(endpoints []string)
 	derpActiveFunc   func()
 	idleFunc         func() time.Duration // nil means unknown
@@ -126,6 +127,7 @@ type Conn struct {
 	noteRecvActivity func(tailcfg.DiscoKey) // or nil, see Options.NoteRecvActivity
 	simulatedNetwork bool
 	disableLegacy    bool
+	netns            *netns.Binding // or nil
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -157,6 +159,10 @@ type Conn struct {
 	// TODO(danderson): now that we have global rate-limiting, is this still useful?
 	sendLogLimit *rate.Limiter
 
+	// portAtomic is the preferred port to listen on; 0 means auto.
+	// It starts as opts.Port and is changed by SetPreferredPort.
+	portAtomic uint32
+
 	// stunReceiveFunc holds the current STUN packet processing func.
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
@@ -170,6 +176,12 @@ type Conn struct {
 	// arrives and decremented when they're read.
 	derpRecvCountAtomic int64
 
+	// For tests: how many derpReadResult zero values were sent on
+	// and received from derpRecvCh. (Kept after derpRecvCountAtomic
+	// for 64-bit alignment.)
+	testCounterZeroDerpReadResultSend expvar.Int
+	testCounterZeroDerpReadResultRecv expvar.Int
+
 	// ippEndpoint4 and ippEndpoint6 are owned by ReceiveIPv4 and
 	// ReceiveIPv6, respectively, to cache an IPPort->endpoint for
 	// hot flows.
@@ -285,6 +297,7 @@ type Conn struct {
 	privateKey  key.Private        // WireGuard private key for this node
 	everHadKey  bool               // whether we ever had a non-zero private key
 	myDerp      int                // nearest DERP region ID; 0 means none/unknown
+	prefDerp    int                // DERP region ID to use as home when reachable; 0 means none
 	derpStarted chan struct{}      // closed on first connection to DERP; for tests & cleaner Close
 	activeDerp  map[int]activeDerp // DERP regionID -> connection to a node in that region
 	prevDerp    map[int]*syncs.WaitGroupChan
@@ -309,6 +322,15 @@ type Conn struct {
 	// logging.
 	noV4, noV6 syncs.AtomicBool
 
+	// lastLinkSig is the linkSig of the interface state as of the
+	// last link change. It's guarded by mu.
+	lastLinkSig string
+
+	// nat64Prefix is the NAT64 prefix discovered by the most
+	// recent netcheck, if any. When IPv4 is missing, IPv4
+	// destinations are reached via addresses synthesized from it.
+	nat64Prefix atomic.Value // of netaddr.IPPrefix
+
 	// networkUp is whether the network is up (some interface is up
 	// with IPv4 or IPv6). It's used to suppress log spam and prevent
 	// new connection that'll fail.
@@ -398,7 +420,8 @@ type Options struct {
 	IdleFunc func() time.Duration
 
 	// PacketListener optionally specifies how to create PacketConns.
-	// It's meant for testing.
+	// It's meant for testing, and for picking up sockets inherited
+	// from a previous process.
 	PacketListener nettype.PacketListener
 
 	// NoteRecvActivity, if provided, is a func for magicsock to
@@ -429,6 +452,12 @@ type Options struct {
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
+
+	// Netns optionally sets the interface that the Conn's sockets,
+	// and those of its DERP, netcheck and portmapper clients, bind
+	// to. If nil, the OS is asked for the default route's on each
+	// dial or listen.
+	Netns *netns.Binding
 }
 
 func (o *Options) logf() logger.Logf {
@@ -479,18 +508,23 @@ func newConn() *Conn {
 // It doesn't start doing anything until Start is called.
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
-	c.port = opts.Port
+	c.portAtomic = uint32(opts.Port)
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
 	c.packetListener = opts.PacketListener
+	c.netns = opts.Netns
 	c.noteRecvActivity = opts.NoteRecvActivity
 	c.simulatedNetwork = opts.SimulatedNetwork
 	c.disableLegacy = opts.DisableLegacyNetworking
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "))
+	c.portMapper.SetNetnsBinding(c.netns)
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
+		// Start from the monitor's current state, so the first
+		// link change isn't mistaken for a major one.
+		c.lastLinkSig = linkSig(opts.LinkMonitor.InterfaceState())
 	}
 
 	if err := c.initialBind(); err != nil {
@@ -504,11 +538,15 @@ func NewConn(opts Options) (*Conn, error) {
 		GetSTUNConn4:        func() netcheck.STUNConn { return c.pconn4 },
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
+		Netns:               c.netns,
 	}
 
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
 	}
+	if opts.LinkMonitor != nil {
+		c.netChecker.GetInterfaceState = opts.LinkMonitor.InterfaceState
+	}
 
 	c.ignoreSTUNPackets()
 
@@ -676,6 +714,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
+	c.nat64Prefix.Store(report.NAT64Prefix)
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -694,7 +733,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 	ni.WorkingIPv6.Set(report.IPv6)
 	ni.WorkingUDP.Set(report.UDP)
-	ni.PreferredDERP = report.PreferredDERP
+	ni.PreferredDERP = homeDERP(report, c.preferredDERP())
 
 	if ni.PreferredDERP == 0 {
 		// Perhaps UDP is blocked. Pick a deterministic but arbitrary
@@ -854,6 +893,48 @@ func (c *Conn) PeerForIP(ip netaddr.IP) (n *tailcfg.Node, ok bool) {
 	return peerForIP(c.netMap, ip)
 }
 
+// wgTransportOverhead is the size of the header and authentication
+// tag that WireGuard adds to each packet it tunnels.
+const wgTransportOverhead = 16 + 16
+
+// PeerPathMTU reports on the path that traffic to the peer that ip
+// routes to currently takes. viaDERP is whether it's relayed via DERP.
+// Otherwise, known is whether the direct path's MTU has been probed,
+// and if so, mtu is the largest tunneled packet, in bytes, that the
+// path carries, or 0 if even the smallest probe didn't get through.
+func (c *Conn) PeerPathMTU(ip netaddr.IP) (viaDERP bool, mtu int, known bool) {
+	c.mu.Lock()
+	n, ok := peerForIP(c.netMap, ip)
+	var de *discoEndpoint
+	if ok {
+		de = c.endpointOfDisco[n.DiscoKey]
+	}
+	c.mu.Unlock()
+	if de == nil {
+		return false, 0, false
+	}
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	udpAddr, derpAddr := de.addrForSendLocked(time.Now())
+	if !derpAddr.IsZero() {
+		// Until a direct path is trusted, packets may go either way.
+		return true, 0, false
+	}
+	st, ok := de.endpointState[udpAddr]
+	if !ok || !st.mtuKnown {
+		return false, 0, false
+	}
+	if st.mtu == 0 {
+		return false, 0, true
+	}
+	hdr := 20 + 8 // IPv4 and UDP headers
+	if udpAddr.IP.Is6() {
+		hdr = 40 + 8
+	}
+	return false, st.mtu - hdr - wgTransportOverhead, true
+}
+
 // LastRecvActivityOfDisco returns the time we last got traffic from
 // this endpoint (updated every ~10 seconds).
 func (c *Conn) LastRecvActivityOfDisco(dk tailcfg.DiscoKey) time.Time {
@@ -1062,9 +1143,9 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 		// port mapping on their router to the same explicit
 		// port that tailscaled is running with. Worst case
 		// it's an invalid candidate mapping.
-		if nr.MappingVariesByDestIP.EqualBool(true) && c.port != 0 {
+		if port := c.preferredPort(); nr.MappingVariesByDestIP.EqualBool(true) && port != 0 {
 			if ip, _, err := net.SplitHostPort(nr.GlobalV4); err == nil {
-				addAddr(net.JoinHostPort(ip, strconv.Itoa(int(c.port))), "port_in")
+				addAddr(net.JoinHostPort(ip, strconv.Itoa(int(port))), "port_in")
 			}
 		}
 	}
@@ -1090,7 +1171,16 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 			reason = "loopback"
 		}
 		for _, ip := range ips {
-			addAddr(netaddr.IPPort{IP: ip, Port: uint16(localAddr.Port)}.String(), reason)
+			port := localAddr.Port
+			if ip.Is6() {
+				// The IPv6 socket may be on a different
+				// port, or missing.
+				if c.pconn6 == nil {
+					continue
+				}
+				port = c.pconn6.LocalAddr().Port
+			}
+			addAddr(netaddr.IPPort{IP: ip, Port: uint16(port)}.String(), reason)
 		}
 	} else {
 		// Our local endpoint is bound to a particular address.
@@ -1129,6 +1219,16 @@ func (c *Conn) LocalPort() uint16 {
 	return uint16(laddr.Port)
 }
 
+// PacketConns returns the UDP sockets currently in use for IPv4 and,
+// if bound, IPv6. They remain owned by c.
+func (c *Conn) PacketConns() (pc4, pc6 net.PacketConn) {
+	pc4 = c.pconn4.currentConn()
+	if c.pconn6 != nil {
+		pc6 = c.pconn6.currentConn()
+	}
+	return pc4, pc6
+}
+
 var errNetworkDown = errors.New("magicsock: network down")
 
 func (c *Conn) networkDown() bool { return !c.networkUp.Get() }
@@ -1159,11 +1259,25 @@ var udpAddrPool = &sync.Pool{
 // sendUDP sends UDP packet b to ipp.
 // See sendAddr's docs on the return value meanings.
 func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+	if ipp.IP.Is4() && c.noV4.Get() {
+		if pfx := c.curNAT64Prefix(); !pfx.IsZero() {
+			if ip6, ok := nat64.Synthesize(pfx, ipp.IP); ok {
+				ipp.IP = ip6
+			}
+		}
+	}
 	ua := udpAddrPool.Get().(*net.UDPAddr)
 	defer udpAddrPool.Put(ua)
 	return c.sendUDPStd(ipp.UDPAddrAt(ua), b)
 }
 
+// curNAT64Prefix returns the NAT64 prefix found by the most recent
+// netcheck, or the zero value if none is known.
+func (c *Conn) curNAT64Prefix() netaddr.IPPrefix {
+	pfx, _ := c.nat64Prefix.Load().(netaddr.IPPrefix)
+	return pfx
+}
+
 // sendUDP sends UDP packet b to addr.
 // See sendAddr's docs on the return value meanings.
 func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
@@ -1208,25 +1322,34 @@ func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent
 		return false, nil
 	}
 
-	// TODO(bradfitz): this makes garbage for now; we could use a
-	// buffer pool later.  Previously we passed ownership of this
-	// to derpWriteRequest and waited for derphttp.Client.Send to
-	// complete, but that's too slow while holding wireguard-go
-	// internal locks.
-	pkt := make([]byte, len(b))
-	copy(pkt, b)
+	// Copy b, as it belongs to wireguard-go. Previously we passed
+	// ownership of it to derpWriteRequest and waited for
+	// derphttp.Client.Send to complete, but that's too slow while
+	// holding wireguard-go internal locks. The copy comes from a
+	// pool and goes back to it once written.
+	pkt := derpWriteBufPool.Get().(*[]byte)
+	*pkt = append((*pkt)[:0], b...)
 
 	select {
 	case <-c.donec:
+		derpWriteBufPool.Put(pkt)
 		return false, errConnClosed
 	case ch <- derpWriteRequest{addr, pubKey, pkt}:
 		return true, nil
 	default:
 		// Too many writes queued. Drop packet.
+		derpWriteBufPool.Put(pkt)
 		return false, errDropDerpPacket
 	}
 }
 
+// derpWriteBufPool holds the packet copies passed to DERP writers in
+// derpWriteRequests, so that steady-state sends via DERP don't
+// allocate.
+var derpWriteBufPool = &sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
 // bufferedDerpWritesBeforeDrop is how many packets writes can be
 // queued up the DERP client to write on the wire before we start
 // dropping.
@@ -1322,6 +1445,8 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	dc.SetCanAckPings(true)
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.NAT64Prefix = c.curNAT64Prefix
+	dc.Netns = c.netns
 
 	ctx, cancel := context.WithCancel(c.connCtx)
 	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
@@ -1538,11 +1663,6 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 	}
 }
 
-var (
-	testCounterZeroDerpReadResultSend expvar.Int
-	testCounterZeroDerpReadResultRecv expvar.Int
-)
-
 // sendDerpReadResult sends res to c.derpRecvCh and reports whether it
 // was sent. (It reports false if ctx was done first.)
 //
@@ -1572,7 +1692,7 @@ func (c *Conn) sendDerpReadResult(ctx context.Context, res derpReadResult) (sent
 			// conn is going down).
 			// The receiver treats a derpReadResult zero value
 			// message as a skip.
-			testCounterZeroDerpReadResultSend.Add(1)
+			c.testCounterZeroDerpReadResultSend.Add(1)
 
 		}
 		return false
@@ -1584,7 +1704,7 @@ func (c *Conn) sendDerpReadResult(ctx context.Context, res derpReadResult) (sent
 type derpWriteRequest struct {
 	addr   netaddr.IPPort
 	pubKey key.Public
-	b      []byte // copied; ownership passed to receiver
+	b      *[]byte // copied from derpWriteBufPool; ownership passed to receiver
 }
 
 // runDerpWriter runs in a goroutine for the life of a DERP
@@ -1602,7 +1722,8 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 		case <-ctx.Done():
 			return
 		case wr := <-ch:
-			err := dc.Send(wr.pubKey, wr.b)
+			err := dc.Send(wr.pubKey, *wr.b)
+			derpWriteBufPool.Put(wr.b)
 			if err != nil {
 				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
 			}
@@ -1659,6 +1780,14 @@ func (c *Conn) ReceiveIPv6(b []byte) (int, conn.Endpoint, error) {
 		if err != nil {
 			return 0, nil, err
 		}
+		if pfx := c.curNAT64Prefix(); !pfx.IsZero() && pfx.Contains(ipp.IP) {
+			// Packets from IPv4 peers arrive via the NAT64 with
+			// synthesized source addresses; map them back so they
+			// match the peer's advertised IPv4 endpoints.
+			if ip4, ok := nat64.Extract(pfx, ipp.IP); ok {
+				ipp.IP = ip4
+			}
+		}
 		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
 			return n, ep, nil
 		}
@@ -1769,7 +1898,7 @@ func (c *Conn) receiveIPv4DERP(b []byte) (n int, ep conn.Endpoint, err error) {
 		c.pconn4.SetReadDeadline(time.Time{})
 	}
 	if dm.copyBuf == nil {
-		testCounterZeroDerpReadResultRecv.Add(1)
+		c.testCounterZeroDerpReadResultRecv.Add(1)
 		return 0, nil, errLoopAgain
 	}
 
@@ -2290,12 +2419,32 @@ func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
 		return
 	}
 
+	old := c.derpMap
 	c.derpMap = dm
 	if dm == nil {
 		c.closeAllDerpLocked("derp-disabled")
 		return
 	}
 
+	// Reconnect to regions whose servers changed or that are gone,
+	// such as after a local DERP map file was edited.
+	if old != nil {
+		dirty := false
+		for regionID := range c.activeDerp {
+			was, now := old.Regions[regionID], dm.Regions[regionID]
+			if was == nil || now == nil || !reflect.DeepEqual(was.Nodes, now.Nodes) {
+				c.closeDerpLocked(regionID, "derp-map-changed")
+				dirty = true
+			}
+		}
+		if dirty {
+			c.logActiveDerpLocked()
+			if dm.Regions[c.myDerp] != nil {
+				c.startDerpHomeConnectLocked()
+			}
+		}
+	}
+
 	if c.started {
 		go c.ReSTUN("derp-map-update")
 	}
@@ -2629,6 +2778,66 @@ func (c *Conn) ReSTUN(why string) {
 	}
 }
 
+// preferredPort returns the port c prefers to listen on, or 0 for
+// any port.
+func (c *Conn) preferredPort() uint16 {
+	return uint16(atomic.LoadUint32(&c.portAtomic))
+}
+
+// SetPreferredDERP sets the DERP region to use as home whenever
+// netcheck can reach it, rather than the one with the lowest latency,
+// or 0 for no preference.
+func (c *Conn) SetPreferredDERP(regionID int) {
+	c.mu.Lock()
+	if c.prefDerp == regionID {
+		c.mu.Unlock()
+		return
+	}
+	c.prefDerp = regionID
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.logf("magicsock: preferred DERP region changed to %d", regionID)
+	c.ReSTUN("preferred-derp-changed")
+}
+
+func (c *Conn) preferredDERP() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prefDerp
+}
+
+// homeDERP returns the DERP region to use as home given netcheck's
+// report and the preferred region (0 for none). The preferred region
+// wins only if it answered the report, so that the node still has a
+// home while it's down.
+func homeDERP(report *netcheck.Report, preferred int) int {
+	if preferred != 0 && report.RegionLatency[preferred] != 0 {
+		return preferred
+	}
+	return report.PreferredDERP
+}
+
+// SetPreferredPort sets the UDP port to listen on, or 0 to pick one
+// automatically, and rebinds if it changed. If the port can't be
+// bound, a random one is used instead, as with Options.Port.
+func (c *Conn) SetPreferredPort(port uint16) {
+	if old := atomic.SwapUint32(&c.portAtomic, uint32(port)); old == uint32(port) {
+		return
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.logf("magicsock: preferred port changed to %d", port)
+	c.Rebind()
+	c.ReSTUN("port-changed")
+}
+
 func (c *Conn) initialBind() error {
 	if err := c.bind1(&c.pconn4, "udp4"); err != nil {
 		return err
@@ -2644,7 +2853,7 @@ func (c *Conn) listenPacket(ctx context.Context, network, addr string) (net.Pack
 	if c.packetListener != nil {
 		return c.packetListener.ListenPacket(ctx, network, addr)
 	}
-	return netns.Listener().ListenPacket(ctx, network, addr)
+	return c.netns.Listener().ListenPacket(ctx, network, addr)
 }
 
 func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
@@ -2658,18 +2867,19 @@ func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
 	var pc net.PacketConn
 	var err error
 	listenCtx := context.Background() // unused without DNS name to resolve
-	if c.port == 0 && DefaultPort != 0 {
+	port := c.preferredPort()
+	if port == 0 && DefaultPort != 0 {
 		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(DefaultPort)))
 		if err != nil {
 			c.logf("magicsock: bind: default port %s/%v unavailable; picking random", which, DefaultPort)
 		}
 	}
 	if pc == nil {
-		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(c.port)))
+		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(port)))
 	}
 	if err != nil {
-		c.logf("magicsock: bind(%s/%v): %v", which, c.port, err)
-		return fmt.Errorf("magicsock: bind: %s/%d: %v", which, c.port, err)
+		c.logf("magicsock: bind(%s/%v): %v", which, port, err)
+		return fmt.Errorf("magicsock: bind: %s/%d: %v", which, port, err)
 	}
 	if *ruc == nil {
 		*ruc = new(RebindingUDPConn)
@@ -2687,15 +2897,15 @@ func (c *Conn) Rebind() {
 	}
 	listenCtx := context.Background() // unused without DNS name to resolve
 
-	if c.port != 0 {
+	if port := c.preferredPort(); port != 0 {
 		c.pconn4.mu.Lock()
 		oldPort := c.pconn4.localAddrLocked().Port
 		if err := c.pconn4.pconn.Close(); err != nil {
 			c.logf("magicsock: link change close failed: %v", err)
 		}
-		packetConn, err := c.listenPacket(listenCtx, "udp4", net.JoinHostPort(host, fmt.Sprint(c.port)))
+		packetConn, err := c.listenPacket(listenCtx, "udp4", net.JoinHostPort(host, fmt.Sprint(port)))
 		if err != nil {
-			c.logf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", c.port, err)
+			c.logf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", port, err)
 			packetConn, err = c.listenPacket(listenCtx, "udp4", net.JoinHostPort(host, "0"))
 			if err != nil {
 				c.logf("magicsock: link change failed to bind random port: %v", err)
@@ -2703,9 +2913,9 @@ func (c *Conn) Rebind() {
 				return
 			}
 			newPort := c.pconn4.localAddrLocked().Port
-			c.logf("magicsock: link change rebound port: from %v to %v (failed to get %v)", oldPort, newPort, c.port)
+			c.logf("magicsock: link change rebound port: from %v to %v (failed to get %v)", oldPort, newPort, port)
 		} else {
-			c.logf("magicsock: link change rebound port: %d", c.port)
+			c.logf("magicsock: link change rebound port: %d", port)
 		}
 		c.pconn4.pconn = packetConn.(*net.UDPConn)
 		c.pconn4.mu.Unlock()
@@ -2719,6 +2929,7 @@ func (c *Conn) Rebind() {
 		c.pconn4.Reset(packetConn.(*net.UDPConn))
 	}
 	c.portMapper.SetLocalPort(c.LocalPort())
+	c.rebind6()
 
 	c.mu.Lock()
 	c.closeAllDerpLocked("rebind")
@@ -2730,6 +2941,128 @@ func (c *Conn) Rebind() {
 	c.resetEndpointStates()
 }
 
+// rebind6 closes and re-binds the IPv6 socket, if there is one, the
+// same way Rebind does the IPv4 one.
+func (c *Conn) rebind6() {
+	if c.pconn6 == nil {
+		return
+	}
+	host := ""
+	if inTest() && !c.simulatedNetwork {
+		host = "::1"
+	}
+	listenCtx := context.Background() // unused without DNS name to resolve
+	port := c.preferredPort()
+
+	c.pconn6.mu.Lock()
+	defer c.pconn6.mu.Unlock()
+	if err := c.pconn6.pconn.Close(); err != nil {
+		c.logf("magicsock: link change close of IPv6 socket failed: %v", err)
+	}
+	packetConn, err := c.listenPacket(listenCtx, "udp6", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil && port != 0 {
+		c.logf("magicsock: link change unable to bind fixed IPv6 port %d: %v, falling back to random port", port, err)
+		packetConn, err = c.listenPacket(listenCtx, "udp6", net.JoinHostPort(host, "0"))
+	}
+	if err != nil {
+		c.logf("magicsock: link change failed to bind IPv6 port: %v", err)
+		return
+	}
+	c.pconn6.pconn = packetConn
+}
+
+// LinkChange is called when the link monitor reports a network
+// change. changed is whether the monitor considered the interface
+// state to have changed at all.
+//
+// The sockets are only rebound if a part of the state that matters
+// to magicsock changed: the usable local addresses, the default route
+// interface, the available address families, or the proxy settings.
+// Other changes, such as a container's veth interface appearing, only
+// get a check that the existing sockets are still bound to valid
+// addresses; the periodic re-STUN revalidates our endpoints.
+func (c *Conn) LinkChange(changed bool, st *interfaces.State) {
+	sig := linkSig(st)
+	c.mu.Lock()
+	relevant := sig != c.lastLinkSig
+	c.lastLinkSig = sig
+	c.mu.Unlock()
+
+	switch {
+	case changed && relevant:
+		c.Rebind()
+		c.ReSTUN("link-change-major")
+	case !c.socketsValid(st):
+		c.logf("magicsock: link change invalidated socket address; rebinding")
+		c.Rebind()
+		c.ReSTUN("link-change-socket")
+	case relevant:
+		c.ReSTUN("link-change-minor")
+	default:
+		c.logf("[v1] magicsock: link change not relevant; skipping rebind and re-STUN")
+	}
+}
+
+// linkSig returns a summary of the parts of st that, when changed,
+// require magicsock to rebind and re-check the network.
+func linkSig(st *interfaces.State) string {
+	if st == nil {
+		return ""
+	}
+	var addrs []string
+	for name, up := range st.InterfaceUp {
+		if !up {
+			continue
+		}
+		for _, pfx := range st.InterfaceIPs[name] {
+			if pfx.IP.IsLoopback() || pfx.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, name+"="+pfx.IP.String())
+		}
+	}
+	sort.Strings(addrs)
+	return fmt.Sprintf("v4=%v v6=%v def=%s proxy=%s pac=%s addrs=%s",
+		st.HaveV4, st.HaveV6Global, st.DefaultRouteInterface, st.HTTPProxy, st.PAC,
+		strings.Join(addrs, ","))
+}
+
+// socketsValid reports whether c's sockets are bound to the
+// unspecified address or to an address that's still present in st.
+func (c *Conn) socketsValid(st *interfaces.State) bool {
+	for _, pc := range []*RebindingUDPConn{c.pconn4, c.pconn6} {
+		if pc == nil {
+			continue
+		}
+		la := pc.LocalAddr()
+		if la == nil {
+			return false
+		}
+		if la.IP.IsUnspecified() || la.IP.IsLoopback() {
+			continue
+		}
+		ip, ok := netaddr.FromStdIP(la.IP)
+		if !ok || !stateHasIP(st, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func stateHasIP(st *interfaces.State, ip netaddr.IP) bool {
+	for name, pfxs := range st.InterfaceIPs {
+		if !st.InterfaceUp[name] {
+			continue
+		}
+		for _, pfx := range pfxs {
+			if pfx.IP == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // resetEndpointStates resets the preferred address for all peers and
 // re-enables spraying.
 // This is called when connectivity changes enough that we no longer
@@ -2822,6 +3155,13 @@ func (c *RebindingUDPConn) Reset(pconn net.PacketConn) {
 	}
 }
 
+// currentConn returns c's current underlying socket.
+func (c *RebindingUDPConn) currentConn() net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pconn
+}
+
 // ReadFromNetaddr reads a packet from c into b.
 // It returns the number of bytes copied and the source address.
 func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
@@ -3155,6 +3495,13 @@ const (
 	// try to upgrade to a better path.
 	goodEnoughLatency = 5 * time.Millisecond
 
+	// discoProbeCount is how many pings are sent to each endpoint,
+	// discoProbeSpacing apart, when looking for the best path, so
+	// that its loss and jitter are measured too, not just whether
+	// it works.
+	discoProbeCount   = 4
+	discoProbeSpacing = 250 * time.Millisecond
+
 	// derpInactiveCleanupTime is how long a non-home DERP connection
 	// needs to be idle (last written to) before we close it.
 	derpInactiveCleanupTime = 60 * time.Second
@@ -3191,6 +3538,28 @@ type endpointState struct {
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	// lostPings records which of the most recent numPings pings
+	// went unanswered, the most recent in bit 0.
+	lostPings uint32
+	numPings  uint8
+
+	// mtu is the size, in bytes of IP packet, of the largest MTU
+	// probe that got a pong in the last complete round of probes,
+	// or 0 if none did; mtuKnown is whether a round has completed.
+	// Probes aren't sent with DF set, so one that's fragmented and
+	// reassembled along the way counts: this is the largest packet
+	// that gets through at all, which is what middleboxes that drop
+	// fragments limit.
+	mtu      int
+	mtuKnown bool
+
+	// mtuNext and mtuProbesLeft are the largest probe to get a pong
+	// so far in the round of probes sent at mtuProbeAt, and how many
+	// of its probes are still awaiting a pong or timeout.
+	mtuNext       int
+	mtuProbesLeft int
+	mtuProbeAt    time.Time
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
@@ -3229,11 +3598,74 @@ type pongReply struct {
 	pongSrc netaddr.IPPort // what they reported they heard
 }
 
+// pathStatsPings is how many of an endpoint's recent pings its loss
+// is measured over. It must be at most 32, the bits in
+// endpointState.lostPings.
+const pathStatsPings = 16
+
+// pathStatsPongs is how many of an endpoint's recent pongs its
+// latency and jitter are measured over.
+const pathStatsPongs = 8
+
+// lossPenalty is how much latency total loss is worth when comparing
+// paths, in proportion to the loss: a path that loses 10% of pings
+// ranks like one 100ms slower.
+const lossPenalty = time.Second
+
+// pathSwitchMinMargin and pathSwitchFraction set how much lower a
+// path's cost must be than the current best path's before switching
+// to it: by the larger of pathSwitchMinMargin and pathSwitchFraction
+// of the current cost. This keeps paths of similar quality from
+// flapping.
+const (
+	pathSwitchMinMargin = 5 * time.Millisecond
+	pathSwitchFraction  = 0.1
+)
+
+// pathStats summarizes an endpoint's recent pings.
+type pathStats struct {
+	latency time.Duration // mean round-trip time
+	jitter  time.Duration // mean change in round-trip time between pongs
+	loss    float64       // fraction of pings unanswered
+	pings   int           // number of pings answered or timed out
+}
+
+// cost ranks paths by their stats. Lower is better.
+func (s pathStats) cost() time.Duration {
+	return s.latency + s.jitter + time.Duration(s.loss*float64(lossPenalty))
+}
+
+// mtuProbeSizes are the sizes, in bytes of IP packet, of the padded
+// pings that probe the path MTU of an endpoint once it answers pings:
+// the least MTU that IPv6 requires, one that leaves room for common
+// tunnel and PPPoE headers, and Ethernet's.
+var mtuProbeSizes = []int{1280, 1400, 1500}
+
+// mtuProbeInterval is how often an endpoint's path MTU is probed
+// again, as long as it answers pings.
+const mtuProbeInterval = 10 * time.Minute
+
+// discoPingOverhead is the size of an unpadded disco ping in a UDP
+// payload: the disco header, the secretbox overhead, and the ping
+// message itself.
+const discoPingOverhead = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen + box.Overhead + 2 + 12
+
+// mtuProbePadding returns the padding that makes a disco ping to ep
+// an IP packet of size bytes.
+func mtuProbePadding(ep netaddr.IPPort, size int) int {
+	hdr := 20 + 8 // IPv4 and UDP headers
+	if ep.IP.Is6() {
+		hdr = 40 + 8
+	}
+	return size - hdr - discoPingOverhead
+}
+
 type sentPing struct {
 	to      netaddr.IPPort
 	at      time.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	size    int // for pingMTUProbe, the IP packet size probed
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -3337,7 +3769,10 @@ func (de *discoEndpoint) wantFullPingLocked(now time.Time) bool {
 		return true
 	}
 	if de.bestAddrLatency <= goodEnoughLatency {
-		return false
+		// Unless it's losing packets, when another path might not.
+		if st, ok := de.endpointState[de.bestAddr]; !ok || st.pathStatsLocked().loss == 0 {
+			return false
+		}
 	}
 	if now.Sub(de.lastFullPing) >= upgradeInterval {
 		return true
@@ -3413,10 +3848,20 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
+	de.removeSentPingLocked(txid, sp)
+	if sp.purpose == pingMTUProbe {
+		// Too big for the path, which isn't loss.
+		if st, ok := de.endpointState[sp.to]; ok {
+			st.noteMTUProbeLocked(0)
+		}
+		return
+	}
 	if debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
-	de.removeSentPingLocked(txid, sp)
+	if st, ok := de.endpointState[sp.to]; ok {
+		st.notePingResultLocked(true)
+	}
 }
 
 // forgetPing is called by a timer when a ping either fails to send or
@@ -3426,6 +3871,9 @@ func (de *discoEndpoint) forgetPing(txid stun.TxID) {
 	defer de.mu.Unlock()
 	if sp, ok := de.sentPing[txid]; ok {
 		de.removeSentPingLocked(txid, sp)
+		if st, ok := de.endpointState[sp.to]; ok && sp.purpose == pingMTUProbe {
+			st.noteMTUProbeLocked(0)
+		}
 	}
 }
 
@@ -3436,12 +3884,12 @@ func (de *discoEndpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid and padding to ep.
 //
 // The caller (startPingLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
+func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, padding int, logLevel discoLogLevel) {
+	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid), Padding: padding}, logLevel)
 	if !sent {
 		de.forgetPing(txid)
 	}
@@ -3463,6 +3911,10 @@ const (
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingMTUProbe means that the ping was padded to see whether
+	// packets of its size get through on the path.
+	pingMTUProbe
 )
 
 func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpose discoPingPurpose) {
@@ -3488,7 +3940,48 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, txid, logLevel)
+	go de.sendDiscoPing(ep, txid, 0, logLevel)
+}
+
+// noteMTUProbeLocked records the result of one of the MTU probes of
+// the current round: the size it probed if it got a pong, else 0.
+// Once all of them are in, the round's result becomes st's path MTU.
+func (st *endpointState) noteMTUProbeLocked(size int) {
+	if st.mtuProbesLeft == 0 {
+		return
+	}
+	if size > st.mtuNext {
+		st.mtuNext = size
+	}
+	st.mtuProbesLeft--
+	if st.mtuProbesLeft == 0 {
+		st.mtu, st.mtuKnown = st.mtuNext, true
+	}
+}
+
+// startMTUProbesLocked sends ep, whose endpointState is st, a padded
+// ping of each of mtuProbeSizes, if it's time to probe its path MTU
+// again.
+//
+// de.mu must be held.
+func (de *discoEndpoint) startMTUProbesLocked(ep netaddr.IPPort, st *endpointState, now time.Time) {
+	if !st.mtuProbeAt.IsZero() && now.Sub(st.mtuProbeAt) < mtuProbeInterval {
+		return
+	}
+	st.mtuProbeAt = now
+	st.mtuNext = 0
+	st.mtuProbesLeft = len(mtuProbeSizes)
+	for _, size := range mtuProbeSizes {
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:      ep,
+			at:      now,
+			timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
+			purpose: pingMTUProbe,
+			size:    size,
+		}
+		go de.sendDiscoPing(ep, txid, mtuProbePadding(ep, size), discoVerboseLog)
+	}
 }
 
 func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
@@ -3511,6 +4004,10 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 		}
 
 		de.startPingLocked(ep, now, pingDiscovery)
+		for i := 1; i < discoProbeCount; i++ {
+			ep := ep
+			time.AfterFunc(time.Duration(i)*discoProbeSpacing, func() { de.sendProbe(ep) })
+		}
 	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && !derpAddr.IsZero() {
@@ -3523,6 +4020,19 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 	}
 }
 
+// sendProbe sends one of the follow-up discovery pings to ep that
+// sendPingsLocked schedules, unless ep is no longer a candidate or
+// de has been reset since.
+func (de *discoEndpoint) sendProbe(ep netaddr.IPPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	st, ok := de.endpointState[ep]
+	if !ok || st.lastPing.IsZero() {
+		return
+	}
+	de.startPingLocked(ep, time.Now(), pingDiscovery)
+}
+
 func (de *discoEndpoint) sendDiscoMessage(dst netaddr.IPPort, dm disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	return de.c.sendDiscoMessage(dst, de.publicKey, de.discoKey, dm, logLevel)
 }
@@ -3631,6 +4141,19 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.removeSentPingLocked(m.TxID, sp)
 
+	if sp.purpose == pingMTUProbe {
+		// Its padding makes its latency meaningless; all it tells
+		// is that its size got through.
+		if st, ok := de.endpointState[sp.to]; ok {
+			size := sp.size
+			if isDerp {
+				size = 0
+			}
+			st.noteMTUProbeLocked(size)
+		}
+		return
+	}
+
 	now := time.Now()
 	latency := now.Sub(sp.at)
 
@@ -3649,6 +4172,8 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 			from:    src,
 			pongSrc: m.Src,
 		})
+		st.notePingResultLocked(false)
+		de.startMTUProbesLocked(sp.to, st, now)
 	}
 
 	if sp.purpose != pingHeartbeat {
@@ -3665,10 +4190,11 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.pendingCLIPings = nil
 
-	// Promote this pong response to our current best address if it's lower latency.
+	// Promote this pong's endpoint to our current best address if
+	// its recent pings show a better path.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
-		if de.bestAddr.IsZero() || latency < de.bestAddrLatency {
+		if de.bestAddr.IsZero() || de.betterAddrLocked(sp.to) {
 			if de.bestAddr != sp.to {
 				de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
 				de.bestAddr = sp.to
@@ -3682,6 +4208,83 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 }
 
+// betterAddrLocked reports whether the path to ep is better than
+// the one to de.bestAddr, by the stats of their recent pings, by
+// enough to switch to it.
+//
+// de.mu must be held.
+func (de *discoEndpoint) betterAddrLocked(ep netaddr.IPPort) bool {
+	if ep == de.bestAddr {
+		return false
+	}
+	cand, ok := de.endpointState[ep]
+	if !ok {
+		return false
+	}
+	cur, ok := de.endpointState[de.bestAddr]
+	if !ok {
+		return true
+	}
+	curCost := cur.pathStatsLocked().cost()
+	margin := time.Duration(float64(curCost) * pathSwitchFraction)
+	if margin < pathSwitchMinMargin {
+		margin = pathSwitchMinMargin
+	}
+	return cand.pathStatsLocked().cost()+margin < curCost
+}
+
+// notePingResultLocked records whether a ping to st's endpoint was
+// answered or timed out.
+//
+// discoEndpoint.mu must be held.
+func (st *endpointState) notePingResultLocked(lost bool) {
+	st.lostPings <<= 1
+	if lost {
+		st.lostPings |= 1
+	}
+	if st.numPings < pathStatsPings {
+		st.numPings++
+	}
+}
+
+// pathStatsLocked returns the stats of the most recent pings to st's
+// endpoint.
+//
+// discoEndpoint.mu must be held.
+func (st *endpointState) pathStatsLocked() (s pathStats) {
+	s.pings = int(st.numPings)
+	if s.pings > 0 {
+		mask := uint32(1)<<s.pings - 1
+		s.loss = float64(bits.OnesCount32(st.lostPings&mask)) / float64(s.pings)
+	}
+	n := len(st.recentPongs)
+	if n > pathStatsPongs {
+		n = pathStatsPongs
+	}
+	if n == 0 {
+		return s
+	}
+	var sum, jitterSum, prev time.Duration
+	for i := 0; i < n; i++ {
+		// Walk the ring buffer back from the most recent.
+		lat := st.recentPongs[(int(st.recentPong)-i+len(st.recentPongs))%len(st.recentPongs)].latency
+		sum += lat
+		if i > 0 {
+			if d := lat - prev; d < 0 {
+				jitterSum -= d
+			} else {
+				jitterSum += d
+			}
+		}
+		prev = lat
+	}
+	s.latency = sum / time.Duration(n)
+	if n > 1 {
+		s.jitter = jitterSum / time.Duration(n-1)
+	}
+	return s
+}
+
 // discoEndpoint.mu must be held.
 func (st *endpointState) addPongReplyLocked(r pongReply) {
 	if n := len(st.recentPongs); n < pongHistoryCount {
@@ -3758,10 +4361,64 @@ func (de *discoEndpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	de.sendPingsLocked(time.Now(), false)
 }
 
+// DebugState returns c's path discovery state, for bug reports.
+func (c *Conn) DebugState() *ipnstate.MagicsockDebug {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &ipnstate.MagicsockDebug{
+		LocalPort: c.LocalPort(),
+		DERPHome:  c.myDerp,
+		Endpoints: append([]string(nil), c.lastEndpoints...),
+	}
+	for _, de := range c.endpointOfDisco {
+		st.Peers = append(st.Peers, de.debugState())
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].NodeKey < st.Peers[j].NodeKey })
+	return st
+}
+
+func (de *discoEndpoint) debugState() ipnstate.PeerEndpointsDebug {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	ps := ipnstate.PeerEndpointsDebug{
+		NodeKey:            de.publicKey.ShortString(),
+		DiscoKey:           de.discoShort,
+		TrustBestAddrUntil: de.trustBestAddrUntil,
+		LastSend:           de.lastSend,
+		LastFullPing:       de.lastFullPing,
+	}
+	if !de.derpAddr.IsZero() {
+		ps.DERP = de.derpAddr.String()
+	}
+	if !de.bestAddr.IsZero() {
+		ps.BestAddr = de.bestAddr.String()
+		ps.BestAddrLatencySeconds = de.bestAddrLatency.Seconds()
+	}
+	for ipp, st := range de.endpointState {
+		ed := ipnstate.EndpointDebug{
+			Addr:            ipp.String(),
+			LastPing:        st.lastPing,
+			LastGotPing:     st.lastGotPing,
+			CallMeMaybeTime: st.callMeMaybeTime,
+		}
+		if len(st.recentPongs) > 0 {
+			pong := st.recentPongs[st.recentPong]
+			ed.LastPongAt = pong.pongAt
+			ed.LastPongLatencySeconds = pong.latency.Seconds()
+		}
+		ps.Endpoints = append(ps.Endpoints, ed)
+	}
+	sort.Slice(ps.Endpoints, func(i, j int) bool { return ps.Endpoints[i].Addr < ps.Endpoints[j].Addr })
+	return ps
+}
+
 func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	ps.Latencies = de.latencySamplesLocked()
+	ps.Paths = de.pathQualitiesLocked()
+
 	if de.lastSend.IsZero() {
 		return
 	}
@@ -3769,9 +4426,86 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	ps.LastWrite = de.lastSend
 
 	now := time.Now()
-	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
+	udpAddr, derpAddr := de.addrForSendLocked(now)
+	switch {
+	case !udpAddr.IsZero() && derpAddr.IsZero():
 		ps.CurAddr = udpAddr.String()
+		ps.PathType = "direct"
+	case !udpAddr.IsZero():
+		ps.PathType = "direct+derp"
+	case !derpAddr.IsZero():
+		ps.PathType = "derp"
+	}
+}
+
+// maxLatencySamples is the maximum number of disco latency samples
+// reported per peer in status.
+const maxLatencySamples = 16
+
+// latencySamplesLocked returns the most recent pongs from de's
+// endpoints, most recent first.
+//
+// de.mu must be held.
+func (de *discoEndpoint) latencySamplesLocked() []ipnstate.LatencySample {
+	var pongs []pongReply
+	for _, st := range de.endpointState {
+		pongs = append(pongs, st.recentPongs...)
+	}
+	if len(pongs) == 0 {
+		return nil
+	}
+	sort.Slice(pongs, func(i, j int) bool { return pongs[i].pongAt.After(pongs[j].pongAt) })
+	if len(pongs) > maxLatencySamples {
+		pongs = pongs[:maxLatencySamples]
+	}
+	ret := make([]ipnstate.LatencySample, len(pongs))
+	for i, p := range pongs {
+		ret[i] = ipnstate.LatencySample{
+			Endpoint:       p.from.String(),
+			At:             p.pongAt,
+			LatencySeconds: p.latency.Seconds(),
+		}
+	}
+	return ret
+}
+
+// pathQualitiesLocked returns the stats of the paths to de's
+// endpoints that have been pinged, best first.
+//
+// de.mu must be held.
+func (de *discoEndpoint) pathQualitiesLocked() []ipnstate.PathQuality {
+	type path struct {
+		ep  netaddr.IPPort
+		s   pathStats
+		mtu int
+	}
+	var paths []path
+	for ep, st := range de.endpointState {
+		if s := st.pathStatsLocked(); s.pings > 0 {
+			paths = append(paths, path{ep, s, st.mtu})
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if ci, cj := paths[i].s.cost(), paths[j].s.cost(); ci != cj {
+			return ci < cj
+		}
+		return paths[i].ep.String() < paths[j].ep.String()
+	})
+	ret := make([]ipnstate.PathQuality, len(paths))
+	for i, p := range paths {
+		ret[i] = ipnstate.PathQuality{
+			Endpoint:       p.ep.String(),
+			LatencySeconds: p.s.latency.Seconds(),
+			JitterSeconds:  p.s.jitter.Seconds(),
+			Loss:           p.s.loss,
+			Pings:          p.s.pings,
+			MTU:            p.mtu,
+		}
 	}
+	return ret
 }
 
 // stopAndReset stops timers associated with de and resets its state back to zero.
@@ -35,7 +35,11 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpmap"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
@@ -47,6 +51,7 @@ import (
 	"tailscale.com/types/wgkey"
 	"tailscale.com/util/cibuild"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/tstun"
 	"tailscale.com/wgengine/wgcfg"
 	"tailscale.com/wgengine/wgcfg/nmcfg"
@@ -399,6 +404,150 @@ func pickPort(t testing.TB) uint16 {
 	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
 }
 
+func TestSetPreferredPort(t *testing.T) {
+	conn := newNonLegacyTestConn(t)
+	defer conn.Close()
+	conn.Start()
+
+	port := pickPort(t)
+	conn.SetPreferredPort(port)
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("after SetPreferredPort(%d), LocalPort = %d", port, got)
+	}
+
+	conn.SetPreferredPort(0)
+	if got := conn.LocalPort(); got == port {
+		t.Errorf("after SetPreferredPort(0), still on port %d", got)
+	}
+}
+
+func TestLinkSig(t *testing.T) {
+	base := &interfaces.State{
+		InterfaceIPs: map[string][]netaddr.IPPrefix{
+			"lo":   {netaddr.MustParseIPPrefix("127.0.0.1/8")},
+			"eth0": {netaddr.MustParseIPPrefix("192.168.0.2/24")},
+		},
+		InterfaceUp:           map[string]bool{"lo": true, "eth0": true},
+		HaveV4:                true,
+		DefaultRouteInterface: "eth0",
+	}
+	sig := linkSig(base)
+
+	// A container's veth appearing with only a link-local address
+	// isn't relevant.
+	veth := *base
+	veth.InterfaceIPs = map[string][]netaddr.IPPrefix{
+		"lo":          base.InterfaceIPs["lo"],
+		"eth0":        base.InterfaceIPs["eth0"],
+		"veth1234abc": {netaddr.MustParseIPPrefix("fe80::1/64")},
+	}
+	veth.InterfaceUp = map[string]bool{"lo": true, "eth0": true, "veth1234abc": true}
+	if got := linkSig(&veth); got != sig {
+		t.Errorf("veth changed linkSig:\n got: %s\nwant: %s", got, sig)
+	}
+
+	// A new usable address is.
+	wifi := veth
+	wifi.InterfaceIPs = map[string][]netaddr.IPPrefix{
+		"eth0":  base.InterfaceIPs["eth0"],
+		"wlan0": {netaddr.MustParseIPPrefix("10.1.2.3/16")},
+	}
+	wifi.InterfaceUp = map[string]bool{"eth0": true, "wlan0": true}
+	if got := linkSig(&wifi); got == sig {
+		t.Errorf("new address didn't change linkSig: %s", got)
+	}
+}
+
+func TestLinkChangeScenario(t *testing.T) {
+	mon, fake := monitor.NewFake(t.Logf, nil)
+	defer mon.Close()
+
+	var mu sync.Mutex
+	var rebinds, skips int
+	restuns := map[string]int{} // endpoint updates by reason
+	logf := func(format string, args ...interface{}) {
+		t.Logf(format, args...)
+		msg := fmt.Sprintf(format, args...)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(msg, "link change, binding new port"):
+			rebinds++
+		case strings.Contains(msg, "link change not relevant"):
+			skips++
+		case strings.Contains(msg, "starting endpoint update (link-change-"):
+			why := msg[strings.Index(msg, "(")+1:]
+			restuns[strings.TrimSuffix(why, ")")]++
+		}
+	}
+	conn, err := NewConn(Options{
+		Logf:                    logf,
+		EndpointsFunc:           func([]string) {},
+		LinkMonitor:             mon,
+		DisableLegacyNetworking: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Start()
+	mon.RegisterChangeCallback(conn.LinkChange)
+	mon.Start()
+
+	waitCounts := func(step string, wantRebinds, wantSkips int) {
+		t.Helper()
+		var gotRebinds, gotSkips int
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			gotRebinds, gotSkips = rebinds, skips
+			mu.Unlock()
+			if gotRebinds == wantRebinds && gotSkips == wantSkips {
+				return
+			}
+		}
+		t.Fatalf("after %s: %d rebinds, %d skips; want %d, %d", step, gotRebinds, gotSkips, wantRebinds, wantSkips)
+	}
+
+	// A container's veth appearing needs neither a rebind nor a
+	// re-STUN.
+	if err := fake.Run(5*time.Second, monitor.AddInterface("veth1234abc", "fe80::1/64")); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts("veth", 0, 1)
+
+	// Nor does a new gateway handing out the same address.
+	if err := fake.Run(5*time.Second, monitor.GatewayChange("192.168.0.254", "192.168.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts("gateway change", 0, 2)
+
+	// Moving to another network needs a rebind.
+	renumber := func(f *monitor.Fake) { f.SetInterface("eth0", true, "10.1.2.3/16") }
+	if err := fake.Run(5*time.Second, renumber); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts("renumber", 1, 2)
+
+	// The rebind's re-STUN must be the only one: the irrelevant
+	// changes before it don't re-STUN.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		major := restuns["link-change-major"]
+		mu.Unlock()
+		if major > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no re-STUN after renumber")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(restuns) != 1 {
+		t.Errorf("re-STUNs by reason = %v; want only link-change-major", restuns)
+	}
+}
+
 func TestPickDERPFallback(t *testing.T) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1479,7 +1628,7 @@ func TestDerpReceiveFromIPv4(t *testing.T) {
 		}()
 	}
 
-	zeroSendsStart := testCounterZeroDerpReadResultSend.Value()
+	zeroSendsStart := conn.testCounterZeroDerpReadResultSend.Value()
 
 	buf := make([]byte, 1500)
 	for i := 0; i < sends; i++ {
@@ -1493,7 +1642,7 @@ func TestDerpReceiveFromIPv4(t *testing.T) {
 
 	t.Logf("did %d ReceiveIPv4 calls", sends)
 
-	zeroSends, zeroRecv := testCounterZeroDerpReadResultSend.Value(), testCounterZeroDerpReadResultRecv.Value()
+	zeroSends, zeroRecv := conn.testCounterZeroDerpReadResultSend.Value(), conn.testCounterZeroDerpReadResultRecv.Value()
 	if zeroSends != zeroRecv {
 		t.Errorf("did %d zero sends != %d corresponding receives", zeroSends, zeroRecv)
 	}
@@ -1608,6 +1757,26 @@ func TestGoMajorVersion(t *testing.T) {
 	}
 }
 
+func TestHomeDERP(t *testing.T) {
+	report := &netcheck.Report{
+		PreferredDERP: 1,
+		RegionLatency: map[int]time.Duration{1: 10 * time.Millisecond, 2: 50 * time.Millisecond},
+	}
+	tests := []struct {
+		preferred int
+		want      int
+	}{
+		{0, 1},
+		{2, 2},
+		{3, 1}, // preferred region down or not in the map
+	}
+	for _, tt := range tests {
+		if got := homeDERP(report, tt.preferred); got != tt.want {
+			t.Errorf("homeDERP(preferred=%d) = %d; want %d", tt.preferred, got, tt.want)
+		}
+	}
+}
+
 func TestReceiveFromAllocs(t *testing.T) {
 	// Go 1.16 and before: allow 3 allocs.
 	// Go Tailscale fork, Go 1.17+: only allow 2 allocs.
@@ -1624,6 +1793,32 @@ func TestReceiveFromAllocs(t *testing.T) {
 	}
 }
 
+// TestDerpSendAllocs enforces that sending a packet via an already
+// connected DERP region doesn't allocate, as the copy handed to the
+// DERP writer comes from derpWriteBufPool.
+func TestDerpSendAllocs(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+	c.derpMap = &tailcfg.DERPMap{}
+	ch := make(chan derpWriteRequest, 1)
+	lastWrite := time.Now()
+	c.activeDerp = map[int]activeDerp{1: {writeCh: ch, lastWrite: &lastWrite}}
+
+	addr := netaddr.IPPort{IP: derpMagicIPAddr, Port: 1}
+	pkt := make([]byte, 1280)
+	err := tstest.MinAllocsPerRun(t, 0, func() {
+		if sent, err := c.sendAddr(addr, key.Public{}, pkt); !sent || err != nil {
+			t.Fatalf("sendAddr = %v, %v; want true, nil", sent, err)
+		}
+		wr := <-ch
+		derpWriteBufPool.Put(wr.b)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
 func BenchmarkReceiveFrom(b *testing.B) {
 	roundTrip := setUpReceiveFrom(b)
 	for i := 0; i < b.N; i++ {
@@ -1793,3 +1988,162 @@ func TestRebindStress(t *testing.T) {
 		t.Fatalf("Got ReceiveIPv4 error: %v (is closed = %v). Log:\n%s", err, errors.Is(err, net.ErrClosed), logBuf.Bytes())
 	}
 }
+
+func TestLatencySamples(t *testing.T) {
+	ep1 := netaddr.MustParseIPPort("1.2.3.4:1")
+	ep2 := netaddr.MustParseIPPort("5.6.7.8:2")
+	t0 := time.Unix(1e9, 0)
+	de := &discoEndpoint{endpointState: map[netaddr.IPPort]*endpointState{
+		ep1: {},
+		ep2: {},
+	}}
+	for i := 0; i < maxLatencySamples; i++ {
+		at := t0.Add(time.Duration(2*i) * time.Second)
+		de.endpointState[ep1].addPongReplyLocked(pongReply{latency: time.Millisecond, pongAt: at, from: ep1})
+		de.endpointState[ep2].addPongReplyLocked(pongReply{latency: 2 * time.Millisecond, pongAt: at.Add(time.Second), from: ep2})
+	}
+	got := de.latencySamplesLocked()
+	if len(got) != maxLatencySamples {
+		t.Fatalf("got %d samples; want %d", len(got), maxLatencySamples)
+	}
+	for i := 1; i < len(got); i++ {
+		if !got[i].At.Before(got[i-1].At) {
+			t.Fatalf("samples not most recent first: %+v", got)
+		}
+	}
+	if got[0].Endpoint != ep2.String() || got[0].LatencySeconds != 0.002 {
+		t.Errorf("newest sample = %+v", got[0])
+	}
+
+	if got := (&discoEndpoint{}).latencySamplesLocked(); got != nil {
+		t.Errorf("no pongs: got %+v; want nil", got)
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	fast := netaddr.MustParseIPPort("1.2.3.4:1")   // 10ms, but lossy
+	steady := netaddr.MustParseIPPort("5.6.7.8:2") // 20ms, no loss
+	t0 := time.Unix(1e9, 0)
+	de := &discoEndpoint{
+		bestAddr: fast,
+		endpointState: map[netaddr.IPPort]*endpointState{
+			fast:   {},
+			steady: {},
+		},
+	}
+	for i := 0; i < pathStatsPings; i++ {
+		at := t0.Add(time.Duration(i) * time.Second)
+		if i%4 == 0 {
+			de.endpointState[fast].notePingResultLocked(true)
+		} else {
+			de.endpointState[fast].addPongReplyLocked(pongReply{latency: 10 * time.Millisecond, pongAt: at, from: fast})
+			de.endpointState[fast].notePingResultLocked(false)
+		}
+		lat := 18 * time.Millisecond
+		if i%2 == 0 {
+			lat = 22 * time.Millisecond
+		}
+		de.endpointState[steady].addPongReplyLocked(pongReply{latency: lat, pongAt: at, from: steady})
+		de.endpointState[steady].notePingResultLocked(false)
+	}
+
+	s := de.endpointState[fast].pathStatsLocked()
+	if s.latency != 10*time.Millisecond || s.jitter != 0 || s.loss != 0.25 || s.pings != pathStatsPings {
+		t.Errorf("fast stats = %+v", s)
+	}
+	s = de.endpointState[steady].pathStatsLocked()
+	if s.latency != 20*time.Millisecond || s.jitter != 4*time.Millisecond || s.loss != 0 {
+		t.Errorf("steady stats = %+v", s)
+	}
+	if !de.betterAddrLocked(steady) {
+		t.Errorf("lossless path not preferred to lossy one")
+	}
+
+	// Paths of about the same quality don't displace each other.
+	similar := netaddr.MustParseIPPort("9.9.9.9:3") // 19ms, no loss
+	de.endpointState[similar] = &endpointState{}
+	for i := 0; i < pathStatsPings; i++ {
+		de.endpointState[similar].addPongReplyLocked(pongReply{latency: 19 * time.Millisecond, pongAt: t0, from: similar})
+		de.endpointState[similar].notePingResultLocked(false)
+	}
+	de.bestAddr = steady
+	if de.betterAddrLocked(similar) {
+		t.Errorf("switched from 20ms to 19ms path")
+	}
+	de.bestAddr = similar
+	if de.betterAddrLocked(steady) {
+		t.Errorf("switched back from 19ms to 20ms path")
+	}
+	delete(de.endpointState, similar)
+	de.bestAddr = fast
+
+	got := de.pathQualitiesLocked()
+	if len(got) != 2 || got[0].Endpoint != steady.String() || got[1].Loss != 0.25 {
+		t.Errorf("pathQualities = %+v", got)
+	}
+
+	if got := (&discoEndpoint{}).pathQualitiesLocked(); got != nil {
+		t.Errorf("no pings: got %+v; want nil", got)
+	}
+}
+
+func TestMTUProbes(t *testing.T) {
+	for _, ep := range []netaddr.IPPort{
+		netaddr.MustParseIPPort("1.2.3.4:1"),
+		netaddr.MustParseIPPort("[2001:db8::1]:1"),
+	} {
+		for _, size := range mtuProbeSizes {
+			m := &disco.Ping{Padding: mtuProbePadding(ep, size)}
+			udp := len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen + box.Overhead + len(m.AppendMarshal(nil))
+			hdr := 28
+			if ep.IP.Is6() {
+				hdr = 48
+			}
+			if got := hdr + udp; got != size {
+				t.Errorf("probe of %d bytes to %v is %d bytes", size, ep, got)
+			}
+		}
+	}
+
+	ep := netaddr.MustParseIPPort("1.2.3.4:1")
+	st := &endpointState{}
+	de := &discoEndpoint{
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{ep: st},
+	}
+	probe := func(size int) stun.TxID {
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:      ep,
+			at:      time.Now(),
+			timer:   time.AfterFunc(time.Hour, func() {}),
+			purpose: pingMTUProbe,
+			size:    size,
+		}
+		return txid
+	}
+	// A previous round's result stands until this round's is in.
+	st.mtu, st.mtuKnown = 1500, true
+	st.mtuProbesLeft = len(mtuProbeSizes)
+	small, big, lost := probe(1280), probe(1400), probe(1500)
+	de.handlePongConnLocked(&disco.Pong{TxID: big}, ep)
+	de.handlePongConnLocked(&disco.Pong{TxID: small}, ep)
+	if st.mtu != 1500 {
+		t.Errorf("mtu mid-round = %d; want 1500", st.mtu)
+	}
+	de.pingTimeout(lost)
+	if st.mtu != 1400 || !st.mtuKnown {
+		t.Errorf("mtu = %d, known = %v; want 1400", st.mtu, st.mtuKnown)
+	}
+	if st.numPings != 0 || len(st.recentPongs) != 0 {
+		t.Errorf("probes counted as pings: %d pings, %d pongs", st.numPings, len(st.recentPongs))
+	}
+	if len(de.sentPing) != 0 {
+		t.Errorf("%d probes still outstanding", len(de.sentPing))
+	}
+
+	st.notePingResultLocked(false)
+	if got := de.pathQualitiesLocked(); len(got) != 1 || got[0].MTU != 1400 {
+		t.Errorf("pathQualities = %+v; want MTU 1400", got)
+	}
+}
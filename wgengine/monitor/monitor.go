@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/types/logger"
 )
@@ -36,28 +37,95 @@ type osMon interface {
 	Receive() (message, error)
 }
 
+// netState is how a Mon reads the state of the network. It's
+// osNetState for monitors created by New; fake backends supply their
+// own, alongside their osMon.
+type netState interface {
+	// interfaceState returns the state of the machine's network
+	// interfaces, without any Tailscale ones.
+	interfaceState() (*interfaces.State, error)
+
+	// gatewayAndSelfIP returns the default gateway and the
+	// machine's IP on its network, as interfaces.LikelyHomeRouterIP
+	// does.
+	gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool)
+
+	// networkID returns the ID of the network the machine is on,
+	// as described by Mon.NetworkID. m may be used to look up the
+	// gateway.
+	networkID(m *Mon) string
+}
+
+// osNetState is the netState of the operating system.
+type osNetState struct{}
+
+func (osNetState) interfaceState() (*interfaces.State, error) {
+	s, err := interfaces.GetState()
+	if s != nil {
+		s.RemoveTailscaleInterfaces()
+		s.RemoveUninterestingInterfacesAndAddresses()
+	}
+	return s, err
+}
+
+func (osNetState) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
+	return interfaces.LikelyHomeRouterIP()
+}
+
+func (osNetState) networkID(m *Mon) string {
+	if ssid := wifiSSID(); ssid != "" {
+		return "wifi:" + ssid
+	}
+	if gw, _, ok := m.GatewayAndSelfIP(); ok {
+		if mac := gatewayMAC(gw); mac != "" {
+			return "gw:" + mac
+		}
+	}
+	return ""
+}
+
 // ChangeFunc is a callback function that's called when the network
 // changed. The changed parameter is whether the network changed
 // enough for interfaces.State to have changed since the last
 // callback.
 type ChangeFunc func(changed bool, state *interfaces.State)
 
+// Event is a network change the monitor noticed, as returned by
+// RecentEvents.
+type Event struct {
+	Time time.Time
+
+	// Changed is whether the interfaces' state changed. Many OS
+	// notifications turn out not to matter.
+	Changed bool
+
+	// State is a summary of the interfaces' state after the event.
+	State string
+}
+
+// maxRecentEvents is how many events RecentEvents returns at most.
+const maxRecentEvents = 32
+
 // An allocated callbackHandle's address is the Mon.cbs map key.
 type callbackHandle byte
 
 // Mon represents a monitoring instance.
 type Mon struct {
 	logf   logger.Logf
-	om     osMon // nil means not supported on this platform
+	om     osMon    // nil means not supported on this platform
+	ns     netState // where the network state is read from
 	change chan struct{}
 	stop   chan struct{}
 
-	mu       sync.Mutex // guards cbs
-	cbs      map[*callbackHandle]ChangeFunc
-	ifState  *interfaces.State
-	gwValid  bool // whether gw and gwSelfIP are valid (cached)x
-	gw       netaddr.IP
-	gwSelfIP netaddr.IP
+	mu         sync.Mutex // guards cbs
+	cbs        map[*callbackHandle]ChangeFunc
+	ifState    *interfaces.State
+	gwValid    bool // whether gw and gwSelfIP are valid (cached)
+	gw         netaddr.IP
+	gwSelfIP   netaddr.IP
+	netIDValid bool // whether netID is valid (cached)
+	netID      string
+	events     []Event // most recent last; at most maxRecentEvents
 
 	onceStart  sync.Once
 	started    bool
@@ -68,9 +136,16 @@ type Mon struct {
 // The returned monitor is inactive until it's started by the Start method.
 // Use RegisterChangeCallback to get notified of network changes.
 func New(logf logger.Logf) (*Mon, error) {
+	return newMon(logf, osNetState{}, newOSMon)
+}
+
+// newMon returns a new monitor that reads the network state from ns
+// and learns of changes from the osMon returned by newOM.
+func newMon(logf logger.Logf, ns netState, newOM func(logger.Logf, *Mon) (osMon, error)) (*Mon, error) {
 	logf = logger.WithPrefix(logf, "monitor: ")
 	m := &Mon{
 		logf:   logf,
+		ns:     ns,
 		cbs:    map[*callbackHandle]ChangeFunc{},
 		change: make(chan struct{}, 1),
 		stop:   make(chan struct{}),
@@ -81,7 +156,7 @@ func New(logf logger.Logf) (*Mon, error) {
 	}
 	m.ifState = st
 
-	m.om, err = newOSMon(logf, m)
+	m.om, err = newOM(logf, m)
 	if err != nil {
 		return nil, err
 	}
@@ -101,26 +176,44 @@ func (m *Mon) InterfaceState() *interfaces.State {
 }
 
 func (m *Mon) interfaceStateUncached() (*interfaces.State, error) {
-	s, err := interfaces.GetState()
-	if s != nil {
-		s.RemoveTailscaleInterfaces()
-		s.RemoveUninterestingInterfacesAndAddresses()
+	return m.ns.interfaceState()
+}
+
+// DefaultRouteInterface returns the name and index of the interface
+// that has the machine's default route.
+//
+// It's answered from the monitor's interface state, which is kept
+// current by the OS's route and address notifications, so unlike
+// interfaces.DefaultRouteInterface it doesn't read the routing table.
+// The index is zero on platforms that don't report it.
+func (m *Mon) DefaultRouteInterface() (name string, index int, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ifState == nil || m.ifState.DefaultRouteInterface == "" {
+		return "", 0, false
 	}
-	return s, err
+	return m.ifState.DefaultRouteInterface, m.ifState.DefaultRouteInterfaceIndex, true
+}
+
+// Gateway returns the current network's default gateway.
+// Like GatewayAndSelfIP, the result is cached.
+func (m *Mon) Gateway() (gw netaddr.IP, ok bool) {
+	gw, _, ok = m.GatewayAndSelfIP()
+	return gw, ok
 }
 
 // GatewayAndSelfIP returns the current network's default gateway, and
 // the machine's default IP for that gateway.
 //
 // It's the same as interfaces.LikelyHomeRouterIP, but it caches the
-// result until the monitor detects a network change.
+// result until the OS next reports a route or address change.
 func (m *Mon) GatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.gwValid {
 		return m.gw, m.gwSelfIP, true
 	}
-	gw, myIP, ok = interfaces.LikelyHomeRouterIP()
+	gw, myIP, ok = m.ns.gatewayAndSelfIP()
 	if ok {
 		m.gw, m.gwSelfIP, m.gwValid = gw, myIP, true
 	}
@@ -207,9 +300,11 @@ func (m *Mon) pump() {
 			}
 			// Keep retrying while we're not closed.
 			m.logf("error from link monitor: %v", err)
+			health.SetLinkMonitorHealth(err)
 			time.Sleep(time.Second)
 			continue
 		}
+		health.SetLinkMonitorHealth(nil)
 		if msg.ignore() {
 			continue
 		}
@@ -232,10 +327,15 @@ func (m *Mon) debounce() {
 			m.logf("interfaces.State: %v", err)
 		} else {
 			m.mu.Lock()
+			// The gateway can change without the interface state
+			// changing (a new DHCP lease on the same interface,
+			// say), so forget it and the network ID derived from
+			// it on any route or address event.
+			m.gwValid = false
+			m.netIDValid = false
 			oldState := m.ifState
 			changed := !curState.Equal(oldState)
 			if changed {
-				m.gwValid = false
 				m.ifState = curState
 
 				if s1, s2 := oldState.String(), curState.String(); s1 == s2 {
@@ -243,8 +343,12 @@ func (m *Mon) debounce() {
 						jsonSummary(oldState), jsonSummary(curState))
 				}
 			}
+			m.recordEventLocked(changed)
+			// Callbacks get the state just read, which equals
+			// m.ifState, so a Fake can tell which read each
+			// delivery is of.
 			for _, cb := range m.cbs {
-				go cb(changed, m.ifState)
+				go cb(changed, curState)
 			}
 			m.mu.Unlock()
 		}
@@ -257,6 +361,28 @@ func (m *Mon) debounce() {
 	}
 }
 
+// recordEventLocked adds an event to those returned by RecentEvents.
+// m.mu must be held.
+func (m *Mon) recordEventLocked(changed bool) {
+	if len(m.events) == maxRecentEvents {
+		copy(m.events, m.events[1:])
+		m.events = m.events[:len(m.events)-1]
+	}
+	m.events = append(m.events, Event{
+		Time:    time.Now(),
+		Changed: changed,
+		State:   m.ifState.String(),
+	})
+}
+
+// RecentEvents returns the network changes m most recently noticed,
+// oldest first.
+func (m *Mon) RecentEvents() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event(nil), m.events...)
+}
+
 func jsonSummary(x interface{}) interface{} {
 	j, err := json.Marshal(x)
 	if err != nil {
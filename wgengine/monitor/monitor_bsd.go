@@ -2,6 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// +build darwin freebsd openbsd
+
 package monitor
 
 import (
@@ -12,6 +14,7 @@ import (
 	"golang.org/x/net/route"
 	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 )
 
@@ -29,20 +32,22 @@ func newOSMon(logf logger.Logf, _ *Mon) (osMon, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &darwinRouteMon{
+	return &routeSocketMon{
 		logf: logf,
 		fd:   fd,
 	}, nil
 }
 
-type darwinRouteMon struct {
+// routeSocketMon implements osMon using a BSD routing socket, which
+// gets the kernel's route and address change messages.
+type routeSocketMon struct {
 	logf      logger.Logf
 	fd        int // AF_ROUTE socket
 	buf       [2 << 10]byte
 	closeOnce sync.Once
 }
 
-func (m *darwinRouteMon) Close() error {
+func (m *routeSocketMon) Close() error {
 	var err error
 	m.closeOnce.Do(func() {
 		err = unix.Close(m.fd)
@@ -50,7 +55,7 @@ func (m *darwinRouteMon) Close() error {
 	return err
 }
 
-func (m *darwinRouteMon) Receive() (message, error) {
+func (m *routeSocketMon) Receive() (message, error) {
 	for {
 		n, err := unix.Read(m.fd, m.buf[:])
 		if err != nil {
@@ -86,23 +91,39 @@ func (m *darwinRouteMon) Receive() (message, error) {
 	}
 }
 
-func (m *darwinRouteMon) skipMessage(msg route.Message) bool {
-	switch msg.(type) {
-	case *route.InterfaceMulticastAddrMessage:
+func (m *routeSocketMon) skipMessage(msg route.Message) bool {
+	if isMulticastAddrMessage(msg) {
 		return true
 	}
+	if rm, ok := msg.(*route.RouteMessage); ok {
+		// Routes to Tailscale IPs are the ones we add ourselves.
+		if len(rm.Addrs) > unix.RTAX_DST && tsaddr.IsTailscaleIP(routeAddrIP(rm.Addrs[unix.RTAX_DST])) {
+			return true
+		}
+	}
 	return false
 }
 
-func (m *darwinRouteMon) logMessages(msgs []route.Message) {
+// routeAddrIP returns the IP address of a, or the zero IP if a isn't
+// an IP address.
+func routeAddrIP(a route.Addr) netaddr.IP {
+	switch a := a.(type) {
+	case *route.Inet4Addr:
+		return netaddr.IPv4(a.IP[0], a.IP[1], a.IP[2], a.IP[3])
+	case *route.Inet6Addr:
+		return netaddr.IPv6Raw(a.IP)
+	}
+	return netaddr.IP{}
+}
+
+func (m *routeSocketMon) logMessages(msgs []route.Message) {
 	for i, msg := range msgs {
+		if m.logMulticastAddrMessage(i, msg) {
+			continue
+		}
 		switch msg := msg.(type) {
 		default:
 			m.logf("  [%d] %T", i, msg)
-		case *route.InterfaceMulticastAddrMessage:
-			m.logf("  [%d] InterfaceMulticastAddrMessage: ver=%d, type=%v, flags=0x%x, idx=%v",
-				i, msg.Version, msg.Type, msg.Flags, msg.Index)
-			m.logAddrs(msg.Addrs)
 		case *route.RouteMessage:
 			log.Printf("  [%d] RouteMessage: ver=%d, type=%v, flags=0x%x, idx=%v, id=%v, seq=%v, err=%v",
 				i, msg.Version, msg.Type, msg.Flags, msg.Index, msg.ID, msg.Seq, msg.Err)
@@ -111,7 +132,7 @@ func (m *darwinRouteMon) logMessages(msgs []route.Message) {
 	}
 }
 
-func (m *darwinRouteMon) logAddrs(addrs []route.Addr) {
+func (m *routeSocketMon) logAddrs(addrs []route.Addr) {
 	for i, a := range addrs {
 		if a == nil {
 			continue
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin freebsd
+
+package monitor
+
+import "golang.org/x/net/route"
+
+func isMulticastAddrMessage(msg route.Message) bool {
+	_, ok := msg.(*route.InterfaceMulticastAddrMessage)
+	return ok
+}
+
+// logMulticastAddrMessage logs msg, the i'th in a batch, if it's an
+// InterfaceMulticastAddrMessage, and reports whether it was.
+func (m *routeSocketMon) logMulticastAddrMessage(i int, msg route.Message) bool {
+	mm, ok := msg.(*route.InterfaceMulticastAddrMessage)
+	if !ok {
+		return false
+	}
+	m.logf("  [%d] InterfaceMulticastAddrMessage: ver=%d, type=%v, flags=0x%x, idx=%v",
+		i, mm.Version, mm.Type, mm.Flags, mm.Index)
+	m.logAddrs(mm.Addrs)
+	return true
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/types/logger"
+)
+
+// Fake is a fake operating system network backend for a Mon: it's
+// both the Mon's osMon and where it reads the network state from.
+//
+// It lets tests of code that reacts to network changes (wgengine,
+// the DNS manager, magicsock, etc) script sequences of interface and
+// gateway changes without needing a particular OS or privileges to
+// change the real network configuration.
+type Fake struct {
+	msgs      chan message
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	st     *interfaces.State
+	gw     netaddr.IP
+	selfIP netaddr.IP
+	netID  string
+	mon    *Mon
+
+	// seq counts the changes made to the fake network, and
+	// readSeq records the seq of each state the Mon has read and
+	// not yet delivered to Run's callback, so Run can tell which
+	// deliveries include a step's change.
+	seq     uint64
+	readSeq map[*interfaces.State]uint64
+}
+
+var (
+	_ osMon    = (*Fake)(nil)
+	_ netState = (*Fake)(nil)
+)
+
+// NewFake returns a new Mon whose view of the network comes from the
+// returned Fake rather than from the operating system.
+//
+// st is the initial interface state. If nil, the machine starts with
+// a single interface "eth0", up, with address 192.168.0.2/24 behind
+// gateway 192.168.0.1, that has the default route.
+func NewFake(logf logger.Logf, st *interfaces.State) (*Mon, *Fake) {
+	f := &Fake{
+		msgs:    make(chan message, 1),
+		closed:  make(chan struct{}),
+		readSeq: map[*interfaces.State]uint64{},
+	}
+	if st == nil {
+		st = &interfaces.State{
+			InterfaceIPs: map[string][]netaddr.IPPrefix{
+				"eth0": {netaddr.MustParseIPPrefix("192.168.0.2/24")},
+			},
+			InterfaceUp:                map[string]bool{"eth0": true},
+			DefaultRouteInterface:      "eth0",
+			DefaultRouteInterfaceIndex: 2,
+		}
+		f.gw = netaddr.MustParseIP("192.168.0.1")
+		f.selfIP = netaddr.MustParseIP("192.168.0.2")
+	}
+	f.st = cloneState(st)
+	recomputeState(f.st)
+
+	// newMon can't fail: neither the fake's interfaceState nor
+	// its osMon constructor returns an error.
+	m, _ := newMon(logf, f, func(logger.Logf, *Mon) (osMon, error) { return f, nil })
+	f.mon = m
+	return m, f
+}
+
+type fakeMessage struct{}
+
+func (fakeMessage) ignore() bool { return false }
+
+// Close implements osMon.
+func (f *Fake) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// Receive implements osMon.
+func (f *Fake) Receive() (message, error) {
+	select {
+	case msg := <-f.msgs:
+		return msg, nil
+	case <-f.closed:
+		return nil, errors.New("fake monitor closed")
+	}
+}
+
+// notify counts a change and wakes up the Mon, as an OS route or
+// link message would.
+func (f *Fake) notify() {
+	f.mu.Lock()
+	f.seq++
+	f.mu.Unlock()
+
+	select {
+	case f.msgs <- fakeMessage{}:
+	default:
+		// A message is already pending.
+	}
+}
+
+// State returns a copy of the fake's current interface state.
+func (f *Fake) State() *interfaces.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return cloneState(f.st)
+}
+
+// interfaceState implements netState.
+func (f *Fake) interfaceState() (*interfaces.State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := cloneState(f.st)
+	if f.mon != nil {
+		f.readSeq[st] = f.seq
+	}
+	return st, nil
+}
+
+// takeReadSeq returns the seq of the last change before st was read,
+// and forgets st along with any states read no later, whose
+// deliveries can no longer be the first of a newer change.
+func (f *Fake) takeReadSeq(st *interfaces.State) (seq uint64, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seq, ok = f.readSeq[st]
+	if ok {
+		for s, n := range f.readSeq {
+			if n <= seq {
+				delete(f.readSeq, s)
+			}
+		}
+	}
+	return seq, ok
+}
+
+// gatewayAndSelfIP implements netState.
+func (f *Fake) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gw, f.selfIP, !f.gw.IsZero() && !f.selfIP.IsZero()
+}
+
+// networkID implements netState.
+func (f *Fake) networkID(*Mon) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.netID
+}
+
+// SetNetworkID sets the network ID, such as "wifi:CoffeeShop", and
+// notifies the Mon of a change.
+func (f *Fake) SetNetworkID(id string) {
+	f.mu.Lock()
+	f.netID = id
+	f.mu.Unlock()
+	f.notify()
+}
+
+// Update calls fn with a copy of the current interface state, which
+// fn may modify, and then makes it the current state and notifies
+// the Mon of a change. HaveV4 and HaveV6Global are recomputed from
+// the interfaces after fn returns.
+func (f *Fake) Update(fn func(*interfaces.State)) {
+	f.mu.Lock()
+	st := cloneState(f.st)
+	fn(st)
+	recomputeState(st)
+	f.st = st
+	f.mu.Unlock()
+	f.notify()
+}
+
+// SetInterface adds or replaces the named interface, with the given
+// up state and addresses (in CIDR form).
+func (f *Fake) SetInterface(name string, up bool, addrs ...string) {
+	pfxs := make([]netaddr.IPPrefix, len(addrs))
+	for i, a := range addrs {
+		pfxs[i] = netaddr.MustParseIPPrefix(a)
+	}
+	f.Update(func(st *interfaces.State) {
+		st.InterfaceUp[name] = up
+		st.InterfaceIPs[name] = pfxs
+	})
+}
+
+// SetLinkUp sets whether the named interface is up.
+func (f *Fake) SetLinkUp(name string, up bool) {
+	f.Update(func(st *interfaces.State) {
+		st.InterfaceUp[name] = up
+	})
+}
+
+// RemoveInterface removes the named interface.
+func (f *Fake) RemoveInterface(name string) {
+	f.Update(func(st *interfaces.State) {
+		delete(st.InterfaceUp, name)
+		delete(st.InterfaceIPs, name)
+	})
+}
+
+// SetGateway sets the default gateway and the machine's IP on the
+// gateway's network, and notifies the Mon of a change.
+func (f *Fake) SetGateway(gw, myIP netaddr.IP) {
+	f.mu.Lock()
+	f.gw, f.selfIP = gw, myIP
+	f.mu.Unlock()
+	f.notify()
+}
+
+// A Step is one step of a scripted network change scenario.
+// See Fake.Run.
+type Step func(*Fake)
+
+// LinkUp returns a Step that brings up the named interface.
+func LinkUp(name string) Step { return func(f *Fake) { f.SetLinkUp(name, true) } }
+
+// LinkDown returns a Step that takes down the named interface.
+func LinkDown(name string) Step { return func(f *Fake) { f.SetLinkUp(name, false) } }
+
+// AddInterface returns a Step that adds the named interface, up,
+// with the given addresses in CIDR form.
+func AddInterface(name string, addrs ...string) Step {
+	return func(f *Fake) { f.SetInterface(name, true, addrs...) }
+}
+
+// RemoveInterface returns a Step that removes the named interface.
+func RemoveInterface(name string) Step { return func(f *Fake) { f.RemoveInterface(name) } }
+
+// GatewayChange returns a Step that changes the default gateway to
+// gw, with the machine having address myIP on its network.
+func GatewayChange(gw, myIP string) Step {
+	return func(f *Fake) { f.SetGateway(netaddr.MustParseIP(gw), netaddr.MustParseIP(myIP)) }
+}
+
+// Run applies each step in order, waiting after each for the Mon to
+// deliver a state it read after the step's changes to its registered
+// callbacks before applying the next. The Mon must have been started.
+//
+// It returns an error if a change isn't delivered within the timeout.
+func (f *Fake) Run(timeout time.Duration, steps ...Step) error {
+	for i, step := range steps {
+		done := make(chan struct{}, 1)
+		var wantMu sync.Mutex
+		var want uint64 // the seq after step; 0 until it's applied
+		unregister := f.mon.RegisterChangeCallback(func(_ bool, st *interfaces.State) {
+			wantMu.Lock()
+			defer wantMu.Unlock()
+			seq, ok := f.takeReadSeq(st)
+			if ok && want != 0 && seq >= want {
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			}
+		})
+		wantMu.Lock()
+		step(f)
+		f.mu.Lock()
+		want = f.seq
+		f.mu.Unlock()
+		wantMu.Unlock()
+
+		select {
+		case <-done:
+			unregister()
+		case <-time.After(timeout):
+			unregister()
+			return fmt.Errorf("monitor: timeout waiting for step %d to be delivered", i)
+		}
+	}
+	return nil
+}
+
+// cloneState returns a deep copy of st.
+func cloneState(st *interfaces.State) *interfaces.State {
+	st2 := *st
+	st2.InterfaceIPs = make(map[string][]netaddr.IPPrefix, len(st.InterfaceIPs))
+	for k, v := range st.InterfaceIPs {
+		st2.InterfaceIPs[k] = append([]netaddr.IPPrefix(nil), v...)
+	}
+	st2.InterfaceUp = make(map[string]bool, len(st.InterfaceUp))
+	for k, v := range st.InterfaceUp {
+		st2.InterfaceUp[k] = v
+	}
+	return &st2
+}
+
+var v6Global = netaddr.MustParseIPPrefix("2000::/3")
+
+// recomputeState sets st's HaveV4 and HaveV6Global from its
+// interfaces, the same way interfaces.GetState does.
+func recomputeState(st *interfaces.State) {
+	st.HaveV4, st.HaveV6Global = false, false
+	for name, up := range st.InterfaceUp {
+		if !up {
+			continue
+		}
+		for _, pfx := range st.InterfaceIPs[name] {
+			if pfx.IP.IsLoopback() || pfx.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			st.HaveV4 = st.HaveV4 || pfx.IP.Is4()
+			st.HaveV6Global = st.HaveV6Global || v6Global.Contains(pfx.IP)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monitor
+
+import "golang.org/x/net/route"
+
+// OpenBSD's routing socket has no multicast address messages.
+
+func isMulticastAddrMessage(route.Message) bool { return false }
+
+func (m *routeSocketMon) logMulticastAddrMessage(int, route.Message) bool { return false }
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !linux,!freebsd,!windows,!darwin android
+// +build !linux,!freebsd,!openbsd,!windows,!darwin android
 
 package monitor
 
@@ -6,9 +6,12 @@ package monitor
 
 import (
 	"flag"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/net/interfaces"
 )
 
@@ -56,6 +59,175 @@ func TestMonitorInjectEvent(t *testing.T) {
 	}
 }
 
+func TestMonitorRecentEvents(t *testing.T) {
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+	got := make(chan bool, 1)
+	mon.RegisterChangeCallback(func(changed bool, state *interfaces.State) {
+		select {
+		case got <- true:
+		default:
+		}
+	})
+	mon.Start()
+	mon.InjectEvent()
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for callback")
+	}
+	evs := mon.RecentEvents()
+	if len(evs) == 0 {
+		t.Fatal("no events recorded")
+	}
+	if evs[0].Time.IsZero() || evs[0].State == "" {
+		t.Errorf("event = %+v", evs[0])
+	}
+
+	mon.mu.Lock()
+	for i := 0; i < maxRecentEvents+5; i++ {
+		mon.recordEventLocked(false)
+	}
+	mon.mu.Unlock()
+	if n := len(mon.RecentEvents()); n != maxRecentEvents {
+		t.Errorf("after many events, got %d; want %d", n, maxRecentEvents)
+	}
+}
+
+func TestFakeScenario(t *testing.T) {
+	mon, fake := NewFake(t.Logf, nil)
+	defer mon.Close()
+
+	var mu sync.Mutex
+	var ups []bool
+	mon.RegisterChangeCallback(func(changed bool, st *interfaces.State) {
+		if !changed {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ups = append(ups, st.AnyInterfaceUp())
+	})
+	mon.Start()
+
+	err := fake.Run(5*time.Second,
+		LinkDown("eth0"),
+		LinkUp("eth0"),
+		AddInterface("wlan0", "2001:db8::2/64"),
+		GatewayChange("10.0.0.1", "10.0.0.5"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := mon.InterfaceState(); !st.HaveV6Global || !st.InterfaceUp["wlan0"] {
+		t.Errorf("state after scenario = %v; want wlan0 up with global IPv6", st)
+	}
+	gw, myIP, ok := mon.GatewayAndSelfIP()
+	if !ok || gw != netaddr.MustParseIP("10.0.0.1") || myIP != netaddr.MustParseIP("10.0.0.5") {
+		t.Errorf("GatewayAndSelfIP = %v, %v, %v; want 10.0.0.1, 10.0.0.5, true", gw, myIP, ok)
+	}
+	if gw, ok := mon.Gateway(); !ok || gw != netaddr.MustParseIP("10.0.0.1") {
+		t.Errorf("Gateway = %v, %v; want 10.0.0.1, true", gw, ok)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []bool{false, true, true}; !reflect.DeepEqual(ups, want) {
+		t.Errorf("AnyInterfaceUp on changes = %v; want %v", ups, want)
+	}
+}
+
+func TestFakeReadSeq(t *testing.T) {
+	mon, fake := NewFake(t.Logf, nil)
+	defer mon.Close()
+
+	// A gateway change leaves the interface state as it was, so
+	// only the sequence of changes tells whether a state the Mon
+	// delivers was read before or after it.
+	before, _ := fake.interfaceState()
+	fake.SetGateway(netaddr.MustParseIP("10.0.0.1"), netaddr.MustParseIP("10.0.0.5"))
+	after, _ := fake.interfaceState()
+	if !before.Equal(after) {
+		t.Fatal("gateway change changed the interface state")
+	}
+	seqBefore, ok1 := fake.takeReadSeq(before)
+	seqAfter, ok2 := fake.takeReadSeq(after)
+	if !ok1 || !ok2 || seqBefore >= seqAfter {
+		t.Errorf("read seqs = %d (%v), %d (%v); want the later read's to be larger", seqBefore, ok1, seqAfter, ok2)
+	}
+	if _, ok := fake.takeReadSeq(after); ok {
+		t.Error("delivered state still has a seq")
+	}
+}
+
+func TestFakeNetworkID(t *testing.T) {
+	mon, fake := NewFake(t.Logf, nil)
+	defer mon.Close()
+	mon.Start()
+
+	if id := mon.NetworkID(); id != "" {
+		t.Errorf("initial NetworkID = %q; want empty", id)
+	}
+	// The ID is cached, but not across a change notification, even
+	// one that doesn't change the interfaces.
+	join := func(f *Fake) { f.SetNetworkID("wifi:CoffeeShop") }
+	if err := fake.Run(5*time.Second, join); err != nil {
+		t.Fatal(err)
+	}
+	if id := mon.NetworkID(); id != "wifi:CoffeeShop" {
+		t.Errorf("NetworkID = %q; want wifi:CoffeeShop", id)
+	}
+}
+
+func TestDefaultRouteInterface(t *testing.T) {
+	mon, fake := NewFake(t.Logf, nil)
+	defer mon.Close()
+
+	if name, idx, ok := mon.DefaultRouteInterface(); !ok || name != "eth0" || idx != 2 {
+		t.Errorf("DefaultRouteInterface = %q, %v, %v; want eth0, 2, true", name, idx, ok)
+	}
+
+	changes := make(chan bool, 1)
+	mon.RegisterChangeCallback(func(changed bool, _ *interfaces.State) {
+		if changed {
+			changes <- true
+		}
+	})
+	mon.Start()
+	waitChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change")
+		}
+	}
+
+	fake.Update(func(st *interfaces.State) {
+		st.InterfaceUp["wlan0"] = true
+		st.InterfaceIPs["wlan0"] = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.5/24")}
+		st.DefaultRouteInterface = "wlan0"
+		st.DefaultRouteInterfaceIndex = 3
+	})
+	waitChange()
+	if name, idx, ok := mon.DefaultRouteInterface(); !ok || name != "wlan0" || idx != 3 {
+		t.Errorf("after change, DefaultRouteInterface = %q, %v, %v; want wlan0, 3, true", name, idx, ok)
+	}
+
+	fake.Update(func(st *interfaces.State) {
+		st.DefaultRouteInterface = ""
+		st.DefaultRouteInterfaceIndex = 0
+	})
+	waitChange()
+	if name, _, ok := mon.DefaultRouteInterface(); ok {
+		t.Errorf("with no default route, DefaultRouteInterface = %q, true; want false", name)
+	}
+}
+
 var monitor = flag.String("monitor", "", `go into monitor mode like 'route monitor'; test never terminates. Value can be either "raw" or "callback"`)
 
 func TestMonitorMode(t *testing.T) {
@@ -87,3 +259,36 @@ func TestMonitorMode(t *testing.T) {
 		select {}
 	}
 }
+
+func TestParseSSID(t *testing.T) {
+	tests := []struct {
+		name, out, want string
+	}{
+		{"airport", "     agrCtlRSSI: -52\n          BSSID: 0:1a:2b:3c:4d:5e\n           SSID: Coffee Shop\n            MCS: 9\n", "Coffee Shop"},
+		{"netsh", "    Name                   : Wi-Fi\r\n    BSSID                  : 00:1a:2b:3c:4d:5e\r\n    SSID                   : Home\r\n", "Home"},
+		{"disconnected", "    Name                   : Wi-Fi\r\n    State                  : disconnected\r\n", ""},
+	}
+	for _, tt := range tests {
+		if got := parseSSID(tt.out); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseARP(t *testing.T) {
+	gw := netaddr.MustParseIP("192.168.1.1")
+	tests := []struct {
+		name, out, want string
+	}{
+		{"linux", "IP address       HW type     Flags       HW address            Mask     Device\n192.168.1.10     0x1         0x2         11:22:33:44:55:66     *        eth0\n192.168.1.1      0x1         0x2         AA:bb:cc:dd:ee:ff     *        eth0\n", "aa:bb:cc:dd:ee:ff"},
+		{"linux-incomplete", "192.168.1.1      0x1         0x0         00:00:00:00:00:00     *        eth0\n", ""},
+		{"darwin", "? (192.168.1.1) at 0:1b:2c:3d:4e:f on en0 ifscope [ethernet]\n", "00:1b:2c:3d:4e:0f"},
+		{"windows", "\r\nInterface: 192.168.1.10 --- 0xb\r\n  Internet Address      Physical Address      Type\r\n  192.168.1.1           aa-bb-cc-dd-ee-ff     dynamic\r\n", "aa:bb:cc:dd:ee:ff"},
+		{"missing", "? (192.168.1.10) at 11:22:33:44:55:66 on en0\n", ""},
+	}
+	for _, tt := range tests {
+		if got := parseARP(tt.out, gw); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// NetworkID returns an identifier for the network the machine is
+// on, stable across visits to it, or the empty string if it can't
+// be determined.
+//
+// On Wi-Fi, it's "wifi:" followed by the network's SSID. Otherwise
+// it's "gw:" followed by the MAC address of the default gateway.
+// Like GatewayAndSelfIP, the result is cached until the monitor
+// detects a network change.
+func (m *Mon) NetworkID() string {
+	m.mu.Lock()
+	id, ok := m.netID, m.netIDValid
+	m.mu.Unlock()
+	if ok {
+		return id
+	}
+
+	id = m.ns.networkID(m)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.netID, m.netIDValid = id, true
+	return id
+}
+
+// parseSSID returns the SSID from the output of a command that
+// describes the current Wi-Fi connection with "SSID: name" lines,
+// such as macOS's airport -I or Windows' netsh wlan show interfaces.
+func parseSSID(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 || strings.TrimSpace(line[:i]) != "SSID" {
+			continue
+		}
+		return strings.TrimSpace(line[i+1:])
+	}
+	return ""
+}
+
+// parseARP returns the MAC address of ip, normalized to lowercase
+// colon-separated form, from an ARP table listing: Linux's
+// /proc/net/arp, or the output of arp on macOS or Windows.
+func parseARP(out string, ip netaddr.IP) string {
+	want := ip.String()
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		found := false
+		for _, f := range fields {
+			if strings.Trim(f, "()") == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		for _, f := range fields {
+			if mac, ok := parseMAC(f); ok {
+				return mac
+			}
+		}
+	}
+	return ""
+}
+
+// parseMAC parses a 48-bit MAC address separated by colons or
+// hyphens. Unlike net.ParseMAC, it accepts the single digit octets
+// that macOS's arp prints.
+func parseMAC(s string) (string, bool) {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 6 {
+		return "", false
+	}
+	var b strings.Builder
+	for i, p := range parts {
+		if len(p) > 2 {
+			return "", false
+		}
+		v, err := strconv.ParseUint(p, 16, 8)
+		if err != nil {
+			return "", false
+		}
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		fmt.Fprintf(&b, "%02x", v)
+	}
+	mac := b.String()
+	if mac == "00:00:00:00:00:00" {
+		// Incomplete ARP entry.
+		return "", false
+	}
+	return mac, true
+}
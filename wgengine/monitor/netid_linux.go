@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !android
+
+package monitor
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+func wifiSSID() string {
+	out, err := exec.Command("iwgetid", "--raw").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func gatewayMAC(gw netaddr.IP) string {
+	b, err := ioutil.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	return parseARP(string(b), gw)
+}
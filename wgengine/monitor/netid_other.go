@@ -0,0 +1,13 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin,!windows android
+
+package monitor
+
+import "inet.af/netaddr"
+
+func wifiSSID() string { return "" }
+
+func gatewayMAC(gw netaddr.IP) string { return "" }
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monitor
+
+import (
+	"os/exec"
+
+	"inet.af/netaddr"
+)
+
+func wifiSSID() string {
+	out, err := exec.Command("netsh", "wlan", "show", "interfaces").Output()
+	if err != nil {
+		return ""
+	}
+	return parseSSID(string(out))
+}
+
+func gatewayMAC(gw netaddr.IP) string {
+	out, err := exec.Command("arp", "-a", gw.String()).Output()
+	if err != nil {
+		return ""
+	}
+	return parseARP(string(out), gw)
+}
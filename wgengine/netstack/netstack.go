@@ -34,6 +34,7 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/dnsname"
@@ -55,6 +56,9 @@ type Impl struct {
 	e       wgengine.Engine
 	mc      *magicsock.Conn
 	logf    logger.Logf
+	raw     *rawForwarder
+
+	dialSubnet func(ctx context.Context, network, addr string) (net.Conn, error) // for tests; if non-nil, replaces net.Dialer for subnet hosts
 
 	mu  sync.Mutex
 	dns DNSMap
@@ -77,13 +81,44 @@ func Create(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsoc
 	if e == nil {
 		return nil, errors.New("nil Engine")
 	}
-	ipstack := stack.New(stack.Options{
+	ipstack, linkEP, err := newIPStack()
+	if err != nil {
+		return nil, err
+	}
+	ns := &Impl{
+		logf:    logf,
+		ipstack: ipstack,
+		linkEP:  linkEP,
+		tundev:  tundev,
+		e:       e,
+		mc:      mc,
+		raw:     newRawForwarder(logf, tundev.InjectOutbound),
+	}
+	return ns, nil
+}
+
+// newIPStack returns a netstack with one NIC, whose packets go
+// through linkEP, that handles packets to and from any address.
+func newIPStack() (ipstack *stack.Stack, linkEP *channel.Endpoint, err error) {
+	ipstack = stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
-	linkEP := channel.New(512, mtu, "")
+	linkEP = channel.New(512, mtu, "")
 	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
-		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+		return nil, nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+	}
+	// The NIC only accepts packets to, and sends packets from, the
+	// addresses registered to it: the node's Tailscale IPs. Lift
+	// that, so connections to hosts on advertised subnets can be
+	// terminated here and forwarded, as there's no kernel to route
+	// them. The packet filter has already dropped packets to any
+	// destination the node doesn't route.
+	if tcpipProblem := ipstack.SetPromiscuousMode(nicID, true); tcpipProblem != nil {
+		return nil, nil, fmt.Errorf("could not set netstack NIC promiscuous: %v", tcpipProblem)
+	}
+	if tcpipProblem := ipstack.SetSpoofing(nicID, true); tcpipProblem != nil {
+		return nil, nil, fmt.Errorf("could not enable netstack NIC spoofing: %v", tcpipProblem)
 	}
 	// Add IPv4 and IPv6 default routes, so all incoming packets from the Tailscale side
 	// are handled by the one fake NIC we use.
@@ -99,15 +134,7 @@ func Create(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsoc
 			NIC:         nicID,
 		},
 	})
-	ns := &Impl{
-		logf:    logf,
-		ipstack: ipstack,
-		linkEP:  linkEP,
-		tundev:  tundev,
-		e:       e,
-		mc:      mc,
-	}
-	return ns, nil
+	return ipstack, linkEP, nil
 }
 
 // Start sets up all the handlers so netstack can start working. Implements
@@ -311,6 +338,10 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.TUN) filter.Response {
 	if debugNetstack {
 		ns.logf("[v2] packet in (from %v): % x", p.Src, p.Buffer())
 	}
+	if ns.raw.handles(p) {
+		ns.raw.forward(p)
+		return filter.Accept
+	}
 	vv := buffer.View(append([]byte(nil), p.Buffer()...)).ToVectorisedView()
 	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 		Data: vv,
@@ -325,6 +356,11 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		// ForwarderRequest: &{{{{0 0}}} 0xc0001c30b0 0xc0004c3d40 {1240 6 true 826109390 0 true}
 		ns.logf("[v2] ForwarderRequest: %v", r)
 	}
+	id := r.ID()
+	if dst, ok := subnetDst(id.LocalAddress, id.LocalPort); ok {
+		ns.forwardSubnetTCP(r, dst)
+		return
+	}
 	var wq waiter.Queue
 	ep, err := r.CreateEndpoint(&wq)
 	if err != nil {
@@ -388,6 +424,67 @@ func (ns *Impl) forwardTCP(client *gonet.TCPConn, wq *waiter.Queue, port uint16)
 	ns.logf("[v2] netstack: forwarder connection on port %v closed", port)
 }
 
+// subnetDialTimeout is how long forwardSubnetTCP waits to connect to a
+// host on an advertised subnet.
+const subnetDialTimeout = 10 * time.Second
+
+// subnetDst returns the address of the host on an advertised subnet
+// that a connection to addr:port is for, or false if addr is one of
+// the node's Tailscale IPs.
+func subnetDst(addr tcpip.Address, port uint16) (netaddr.IPPort, bool) {
+	ip, ok := netaddr.FromStdIP(net.IP(addr))
+	if !ok || tsaddr.IsTailscaleIP(ip) {
+		return netaddr.IPPort{}, false
+	}
+	return netaddr.IPPort{IP: ip, Port: port}, true
+}
+
+// forwardSubnetTCP forwards r's connection to dst, a host on an
+// advertised subnet, as a kernel router would forward its packets.
+// The peer's connection is only accepted once dst accepts ours, and
+// is reset if dst can't be reached, so the peer sees what it would
+// have if it were talking to dst directly.
+func (ns *Impl) forwardSubnetTCP(r *tcp.ForwarderRequest, dst netaddr.IPPort) {
+	dial := ns.dialSubnet
+	if dial == nil {
+		var stdDialer net.Dialer
+		dial = stdDialer.DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), subnetDialTimeout)
+	server, err := dial(ctx, "tcp", dst.String())
+	cancel()
+	if err != nil {
+		ns.logf("[v2] netstack: could not connect to subnet host %v: %v", dst, err)
+		r.Complete(true)
+		return
+	}
+	defer server.Close()
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	client := gonet.NewTCPConn(&wq, ep)
+	defer client.Close()
+
+	ns.logf("[v2] netstack: forwarding connection to subnet host %v", dst)
+	connClosed := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(server, client)
+		connClosed <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, server)
+		connClosed <- err
+	}()
+	if err := <-connClosed; err != nil {
+		ns.logf("[v2] netstack: connection to subnet host %v closed with error: %v", dst, err)
+	}
+}
+
 func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 	ns.logf("[v2] UDP ForwarderRequest: %v", r)
 	var wq waiter.Queue
@@ -405,9 +502,45 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 		return
 	}
 	c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+	if dst, ok := subnetDst(localAddr.Addr, localAddr.Port); ok {
+		go ns.forwardSubnetUDP(c, remoteAddr, dst)
+		return
+	}
 	go ns.forwardUDP(c, &wq, localAddr, remoteAddr)
 }
 
+// forwardSubnetUDP forwards the UDP packets of a peer's session with
+// dst, a host on an advertised subnet, and dst's replies, until the
+// session is idle for two minutes.
+func (ns *Impl) forwardSubnetUDP(client *gonet.UDPConn, clientRemoteAddr tcpip.FullAddress, dst netaddr.IPPort) {
+	network := "udp4"
+	if dst.IP.Is6() {
+		network = "udp6"
+	}
+	backendConn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		ns.logf("netstack: could not open UDP socket for subnet host %v: %v", dst, err)
+		client.Close()
+		return
+	}
+	ns.logf("[v2] netstack: forwarding UDP session with subnet host %v", dst)
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(2*time.Minute, func() {
+		ns.logf("[v2] netstack: UDP session with subnet host %v timed out", dst)
+		cancel()
+		client.Close()
+		backendConn.Close()
+	})
+	extend := func() {
+		timer.Reset(2 * time.Minute)
+	}
+	startPacketCopy(ctx, cancel, client, &net.UDPAddr{
+		IP:   net.IP(clientRemoteAddr.Addr),
+		Port: int(clientRemoteAddr.Port),
+	}, backendConn, ns.logf, extend)
+	startPacketCopy(ctx, cancel, backendConn, dst.UDPAddr(), client, ns.logf, extend)
+}
+
 func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientLocalAddr, clientRemoteAddr tcpip.FullAddress) {
 	port := clientLocalAddr.Port
 	ns.logf("[v2] netstack: forwarding incoming UDP connection on port %v", port)
@@ -0,0 +1,159 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build amd64 arm64 ppc64le riscv64 s390x
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"inet.af/netaddr"
+)
+
+// linkPackets copies the packets sent out of from's NIC into to's,
+// as a fake wire between two stacks, until ctx is done.
+func linkPackets(ctx context.Context, from, to *channel.Endpoint) {
+	for {
+		pi, ok := from.ReadContext(ctx)
+		if !ok {
+			return
+		}
+		pkt := pi.Pkt
+		full := make([]byte, 0, pkt.Size())
+		full = append(full, pkt.NetworkHeader().View()...)
+		full = append(full, pkt.TransportHeader().View()...)
+		full = append(full, pkt.Data.ToView()...)
+		pn := header.IPv4ProtocolNumber
+		if full[0]>>4 == 6 {
+			pn = header.IPv6ProtocolNumber
+		}
+		to.InjectInbound(pn, stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buffer.View(full).ToVectorisedView(),
+		}))
+	}
+}
+
+// newSubnetTestPeer starts an Impl that forwards TCP connections to
+// subnet hosts with dial, and returns the stack of a peer whose
+// packets reach the Impl's NIC directly, in place of WireGuard and the
+// TUN device.
+func newSubnetTestPeer(t *testing.T, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *stack.Stack {
+	t.Helper()
+	ipstack, linkEP, err := newIPStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &Impl{
+		logf:       t.Logf,
+		ipstack:    ipstack,
+		linkEP:     linkEP,
+		dialSubnet: dial,
+	}
+	tcpFwd := tcp.NewForwarder(ipstack, 0, 16, ns.acceptTCP)
+	ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+
+	peer, peerEP, err := newIPStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpipProblem := peer.AddAddress(nicID, ipv4.ProtocolNumber, tcpip.Address(net.ParseIP("100.64.0.2").To4())); tcpipProblem != nil {
+		t.Fatal(tcpipProblem)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		ipstack.Close()
+		peer.Close()
+	})
+	go linkPackets(ctx, peerEP, linkEP)
+	go linkPackets(ctx, linkEP, peerEP)
+	return peer
+}
+
+func TestForwardSubnetTCP(t *testing.T) {
+	subnetHost := netaddr.MustParseIPPort("192.0.2.1:80")
+
+	t.Run("forward", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write([]byte("hello from the subnet"))
+		}()
+
+		dialed := make(chan string, 1)
+		peer := newSubnetTestPeer(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			var d net.Dialer
+			return d.DialContext(ctx, network, ln.Addr().String())
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c, err := gonet.DialContextTCP(ctx, peer, tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.Address(subnetHost.IP.IPAddr().IP.To4()),
+			Port: subnetHost.Port,
+		}, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if got := <-dialed; got != subnetHost.String() {
+			t.Errorf("dialed %q; want %q", got, subnetHost)
+		}
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		got, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello from the subnet" {
+			t.Errorf("read %q from subnet host", got)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		// The peer's connection is refused, not accepted and then
+		// closed, when the subnet host can't be reached.
+		peer := newSubnetTestPeer(t, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("no route to host")
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c, err := gonet.DialContextTCP(ctx, peer, tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.Address(subnetHost.IP.IPAddr().IP.To4()),
+			Port: subnetHost.Port,
+		}, ipv4.ProtocolNumber)
+		if err == nil {
+			c.Close()
+			t.Fatal("dial succeeded; want it refused")
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("dial timed out; want it refused: %v", err)
+		}
+	})
+}
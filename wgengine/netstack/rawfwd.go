@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// netstack doesn't build on 32-bit machines (https://github.com/google/gvisor/issues/5241)
+// +build amd64 arm64 ppc64le riscv64 s390x
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// rawFlowTimeout is how long a raw flow is remembered after
+	// its last packet from the tailnet.
+	rawFlowTimeout = 2 * time.Minute
+
+	// maxRawFlows is how many raw flows are remembered before
+	// expired ones are pruned.
+	maxRawFlows = 1024
+)
+
+// rawForwarder forwards packets of protocols without ports, such as
+// 6in4 and GRE, between the tailnet and hosts on advertised subnets,
+// using raw IP sockets. gVisor only handles TCP, UDP and ICMP, so
+// without it such packets would be silently dropped in userspace
+// networking mode.
+//
+// Raw sockets need privileges (CAP_NET_RAW on Linux). Without them,
+// the protocol's packets are dropped and the failure is logged once.
+type rawForwarder struct {
+	logf   logger.Logf
+	inject func([]byte) error // sends a packet to the tailnet
+
+	mu    sync.Mutex
+	conns map[rawKey]*net.IPConn // nil value means opening failed
+	flows map[rawFlow]rawPeer
+}
+
+// rawKey is an IP version and protocol, which a raw socket handles.
+type rawKey struct {
+	v6    bool
+	proto packet.IPProto
+}
+
+// rawFlow is the packets of one protocol from a local host.
+type rawFlow struct {
+	rawKey
+	host netaddr.IP
+}
+
+// rawPeer is the tailnet peer that a rawFlow's packets are sent to.
+type rawPeer struct {
+	ip       netaddr.IP
+	lastSeen time.Time
+}
+
+func newRawForwarder(logf logger.Logf, inject func([]byte) error) *rawForwarder {
+	return &rawForwarder{
+		logf:   logf,
+		inject: inject,
+		conns:  map[rawKey]*net.IPConn{},
+		flows:  map[rawFlow]rawPeer{},
+	}
+}
+
+// handles reports whether p is a packet rf should forward: one of
+// a protocol gVisor doesn't handle, to a host that isn't a Tailscale
+// node.
+func (rf *rawForwarder) handles(p *packet.Parsed) bool {
+	switch p.IPProto {
+	case packet.TCP, packet.UDP, packet.ICMPv4, packet.ICMPv6, packet.TSMP, packet.IGMP, packet.Unknown, packet.Fragment:
+		return false
+	}
+	return !tsaddr.IsTailscaleIP(p.Dst.IP)
+}
+
+// forward sends p's payload to its destination, and notes its source
+// as where to send the destination's replies.
+func (rf *rawForwarder) forward(p *packet.Parsed) {
+	key := rawKey{v6: p.IPVersion == 6, proto: p.IPProto}
+	conn := rf.conn(key)
+	if conn == nil {
+		return
+	}
+
+	now := time.Now()
+	rf.mu.Lock()
+	if len(rf.flows) >= maxRawFlows {
+		for f, peer := range rf.flows {
+			if now.Sub(peer.lastSeen) > rawFlowTimeout {
+				delete(rf.flows, f)
+			}
+		}
+	}
+	rf.flows[rawFlow{key, p.Dst.IP}] = rawPeer{ip: p.Src.IP, lastSeen: now}
+	rf.mu.Unlock()
+
+	if _, err := conn.WriteToIP(p.Payload(), p.Dst.IP.IPAddr()); err != nil {
+		rf.logf("[v1] netstack: forwarding %v: %v", p, err)
+	}
+}
+
+// conn returns the raw socket for key, opening it and starting its
+// read loop if needed. It returns nil if it can't be opened.
+func (rf *rawForwarder) conn(key rawKey) *net.IPConn {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if c, ok := rf.conns[key]; ok {
+		return c
+	}
+	network := "ip4"
+	if key.v6 {
+		network = "ip6"
+	}
+	network = fmt.Sprintf("%s:%d", network, key.proto)
+	c, err := net.ListenIP(network, nil)
+	if err != nil {
+		rf.logf("netstack: can't forward %v packets: %v", key.proto, err)
+		rf.conns[key] = nil
+		return nil
+	}
+	rf.conns[key] = c
+	go rf.readLoop(key, c)
+	return c
+}
+
+// readLoop sends replies received on c to the tailnet peers that
+// last sent packets to their sources.
+func (rf *rawForwarder) readLoop(key rawKey, c *net.IPConn) {
+	buf := make([]byte, mtu)
+	for {
+		n, addr, err := c.ReadFromIP(buf)
+		if err != nil {
+			rf.logf("netstack: reading %v packets: %v", key.proto, err)
+			return
+		}
+		host, ok := netaddr.FromStdIP(addr.IP)
+		if !ok {
+			continue
+		}
+		rf.mu.Lock()
+		peer, ok := rf.flows[rawFlow{key, host}]
+		rf.mu.Unlock()
+		if !ok || time.Since(peer.lastSeen) > rawFlowTimeout {
+			// Not a reply to anything from the tailnet.
+			continue
+		}
+
+		var h packet.Header
+		if key.v6 {
+			h = packet.IP6Header{IPProto: key.proto, Src: host, Dst: peer.ip}
+		} else {
+			h = packet.IP4Header{IPProto: key.proto, Src: host, Dst: peer.ip}
+		}
+		if err := rf.inject(packet.Generate(h, buf[:n])); err != nil {
+			rf.logf("netstack: injecting %v reply: %v", key.proto, err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ package dns
 import (
 	"time"
 
+	"tailscale.com/health"
 	"tailscale.com/types/logger"
 )
 
@@ -57,6 +58,12 @@ func NewManager(mconfig ManagerConfig) *Manager {
 }
 
 func (m *Manager) Set(config Config) error {
+	err := m.set(config)
+	health.SetDNSHealth(err)
+	return err
+}
+
+func (m *Manager) set(config Config) error {
 	if config.Equal(m.config) {
 		return nil
 	}
@@ -18,6 +18,20 @@ import (
 const (
 	ipv4RegBase = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
 	ipv6RegBase = `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`
+
+	// nrptBase is where the local Name Resolution Policy Table
+	// rules live. Rules from group policy live elsewhere, and take
+	// precedence over these.
+	nrptBase = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+	// nrptRuleID is the ID of the NRPT rule that we manage.
+	nrptRuleID = `{5abeaf58-1d8c-4e20-8a31-b25c5ef1b8c0}`
+	// nrptConfigGenericDNS is the NRPT rule ConfigOptions flag
+	// that sends matching queries to the GenericDNSServers.
+	nrptConfigGenericDNS = 0x8
+
+	// tsRegBase is our own registry key, where we remember the
+	// search domains we added to the system's search list.
+	tsRegBase = `SOFTWARE\Tailscale IPN`
 )
 
 type windowsManager struct {
@@ -64,7 +78,174 @@ func (m windowsManager) setDomains(basePath string, domains []string) error {
 	return setRegistryString(path, "SearchList", value)
 }
 
+// setNRPTRule sets our NRPT rule to send queries for domains and
+// their subdomains to servers.
+func setNRPTRule(domains, servers []string) error {
+	names := nrptNames(domains)
+	path := nrptBase + `\` + nrptRuleID
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, path, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer key.Close()
+
+	for _, err := range []error{
+		key.SetDWordValue("Version", 2),
+		key.SetStringsValue("Name", names),
+		key.SetStringValue("GenericDNSServers", strings.Join(servers, "; ")),
+		key.SetDWordValue("ConfigOptions", nrptConfigGenericDNS),
+		key.SetStringValue("IPSECCARestriction", ""),
+		key.SetStringValue("Comment", "Tailscale"),
+	} {
+		if err != nil {
+			return fmt.Errorf("setting NRPT rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// nrptNames returns the NRPT rule names that match domains and their
+// subdomains.
+func nrptNames(domains []string) []string {
+	names := make([]string, len(domains))
+	for i, d := range domains {
+		// A leading dot makes the rule match subdomains too.
+		names[i] = "." + strings.TrimSuffix(d, ".")
+	}
+	return names
+}
+
+// delNRPTRule removes our NRPT rule, if there is one.
+func delNRPTRule() error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, nrptBase+`\`+nrptRuleID)
+	if err != nil && err != registry.ErrNotExist {
+		return fmt.Errorf("deleting NRPT rule: %w", err)
+	}
+	return nil
+}
+
+// setSearchDomains puts domains at the front of the system's DNS
+// suffix search list, in place of the ones we added last time, which
+// are remembered under tsRegBase. It leaves the other entries alone.
+func setSearchDomains(domains []string) error {
+	sys, err := registry.OpenKey(registry.LOCAL_MACHINE, ipv4RegBase, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", ipv4RegBase, err)
+	}
+	defer sys.Close()
+	ts, _, err := registry.CreateKey(registry.LOCAL_MACHINE, tsRegBase, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", tsRegBase, err)
+	}
+	defer ts.Close()
+
+	cur, _, err := sys.GetStringValue("SearchList")
+	if err != nil && err != registry.ErrNotExist {
+		return fmt.Errorf("reading search list: %w", err)
+	}
+	prev, _, err := ts.GetStringsValue("SearchList")
+	if err != nil && err != registry.ErrNotExist {
+		return fmt.Errorf("reading previous search domains: %w", err)
+	}
+	ours := make([]string, len(domains))
+	for i, d := range domains {
+		ours[i] = strings.TrimSuffix(d, ".")
+	}
+	list := mergeSearchList(strings.Split(cur, ","), prev, ours)
+	if err := sys.SetStringValue("SearchList", strings.Join(list, ",")); err != nil {
+		return fmt.Errorf("setting search list: %w", err)
+	}
+	if len(ours) == 0 {
+		err = ts.DeleteValue("SearchList")
+		if err == registry.ErrNotExist {
+			err = nil
+		}
+	} else {
+		err = ts.SetStringsValue("SearchList", ours)
+	}
+	if err != nil {
+		return fmt.Errorf("saving search domains: %w", err)
+	}
+	return nil
+}
+
+// mergeSearchList returns the search list cur with the domains in
+// prev replaced by those in ours, which go first.
+func mergeSearchList(cur, prev, ours []string) []string {
+	skip := map[string]bool{}
+	for _, d := range prev {
+		skip[d] = true
+	}
+	for _, d := range ours {
+		skip[d] = true
+	}
+	ret := append([]string(nil), ours...)
+	for _, d := range cur {
+		if d != "" && !skip[d] {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// upPerDomain sends queries for config.Domains to config.Nameservers
+// with an NRPT rule, rather than making them the interface's
+// nameservers, so that the system's other DNS settings (often a
+// corporate DNS setup) keep handling every other name.
+func (m windowsManager) upPerDomain(config Config) error {
+	for _, base := range []string{ipv4RegBase, ipv6RegBase} {
+		if err := m.setNameservers(base, nil); err != nil {
+			return err
+		}
+		if err := m.setDomains(base, nil); err != nil {
+			return err
+		}
+	}
+
+	servers := make([]string, len(config.Nameservers))
+	for i, ip := range config.Nameservers {
+		servers[i] = ip.String()
+	}
+	if err := setNRPTRule(config.Domains, servers); err != nil {
+		return err
+	}
+	if err := setSearchDomains(config.Domains); err != nil {
+		return err
+	}
+
+	// Drop answers cached from before the rule, which the DNS
+	// client service otherwise keeps using.
+	go m.runIpconfig("/flushdns")
+	return nil
+}
+
+// runIpconfig runs ipconfig with arg, logging how it went. It can
+// take a few seconds, so callers run it async, best effort.
+func (m windowsManager) runIpconfig(arg string) {
+	t0 := time.Now()
+	m.logf("running ipconfig %s ...", arg)
+	cmd := exec.Command("ipconfig", arg)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	err := cmd.Run()
+	d := time.Since(t0).Round(time.Millisecond)
+	if err != nil {
+		m.logf("error running ipconfig %s after %v: %v", arg, d, err)
+	} else {
+		m.logf("ran ipconfig %s in %v", arg, d)
+	}
+}
+
 func (m windowsManager) Up(config Config) error {
+	if config.PerDomain && len(config.Domains) > 0 {
+		return m.upPerDomain(config)
+	}
+	if err := delNRPTRule(); err != nil {
+		return err
+	}
+	if err := setSearchDomains(nil); err != nil {
+		return err
+	}
+
 	var ipsv4 []string
 	var ipsv6 []string
 
@@ -97,18 +278,7 @@ func (m windowsManager) Up(config Config) error {
 	// effect.
 	//
 	// This command can take a few seconds to run, so run it async, best effort.
-	go func() {
-		t0 := time.Now()
-		m.logf("running ipconfig /registerdns ...")
-		cmd := exec.Command("ipconfig", "/registerdns")
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		d := time.Since(t0).Round(time.Millisecond)
-		if err := cmd.Run(); err != nil {
-			m.logf("error running ipconfig /registerdns after %v: %v", d, err)
-		} else {
-			m.logf("ran ipconfig /registerdns in %v", d)
-		}
-	}()
+	go m.runIpconfig("/registerdns")
 
 	return nil
 }
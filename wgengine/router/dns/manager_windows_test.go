@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNRPTNames(t *testing.T) {
+	got := nrptNames([]string{"corp.example.com.", "ts.net"})
+	want := []string{".corp.example.com", ".ts.net"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nrptNames = %q; want %q", got, want)
+	}
+}
+
+func TestMergeSearchList(t *testing.T) {
+	tests := []struct {
+		name            string
+		cur, prev, ours []string
+		want            []string
+	}{
+		{
+			name: "first_time",
+			cur:  []string{"corp.example.com", "example.com"},
+			ours: []string{"tail.ts.net"},
+			want: []string{"tail.ts.net", "corp.example.com", "example.com"},
+		},
+		{
+			name: "replace_previous",
+			cur:  []string{"old.ts.net", "corp.example.com"},
+			prev: []string{"old.ts.net"},
+			ours: []string{"new.ts.net"},
+			want: []string{"new.ts.net", "corp.example.com"},
+		},
+		{
+			name: "remove",
+			cur:  []string{"old.ts.net", "corp.example.com"},
+			prev: []string{"old.ts.net"},
+			want: []string{"corp.example.com"},
+		},
+		{
+			name: "no_duplicates",
+			cur:  []string{"corp.example.com", "tail.ts.net"},
+			ours: []string{"tail.ts.net"},
+			want: []string{"tail.ts.net", "corp.example.com"},
+		},
+		{
+			name: "empty_system_list",
+			cur:  []string{""}, // strings.Split("", ",")
+			ours: []string{"tail.ts.net"},
+			want: []string{"tail.ts.net"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeSearchList(tt.cur, tt.prev, tt.ours)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+// pfAnchor is the pf anchor that tailscaled loads its firewall rules
+// into on FreeBSD and OpenBSD.
+//
+// tailscaled never edits the main pf ruleset. For the rules to take
+// effect, the main ruleset (pf.conf, or on pfSense/OPNsense a
+// floating rule) has to reference the anchor, with
+//
+//	nat-anchor "tailscale"
+//	anchor "tailscale"
+//
+// on FreeBSD, or just the "anchor" line on OpenBSD.
+const pfAnchor = "tailscale"
+
+// pfTag is the pf tag attached to packets arriving on the Tailscale
+// interface, so that they can be passed again when they are forwarded
+// out of a different interface.
+const pfTag = "tailscale"
+
+// pfNAT is a subnet route whose traffic from the tailnet should be
+// masqueraded as it leaves through Interface.
+type pfNAT struct {
+	Route     netaddr.IPPrefix
+	Interface string
+}
+
+// pfRules returns the ruleset to load into pfAnchor on goos ("freebsd"
+// or "openbsd") for the Tailscale interface tunname.
+//
+// The rules mirror what the Linux router installs in its ts-input and
+// ts-forward chains: traffic on the Tailscale interface is accepted
+// (wgengine/filter has already had its say), forwarded traffic from the
+// tailnet is allowed back out, and packets claiming a Tailscale source
+// address on any other interface are dropped. Each entry in nats gets a
+// translation rule using the pf syntax of goos.
+func pfRules(goos, tunname string, nats []pfNAT) string {
+	var b strings.Builder
+	cgnat := tsaddr.CGNATRange()
+	ula := tsaddr.TailscaleULARange()
+
+	// ChromeOS runs its VMs in a slice of CGNAT space, which we never
+	// assign from, so don't treat it as spoofed.
+	fmt.Fprintf(&b, "table <tailscale-cgnat> const { %v, !%v }\n", cgnat, tsaddr.ChromeOSVMRange())
+
+	for _, n := range nats {
+		family, src := "inet", cgnat
+		if n.Route.IP.Is6() {
+			family, src = "inet6", ula
+		}
+		switch goos {
+		case "openbsd":
+			fmt.Fprintf(&b, "match out on %s %s from %v to %v nat-to (%s:0)\n", n.Interface, family, src, n.Route, n.Interface)
+		default:
+			// FreeBSD's pf (and so pfSense and OPNsense) still uses
+			// the old nat rules, which must precede all filter rules.
+			fmt.Fprintf(&b, "nat on %s %s from %v to %v -> (%s:0)\n", n.Interface, family, src, n.Route, n.Interface)
+		}
+	}
+
+	fmt.Fprintf(&b, "pass in quick on %s all tag %s\n", tunname, pfTag)
+	fmt.Fprintf(&b, "pass out quick on %s all\n", tunname)
+	fmt.Fprintf(&b, "pass out quick all tagged %s\n", pfTag)
+	fmt.Fprintf(&b, "block drop in quick on ! %s inet from <tailscale-cgnat> to any\n", tunname)
+	fmt.Fprintf(&b, "block drop in quick on ! %s inet6 from %v to any\n", tunname, ula)
+	return b.String()
+}
+
+// parseRouteGetInterface returns the interface name from the output
+// of "route -n get", or the empty string if there is none.
+func parseRouteGetInterface(out []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "interface:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "interface:"))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestPFRules(t *testing.T) {
+	nats := []pfNAT{
+		{Route: netaddr.MustParseIPPrefix("192.168.1.0/24"), Interface: "em0"},
+		{Route: netaddr.MustParseIPPrefix("2001:db8::/64"), Interface: "igb1"},
+	}
+	tests := []struct {
+		name string
+		goos string
+		nats []pfNAT
+		want string
+	}{
+		{
+			name: "freebsd_no_nat",
+			goos: "freebsd",
+			want: `table <tailscale-cgnat> const { 100.64.0.0/10, !100.115.92.0/23 }
+pass in quick on tailscale0 all tag tailscale
+pass out quick on tailscale0 all
+pass out quick all tagged tailscale
+block drop in quick on ! tailscale0 inet from <tailscale-cgnat> to any
+block drop in quick on ! tailscale0 inet6 from fd7a:115c:a1e0::/48 to any
+`,
+		},
+		{
+			name: "freebsd_nat",
+			goos: "freebsd",
+			nats: nats,
+			want: `table <tailscale-cgnat> const { 100.64.0.0/10, !100.115.92.0/23 }
+nat on em0 inet from 100.64.0.0/10 to 192.168.1.0/24 -> (em0:0)
+nat on igb1 inet6 from fd7a:115c:a1e0::/48 to 2001:db8::/64 -> (igb1:0)
+pass in quick on tailscale0 all tag tailscale
+pass out quick on tailscale0 all
+pass out quick all tagged tailscale
+block drop in quick on ! tailscale0 inet from <tailscale-cgnat> to any
+block drop in quick on ! tailscale0 inet6 from fd7a:115c:a1e0::/48 to any
+`,
+		},
+		{
+			name: "openbsd_nat",
+			goos: "openbsd",
+			nats: nats,
+			want: `table <tailscale-cgnat> const { 100.64.0.0/10, !100.115.92.0/23 }
+match out on em0 inet from 100.64.0.0/10 to 192.168.1.0/24 nat-to (em0:0)
+match out on igb1 inet6 from fd7a:115c:a1e0::/48 to 2001:db8::/64 nat-to (igb1:0)
+pass in quick on tailscale0 all tag tailscale
+pass out quick on tailscale0 all
+pass out quick all tagged tailscale
+block drop in quick on ! tailscale0 inet from <tailscale-cgnat> to any
+block drop in quick on ! tailscale0 inet6 from fd7a:115c:a1e0::/48 to any
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pfRules(tt.goos, "tailscale0", tt.nats)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRouteGetInterface(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "freebsd",
+			out: `   route to: 192.168.1.0
+destination: 192.168.1.0
+       mask: 255.255.255.0
+        fib: 0
+  interface: em0
+      flags: <UP,DONE,PINNED>
+ recvpipe  sendpipe  ssthresh  rtt,msec    mtu        weight    expire
+       0         0         0         0      1500         1         0
+`,
+			want: "em0",
+		},
+		{
+			name: "openbsd",
+			out: `   route to: 10.0.0.0
+destination: 10.0.0.0
+       mask: 255.0.0.0
+    gateway: 192.168.1.1
+  interface: vio0
+ if address: 192.168.1.20
+   priority: 8 (static)
+      flags: <UP,GATEWAY,DONE,STATIC>
+`,
+			want: "vio0",
+		},
+		{
+			name: "not_in_table",
+			out:  "route: writing to routing socket: No such process\n",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRouteGetInterface([]byte(tt.out)); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
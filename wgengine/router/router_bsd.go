@@ -0,0 +1,387 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
+	"tailscale.com/wgengine/router/dns"
+)
+
+// For now this router only supports the userspace WireGuard
+// implementation. In-kernel WireGuard exists for both FreeBSD and
+// OpenBSD, but tailscaled can't drive it yet.
+
+// bsdRouter programs addresses and routes on FreeBSD and OpenBSD with
+// ifconfig(8) and route(8), and firewall rules with pfctl(8).
+type bsdRouter struct {
+	logf    logger.Logf
+	cmd     commandRunner
+	goos    string
+	tunname string
+	local   []netaddr.IPPrefix
+	routes  map[netaddr.IPPrefix]struct{}
+
+	// pf is whether pf is available on this machine. If it's not,
+	// NetfilterMode is ignored.
+	pf bool
+	// pfRules is the ruleset currently loaded into pfAnchor, or
+	// empty if the anchor is flushed.
+	pfRules string
+
+	dns *dns.Manager
+}
+
+func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
+	tunname, err := tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	mconfig := dns.ManagerConfig{
+		Logf:          logf,
+		InterfaceName: tunname,
+	}
+
+	r := &bsdRouter{
+		logf:    logf,
+		cmd:     osCommandRunner{},
+		goos:    runtime.GOOS,
+		tunname: tunname,
+		dns:     dns.NewManager(mconfig),
+	}
+	r.pf = r.checkPF()
+	return r, nil
+}
+
+// checkPF reports whether pf can be used, logging if it's usable but
+// currently disabled.
+func (r *bsdRouter) checkPF() bool {
+	out, err := r.cmd.output("pfctl", "-s", "info")
+	if err != nil {
+		r.logf("pf unavailable, not managing firewall rules: %v", err)
+		return false
+	}
+	if strings.Contains(string(out), "Status: Disabled") {
+		r.logf("pf is disabled; rules in anchor %q take effect once it's enabled", pfAnchor)
+	}
+	return true
+}
+
+func (r *bsdRouter) Up() error {
+	if err := r.cmd.run("ifconfig", r.tunname, "up"); err != nil {
+		r.logf("running ifconfig failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+func inet(p netaddr.IPPrefix) string {
+	if p.IP.Is6() {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// ifconfigAddr returns the prefix actually configured on the
+// interface for the Tailscale address addr.
+func ifconfigAddr(addr netaddr.IPPrefix) netaddr.IPPrefix {
+	if addr.IP.Is6() && addr.Bits == 128 {
+		// FreeBSD rejects tun addresses of the form fc00::1/128 -> fc00::1,
+		// https://bugs.freebsd.org/bugzilla/show_bug.cgi?id=218508
+		// Instead add our whole /48, which works because we use a /48 route.
+		// Full history: https://github.com/tailscale/tailscale/issues/1307
+		// OpenBSD does the same so that it doesn't need an extra route.
+		return netaddr.IPPrefix{IP: addr.IP, Bits: 48}
+	}
+	return addr
+}
+
+func (r *bsdRouter) addAddr(addr netaddr.IPPrefix) error {
+	a := ifconfigAddr(addr)
+	switch {
+	case addr.IP.Is6():
+		return r.cmd.run("ifconfig", r.tunname, "inet6", a.String(), "alias")
+	case r.goos == "openbsd":
+		// OpenBSD's tun has no destination address, so add the
+		// address alone and route it to ourselves.
+		if err := r.cmd.run("ifconfig", r.tunname, "inet", a.String(), "alias"); err != nil {
+			return err
+		}
+		return r.cmd.run("route", "-q", "-n", "add", "-inet", a.String(), "-iface", a.IP.String())
+	default:
+		return r.cmd.run("ifconfig", r.tunname, "inet", a.String(), a.IP.String(), "alias")
+	}
+}
+
+func (r *bsdRouter) delAddr(addr netaddr.IPPrefix) error {
+	a := ifconfigAddr(addr)
+	if addr.IP.Is4() && r.goos == "openbsd" {
+		if err := r.cmd.run("route", "-q", "-n", "delete", "-inet", a.String(), "-iface", a.IP.String()); err != nil {
+			r.logf("route del failed: %v", err)
+		}
+	}
+	return r.cmd.run("ifconfig", r.tunname, inet(addr), a.String(), "-alias")
+}
+
+// routeGateway returns the "-iface" argument for routes of the given
+// family. FreeBSD routes point at the tun interface; OpenBSD wants one
+// of the interface's own addresses.
+func (r *bsdRouter) routeGateway(route netaddr.IPPrefix, local []netaddr.IPPrefix) (string, bool) {
+	if r.goos != "openbsd" {
+		return r.tunname, true
+	}
+	for _, addr := range local {
+		if addr.IP.Is4() == route.IP.Is4() {
+			return addr.IP.String(), true
+		}
+	}
+	return "", false
+}
+
+// addRoute adds route via the Tailscale interface. If the kernel
+// already has a route for the same prefix that isn't ours, it's left
+// alone and added is false, so that a later Set tries again.
+func (r *bsdRouter) addRoute(route netaddr.IPPrefix, local []netaddr.IPPrefix) (added bool, err error) {
+	gw, ok := r.routeGateway(route, local)
+	if !ok {
+		r.logf("no local %s address, skipping route %v", inet(route), route)
+		return false, nil
+	}
+	route = route.Masked()
+	err = r.cmd.run("route", "-q", "-n", "add", "-"+inet(route), route.String(), "-iface", gw)
+	if err == nil {
+		return true, nil
+	}
+	if !strings.Contains(err.Error(), "File exists") {
+		return false, err
+	}
+	out, _ := r.cmd.output("route", "-n", "get", "-"+inet(route), route.String())
+	switch dev := parseRouteGetInterface(out); dev {
+	case r.tunname:
+		// Left behind by a previous run; adopt it.
+		return true, nil
+	case "":
+		return false, err
+	default:
+		r.logf("route %v already exists via %s; not overriding it", route, dev)
+		return false, nil
+	}
+}
+
+func (r *bsdRouter) delRoute(route netaddr.IPPrefix, local []netaddr.IPPrefix) error {
+	gw, ok := r.routeGateway(route, local)
+	if !ok {
+		return nil
+	}
+	route = route.Masked()
+	err := r.cmd.run("route", "-q", "-n", "delete", "-"+inet(route), route.String(), "-iface", gw)
+	if err != nil && strings.Contains(err.Error(), "not in table") {
+		return nil
+	}
+	return err
+}
+
+func (r *bsdRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+
+	var errq error
+	setErr := func(err error) {
+		if errq == nil {
+			errq = err
+		}
+	}
+
+	// Remove routes that are going away while the addresses they
+	// may reference (on OpenBSD) are still configured.
+	newRoutes := make(map[netaddr.IPPrefix]struct{})
+	for _, route := range cfg.Routes {
+		newRoutes[route] = struct{}{}
+	}
+	for route := range r.routes {
+		if _, keep := newRoutes[route]; keep && sameFamilyAddr(r.local, cfg.LocalAddrs, route) {
+			continue
+		}
+		if err := r.delRoute(route, r.local); err != nil {
+			r.logf("route del failed: %v", err)
+			setErr(err)
+		}
+		delete(r.routes, route)
+	}
+
+	// Update the addresses.
+	newLocal := make(map[netaddr.IPPrefix]bool)
+	for _, addr := range cfg.LocalAddrs {
+		newLocal[addr] = true
+	}
+	oldLocal := make(map[netaddr.IPPrefix]bool)
+	var local []netaddr.IPPrefix
+	for _, addr := range r.local {
+		oldLocal[addr] = true
+		if newLocal[addr] {
+			local = append(local, addr)
+			continue
+		}
+		if err := r.delAddr(addr); err != nil {
+			r.logf("addr del failed: %v", err)
+			setErr(err)
+		}
+	}
+	for _, addr := range cfg.LocalAddrs {
+		if oldLocal[addr] {
+			continue
+		}
+		if err := r.addAddr(addr); err != nil {
+			r.logf("addr add failed: %v", err)
+			setErr(err)
+			continue
+		}
+		local = append(local, addr)
+	}
+	r.local = local
+
+	// Add the routes.
+	if r.routes == nil {
+		r.routes = make(map[netaddr.IPPrefix]struct{})
+	}
+	for route := range newRoutes {
+		if _, exists := r.routes[route]; exists {
+			continue
+		}
+		added, err := r.addRoute(route, r.local)
+		if err != nil {
+			r.logf("route add failed: %v", err)
+			setErr(err)
+		}
+		if added {
+			r.routes[route] = struct{}{}
+		}
+	}
+
+	if err := r.setPF(cfg); err != nil {
+		r.logf("pf: %v", err)
+		setErr(err)
+	}
+
+	if err := r.dns.Set(cfg.DNS); err != nil {
+		setErr(fmt.Errorf("dns set: %v", err))
+	}
+
+	return errq
+}
+
+// sameFamilyAddr reports whether the address that a route of route's
+// family is programmed against is unchanged between old and new.
+// It only matters on OpenBSD, where routes name a local address.
+func sameFamilyAddr(old, new []netaddr.IPPrefix, route netaddr.IPPrefix) bool {
+	first := func(addrs []netaddr.IPPrefix) netaddr.IPPrefix {
+		for _, a := range addrs {
+			if a.IP.Is4() == route.IP.Is4() {
+				return a
+			}
+		}
+		return netaddr.IPPrefix{}
+	}
+	return first(old) == first(new)
+}
+
+// setPF loads the ruleset for cfg into pfAnchor, or flushes the
+// anchor if cfg turns netfilter management off. There's no
+// difference between NetfilterOn and NetfilterNoDivert here, as the
+// main ruleset is never modified.
+func (r *bsdRouter) setPF(cfg *Config) error {
+	if !r.pf {
+		return nil
+	}
+	var rules string
+	if cfg.NetfilterMode != preftype.NetfilterOff && len(cfg.LocalAddrs) > 0 {
+		var nats []pfNAT
+		if cfg.SNATSubnetRoutes {
+			for _, route := range cfg.SubnetRoutes {
+				out, err := r.cmd.output("route", "-n", "get", "-"+inet(route), route.Masked().String())
+				if err != nil {
+					r.logf("no interface for subnet route %v, not masquerading it: %v", route, err)
+					continue
+				}
+				dev := parseRouteGetInterface(out)
+				if dev == "" || dev == r.tunname {
+					continue
+				}
+				nats = append(nats, pfNAT{Route: route.Masked(), Interface: dev})
+			}
+		}
+		rules = pfRules(r.goos, r.tunname, nats)
+	}
+	if rules == r.pfRules {
+		return nil
+	}
+	if rules == "" {
+		if err := r.cmd.run("pfctl", "-a", pfAnchor, "-F", "all"); err != nil {
+			return err
+		}
+		r.pfRules = ""
+		return nil
+	}
+	if err := r.cmd.runStdin(rules, "pfctl", "-a", pfAnchor, "-f", "-"); err != nil {
+		return fmt.Errorf("loading anchor %q: %w", pfAnchor, err)
+	}
+	r.pfRules = rules
+	return nil
+}
+
+func (r *bsdRouter) Close() error {
+	for route := range r.routes {
+		if err := r.delRoute(route, r.local); err != nil {
+			r.logf("route del failed: %v", err)
+		}
+	}
+	r.routes = nil
+	if r.pf && r.pfRules != "" {
+		if err := r.cmd.run("pfctl", "-a", pfAnchor, "-F", "all"); err != nil {
+			r.logf("pf flush: %v", err)
+		}
+		r.pfRules = ""
+	}
+	if err := r.dns.Down(); err != nil {
+		return fmt.Errorf("dns down: %v", err)
+	}
+	if r.goos == "openbsd" {
+		if err := r.cmd.run("ifconfig", r.tunname, "down"); err != nil {
+			r.logf("ifconfig down: %v", err)
+		}
+	}
+	return nil
+}
+
+func cleanup(logf logger.Logf, interfaceName string) {
+	// Flush rules left behind by a tailscaled that didn't shut down
+	// cleanly. pf may not be loaded at all, so ignore errors.
+	osCommandRunner{}.run("pfctl", "-a", pfAnchor, "-F", "all")
+
+	if runtime.GOOS == "freebsd" {
+		// If the interface was left behind, ifconfig down will not remove it.
+		// In fact, this will leave a system in a tainted state where starting tailscaled
+		// will result in "interface tailscale0 already exists"
+		// until the defunct interface is ifconfig-destroyed.
+		if err := (osCommandRunner{}).run("ifconfig", interfaceName, "destroy"); err != nil {
+			logf("ifconfig destroy: %v", err)
+		}
+		return
+	}
+	if err := (osCommandRunner{}).run("ifconfig", interfaceName, "down"); err != nil {
+		logf("ifconfig down: %v", err)
+	}
+}
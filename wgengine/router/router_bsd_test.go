@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/preftype"
+)
+
+// pfRunner is a commandRunner that answers route lookups with a fixed
+// interface and records the commands run, with their stdin.
+type pfRunner struct {
+	iface string
+	ran   []string
+	stdin []string
+}
+
+func (o *pfRunner) run(args ...string) error {
+	o.ran = append(o.ran, strings.Join(args, " "))
+	return nil
+}
+
+func (o *pfRunner) runStdin(stdin string, args ...string) error {
+	o.stdin = append(o.stdin, stdin)
+	return o.run(args...)
+}
+
+func (o *pfRunner) output(args ...string) ([]byte, error) {
+	if len(args) > 1 && args[0] == "route" {
+		return []byte(fmt.Sprintf("   route to: %s\n  interface: %s\n", args[len(args)-1], o.iface)), nil
+	}
+	return nil, fmt.Errorf("unexpected command %q", strings.Join(args, " "))
+}
+
+func TestSetPF(t *testing.T) {
+	cmd := &pfRunner{iface: "em0"}
+	r := &bsdRouter{
+		logf:    t.Logf,
+		cmd:     cmd,
+		goos:    "freebsd",
+		tunname: "tailscale0",
+		pf:      true,
+	}
+	subnet := netaddr.MustParseIPPrefix("192.168.1.0/24")
+	cfg := &Config{
+		LocalAddrs:       []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.101.102.103/32")},
+		SubnetRoutes:     []netaddr.IPPrefix{subnet},
+		SNATSubnetRoutes: true,
+		NetfilterMode:    preftype.NetfilterOn,
+	}
+
+	if err := r.setPF(cfg); err != nil {
+		t.Fatal(err)
+	}
+	load := "pfctl -a " + pfAnchor + " -f -"
+	if want := []string{"route -n get -inet 192.168.1.0/24", load}; !reflect.DeepEqual(cmd.ran, want) {
+		t.Errorf("ran %q; want %q", cmd.ran, want)
+	}
+	want := pfRules("freebsd", "tailscale0", []pfNAT{{Route: subnet, Interface: "em0"}})
+	if len(cmd.stdin) != 1 || cmd.stdin[0] != want {
+		t.Errorf("loaded rules %q; want %q", cmd.stdin, want)
+	}
+
+	// Setting the same rules again doesn't reload them.
+	cmd.ran, cmd.stdin = nil, nil
+	if err := r.setPF(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd.stdin) != 0 {
+		t.Errorf("unchanged rules reloaded: %q", cmd.stdin)
+	}
+
+	// Turning netfilter off flushes the anchor.
+	cmd.ran = nil
+	cfg.NetfilterMode = preftype.NetfilterOff
+	if err := r.setPF(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pfctl -a " + pfAnchor + " -F all"}; !reflect.DeepEqual(cmd.ran, want) {
+		t.Errorf("ran %q; want %q", cmd.ran, want)
+	}
+	if r.pfRules != "" {
+		t.Errorf("pfRules = %q after flush; want empty", r.pfRules)
+	}
+}
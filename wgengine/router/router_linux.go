@@ -141,7 +141,95 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (
 		}
 	}
 
-	return newUserspaceRouterAdvanced(logf, tunname, ipt4, ipt6, osCommandRunner{}, supportsV6, supportsV6NAT)
+	r, err := newUserspaceRouterAdvanced(logf, tunname, ipt4, ipt6, osCommandRunner{}, supportsV6, supportsV6NAT)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.(*linuxRouter).adoptInterfaceState(); err != nil {
+		logf("reading existing addresses and routes of %s: %v", tunname, err)
+	}
+	return r, nil
+}
+
+// adoptInterfaceState sets r.addrs and r.routes to the addresses and
+// routes already on the tunnel interface. A newly created interface
+// has none, but one handed over by a previous tailscaled keeps its
+// configuration, and Set needs to know about it to remove whatever
+// the new config doesn't want.
+func (r *linuxRouter) adoptInterfaceState() error {
+	out, err := r.cmd.output("ip", "-o", "addr", "show", "dev", r.tunname)
+	if err != nil {
+		return err
+	}
+	addrs := parseIPAddrs(string(out))
+	routes := map[netaddr.IPPrefix]bool{}
+	for _, fam := range r.iprouteFamilies() {
+		args := []string{"ip", fam, "route", "show", "dev", r.tunname}
+		if r.ipRuleAvailable {
+			args = append(args, "table", tailscaleRouteTable)
+		}
+		out, err := r.cmd.output(args...)
+		if err != nil {
+			return err
+		}
+		for cidr := range parseIPRoutes(string(out), fam == "-6") {
+			routes[cidr] = true
+		}
+	}
+	if len(addrs) > 0 || len(routes) > 0 {
+		r.logf("adopting %d addresses and %d routes already on %s", len(addrs), len(routes), r.tunname)
+	}
+	r.addrs, r.routes = addrs, routes
+	return nil
+}
+
+// parseIPAddrs parses the output of "ip -o addr show" into the set of
+// addresses it lists, skipping link-local ones, which the kernel
+// assigns rather than the router.
+func parseIPAddrs(out string) map[netaddr.IPPrefix]bool {
+	ret := map[netaddr.IPPrefix]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		for i := 0; i+1 < len(f); i++ {
+			if f[i] != "inet" && f[i] != "inet6" {
+				continue
+			}
+			pfx, err := netaddr.ParseIPPrefix(f[i+1])
+			if err == nil && !pfx.IP.IsLinkLocalUnicast() {
+				ret[pfx] = true
+			}
+			break
+		}
+	}
+	return ret
+}
+
+// parseIPRoutes parses the output of "ip route show" into the set of
+// routes it lists, skipping those added by the kernel. v6 is whether
+// they're IPv6 routes, for interpreting "default".
+func parseIPRoutes(out string, v6 bool) map[netaddr.IPPrefix]bool {
+	ret := map[netaddr.IPPrefix]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.Contains(line, "proto kernel") {
+			continue
+		}
+		s := f[0]
+		switch {
+		case s == "default" && v6:
+			s = "::/0"
+		case s == "default":
+			s = "0.0.0.0/0"
+		case !strings.Contains(s, "/") && v6:
+			s += "/128"
+		case !strings.Contains(s, "/"):
+			s += "/32"
+		}
+		if pfx, err := netaddr.ParseIPPrefix(s); err == nil {
+			ret[pfx] = true
+		}
+	}
+	return ret
 }
 
 func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netfilter4, netfilter6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool) (Router, error) {
@@ -369,14 +457,13 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 	return nil
 }
 
-// addAddress adds an IP/mask to the tunnel interface. Fails if the
-// address is already assigned to the interface, or if the addition
-// fails.
+// addAddress adds an IP/mask to the tunnel interface, if it's not
+// already assigned. Fails if the addition fails.
 func (r *linuxRouter) addAddress(addr netaddr.IPPrefix) error {
 	if !r.v6Available && addr.IP.Is6() {
 		return nil
 	}
-	if err := r.cmd.run("ip", "addr", "add", addr.String(), "dev", r.tunname); err != nil {
+	if err := r.cmd.run("ip", "addr", "add", addr.String(), "dev", r.tunname); err != nil && !errExists(err) {
 		return fmt.Errorf("adding address %q to tunnel interface: %w", addr, err)
 	}
 	if err := r.addLoopbackRule(addr.IP); err != nil {
@@ -446,8 +533,8 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 }
 
 // addRoute adds a route for cidr, pointing to the tunnel
-// interface. Fails if the route already exists, or if adding the
-// route fails.
+// interface, if it doesn't already exist. Fails if adding the route
+// fails.
 func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
 	if !r.v6Available && cidr.IP.Is6() {
 		return nil
@@ -460,7 +547,18 @@ func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
 	if r.ipRuleAvailable {
 		args = append(args, "table", tailscaleRouteTable)
 	}
-	return r.cmd.run(args...)
+	if err := r.cmd.run(args...); err != nil && !errExists(err) {
+		return err
+	}
+	return nil
+}
+
+// errExists reports whether err is from an ip command refusing to add
+// something that's already there. That's expected when the interface
+// was handed over by a previous tailscaled, which left its addresses
+// and routes in place.
+func errExists(err error) bool {
+	return strings.Contains(err.Error(), "File exists")
 }
 
 // delRoute removes the route for cidr pointing to the tunnel
@@ -767,13 +865,17 @@ func (r *linuxRouter) addNetfilterBase4() error {
 	return nil
 }
 
-// addNetfilterBase4 adds some basic IPv6 processing rules to be
+// addNetfilterBase6 adds some basic IPv6 processing rules to be
 // supplemented by later calls to other helpers.
 func (r *linuxRouter) addNetfilterBase6() error {
-	// TODO: only allow traffic from Tailscale's ULA range to come
-	// from tailscale0.
+	// Only allow traffic from Tailscale's ULA range to come from
+	// tailscale0, as with the CGNAT range for IPv4.
+	args := []string{"!", "-i", r.tunname, "-s", tsaddr.TailscaleULARange().String(), "-j", "DROP"}
+	if err := r.ipt6.Append("filter", "ts-input", args...); err != nil {
+		return fmt.Errorf("adding %v in v6/filter/ts-input: %w", args, err)
+	}
 
-	args := []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark}
+	args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark}
 	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
 	}
@@ -781,8 +883,10 @@ func (r *linuxRouter) addNetfilterBase6() error {
 	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
 	}
-	// TODO: drop forwarded traffic to tailscale0 from tailscale's ULA
-	// (see corresponding IPv4 CGNAT rule).
+	args = []string{"-o", r.tunname, "-s", tsaddr.TailscaleULARange().String(), "-j", "DROP"}
+	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
+		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
+	}
 	args = []string{"-o", r.tunname, "-j", "ACCEPT"}
 	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
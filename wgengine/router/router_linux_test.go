@@ -127,7 +127,9 @@ v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/nat/POSTROUTING -j ts-postrouting
 v6/nat/ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
 `,
@@ -158,7 +160,9 @@ v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/nat/POSTROUTING -j ts-postrouting
 `,
 		},
@@ -191,7 +195,9 @@ v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/nat/POSTROUTING -j ts-postrouting
 `,
 		},
@@ -221,7 +227,9 @@ v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/nat/POSTROUTING -j ts-postrouting
 `,
 		},
@@ -247,7 +255,9 @@ v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 `,
 		},
 		{
@@ -276,7 +286,9 @@ v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input ! -i tailscale0 -s fd7a:115c:a1e0::/48 -j DROP
 v6/nat/POSTROUTING -j ts-postrouting
 `,
 		},
@@ -583,6 +595,11 @@ func (o *fakeOS) run(args ...string) error {
 	return nil
 }
 
+func (o *fakeOS) runStdin(stdin string, args ...string) error {
+	o.t.Errorf("unexpected command that wants input: %q", strings.Join(args, " "))
+	return errExec
+}
+
 func (o *fakeOS) output(args ...string) ([]byte, error) {
 	want := "ip rule list priority 10000"
 	got := strings.Join(args, " ")
@@ -665,3 +682,91 @@ func TestDelRouteIdempotent(t *testing.T) {
 		t.Logf("Log output:\n%s", out)
 	}
 }
+
+// outputRunner is a commandRunner that returns canned output for each
+// command, and records the commands run.
+type outputRunner struct {
+	out map[string]string
+	ran []string
+}
+
+func (o *outputRunner) run(args ...string) error {
+	o.ran = append(o.ran, strings.Join(args, " "))
+	return nil
+}
+
+func (o *outputRunner) runStdin(stdin string, args ...string) error {
+	return o.run(args...)
+}
+
+func (o *outputRunner) output(args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	out, ok := o.out[cmd]
+	if !ok {
+		return nil, fmt.Errorf("unexpected command %q", cmd)
+	}
+	return []byte(out), nil
+}
+
+func TestAdoptInterfaceState(t *testing.T) {
+	cmd := &outputRunner{out: map[string]string{
+		"ip -o addr show dev tailscale0": `5: tailscale0    inet 100.101.102.103/32 scope global tailscale0\       valid_lft forever preferred_lft forever
+5: tailscale0    inet6 fd7a:115c:a1e0:ab12:4843:cd96:6265:6667/128 scope global \       valid_lft forever preferred_lft forever
+5: tailscale0    inet6 fe80::e1a5:7b81:51a4:24c8/64 scope link stable-privacy \       valid_lft forever preferred_lft forever
+`,
+		"ip -4 route show dev tailscale0 table 52": `100.100.100.100 
+100.64.0.0/10 
+10.0.0.0/8 
+default 
+`,
+		"ip -6 route show dev tailscale0 table 52": `fd7a:115c:a1e0::/48 metric 1024 pref medium
+fe80::/64 proto kernel metric 256 pref medium
+`,
+	}}
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", nil, nil, cmd, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := router.(*linuxRouter)
+	if err := r.adoptInterfaceState(); err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs := map[netaddr.IPPrefix]bool{
+		mustCIDR("100.101.102.103/32"):                          true,
+		mustCIDR("fd7a:115c:a1e0:ab12:4843:cd96:6265:6667/128"): true,
+	}
+	if diff := cmp.Diff(r.addrs, wantAddrs); diff != "" {
+		t.Errorf("addrs wrong (-got+want):\n%s", diff)
+	}
+	wantRoutes := map[netaddr.IPPrefix]bool{
+		mustCIDR("100.100.100.100/32"):  true,
+		mustCIDR("100.64.0.0/10"):       true,
+		mustCIDR("10.0.0.0/8"):          true,
+		mustCIDR("0.0.0.0/0"):           true,
+		mustCIDR("fd7a:115c:a1e0::/48"): true,
+	}
+	if diff := cmp.Diff(r.routes, wantRoutes); diff != "" {
+		t.Errorf("routes wrong (-got+want):\n%s", diff)
+	}
+
+	// Routes and addresses left behind that the new config doesn't
+	// want are removed, and wanted ones aren't added again.
+	cmd.ran = nil
+	err = r.Set(&Config{
+		LocalAddrs: []netaddr.IPPrefix{mustCIDR("100.101.102.103/32")},
+		Routes:     []netaddr.IPPrefix{mustCIDR("100.64.0.0/10"), mustCIDR("100.100.100.100/32")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(cmd.ran)
+	want := []string{
+		"ip addr del fd7a:115c:a1e0:ab12:4843:cd96:6265:6667/128 dev tailscale0",
+		"ip route del 0.0.0.0/0 dev tailscale0 table 52",
+		"ip route del 10.0.0.0/8 dev tailscale0 table 52",
+		"ip route del fd7a:115c:a1e0::/48 dev tailscale0 table 52",
+	}
+	if diff := cmp.Diff(cmd.ran, want); diff != "" {
+		t.Errorf("commands wrong (-got+want):\n%s", diff)
+	}
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build darwin freebsd
+// +build darwin
 
 package router
 
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
-	"runtime"
 
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
@@ -124,17 +123,7 @@ func (r *userspaceBSDRouter) Set(cfg *Config) (reterr error) {
 		}
 	}
 	for _, addr := range r.addrsToAdd(cfg.LocalAddrs) {
-		var arg []string
-		if runtime.GOOS == "freebsd" && addr.IP.Is6() && addr.Bits == 128 {
-			// FreeBSD rejects tun addresses of the form fc00::1/128 -> fc00::1,
-			// https://bugs.freebsd.org/bugzilla/show_bug.cgi?id=218508
-			// Instead add our whole /48, which works because we use a /48 route.
-			// Full history: https://github.com/tailscale/tailscale/issues/1307
-			tmp := netaddr.IPPrefix{IP: addr.IP, Bits: 48}
-			arg = []string{"ifconfig", r.tunname, inet(tmp), tmp.String()}
-		} else {
-			arg = []string{"ifconfig", r.tunname, inet(addr), addr.String(), addr.IP.String()}
-		}
+		arg := []string{"ifconfig", r.tunname, inet(addr), addr.String(), addr.IP.String()}
 		out, err := cmd(arg...).CombinedOutput()
 		if err != nil {
 			r.logf("addr add failed: %v => %v\n%s", arg, err, out)
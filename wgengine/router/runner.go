@@ -2,13 +2,14 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build linux
+// +build linux freebsd openbsd
 
 package router
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -20,6 +21,8 @@ import (
 type commandRunner interface {
 	run(...string) error
 	output(...string) ([]byte, error)
+	// runStdin is like run, but feeds stdin to the command.
+	runStdin(stdin string, args ...string) error
 }
 
 type osCommandRunner struct{}
@@ -49,12 +52,23 @@ func (o osCommandRunner) run(args ...string) error {
 	return err
 }
 
+func (o osCommandRunner) runStdin(stdin string, args ...string) error {
+	_, err := o.outputStdin(strings.NewReader(stdin), args...)
+	return err
+}
+
 func (o osCommandRunner) output(args ...string) ([]byte, error) {
+	return o.outputStdin(nil, args...)
+}
+
+func (o osCommandRunner) outputStdin(stdin io.Reader, args ...string) ([]byte, error) {
 	if len(args) == 0 {
 		return nil, errors.New("cmd: no argv[0]")
 	}
 
-	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = stdin
+	out, err := c.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("running %q failed: %w\n%s", strings.Join(args, " "), err, out)
 	}
@@ -11,12 +11,17 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netns"
@@ -34,15 +39,26 @@ const (
 	cleanupInterval = 30 * time.Second
 	// responseTimeout is the maximal amount of time to wait for a DNS response.
 	responseTimeout = 5 * time.Second
+	// maxPeerResponseBytes is the largest response accepted from
+	// an exit node or app connector, the most that fits in a TCP DNS
+	// message.
+	maxPeerResponseBytes = 65535
 )
 
-var errNoUpstreams = errors.New("upstream nameservers not set")
+var (
+	errNoUpstreams = errors.New("upstream nameservers not set")
+	errTimeout     = errors.New("timeout waiting for upstream nameservers")
+)
 
 var aLongTimeAgo = time.Unix(0, 1)
 
 type forwardingRecord struct {
 	src       netaddr.IPPort
 	createdAt time.Time
+	query     []byte // the query, if it's to be logged; otherwise nil
+	// resp, if non-nil, receives the response instead of the
+	// forwarder's responses channel. It must be buffered.
+	resp chan<- []byte
 }
 
 // txid identifies a DNS transaction.
@@ -106,6 +122,10 @@ type forwarder struct {
 
 	// responses is a channel by which responses are returned.
 	responses chan Packet
+	// qlog is the Resolver's query log.
+	qlog *QueryLog
+	// netns is the interface binding of the forwarding sockets, or nil.
+	netns *netns.Binding
 	// closed signals all goroutines to stop.
 	closed chan struct{}
 	// wg signals when all goroutines have stopped.
@@ -118,6 +138,18 @@ type forwarder struct {
 	mu sync.Mutex
 	// upstreams are the nameserver addresses that should be used for forwarding.
 	upstreams []net.Addr
+	// exitNodeURL is the exit node's DNS-over-HTTP endpoint, used
+	// instead of upstreams when there are none. It's empty if
+	// there's no exit node. exitNodeClient is what queries it.
+	exitNodeURL    string
+	exitNodeClient *http.Client
+	// appConnectors are the DNS-over-HTTP endpoints of the app
+	// connectors, by the domains they route, which take precedence
+	// over both upstreams and the exit node. A "*.example.com" key
+	// routes the subdomains of example.com. appConnectorClient is
+	// what queries them.
+	appConnectors      map[string]string
+	appConnectorClient *http.Client
 	// txMap maps DNS txids to active forwarding records.
 	txMap map[txid]forwardingRecord
 }
@@ -126,10 +158,12 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func newForwarder(logf logger.Logf, responses chan Packet) *forwarder {
+func newForwarder(logf logger.Logf, responses chan Packet, qlog *QueryLog, nb *netns.Binding) *forwarder {
 	return &forwarder{
 		logf:      logger.WithPrefix(logf, "forward: "),
 		responses: responses,
+		qlog:      qlog,
+		netns:     nb,
 		closed:    make(chan struct{}),
 		conns:     make([]*fwdConn, connCount),
 		txMap:     make(map[txid]forwardingRecord),
@@ -139,7 +173,7 @@ func newForwarder(logf logger.Logf, responses chan Packet) *forwarder {
 func (f *forwarder) Start() error {
 	f.wg.Add(connCount + 1)
 	for idx := range f.conns {
-		f.conns[idx] = newFwdConn(f.logf, idx)
+		f.conns[idx] = newFwdConn(f.logf, idx, f.netns)
 		go f.recv(f.conns[idx])
 	}
 	go f.cleanMap()
@@ -159,6 +193,14 @@ func (f *forwarder) Close() {
 	for _, conn := range f.conns {
 		conn.close()
 	}
+	f.mu.Lock()
+	clients := []*http.Client{f.exitNodeClient, f.appConnectorClient}
+	f.mu.Unlock()
+	for _, c := range clients {
+		if c != nil {
+			c.CloseIdleConnections()
+		}
+	}
 
 	f.wg.Wait()
 }
@@ -177,6 +219,82 @@ func (f *forwarder) setUpstreams(upstreams []net.Addr) {
 	f.mu.Unlock()
 }
 
+func (f *forwarder) setExitNode(url string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	var c *http.Client
+	if url != "" {
+		c = newPeerClient(dial)
+	}
+	f.mu.Lock()
+	old := f.exitNodeClient
+	f.exitNodeURL, f.exitNodeClient = url, c
+	f.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+func (f *forwarder) setAppConnectors(routes map[string]string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	var c *http.Client
+	if len(routes) > 0 {
+		c = newPeerClient(dial)
+	}
+	f.mu.Lock()
+	old := f.appConnectorClient
+	f.appConnectors, f.appConnectorClient = routes, c
+	f.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// newPeerClient returns an HTTP client for the peer API of a peer,
+// which connects with dial, or with the OS if dial is nil.
+func newPeerClient(dial func(ctx context.Context, addr string) (net.Conn, error)) *http.Client {
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+	// No proxy: peers are only reachable over the tailnet.
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, addr)
+		},
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     time.Minute,
+	}}
+}
+
+// appConnectorURLLocked returns the DNS-over-HTTP endpoint of the app
+// connector that routes the name query asks about, or the empty
+// string if none does. An exact route wins over wildcards, and a
+// wildcard over those for parent domains. f.mu must be held.
+func (f *forwarder) appConnectorURLLocked(query []byte) string {
+	if len(f.appConnectors) == 0 {
+		return ""
+	}
+	var p dns.Parser
+	if _, err := p.Start(query); err != nil {
+		return ""
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	if url, ok := f.appConnectors[name]; ok {
+		return url
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if url, ok := f.appConnectors["*."+name]; ok {
+			return url
+		}
+	}
+	return ""
+}
+
 // send sends packet to dst. It is best effort.
 func (f *forwarder) send(packet []byte, dst net.Addr) {
 	connIdx := rand.Intn(connCount)
@@ -194,7 +312,7 @@ func (f *forwarder) recv(conn *fwdConn) {
 		default:
 		}
 		out := make([]byte, maxResponseBytes)
-		n := conn.read(out)
+		n, from := conn.read(out)
 		if n == 0 {
 			continue
 		}
@@ -202,33 +320,93 @@ func (f *forwarder) recv(conn *fwdConn) {
 			f.logf("recv: packet too small (%d bytes)", n)
 		}
 
-		out = out[:n]
-		txid := getTxID(out)
+		if !f.deliver(out[:n], from) {
+			return
+		}
+	}
+}
 
-		f.mu.Lock()
+// deliver sends the response out from the nameserver at from to
+// whoever is waiting for it, if anyone. It reports false if the
+// forwarder was closed first.
+func (f *forwarder) deliver(out []byte, from net.Addr) bool {
+	txid := getTxID(out)
 
-		record, found := f.txMap[txid]
-		// At most one nameserver will return a response:
-		// the first one to do so will delete txid from the map.
-		if !found {
-			f.mu.Unlock()
-			continue
-		}
-		delete(f.txMap, txid)
+	f.mu.Lock()
 
+	record, found := f.txMap[txid]
+	// At most one nameserver will return a response:
+	// the first one to do so will delete txid from the map.
+	if !found {
 		f.mu.Unlock()
+		return true
+	}
+	delete(f.txMap, txid)
 
-		packet := Packet{
-			Payload: out,
-			Addr:    record.src,
-		}
-		select {
-		case <-f.closed:
-			return
-		case f.responses <- packet:
-			// continue
-		}
+	f.mu.Unlock()
+
+	if record.query != nil {
+		f.qlog.logResponse(out, from.String(), record.createdAt)
+	}
+
+	if record.resp != nil {
+		record.resp <- out
+		return true
+	}
+
+	packet := Packet{
+		Payload: out,
+		Addr:    record.src,
+	}
+	select {
+	case <-f.closed:
+		return false
+	case f.responses <- packet:
+		return true
+	}
+}
+
+// peerAddr is the net.Addr of an exit node's or app connector's
+// DNS-over-HTTP endpoint, for the query log.
+type peerAddr string
+
+func (a peerAddr) Network() string { return "http" }
+func (a peerAddr) String() string  { return string(a) }
+
+// sendPeer sends query to the DNS-over-HTTP endpoint of a peer's
+// peer API at url with c, over the tunnel, and delivers the response
+// as if it had come from an upstream nameserver. The peer is the exit
+// node or an app connector. It's best effort: failed queries time out
+// like lost UDP packets do.
+func (f *forwarder) sendPeer(c *http.Client, url string, query []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), responseTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(query))
+	if err != nil {
+		f.logf("peer %s: %v", url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	res, err := c.Do(req)
+	if err != nil {
+		f.logf("peer %s: %v", url, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		f.logf("peer %s: %v", url, res.Status)
+		return
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(res.Body, maxPeerResponseBytes))
+	if err != nil {
+		f.logf("peer %s: %v", url, err)
+		return
+	}
+	if len(out) < headerBytes {
+		f.logf("peer %s: response too small (%d bytes)", url, len(out))
+		return
 	}
+	f.deliver(out, peerAddr(url))
 }
 
 // cleanMap periodically deletes timed-out forwarding records from f.txMap to bound growth.
@@ -251,6 +429,9 @@ func (f *forwarder) cleanMap() {
 		for k, v := range f.txMap {
 			if now.Sub(v.createdAt) > responseTimeout {
 				delete(f.txMap, k)
+				if v.query != nil {
+					f.qlog.logQuery(v.query, "Timeout", v.createdAt)
+				}
 			}
 		}
 		f.mu.Unlock()
@@ -259,24 +440,82 @@ func (f *forwarder) cleanMap() {
 
 // forward forwards the query to all upstream nameservers and returns the first response.
 func (f *forwarder) forward(query Packet) error {
-	txid := getTxID(query.Payload)
+	return f.forwardRecord(query.Payload, forwardingRecord{src: query.Addr})
+}
+
+// exchange forwards the query to all upstream nameservers like
+// forward, but waits for the first response and returns it rather
+// than sending it to the responses channel.
+func (f *forwarder) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	if err := f.forwardRecord(query, forwardingRecord{resp: ch}); err != nil {
+		return nil, err
+	}
+	t := time.NewTimer(responseTimeout)
+	defer t.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-f.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		f.abandon(query, ch, ctx.Err().Error())
+		return nil, ctx.Err()
+	case <-t.C:
+		f.abandon(query, ch, "Timeout")
+		return nil, errTimeout
+	}
+}
+
+// abandon removes the forwarding record of query, if it's still
+// waiting for a response on ch.
+func (f *forwarder) abandon(query []byte, ch chan<- []byte, why string) {
+	txid := getTxID(query)
+	f.mu.Lock()
+	record, ok := f.txMap[txid]
+	if ok && record.resp == ch {
+		delete(f.txMap, txid)
+	}
+	f.mu.Unlock()
+	if ok && record.resp == ch && record.query != nil {
+		f.qlog.logQuery(record.query, why, record.createdAt)
+	}
+}
+
+// forwardRecord sends query to the app connector for its name if
+// there is one, or else to all upstream nameservers, or to the exit
+// node if there are none, recording where the response should go in
+// f.txMap.
+func (f *forwarder) forwardRecord(query []byte, record forwardingRecord) error {
+	txid := getTxID(query)
 
 	f.mu.Lock()
 
 	upstreams := f.upstreams
-	if len(upstreams) == 0 {
+	exitNodeURL, exitNodeClient := f.exitNodeURL, f.exitNodeClient
+	appURL, appClient := f.appConnectorURLLocked(query), f.appConnectorClient
+	if len(upstreams) == 0 && exitNodeURL == "" && appURL == "" {
 		f.mu.Unlock()
 		return errNoUpstreams
 	}
-	f.txMap[txid] = forwardingRecord{
-		src:       query.Addr,
-		createdAt: time.Now(),
+	record.createdAt = time.Now()
+	if f.qlog.logging() {
+		record.query = query
 	}
+	f.txMap[txid] = record
 
 	f.mu.Unlock()
 
+	switch {
+	case appURL != "":
+		go f.sendPeer(appClient, appURL, query)
+		return nil
+	case len(upstreams) == 0:
+		go f.sendPeer(exitNodeClient, exitNodeURL, query)
+		return nil
+	}
 	for _, upstream := range upstreams {
-		f.send(query.Payload, upstream)
+		f.send(query, upstream)
 	}
 
 	return nil
@@ -288,6 +527,8 @@ func (f *forwarder) forward(query Packet) error {
 type fwdConn struct {
 	// logf allows a fwdConn to log.
 	logf logger.Logf
+	// netns is the interface binding of conn, or nil.
+	netns *netns.Binding
 
 	// wg tracks the number of outstanding conn.Read and conn.Write calls.
 	wg sync.WaitGroup
@@ -302,9 +543,10 @@ type fwdConn struct {
 	conn net.PacketConn
 }
 
-func newFwdConn(logf logger.Logf, idx int) *fwdConn {
+func newFwdConn(logf logger.Logf, idx int, nb *netns.Binding) *fwdConn {
 	c := new(fwdConn)
 	c.logf = logger.WithPrefix(logf, fmt.Sprintf("fwdConn %d: ", idx))
+	c.netns = nb
 	c.change = sync.NewCond(&c.mu)
 	// c.conn is created lazily in send
 	return c
@@ -393,8 +635,9 @@ func (c *fwdConn) send(packet []byte, dst net.Addr) {
 
 // read waits for a response from c's connection.
 // It returns the number of bytes read, which may be 0
-// in case of an error or a closed connection.
-func (c *fwdConn) read(out []byte) int {
+// in case of an error or a closed connection,
+// and the address the response came from.
+func (c *fwdConn) read(out []byte) (int, net.Addr) {
 	for {
 		// Gather the current connection.
 		// We can't hold the lock while we call ReadFrom.
@@ -403,7 +646,7 @@ func (c *fwdConn) read(out []byte) int {
 		closed := c.closed
 		if closed {
 			c.mu.Unlock()
-			return 0
+			return 0, nil
 		}
 		if conn == nil {
 			// There is no current connection.
@@ -415,11 +658,11 @@ func (c *fwdConn) read(out []byte) int {
 		c.mu.Unlock()
 
 		c.wg.Add(1)
-		n, _, err := conn.ReadFrom(out)
+		n, from, err := conn.ReadFrom(out)
 		c.wg.Done()
 		if err == nil {
 			// Success.
-			return n
+			return n, from
 		}
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			// We intentionally closed this connection.
@@ -428,7 +671,7 @@ func (c *fwdConn) read(out []byte) int {
 		}
 
 		c.logf("read: unrecognized error: %v", err)
-		return 0
+		return 0, nil
 	}
 }
 
@@ -437,7 +680,7 @@ func (c *fwdConn) read(out []byte) int {
 func (c *fwdConn) reconnectLocked() {
 	c.closeConnLocked()
 	// Make a new connection.
-	conn, err := netns.Listener().ListenPacket(context.Background(), "udp", "")
+	conn, err := c.netns.Listener().ListenPacket(context.Background(), "udp", "")
 	if err != nil {
 		c.logf("ListenPacket failed: %v", err)
 	} else {
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// queryLogSize is how many queries a QueryLog remembers.
+const queryLogSize = 256
+
+// resolverMagicDNS is the DNSQuery.Resolver of queries answered by
+// the Resolver itself rather than forwarded.
+const resolverMagicDNS = "magicdns"
+
+// A QueryLog is a Resolver's ring buffer of recent queries, for
+// debugging which queries are answered by MagicDNS and which are
+// forwarded where. It's off by default. Even when on, it doesn't
+// record the answers unless asked to, as those say more about what
+// the user is up to than the names alone.
+type QueryLog struct {
+	mu      sync.Mutex
+	on      bool
+	answers bool
+	ents    []ipnstate.DNSQuery // ring buffer, of capacity queryLogSize
+	next    int                 // index in ents of the next entry
+}
+
+// SetEnabled turns the log on or off, and sets whether it records
+// answers. Turning it off clears it.
+func (l *QueryLog) SetEnabled(on, withAnswers bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.on = on
+	l.answers = on && withAnswers
+	if !on {
+		l.ents = nil
+		l.next = 0
+	}
+}
+
+// Enabled reports whether the log is on, and whether it records
+// answers.
+func (l *QueryLog) Enabled() (on, withAnswers bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.on, l.answers
+}
+
+// Snapshot returns the log's state and its queries.
+func (l *QueryLog) Snapshot() *ipnstate.DNSQueryLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := &ipnstate.DNSQueryLog{
+		Enabled:     l.on,
+		WithAnswers: l.answers,
+		Queries:     make([]ipnstate.DNSQuery, 0, len(l.ents)),
+	}
+	if len(l.ents) == queryLogSize {
+		ret.Queries = append(ret.Queries, l.ents[l.next:]...)
+	}
+	ret.Queries = append(ret.Queries, l.ents[:l.next]...)
+	return ret
+}
+
+// logging reports whether the log is on. It's cheap enough to call on
+// every query.
+func (l *QueryLog) logging() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.on
+}
+
+func (l *QueryLog) add(e ipnstate.DNSQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.on {
+		return
+	}
+	if !l.answers {
+		e.Answers = nil
+	}
+	if len(l.ents) < queryLogSize {
+		l.ents = append(l.ents, e)
+	} else {
+		l.ents[l.next] = e
+	}
+	l.next = (l.next + 1) % queryLogSize
+}
+
+// logResponse logs the query answered by the DNS response resp, which
+// took since start to come from resolver.
+func (l *QueryLog) logResponse(resp []byte, resolver string, start time.Time) {
+	_, withAnswers := l.Enabled()
+	e := ipnstate.DNSQuery{
+		Time:           start,
+		Resolver:       resolver,
+		LatencySeconds: time.Since(start).Seconds(),
+	}
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		e.RCode = "unparseable response: " + err.Error()
+		l.add(e)
+		return
+	}
+	e.RCode = rcodeString(h.RCode)
+	if q, err := p.Question(); err == nil {
+		e.Name = q.Name.String()
+		e.Type = typeString(q.Type)
+	}
+	if !withAnswers {
+		// Don't bother parsing them.
+	} else if err := p.SkipAllQuestions(); err == nil {
+		if answers, err := p.AllAnswers(); err == nil {
+			for _, a := range answers {
+				e.Answers = append(e.Answers, answerString(a))
+			}
+		}
+	}
+	l.add(e)
+}
+
+// logQuery logs the DNS query, which got no response, with why as its
+// RCode.
+func (l *QueryLog) logQuery(query []byte, why string, start time.Time) {
+	e := ipnstate.DNSQuery{
+		Time:           start,
+		LatencySeconds: time.Since(start).Seconds(),
+		RCode:          why,
+	}
+	var p dns.Parser
+	if _, err := p.Start(query); err == nil {
+		if q, err := p.Question(); err == nil {
+			e.Name = q.Name.String()
+			e.Type = typeString(q.Type)
+		}
+	}
+	l.add(e)
+}
+
+func rcodeString(c dns.RCode) string {
+	return strings.TrimPrefix(c.String(), "RCode")
+}
+
+func typeString(t dns.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+func answerString(a dns.Resource) string {
+	switch b := a.Body.(type) {
+	case *dns.AResource:
+		ip, _ := netaddr.FromStdIP(net.IP(b.A[:]))
+		return "A " + ip.String()
+	case *dns.AAAAResource:
+		ip, _ := netaddr.FromStdIP(net.IP(b.AAAA[:]))
+		return "AAAA " + ip.String()
+	case *dns.CNAMEResource:
+		return "CNAME " + b.CNAME.String()
+	case *dns.PTRResource:
+		return "PTR " + b.PTR.String()
+	default:
+		return typeString(a.Header.Type)
+	}
+}
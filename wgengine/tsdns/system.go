@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// systemNameservers returns the addresses of the operating system's
+// nameservers. Tests replace it.
+var systemNameservers = osNameservers
+
+// QuerySystem forwards the DNS query message, as is, to the operating
+// system's nameservers and returns the first response message, also
+// as is. Exit nodes use it to answer queries forwarded to them by
+// peers, so that those are resolved by the exit node's own resolvers,
+// with every record type, CNAME chain and TTL intact. Its sockets bind
+// to nb's interface; nb may be nil.
+//
+// If no nameserver answers in time, the response is a SERVFAIL.
+func QuerySystem(ctx context.Context, nb *netns.Binding, query []byte) ([]byte, error) {
+	resp := new(response)
+	if err := parseQuery(query, resp); err != nil {
+		resp.Header.RCode = dns.RCodeFormatError
+		return marshalResponse(resp)
+	}
+	servers, err := systemNameservers()
+	if err == nil && len(servers) == 0 {
+		err = errNoUpstreams
+	}
+	if err == nil {
+		var out []byte
+		if out, err = exchangeSystem(ctx, nb, servers, query); err == nil {
+			return out, nil
+		}
+	}
+	resp.Header.RCode = dns.RCodeServerFailure
+	return marshalResponse(resp)
+}
+
+// exchangeSystem sends query to each of servers over UDP and returns
+// the first response to it. If that response is truncated, the query
+// is sent again to the same server over TCP.
+func exchangeSystem(ctx context.Context, nb *netns.Binding, servers []netaddr.IPPort, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, responseTimeout)
+	defer cancel()
+
+	pc, err := nb.Listener().ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	for _, s := range servers {
+		pc.WriteTo(query, s.UDPAddr())
+	}
+	buf := make([]byte, maxPeerResponseBytes)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errTimeout
+			}
+			return nil, err
+		}
+		ua, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		src, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+		if !ok || !isSystemNameserver(servers, src) {
+			continue
+		}
+		out := buf[:n]
+		if n < headerBytes || out[2]&0x80 == 0 || getTxID(out) != getTxID(query) {
+			// Not a response to query.
+			continue
+		}
+		if out[2]&0x02 != 0 {
+			// Truncated.
+			return exchangeTCP(ctx, nb, src, query)
+		}
+		return append([]byte(nil), out...), nil
+	}
+}
+
+// isSystemNameserver reports whether ipp is one of servers.
+func isSystemNameserver(servers []netaddr.IPPort, ipp netaddr.IPPort) bool {
+	ipp.IP = ipp.IP.Unmap()
+	for _, s := range servers {
+		if s.IP.Unmap() == ipp.IP && s.Port == ipp.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeTCP sends query to server over TCP and returns its response.
+func exchangeTCP(ctx context.Context, nb *netns.Binding, server netaddr.IPPort, query []byte) ([]byte, error) {
+	c, err := nb.NewDialer().DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c, out); err != nil {
+		return nil, err
+	}
+	if len(out) < headerBytes || getTxID(out) != getTxID(query) {
+		return nil, errors.New("TCP response doesn't match query")
+	}
+	return out, nil
+}
+
+// parseResolvConf returns the nameservers listed in the resolv.conf
+// file r, on port 53.
+func parseResolvConf(r io.Reader) []netaddr.IPPort {
+	var ret []netaddr.IPPort
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		ip, err := netaddr.ParseIP(f[1])
+		if err != nil {
+			continue
+		}
+		ret = append(ret, netaddr.IPPort{IP: ip, Port: 53})
+	}
+	return ret
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package tsdns
+
+import (
+	"os"
+
+	"inet.af/netaddr"
+)
+
+// osNameservers returns the nameservers in /etc/resolv.conf.
+func osNameservers() ([]netaddr.IPPort, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseResolvConf(f), nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+func TestQuerySystem(t *testing.T) {
+	dnsHandleFunc("mx.system.test.", resolveToCNAMEAndMX)
+	dnsHandleFunc("big.system.test.", resolveToTXTOverTCP)
+	ns := serveDNSUDPAndTCP(t)
+	defer func(old func() ([]netaddr.IPPort, error)) { systemNameservers = old }(systemNameservers)
+	systemNameservers = func() ([]netaddr.IPPort, error) { return []netaddr.IPPort{ns}, nil }
+
+	// query returns the response header and answer headers of
+	// QuerySystem's response to a query for name and tp.
+	query := func(t *testing.T, name string, tp dns.Type) (dns.Header, []dns.ResourceHeader) {
+		t.Helper()
+		out, err := QuerySystem(context.Background(), nil, dnspacket(name, tp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p dns.Parser
+		h, err := p.Start(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SkipAllQuestions(); err != nil {
+			t.Fatal(err)
+		}
+		var answers []dns.ResourceHeader
+		for {
+			ah, err := p.AnswerHeader()
+			if err == dns.ErrSectionDone {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			answers = append(answers, ah)
+			if err := p.SkipAnswer(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return h, answers
+	}
+
+	t.Run("cname_mx", func(t *testing.T) {
+		// Neither the MX type, nor the CNAME, nor the TTLs
+		// survive a trip through the system's net.Resolver.
+		_, answers := query(t, "mx.system.test.", dns.TypeMX)
+		if len(answers) != 2 {
+			t.Fatalf("answers = %v; want CNAME and MX", answers)
+		}
+		if a := answers[0]; a.Type != dns.TypeCNAME || a.TTL != 1234 {
+			t.Errorf("first answer = %v; want a CNAME with TTL 1234", a)
+		}
+		if a := answers[1]; a.Type != dns.TypeMX || a.Name.String() != "mail.mx.system.test." || a.TTL != 42 {
+			t.Errorf("second answer = %v; want an MX for the CNAME's target with TTL 42", a)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		h, answers := query(t, "big.system.test.", dns.TypeTXT)
+		if h.Truncated || len(answers) != 20 {
+			t.Errorf("truncated=%v with %d answers; want the full TCP response of 20", h.Truncated, len(answers))
+		}
+	})
+	t.Run("no_nameservers", func(t *testing.T) {
+		defer func(old func() ([]netaddr.IPPort, error)) { systemNameservers = old }(systemNameservers)
+		systemNameservers = func() ([]netaddr.IPPort, error) { return nil, nil }
+		if h, _ := query(t, "mx.system.test.", dns.TypeMX); h.RCode != dns.RCodeServerFailure {
+			t.Errorf("rcode = %v; want SERVFAIL", h.RCode)
+		}
+	})
+	t.Run("formerr", func(t *testing.T) {
+		out, err := QuerySystem(context.Background(), nil, []byte{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := unpackResponse(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.rcode != dns.RCodeFormatError {
+			t.Errorf("rcode = %v; want FORMERR", resp.rcode)
+		}
+	})
+}
+
+func TestParseResolvConf(t *testing.T) {
+	const conf = `# generated
+search example.com
+nameserver 192.168.1.1
+nameserver   2001:db8::53
+nameserver bogus
+options edns0
+`
+	got := parseResolvConf(strings.NewReader(conf))
+	want := []netaddr.IPPort{
+		netaddr.MustParseIPPort("192.168.1.1:53"),
+		netaddr.MustParseIPPort("[2001:db8::53]:53"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResolvConf = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+)
+
+// osNameservers returns the nameservers configured on the interfaces
+// that are up, other than Tailscale's own.
+func osNameservers() ([]netaddr.IPPort, error) {
+	ifs, err := interfaces.NonTailscaleInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPort
+	for _, iface := range ifs {
+		if iface.OperStatus != winipcfg.IfOperStatusUp {
+			continue
+		}
+		for s := iface.FirstDNSServerAddress; s != nil; s = s.Next {
+			if ip, ok := netaddr.FromStdIP(s.Address.IP()); ok {
+				ret = append(ret, netaddr.IPPort{IP: ip, Port: 53})
+			}
+		}
+	}
+	return ret, nil
+}
@@ -7,6 +7,7 @@
 package tsdns
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"net"
@@ -17,6 +18,7 @@ import (
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/monitor"
@@ -65,6 +67,8 @@ type Resolver struct {
 	unregLinkMon func()       // or nil
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// qlog is the optional log of queries.
+	qlog *QueryLog
 
 	// queue is a buffered channel holding DNS requests queued for resolution.
 	queue chan Packet
@@ -94,6 +98,10 @@ type ResolverConfig struct {
 	// connections on link changes.
 	// If nil, rebinds are not performend.
 	LinkMonitor *monitor.Mon
+	// Netns optionally sets the interface that forwarding sockets
+	// bind to. If nil, the OS is asked for the default route's on
+	// each listen.
+	Netns *netns.Binding
 }
 
 // NewResolver constructs a resolver associated with the given root domain.
@@ -106,10 +114,11 @@ func NewResolver(config ResolverConfig) *Resolver {
 		responses: make(chan Packet),
 		errors:    make(chan error),
 		closed:    make(chan struct{}),
+		qlog:      new(QueryLog),
 	}
 
 	if config.Forward {
-		r.forwarder = newForwarder(r.logf, r.responses)
+		r.forwarder = newForwarder(r.logf, r.responses, r.qlog, config.Netns)
 	}
 	if r.linkMon != nil {
 		r.unregLinkMon = r.linkMon.RegisterChangeCallback(r.onLinkMonitorChange)
@@ -171,6 +180,12 @@ func (r *Resolver) SetMap(m *Map) {
 	r.logf("map diff:\n%s", m.PrettyDiffFrom(oldMap))
 }
 
+// QueryLog returns the resolver's query log, which is off until
+// enabled.
+func (r *Resolver) QueryLog() *QueryLog {
+	return r.qlog
+}
+
 // SetUpstreams sets the addresses of the resolver's
 // upstream nameservers, taking ownership of the argument.
 func (r *Resolver) SetUpstreams(upstreams []net.Addr) {
@@ -180,6 +195,35 @@ func (r *Resolver) SetUpstreams(upstreams []net.Addr) {
 	r.logf("set upstreams: %v", upstreams)
 }
 
+// SetExitNode sets the DNS-over-HTTP endpoint of the exit node's
+// peer API, to forward queries to when there are no upstream
+// nameservers, so that they leave through the exit node rather than
+// the local network. The empty url means there's no exit node.
+//
+// dial makes TCP connections through the tailnet, which in userspace
+// networking mode the OS can't. If it's nil, the OS dials.
+func (r *Resolver) SetExitNode(url string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	if r.forwarder != nil {
+		r.forwarder.setExitNode(url, dial)
+	}
+	r.logf("set exit node DNS: %q", url)
+}
+
+// SetAppConnectors sets the DNS-over-HTTP endpoints of the peer APIs
+// of app connectors, by the domains they route, to forward queries
+// for those domains to rather than to upstream nameservers or the
+// exit node. That way the app connector sees, and advertises routes
+// for, the addresses that this node is told. A "*.example.com" domain
+// routes the subdomains of example.com, but not example.com itself.
+//
+// dial is as for SetExitNode.
+func (r *Resolver) SetAppConnectors(routes map[string]string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	if r.forwarder != nil {
+		r.forwarder.setAppConnectors(routes, dial)
+	}
+	r.logf("set app connector DNS: %v", routes)
+}
+
 // EnqueueRequest places the given DNS request in the resolver's queue.
 // It takes ownership of the payload and does not block.
 // If the queue is full, the request will be dropped and an error will be returned.
@@ -207,6 +251,35 @@ func (r *Resolver) NextResponse() (Packet, error) {
 	}
 }
 
+// Query answers the DNS query, forwarding it upstream if it's not for
+// a Tailscale name, and returns the response. Unlike EnqueueRequest,
+// it waits for the answer itself, for callers such as the LocalAPI
+// that get queries other than as packets from the TUN device.
+func (r *Resolver) Query(ctx context.Context, query []byte) ([]byte, error) {
+	select {
+	case <-r.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	start := time.Now()
+	out, err := r.respond(query)
+	if err == errNotOurName {
+		if r.forwarder != nil {
+			return r.forwarder.exchange(ctx, query)
+		}
+		err = errNotForwarding
+	}
+	if r.qlog.logging() {
+		if err != nil {
+			r.qlog.logQuery(query, err.Error(), start)
+		} else {
+			r.qlog.logResponse(out, resolverMagicDNS, start)
+		}
+	}
+	return out, err
+}
+
 // Resolve maps a given domain name to the IP address of the host that owns it,
 // if the IP address conforms to the DNS resource type given by tp (one of A, AAAA, ALL).
 // The domain name must be in canonical form (with a trailing period).
@@ -305,6 +378,7 @@ func (r *Resolver) poll() {
 			// continue
 		}
 
+		start := time.Now()
 		out, err := r.respond(packet.Payload)
 
 		if err == errNotOurName {
@@ -320,6 +394,9 @@ func (r *Resolver) poll() {
 		}
 
 		if err != nil {
+			if r.qlog.logging() {
+				r.qlog.logQuery(packet.Payload, err.Error(), start)
+			}
 			select {
 			case <-r.closed:
 				return
@@ -327,6 +404,9 @@ func (r *Resolver) poll() {
 				// continue
 			}
 		} else {
+			if r.qlog.logging() {
+				r.qlog.logResponse(out, resolverMagicDNS, start)
+			}
 			packet.Payload = out
 			select {
 			case <-r.closed:
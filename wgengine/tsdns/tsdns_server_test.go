@@ -5,7 +5,9 @@
 package tsdns
 
 import (
+	"fmt"
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -74,6 +76,71 @@ func resolveToNXDOMAIN(w dns.ResponseWriter, req *dns.Msg) {
 	w.WriteMsg(m)
 }
 
+// resolveToCNAMEAndMX responds to every query with a CNAME of the
+// queried name to "mail."+name, with TTL 1234, and an MX record for
+// the CNAME's target, with TTL 42.
+func resolveToCNAMEAndMX(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	name := req.Question[0].Name
+	m.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 1234},
+			Target: "mail." + name,
+		},
+		&dns.MX{
+			Hdr:        dns.RR_Header{Name: "mail." + name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 42},
+			Preference: 10,
+			Mx:         "mx1." + name,
+		},
+	}
+	w.WriteMsg(m)
+}
+
+// resolveToTXTOverTCP responds to queries over UDP with an empty,
+// truncated response, and to queries over TCP with 20 TXT records.
+func resolveToTXTOverTCP(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if w.RemoteAddr().Network() == "udp" {
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("%d-%s", i, strings.Repeat("x", 100))},
+		})
+	}
+	w.WriteMsg(m)
+}
+
+// serveDNSUDPAndTCP starts UDP and TCP DNS servers on the same local
+// port, shut down when the test ends, and returns their address.
+func serveDNSUDPAndTCP(t *testing.T) netaddr.IPPort {
+	t.Helper()
+	udp, udpErr := serveDNS(t, "127.0.0.1:0")
+	if udp == nil {
+		t.Fatal(<-udpErr)
+	}
+	t.Cleanup(func() { udp.Shutdown() })
+	addr := udp.PacketConn.LocalAddr().String()
+
+	tcp := &dns.Server{Addr: addr, Net: "tcp"}
+	started := make(chan struct{})
+	tcp.NotifyStartedFunc = func() { close(started) }
+	tcpErr := make(chan error, 1)
+	go func() { tcpErr <- tcp.ListenAndServe() }()
+	select {
+	case <-started:
+	case err := <-tcpErr:
+		t.Fatalf("TCP server on %v: %v", addr, err)
+	}
+	t.Cleanup(func() { tcp.Shutdown() })
+	return netaddr.MustParseIPPort(addr)
+}
+
 func serveDNS(tb testing.TB, addr string) (*dns.Server, chan error) {
 	server := &dns.Server{Addr: addr, Net: "udp"}
 
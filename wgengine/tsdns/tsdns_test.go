@@ -6,14 +6,21 @@ package tsdns
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tstest"
+	"tailscale.com/wgengine/monitor"
 )
 
 var testipv4 = netaddr.IPv4(1, 2, 3, 4)
@@ -382,6 +389,217 @@ func TestDelegate(t *testing.T) {
 	}
 }
 
+func TestQuery(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	dnsHandleFunc("test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+
+	server, errch := serveDNS(t, "127.0.0.1:0")
+	defer func() {
+		if err := <-errch; err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+	if server == nil {
+		return
+	}
+	defer server.Shutdown()
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{server.PacketConn.LocalAddr()})
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		name   string
+		wantIP netaddr.IP
+	}{
+		{"test1.ipn.dev.", testipv4}, // answered by MagicDNS
+		{"test.site.", testipv4},     // forwarded
+	}
+	for _, tt := range tests {
+		payload, err := r.Query(context.Background(), dnspacket(tt.name, dns.TypeA))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		resp, err := unpackResponse(payload)
+		if err != nil {
+			t.Errorf("%s: unpack: %v", tt.name, err)
+			continue
+		}
+		if resp.rcode != dns.RCodeSuccess || resp.ip != tt.wantIP {
+			t.Errorf("%s: rcode, ip = %v, %v; want Success, %v", tt.name, resp.rcode, resp.ip, tt.wantIP)
+		}
+	}
+}
+
+// newFakePeerDNS returns a fake exit node or app connector peer API
+// that answers every A query with ip.
+func newFakePeerDNS(ip netaddr.IP) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		var parser dns.Parser
+		h, err := parser.Start(query)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		q, err := parser.Question()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		h.Response = true
+		b := dns.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		b.AResource(dns.ResourceHeader{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET, TTL: 60}, dns.AResource{A: ip.As4()})
+		resp, _ := b.Finish()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+}
+
+func TestQueryExitNode(t *testing.T) {
+	ts := newFakePeerDNS(testipv4)
+	defer ts.Close()
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	if _, err := r.Query(context.Background(), dnspacket("test.site.", dns.TypeA)); err != errNoUpstreams {
+		t.Errorf("query without exit node: err = %v; want %v", err, errNoUpstreams)
+	}
+
+	r.SetExitNode(ts.URL+"/v0/dns-query", nil)
+	payload, err := r.Query(context.Background(), dnspacket("test.site.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := unpackResponse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.rcode != dns.RCodeSuccess || resp.ip != testipv4 {
+		t.Errorf("rcode, ip = %v, %v; want Success, %v", resp.rcode, resp.ip, testipv4)
+	}
+}
+
+func TestQueryAppConnector(t *testing.T) {
+	exitIP := testipv4
+	exact, wild := netaddr.IPv4(192, 0, 2, 1), netaddr.IPv4(192, 0, 2, 2)
+	exitNode, exactConn, wildConn := newFakePeerDNS(exitIP), newFakePeerDNS(exact), newFakePeerDNS(wild)
+	defer exitNode.Close()
+	defer exactConn.Close()
+	defer wildConn.Close()
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+	r.SetExitNode(exitNode.URL+"/v0/dns-query", nil)
+	r.SetAppConnectors(map[string]string{
+		"app.example.com": exactConn.URL + "/v0/dns-query",
+		"*.example.com":   wildConn.URL + "/v0/dns-query",
+	}, nil)
+
+	tests := []struct {
+		name string
+		want netaddr.IP
+	}{
+		{"app.example.com.", exact},
+		{"APP.Example.com.", exact},
+		{"www.example.com.", wild},
+		{"a.app.example.com.", wild},
+		{"example.com.", exitIP},
+		{"example.org.", exitIP},
+	}
+	for _, tt := range tests {
+		payload, err := r.Query(context.Background(), dnspacket(tt.name, dns.TypeA))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		resp, err := unpackResponse(payload)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.ip != tt.want {
+			t.Errorf("%s: ip = %v; want %v", tt.name, resp.ip, tt.want)
+		}
+	}
+
+	// Without an exit node or upstreams, names the app connectors
+	// route are still answered.
+	r.SetExitNode("", nil)
+	if _, err := r.Query(context.Background(), dnspacket("www.example.com.", dns.TypeA)); err != nil {
+		t.Errorf("app connector without upstreams: %v", err)
+	}
+	if _, err := r.Query(context.Background(), dnspacket("example.org.", dns.TypeA)); err != errNoUpstreams {
+		t.Errorf("other name without upstreams: err = %v; want %v", err, errNoUpstreams)
+	}
+}
+
+func TestLinkChangeRebinds(t *testing.T) {
+	mon, fake := monitor.NewFake(t.Logf, nil)
+	defer mon.Close()
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true, LinkMonitor: mon})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	mon.Start()
+
+	// The forwarder's sockets are created lazily, so any that are
+	// bound here were bound by a rebind.
+	bound := func() int {
+		n := 0
+		for _, c := range r.forwarder.conns {
+			c.mu.Lock()
+			if c.conn != nil {
+				n++
+			}
+			c.mu.Unlock()
+		}
+		return n
+	}
+
+	// A gateway change without any interface change doesn't rebind.
+	if err := fake.Run(5*time.Second, monitor.GatewayChange("192.168.0.254", "192.168.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := bound(); n != 0 {
+		t.Fatalf("after gateway change, %d sockets rebound; want 0", n)
+	}
+
+	// The interface going down does.
+	if err := fake.Run(5*time.Second, monitor.LinkDown("eth0")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); bound() != connCount; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("after link down, %d sockets rebound; want %d", bound(), connCount)
+		}
+	}
+}
+
 func TestDelegateCollision(t *testing.T) {
 	dnsHandleFunc("test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
 
@@ -740,6 +958,68 @@ func TestAllocs(t *testing.T) {
 	}
 }
 
+func TestQueryLog(t *testing.T) {
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: false})
+	r.SetMap(dnsMap)
+
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA))
+	if l := r.QueryLog().Snapshot(); l.Enabled || len(l.Queries) != 0 {
+		t.Fatalf("query log on by default: %+v", l)
+	}
+
+	r.QueryLog().SetEnabled(true, false)
+	syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA))
+	syncRespond(r, dnspacket("test3.ipn.dev.", dns.TypeA))
+	l := r.QueryLog().Snapshot()
+	if len(l.Queries) != 2 {
+		t.Fatalf("got %d queries; want 2", len(l.Queries))
+	}
+	q := l.Queries[0]
+	if q.Name != "test1.ipn.dev." || q.Type != "A" || q.Resolver != resolverMagicDNS || q.RCode != "Success" {
+		t.Errorf("first query = %+v", q)
+	}
+	if len(q.Answers) != 0 {
+		t.Errorf("answers logged without being asked for: %q", q.Answers)
+	}
+	if q := l.Queries[1]; q.Name != "test3.ipn.dev." || q.RCode != "NameError" {
+		t.Errorf("second query = %+v", q)
+	}
+
+	r.QueryLog().SetEnabled(true, true)
+	syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA))
+	l = r.QueryLog().Snapshot()
+	if got, want := l.Queries[len(l.Queries)-1].Answers, []string{"A 1.2.3.4"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("answers = %q; want %q", got, want)
+	}
+
+	r.QueryLog().SetEnabled(false, false)
+	if l := r.QueryLog().Snapshot(); len(l.Queries) != 0 {
+		t.Errorf("%d queries kept after turning the log off", len(l.Queries))
+	}
+}
+
+func TestQueryLogWraps(t *testing.T) {
+	var l QueryLog
+	l.SetEnabled(true, false)
+	for i := 0; i < queryLogSize+10; i++ {
+		l.add(ipnstate.DNSQuery{LatencySeconds: float64(i)})
+	}
+	qs := l.Snapshot().Queries
+	if len(qs) != queryLogSize {
+		t.Fatalf("got %d queries; want %d", len(qs), queryLogSize)
+	}
+	for i, q := range qs {
+		if want := float64(i + 10); q.LatencySeconds != want {
+			t.Fatalf("query %d is %v; want %v", i, q.LatencySeconds, want)
+		}
+	}
+}
+
 func TestTrimRDNSBonjourPrefix(t *testing.T) {
 	tests := []struct {
 		in   string
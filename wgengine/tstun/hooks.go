@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"tailscale.com/net/packet"
+)
+
+// A PacketHook is called with each packet passing through a TUN in
+// one direction, for programs embedding tailscale that need to do
+// their own NAT, accounting or protocol translation.
+//
+// The packet's bytes are p.Buffer(). The hook may modify them in
+// place, without changing the packet's length, and return
+// HookModified; the TUN then parses the packet again. Fixing up any
+// checksums the change affects is up to the hook.
+//
+// Hooks run synchronously on the data path, for every packet. They
+// must be fast and must not block, allocate per packet, panic, or
+// retain p or its buffer after returning. They may be called
+// concurrently with themselves.
+type PacketHook func(p *packet.Parsed) HookResponse
+
+// HookResponse is a PacketHook's verdict on a packet.
+type HookResponse int
+
+const (
+	// HookAccept passes the packet on unchanged.
+	HookAccept HookResponse = iota
+	// HookModified passes on the packet, which the hook modified.
+	HookModified
+	// HookDrop drops the packet silently.
+	HookDrop
+)
+
+// hooks is a TUN's packet hooks in one direction.
+type hooks struct {
+	mu   sync.Mutex   // serializes changes
+	list atomic.Value // of []*PacketHook, copied on write
+}
+
+func (h *hooks) load() []*PacketHook {
+	list, _ := h.list.Load().([]*PacketHook)
+	return list
+}
+
+// add adds hook and returns a func that removes it.
+func (h *hooks) add(hook PacketHook) (remove func()) {
+	hp := &hook
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.load()
+	h.list.Store(append(old[:len(old):len(old)], hp))
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		var list []*PacketHook
+		for _, v := range h.load() {
+			if v != hp {
+				list = append(list, v)
+			}
+		}
+		h.list.Store(list)
+	}
+}
+
+// run runs the hooks on p, in the order they were added, and reports
+// whether p should be passed on.
+func (h *hooks) run(p *packet.Parsed) bool {
+	for _, hook := range h.load() {
+		switch (*hook)(p) {
+		case HookDrop:
+			return false
+		case HookModified:
+			p.Decode(p.Buffer())
+		}
+	}
+	return true
+}
+
+// AddInboundHook adds a hook for packets from peers, returning a func
+// that removes it. Inbound hooks see only packets the packet filter
+// accepted, just before they're written to the OS, so they may
+// rewrite Tailscale addresses into local ones. Packets injected with
+// InjectInboundDirect or InjectInboundCopy bypass them.
+func (t *TUN) AddInboundHook(hook PacketHook) (remove func()) {
+	return t.inboundHooks.add(hook)
+}
+
+// AddOutboundHook adds a hook for packets from the OS, returning a
+// func that removes it. Outbound hooks see packets as the OS sent
+// them, before the packet filter, so they may rewrite local addresses
+// into Tailscale ones. Packets injected with InjectOutbound bypass
+// them.
+func (t *TUN) AddOutboundHook(hook PacketHook) (remove func()) {
+	return t.outboundHooks.add(hook)
+}
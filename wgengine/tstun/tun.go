@@ -19,6 +19,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -70,6 +71,18 @@ type TUN struct {
 
 	destIPActivity atomic.Value // of map[netaddr.IP]func()
 
+	// mssClamp optionally reports the TCP MSS to clamp SYN packets
+	// to or from a peer IP. See SetMSSClampFunc.
+	mssClamp atomic.Value // of func(netaddr.IP) uint16
+
+	// echoLocal optionally reports whether an IP is one of the
+	// node's own, whose pings t answers. See SetEchoResponder.
+	echoLocal atomic.Value // of func(netaddr.IP) bool
+
+	// captureHook, if set, is called with every packet read from or
+	// written to the device. See InstallCaptureHook.
+	captureHook atomic.Value // of capture.Callback
+
 	// buffer stores the oldest unconsumed packet from tdev.
 	// It is made a static buffer in order to avoid allocations.
 	buffer [maxBufferSize]byte
@@ -108,6 +121,11 @@ type TUN struct {
 	// PostFilterOut is the outbound filter function that runs after the main filter.
 	PostFilterOut FilterFunc
 
+	// inboundHooks and outboundHooks are the packet hooks added by
+	// embedders. See AddInboundHook and AddOutboundHook.
+	inboundHooks  hooks
+	outboundHooks hooks
+
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
 }
@@ -134,13 +152,83 @@ func WrapTUN(logf logger.Logf, tdev tun.Device) *TUN {
 }
 
 // SetDestIPActivityFuncs sets a map of funcs to run per packet
-// destination (the map keys).
+// destination (the map keys). They're only run for outbound packets
+// accepted by the packet filter (or injected ones).
 //
 // The map ownership passes to the TUN. It must be non-nil.
 func (t *TUN) SetDestIPActivityFuncs(m map[netaddr.IP]func()) {
 	t.destIPActivity.Store(m)
 }
 
+// InstallCaptureHook sets the func called with every packet going
+// through the device, before any filtering, for debug packet capture.
+// A nil cb removes it.
+func (t *TUN) InstallCaptureHook(cb capture.Callback) {
+	t.captureHook.Store(cb)
+}
+
+// capture passes pkt to the capture hook, if there is one.
+func (t *TUN) capture(dir capture.Direction, pkt []byte) {
+	if cb, _ := t.captureHook.Load().(capture.Callback); cb != nil {
+		cb(dir, pkt)
+	}
+}
+
+// SetMSSClampFunc sets the func that reports, for a peer IP, the TCP
+// MSS that new TCP connections to or from that peer should be clamped
+// to. A return value of zero means no clamping.
+func (t *TUN) SetMSSClampFunc(fn func(peer netaddr.IP) uint16) {
+	t.mssClamp.Store(fn)
+}
+
+// clampMSS clamps the MSS of p, a TCP SYN to or from peer, if
+// requested by the func set by SetMSSClampFunc.
+func (t *TUN) clampMSS(p *packet.Parsed, peer netaddr.IP) {
+	if p.IPProto != packet.TCP || p.TCPFlags&packet.TCPSyn == 0 {
+		return
+	}
+	fn, _ := t.mssClamp.Load().(func(netaddr.IP) uint16)
+	if fn == nil {
+		return
+	}
+	if mss := fn(peer); mss != 0 {
+		p.ClampTCPMSS(mss)
+	}
+}
+
+// SetEchoResponder makes t itself answer the ICMP and ICMPv6 echo
+// requests (pings) that pass the packet filter and are to IPs that
+// isLocal reports as the node's own. It's for when nothing else would
+// answer them, such as with a fake TUN device, as otherwise they'd be
+// answered twice. A nil isLocal turns it off.
+func (t *TUN) SetEchoResponder(isLocal func(netaddr.IP) bool) {
+	t.echoLocal.Store(isLocal)
+}
+
+// answerEcho answers p, if it's a ping for the echo responder, and
+// reports whether it did.
+func (t *TUN) answerEcho(p *packet.Parsed) bool {
+	isLocal, _ := t.echoLocal.Load().(func(netaddr.IP) bool)
+	if isLocal == nil || !p.IsEchoRequest() || !isLocal(p.Dst.IP) {
+		return false
+	}
+	var h packet.Header
+	switch p.IPVersion {
+	case 4:
+		icmp := p.ICMP4Header()
+		icmp.ToResponse()
+		h = icmp
+	case 6:
+		icmp := p.ICMP6Header()
+		icmp.ToResponse()
+		h = icmp
+	default:
+		return false
+	}
+	t.InjectOutbound(packet.Generate(h, p.Payload()))
+	return true
+}
+
 func (t *TUN) Close() error {
 	var err error
 	t.closeOnce.Do(func() {
@@ -289,18 +377,22 @@ func (t *TUN) Read(buf []byte, offset int) (int, error) {
 		}
 	}
 
+	t.capture(capture.FromLocal, buf[offset:offset+n])
+
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
 	p.Decode(buf[offset : offset+n])
 
-	if m, ok := t.destIPActivity.Load().(map[netaddr.IP]func()); ok {
-		if fn := m[p.Dst.IP]; fn != nil {
-			fn()
-		}
+	if !wasInjectedPacket && !t.outboundHooks.run(p) {
+		return 0, nil
 	}
 
 	// For injected packets, we return early to bypass filtering.
+	// They're still clamped, as netstack's own TCP connections to
+	// peers take the same path as the OS's.
 	if wasInjectedPacket {
+		t.clampMSS(p, p.Dst.IP)
+		t.noteDestIPActivity(p.Dst.IP)
 		t.noteActivity()
 		return n, nil
 	}
@@ -312,11 +404,25 @@ func (t *TUN) Read(buf []byte, offset int) (int, error) {
 			return 0, nil
 		}
 	}
+	t.clampMSS(p, p.Dst.IP)
 
+	// Only packets that pass the filter may cause a lazily
+	// configured peer to be installed in wireguard-go.
+	t.noteDestIPActivity(p.Dst.IP)
 	t.noteActivity()
 	return n, nil
 }
 
+// noteDestIPActivity calls the activity func registered with
+// SetDestIPActivityFuncs for dst, if any.
+func (t *TUN) noteDestIPActivity(dst netaddr.IP) {
+	if m, ok := t.destIPActivity.Load().(map[netaddr.IP]func()); ok {
+		if fn := m[dst]; fn != nil {
+			fn()
+		}
+	}
+}
+
 func (t *TUN) filterIn(buf []byte) filter.Response {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
@@ -361,18 +467,36 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 		return filter.Drop
 	}
 
+	if t.answerEcho(p) {
+		return filter.DropSilently // answered; don't pass on
+	}
+
 	if t.PostFilterIn != nil {
 		if res := t.PostFilterIn(p, t); res.IsDrop() {
 			return res
 		}
 	}
 
+	t.clampMSS(p, p.Src.IP)
 	return filter.Accept
 }
 
+// clampMSSIn clamps the MSS of pkt, a packet from a peer that the
+// filter didn't see, if requested by the func set by SetMSSClampFunc.
+func (t *TUN) clampMSSIn(pkt []byte) {
+	if fn, _ := t.mssClamp.Load().(func(netaddr.IP) uint16); fn == nil {
+		return
+	}
+	p := parsedPacketPool.Get().(*packet.Parsed)
+	defer parsedPacketPool.Put(p)
+	p.Decode(pkt)
+	t.clampMSS(p, p.Src.IP)
+}
+
 // Write accepts an incoming packet. The packet begins at buf[offset:],
 // like wireguard-go/tun.Device.Write.
 func (t *TUN) Write(buf []byte, offset int) (int, error) {
+	t.capture(capture.FromPeer, buf[offset:])
 	if !t.disableFilter {
 		res := t.filterIn(buf[offset:])
 		if res == filter.DropSilently {
@@ -381,12 +505,26 @@ func (t *TUN) Write(buf []byte, offset int) (int, error) {
 		if res != filter.Accept {
 			return 0, ErrFiltered
 		}
+	} else {
+		t.clampMSSIn(buf[offset:])
+	}
+	if len(t.inboundHooks.load()) > 0 && !t.runInboundHooks(buf[offset:]) {
+		return len(buf), nil
 	}
 
 	t.noteActivity()
 	return t.tdev.Write(buf, offset)
 }
 
+// runInboundHooks runs the inbound hooks on pkt and reports whether
+// it should be written to the device.
+func (t *TUN) runInboundHooks(pkt []byte) bool {
+	p := parsedPacketPool.Get().(*packet.Parsed)
+	defer parsedPacketPool.Put(p)
+	p.Decode(pkt)
+	return t.inboundHooks.run(p)
+}
+
 func (t *TUN) GetFilter() *filter.Filter {
 	filt, _ := t.filter.Load().(*filter.Filter)
 	return filt
@@ -415,6 +553,9 @@ func (t *TUN) InjectInboundDirect(buf []byte, offset int) error {
 		return errOffsetTooSmall
 	}
 
+	t.capture(capture.FromPeer, buf[offset:])
+	t.clampMSSIn(buf[offset:])
+
 	// Write to the underlying device to skip filters.
 	_, err := t.tdev.Write(buf, offset)
 	return err
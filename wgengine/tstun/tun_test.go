@@ -6,6 +6,7 @@ package tstun
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"strconv"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/tailscale/wireguard-go/tun/tuntest"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/filter"
 )
@@ -41,6 +43,24 @@ func udp4(src, dst string, sport, dport uint16) []byte {
 	return packet.Generate(header, []byte("udp_payload"))
 }
 
+// tcp4Syn returns a TCP SYN from src to dst with an MSS option of mss.
+func tcp4Syn(src, dst string, mss uint16) []byte {
+	sip, dip := netaddr.MustParseIP(src).As4(), netaddr.MustParseIP(dst).As4()
+	b := make([]byte, 20+24)
+	b[0] = 0x45 // IPv4, 20 byte header
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64 // TTL
+	b[9] = byte(packet.TCP)
+	copy(b[12:16], sip[:])
+	copy(b[16:20], dip[:])
+	tcp := b[20:]
+	tcp[12] = 6 << 4 // 24 byte header
+	tcp[13] = byte(packet.TCPSyn)
+	tcp[20], tcp[21] = 2, 4 // MSS option
+	binary.BigEndian.PutUint16(tcp[22:24], mss)
+	return b
+}
+
 func nets(nets ...string) (ret []netaddr.IPPrefix) {
 	for _, s := range nets {
 		if i := strings.IndexByte(s, '/'); i == -1 {
@@ -242,6 +262,52 @@ func TestWriteAndInject(t *testing.T) {
 	}
 }
 
+func TestMSSClamp(t *testing.T) {
+	// The filter is disabled; clamping must not depend on it.
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+	tun.SetMSSClampFunc(func(peer netaddr.IP) uint16 {
+		if peer == netaddr.MustParseIP("100.64.0.2") {
+			return 1000
+		}
+		return 0
+	})
+	mss := func(pkt []byte) uint16 { return binary.BigEndian.Uint16(pkt[42:44]) }
+
+	var buf [MaxPacketSize]byte
+	read := func() []byte {
+		t.Helper()
+		n, err := tun.Read(buf[:], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	chtun.Outbound <- tcp4Syn("100.64.0.1", "100.64.0.2", 1460)
+	if got := mss(read()); got != 1000 {
+		t.Errorf("outbound MSS = %d; want 1000", got)
+	}
+	chtun.Outbound <- tcp4Syn("100.64.0.1", "100.64.0.3", 1460)
+	if got := mss(read()); got != 1460 {
+		t.Errorf("outbound MSS to unclamped peer = %d; want 1460", got)
+	}
+	// Netstack's own connections come in as injected packets.
+	go tun.InjectOutbound(tcp4Syn("100.64.0.1", "100.64.0.2", 1460))
+	if got := mss(read()); got != 1000 {
+		t.Errorf("injected outbound MSS = %d; want 1000", got)
+	}
+
+	go tun.Write(tcp4Syn("100.64.0.2", "100.64.0.1", 1460), 0)
+	if got := mss(<-chtun.Inbound); got != 1000 {
+		t.Errorf("inbound MSS = %d; want 1000", got)
+	}
+	go tun.InjectInboundCopy(tcp4Syn("100.64.0.2", "100.64.0.1", 1460))
+	if got := mss(<-chtun.Inbound); got != 1000 {
+		t.Errorf("injected inbound MSS = %d; want 1000", got)
+	}
+}
+
 func TestFilter(t *testing.T) {
 	chtun, tun := newChannelTUN(t.Logf, true)
 	defer tun.Close()
@@ -324,6 +390,158 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestEchoResponder(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	self := netaddr.MustParseIP("1.2.3.4")
+	tun.SetEchoResponder(func(ip netaddr.IP) bool { return ip == self })
+
+	ping := func(dst string) []byte {
+		return packet.Generate(packet.ICMP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.MustParseIP("5.6.7.8"),
+				Dst: netaddr.MustParseIP(dst),
+			},
+			Type: packet.ICMP4EchoRequest,
+		}, []byte("\x00\x01\x00\x01ping"))
+	}
+
+	go func() {
+		if _, err := tun.Write(ping("1.2.3.4"), 0); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}()
+	var buf [MaxPacketSize]byte
+	n, err := tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	var p packet.Parsed
+	p.Decode(buf[:n])
+	if !p.IsEchoResponse() || p.Src.IP != self || p.Dst.IP != netaddr.MustParseIP("5.6.7.8") {
+		t.Errorf("got %v; want echo reply from 1.2.3.4 to 5.6.7.8", &p)
+	}
+	if got := string(p.Payload()); got != "\x00\x01\x00\x01ping" {
+		t.Errorf("reply payload = %q", got)
+	}
+
+	// With the responder off, pings pass through.
+	tun.SetEchoResponder(nil)
+	go tun.Write(ping("1.2.3.4"), 0)
+	p.Decode(<-chtun.Inbound)
+	if !p.IsEchoRequest() || p.Dst.IP != self {
+		t.Errorf("got %v; want the echo request to 1.2.3.4", &p)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	// An outbound hook that drops packets to port 22, and one that
+	// counts the packets that get past it.
+	var counted int32
+	tun.AddOutboundHook(func(p *packet.Parsed) HookResponse {
+		if p.Dst.Port == 22 {
+			return HookDrop
+		}
+		return HookAccept
+	})
+	removeCount := tun.AddOutboundHook(func(p *packet.Parsed) HookResponse {
+		atomic.AddInt32(&counted, 1)
+		return HookAccept
+	})
+
+	var buf [MaxPacketSize]byte
+	read := func(pkt []byte) int {
+		chtun.Outbound <- pkt
+		n, err := tun.Read(buf[:], 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return n
+	}
+	if n := read(udp4("1.2.3.4", "5.6.7.8", 98, 22)); n != 0 {
+		t.Errorf("packet to port 22 not dropped")
+	}
+	if n := read(udp4("1.2.3.4", "5.6.7.8", 98, 98)); n == 0 {
+		t.Errorf("packet to port 98 dropped")
+	}
+	removeCount()
+	read(udp4("1.2.3.4", "5.6.7.8", 98, 98))
+	if got := atomic.LoadInt32(&counted); got != 1 {
+		t.Errorf("counting hook saw %d packets; want 1", got)
+	}
+
+	// An inbound hook that rewrites the destination from the
+	// Tailscale IP to a local one. The next hook must see the new
+	// address, and the filter must have seen the old one.
+	var sawDst netaddr.IP
+	tun.AddInboundHook(func(p *packet.Parsed) HookResponse {
+		copy(p.Buffer()[16:20], []byte{10, 0, 0, 9})
+		return HookModified
+	})
+	tun.AddInboundHook(func(p *packet.Parsed) HookResponse {
+		sawDst = p.Dst.IP
+		return HookAccept
+	})
+	if _, err := tun.Write(udp4("5.6.7.8", "1.2.3.4", 89, 89), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := <-chtun.Inbound
+	want := udp4("5.6.7.8", "10.0.0.9", 89, 89)
+	if !bytes.Equal(got[16:20], want[16:20]) {
+		t.Errorf("inbound packet dst = %v; want 10.0.0.9", got[16:20])
+	}
+	if sawDst != netaddr.MustParseIP("10.0.0.9") {
+		t.Errorf("second hook saw dst %v; want 10.0.0.9", sawDst)
+	}
+
+	// Packets the filter drops never reach inbound hooks.
+	sawDst = netaddr.IP{}
+	if _, err := tun.Write(udp4("5.6.7.8", "1.2.3.4", 22, 22), 0); err != ErrFiltered {
+		t.Errorf("write = %v; want ErrFiltered", err)
+	}
+	if !sawDst.IsZero() {
+		t.Errorf("inbound hook saw a filtered packet")
+	}
+}
+
+func TestDestIPActivity(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	var active int32
+	dst := netaddr.MustParseIP("5.6.7.8")
+	tun.SetDestIPActivityFuncs(map[netaddr.IP]func(){
+		dst: func() { atomic.AddInt32(&active, 1) },
+	})
+	tun.PreFilterOut = func(p *packet.Parsed, t *TUN) filter.Response {
+		if p.Dst.Port == 22 {
+			return filter.Drop
+		}
+		return filter.Accept
+	}
+
+	var buf [MaxPacketSize]byte
+	read := func(pkt []byte) {
+		chtun.Outbound <- pkt
+		if _, err := tun.Read(buf[:], 0); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+
+	// A filtered packet must not wake up a lazily configured peer.
+	read(udp4("1.2.3.4", "5.6.7.8", 98, 22))
+	if got := atomic.LoadInt32(&active); got != 0 {
+		t.Errorf("activity func ran %d times for a dropped packet; want 0", got)
+	}
+	read(udp4("1.2.3.4", "5.6.7.8", 98, 98))
+	if got := atomic.LoadInt32(&active); got != 1 {
+		t.Errorf("activity func ran %d times; want 1", got)
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	ftun, tun := newFakeTUN(t.Logf, false)
 	defer tun.Close()
@@ -342,6 +560,43 @@ func TestAllocs(t *testing.T) {
 	}
 }
 
+// TestFilteredAllocs enforces the allocation budgets of the filtered
+// packet paths through TUN, which run once per packet.
+func TestFilteredAllocs(t *testing.T) {
+	t.Run("write", func(t *testing.T) {
+		_, tun := newFakeTUN(t.Logf, true)
+		defer tun.Close()
+
+		packet := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+		err := tstest.MinAllocsPerRun(t, 0, func() {
+			if _, err := tun.Write(packet, 0); err != nil {
+				t.Errorf("write: error: %v", err)
+			}
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		chtun, tun := newChannelTUN(t.Logf, true)
+		defer tun.Close()
+
+		// Outbound UDP records its flow in the filter, which
+		// allocates for a flow's first packet only.
+		packet := udp4("1.2.3.4", "5.6.7.8", 98, 98)
+		buf := make([]byte, MaxPacketSize)
+		err := tstest.MinAllocsPerRun(t, 0, func() {
+			chtun.Outbound <- packet
+			if n, err := tun.Read(buf, 0); err != nil || n != len(packet) {
+				t.Errorf("read = %d, %v; want %d, nil", n, err, len(packet))
+			}
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestClose(t *testing.T) {
 	ftun, tun := newFakeTUN(t.Logf, false)
 
@@ -0,0 +1,16 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"errors"
+	"os"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+func createTUNFromFile(f *os.File, mtu int) (tun.Device, error) {
+	return nil, errors.New("TUNFile not supported on Windows")
+}
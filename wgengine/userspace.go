@@ -14,6 +14,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -21,6 +22,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/go-multierror/multierror"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"go4.org/mem"
@@ -31,6 +33,7 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tshttpproxy"
@@ -38,9 +41,10 @@ import (
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/nettype"
 	"tailscale.com/types/wgkey"
-	"tailscale.com/version"
 	"tailscale.com/version/distro"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -73,6 +77,12 @@ const (
 	// effectively have infinite idleness)
 	lazyPeerIdleThreshold = 5 * time.Minute
 
+	// minLazyPeerIdleThreshold is the lowest idle threshold that
+	// wgcfg.Config.PeerIdleTimeout can set. Activity is only
+	// recorded every packetSendTimeUpdateFrequency or so, so
+	// anything much lower would trim peers that are in use.
+	minLazyPeerIdleThreshold = 30 * time.Second
+
 	// packetSendTimeUpdateFrequency controls how often we record
 	// the time that we wrote a packet to an IP address.
 	packetSendTimeUpdateFrequency = 10 * time.Second
@@ -95,9 +105,15 @@ type userspaceEngine struct {
 	router            router.Router
 	resolver          *tsdns.Resolver
 	magicConn         *magicsock.Conn
+	confListenPort    uint16 // Config.ListenPort; the port used when SetListenPort is given 0
 	linkMon           *monitor.Mon
 	linkMonOwned      bool   // whether we created linkMon (and thus need to close it)
 	linkMonUnregister func() // unsubscribes from changes; used regardless of linkMonOwned
+	unregisterIface   func() // undoes the interfaces.RegisterTailscaleInterface of the TUN device
+
+	// netns is the interface that the sockets of the engine and its
+	// clients bind to, kept up to date from linkMon.
+	netns netns.Binding
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -108,11 +124,15 @@ type userspaceEngine struct {
 
 	wgLock              sync.Mutex // serializes all wgdev operations; see lock order comment below
 	lastCfgFull         wgcfg.Config
-	lastRouterSig       string // of router.Config
-	lastEngineSigFull   string // of full wireguard config
-	lastEngineSigTrim   string // of trimmed wireguard config
+	lastCfgDevice       *wgcfg.Config  // last config successfully set on wgdev, or nil if unknown
+	lastRouterCfg       *router.Config // last config successfully set on router, or nil
+	lastDNSUpstreams    []net.Addr     // last upstreams set on resolver
+	lastRouterSig       string         // of router.Config
+	lastEngineSigFull   string         // of full wireguard config
+	lastEngineSigTrim   string         // of trimmed wireguard config
 	recvActivityAt      map[tailcfg.DiscoKey]time.Time
 	trimmedDisco        map[tailcfg.DiscoKey]bool // set of disco keys of peers currently excluded from wireguard config
+	trimTimer           *time.Timer               // or nil; re-checks for idle peers to trim
 	sentActivityAt      map[netaddr.IP]*int64     // value is atomic int64 of unixtime
 	destIPActivityFuncs map[netaddr.IP]func()
 	statusBufioReader   *bufio.Reader // reusable for UAPI
@@ -126,6 +146,8 @@ type userspaceEngine struct {
 	pendOpen            map[flowtrack.Tuple]*pendingOpenFlow // see pendopen.go
 	networkMapCallbacks map[*someHandle]NetworkMapCallback
 	tsIPByIPPort        map[netaddr.IPPort]netaddr.IP // allows registration of IP:ports as belonging to a certain Tailscale IP for whois lookups
+	dnsExitNodeURL      string                        // last URL passed to SetDNSExitNode
+	dnsAppConnectors    map[string]string             // last routes passed to SetDNSAppConnectors
 
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
@@ -153,6 +175,11 @@ type Config struct {
 	// Exactly one of either TUN or TUNName must be specified.
 	TUNName string
 
+	// TUNFile optionally provides TUNName already open, such as
+	// when inherited from a previous tailscaled, to use rather than
+	// creating the device.
+	TUNFile *os.File
+
 	// RouterGen is the function used to instantiate the router.
 	// If nil, wgengine/router.New is used.
 	RouterGen RouterGen
@@ -168,6 +195,15 @@ type Config struct {
 	// Fake determines whether this engine should automatically
 	// reply to ICMP pings.
 	Fake bool
+
+	// RespondToPings determines whether the engine itself answers
+	// ICMP and ICMPv6 pings to the node's Tailscale IPs, for when the
+	// OS won't, such as without a kernel TUN device.
+	RespondToPings bool
+
+	// PacketListener optionally specifies how magicsock creates its
+	// UDP sockets. If nil, they're created normally.
+	PacketListener nettype.PacketListener
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -193,7 +229,11 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (Engine, error) {
 	var err error
 	if tunName := conf.TUNName; tunName != "" {
 		logf("Starting userspace wireguard engine with tun device %q", tunName)
-		tunDev, err = tun.CreateTUN(tunName, minimalMTU)
+		if conf.TUNFile != nil {
+			tunDev, err = createTUNFromFile(conf.TUNFile, minimalMTU)
+		} else {
+			tunDev, err = tun.CreateTUN(tunName, minimalMTU)
+		}
 		if err != nil {
 			diagnoseTUNFailure(tunName, logf)
 			logf("CreateTUN: %v", err)
@@ -220,6 +260,15 @@ func newUserspaceEngine(logf logger.Logf, rawTUNDev tun.Device, conf Config) (_
 	tsTUNDev := tstun.WrapTUN(logf, rawTUNDev)
 	closePool.add(tsTUNDev)
 
+	// Let the link monitor and interface code (which may be shared
+	// with other engines in this process) tell our TUN device apart
+	// from the real network whatever it's called.
+	unregisterIface := func() {}
+	if tunName, err := rawTUNDev.Name(); err == nil {
+		unregisterIface = interfaces.RegisterTailscaleInterface(tunName)
+		closePool.addFunc(unregisterIface)
+	}
+
 	e := &userspaceEngine{
 		timeNow: time.Now,
 		logf:    logf,
@@ -227,6 +276,9 @@ func newUserspaceEngine(logf logger.Logf, rawTUNDev tun.Device, conf Config) (_
 		waitCh:  make(chan struct{}),
 		tundev:  tsTUNDev,
 		pingers: make(map[wgkey.Key]*pinger),
+
+		confListenPort:  conf.ListenPort,
+		unregisterIface: unregisterIface,
 	}
 	e.localAddrs.Store(map[netaddr.IP]bool{})
 
@@ -246,12 +298,15 @@ func newUserspaceEngine(logf logger.Logf, rawTUNDev tun.Device, conf Config) (_
 		Logf:        logf,
 		Forward:     true,
 		LinkMonitor: e.linkMon,
+		Netns:       &e.netns,
 	})
 
 	logf("link state: %+v", e.linkMon.InterfaceState())
+	e.setDefaultInterface(e.linkMon.InterfaceState())
 
 	unregisterMonWatch := e.linkMon.RegisterChangeCallback(func(changed bool, st *interfaces.State) {
 		tshttpproxy.InvalidateCache()
+		e.setDefaultInterface(st)
 		e.linkChange(changed, st)
 	})
 	closePool.addFunc(unregisterMonWatch)
@@ -272,6 +327,8 @@ func newUserspaceEngine(logf logger.Logf, rawTUNDev tun.Device, conf Config) (_
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteReceiveActivity,
 		LinkMonitor:      e.linkMon,
+		PacketListener:   conf.PacketListener,
+		Netns:            &e.netns,
 	}
 	var err error
 	e.magicConn, err = magicsock.NewConn(magicsockOpts)
@@ -285,7 +342,11 @@ func newUserspaceEngine(logf logger.Logf, rawTUNDev tun.Device, conf Config) (_
 	if conf.Fake {
 		e.tundev.PostFilterIn = echoRespondToAll
 	}
+	if conf.RespondToPings {
+		e.tundev.SetEchoResponder(e.isLocalAddr)
+	}
 	e.tundev.PreFilterOut = e.handleLocalPackets
+	e.tundev.SetMSSClampFunc(e.pathMSS)
 
 	if debugConnectFailures() {
 		if e.tundev.PreFilterIn != nil {
@@ -451,6 +512,35 @@ func (e *userspaceEngine) handleLocalPackets(p *packet.Parsed, t *tstun.TUN) fil
 	return filter.Accept
 }
 
+// derpOnlyMTU is the tunnel MTU we assume for peers that are only
+// reachable via DERP, or whose direct path doesn't even carry the
+// smallest MTU probe. Some HTTP proxies and middleboxes on relay-only
+// paths mishandle full-sized segments, stalling bulk transfers, so
+// new TCP connections to such peers have their MSS clamped to fit.
+const derpOnlyMTU = 1200
+
+// pathMSS returns the TCP MSS to clamp new connections with peer to,
+// given the path its traffic takes now, or zero for no clamping.
+// A direct path is clamped to its probed MTU, if that's smaller than
+// the tunnel's; connections made later get the later path's MSS.
+func (e *userspaceEngine) pathMSS(peer netaddr.IP) uint16 {
+	viaDERP, mtu, known := e.magicConn.PeerPathMTU(peer)
+	switch {
+	case viaDERP || (known && mtu == 0):
+		mtu = derpOnlyMTU
+	case !known:
+		return 0
+	default:
+		if tunMTU, err := e.tundev.MTU(); err != nil || mtu >= tunMTU {
+			return 0
+		}
+	}
+	if peer.Is4() {
+		return uint16(mtu - 40) // IPv4 + TCP headers
+	}
+	return uint16(mtu - 60) // IPv6 + TCP headers
+}
+
 func (e *userspaceEngine) isLocalAddr(ip netaddr.IP) bool {
 	localAddrs, ok := e.localAddrs.Load().(map[netaddr.IP]bool)
 	if !ok {
@@ -640,11 +730,11 @@ var (
 )
 
 // forceFullWireguardConfig reports whether we should give wireguard
-// our full network map, even for inactive peers
+// our full network map, even for inactive peers.
 //
-// TODO(bradfitz): remove this after our 1.0 launch; we don't want to
-// enable wireguard config trimming quite yet because it just landed
-// and we haven't got enough time testing it.
+// Trimming is on by default, so that large tailnets only pay for the
+// peers they talk to. It can be turned off with the
+// TS_DEBUG_TRIM_WIREGUARD environment variable or by control.
 func forceFullWireguardConfig(numPeers int) bool {
 	// Did the user explicitly enable trimmming via the environment variable knob?
 	if debugTrimWireguardEnv != "" {
@@ -653,13 +743,6 @@ func forceFullWireguardConfig(numPeers int) bool {
 	if opt := controlclient.TrimWGConfig(); opt != "" {
 		return !opt.EqualBool(true)
 	}
-
-	// On iOS with large networks, it's critical, so turn on trimming.
-	// Otherwise we run out of memory from wireguard-go goroutine stacks+buffers.
-	// This will be the default later for all platforms and network sizes.
-	if numPeers > 50 && version.OS() == "iOS" {
-		return false
-	}
 	return false
 }
 
@@ -676,6 +759,10 @@ func isTrimmablePeer(p *wgcfg.Peer, numPeers int) bool {
 	if forceFullWireguardConfig(numPeers) {
 		return false
 	}
+	if p.PersistentKeepalive != 0 {
+		// Keepalives only do anything if the peer stays configured.
+		return false
+	}
 	if !isSingleEndpoint(p.Endpoints) {
 		return false
 	}
@@ -786,8 +873,17 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 	// We'll only keep a peer around if it's been active in
 	// the past 5 minutes. That's more than WireGuard's key
 	// rotation time anyway so it's no harm if we remove it
-	// later if it's been inactive.
-	activeCutoff := e.timeNow().Add(-lazyPeerIdleThreshold)
+	// later if it's been inactive. The config can ask for a
+	// different threshold, to save battery or to be lazier.
+	idleThreshold := lazyPeerIdleThreshold
+	if full.PeerIdleTimeout != 0 {
+		idleThreshold = full.PeerIdleTimeout
+		if idleThreshold < minLazyPeerIdleThreshold {
+			idleThreshold = minLazyPeerIdleThreshold
+		}
+	}
+	activeCutoff := e.timeNow().Add(-idleThreshold)
+	numActiveTrimmable := 0
 
 	// Not all peers can be trimmed from the network map (see
 	// isTrimmablePeer).  For those are are trimmable, keep track
@@ -818,6 +914,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 		}
 		if recentlyActive {
 			min.Peers = append(min.Peers, *p)
+			numActiveTrimmable++
 			if discoChanged[key.Public(p.PublicKey)] {
 				needRemoveStep = true
 			}
@@ -826,6 +923,26 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 		}
 	}
 
+	// Check again once the active peers could have gone idle, so
+	// that they're removed even if nothing else reconfigures
+	// WireGuard in the meantime.
+	if e.trimTimer != nil {
+		e.trimTimer.Stop()
+		e.trimTimer = nil
+	}
+	if numActiveTrimmable > 0 {
+		e.trimTimer = time.AfterFunc(idleThreshold, func() {
+			e.wgLock.Lock()
+			defer e.wgLock.Unlock()
+			e.mu.Lock()
+			closing := e.closing
+			e.mu.Unlock()
+			if !closing {
+				e.maybeReconfigWireguardLocked(nil)
+			}
+		})
+	}
+
 	if !deepprint.UpdateHash(&e.lastEngineSigTrim, min, trimmedDisco, trackDisco, trackIPs) {
 		// No changes
 		return nil
@@ -848,7 +965,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 		}
 		if numRemove > 0 {
 			e.logf("wgengine: Reconfig: removing session keys for %d peers", numRemove)
-			if err := wgcfg.ReconfigDevice(e.wgdev, &minner, e.logf); err != nil {
+			if err := e.reconfigDeviceLocked(&minner); err != nil {
 				e.logf("wgdev.Reconfig: %v", err)
 				return err
 			}
@@ -856,13 +973,35 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 	}
 
 	e.logf("wgengine: Reconfig: configuring userspace wireguard config (with %d/%d peers)", len(min.Peers), len(full.Peers))
-	if err := wgcfg.ReconfigDevice(e.wgdev, &min, e.logf); err != nil {
+	if err := e.reconfigDeviceLocked(&min); err != nil {
 		e.logf("wgdev.Reconfig: %v", err)
 		return err
 	}
 	return nil
 }
 
+// reconfigDeviceLocked sets wgdev's config to cfg, sending it only the
+// peers that changed since the last successful call.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) reconfigDeviceLocked(cfg *wgcfg.Config) error {
+	var err error
+	if prev := e.lastCfgDevice; prev != nil {
+		err = wgcfg.ReconfigDeviceFrom(e.wgdev, prev, cfg, e.logf)
+	} else {
+		err = wgcfg.ReconfigDevice(e.wgdev, cfg, e.logf)
+	}
+	if err != nil {
+		// wgdev may have taken part of cfg. Read its config
+		// back next time rather than guess.
+		e.lastCfgDevice = nil
+		return err
+	}
+	c := cfg.Copy()
+	e.lastCfgDevice = &c
+	return nil
+}
+
 // updateActivityMapsLocked updates the data structures used for tracking the activity
 // of wireguard peers that we might add/remove dynamically from the real config
 // as given to wireguard-go.
@@ -930,24 +1069,11 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 		panic("routerCfg must not be nil")
 	}
 
-	localAddrs := map[netaddr.IP]bool{}
-	for _, addr := range routerCfg.LocalAddrs {
-		localAddrs[addr.IP] = true
-	}
-	e.localAddrs.Store(localAddrs)
-
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
 
-	peerSet := make(map[key.Public]struct{}, len(cfg.Peers))
-	e.mu.Lock()
-	e.peerSequence = e.peerSequence[:0]
-	for _, p := range cfg.Peers {
-		e.peerSequence = append(e.peerSequence, wgkey.Key(p.PublicKey))
-		peerSet[key.Public(p.PublicKey)] = struct{}{}
-	}
-	e.mu.Unlock()
-
+	prevCfg := e.lastCfgFull
+	prevEngineSig, prevRouterSig := e.lastEngineSigFull, e.lastRouterSig
 	engineChanged := deepprint.UpdateHash(&e.lastEngineSigFull, cfg)
 	routerChanged := deepprint.UpdateHash(&e.lastRouterSig, routerCfg)
 	if !engineChanged && !routerChanged {
@@ -980,24 +1106,18 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	}
 
 	e.lastCfgFull = cfg.Copy()
-
-	// Tell magicsock about the new (or initial) private key
-	// (which is needed by DERP) before wgdev gets it, as wgdev
-	// will start trying to handshake, which we want to be able to
-	// go over DERP.
-	if err := e.magicConn.SetPrivateKey(wgkey.Private(cfg.PrivateKey)); err != nil {
-		e.logf("wgengine: Reconfig: SetPrivateKey: %v", err)
-	}
-	e.magicConn.UpdatePeers(peerSet)
+	e.setLocalAddrs(routerCfg)
+	e.setPeersLocked(cfg)
 
 	if err := e.maybeReconfigWireguardLocked(discoChanged); err != nil {
-		return err
+		return e.rollbackLocked(err, prevCfg, prevEngineSig, prevRouterSig, false)
 	}
 
 	if routerChanged {
+		var upstreams []net.Addr
 		if routerCfg.DNS.Proxied {
 			ips := routerCfg.DNS.Nameservers
-			upstreams := make([]net.Addr, len(ips))
+			upstreams = make([]net.Addr, len(ips))
 			for i, ip := range ips {
 				stdIP := ip.IPAddr()
 				upstreams[i] = &net.UDPAddr{
@@ -1013,14 +1133,93 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 		err := e.router.Set(routerCfg)
 		health.SetRouterHealth(err)
 		if err != nil {
-			return err
+			return e.rollbackLocked(err, prevCfg, prevEngineSig, prevRouterSig, true)
+		}
+		e.lastRouterCfg = routerCfg
+		if upstreams != nil {
+			e.lastDNSUpstreams = upstreams
 		}
 	}
 
+	health.SetReconfigHealth(nil)
 	e.logf("[v1] wgengine: Reconfig done")
 	return nil
 }
 
+// setLocalAddrs records the local tunnel addresses in routerCfg, or
+// none if it's nil.
+func (e *userspaceEngine) setLocalAddrs(routerCfg *router.Config) {
+	localAddrs := map[netaddr.IP]bool{}
+	if routerCfg != nil {
+		for _, addr := range routerCfg.LocalAddrs {
+			localAddrs[addr.IP] = true
+		}
+	}
+	e.localAddrs.Store(localAddrs)
+}
+
+// setPeersLocked tells magicsock about cfg's private key and peers.
+// e.wgLock must be held.
+func (e *userspaceEngine) setPeersLocked(cfg *wgcfg.Config) {
+	peerSet := make(map[key.Public]struct{}, len(cfg.Peers))
+	e.mu.Lock()
+	e.peerSequence = e.peerSequence[:0]
+	for _, p := range cfg.Peers {
+		e.peerSequence = append(e.peerSequence, wgkey.Key(p.PublicKey))
+		peerSet[key.Public(p.PublicKey)] = struct{}{}
+	}
+	e.mu.Unlock()
+
+	// Tell magicsock about the new (or initial) private key
+	// (which is needed by DERP) before wgdev gets it, as wgdev
+	// will start trying to handshake, which we want to be able to
+	// go over DERP.
+	if err := e.magicConn.SetPrivateKey(wgkey.Private(cfg.PrivateKey)); err != nil {
+		e.logf("wgengine: Reconfig: SetPrivateKey: %v", err)
+	}
+	e.magicConn.UpdatePeers(peerSet)
+}
+
+// rollbackLocked is called when Reconfig fails with err partway
+// through. Routers in particular can fail after programming some of
+// the new routes but not others, so rather than leave the system half
+// configured, rollbackLocked restores the last config that applied
+// cleanly: prevCfg, and e.lastRouterCfg if routerTouched. It restores
+// the config hashes too, so a later Reconfig with the same config
+// tries again instead of returning ErrNoChanges.
+//
+// It returns err, annotated if the rollback failed too, and reports it
+// as a health problem.
+func (e *userspaceEngine) rollbackLocked(err error, prevCfg wgcfg.Config, prevEngineSig, prevRouterSig string, routerTouched bool) error {
+	e.logf("wgengine: Reconfig: %v; rolling back to previous config", err)
+	e.lastCfgFull = prevCfg
+	e.lastEngineSigFull = prevEngineSig
+	e.lastRouterSig = prevRouterSig
+	e.setLocalAddrs(e.lastRouterCfg)
+	e.setPeersLocked(&prevCfg)
+
+	var errs []error
+	if rerr := e.maybeReconfigWireguardLocked(nil); rerr != nil {
+		errs = append(errs, fmt.Errorf("wireguard: %w", rerr))
+	}
+	if routerTouched {
+		e.resolver.SetUpstreams(e.lastDNSUpstreams)
+		// A nil lastRouterCfg means nothing was configured
+		// before, which Set(nil) restores.
+		if rerr := e.router.Set(e.lastRouterCfg); rerr != nil {
+			errs = append(errs, fmt.Errorf("router: %w", rerr))
+		}
+	}
+	if rerr := multierror.New(errs); rerr != nil {
+		e.logf("wgengine: Reconfig: rollback failed: %v", rerr)
+		err = fmt.Errorf("%w (rollback also failed: %v)", err, rerr)
+		health.SetReconfigHealth(fmt.Errorf("applying network config failed, and so did restoring the previous one: %v", err))
+		return err
+	}
+	health.SetReconfigHealth(fmt.Errorf("applying network config failed; kept the previous config: %v", err))
+	return err
+}
+
 // isSingleEndpoint reports whether endpoints contains exactly one host:port pair.
 func isSingleEndpoint(s string) bool {
 	return s != "" && !strings.Contains(s, ",")
@@ -1225,6 +1424,12 @@ func (e *userspaceEngine) Close() {
 	}
 	e.mu.Unlock()
 
+	e.wgLock.Lock()
+	if e.trimTimer != nil {
+		e.trimTimer.Stop()
+	}
+	e.wgLock.Unlock()
+
 	r := bufio.NewReader(strings.NewReader(""))
 	e.wgdev.IpcSetOperation(r)
 	e.resolver.Close()
@@ -1236,6 +1441,7 @@ func (e *userspaceEngine) Close() {
 	e.router.Close()
 	e.wgdev.Close()
 	e.tundev.Close()
+	e.unregisterIface()
 
 	// Shut down pingers after tundev is closed (by e.wgdev.Close) so the
 	// synchronous close does not get stuck on InjectOutbound.
@@ -1254,6 +1460,10 @@ func (e *userspaceEngine) GetLinkMonitor() *monitor.Mon {
 	return e.linkMon
 }
 
+func (e *userspaceEngine) GetNetnsBinding() *netns.Binding {
+	return &e.netns
+}
+
 // LinkChange signals a network change event. It's currently
 // (2021-03-03) only called on Android.
 func (e *userspaceEngine) LinkChange(_ bool) {
@@ -1271,13 +1481,17 @@ func (e *userspaceEngine) linkChange(changed bool, cur *interfaces.State) {
 	}
 
 	e.magicConn.SetNetworkUp(up)
+	e.magicConn.LinkChange(changed, cur)
+}
 
-	why := "link-change-minor"
-	if changed {
-		why = "link-change-major"
-		e.magicConn.Rebind()
+// setDefaultInterface records which interface the engine's sockets
+// bind to, so that magicsock, DERP and control connections keep using
+// the physical network when an exit node's default route is installed.
+func (e *userspaceEngine) setDefaultInterface(st *interfaces.State) {
+	if st == nil {
+		return
 	}
-	e.magicConn.ReSTUN(why)
+	e.netns.SetDefaultInterface(st.DefaultRouteInterface, st.DefaultRouteInterfaceIndex)
 }
 
 func (e *userspaceEngine) AddNetworkMapCallback(cb NetworkMapCallback) func() {
@@ -1303,6 +1517,17 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 	e.magicConn.SetDERPMap(dm)
 }
 
+func (e *userspaceEngine) SetPreferredDERP(regionID int) {
+	e.magicConn.SetPreferredDERP(regionID)
+}
+
+func (e *userspaceEngine) SetListenPort(port uint16) {
+	if port == 0 {
+		port = e.confListenPort
+	}
+	e.magicConn.SetPreferredPort(port)
+}
+
 func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.magicConn.SetNetworkMap(nm)
 	e.mu.Lock()
@@ -1367,6 +1592,68 @@ func (e *userspaceEngine) WhoIsIPPort(ipport netaddr.IPPort) (tsIP netaddr.IP, o
 	return tsIP, ok
 }
 
+func (e *userspaceEngine) DNSQueryLog() *tsdns.QueryLog {
+	return e.resolver.QueryLog()
+}
+
+func (e *userspaceEngine) DebugMagicsock() *ipnstate.MagicsockDebug {
+	return e.magicConn.DebugState()
+}
+
+func (e *userspaceEngine) DNSStatus() *ipnstate.DNSStatus {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	st := new(ipnstate.DNSStatus)
+	if rcfg := e.lastRouterCfg; rcfg != nil {
+		st.Nameservers = append(st.Nameservers, rcfg.DNS.Nameservers...)
+		st.Domains = append(st.Domains, rcfg.DNS.Domains...)
+		st.PerDomain = rcfg.DNS.PerDomain
+		st.Proxied = rcfg.DNS.Proxied
+	}
+	if st.Proxied {
+		for _, a := range e.lastDNSUpstreams {
+			st.Upstreams = append(st.Upstreams, a.String())
+		}
+		e.mu.Lock()
+		if len(st.Upstreams) == 0 && e.dnsExitNodeURL != "" {
+			st.Upstreams = append(st.Upstreams, e.dnsExitNodeURL)
+		}
+		e.mu.Unlock()
+	}
+	if err := health.DNSHealth(); err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+func (e *userspaceEngine) SetDNSExitNode(url string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	e.mu.Lock()
+	changed := url != e.dnsExitNodeURL
+	e.dnsExitNodeURL = url
+	e.mu.Unlock()
+	if changed {
+		e.resolver.SetExitNode(url, dial)
+	}
+}
+
+func (e *userspaceEngine) SetDNSAppConnectors(routes map[string]string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	e.mu.Lock()
+	changed := !reflect.DeepEqual(routes, e.dnsAppConnectors)
+	e.dnsAppConnectors = routes
+	e.mu.Unlock()
+	if changed {
+		e.resolver.SetAppConnectors(routes, dial)
+	}
+}
+
+func (e *userspaceEngine) QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	return e.resolver.Query(ctx, query)
+}
+
+func (e *userspaceEngine) InstallCaptureHook(cb capture.Callback) {
+	e.tundev.InstallCaptureHook(cb)
+}
+
 // diagnoseTUNFailure is called if tun.CreateTUN fails, to poke around
 // the system and log some diagnostic info that might help debug why
 // TUN failed. Because TUN's already failed and things the program's
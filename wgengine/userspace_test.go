@@ -6,15 +6,20 @@ package wgengine
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tstun"
 	"tailscale.com/wgengine/wgcfg"
@@ -129,6 +134,134 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+func TestMultipleUserspaceEngines(t *testing.T) {
+	var engines []Engine
+	for i := 0; i < 2; i++ {
+		e, err := NewFakeUserspaceEngine(t.Logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines = append(engines, e)
+	}
+	for i, e := range engines {
+		cfg := &wgcfg.Config{
+			Addresses: []netaddr.IPPrefix{{IP: netaddr.IPv4(100, 100, 98, byte(i+1)), Bits: 32}},
+		}
+		if err := e.Reconfig(cfg, &router.Config{}); err != nil {
+			t.Fatalf("engine %d: %v", i, err)
+		}
+	}
+	engines[0].Close()
+	if err := engines[1].Reconfig(&wgcfg.Config{}, &router.Config{}); err != nil {
+		t.Fatalf("engine 1 after closing engine 0: %v", err)
+	}
+	engines[1].Close()
+}
+
+func TestUserspaceEngineKeepalivePeersNotTrimmed(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	const discoHex = "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{
+				AllowedIPs: []netaddr.IPPrefix{
+					{IP: netaddr.IPv4(100, 100, 99, 2), Bits: 32},
+				},
+				Endpoints:           discoHex + ".disco.tailscale:12345",
+				PersistentKeepalive: 25,
+			},
+		},
+		PeerIdleTimeout: time.Minute,
+	}
+	if err := e.Reconfig(cfg, &router.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ue.trimmedDisco) != 0 {
+		t.Errorf("peer with keepalive was trimmed: %v", ue.trimmedDisco)
+	}
+	if len(ue.recvActivityAt) != 0 {
+		t.Errorf("peer with keepalive is tracked for trimming: %v", ue.recvActivityAt)
+	}
+}
+
+// failingRouter is a router.Router that records the configs it's
+// set to and fails to set any with routes in failPrefix.
+type failingRouter struct {
+	failPrefix netaddr.IPPrefix
+	sets       []*router.Config
+}
+
+func (r *failingRouter) Up() error    { return nil }
+func (r *failingRouter) Close() error { return nil }
+
+func (r *failingRouter) Set(cfg *router.Config) error {
+	r.sets = append(r.sets, cfg)
+	if cfg != nil {
+		for _, rt := range cfg.Routes {
+			if rt == r.failPrefix {
+				return errors.New("failed to add route")
+			}
+		}
+	}
+	return nil
+}
+
+func TestUserspaceEngineReconfigRollback(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+	bad := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	fr := &failingRouter{failPrefix: bad}
+	ue.router = fr
+	defer health.SetReconfigHealth(nil)
+
+	good := &router.Config{Routes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.100.99.1/32")}}
+	if err := e.Reconfig(&wgcfg.Config{}, good); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.ReconfigHealth(); err != nil {
+		t.Errorf("health after good config: %v", err)
+	}
+
+	broken := &router.Config{Routes: []netaddr.IPPrefix{bad}}
+	if err := e.Reconfig(&wgcfg.Config{}, broken); err == nil {
+		t.Fatal("Reconfig with failing router succeeded")
+	}
+	if got := fr.sets[len(fr.sets)-1]; got != good {
+		t.Errorf("router left with %v; want rollback to %v", got, good)
+	}
+	if health.ReconfigHealth() == nil {
+		t.Errorf("no health warning after rollback")
+	}
+
+	// Trying the same config again must try to apply it again,
+	// rather than be skipped as unchanged.
+	n := len(fr.sets)
+	if err := e.Reconfig(&wgcfg.Config{}, broken); err == nil || err == ErrNoChanges {
+		t.Errorf("second Reconfig = %v; want router error", err)
+	}
+	if len(fr.sets) == n {
+		t.Errorf("second Reconfig didn't call router")
+	}
+
+	fr.failPrefix = netaddr.IPPrefix{}
+	if err := e.Reconfig(&wgcfg.Config{}, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.ReconfigHealth(); err != nil {
+		t.Errorf("health after recovery: %v", err)
+	}
+}
+
 func dkFromHex(hex string) tailcfg.DiscoKey {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))
@@ -139,3 +272,63 @@ func dkFromHex(hex string) tailcfg.DiscoKey {
 	}
 	return tailcfg.DiscoKey(k)
 }
+
+func TestUserspaceEngineLinkChange(t *testing.T) {
+	mon, fake := monitor.NewFake(t.Logf, nil)
+	defer mon.Close()
+
+	var mu sync.Mutex
+	var netUp []string
+	logf := func(format string, args ...interface{}) {
+		t.Logf(format, args...)
+		msg := fmt.Sprintf(format, args...)
+		if strings.Contains(msg, "SetNetworkUp(") {
+			mu.Lock()
+			netUp = append(netUp, msg[strings.Index(msg, "SetNetworkUp("):])
+			mu.Unlock()
+		}
+	}
+	e, err := NewUserspaceEngine(logf, Config{
+		TUN:         tstun.NewFakeTUN(),
+		RouterGen:   router.NewFake,
+		LinkMonitor: mon,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if got := e.GetLinkMonitor(); got != mon {
+		t.Fatalf("GetLinkMonitor = %p; want the configured %p", got, mon)
+	}
+
+	waitNetUp := func(want ...string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			got = append(got[:0], netUp...)
+			mu.Unlock()
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		}
+		t.Fatalf("magicsock network changes = %q; want %q", got, want)
+	}
+
+	// All links going down pauses magicsock; one coming back up
+	// resumes it.
+	if err := fake.Run(5*time.Second, monitor.LinkDown("eth0")); err != nil {
+		t.Fatal(err)
+	}
+	waitNetUp("SetNetworkUp(false)")
+	if err := fake.Run(5*time.Second, monitor.AddInterface("wlan0", "10.0.0.5/24")); err != nil {
+		t.Fatal(err)
+	}
+	waitNetUp("SetNetworkUp(false)", "SetNetworkUp(true)")
+
+	// The engine doesn't own a monitor it was given.
+	e.Close()
+	if err := fake.Run(5*time.Second, monitor.LinkDown("wlan0")); err != nil {
+		t.Fatalf("monitor stopped by engine Close: %v", err)
+	}
+}
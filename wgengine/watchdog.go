@@ -5,7 +5,9 @@
 package wgengine
 
 import (
+	"context"
 	"log"
+	"net"
 	"os"
 	"runtime/pprof"
 	"strconv"
@@ -14,8 +16,10 @@ import (
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netns"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
@@ -78,6 +82,9 @@ func (e *watchdogEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config) e
 func (e *watchdogEngine) GetLinkMonitor() *monitor.Mon {
 	return e.wrap.GetLinkMonitor()
 }
+func (e *watchdogEngine) GetNetnsBinding() *netns.Binding {
+	return e.wrap.GetNetnsBinding()
+}
 func (e *watchdogEngine) GetFilter() *filter.Filter {
 	return e.wrap.GetFilter()
 }
@@ -105,6 +112,12 @@ func (e *watchdogEngine) LinkChange(isExpensive bool) {
 func (e *watchdogEngine) SetDERPMap(m *tailcfg.DERPMap) {
 	e.watchdog("SetDERPMap", func() { e.wrap.SetDERPMap(m) })
 }
+func (e *watchdogEngine) SetPreferredDERP(regionID int) {
+	e.watchdog("SetPreferredDERP", func() { e.wrap.SetPreferredDERP(regionID) })
+}
+func (e *watchdogEngine) SetListenPort(port uint16) {
+	e.watchdog("SetListenPort", func() { e.wrap.SetListenPort(port) })
+}
 func (e *watchdogEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.watchdog("SetNetworkMap", func() { e.wrap.SetNetworkMap(nm) })
 }
@@ -130,6 +143,30 @@ func (e *watchdogEngine) WhoIsIPPort(ipp netaddr.IPPort) (tsIP netaddr.IP, ok bo
 	e.watchdog("UnregisterIPPortIdentity", func() { tsIP, ok = e.wrap.WhoIsIPPort(ipp) })
 	return tsIP, ok
 }
+func (e *watchdogEngine) DNSQueryLog() *tsdns.QueryLog {
+	return e.wrap.DNSQueryLog()
+}
+func (e *watchdogEngine) DebugMagicsock() (st *ipnstate.MagicsockDebug) {
+	e.watchdog("DebugMagicsock", func() { st = e.wrap.DebugMagicsock() })
+	return st
+}
+func (e *watchdogEngine) DNSStatus() (st *ipnstate.DNSStatus) {
+	e.watchdog("DNSStatus", func() { st = e.wrap.DNSStatus() })
+	return st
+}
+func (e *watchdogEngine) SetDNSExitNode(url string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	e.watchdog("SetDNSExitNode", func() { e.wrap.SetDNSExitNode(url, dial) })
+}
+func (e *watchdogEngine) SetDNSAppConnectors(routes map[string]string, dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	e.watchdog("SetDNSAppConnectors", func() { e.wrap.SetDNSAppConnectors(routes, dial) })
+}
+func (e *watchdogEngine) QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	// Not wrapped: forwarded queries wait on upstream nameservers.
+	return e.wrap.QueryDNS(ctx, query)
+}
+func (e *watchdogEngine) InstallCaptureHook(cb capture.Callback) {
+	e.watchdog("InstallCaptureHook", func() { e.wrap.InstallCaptureHook(cb) })
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
@@ -6,6 +6,8 @@
 package wgcfg
 
 import (
+	"time"
+
 	"inet.af/netaddr"
 )
 
@@ -24,6 +26,13 @@ type Config struct {
 	MTU        uint16
 	DNS        []netaddr.IP
 	Peers      []Peer
+
+	// PeerIdleTimeout is how long a peer can be idle before wgengine
+	// removes it from WireGuard's configuration, until it's used
+	// again. Zero means wgengine's default. It's not a WireGuard
+	// setting, and peers with a PersistentKeepalive are never
+	// removed.
+	PeerIdleTimeout time.Duration
 }
 
 type Peer struct {
@@ -33,6 +42,15 @@ type Peer struct {
 	PersistentKeepalive uint16
 }
 
+// Equal reports whether peer and other are configured the same,
+// ignoring the order of their endpoints and allowed IPs.
+func (peer Peer) Equal(other Peer) bool {
+	return peer.PublicKey == other.PublicKey &&
+		peer.PersistentKeepalive == other.PersistentKeepalive &&
+		endpointsEqual(peer.Endpoints, other.Endpoints) &&
+		cidrsEqual(peer.AllowedIPs, other.AllowedIPs)
+}
+
 // Copy makes a deep copy of Config.
 // The result aliases no memory with the original.
 func (cfg Config) Copy() Config {
@@ -35,17 +35,25 @@ func DeviceConfig(d *device.Device) (*Config, error) {
 
 // ReconfigDevice replaces the existing device configuration with cfg.
 func ReconfigDevice(d *device.Device, cfg *Config, logf logger.Logf) (err error) {
+	prev, err := DeviceConfig(d)
+	if err != nil {
+		logf("wgcfg.Reconfig failed: %v", err)
+		return err
+	}
+	return ReconfigDeviceFrom(d, prev, cfg, logf)
+}
+
+// ReconfigDeviceFrom is like ReconfigDevice, but trusts the caller
+// that d's current configuration is prev rather than reading it back.
+// Only the peers that differ between prev and cfg are sent to d, so
+// the cost of a small change doesn't grow with the number of peers.
+func ReconfigDeviceFrom(d *device.Device, prev, cfg *Config, logf logger.Logf) (err error) {
 	defer func() {
 		if err != nil {
 			logf("wgcfg.Reconfig failed: %v", err)
 		}
 	}()
 
-	prev, err := DeviceConfig(d)
-	if err != nil {
-		return err
-	}
-
 	r, w := io.Pipe()
 	errc := make(chan error)
 	go func() {
@@ -204,6 +204,49 @@ func TestDeviceConfig(t *testing.T) {
 			t.Error("reconfig failed to remove peer")
 		}
 	})
+
+	t.Run("device1 reconfig from known config", func(t *testing.T) {
+		prev := cfg1.Copy()
+		cfg1.Peers[0].Endpoints = "2.2.2.2:222"
+		if err := ReconfigDeviceFrom(device1, &prev, cfg1, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, device1, cfg1)
+	})
+}
+
+func TestToUAPIOnlyChanges(t *testing.T) {
+	key := func(b byte) Key {
+		var k Key
+		k[0] = b
+		return k
+	}
+	peer := func(b byte, ep string) Peer {
+		return Peer{
+			PublicKey:  key(b),
+			AllowedIPs: []netaddr.IPPrefix{{IP: netaddr.IPv4(100, 64, 0, b), Bits: 32}},
+			Endpoints:  ep,
+		}
+	}
+	prev := &Config{Peers: []Peer{peer(1, "1.1.1.1:1"), peer(2, "2.2.2.2:2"), peer(3, "3.3.3.3:3")}}
+	cfg := &Config{Peers: []Peer{peer(1, "1.1.1.1:1"), peer(2, "2.2.2.2:22"), peer(4, "4.4.4.4:4")}}
+
+	var buf strings.Builder
+	if err := cfg.ToUAPI(&buf, prev); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, k := range []Key{key(2), key(3), key(4)} {
+		if !strings.Contains(got, "public_key="+k.HexString()+"\n") {
+			t.Errorf("peer %s not written; got:\n%s", k.ShortString(), got)
+		}
+	}
+	if strings.Contains(got, key(1).HexString()) {
+		t.Errorf("unchanged peer written; got:\n%s", got)
+	}
+	if !strings.Contains(got, "replace_allowed_ips") {
+		t.Errorf("new peer's allowed IPs not written; got:\n%s", got)
+	}
 }
 
 // TODO: replace with a loopback tunnel
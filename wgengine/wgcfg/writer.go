@@ -49,9 +49,12 @@ func (cfg *Config) ToUAPI(w io.Writer, prev *Config) error {
 		old[p.PublicKey] = p
 	}
 
-	// Add/configure all new peers.
+	// Add/configure all new and changed peers.
 	for _, p := range cfg.Peers {
-		oldPeer := old[p.PublicKey]
+		oldPeer, existed := old[p.PublicKey]
+		if existed && oldPeer.Equal(p) {
+			continue
+		}
 		setPeer(p)
 		set("protocol_version", "1")
 
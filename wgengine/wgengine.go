@@ -5,12 +5,16 @@
 package wgengine
 
 import (
+	"context"
 	"errors"
+	"net"
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netns"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
@@ -68,6 +72,36 @@ type Engine interface {
 	// SetDNSMap updates the DNS map.
 	SetDNSMap(*tsdns.Map)
 
+	// DNSQueryLog returns the MagicDNS resolver's query log.
+	DNSQueryLog() *tsdns.QueryLog
+
+	// DebugMagicsock returns magicsock's path discovery state, for
+	// bug reports.
+	DebugMagicsock() *ipnstate.MagicsockDebug
+
+	// DNSStatus returns the DNS configuration last applied to the OS
+	// and the MagicDNS resolver. The caller fills in the fields that
+	// come from prefs and the netmap.
+	DNSStatus() *ipnstate.DNSStatus
+
+	// SetDNSExitNode sets the exit node's DNS-over-HTTP peer API
+	// endpoint, to which the MagicDNS resolver forwards queries when
+	// it has no upstream nameservers, and the func it dials the exit
+	// node with, or nil to dial with the OS. The empty url means
+	// there's no exit node.
+	SetDNSExitNode(url string, dial func(ctx context.Context, addr string) (net.Conn, error))
+
+	// SetDNSAppConnectors sets the DNS-over-HTTP peer API endpoints
+	// of app connectors, by the domains they route, to which the
+	// MagicDNS resolver forwards queries for those domains. dial is
+	// as for SetDNSExitNode.
+	SetDNSAppConnectors(routes map[string]string, dial func(ctx context.Context, addr string) (net.Conn, error))
+
+	// QueryDNS answers the DNS query message with the MagicDNS
+	// resolver, as if it had been sent to the resolver's IP, and
+	// returns the response message.
+	QueryDNS(ctx context.Context, query []byte) ([]byte, error)
+
 	// SetStatusCallback sets the function to call when the
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
@@ -75,6 +109,11 @@ type Engine interface {
 	// GetLinkMonitor returns the link monitor.
 	GetLinkMonitor() *monitor.Mon
 
+	// GetNetnsBinding returns the interface binding that the
+	// engine's sockets use, for other clients of the same network,
+	// such as the control client, to use too.
+	GetNetnsBinding() *netns.Binding
+
 	// RequestStatus requests a WireGuard status update right
 	// away, sent to the callback registered via SetStatusCallback.
 	RequestStatus()
@@ -109,6 +148,15 @@ type Engine interface {
 	// is configured.
 	SetDERPMap(*tailcfg.DERPMap)
 
+	// SetPreferredDERP sets the DERP region to use as home whenever
+	// it's reachable, or 0 to pick the one with the lowest latency.
+	SetPreferredDERP(regionID int)
+
+	// SetListenPort sets the UDP port to listen on for WireGuard
+	// and peer-to-peer traffic. Zero means the port the engine was
+	// created with.
+	SetListenPort(uint16)
+
 	// SetNetworkMap informs the engine of the latest network map
 	// from the server. The network map's DERPMap field should be
 	// ignored as as it might be disabled; get it from SetDERPMap
@@ -150,4 +198,9 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// InstallCaptureHook sets the func called with each packet
+	// going through the TUN device, for debug packet capture, or
+	// removes it if nil.
+	InstallCaptureHook(capture.Callback)
 }